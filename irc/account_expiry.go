@@ -0,0 +1,229 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/oragono/oragono/irc/custime"
+	"github.com/oragono/oragono/irc/sno"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	// keyAccountLastSeen is the last time the account was logged into or had a client
+	// disconnect, as a unix timestamp.
+	keyAccountLastSeen = "account.lastseen %s"
+	// keyAccountExpiryWarned is set once we've warned the account that it's about to expire.
+	keyAccountExpiryWarned = "account.expirywarned %s"
+
+	// accountExpiryCheckInterval is how often we look for accounts to expire.
+	accountExpiryCheckInterval = time.Hour
+)
+
+// AccountExpiryConfig controls dropping accounts that haven't been used in a while, so their
+// names can be registered again.
+type AccountExpiryConfig struct {
+	Enabled bool
+	// Duration is how long an account can go unused before it's dropped.
+	DurationString string        `yaml:"duration"`
+	Duration       time.Duration `yaml:"duration-real"`
+	// Warning is how long before an account is dropped that we email its owner about it.
+	WarningString string        `yaml:"warning"`
+	Warning       time.Duration `yaml:"warning-real"`
+}
+
+// load checks the config and parses the durations.
+func (conf *AccountExpiryConfig) load() (err error) {
+	if !conf.Enabled {
+		return nil
+	}
+	conf.Duration, err = custime.ParseDuration(conf.DurationString)
+	if err != nil || conf.Duration <= 0 {
+		return errors.New("duration must be set, like 180d")
+	}
+	if conf.WarningString != "" {
+		conf.Warning, err = custime.ParseDuration(conf.WarningString)
+		if err != nil {
+			return fmt.Errorf("Could not parse warning: %s", err.Error())
+		}
+		if conf.Duration <= conf.Warning {
+			return errors.New("warning must be shorter than duration")
+		}
+	}
+	return nil
+}
+
+// setAccountLastSeen records that the account has just been used.
+func (server *Server) setAccountLastSeen(accountName string) {
+	accountKey, err := CasefoldName(accountName)
+	if err != nil || server.isReadOnly() {
+		return
+	}
+	server.store.Update(func(tx *buntdb.Tx) error {
+		tx.Set(fmt.Sprintf(keyAccountLastSeen, accountKey), strconv.FormatInt(time.Now().Unix(), 10), nil)
+		tx.Delete(fmt.Sprintf(keyAccountExpiryWarned, accountKey))
+		return nil
+	})
+}
+
+// checkAccountExpiry starts a sweep for expired accounts, if account expiry is on and a sweep
+// isn't running already.
+func (server *Server) checkAccountExpiry() {
+	server.accountExpiryMutex.Lock()
+	defer server.accountExpiryMutex.Unlock()
+	if !server.accountExpiry.Enabled || server.accountExpiryRunning || server.isReadOnly() {
+		return
+	}
+	server.accountExpiryRunning = true
+
+	go func() {
+		server.expireAccounts(time.Now())
+		server.accountExpiryMutex.Lock()
+		server.accountExpiryRunning = false
+		server.accountExpiryMutex.Unlock()
+	}()
+}
+
+// expiryWarning is an account that's about to expire, and where to warn them.
+type expiryWarning struct {
+	name  string
+	email string
+	left  time.Duration
+}
+
+// expiryWarningTime says how long an account has left before it's dropped, in days. Part
+// of a day counts as a whole one, so accounts aren't told they have 0 days left.
+func expiryWarningTime(left time.Duration) string {
+	day := 24 * time.Hour
+	if left < day {
+		return "less than a day"
+	}
+	days := int((left + day - 1) / day)
+	if days == 1 {
+		return "1 day"
+	}
+	return fmt.Sprintf("%d days", days)
+}
+
+// expireAccounts drops the accounts that haven't been used within the expiry duration, and
+// the ones that were never verified, and warns the ones that are about to expire.
+func (server *Server) expireAccounts(now time.Time) {
+	// a rehash can change the config while we're running
+	server.accountExpiryMutex.Lock()
+	config := server.accountExpiry
+	server.accountExpiryMutex.Unlock()
+	verifyTimeout := server.accountRegistration.VerifyTimeout
+
+	// accounts with clients connected are in use, however long they've been connected for
+	online := make(map[string]bool)
+	server.clients.ByNickMutex.RLock()
+	for _, client := range server.clients.ByNick {
+		if client.account != &NoAccount {
+			accountKey, err := CasefoldName(client.account.Name)
+			if err == nil {
+				online[accountKey] = true
+			}
+		}
+	}
+	server.clients.ByNickMutex.RUnlock()
+
+	var droppedKeys, dropped, unverified []string
+	var warnings []expiryWarning
+	var successions []channelSuccession
+	server.registeredChannelsMutex.Lock()
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		var accountKeys []string
+		existsPrefix := strings.TrimSuffix(keyAccountExists, "%s")
+		tx.AscendKeys(existsPrefix+"*", func(key, value string) bool {
+			accountKeys = append(accountKeys, strings.TrimPrefix(key, existsPrefix))
+			return true
+		})
+
+		for _, accountKey := range accountKeys {
+			lastSeenKey := fmt.Sprintf(keyAccountLastSeen, accountKey)
+			warnedKey := fmt.Sprintf(keyAccountExpiryWarned, accountKey)
+			name, _ := tx.Get(fmt.Sprintf(keyAccountName, accountKey))
+
+			if _, err := tx.Get(fmt.Sprintf(keyAccountVerified, accountKey)); err == buntdb.ErrNotFound {
+				// unverified accounts are only kept until their verification code expires
+				regTime, _ := tx.Get(fmt.Sprintf(keyAccountRegTime, accountKey))
+				regTimeInt, _ := strconv.ParseInt(regTime, 10, 64)
+				if 0 < verifyTimeout && now.Sub(time.Unix(regTimeInt, 0)) > verifyTimeout {
+					unverified = append(unverified, name)
+					droppedKeys = append(droppedKeys, accountKey)
+					dropAccount(tx, accountKey)
+				}
+				continue
+			}
+
+			if online[accountKey] {
+				tx.Set(lastSeenKey, strconv.FormatInt(now.Unix(), 10), nil)
+				tx.Delete(warnedKey)
+				continue
+			}
+			lastSeen, err := tx.Get(lastSeenKey)
+			if err == buntdb.ErrNotFound {
+				// accounts from before we tracked this start counting from now
+				tx.Set(lastSeenKey, strconv.FormatInt(now.Unix(), 10), nil)
+				continue
+			}
+			lastSeenInt, _ := strconv.ParseInt(lastSeen, 10, 64)
+			unused := now.Sub(time.Unix(lastSeenInt, 0))
+			if config.Duration <= unused {
+				dropped = append(dropped, name)
+				droppedKeys = append(droppedKeys, accountKey)
+				successions = append(successions, server.handOverChannelsNoMutex(tx, accountKey)...)
+				dropAccount(tx, accountKey)
+			} else if 0 < config.Warning && config.Duration-config.Warning <= unused {
+				if _, err := tx.Get(warnedKey); err == buntdb.ErrNotFound {
+					tx.Set(warnedKey, "1", nil)
+					email, _ := tx.Get(fmt.Sprintf(keyAccountEmail, accountKey))
+					if email != "" {
+						warnings = append(warnings, expiryWarning{name, email, config.Duration - unused})
+					}
+				}
+			}
+		}
+		return nil
+	})
+	server.registeredChannelsMutex.Unlock()
+	if err != nil {
+		server.logger.Error("accounts", fmt.Sprintf("Could not check for expired accounts: %s", err.Error()))
+		return
+	}
+
+	for _, accountKey := range droppedKeys {
+		server.forgetAccount(accountKey)
+	}
+	for _, name := range unverified {
+		server.logger.Info("accounts", fmt.Sprintf("Account %s dropped, it was never verified", name))
+	}
+	for _, name := range dropped {
+		server.logger.Info("accounts", fmt.Sprintf("Account %s dropped, it hasn't been used in %s", name, config.DurationString))
+		server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Account expired $c[grey][$r%s$c[grey]]"), name))
+	}
+	server.announceChannelSuccessions(successions)
+
+	mailto := server.mailto
+	if !mailto.Enabled() {
+		return
+	}
+	for _, warning := range warnings {
+		data := emailData{
+			NetworkName: server.networkName,
+			Account:     warning.name,
+			Expiry:      expiryWarningTime(warning.left),
+		}
+		err := mailto.sendTemplate(warning.email, mailto.expiryTemplate, data)
+		if err != nil {
+			server.logger.Error("accounts", fmt.Sprintf("Could not send expiry warning for account %s: %s", warning.name, err.Error()))
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/oragono/oragono/irc/logger"
+	"github.com/tidwall/buntdb"
+)
+
+func TestAccountExpiryConfig(t *testing.T) {
+	for _, c := range []struct {
+		conf  AccountExpiryConfig
+		valid bool
+	}{
+		{AccountExpiryConfig{}, true},
+		{AccountExpiryConfig{Enabled: true, DurationString: "180d", WarningString: "7d"}, true},
+		{AccountExpiryConfig{Enabled: true, DurationString: "180d"}, true},
+		{AccountExpiryConfig{Enabled: true}, false},
+		{AccountExpiryConfig{Enabled: true, DurationString: "forever"}, false},
+		{AccountExpiryConfig{Enabled: true, DurationString: "7d", WarningString: "7d"}, false},
+	} {
+		if err := c.conf.load(); (err == nil) != c.valid {
+			t.Errorf("%+v: expected valid %v, got %v", c.conf, c.valid, err)
+		}
+	}
+}
+
+func TestExpireAccounts(t *testing.T) {
+	now := time.Now()
+	daysAgo := func(days int) string {
+		return strconv.FormatInt(now.Add(-time.Duration(days)*24*time.Hour).Unix(), 10)
+	}
+
+	server := newAccountsTestServer(t)
+	server.logger, _ = logger.NewManager()
+	server.snomasks = NewSnoManager()
+	server.clients = NewClientLookupSet()
+	server.registeredChannels = make(map[string]*RegisteredChannel)
+	server.accountRegistration = &AccountRegistration{VerifyTimeout: 24 * time.Hour}
+	server.accountExpiry = AccountExpiryConfig{Enabled: true, DurationString: "90d", WarningString: "7d"}
+	if err := server.accountExpiry.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	server.store.Update(func(tx *buntdb.Tx) error {
+		for name, lastSeen := range map[string]string{
+			"old":    daysAgo(100),
+			"warned": daysAgo(85),
+			"fresh":  daysAgo(1),
+			"legacy": "",
+			"online": daysAgo(200),
+		} {
+			createVerifiedAccount(tx, name, name, &AccountCredentials{})
+			if lastSeen != "" {
+				tx.Set(fmt.Sprintf(keyAccountLastSeen, name), lastSeen, nil)
+			}
+		}
+		tx.Set(fmt.Sprintf(keyAccountEmail, "warned"), "warned@example.com", nil)
+
+		// unverified accounts only have until their verification code expires
+		for name, regTime := range map[string]string{"pending": daysAgo(2), "new": strconv.FormatInt(now.Unix(), 10)} {
+			tx.Set(fmt.Sprintf(keyAccountExists, name), "1", nil)
+			tx.Set(fmt.Sprintf(keyAccountName, name), name, nil)
+			tx.Set(fmt.Sprintf(keyAccountRegTime, name), regTime, nil)
+		}
+		return nil
+	})
+	server.clients.ByNick["online"] = &Client{account: &ClientAccount{Name: "online"}}
+
+	server.expireAccounts(now)
+
+	server.store.View(func(tx *buntdb.Tx) error {
+		for _, c := range []struct {
+			name   string
+			exists bool
+			warned bool
+		}{
+			{"old", false, false},
+			{"warned", true, true},
+			{"fresh", true, false},
+			{"legacy", true, false},
+			{"online", true, false},
+			{"pending", false, false},
+			{"new", true, false},
+		} {
+			_, err := tx.Get(fmt.Sprintf(keyAccountExists, c.name))
+			if exists := err == nil; exists != c.exists {
+				t.Errorf("%s: expected exists to be %v, got %v", c.name, c.exists, exists)
+			}
+			_, err = tx.Get(fmt.Sprintf(keyAccountExpiryWarned, c.name))
+			if warned := err == nil; warned != c.warned {
+				t.Errorf("%s: expected warned to be %v, got %v", c.name, c.warned, warned)
+			}
+		}
+
+		// accounts in use, and ones from before we tracked this, count from now
+		for _, name := range []string{"legacy", "online"} {
+			lastSeen, _ := tx.Get(fmt.Sprintf(keyAccountLastSeen, name))
+			if lastSeen != strconv.FormatInt(now.Unix(), 10) {
+				t.Errorf("%s: expected last seen to be now, got %q", name, lastSeen)
+			}
+		}
+		return nil
+	})
+}
+
+func TestExpiryWarningTime(t *testing.T) {
+	for _, c := range []struct {
+		left     time.Duration
+		expected string
+	}{
+		{time.Hour, "less than a day"},
+		{24 * time.Hour, "1 day"},
+		{36 * time.Hour, "2 days"},
+		{7 * 24 * time.Hour, "7 days"},
+	} {
+		if text := expiryWarningTime(c.left); text != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.left, c.expected, text)
+		}
+	}
+}
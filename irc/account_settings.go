@@ -0,0 +1,248 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	// keyAccountSettings holds the account's settings, as a JSON object.
+	keyAccountSettings = "account.settings %s"
+
+	// AccountSettingLanguage is the language the account's user would like to be spoken to in.
+	AccountSettingLanguage = "language"
+	// AccountSettingAutoreplayLines is how many lines of history are replayed when joining a channel.
+	AccountSettingAutoreplayLines = "autoreplay-lines"
+	// AccountSettingPrivateInfo hides the account's details in NickServ INFO from everyone but opers.
+	AccountSettingPrivateInfo = "private-info"
+)
+
+var (
+	errUnknownAccountSetting = errors.New("Unknown setting")
+
+	languageCodeRegex = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+)
+
+// AccountSetting is a preference that's stored for each account.
+type AccountSetting struct {
+	Name string
+	// Description is what the setting does, shown in NickServ GET.
+	Description string
+	// Default is the value the setting has if the account hasn't changed it.
+	Default string
+	// Parse checks a new value for the setting, and returns it the way it should be stored.
+	Parse func(value string) (string, error)
+}
+
+// accountSettings are the settings accounts can change.
+var accountSettings = map[string]AccountSetting{
+	AccountSettingLanguage: {
+		Name:        AccountSettingLanguage,
+		Description: "The language you'd like to use, as a code like en or pt-br",
+		Parse: func(value string) (string, error) {
+			value = strings.ToLower(value)
+			if !languageCodeRegex.MatchString(value) {
+				return "", errors.New("Language must be a code like en or pt-br")
+			}
+			return value, nil
+		},
+	},
+	AccountSettingAutoreplayLines: {
+		Name:        AccountSettingAutoreplayLines,
+		Description: "How many lines of history you're sent when you join a channel",
+		Default:     "0",
+		Parse: func(value string) (string, error) {
+			lines, err := strconv.Atoi(value)
+			if err != nil || lines < 0 || maxHistoryReplay < lines {
+				return "", fmt.Errorf("Lines must be a number from 0 to %d", maxHistoryReplay)
+			}
+			return strconv.Itoa(lines), nil
+		},
+	},
+	AccountSettingPrivateInfo: {
+		Name:        AccountSettingPrivateInfo,
+		Description: "Whether NickServ INFO hides your account's details from other users",
+		Default:     "off",
+		Parse:       parseOnOffSetting,
+	},
+}
+
+// parseOnOffSetting parses a setting that can be turned on or off.
+func parseOnOffSetting(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "on", "true", "yes":
+		return "on", nil
+	case "off", "false", "no":
+		return "off", nil
+	}
+	return "", errors.New("Setting must be ON or OFF")
+}
+
+// loadAccountSettings loads the settings the account has changed from the store.
+func loadAccountSettings(tx *buntdb.Tx, accountKey string) map[string]string {
+	settings := make(map[string]string)
+	settingsText, err := tx.Get(fmt.Sprintf(keyAccountSettings, accountKey))
+	if err == nil {
+		json.Unmarshal([]byte(settingsText), &settings)
+	}
+	return settings
+}
+
+// Setting returns the value of the given account setting.
+func (account *ClientAccount) Setting(name string) string {
+	if value, exists := account.Settings[name]; exists {
+		return value
+	}
+	return accountSettings[name].Default
+}
+
+// SettingInt returns the value of the given numeric account setting.
+func (account *ClientAccount) SettingInt(name string) int {
+	value, _ := strconv.Atoi(account.Setting(name))
+	return value
+}
+
+// SettingOn returns true if the given on/off account setting is on.
+func (account *ClientAccount) SettingOn(name string) bool {
+	return account.Setting(name) == "on"
+}
+
+// setAccountSetting changes one of the account's settings, or resets it to the default if
+// the value is empty. It returns the value that was stored.
+func (server *Server) setAccountSetting(account *ClientAccount, name, value string) (string, error) {
+	setting, known := accountSettings[name]
+	if !known {
+		return "", errUnknownAccountSetting
+	}
+	if value != "" {
+		var err error
+		value, err = setting.Parse(value)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	settings := make(map[string]string)
+	for settingName, settingValue := range account.Settings {
+		settings[settingName] = settingValue
+	}
+	if value == "" || value == setting.Default {
+		delete(settings, name)
+	} else {
+		settings[name] = value
+	}
+
+	accountKey, _ := CasefoldName(account.Name)
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		key := fmt.Sprintf(keyAccountSettings, accountKey)
+		if len(settings) == 0 {
+			_, err := tx.Delete(key)
+			if err == buntdb.ErrNotFound {
+				err = nil
+			}
+			return err
+		}
+		settingsText, err := json.Marshal(settings)
+		if err != nil {
+			return err
+		}
+		_, _, err = tx.Set(key, string(settingsText), nil)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	account.Settings = settings
+	return account.Setting(name), nil
+}
+
+// nickservSetSetting handles NickServ SET for the account settings.
+//
+// SET <setting> <value|DEFAULT>
+func (server *Server) nickservSetSetting(client *Client, name string, params []string, rb *ResponseBuffer) {
+	if client.account == &NoAccount {
+		rb.NickServNotice("You must be logged into an account to change its settings")
+		return
+	}
+	name = strings.ToLower(name)
+	setting, known := accountSettings[name]
+	if !known {
+		rb.NickServNotice(fmt.Sprintf("Unknown setting %s, see /NS GET for the list", strings.ToUpper(name)))
+		return
+	}
+	if len(params) < 1 {
+		rb.NickServNotice(fmt.Sprintf("Syntax: SET %s <value|DEFAULT>", strings.ToUpper(name)))
+		return
+	}
+
+	value := strings.Join(params, " ")
+	reset := strings.ToLower(value) == "default"
+	if reset {
+		value = ""
+	} else if _, err := setting.Parse(value); err != nil {
+		rb.NickServNotice(err.Error())
+		return
+	}
+	if !server.checkWritable(client, "NICKSERV", rb) {
+		return
+	}
+
+	value, err := server.setAccountSetting(client.account, name, value)
+	if err != nil {
+		rb.NickServNotice("Could not save setting")
+		server.logger.Error("internal", fmt.Sprintf("Could not save %s setting for account %s: %s", name, client.account.Name, err.Error()))
+		return
+	}
+	if reset {
+		rb.NickServNotice(fmt.Sprintf("%s has been reset to the default", strings.ToUpper(name)))
+	} else {
+		rb.NickServNotice(fmt.Sprintf("%s is now %s", strings.ToUpper(name), value))
+	}
+}
+
+// nickservGet handles NickServ GET, which shows the settings of the account the client is
+// logged into.
+//
+// GET [<setting>]
+func (server *Server) nickservGet(client *Client, params []string, rb *ResponseBuffer) {
+	if client.account == &NoAccount {
+		rb.NickServNotice("You must be logged into an account to see its settings")
+		return
+	}
+
+	var names []string
+	if 0 < len(params) {
+		name := strings.ToLower(params[0])
+		if _, known := accountSettings[name]; !known {
+			rb.NickServNotice(fmt.Sprintf("Unknown setting %s", strings.ToUpper(name)))
+			return
+		}
+		names = append(names, name)
+	} else {
+		for name := range accountSettings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+		value := client.account.Setting(name)
+		if value == "" {
+			value = "(not set)"
+		}
+		if _, changed := client.account.Settings[name]; !changed {
+			value += " (default)"
+		}
+		rb.NickServNotice(fmt.Sprintf("%s: %s - %s", strings.ToUpper(name), value, accountSettings[name].Description))
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	// AccountStatusIdentified means the user is logged into the account that owns their nick.
+	AccountStatusIdentified = "identified"
+	// AccountStatusLoggedIn means the user is logged in, but their nick belongs to another
+	// account or isn't registered.
+	AccountStatusLoggedIn = "loggedin"
+	// AccountStatusRegistered means the user isn't logged in, and their nick belongs to an
+	// account.
+	AccountStatusRegistered = "registered"
+	// AccountStatusNone means the user isn't logged in, and their nick isn't registered.
+	AccountStatusNone = "none"
+)
+
+// nickIsRegistered returns true if the given casefolded nickname belongs to a verified
+// account, either as its name or one of its grouped nicknames.
+func (server *Server) nickIsRegistered(nickname string) bool {
+	var registered bool
+	server.store.View(func(tx *buntdb.Tx) error {
+		_, err := tx.Get(fmt.Sprintf(keyAccountVerified, nickAccount(tx, nickname)))
+		registered = err == nil
+		return nil
+	})
+	return registered
+}
+
+// accountStatus returns the account the target is logged into (or "*") and their status.
+func (target *Client) accountStatus() (account, status string) {
+	if target.account != &NoAccount {
+		if target.ownsNick(target.nickCasefolded) {
+			return target.account.Name, AccountStatusIdentified
+		}
+		return target.account.Name, AccountStatusLoggedIn
+	}
+	if target.server.nickIsRegistered(target.nickCasefolded) {
+		return "*", AccountStatusRegistered
+	}
+	return "*", AccountStatusNone
+}
+
+// ACCOUNTSTATUS <nickname>{,<nickname>}
+func accountStatusHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	if !server.allowAccountStatus(client) {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "ACCOUNTSTATUS", "You're looking up accounts too quickly, try again later")
+		return false
+	}
+
+	for _, nickname := range client.limitTargets("ACCOUNTSTATUS", strings.Split(msg.Params[0], ","), rb) {
+		casefoldedNickname, err := CasefoldName(nickname)
+		target := server.clients.Get(casefoldedNickname)
+		if err != nil || target == nil {
+			rb.Send(nil, server.name, ERR_NOSUCHNICK, client.nick, nickname, "No such nick")
+			continue
+		}
+		account, status := target.accountStatus()
+		rb.Send(nil, server.name, RPL_ACCOUNTSTATUS, client.nick, target.nick, account, status)
+	}
+	rb.Send(nil, server.name, RPL_ENDOFACCOUNTSTATUS, client.nick, msg.Params[0], "End of ACCOUNTSTATUS")
+	return false
+}
@@ -4,6 +4,7 @@
 package irc
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -18,6 +19,14 @@ import (
 	"github.com/tidwall/buntdb"
 )
 
+const (
+	// keyAccountVerificationCode holds the hash of the code emailed to verify a new account,
+	// and expires along with it.
+	keyAccountVerificationCode = "account.verificationcode %s"
+
+	defaultVerifyTimeout = 120 * time.Hour
+)
+
 var (
 	errAccountCreation     = errors.New("Account could not be created")
 	errCertfpAlreadyExists = errors.New("An account already exists with your certificate")
@@ -28,6 +37,7 @@ type AccountRegistration struct {
 	Enabled                bool
 	EnabledCallbacks       []string
 	EnabledCredentialTypes []string
+	VerifyTimeout          time.Duration
 }
 
 // AccountCredentials stores the various methods for verifying accounts.
@@ -35,12 +45,21 @@ type AccountCredentials struct {
 	PassphraseSalt []byte
 	PassphraseHash []byte
 	Certificate    string // fingerprint
+	// Certificates holds any fingerprints added after the first one.
+	Certificates []string
+	// SCRAMSHA256 is set when the passphrase is, so clients can log in with SCRAM-SHA-256.
+	SCRAMSHA256 *ScramCredentials
+	// LegacyHash is a hash of the passphrase imported from other services, in one of the
+	// formats checkLegacyHash supports. It's replaced with our own hash the first time the
+	// account logs in with its passphrase.
+	LegacyHash string `json:",omitempty"`
 }
 
 // NewAccountRegistration returns a new AccountRegistration, configured correctly.
 func NewAccountRegistration(config AccountRegistrationConfig) (accountReg AccountRegistration) {
 	if config.Enabled {
 		accountReg.Enabled = true
+		accountReg.VerifyTimeout = config.VerifyTimeout
 		for _, name := range config.EnabledCallbacks {
 			// we store "none" as "*" internally
 			if name == "none" {
@@ -58,15 +77,21 @@ func NewAccountRegistration(config AccountRegistrationConfig) (accountReg Accoun
 }
 
 // accHandler parses the ACC command.
-func accHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func accHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	subcommand := strings.ToLower(msg.Params[0])
 
 	if subcommand == "register" {
-		return accRegisterHandler(server, client, msg)
+		if !server.checkWritable(client, "ACC", rb) {
+			return false
+		}
+		return accRegisterHandler(server, client, msg, rb)
 	} else if subcommand == "verify" {
-		client.Notice("VERIFY is not yet implemented")
+		if !server.checkWritable(client, "ACC", rb) {
+			return false
+		}
+		return accVerifyHandler(server, client, msg, rb)
 	} else {
-		client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "ACC", msg.Params[0], "Unknown subcommand")
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "ACC", msg.Params[0], "Unknown subcommand")
 	}
 
 	return false
@@ -84,11 +109,31 @@ func removeFailedAccRegisterData(store *buntdb.DB, account string) {
 	})
 }
 
+// createPasswordlessAccount creates a verified account with no credentials, for accounts
+// that are logged into through an external service like LDAP.
+func createPasswordlessAccount(tx *buntdb.Tx, accountKey, accountName string) error {
+	return createVerifiedAccount(tx, accountKey, accountName, &AccountCredentials{})
+}
+
+// createVerifiedAccount creates a verified account with the given credentials.
+func createVerifiedAccount(tx *buntdb.Tx, accountKey, accountName string, creds *AccountCredentials) error {
+	credText, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	tx.Set(fmt.Sprintf(keyAccountExists, accountKey), "1", nil)
+	tx.Set(fmt.Sprintf(keyAccountName, accountKey), accountName, nil)
+	tx.Set(fmt.Sprintf(keyAccountRegTime, accountKey), strconv.FormatInt(time.Now().Unix(), 10), nil)
+	tx.Set(fmt.Sprintf(keyAccountCredentials, accountKey), string(credText), nil)
+	tx.Set(fmt.Sprintf(keyAccountVerified, accountKey), "1", nil)
+	return nil
+}
+
 // accRegisterHandler parses the ACC REGISTER command.
-func accRegisterHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func accRegisterHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	// make sure reg is enabled
 	if !server.accountRegistration.Enabled {
-		client.Send(nil, server.name, ERR_REG_UNSPECIFIED_ERROR, client.nick, "*", "Account registration is disabled")
+		rb.Send(nil, server.name, ERR_REG_UNSPECIFIED_ERROR, client.nick, "*", "Account registration is disabled")
 		return false
 	}
 
@@ -97,7 +142,12 @@ func accRegisterHandler(server *Server, client *Client, msg ircmsg.IrcMessage) b
 	casefoldedAccount, err := CasefoldName(account)
 	// probably don't need explicit check for "*" here... but let's do it anyway just to make sure
 	if err != nil || msg.Params[1] == "*" {
-		client.Send(nil, server.name, ERR_REG_UNSPECIFIED_ERROR, client.nick, account, "Account name is not valid")
+		rb.Send(nil, server.name, ERR_REG_UNSPECIFIED_ERROR, client.nick, account, "Account name is not valid")
+		return false
+	}
+
+	if !server.allowRegistration(client) {
+		rb.Send(nil, server.name, ERR_REG_UNSPECIFIED_ERROR, client.nick, account, "Too many accounts have been registered from your address recently, try again later")
 		return false
 	}
 
@@ -106,10 +156,9 @@ func accRegisterHandler(server *Server, client *Client, msg ircmsg.IrcMessage) b
 	err = server.store.Update(func(tx *buntdb.Tx) error {
 		accountKey := fmt.Sprintf(keyAccountExists, casefoldedAccount)
 
-		_, err := tx.Get(accountKey)
-		if err != buntdb.ErrNotFound {
-			//TODO(dan): if account verified key doesn't exist account is not verified, calc the maximum time without verification and expire and continue if need be
-			client.Send(nil, server.name, ERR_ACCOUNT_ALREADY_EXISTS, client.nick, account, "Account already exists")
+		if accountNameTaken(tx, casefoldedAccount) {
+			// unverified accounts are dropped once verify-timeout has passed, freeing the name
+			rb.Send(nil, server.name, ERR_ACCOUNT_ALREADY_EXISTS, client.nick, account, "Account already exists")
 			return errAccountCreation
 		}
 
@@ -124,7 +173,7 @@ func accRegisterHandler(server *Server, client *Client, msg ircmsg.IrcMessage) b
 	// account could not be created and relevant numerics have been dispatched, abort
 	if err != nil {
 		if err != errAccountCreation {
-			client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "ACC", "REGISTER", "Could not register")
+			rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "ACC", "REGISTER", "Could not register")
 			log.Println("Could not save registration initial data:", err.Error())
 		}
 		return false
@@ -136,6 +185,9 @@ func accRegisterHandler(server *Server, client *Client, msg ircmsg.IrcMessage) b
 
 	if callback == "*" {
 		callbackNamespace = "*"
+	} else if callback == "captcha" {
+		// there's nothing to send a captcha to, so it doesn't need a value
+		callbackNamespace = "captcha"
 	} else if strings.Contains(callback, ":") {
 		callbackValues := strings.SplitN(callback, ":", 2)
 		callbackNamespace, callbackValue = callbackValues[0], callbackValues[1]
@@ -154,10 +206,41 @@ func accRegisterHandler(server *Server, client *Client, msg ircmsg.IrcMessage) b
 	}
 
 	if !callbackValid {
-		client.Send(nil, server.name, ERR_REG_INVALID_CALLBACK, client.nick, account, callbackNamespace, "Callback namespace is not supported")
+		rb.Send(nil, server.name, ERR_REG_INVALID_CALLBACK, client.nick, account, callbackNamespace, "Callback namespace is not supported")
 		removeFailedAccRegisterData(server.store, casefoldedAccount)
 		return false
 	}
+	if callbackNamespace == "mailto" {
+		if !server.mailto.Enabled() {
+			rb.Send(nil, server.name, ERR_REG_INVALID_CALLBACK, client.nick, account, callbackNamespace, errMailNotConfigured.Error())
+			removeFailedAccRegisterData(server.store, casefoldedAccount)
+			return false
+		}
+		callbackValue, err = normalizeEmail(callbackValue)
+		if err != nil {
+			rb.Send(nil, server.name, ERR_REG_INVALID_CALLBACK, client.nick, account, callbackNamespace, "Email address is invalid")
+			removeFailedAccRegisterData(server.store, casefoldedAccount)
+			return false
+		}
+	} else if callbackNamespace == "captcha" {
+		if !server.captcha.Enabled() {
+			rb.Send(nil, server.name, ERR_REG_INVALID_CALLBACK, client.nick, account, callbackNamespace, errCaptchaNotConfigured.Error())
+			removeFailedAccRegisterData(server.store, casefoldedAccount)
+			return false
+		}
+	} else if callbackNamespace == "sms" {
+		if !server.sms.Enabled() {
+			rb.Send(nil, server.name, ERR_REG_INVALID_CALLBACK, client.nick, account, callbackNamespace, errSMSNotConfigured.Error())
+			removeFailedAccRegisterData(server.store, casefoldedAccount)
+			return false
+		}
+		callbackValue, err = normalizePhone(callbackValue)
+		if err != nil {
+			rb.Send(nil, server.name, ERR_REG_INVALID_CALLBACK, client.nick, account, callbackNamespace, "Phone number is invalid")
+			removeFailedAccRegisterData(server.store, casefoldedAccount)
+			return false
+		}
+	}
 
 	// get credential type/value
 	var credentialType, credentialValue string
@@ -169,7 +252,7 @@ func accRegisterHandler(server *Server, client *Client, msg ircmsg.IrcMessage) b
 		credentialType = "passphrase" // default from the spec
 		credentialValue = msg.Params[3]
 	} else {
-		client.Send(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, msg.Command, "Not enough parameters")
+		rb.Send(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, msg.Command, "Not enough parameters")
 		removeFailedAccRegisterData(server.store, casefoldedAccount)
 		return false
 	}
@@ -182,13 +265,13 @@ func accRegisterHandler(server *Server, client *Client, msg ircmsg.IrcMessage) b
 		}
 	}
 	if credentialType == "certfp" && client.certfp == "" {
-		client.Send(nil, server.name, ERR_REG_INVALID_CRED_TYPE, client.nick, credentialType, callbackNamespace, "You are not using a TLS certificate")
+		rb.Send(nil, server.name, ERR_REG_INVALID_CRED_TYPE, client.nick, credentialType, callbackNamespace, "You are not using a TLS certificate")
 		removeFailedAccRegisterData(server.store, casefoldedAccount)
 		return false
 	}
 
 	if !credentialValid {
-		client.Send(nil, server.name, ERR_REG_INVALID_CRED_TYPE, client.nick, credentialType, callbackNamespace, "Credential type is not supported")
+		rb.Send(nil, server.name, ERR_REG_INVALID_CRED_TYPE, client.nick, credentialType, callbackNamespace, "Credential type is not supported")
 		removeFailedAccRegisterData(server.store, casefoldedAccount)
 		return false
 	}
@@ -208,6 +291,11 @@ func accRegisterHandler(server *Server, client *Client, msg ircmsg.IrcMessage) b
 			tx.Set(assembledKeyCertToAccount, casefoldedAccount, nil)
 		}
 
+		// keep the address around for password resets
+		if callbackNamespace == "mailto" {
+			tx.Set(fmt.Sprintf(keyAccountEmail, casefoldedAccount), callbackValue, nil)
+		}
+
 		// make creds
 		var creds AccountCredentials
 
@@ -220,7 +308,7 @@ func accRegisterHandler(server *Server, client *Client, msg ircmsg.IrcMessage) b
 		if credentialType == "certfp" {
 			creds.Certificate = client.certfp
 		} else if credentialType == "passphrase" {
-			creds.PassphraseHash, err = server.passwords.GenerateFromPassword(creds.PassphraseSalt, credentialValue)
+			err = creds.setPassphrase(server.passwords, credentialValue)
 			if err != nil {
 				return fmt.Errorf("Could not hash password: %s", err)
 			}
@@ -240,7 +328,7 @@ func accRegisterHandler(server *Server, client *Client, msg ircmsg.IrcMessage) b
 		if err == errCertfpAlreadyExists {
 			errMsg = "An account already exists for your certificate fingerprint"
 		}
-		client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "ACC", "REGISTER", errMsg)
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "ACC", "REGISTER", errMsg)
 		log.Println("Could not save registration creds:", err.Error())
 		removeFailedAccRegisterData(server.store, casefoldedAccount)
 		return false
@@ -256,19 +344,23 @@ func accRegisterHandler(server *Server, client *Client, msg ircmsg.IrcMessage) b
 				Name:         strings.TrimSpace(msg.Params[1]),
 				RegisteredAt: time.Now(),
 				Clients:      []*Client{client},
+				Links:        &AccountLinks{Links: make(map[string]string)},
 			}
-			//TODO(dan): Consider creating ircd-wide account adding/removing/affecting lock for protecting access to these sorts of variables
+			server.accountsMutex.Lock()
 			server.accounts[casefoldedAccount] = &account
+			server.accountsMutex.Unlock()
+			client.stateMutex.Lock()
 			client.account = &account
+			client.stateMutex.Unlock()
 
-			client.Send(nil, server.name, RPL_REGISTRATION_SUCCESS, client.nick, account.Name, "Account created")
-			client.Send(nil, server.name, RPL_LOGGEDIN, client.nick, client.nickMaskString, account.Name, fmt.Sprintf("You are now logged in as %s", account.Name))
-			client.Send(nil, server.name, RPL_SASLSUCCESS, client.nick, "Authentication successful")
+			rb.Send(nil, server.name, RPL_REGISTRATION_SUCCESS, client.nick, account.Name, "Account created")
+			rb.Send(nil, server.name, RPL_LOGGEDIN, client.nick, client.nickMaskString, account.Name, fmt.Sprintf("You are now logged in as %s", account.Name))
+			rb.Send(nil, server.name, RPL_SASLSUCCESS, client.nick, "Authentication successful")
 			server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Account registered $c[grey][$r%s$c[grey]] by $c[grey][$r%s$c[grey]]"), account.Name, client.nickMaskString))
 			return nil
 		})
 		if err != nil {
-			client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "ACC", "REGISTER", "Could not register")
+			rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "ACC", "REGISTER", "Could not register")
 			log.Println("Could not save verification confirmation (*):", err.Error())
 			removeFailedAccRegisterData(server.store, casefoldedAccount)
 			return false
@@ -278,7 +370,120 @@ func accRegisterHandler(server *Server, client *Client, msg ircmsg.IrcMessage) b
 	}
 
 	// dispatch callback
-	client.Notice(fmt.Sprintf("We should dispatch a real callback here to %s:%s", callbackNamespace, callbackValue))
+	if callbackNamespace == "mailto" {
+		server.sendVerificationEmail(client, casefoldedAccount, account, callbackValue, rb)
+	} else if callbackNamespace == "sms" {
+		server.sendVerificationSMS(client, casefoldedAccount, account, callbackValue, rb)
+	} else if callbackNamespace == "captcha" {
+		server.sendCaptchaLink(client, casefoldedAccount, account, rb)
+	} else {
+		rb.Notice(fmt.Sprintf("We should dispatch a real callback here to %s:%s", callbackNamespace, callbackValue))
+	}
+
+	return false
+}
+
+// saveVerificationCode stores the code that the client can use to verify their new account,
+// returning the template data for the message that sends it. If the code can't be stored,
+// the registration is removed and nil is returned.
+func (server *Server) saveVerificationCode(client *Client, accountKey, accountName, code string, rb *ResponseBuffer) *emailData {
+	timeout := server.accountRegistration.VerifyTimeout
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(fmt.Sprintf(keyAccountVerificationCode, accountKey), resetCodeHash(code), &buntdb.SetOptions{Expires: true, TTL: timeout})
+		return err
+	})
+	if err != nil {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "ACC", "REGISTER", "Could not register")
+		server.logger.Error("internal", fmt.Sprintf("Could not save verification code for account %s: %s", accountName, err.Error()))
+		removeFailedAccRegisterData(server.store, accountKey)
+		return nil
+	}
+	return &emailData{
+		NetworkName: server.networkName,
+		Account:     accountName,
+		Code:        code,
+		Expiry:      timeout.String(),
+	}
+}
+
+// sendVerificationEmail emails a code that the client can use to verify their new account.
+func (server *Server) sendVerificationEmail(client *Client, accountKey, accountName, email string, rb *ResponseBuffer) {
+	data := server.saveVerificationCode(client, accountKey, accountName, randomMailToken(), rb)
+	if data == nil {
+		return
+	}
+
+	rb.Send(nil, server.name, RPL_REG_VERIFICATION_REQUIRED, client.nick, accountName, fmt.Sprintf("A verification code has been sent to %s", email))
+	mailto := server.mailto
+	go func() {
+		err := mailto.sendTemplate(email, mailto.verifyTemplate, *data)
+		if err != nil {
+			server.logger.Error("accounts", fmt.Sprintf("Could not send verification code for account %s: %s", accountName, err.Error()))
+		}
+	}()
+}
+
+// sendVerificationSMS texts a code that the client can use to verify their new account.
+func (server *Server) sendVerificationSMS(client *Client, accountKey, accountName, phone string, rb *ResponseBuffer) {
+	code, err := randomSMSCode()
+	if err != nil {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "ACC", "REGISTER", "Could not register")
+		removeFailedAccRegisterData(server.store, accountKey)
+		return
+	}
+	data := server.saveVerificationCode(client, accountKey, accountName, code, rb)
+	if data == nil {
+		return
+	}
+
+	rb.Send(nil, server.name, RPL_REG_VERIFICATION_REQUIRED, client.nick, accountName, fmt.Sprintf("A verification code has been texted to %s", phone))
+	sms := server.sms
+	go func() {
+		err := sms.sendTemplate(phone, sms.verifyTemplate, *data)
+		if err != nil {
+			server.logger.Error("accounts", fmt.Sprintf("Could not text verification code for account %s: %s", accountName, err.Error()))
+		}
+	}()
+}
+
+// accVerifyHandler parses the ACC VERIFY command.
+func accVerifyHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	accountKey, err := CasefoldName(msg.Params[1])
+	if err != nil || client.account != &NoAccount {
+		rb.Send(nil, server.name, ERR_ACCOUNT_INVALID_VERIFY_CODE, client.nick, msg.Params[1], "Invalid verification code")
+		return false
+	}
+	// texted codes are short, so guesses count against the same limit as logins
+	if !server.allowSaslAttempt(client) {
+		rb.Send(nil, server.name, ERR_ACCOUNT_INVALID_VERIFY_CODE, client.nick, msg.Params[1], "Too many attempts, try again later")
+		return false
+	}
+
+	var account *ClientAccount
+	err = server.store.Update(func(tx *buntdb.Tx) error {
+		codeKey := fmt.Sprintf(keyAccountVerificationCode, accountKey)
+		hash, err := tx.Get(codeKey)
+		if err != nil || subtle.ConstantTimeCompare([]byte(hash), []byte(resetCodeHash(msg.Params[2]))) != 1 {
+			return errAccountCreation
+		}
+		tx.Delete(codeKey)
+		tx.Set(fmt.Sprintf(keyAccountVerified, accountKey), "1", nil)
+		account = loadAccount(server, tx, accountKey)
+		client.LoginToAccount(account)
+		return nil
+	})
+	if err == errAccountCreation {
+		rb.Send(nil, server.name, ERR_ACCOUNT_INVALID_VERIFY_CODE, client.nick, msg.Params[1], "Invalid verification code")
+		return false
+	} else if err != nil {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "ACC", "VERIFY", "Could not verify your account")
+		server.logger.Error("internal", fmt.Sprintf("Could not verify account %s: %s", accountKey, err.Error()))
+		return false
+	}
 
+	rb.Send(nil, server.name, RPL_VERIFYSUCCESS, client.nick, account.Name, "Account verification successful")
+	rb.Send(nil, server.name, RPL_LOGGEDIN, client.nick, client.nickMaskString, account.Name, fmt.Sprintf("You are now logged in as %s", account.Name))
+	client.finishLogin(rb)
+	server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Account verified $c[grey][$r%s$c[grey]] by $c[grey][$r%s$c[grey]]"), account.Name, client.nickMaskString))
 	return false
 }
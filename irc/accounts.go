@@ -11,10 +11,12 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/goshuirc/irc-go/ircfmt"
 	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/history"
 	"github.com/oragono/oragono/irc/sno"
 	"github.com/tidwall/buntdb"
 )
@@ -26,14 +28,18 @@ const (
 	keyAccountRegTime     = "account.registered.time %s"
 	keyAccountCredentials = "account.credentials %s"
 	keyCertToAccount      = "account.creds.certfp %s"
+	keyAccountDMHistory   = "account.dmhistory %s"
+	keyAccountIgnores     = "account.ignores %s"
 )
 
 var (
 	// EnabledSaslMechanisms contains the SASL mechanisms that exist and that we support.
 	// This can be moved to some other data structure/place if we need to load/unload mechs later.
-	EnabledSaslMechanisms = map[string]func(*Server, *Client, string, []byte) bool{
-		"PLAIN":    authPlainHandler,
-		"EXTERNAL": authExternalHandler,
+	EnabledSaslMechanisms = map[string]func(*Server, *Client, string, []byte, *ResponseBuffer) bool{
+		"PLAIN":         authPlainHandler,
+		"EXTERNAL":      authExternalHandler,
+		"SCRAM-SHA-256": authScramHandler,
+		"OAUTHBEARER":   authOAuthBearerHandler,
 	}
 
 	// NoAccount is a placeholder which means that the user is not logged into an account.
@@ -53,6 +59,96 @@ type ClientAccount struct {
 	RegisteredAt time.Time
 	// Clients that are currently logged into this account (useful for notifications).
 	Clients []*Client
+	// History holds this account's private messages, if they've opted into storing them.
+	History *history.Buffer
+	// HistoryExpired counts the private messages that have passed the retention period
+	// since the account's clients were last told.
+	HistoryExpired int
+	// Ignores holds the SILENCE, ACCEPT and highlight lists shared by this account's clients.
+	Ignores *IgnoreLists
+	// MissedHighlights holds the highlights that happened while all of this account's clients were away.
+	MissedHighlights *history.Buffer
+	// Vhost is the vhost that this account's clients get when they log in.
+	Vhost string
+	// VhostChanged represents the time that the account's vhost was last changed.
+	VhostChanged time.Time
+	// Links holds the external identities this account is linked to.
+	Links *AccountLinks
+	// Bot is true if opers have marked this account as a bot, which raises its limits.
+	Bot bool
+	// WhoisChannels controls which channels WHOIS shows for this account's clients, if set.
+	WhoisChannels string
+	// PasswordResetRequired is true if the account was provisioned by an admin, and its user
+	// has to set a new password before they can use it.
+	PasswordResetRequired bool
+	// Suspension is set if opers have suspended the account.
+	Suspension *AccountSuspension
+	// Settings holds the account settings that have been changed from their defaults.
+	Settings map[string]string
+
+	// stateMutex protects Clients, History and HistoryExpired, which are used by every
+	// client that's talking to the account's clients, and by the REST API.
+	stateMutex sync.RWMutex
+}
+
+// getClients returns the clients that are logged into the account.
+func (account *ClientAccount) getClients() []*Client {
+	account.stateMutex.RLock()
+	defer account.stateMutex.RUnlock()
+	clients := make([]*Client, len(account.Clients))
+	copy(clients, account.Clients)
+	return clients
+}
+
+// addClient adds a client that's logged into the account.
+func (account *ClientAccount) addClient(client *Client) {
+	account.stateMutex.Lock()
+	defer account.stateMutex.Unlock()
+	account.Clients = append(account.Clients, client)
+}
+
+// removeClient removes a client that's logged out of the account.
+func (account *ClientAccount) removeClient(client *Client) {
+	account.stateMutex.Lock()
+	defer account.stateMutex.Unlock()
+	var newClientAccounts []*Client
+	for _, c := range account.Clients {
+		if c != client {
+			newClientAccounts = append(newClientAccounts, c)
+		}
+	}
+	account.Clients = newClientAccounts
+}
+
+// getHistory returns the account's private message history, or nil if it isn't stored.
+func (account *ClientAccount) getHistory() *history.Buffer {
+	account.stateMutex.RLock()
+	defer account.stateMutex.RUnlock()
+	return account.History
+}
+
+// setHistory sets the account's private message history, nil to stop storing it.
+func (account *ClientAccount) setHistory(buffer *history.Buffer) {
+	account.stateMutex.Lock()
+	defer account.stateMutex.Unlock()
+	account.History = buffer
+}
+
+// addExpiredHistory counts private messages that were removed from the account's history
+// because they passed the retention period.
+func (account *ClientAccount) addExpiredHistory(expired int) {
+	account.stateMutex.Lock()
+	defer account.stateMutex.Unlock()
+	account.HistoryExpired += expired
+}
+
+// takeExpiredHistory returns how many private messages have expired since it was last called.
+func (account *ClientAccount) takeExpiredHistory() int {
+	account.stateMutex.Lock()
+	defer account.stateMutex.Unlock()
+	expired := account.HistoryExpired
+	account.HistoryExpired = 0
+	return expired
 }
 
 // loadAccountCredentials loads an account's credentials from the store.
@@ -76,24 +172,66 @@ func loadAccount(server *Server, tx *buntdb.Tx, accountKey string) *ClientAccoun
 	name, _ := tx.Get(fmt.Sprintf(keyAccountName, accountKey))
 	regTime, _ := tx.Get(fmt.Sprintf(keyAccountRegTime, accountKey))
 	regTimeInt, _ := strconv.ParseInt(regTime, 10, 64)
+	vhost, _ := tx.Get(fmt.Sprintf(keyAccountVhost, accountKey))
+	vhostChanged, _ := tx.Get(fmt.Sprintf(keyAccountVhostChanged, accountKey))
+	vhostChangedInt, _ := strconv.ParseInt(vhostChanged, 10, 64)
+	_, botErr := tx.Get(fmt.Sprintf(keyAccountBot, accountKey))
+	whoisChannels, _ := tx.Get(fmt.Sprintf(keyAccountWhoisChannels, accountKey))
+	_, passwordResetErr := tx.Get(fmt.Sprintf(keyAccountPasswordReset, accountKey))
 	accountInfo := ClientAccount{
-		Name:         name,
-		RegisteredAt: time.Unix(regTimeInt, 0),
-		Clients:      []*Client{},
+		Name:          name,
+		RegisteredAt:  time.Unix(regTimeInt, 0),
+		Clients:       []*Client{},
+		Ignores:       loadIgnoreLists(tx, accountKey),
+		Vhost:         vhost,
+		VhostChanged:  time.Unix(vhostChangedInt, 0),
+		Links:         loadAccountLinks(tx, accountKey),
+		Bot:           botErr == nil,
+		WhoisChannels: whoisChannels,
+
+		PasswordResetRequired: passwordResetErr == nil,
+		Suspension:            loadAccountSuspension(tx, accountKey),
+		Settings:              loadAccountSettings(tx, accountKey),
+	}
+	_, err := tx.Get(fmt.Sprintf(keyAccountDMHistory, accountKey))
+	if err == nil && server.historyDirectMessages.Enabled {
+		accountInfo.History = server.loadDirectMessageHistory(tx, accountKey)
+	}
+	if server.missedHighlights.Enabled {
+		accountInfo.MissedHighlights = history.NewBuffer(accountKey, server.missedHighlights.Length, nil)
+	}
+	server.accountsMutex.Lock()
+	defer server.accountsMutex.Unlock()
+	// someone else could have loaded it while we were
+	if account, exists := server.accounts[accountKey]; exists {
+		return account
 	}
 	server.accounts[accountKey] = &accountInfo
 
 	return &accountInfo
 }
 
+// getAccount returns the account with the given casefolded name, if it's been loaded.
+func (server *Server) getAccount(accountKey string) (*ClientAccount, bool) {
+	server.accountsMutex.RLock()
+	defer server.accountsMutex.RUnlock()
+	account, exists := server.accounts[accountKey]
+	return account, exists
+}
+
+// forgetAccount unloads the account with the given casefolded name, after it's been dropped.
+func (server *Server) forgetAccount(accountKey string) {
+	server.accountsMutex.Lock()
+	delete(server.accounts, accountKey)
+	server.accountsMutex.Unlock()
+}
+
 // authenticateHandler parses the AUTHENTICATE command (for SASL authentication).
-func authenticateHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func authenticateHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	// sasl abort
 	if !server.accountAuthenticationEnabled || len(msg.Params) == 1 && msg.Params[0] == "*" {
-		client.Send(nil, server.name, ERR_SASLABORTED, client.nick, "SASL authentication aborted")
-		client.saslInProgress = false
-		client.saslMechanism = ""
-		client.saslValue = ""
+		rb.Send(nil, server.name, ERR_SASLABORTED, client.nick, "SASL authentication aborted")
+		client.resetSasl()
 		return false
 	}
 
@@ -102,12 +240,17 @@ func authenticateHandler(server *Server, client *Client, msg ircmsg.IrcMessage)
 		mechanism := strings.ToUpper(msg.Params[0])
 		_, mechanismIsEnabled := EnabledSaslMechanisms[mechanism]
 
-		if mechanismIsEnabled {
+		if client.account != &NoAccount {
+			rb.Send(nil, server.name, ERR_SASLALREADY, client.nick, "You have already authenticated using SASL")
+		} else if !mechanismIsEnabled {
+			rb.Send(nil, server.name, RPL_SASLMECHS, client.nick, CapValues[SASL], "are available SASL mechanisms")
+			rb.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed")
+		} else if !server.allowSaslAttempt(client) {
+			rb.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed: Too many attempts, try again later")
+		} else {
 			client.saslInProgress = true
 			client.saslMechanism = mechanism
-			client.Send(nil, server.name, "AUTHENTICATE", "+")
-		} else {
-			client.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed")
+			rb.Send(nil, server.name, "AUTHENTICATE", "+")
 		}
 
 		return false
@@ -117,19 +260,19 @@ func authenticateHandler(server *Server, client *Client, msg ircmsg.IrcMessage)
 	rawData := msg.Params[0]
 
 	if len(rawData) > 400 {
-		client.Send(nil, server.name, ERR_SASLTOOLONG, client.nick, "SASL message too long")
-		client.saslInProgress = false
-		client.saslMechanism = ""
-		client.saslValue = ""
+		rb.Send(nil, server.name, ERR_SASLTOOLONG, client.nick, "SASL message too long")
+		client.resetSasl()
 		return false
 	} else if len(rawData) == 400 {
 		client.saslValue += rawData
-		// allow 4 'continuation' lines before rejecting for length
-		if len(client.saslValue) > 400*4 {
-			client.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed: Passphrase too long")
-			client.saslInProgress = false
-			client.saslMechanism = ""
-			client.saslValue = ""
+		// allow 4 'continuation' lines before rejecting for length, more for bearer tokens
+		maxLines := 4
+		if client.saslMechanism == "OAUTHBEARER" {
+			maxLines = 16
+		}
+		if len(client.saslValue) > 400*maxLines {
+			rb.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed: Passphrase too long")
+			client.resetSasl()
 			return false
 		}
 		return false
@@ -143,10 +286,8 @@ func authenticateHandler(server *Server, client *Client, msg ircmsg.IrcMessage)
 	if client.saslValue != "+" {
 		data, err = base64.StdEncoding.DecodeString(client.saslValue)
 		if err != nil {
-			client.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed: Invalid b64 encoding")
-			client.saslInProgress = false
-			client.saslMechanism = ""
-			client.saslValue = ""
+			rb.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed: Invalid b64 encoding")
+			client.resetSasl()
 			return false
 		}
 	}
@@ -156,26 +297,33 @@ func authenticateHandler(server *Server, client *Client, msg ircmsg.IrcMessage)
 
 	// like 100% not required, but it's good to be safe I guess
 	if !handlerExists {
-		client.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed")
-		client.saslInProgress = false
-		client.saslMechanism = ""
-		client.saslValue = ""
+		rb.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed")
+		client.resetSasl()
 		return false
 	}
 
 	// let the SASL handler do its thing
-	exiting := handler(server, client, client.saslMechanism, data)
+	exiting := handler(server, client, client.saslMechanism, data, rb)
 
-	// wait 'til SASL is done before emptying the sasl vars
-	client.saslInProgress = false
-	client.saslMechanism = ""
+	// wait 'til SASL is done before emptying the sasl vars, multi-step mechanisms keep going
 	client.saslValue = ""
+	if client.scramSession == nil {
+		client.resetSasl()
+	}
 
 	return exiting
 }
 
+// resetSasl clears the client's SASL session.
+func (client *Client) resetSasl() {
+	client.saslInProgress = false
+	client.saslMechanism = ""
+	client.saslValue = ""
+	client.scramSession = nil
+}
+
 // authPlainHandler parses the SASL PLAIN mechanism.
-func authPlainHandler(server *Server, client *Client, mechanism string, value []byte) bool {
+func authPlainHandler(server *Server, client *Client, mechanism string, value []byte, rb *ResponseBuffer) bool {
 	splitValue := bytes.Split(value, []byte{'\000'})
 
 	var accountKey, authzid string
@@ -187,60 +335,113 @@ func authPlainHandler(server *Server, client *Client, mechanism string, value []
 		if accountKey == "" {
 			accountKey = authzid
 		} else if accountKey != authzid {
-			client.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed: authcid and authzid should be the same")
+			rb.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed: authcid and authzid should be the same")
 			return false
 		}
 	} else {
-		client.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed: Invalid auth blob")
+		rb.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed: Invalid auth blob")
 		return false
 	}
 
 	// keep it the same as in the REG CREATE stage
-	accountKey, err := CasefoldName(accountKey)
+	_, err := CasefoldName(accountKey)
+	if err != nil {
+		rb.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed: Bad account name")
+		return false
+	}
+
+	err = server.passwordLogin(client, accountKey, string(splitValue[2]))
 	if err != nil {
-		client.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed: Bad account name")
+		rb.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed")
 		return false
 	}
 
+	client.successfulSaslAuth(rb)
+	return false
+}
+
+// passwordLogin logs the client into the given account if the password is right, checking
+// it with the directory first if LDAP is enabled. It's used by SASL PLAIN and NickServ.
+func (server *Server) passwordLogin(client *Client, accountName, password string) error {
+	accountKey, err := CasefoldName(accountName)
+	if err != nil {
+		return errSaslFail
+	}
+
+	// check with the directory first, this is done outside the update so it doesn't block the store
+	ldapAccepted := server.ldapAuthenticate(accountName, password)
+
 	// load and check acct data all in one update to prevent races.
 	// as noted elsewhere, change to proper locking for Account type later probably
-	err = server.store.Update(func(tx *buntdb.Tx) error {
+	return server.store.Update(func(tx *buntdb.Tx) error {
+		if ldapAccepted {
+			return server.ldapLoginToAccount(tx, client, accountKey, accountName)
+		}
+
+		// grouped nicknames log into their account
+		accountKey = nickAccount(tx, accountKey)
+
 		// confirm account is verified
 		_, err = tx.Get(fmt.Sprintf(keyAccountVerified, accountKey))
 		if err != nil {
 			return errSaslFail
 		}
+		if loadAccountSuspension(tx, accountKey) != nil {
+			return errAccountSuspended
+		}
 
 		creds, err := loadAccountCredentials(tx, accountKey)
 		if err != nil {
 			return err
 		}
 
-		// ensure creds are valid
-		password := string(splitValue[2])
-		if len(creds.PassphraseHash) < 1 || len(creds.PassphraseSalt) < 1 || len(password) < 1 {
-			return errSaslFail
+		// imported accounts keep their old hash until they log in with it
+		if len(creds.PassphraseHash) < 1 && creds.LegacyHash != "" && 0 < len(password) {
+			err = checkLegacyHash(creds.LegacyHash, password)
+			if err != nil {
+				return errSaslFail
+			}
+			if !server.isReadOnly() {
+				err = creds.setPassphrase(server.passwords, password)
+				if err == nil {
+					credText, err := json.Marshal(creds)
+					if err == nil {
+						tx.Set(fmt.Sprintf(keyAccountCredentials, accountKey), string(credText), nil)
+					}
+				}
+			}
+		} else {
+			// ensure creds are valid
+			if len(creds.PassphraseHash) < 1 || len(creds.PassphraseSalt) < 1 || len(password) < 1 {
+				return errSaslFail
+			}
+			err = server.passwords.CompareHashAndPassword(creds.PassphraseHash, creds.PassphraseSalt, password)
+			if err != nil {
+				return errSaslFail
+			}
+		}
+
+		// accounts made before SCRAM was supported get their SCRAM credentials now
+		if creds.SCRAMSHA256 == nil {
+			creds.SCRAMSHA256, err = NewScramCredentials(password)
+			if err == nil && !server.isReadOnly() {
+				credText, err := json.Marshal(creds)
+				if err == nil {
+					tx.Set(fmt.Sprintf(keyAccountCredentials, accountKey), string(credText), nil)
+				}
+			}
 		}
-		err = server.passwords.CompareHashAndPassword(creds.PassphraseHash, creds.PassphraseSalt, password)
 
 		// succeeded, load account info if necessary
-		account, exists := server.accounts[accountKey]
+		account, exists := server.getAccount(accountKey)
 		if !exists {
 			account = loadAccount(server, tx, accountKey)
 		}
 
 		client.LoginToAccount(account)
 
-		return err
+		return nil
 	})
-
-	if err != nil {
-		client.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed")
-		return false
-	}
-
-	client.successfulSaslAuth()
-	return false
 }
 
 // LoginToAccount logs the client into the given account.
@@ -248,33 +449,70 @@ func (client *Client) LoginToAccount(account *ClientAccount) {
 	if client.account == account {
 		// already logged into this acct, no changing necessary
 		return
-	} else if client.account != nil {
+	} else if client.account != nil && client.account != &NoAccount {
 		// logout of existing acct
-		var newClientAccounts []*Client
-		for _, c := range account.Clients {
-			if c != client {
-				newClientAccounts = append(newClientAccounts, c)
-			}
-		}
-		account.Clients = newClientAccounts
+		client.account.removeClient(client)
 	}
 
-	account.Clients = append(account.Clients, client)
+	account.addClient(client)
+	client.stateMutex.Lock()
 	client.account = account
+	client.stateMutex.Unlock()
+
+	// share ignore lists with the account's other clients, keeping what we've already set
+	if account.Ignores != nil && client.ignores != account.Ignores {
+		account.Ignores.Merge(client.ignores)
+		client.ignores = account.Ignores
+	}
 	client.server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Client $c[grey][$r%s$c[grey]] logged into account $c[grey][$r%s$c[grey]]"), client.nickMaskString, account.Name))
 }
 
+// logoutOfAccount logs the client out of their account.
+func (client *Client) logoutOfAccount(rb *ResponseBuffer) {
+	account := client.account
+	if account == &NoAccount {
+		return
+	}
+	account.removeClient(client)
+	client.stateMutex.Lock()
+	client.account = &NoAccount
+	client.stateMutex.Unlock()
+	// keep the lists, but stop sharing them with the account
+	if client.ignores == account.Ignores {
+		ignores := NewIgnoreLists()
+		ignores.Merge(account.Ignores)
+		client.ignores = ignores
+	}
+
+	rb.Send(nil, client.server.name, RPL_LOGGEDOUT, client.nick, client.nickMaskString, "You are now logged out")
+	for friend := range client.Friends(AccountNotify) {
+		friend.SendFromClient("", client, nil, "ACCOUNT", "*")
+	}
+	client.checkNickEnforcement(rb)
+}
+
 // authExternalHandler parses the SASL EXTERNAL mechanism.
-func authExternalHandler(server *Server, client *Client, mechanism string, value []byte) bool {
+func authExternalHandler(server *Server, client *Client, mechanism string, value []byte, rb *ResponseBuffer) bool {
 	if client.certfp == "" {
-		client.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed, you are not connecting with a caertificate")
+		rb.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed, you are not connecting with a certificate")
 		return false
 	}
 
+	// an authzid may be given to pick the account, but it has to be the one the cert is on
+	var authzid string
+	if 0 < len(value) {
+		var err error
+		authzid, err = CasefoldName(string(value))
+		if err != nil {
+			rb.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed: Bad account name")
+			return false
+		}
+	}
+
 	err := server.store.Update(func(tx *buntdb.Tx) error {
 		// certfp lookup key
 		accountKey, err := tx.Get(fmt.Sprintf(keyCertToAccount, client.certfp))
-		if err != nil {
+		if err != nil || (authzid != "" && authzid != accountKey) {
 			return errSaslFail
 		}
 
@@ -289,15 +527,18 @@ func authExternalHandler(server *Server, client *Client, mechanism string, value
 		if err != nil {
 			return errSaslFail
 		}
+		if loadAccountSuspension(tx, accountKey) != nil {
+			return errSaslFail
+		}
 
 		// confirm the certfp in that account's credentials
 		creds, err := loadAccountCredentials(tx, accountKey)
-		if err != nil || creds.Certificate != client.certfp {
+		if err != nil || !creds.hasCertificate(client.certfp) {
 			return errSaslFail
 		}
 
 		// succeeded, load account info if necessary
-		account, exists := server.accounts[accountKey]
+		account, exists := server.getAccount(accountKey)
 		if !exists {
 			account = loadAccount(server, tx, accountKey)
 		}
@@ -308,21 +549,37 @@ func authExternalHandler(server *Server, client *Client, mechanism string, value
 	})
 
 	if err != nil {
-		client.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed")
+		rb.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed")
 		return false
 	}
 
-	client.successfulSaslAuth()
+	client.successfulSaslAuth(rb)
 	return false
 }
 
 // successfulSaslAuth means that a SASL auth attempt completed successfully, and is used to dispatch messages.
-func (client *Client) successfulSaslAuth() {
-	client.Send(nil, client.server.name, RPL_LOGGEDIN, client.nick, client.nickMaskString, client.account.Name, fmt.Sprintf("You are now logged in as %s", client.account.Name))
-	client.Send(nil, client.server.name, RPL_SASLSUCCESS, client.nick, "SASL authentication successful")
+func (client *Client) successfulSaslAuth(rb *ResponseBuffer) {
+	rb.Send(nil, client.server.name, RPL_LOGGEDIN, client.nick, client.nickMaskString, client.account.Name, fmt.Sprintf("You are now logged in as %s", client.account.Name))
+	rb.Send(nil, client.server.name, RPL_SASLSUCCESS, client.nick, "SASL authentication successful")
+	client.server.liftExceededLimits(client)
+	client.finishLogin(rb)
+}
+
+// finishLogin sets up the client after they've logged into an account, and tells their
+// friends about it.
+func (client *Client) finishLogin(rb *ResponseBuffer) {
+	client.sendDirectMessageHistoryStatus(rb)
+	client.saveIgnoreLists()
+	client.sendMissedHighlightsStatus(rb)
+	client.applyAccountVhost()
+	client.checkNickEnforcement(rb)
+	client.server.setAccountLastSeen(client.account.Name)
+	if client.needsPasswordReset() {
+		rb.Notice("Your account needs a new password before you can use it. Set one with /NS SET PASSWORD <new password>")
+	}
 
 	// dispatch account-notify
 	for friend := range client.Friends(AccountNotify) {
-		friend.Send(nil, client.nickMaskString, "ACCOUNT", client.account.Name)
+		friend.SendFromClient("", client, nil, "ACCOUNT", client.account.Name)
 	}
 }
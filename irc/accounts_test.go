@@ -0,0 +1,61 @@
+// Copyright (c) 2016-2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tidwall/buntdb"
+)
+
+// newAccountsTestServer returns a server with an in-memory store holding the given accounts.
+func newAccountsTestServer(t *testing.T, names ...string) *Server {
+	store, err := buntdb.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Update(func(tx *buntdb.Tx) error {
+		for _, name := range names {
+			accountKey, _ := CasefoldName(name)
+			tx.Set(fmt.Sprintf(keyAccountExists, accountKey), "1", nil)
+			tx.Set(fmt.Sprintf(keyAccountVerified, accountKey), "1", nil)
+			tx.Set(fmt.Sprintf(keyAccountName, accountKey), name, nil)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{
+		accounts: make(map[string]*ClientAccount),
+		store:    store,
+	}
+}
+
+func TestLoadAccountByName(t *testing.T) {
+	server := newAccountsTestServer(t, "Alice")
+
+	if _, exists := server.getAccount("alice"); exists {
+		t.Fatal("account was loaded before anyone asked for it")
+	}
+	account := server.loadAccountByName("ALICE")
+	if account == nil || account.Name != "Alice" {
+		t.Fatalf("expected to load Alice, got %+v", account)
+	}
+	if loaded, exists := server.getAccount("alice"); !exists || loaded != account {
+		t.Error("expected the account to be kept once it's been loaded")
+	}
+	if again := server.loadAccountByName("alice"); again != account {
+		t.Error("expected the same account to be returned when it's loaded again")
+	}
+	if server.loadAccountByName("bob") != nil {
+		t.Error("loaded an account that isn't registered")
+	}
+
+	server.forgetAccount("alice")
+	if _, exists := server.getAccount("alice"); exists {
+		t.Error("expected the account to be gone once it's forgotten")
+	}
+}
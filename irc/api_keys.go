@@ -0,0 +1,690 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/history"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	// keyAccountAPIKeys holds the API keys an account has made.
+	keyAccountAPIKeys = "account.apikeys %s"
+	// keyAPIKeyToAccount maps the hash of an API key to the account it belongs to.
+	keyAPIKeyToAccount = "account.apikey.hash %s"
+
+	defaultMaxAPIKeysPerAccount = 5
+	apiKeyTokenLen              = 24
+
+	// APIKeyScopeMessage lets a key send messages from the account.
+	APIKeyScopeMessage = "message"
+	// APIKeyScopeHistory lets a key read the account's stored private messages.
+	APIKeyScopeHistory = "history"
+	// APIKeyScopeSettings lets a key view and change the account's settings.
+	APIKeyScopeSettings = "settings"
+)
+
+var (
+	apiKeyScopes = []string{APIKeyScopeMessage, APIKeyScopeHistory, APIKeyScopeSettings}
+
+	errAPIKeyExists   = errors.New("You already have an API key with that name")
+	errAPIKeyNotFound = errors.New("You don't have an API key with that name")
+	errTooManyAPIKeys = errors.New("You have too many API keys, delete one first")
+
+	errAPIMessageNoSuchTarget  = errors.New("No such nick or channel")
+	errAPIMessageServices      = errors.New("Services can't be messaged with an API key")
+	errAPIMessageNickInUse     = errors.New("Someone who isn't logged into your account is using its name as their nick")
+	errAPIMessageCannotSend    = errors.New("You can't send messages to that target")
+	errAPIMessageFiltered      = errors.New("Your message was blocked by the channel's message policy")
+	errAPIMessageTooLong       = errors.New("Your message is too long")
+	errAPIMessagePasswordReset = errors.New("You must set a new password before you can send messages")
+)
+
+// APIKeysConfig lets users make personal API keys, which bots and integrations can use with
+// the REST API to act as their account without keeping an IRC connection open.
+type APIKeysConfig struct {
+	Enabled       bool
+	MaxPerAccount int `yaml:"max-per-account"`
+}
+
+// load checks the config and fills in the defaults.
+func (conf *APIKeysConfig) load() error {
+	if conf.MaxPerAccount < 0 {
+		return errors.New("max-per-account can't be negative")
+	}
+	if conf.MaxPerAccount == 0 {
+		conf.MaxPerAccount = defaultMaxAPIKeysPerAccount
+	}
+	return nil
+}
+
+// APIKey is a personal API key. Only the hash of the key itself is stored.
+type APIKey struct {
+	Name      string
+	Hash      string
+	Scopes    []string
+	CreatedAt time.Time
+}
+
+// hasScope returns true if the key allows the given scope.
+func (key *APIKey) hasScope(scope string) bool {
+	for _, name := range key.Scopes {
+		if name == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// hashAPIKey returns the hash that we store for the given API key.
+func hashAPIKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadAPIKeys returns the API keys that the given account has made.
+func loadAPIKeys(tx *buntdb.Tx, accountKey string) (keys []APIKey) {
+	value, err := tx.Get(fmt.Sprintf(keyAccountAPIKeys, accountKey))
+	if err == nil {
+		json.Unmarshal([]byte(value), &keys)
+	}
+	return keys
+}
+
+// saveAPIKeys saves the account's API keys, removing the entry if there are none left.
+func saveAPIKeys(tx *buntdb.Tx, accountKey string, keys []APIKey) (err error) {
+	if len(keys) == 0 {
+		_, err = tx.Delete(fmt.Sprintf(keyAccountAPIKeys, accountKey))
+		if err == buntdb.ErrNotFound {
+			err = nil
+		}
+		return err
+	}
+	keysBytes, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	_, _, err = tx.Set(fmt.Sprintf(keyAccountAPIKeys, accountKey), string(keysBytes), nil)
+	return err
+}
+
+// addAPIKey makes a new API key for the account, returning the key itself. This is the only
+// time it's available, since we only store its hash.
+func (server *Server) addAPIKey(accountKey, name string, scopes []string) (token string, err error) {
+	tokenBytes := make([]byte, apiKeyTokenLen)
+	_, err = rand.Read(tokenBytes)
+	if err != nil {
+		return "", err
+	}
+	token = hex.EncodeToString(tokenBytes)
+	hash := hashAPIKey(token)
+
+	err = server.store.Update(func(tx *buntdb.Tx) error {
+		keys := loadAPIKeys(tx, accountKey)
+		for _, key := range keys {
+			if key.Name == name {
+				return errAPIKeyExists
+			}
+		}
+		if server.restAPI.APIKeys.MaxPerAccount <= len(keys) {
+			return errTooManyAPIKeys
+		}
+		keys = append(keys, APIKey{
+			Name:      name,
+			Hash:      hash,
+			Scopes:    scopes,
+			CreatedAt: time.Now().UTC(),
+		})
+		err := saveAPIKeys(tx, accountKey, keys)
+		if err != nil {
+			return err
+		}
+		_, _, err = tx.Set(fmt.Sprintf(keyAPIKeyToAccount, hash), accountKey, nil)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// removeAPIKey deletes the account's API key with the given name.
+func removeAPIKey(tx *buntdb.Tx, accountKey, name string) error {
+	keys := loadAPIKeys(tx, accountKey)
+	for i, key := range keys {
+		if key.Name == name {
+			tx.Delete(fmt.Sprintf(keyAPIKeyToAccount, key.Hash))
+			return saveAPIKeys(tx, accountKey, append(keys[:i], keys[i+1:]...))
+		}
+	}
+	return errAPIKeyNotFound
+}
+
+// parseAPIKeyScopes parses a comma-separated list of scopes, with a blank list meaning all
+// of them.
+func parseAPIKeyScopes(list string) ([]string, error) {
+	if list == "" {
+		return apiKeyScopes, nil
+	}
+	var scopes []string
+	for _, scope := range strings.Split(strings.ToLower(list), ",") {
+		var known bool
+		for _, name := range apiKeyScopes {
+			if scope == name {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown scope %s, scopes can be %s", scope, strings.Join(apiKeyScopes, ", "))
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+// nickservAPIKey handles NickServ APIKEY, which manages the account's personal API keys.
+//
+// APIKEY [LIST] | APIKEY ADD <name> [<scopes>] | APIKEY DEL <name>
+func (server *Server) nickservAPIKey(client *Client, params []string, rb *ResponseBuffer) {
+	if !server.restAPI.Enabled || !server.restAPI.APIKeys.Enabled {
+		rb.NickServNotice("API keys are not enabled on this server")
+		return
+	}
+	if client.account == &NoAccount {
+		rb.NickServNotice("You must be logged into an account to manage its API keys")
+		return
+	}
+	accountKey, _ := CasefoldName(client.account.Name)
+
+	subcommand := "list"
+	if 0 < len(params) {
+		subcommand = strings.ToLower(params[0])
+	}
+
+	switch subcommand {
+	case "list":
+		var keys []APIKey
+		server.store.View(func(tx *buntdb.Tx) error {
+			keys = loadAPIKeys(tx, accountKey)
+			return nil
+		})
+		if len(keys) == 0 {
+			rb.NickServNotice("Your account has no API keys")
+			return
+		}
+		rb.NickServNotice("API keys for your account:")
+		for _, key := range keys {
+			rb.NickServNotice(fmt.Sprintf("%s (%s), made %s", key.Name, strings.Join(key.Scopes, ", "), key.CreatedAt.Format(time.RFC1123)))
+		}
+	case "add":
+		if len(params) < 2 {
+			rb.NickServNotice("Syntax: APIKEY ADD <name> [<scopes>]")
+			return
+		}
+		var scopeList string
+		if 2 < len(params) {
+			scopeList = params[2]
+		}
+		scopes, err := parseAPIKeyScopes(scopeList)
+		if err != nil {
+			rb.NickServNotice(err.Error())
+			return
+		}
+		if !server.checkWritable(client, "NICKSERV", rb) {
+			return
+		}
+		token, err := server.addAPIKey(accountKey, params[1], scopes)
+		switch err {
+		case nil:
+		case errAPIKeyExists, errTooManyAPIKeys:
+			rb.NickServNotice(err.Error())
+			return
+		default:
+			rb.NickServNotice("Could not make your API key")
+			server.logger.Error("internal", fmt.Sprintf("Could not save API key for account %s: %s", client.account.Name, err.Error()))
+			return
+		}
+		rb.NickServNotice(fmt.Sprintf("Your new API key is %s", token))
+		rb.NickServNotice("Keep it somewhere safe, it won't be shown again")
+	case "del":
+		if len(params) < 2 {
+			rb.NickServNotice("Syntax: APIKEY DEL <name>")
+			return
+		}
+		if !server.checkWritable(client, "NICKSERV", rb) {
+			return
+		}
+		err := server.store.Update(func(tx *buntdb.Tx) error {
+			return removeAPIKey(tx, accountKey, params[1])
+		})
+		switch err {
+		case nil:
+			rb.NickServNotice(fmt.Sprintf("Deleted API key %s", params[1]))
+		case errAPIKeyNotFound:
+			rb.NickServNotice(err.Error())
+		default:
+			rb.NickServNotice("Could not delete your API key")
+			server.logger.Error("internal", fmt.Sprintf("Could not delete API key for account %s: %s", client.account.Name, err.Error()))
+		}
+	default:
+		rb.NickServNotice("Syntax: APIKEY [LIST|ADD|DEL] [<name>] [<scopes>]")
+	}
+}
+
+type restUserError struct {
+	Error string `json:"error"`
+}
+
+type restUserMessageResp struct {
+	Sent bool `json:"sent"`
+}
+
+type restUserHistoryResp struct {
+	Messages []history.Item `json:"messages"`
+}
+
+type restUserSettingsResp struct {
+	WhoisChannels string            `json:"whois-channels"`
+	DMHistory     bool              `json:"dm-history"`
+	Settings      map[string]string `json:"settings"`
+}
+
+// restReply writes the given response to the client as JSON.
+func restReply(w http.ResponseWriter, status int, rs interface{}) {
+	b, err := json.Marshal(rs)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, restErr)
+		return
+	}
+	w.WriteHeader(status)
+	fmt.Fprintln(w, string(b))
+}
+
+// restUserAuth returns the account that the request's API key belongs to, as long as the key
+// allows the given scope. If it doesn't, the error is written out and nil is returned.
+func restUserAuth(w http.ResponseWriter, r *http.Request, scope string) *ClientAccount {
+	server := restAPIServer
+	if !server.restAPI.APIKeys.Enabled {
+		restReply(w, http.StatusNotFound, restUserError{"API keys are not enabled on this server"})
+		return nil
+	}
+
+	auth := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(auth) != 2 || strings.ToLower(auth[0]) != "bearer" {
+		restReply(w, http.StatusUnauthorized, restUserError{"You must give your API key with an Authorization: Bearer header"})
+		return nil
+	}
+	hash := hashAPIKey(strings.TrimSpace(auth[1]))
+
+	var key *APIKey
+	var accountKey string
+	var suspended bool
+	server.store.View(func(tx *buntdb.Tx) error {
+		var err error
+		accountKey, err = tx.Get(fmt.Sprintf(keyAPIKeyToAccount, hash))
+		if err != nil {
+			return err
+		}
+		for _, accountAPIKey := range loadAPIKeys(tx, accountKey) {
+			if accountAPIKey.Hash == hash {
+				found := accountAPIKey
+				key = &found
+			}
+		}
+		suspended = loadAccountSuspension(tx, accountKey) != nil
+		return nil
+	})
+	if key == nil {
+		restReply(w, http.StatusUnauthorized, restUserError{"Invalid API key"})
+		return nil
+	}
+	// suspended accounts can't be logged into, and their keys don't get around that
+	if suspended {
+		restReply(w, http.StatusForbidden, restUserError{errAccountSuspended.Error()})
+		return nil
+	}
+	if !key.hasScope(scope) {
+		restReply(w, http.StatusForbidden, restUserError{fmt.Sprintf("This API key can't be used for %s", scope)})
+		return nil
+	}
+	account := server.loadAccountByName(accountKey)
+	if account == nil {
+		restReply(w, http.StatusUnauthorized, restUserError{"Invalid API key"})
+		return nil
+	}
+	return account
+}
+
+// restUserMessage sends a PRIVMSG or NOTICE (if `notice` is set) to the given `target` from
+// the API key's account. The account doesn't need to be connected.
+func restUserMessage(w http.ResponseWriter, r *http.Request) {
+	account := restUserAuth(w, r, APIKeyScopeMessage)
+	if account == nil {
+		return
+	}
+
+	target := r.FormValue("target")
+	message := r.FormValue("message")
+	if target == "" || message == "" || strings.ContainsAny(target+message, "\r\n\x00") {
+		restReply(w, http.StatusBadRequest, restUserError{"You must give a target and a message"})
+		return
+	}
+
+	server := restAPIServer
+	if limiter := server.apiMessageLimits; limiter != nil && !limiter.Allow(account.Name) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(limiter.Wait(account.Name).Seconds())+1))
+		restReply(w, http.StatusTooManyRequests, restUserError{"Too many messages, try again later"})
+		return
+	}
+
+	command := "PRIVMSG"
+	if notice, _ := strconv.ParseBool(r.FormValue("notice")); notice {
+		command = "NOTICE"
+	}
+	err := server.sendAccountMessage(account, command, target, message, r.TLS != nil)
+	switch err {
+	case nil:
+		restReply(w, http.StatusOK, restUserMessageResp{Sent: true})
+	case errAPIMessageNoSuchTarget:
+		restReply(w, http.StatusNotFound, restUserError{err.Error()})
+	case errAPIMessageNickInUse:
+		restReply(w, http.StatusConflict, restUserError{err.Error()})
+	case errAPIMessageTooLong:
+		restReply(w, http.StatusBadRequest, restUserError{err.Error()})
+	default:
+		restReply(w, http.StatusForbidden, restUserError{err.Error()})
+	}
+}
+
+// sendAccountMessage sends a PRIVMSG or NOTICE to the given target from the account itself
+// rather than from one of its clients, as "<account>!api@<server>". These messages are held
+// to the same channel modes, bans, message policies, silences and caller ID as messages
+// from clients, and can't be sent to services. secure is whether the message came over TLS.
+func (server *Server) sendAccountMessage(account *ClientAccount, command, targetString, message string, secure bool) error {
+	if account.PasswordResetRequired {
+		return errAPIMessagePasswordReset
+	}
+	nickname, err := CasefoldName(account.Name)
+	if err != nil {
+		return errAPIMessageNickInUse
+	}
+	// someone else using the account's name would make the message look like it's theirs
+	if holder := server.clients.Get(nickname); holder != nil && holder.account != account {
+		return errAPIMessageNickInUse
+	}
+	prefix := fmt.Sprintf("%s!api@%s", account.Name, server.name)
+	maskCasefolded, _ := Casefold(prefix)
+	// ":<nickmask> <command> <target> :<message>\r\n"
+	if 512-len(prefix)-len(command)-len(targetString)-7 < len(message) {
+		return errAPIMessageTooLong
+	}
+	itemType := history.Privmsg
+	if command == "NOTICE" {
+		itemType = history.Notice
+	}
+
+	if channelName, err := CasefoldChannel(targetString); err == nil {
+		channel := server.channels.Get(channelName)
+		if channel == nil {
+			return errAPIMessageNoSuchTarget
+		}
+		message, err = channel.accountMessagePolicy(account, maskCasefolded, message)
+		if err != nil {
+			return err
+		}
+
+		msgid := server.generateMessageID()
+		if channel.history != nil {
+			channel.history.Add(history.Item{
+				Type:        itemType,
+				Time:        messageTime(msgid),
+				Nickmask:    prefix,
+				AccountName: account.Name,
+				Message:     message,
+				Msgid:       msgid,
+			})
+		}
+		channel.membersMutex.RLock()
+		for member := range channel.members {
+			if member.ignores.IsSilenced(maskCasefolded) {
+				continue
+			}
+			member.Send(member.accountMessageTags(account, msgid), prefix, command, channel.name, message)
+		}
+		channel.membersMutex.RUnlock()
+		return nil
+	}
+
+	target, err := CasefoldName(targetString)
+	if err != nil {
+		return errAPIMessageNoSuchTarget
+	}
+	if target == "chanserv" || target == "hostserv" || server.isNickServ(target) {
+		return errAPIMessageServices
+	}
+	user := server.clients.Get(target)
+	if user == nil {
+		return errAPIMessageNoSuchTarget
+	}
+	if user.account != account {
+		if user.hasFlag(SecureMessages) && !secure {
+			return errAPIMessageCannotSend
+		}
+		if user.ignores.IsSilenced(maskCasefolded) || (user.hasFlag(CallerID) && !user.ignores.IsAccepted(nickname)) {
+			return errAPIMessageCannotSend
+		}
+	}
+
+	msgid := server.generateMessageID()
+	if server.historyDirectMessages.Enabled {
+		item := history.Item{
+			Type:        itemType,
+			Time:        messageTime(msgid),
+			Nickmask:    prefix,
+			AccountName: account.Name,
+			Target:      user.nick,
+			Message:     message,
+			Msgid:       msgid,
+		}
+		server.addDirectMessageHistory(account, item)
+		if user.account != account {
+			server.addDirectMessageHistory(user.account, item)
+		}
+	}
+	user.Send(user.accountMessageTags(account, msgid), prefix, command, user.nick, message)
+	// the account's clients see what was sent in their name, like with echo-message
+	for _, accountClient := range account.getClients() {
+		if accountClient != user && accountClient.hasCapability(EchoMessage) {
+			accountClient.Send(accountClient.accountMessageTags(account, msgid), prefix, command, user.nick, message)
+		}
+	}
+	return nil
+}
+
+// accountMessageTags returns the tags to send this client with a message from the given
+// account.
+func (client *Client) accountMessageTags(account *ClientAccount, msgid string) *map[string]ircmsg.TagValue {
+	var tags *map[string]ircmsg.TagValue
+	if client.hasCapability(AccountTag) {
+		tags = tagsWith(tags, "account", account.Name)
+	}
+	return client.withMessageID(tags, msgid)
+}
+
+// accountMessagePolicy checks whether the account can send a message to this channel from
+// the given casefolded nickmask, and runs the message through the channel's message
+// policies. The account counts as being in the channel (and as having its modes) if any of
+// its clients are. It returns the message that should be relayed.
+func (channel *Channel) accountMessagePolicy(account *ClientAccount, maskCasefolded, message string) (string, error) {
+	channel.membersMutex.RLock()
+	var member, voiced, exempt bool
+	for client := range channel.members {
+		if client.account == account {
+			member = true
+			voiced = voiced || channel.clientIsAtLeastNoMutex(client, Voice)
+			exempt = exempt || channel.clientIsAtLeastNoMutex(client, ChannelOperator)
+		}
+	}
+	cannotSpeak := (channel.flags[NoOutside] && !member) || (channel.flags[Moderated] && !voiced)
+	filters := channel.wordFilters
+	urlPolicy := channel.urlPolicy
+	urlAllowlist := channel.urlAllowlist
+	channel.membersMutex.RUnlock()
+
+	if cannotSpeak {
+		return "", errAPIMessageCannotSend
+	}
+	if channel.lists[BanMask].Match(maskCasefolded) && !channel.lists[ExceptMask].Match(maskCasefolded) {
+		return "", errAPIMessageCannotSend
+	}
+	if exempt {
+		return message, nil
+	}
+	// there's no client to kick or ban, so those filters just block the message
+	message, action := channel.filterWords(filters, message, maskCasefolded)
+	if action != "" && action != WordFilterReplace {
+		return "", errAPIMessageFiltered
+	}
+	if !urlPolicyAllows(urlPolicy, urlAllowlist, true, voiced, message) {
+		return "", errAPIMessageFiltered
+	}
+	return message, nil
+}
+
+// restUserHistory returns the account's stored private messages, optionally only the ones
+// with the given `nick`, up to `limit` of them.
+func restUserHistory(w http.ResponseWriter, r *http.Request) {
+	account := restUserAuth(w, r, APIKeyScopeHistory)
+	if account == nil {
+		return
+	}
+	if account.getHistory() == nil {
+		restReply(w, http.StatusConflict, restUserError{"Your private messages are not being stored, turn this on with DMHISTORY ON"})
+		return
+	}
+
+	var nick string
+	if r.FormValue("nick") != "" {
+		var err error
+		nick, err = CasefoldName(r.FormValue("nick"))
+		if err != nil {
+			restReply(w, http.StatusBadRequest, restUserError{"Invalid nick"})
+			return
+		}
+	}
+	limit := defaultHistoryReplay
+	if r.FormValue("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(r.FormValue("limit"))
+		if err != nil || limit < 1 {
+			restReply(w, http.StatusBadRequest, restUserError{"Invalid limit"})
+			return
+		}
+		if maxHistoryReplay < limit {
+			limit = maxHistoryReplay
+		}
+	}
+
+	rs := restUserHistoryResp{
+		Messages: restAPIServer.accountDirectMessageHistory(account, nick, limit),
+	}
+	if rs.Messages == nil {
+		rs.Messages = []history.Item{}
+	}
+	restReply(w, http.StatusOK, rs)
+}
+
+// restUserSettings returns the account's settings, and changes them first for POST requests.
+// The `whois-channels` setting can be all, shared, none or default, and `dm-history` turns
+// storing private messages on or off. The account settings from NickServ SET can be changed
+// by name too, with default resetting them.
+func restUserSettings(w http.ResponseWriter, r *http.Request) {
+	account := restUserAuth(w, r, APIKeyScopeSettings)
+	if account == nil {
+		return
+	}
+	server := restAPIServer
+
+	if r.Method == "POST" {
+		if server.isReadOnly() {
+			restReply(w, http.StatusServiceUnavailable, restUserError{"The server is in read-only mode"})
+			return
+		}
+		if r.FormValue("whois-channels") != "" {
+			setting := strings.ToLower(r.FormValue("whois-channels"))
+			switch setting {
+			case WhoisChannelsAll, WhoisChannelsShared, WhoisChannelsNone:
+			case "default":
+				setting = ""
+			default:
+				restReply(w, http.StatusBadRequest, restUserError{"whois-channels must be all, shared, none or default"})
+				return
+			}
+			err := server.setAccountWhoisChannels(account, setting)
+			if err != nil {
+				restReply(w, http.StatusInternalServerError, restUserError{"Could not save setting"})
+				return
+			}
+		}
+		if r.FormValue("dm-history") != "" {
+			enabled, err := strconv.ParseBool(r.FormValue("dm-history"))
+			if err != nil {
+				restReply(w, http.StatusBadRequest, restUserError{"dm-history must be true or false"})
+				return
+			}
+			if enabled && !server.historyDirectMessages.Enabled {
+				restReply(w, http.StatusConflict, restUserError{"Private message history is not enabled on this server"})
+				return
+			}
+			err = server.setAccountDMHistory(account, enabled)
+			if err != nil {
+				restReply(w, http.StatusInternalServerError, restUserError{"Could not save setting"})
+				return
+			}
+		}
+		for name, setting := range accountSettings {
+			value := r.FormValue(name)
+			if value == "" {
+				continue
+			}
+			if strings.ToLower(value) == "default" {
+				value = ""
+			} else if _, err := setting.Parse(value); err != nil {
+				restReply(w, http.StatusBadRequest, restUserError{err.Error()})
+				return
+			}
+			_, err := server.setAccountSetting(account, name, value)
+			if err != nil {
+				restReply(w, http.StatusInternalServerError, restUserError{"Could not save setting"})
+				return
+			}
+		}
+	}
+
+	rs := restUserSettingsResp{
+		WhoisChannels: account.WhoisChannels,
+		DMHistory:     account.getHistory() != nil,
+		Settings:      make(map[string]string),
+	}
+	for name := range accountSettings {
+		rs.Settings[name] = account.Setting(name)
+	}
+	if rs.WhoisChannels == "" {
+		rs.WhoisChannels = "default"
+	}
+	restReply(w, http.StatusOK, rs)
+}
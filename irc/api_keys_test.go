@@ -0,0 +1,123 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/buntdb"
+)
+
+func TestParseAPIKeyScopes(t *testing.T) {
+	cases := []struct {
+		list   string
+		scopes []string
+	}{
+		{"", apiKeyScopes},
+		{"message", []string{APIKeyScopeMessage}},
+		{"History,SETTINGS", []string{APIKeyScopeHistory, APIKeyScopeSettings}},
+		{"message,admin", nil},
+		{"message,", nil},
+	}
+	for _, c := range cases {
+		scopes, err := parseAPIKeyScopes(c.list)
+		if !reflect.DeepEqual(scopes, c.scopes) || (err == nil) != (c.scopes != nil) {
+			t.Errorf("%q: expected %v, got %v %v", c.list, c.scopes, scopes, err)
+		}
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	server := newAccountsTestServer(t, "Alice", "Bob")
+	server.restAPI = &RestAPIConfig{APIKeys: APIKeysConfig{Enabled: true, MaxPerAccount: 2}}
+	restAPIServer = server
+	defer func() { restAPIServer = nil }()
+
+	messageKey, err := server.addAPIKey("alice", "bot", []string{APIKeyScopeMessage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	historyKey, err := server.addAPIKey("alice", "logs", []string{APIKeyScopeHistory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.addAPIKey("alice", "third", apiKeyScopes); err != errTooManyAPIKeys {
+		t.Errorf("expected the key limit to be enforced, got %v", err)
+	}
+	if _, err := server.addAPIKey("bob", "bot", apiKeyScopes); err != nil {
+		t.Errorf("expected names to only have to be unique per account, got %v", err)
+	}
+	if _, err := server.addAPIKey("bob", "bot", apiKeyScopes); err != errAPIKeyExists {
+		t.Errorf("expected a name that's already in use to be refused, got %v", err)
+	}
+
+	auth := func(token, scope string) (*ClientAccount, int) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/user/message", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		account := restUserAuth(w, r, scope)
+		return account, w.Code
+	}
+
+	cases := []struct {
+		name    string
+		token   string
+		scope   string
+		account string
+		status  int
+	}{
+		{"message key", messageKey, APIKeyScopeMessage, "Alice", http.StatusOK},
+		{"history key", historyKey, APIKeyScopeHistory, "Alice", http.StatusOK},
+		{"wrong scope", messageKey, APIKeyScopeHistory, "", http.StatusForbidden},
+		{"unknown key", messageKey + "0", APIKeyScopeMessage, "", http.StatusUnauthorized},
+		{"no key", "", APIKeyScopeMessage, "", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		account, status := auth(c.token, c.scope)
+		if status != c.status || (account == nil) != (c.account == "") || (account != nil && account.Name != c.account) {
+			t.Errorf("%s: expected %q with status %d, got %+v with status %d", c.name, c.account, c.status, account, status)
+		}
+	}
+
+	// suspended accounts' keys stop working
+	server.store.Update(func(tx *buntdb.Tx) error {
+		tx.Set(fmt.Sprintf(keyAccountSuspended, "alice"), "{}", nil)
+		return nil
+	})
+	if account, status := auth(messageKey, APIKeyScopeMessage); account != nil || status != http.StatusForbidden {
+		t.Errorf("expected a suspended account's key to be refused, got %+v with status %d", account, status)
+	}
+	server.store.Update(func(tx *buntdb.Tx) error {
+		tx.Delete(fmt.Sprintf(keyAccountSuspended, "alice"))
+		return nil
+	})
+
+	// deleted keys stop working, and don't leave their hash behind
+	server.store.Update(func(tx *buntdb.Tx) error {
+		if err := removeAPIKey(tx, "alice", "bot"); err != nil {
+			t.Error(err)
+		}
+		if err := removeAPIKey(tx, "alice", "bot"); err != errAPIKeyNotFound {
+			t.Errorf("expected deleting the key again to fail, got %v", err)
+		}
+		if _, err := tx.Get(fmt.Sprintf(keyAPIKeyToAccount, hashAPIKey(messageKey))); err != buntdb.ErrNotFound {
+			t.Error("expected the key's hash to be deleted")
+		}
+		return nil
+	})
+	if account, status := auth(messageKey, APIKeyScopeMessage); account != nil || status != http.StatusUnauthorized {
+		t.Errorf("expected a deleted key to be refused, got %+v with status %d", account, status)
+	}
+
+	server.restAPI.APIKeys.Enabled = false
+	if account, status := auth(historyKey, APIKeyScopeHistory); account != nil || status != http.StatusNotFound {
+		t.Errorf("expected keys to be refused when they're disabled, got %+v with status %d", account, status)
+	}
+}
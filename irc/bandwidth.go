@@ -0,0 +1,144 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+const (
+	// defaultBandwidthEntries is how many clients and channels BANDWIDTH lists by default.
+	defaultBandwidthEntries = 10
+	// maxBandwidthEntries is the most clients and channels BANDWIDTH will list.
+	maxBandwidthEntries = 100
+)
+
+// ClientBandwidth is how much data a client has sent and been sent.
+type ClientBandwidth struct {
+	Nick     string `json:"nick"`
+	BytesIn  uint64 `json:"bytes-in"`
+	BytesOut uint64 `json:"bytes-out"`
+}
+
+// ChannelBandwidth is how much message data has been relayed to a channel's members.
+type ChannelBandwidth struct {
+	Name        string `json:"name"`
+	Members     int    `json:"members"`
+	FanoutBytes uint64 `json:"fanout-bytes"`
+}
+
+// BandwidthStats is the server's data usage, with the clients and channels using the most.
+type BandwidthStats struct {
+	BytesIn  uint64 `json:"bytes-in"`
+	BytesOut uint64 `json:"bytes-out"`
+	// TopTalkers are the connected clients that have sent the most data.
+	TopTalkers []ClientBandwidth `json:"top-talkers"`
+	// TopReceivers are the connected clients that have been sent the most data.
+	TopReceivers []ClientBandwidth  `json:"top-receivers"`
+	TopChannels  []ChannelBandwidth `json:"top-channels"`
+}
+
+// addFanout counts the message that was just relayed to the given member.
+func (channel *Channel) addFanout(member *Client, message *SplitMessage) {
+	var length int
+	if member.hasCapability(MaxLine) {
+		length = len(message.ForMaxLine)
+	} else {
+		for _, line := range message.For512 {
+			length += len(line)
+		}
+	}
+	atomic.AddUint64(&channel.fanoutBytes, uint64(length))
+}
+
+// bandwidthStats returns the server's data usage, listing up to count clients and channels.
+func (server *Server) bandwidthStats(count int) BandwidthStats {
+	stats := BandwidthStats{
+		BytesIn:  atomic.LoadUint64(&server.closedBytesIn),
+		BytesOut: atomic.LoadUint64(&server.closedBytesOut),
+	}
+
+	var clients []ClientBandwidth
+	server.clients.ByNickMutex.RLock()
+	for _, client := range server.clients.ByNick {
+		usage := ClientBandwidth{
+			Nick:     client.nick,
+			BytesIn:  client.socket.BytesIn(),
+			BytesOut: client.socket.BytesOut(),
+		}
+		stats.BytesIn += usage.BytesIn
+		stats.BytesOut += usage.BytesOut
+		clients = append(clients, usage)
+	}
+	server.clients.ByNickMutex.RUnlock()
+
+	sort.Slice(clients, func(i, j int) bool { return clients[i].BytesIn > clients[j].BytesIn })
+	stats.TopTalkers = append(stats.TopTalkers, clients[:minInt(count, len(clients))]...)
+	sort.Slice(clients, func(i, j int) bool { return clients[i].BytesOut > clients[j].BytesOut })
+	stats.TopReceivers = append(stats.TopReceivers, clients[:minInt(count, len(clients))]...)
+
+	var channels []ChannelBandwidth
+	server.channels.ChansLock.RLock()
+	for _, channel := range server.channels.Chans {
+		channel.membersMutex.RLock()
+		members := len(channel.members)
+		channel.membersMutex.RUnlock()
+		channels = append(channels, ChannelBandwidth{
+			Name:        channel.name,
+			Members:     members,
+			FanoutBytes: atomic.LoadUint64(&channel.fanoutBytes),
+		})
+	}
+	server.channels.ChansLock.RUnlock()
+
+	sort.Slice(channels, func(i, j int) bool { return channels[i].FanoutBytes > channels[j].FanoutBytes })
+	stats.TopChannels = channels[:minInt(count, len(channels))]
+	return stats
+}
+
+// minInt returns the smaller of the given numbers.
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// BANDWIDTH [<count>]
+func bandwidthHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	count := defaultBandwidthEntries
+	if 0 < len(msg.Params) {
+		var err error
+		count, err = strconv.Atoi(msg.Params[0])
+		if err != nil || count < 1 {
+			rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "BANDWIDTH", msg.Params[0], "Count must be a positive number")
+			return false
+		}
+		if maxBandwidthEntries < count {
+			count = maxBandwidthEntries
+		}
+	}
+
+	stats := server.bandwidthStats(count)
+	rb.Notice(fmt.Sprintf("Total: %s in, %s out", bytefmt.ByteSize(stats.BytesIn), bytefmt.ByteSize(stats.BytesOut)))
+	rb.Notice("Top talkers:")
+	for _, usage := range stats.TopTalkers {
+		rb.Notice(fmt.Sprintf("  %s: %s in, %s out", usage.Nick, bytefmt.ByteSize(usage.BytesIn), bytefmt.ByteSize(usage.BytesOut)))
+	}
+	rb.Notice("Top receivers:")
+	for _, usage := range stats.TopReceivers {
+		rb.Notice(fmt.Sprintf("  %s: %s out, %s in", usage.Nick, bytefmt.ByteSize(usage.BytesOut), bytefmt.ByteSize(usage.BytesIn)))
+	}
+	rb.Notice("Top channels by fan-out:")
+	for _, usage := range stats.TopChannels {
+		rb.Notice(fmt.Sprintf("  %s: %s to %d members", usage.Name, bytefmt.ByteSize(usage.FanoutBytes), usage.Members))
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+const (
+	// BatchLabeledResponse holds the replies to a labeled command.
+	BatchLabeledResponse = "labeled-response"
+	// BatchChathistory holds history that's being replayed to the client.
+	BatchChathistory = "chathistory"
+	// BatchMultiline holds the lines of a single message that's been sent over several lines.
+	BatchMultiline = "draft/multiline"
+	// BatchNetsplit holds the quits caused by a server splitting from the network. Servers
+	// can't be linked yet, so this isn't sent.
+	BatchNetsplit = "netsplit"
+	// BatchNetjoin holds the joins caused by a server rejoining the network. Servers can't
+	// be linked yet, so this isn't sent.
+	BatchNetjoin = "netjoin"
+)
+
+// ClientBatch is a group of lines being sent to a client. If the client doesn't support
+// batches, the lines are sent to them normally.
+type ClientBatch struct {
+	client *Client
+	// ID is the batch's reference tag, or empty if the client doesn't support batches.
+	ID string
+	// parent is the batch this one is nested in, if there is one.
+	parent *ClientBatch
+	// rb is the response buffer the batch is sent through, if it's a reply to a command.
+	rb *ResponseBuffer
+}
+
+// nextBatchID returns a new reference tag for a batch sent to this client.
+func (client *Client) nextBatchID() string {
+	return strconv.FormatUint(uint64(atomic.AddUint32(&client.batchCounter, 1)), 36)
+}
+
+// StartBatch opens a new batch of the given type, sending the opening line with the given
+// tags. End must be called once all the batch's lines have been sent.
+func (client *Client) StartBatch(tags *map[string]ircmsg.TagValue, batchType string, params ...string) *ClientBatch {
+	return client.StartBatchFrom(client.server.name, tags, batchType, params...)
+}
+
+// StartBatchFrom is StartBatch with the given prefix, for batches like multiline messages
+// that come from another client rather than the server.
+func (client *Client) StartBatchFrom(prefix string, tags *map[string]ircmsg.TagValue, batchType string, params ...string) *ClientBatch {
+	return NewResponseBuffer(client).StartBatchFrom(prefix, tags, batchType, params...)
+}
+
+// StartBatch is StartBatch for a batch that's a reply to a command, so it's sent through
+// the response buffer.
+func (rb *ResponseBuffer) StartBatch(tags *map[string]ircmsg.TagValue, batchType string, params ...string) *ClientBatch {
+	return rb.StartBatchFrom(rb.target.server.name, tags, batchType, params...)
+}
+
+// StartBatchFrom is StartBatchFrom for a batch that's a reply to a command, so it's sent
+// through the response buffer.
+func (rb *ResponseBuffer) StartBatchFrom(prefix string, tags *map[string]ircmsg.TagValue, batchType string, params ...string) *ClientBatch {
+	client := rb.target
+	batch := &ClientBatch{
+		client: client,
+		rb:     rb,
+	}
+	if client.hasCapability(Batch) {
+		batch.ID = client.nextBatchID()
+		rb.Send(tags, prefix, "BATCH", append([]string{"+" + batch.ID, batchType}, params...)...)
+	}
+	return batch
+}
+
+// StartBatch opens a new batch nested inside this one.
+func (batch *ClientBatch) StartBatch(batchType string, params ...string) *ClientBatch {
+	nested := &ClientBatch{
+		client: batch.client,
+		parent: batch,
+		rb:     batch.rb,
+	}
+	if batch.ID != "" {
+		nested.ID = batch.client.nextBatchID()
+		batch.Send(nil, batch.client.server.name, "BATCH", append([]string{"+" + nested.ID, batchType}, params...)...)
+	}
+	return nested
+}
+
+// Send sends a line to the client as part of this batch. Lines that are already in a
+// nested batch keep their own batch tag.
+func (batch *ClientBatch) Send(tags *map[string]ircmsg.TagValue, prefix string, command string, params ...string) error {
+	if batch.ID != "" {
+		tags = tagsWith(tags, "batch", batch.ID)
+	}
+	return batch.rb.Send(tags, prefix, command, params...)
+}
+
+// End closes the batch.
+func (batch *ClientBatch) End() {
+	if batch.ID == "" {
+		return
+	}
+	if batch.parent != nil {
+		batch.parent.Send(nil, batch.client.server.name, "BATCH", "-"+batch.ID)
+	} else {
+		batch.rb.Send(nil, batch.client.server.name, "BATCH", "-"+batch.ID)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/history"
+	"github.com/oragono/oragono/irc/sno"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	keyAccountBot = "account.bot %s"
+)
+
+// isBot returns true if the client is logged into an account that opers have marked as a bot.
+func (client *Client) isBot() bool {
+	return client.account != &NoAccount && client.account.Bot
+}
+
+// setAccountBot stores whether the given account is a bot.
+func (server *Server) setAccountBot(account *ClientAccount, bot bool) error {
+	accountKey, _ := CasefoldName(account.Name)
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		var err error
+		if bot {
+			_, _, err = tx.Set(fmt.Sprintf(keyAccountBot, accountKey), "1", nil)
+		} else {
+			_, err = tx.Delete(fmt.Sprintf(keyAccountBot, accountKey))
+			if err == buntdb.ErrNotFound {
+				err = nil
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	account.Bot = bot
+	return nil
+}
+
+// isValidRelayNick returns true if the given nick can be used with RELAYMSG. Relayed nicks
+// must contain one of the separators, so they can't be mistaken for real clients.
+func (server *Server) isValidRelayNick(nick string) bool {
+	if len(nick) < 1 || server.limits.NickLen < len(nick) {
+		return false
+	}
+	if strings.ContainsAny(nick, " !@*?,:") || strings.HasPrefix(nick, "#") {
+		return false
+	}
+	return strings.ContainsAny(nick, server.bots.RelaymsgSeparators)
+}
+
+// SETBOT <account> <ON|OFF>
+func setbotHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	account := server.loadAccountByName(msg.Params[0])
+	if account == nil {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "SETBOT", msg.Params[0], "No such account")
+		return false
+	}
+
+	setting := strings.ToLower(msg.Params[1])
+	if setting != "on" && setting != "off" {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "SETBOT", msg.Params[1], "Setting must be ON or OFF")
+		return false
+	}
+	bot := setting == "on"
+	if !server.checkWritable(client, "SETBOT", rb) {
+		return false
+	}
+
+	err := server.setAccountBot(account, bot)
+	if err != nil {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "SETBOT", "Could not save the account")
+		server.logger.Error("internal", fmt.Sprintf("Could not save bot flag for account %s: %s", account.Name, err.Error()))
+		return false
+	}
+
+	if bot {
+		rb.Notice(fmt.Sprintf("Account %s is now a bot", account.Name))
+		server.logger.Info("opers", fmt.Sprintf("Oper %s [%s] marked account %s as a bot", client.nick, client.operName, account.Name))
+		server.snomasks.Send(sno.LocalOpers, fmt.Sprintf(ircfmt.Unescape("%s$r marked account $c[grey][$r%s$c[grey]] as a bot"), client.nick, account.Name))
+	} else {
+		rb.Notice(fmt.Sprintf("Account %s is no longer a bot", account.Name))
+		server.logger.Info("opers", fmt.Sprintf("Oper %s [%s] removed the bot flag from account %s", client.nick, client.operName, account.Name))
+		server.snomasks.Send(sno.LocalOpers, fmt.Sprintf(ircfmt.Unescape("%s$r removed the bot flag from account $c[grey][$r%s$c[grey]]"), client.nick, account.Name))
+	}
+	return false
+}
+
+// RELAYMSG <channel> <nick> <message>
+func relaymsgHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	if !client.isBot() && !client.HasCapabs("relaymsg") {
+		rb.Send(nil, server.name, ERR_NOPRIVILEGES, client.nick, "Permission Denied - Only bots can relay messages")
+		return false
+	}
+
+	channelName, err := CasefoldChannel(msg.Params[0])
+	channel := server.channels.Get(channelName)
+	if err != nil || channel == nil {
+		rb.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, msg.Params[0], "No such channel")
+		return false
+	}
+	if !channel.CanSpeak(client) {
+		rb.Send(nil, server.name, ERR_CANNOTSENDTOCHAN, channel.name, "Cannot send to channel")
+		return false
+	}
+
+	nick := msg.Params[1]
+	if !server.isValidRelayNick(nick) {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "RELAYMSG", nick, fmt.Sprintf("Relayed nicks must contain one of these characters: %s", server.bots.RelaymsgSeparators))
+		return false
+	}
+	message := msg.Params[2]
+	if len(message) < 1 {
+		return false
+	}
+	message, allowed := channel.applyMessagePolicy(client, "RELAYMSG", message)
+	if !allowed {
+		return false
+	}
+	if allowed, wait := channel.CheckSlowMode(client); !allowed {
+		channel.sendSlowModeFail(client, "RELAYMSG", wait, rb)
+		return false
+	}
+	prefix := fmt.Sprintf("%s!relay@%s", nick, client.hostname)
+	splitMsg, allowed := server.splitMessageFrom(prefix, "PRIVMSG", channel.name, message)
+	if !allowed {
+		rb.Send(nil, server.name, "FAIL", "RELAYMSG", "MESSAGE_TOO_LONG", channel.name, fmt.Sprintf("Message is too long, messages to %s can be at most %d bytes", channel.name, relayLenFrom(prefix, "PRIVMSG", channel.name)))
+		return false
+	}
+
+	msgid := server.generateMessageID()
+	if channel.history != nil {
+		channel.history.Add(history.Item{
+			Type:     history.Privmsg,
+			Time:     messageTime(msgid),
+			Nickmask: prefix,
+			Message:  splitMsg.ForMaxLine,
+			Msgid:    msgid,
+			Tags:     map[string]string{"draft/relaymsg": client.nick},
+		})
+	}
+
+	channel.membersMutex.RLock()
+	defer channel.membersMutex.RUnlock()
+
+	for member := range channel.members {
+		if member == client && !client.hasCapability(EchoMessage) {
+			continue
+		}
+		if member.ignores.IsSilenced(client.nickMaskCasefolded) {
+			continue
+		}
+		var tags *map[string]ircmsg.TagValue
+		if member.hasCapability(MessageTags) {
+			tags = ircmsg.MakeTags("draft/relaymsg", client.nick)
+		}
+		// the sender's echo is a reply to their command
+		memberRb := rb
+		if member != client {
+			memberRb = NewResponseBuffer(member)
+		}
+		memberRb.SendSplitMsg(member.withMessageID(tags, msgid), prefix, "PRIVMSG", channel.name, splitMsg)
+		channel.addFanout(member, &splitMsg)
+	}
+	return false
+}
@@ -20,6 +20,8 @@ const (
 	AccountTag Capability = "account-tag"
 	// AwayNotify is this IRCv3 capability: http://ircv3.net/specs/extensions/away-notify-3.1.html
 	AwayNotify Capability = "away-notify"
+	// Batch is this IRCv3 capability: http://ircv3.net/specs/extensions/batch-3.2.html
+	Batch Capability = "batch"
 	// CapNotify is this IRCv3 capability: http://ircv3.net/specs/extensions/cap-notify-3.2.html
 	CapNotify Capability = "cap-notify"
 	// ChgHost is this IRCv3 capability: http://ircv3.net/specs/extensions/chghost-3.2.html
@@ -30,12 +32,18 @@ const (
 	ExtendedJoin Capability = "extended-join"
 	// InviteNotify is this IRCv3 capability: http://ircv3.net/specs/extensions/invite-notify-3.2.html
 	InviteNotify Capability = "invite-notify"
+	// LabeledResponse is the IRCv3 capability for matching replies to the commands that caused them
+	LabeledResponse Capability = "labeled-response"
 	// MaxLine is this proposed capability: https://github.com/DanielOaks/ircv3-specifications/blob/master+line-lengths/extensions/line-lengths.md
 	MaxLine Capability = "draft/maxline"
 	// MessageIDs is this draft IRCv3 capability: http://ircv3.net/specs/extensions/message-ids.html
 	MessageIDs Capability = "draft/message-ids"
+	// MessageRedaction is the draft IRCv3 capability for removing messages that were already sent
+	MessageRedaction Capability = "draft/message-redaction"
 	// MessageTags is this draft IRCv3 capability: http://ircv3.net/specs/core/message-tags-3.3.html
 	MessageTags Capability = "draft/message-tags-0.2"
+	// Multiline is the draft IRCv3 capability for sending messages of several lines as a batch
+	Multiline Capability = "draft/multiline"
 	// MultiPrefix is this IRCv3 capability: http://ircv3.net/specs/extensions/multi-prefix-3.1.html
 	MultiPrefix Capability = "multi-prefix"
 	// Rename is this proposed capability: https://github.com/SaberUK/ircv3-specifications/blob/rename/extensions/rename.md
@@ -53,17 +61,21 @@ const (
 var (
 	// SupportedCapabilities are the caps we advertise.
 	SupportedCapabilities = CapabilitySet{
-		AccountTag:    true,
-		AccountNotify: true,
-		AwayNotify:    true,
-		CapNotify:     true,
-		ChgHost:       true,
-		EchoMessage:   true,
-		ExtendedJoin:  true,
-		InviteNotify:  true,
-		MessageIDs:    true,
+		AccountTag:      true,
+		AccountNotify:   true,
+		AwayNotify:      true,
+		Batch:           true,
+		CapNotify:       true,
+		ChgHost:         true,
+		EchoMessage:     true,
+		ExtendedJoin:    true,
+		InviteNotify:    true,
+		LabeledResponse: true,
+		MessageIDs:      true,
+		// MessageRedaction is set during server startup
 		// MaxLine is set during server startup
 		MessageTags: true,
+		// Multiline is set during server startup
 		MultiPrefix: true,
 		Rename:      true,
 		// SASL is set during server startup
@@ -73,7 +85,7 @@ var (
 	}
 	// CapValues are the actual values we advertise to v3.2 clients.
 	CapValues = map[Capability]string{
-		SASL: "PLAIN,EXTERNAL",
+		SASL: "PLAIN,EXTERNAL,SCRAM-SHA-256",
 	}
 )
 
@@ -107,9 +119,12 @@ const (
 type CapabilitySet map[Capability]bool
 
 func (set CapabilitySet) String(version CapVersion) string {
-	strs := make([]string, len(set))
-	index := 0
-	for capability := range set {
+	var strs []string
+	for capability, enabled := range set {
+		// caps get set to false when they're turned off during a rehash
+		if !enabled {
+			continue
+		}
 		capString := string(capability)
 		if version == Cap302 {
 			val, exists := CapValues[capability]
@@ -117,14 +132,42 @@ func (set CapabilitySet) String(version CapVersion) string {
 				capString += "=" + val
 			}
 		}
-		strs[index] = capString
-		index++
+		strs = append(strs, capString)
 	}
 	return strings.Join(strs, " ")
 }
 
+// hasCapability returns true if the client has the given capability enabled.
+func (client *Client) hasCapability(capability Capability) bool {
+	client.capabilitiesMutex.RLock()
+	defer client.capabilitiesMutex.RUnlock()
+	return client.capabilities[capability]
+}
+
+// setCapabilities turns the given capabilities on or off for the client. Other goroutines
+// check a client's capabilities whenever they send it something (and rehashes turn them off),
+// so they're only ever changed under the lock.
+func (client *Client) setCapabilities(enabled bool, capabilities ...Capability) {
+	client.capabilitiesMutex.Lock()
+	defer client.capabilitiesMutex.Unlock()
+	for _, capability := range capabilities {
+		if enabled {
+			client.capabilities[capability] = true
+		} else {
+			delete(client.capabilities, capability)
+		}
+	}
+}
+
+// capabilityString returns the client's enabled capabilities, for CAP LIST.
+func (client *Client) capabilityString(version CapVersion) string {
+	client.capabilitiesMutex.RLock()
+	defer client.capabilitiesMutex.RUnlock()
+	return client.capabilities.String(version)
+}
+
 // CAP <subcmd> [<caps>]
-func capHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func capHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	subCommand := strings.ToUpper(msg.Params[0])
 	capabilities := make(CapabilitySet)
 	var capString string
@@ -146,28 +189,32 @@ func capHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 		}
 		if len(msg.Params) > 1 && msg.Params[1] == "302" {
 			client.capVersion = 302
+			// cap-notify is always on for 302 clients
+			client.setCapabilities(true, CapNotify)
 		}
 		// weechat 1.4 has a bug here where it won't accept the CAP reply unless it contains
 		// the server.name source... otherwise it doesn't respond to the CAP message with
 		// anything and just hangs on connection.
 		//TODO(dan): limit number of caps and send it multiline in 3.2 style as appropriate.
-		client.Send(nil, server.name, "CAP", client.nick, subCommand, SupportedCapabilities.String(client.capVersion))
+		rb.Send(nil, server.name, "CAP", client.nick, subCommand, SupportedCapabilities.String(client.capVersion))
 
 	case "LIST":
-		client.Send(nil, server.name, "CAP", client.nick, subCommand, client.capabilities.String(Cap301)) // values not sent on LIST so force 3.1
+		rb.Send(nil, server.name, "CAP", client.nick, subCommand, client.capabilityString(Cap301)) // values not sent on LIST so force 3.1
 
 	case "REQ":
 		// make sure all capabilities actually exist
 		for capability := range capabilities {
 			if !SupportedCapabilities[capability] {
-				client.Send(nil, server.name, "CAP", client.nick, "NAK", capString)
+				rb.Send(nil, server.name, "CAP", client.nick, "NAK", capString)
 				return false
 			}
 		}
+		var requested []Capability
 		for capability := range capabilities {
-			client.capabilities[capability] = true
+			requested = append(requested, capability)
 		}
-		client.Send(nil, server.name, "CAP", client.nick, "ACK", capString)
+		client.setCapabilities(true, requested...)
+		rb.Send(nil, server.name, "CAP", client.nick, "ACK", capString)
 
 	case "END":
 		if !client.registered {
@@ -176,7 +223,7 @@ func capHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 		}
 
 	default:
-		client.Send(nil, server.name, ERR_INVALIDCAPCMD, client.nick, subCommand, "Invalid CAP subcommand")
+		rb.Send(nil, server.name, ERR_INVALIDCAPCMD, client.nick, subCommand, "Invalid CAP subcommand")
 	}
 	return false
 }
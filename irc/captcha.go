@@ -0,0 +1,309 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/oragono/oragono/irc/sno"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	// keyAccountCaptchaToken holds the hash of the token in the CAPTCHA link given to a new
+	// account, and expires along with it.
+	keyAccountCaptchaToken = "account.captchatoken %s"
+
+	defaultCaptchaTimeout = 10 * time.Second
+)
+
+var (
+	errCaptchaNotConfigured = errors.New("CAPTCHA verification isn't set up on this server")
+	errCaptchaInvalidToken  = errors.New("Invalid or expired token")
+	errCaptchaReadOnly      = errors.New("The server is in read-only mode")
+)
+
+// captchaProvider is a CAPTCHA service that clients solve in their browser. They all work
+// the same way: the widget puts a response into the form, and we check it with the
+// provider's siteverify endpoint.
+type captchaProvider struct {
+	scriptURL     string
+	widgetClass   string
+	responseField string
+	verifyURL     string
+}
+
+var captchaProviders = map[string]captchaProvider{
+	"hcaptcha": {
+		scriptURL:     "https://js.hcaptcha.com/1/api.js",
+		widgetClass:   "h-captcha",
+		responseField: "h-captcha-response",
+		verifyURL:     "https://api.hcaptcha.com/siteverify",
+	},
+	"recaptcha": {
+		scriptURL:     "https://www.google.com/recaptcha/api.js",
+		widgetClass:   "g-recaptcha",
+		responseField: "g-recaptcha-response",
+		verifyURL:     "https://www.google.com/recaptcha/api/siteverify",
+	},
+	"turnstile": {
+		scriptURL:     "https://challenges.cloudflare.com/turnstile/v0/api.js",
+		widgetClass:   "cf-turnstile",
+		responseField: "cf-turnstile-response",
+		verifyURL:     "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	},
+}
+
+// CaptchaConfig controls the captcha callback, where new accounts are verified by solving a
+// CAPTCHA on a page served by its own listener. That listener only serves the CAPTCHA pages,
+// so it can be public without exposing the REST API.
+type CaptchaConfig struct {
+	Listen string
+	// URL is where users reach the listener, like https://irc.example.com:8091
+	URL       string
+	Provider  string
+	SiteKey   string `yaml:"site-key"`
+	SecretKey string `yaml:"secret-key"`
+	// VerifyURL replaces the provider's siteverify endpoint, for self-hosted services with a
+	// compatible API.
+	VerifyURL     string        `yaml:"verify-url"`
+	TimeoutString string        `yaml:"timeout"`
+	Timeout       time.Duration `yaml:"timeout-real"`
+
+	provider captchaProvider
+}
+
+// load checks the config and fills in the provider.
+func (conf *CaptchaConfig) load() (err error) {
+	if conf.Provider == "" {
+		return nil
+	}
+	var exists bool
+	conf.provider, exists = captchaProviders[conf.Provider]
+	if !exists {
+		return fmt.Errorf("Unknown provider %s, it must be hcaptcha, recaptcha or turnstile", conf.Provider)
+	}
+	if conf.Listen == "" || conf.URL == "" || conf.SiteKey == "" || conf.SecretKey == "" {
+		return errors.New("listen, url, site-key and secret-key must be set")
+	}
+	conf.URL = strings.TrimSuffix(conf.URL, "/")
+	if conf.VerifyURL != "" {
+		conf.provider.verifyURL = conf.VerifyURL
+	}
+	conf.Timeout = defaultCaptchaTimeout
+	if conf.TimeoutString != "" {
+		conf.Timeout, err = time.ParseDuration(conf.TimeoutString)
+		if err != nil {
+			return fmt.Errorf("Could not parse timeout: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// Enabled returns true if a CAPTCHA provider is set up.
+func (conf *CaptchaConfig) Enabled() bool {
+	return conf.Provider != ""
+}
+
+// verify asks the provider whether the response from the CAPTCHA widget is a solution.
+func (conf *CaptchaConfig) verify(response string) (bool, error) {
+	form := url.Values{}
+	form.Set("secret", conf.SecretKey)
+	form.Set("response", response)
+	httpClient := http.Client{Timeout: conf.Timeout}
+	resp, err := httpClient.PostForm(conf.provider.verifyURL, form)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("siteverify endpoint returned %s", resp.Status)
+	}
+	var result struct {
+		Success bool `json:"success"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
+
+// sendCaptchaLink gives the client a link to a CAPTCHA that verifies their new account.
+func (server *Server) sendCaptchaLink(client *Client, accountKey, accountName string, rb *ResponseBuffer) {
+	if !server.checkWritable(client, "ACC", rb) {
+		removeFailedAccRegisterData(server.store, accountKey)
+		return
+	}
+	token := randomMailToken()
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(fmt.Sprintf(keyAccountCaptchaToken, accountKey), resetCodeHash(token), &buntdb.SetOptions{Expires: true, TTL: server.accountRegistration.VerifyTimeout})
+		return err
+	})
+	if err != nil {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "ACC", "REGISTER", "Could not register")
+		server.logger.Error("internal", fmt.Sprintf("Could not save captcha token for account %s: %s", accountName, err.Error()))
+		removeFailedAccRegisterData(server.store, accountKey)
+		return
+	}
+
+	link := fmt.Sprintf("%s/captcha/%s/%s", server.captcha.URL, url.PathEscape(accountKey), token)
+	rb.Send(nil, server.name, RPL_REG_VERIFICATION_REQUIRED, client.nick, accountName, fmt.Sprintf("To finish registering, solve the CAPTCHA at %s", link))
+}
+
+// checkCaptchaToken returns true if the token is the one we gave to the account.
+func checkCaptchaToken(tx *buntdb.Tx, accountKey, token string) bool {
+	hash, err := tx.Get(fmt.Sprintf(keyAccountCaptchaToken, accountKey))
+	return err == nil && subtle.ConstantTimeCompare([]byte(hash), []byte(resetCodeHash(token))) == 1
+}
+
+// verifyCaptchaAccount verifies the account if the token is still valid.
+func (server *Server) verifyCaptchaAccount(accountKey, token string) (accountName string, err error) {
+	if server.isReadOnly() {
+		return "", errCaptchaReadOnly
+	}
+	err = server.store.Update(func(tx *buntdb.Tx) error {
+		if !checkCaptchaToken(tx, accountKey, token) {
+			return errCaptchaInvalidToken
+		}
+		tx.Delete(fmt.Sprintf(keyAccountCaptchaToken, accountKey))
+		tx.Set(fmt.Sprintf(keyAccountVerified, accountKey), "1", nil)
+		accountName, _ = tx.Get(fmt.Sprintf(keyAccountName, accountKey))
+		return nil
+	})
+	return
+}
+
+// startCaptchaListener starts serving the CAPTCHA pages. Nothing else is served on this
+// listener, since it has to be reachable by anyone registering an account.
+func (server *Server) startCaptchaListener() error {
+	listener, err := net.Listen("tcp", server.captcha.Listen)
+	if err != nil {
+		return err
+	}
+	server.captchaListener = listener
+	r := mux.NewRouter()
+	r.HandleFunc("/captcha/{account}/{token}", server.serveCaptcha).Methods("GET", "POST")
+	go http.Serve(listener, r)
+	return nil
+}
+
+// stopCaptchaListener stops serving the CAPTCHA pages.
+func (server *Server) stopCaptchaListener() {
+	if server.captchaListener != nil {
+		server.captchaListener.Close()
+		server.captchaListener = nil
+	}
+}
+
+// captchaPage is what we show at the CAPTCHA link.
+type captchaPage struct {
+	NetworkName string
+	Account     string
+	Message     string
+	// Solved is true once the account is verified, and hides the form.
+	Solved      bool
+	ScriptURL   string
+	WidgetClass string
+	SiteKey     string
+}
+
+var captchaPageTemplate = template.Must(template.New("captcha").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.NetworkName}} account verification</title>
+{{if not .Solved}}<script src="{{.ScriptURL}}" async defer></script>{{end}}
+</head>
+<body>
+<h1>{{.NetworkName}}</h1>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{if not .Solved}}<form method="post">
+<p>Solve the CAPTCHA below to verify the account <b>{{.Account}}</b>.</p>
+<div class="{{.WidgetClass}}" data-sitekey="{{.SiteKey}}"></div>
+<p><button type="submit">Verify</button></p>
+</form>{{end}}
+</body>
+</html>
+`))
+
+// serveCaptcha shows the CAPTCHA for a new account, and verifies the account once it's solved.
+// This is for users to open in their browser.
+func (server *Server) serveCaptcha(w http.ResponseWriter, r *http.Request) {
+	config := server.captcha
+	vars := mux.Vars(r)
+	accountKey, token := vars["account"], vars["token"]
+
+	page := captchaPage{
+		NetworkName: server.networkName,
+		Account:     accountKey,
+		ScriptURL:   config.provider.scriptURL,
+		WidgetClass: config.provider.widgetClass,
+		SiteKey:     config.SiteKey,
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	showPage := func(status int) {
+		w.WriteHeader(status)
+		captchaPageTemplate.Execute(w, page)
+	}
+
+	var valid bool
+	server.store.View(func(tx *buntdb.Tx) error {
+		valid = checkCaptchaToken(tx, accountKey, token)
+		if valid {
+			page.Account, _ = tx.Get(fmt.Sprintf(keyAccountName, accountKey))
+		}
+		return nil
+	})
+	if !config.Enabled() || !valid {
+		page.Solved = true
+		page.Message = "This link is invalid or has expired."
+		showPage(http.StatusNotFound)
+		return
+	}
+	if r.Method != "POST" {
+		showPage(http.StatusOK)
+		return
+	}
+
+	solved, err := config.verify(r.FormValue(config.provider.responseField))
+	if err != nil {
+		server.logger.Error("accounts", fmt.Sprintf("Could not check captcha for account %s: %s", page.Account, err.Error()))
+		page.Message = "We couldn't check your answer, please try again."
+		showPage(http.StatusBadGateway)
+		return
+	} else if !solved {
+		page.Message = "That wasn't right, please try again."
+		showPage(http.StatusForbidden)
+		return
+	}
+
+	accountName, err := server.verifyCaptchaAccount(accountKey, token)
+	if err == errCaptchaReadOnly {
+		page.Message = "The server is down for maintenance, please try again later."
+		showPage(http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		page.Solved = true
+		page.Message = "This link is invalid or has expired."
+		showPage(http.StatusNotFound)
+		return
+	}
+	server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Account verified $c[grey][$r%s$c[grey]] by CAPTCHA"), accountName))
+	page.Solved = true
+	page.Message = fmt.Sprintf("The account %s is now verified, and you can log in to it.", accountName)
+	showPage(http.StatusOK)
+}
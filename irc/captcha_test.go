@@ -0,0 +1,44 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+)
+
+func TestCaptchaConfigLoad(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  CaptchaConfig
+		valid   bool
+		enabled bool
+	}{
+		{"off", CaptchaConfig{}, true, false},
+		{"complete", CaptchaConfig{Listen: "localhost:8091", URL: "https://example.com/captcha/", Provider: "hcaptcha", SiteKey: "site", SecretKey: "secret"}, true, true},
+		{"no listener", CaptchaConfig{URL: "https://example.com", Provider: "hcaptcha", SiteKey: "site", SecretKey: "secret"}, false, false},
+		{"no keys", CaptchaConfig{Listen: "localhost:8091", URL: "https://example.com", Provider: "turnstile"}, false, false},
+		{"unknown provider", CaptchaConfig{Listen: "localhost:8091", URL: "https://example.com", Provider: "mystery", SiteKey: "site", SecretKey: "secret"}, false, false},
+		{"bad timeout", CaptchaConfig{Listen: "localhost:8091", URL: "https://example.com", Provider: "recaptcha", SiteKey: "site", SecretKey: "secret", TimeoutString: "soon"}, false, false},
+	}
+	for _, c := range cases {
+		config := c.config
+		err := config.load()
+		if (err == nil) != c.valid {
+			t.Errorf("%s: expected valid to be %v, got error %v", c.name, c.valid, err)
+			continue
+		}
+		if err == nil && config.Enabled() != c.enabled {
+			t.Errorf("%s: expected enabled to be %v", c.name, c.enabled)
+		}
+	}
+
+	config := CaptchaConfig{Listen: "localhost:8091", URL: "https://example.com/captcha/", Provider: "hcaptcha", SiteKey: "site", SecretKey: "secret"}
+	config.load()
+	if config.URL != "https://example.com/captcha" {
+		t.Errorf("expected the url's trailing slash to be removed, got %s", config.URL)
+	}
+	if config.provider.verifyURL != captchaProviders["hcaptcha"].verifyURL || config.Timeout != defaultCaptchaTimeout {
+		t.Errorf("expected the provider's defaults, got %s and %s", config.provider.verifyURL, config.Timeout)
+	}
+}
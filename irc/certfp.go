@@ -0,0 +1,190 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	// maxAccountCertificates is how many certificate fingerprints an account can have.
+	maxAccountCertificates = 5
+)
+
+var (
+	errCertfpInvalid     = errors.New("That isn't a valid certificate fingerprint")
+	errCertfpInUse       = errors.New("That certificate fingerprint is already attached to an account")
+	errCertfpNotAttached = errors.New("That certificate fingerprint isn't attached to your account")
+	errTooManyCertfps    = errors.New("Your account has too many certificate fingerprints, remove some first")
+)
+
+// normalizeCertfp returns the given fingerprint in the same form as Socket.CertFP, accepting
+// the colon-separated and uppercase forms that tools like openssl print.
+func normalizeCertfp(certfp string) (string, error) {
+	certfp = strings.ToLower(strings.Replace(certfp, ":", "", -1))
+	decoded, err := hex.DecodeString(certfp)
+	if err != nil || len(decoded) != 32 {
+		return "", errCertfpInvalid
+	}
+	return certfp, nil
+}
+
+// certificates returns all the certificate fingerprints attached to the account.
+func (creds *AccountCredentials) certificates() []string {
+	var certfps []string
+	if creds.Certificate != "" {
+		certfps = append(certfps, creds.Certificate)
+	}
+	return append(certfps, creds.Certificates...)
+}
+
+// hasCertificate returns true if the given fingerprint is attached to the account.
+func (creds *AccountCredentials) hasCertificate(certfp string) bool {
+	if certfp == "" {
+		return false
+	}
+	for _, fp := range creds.certificates() {
+		if fp == certfp {
+			return true
+		}
+	}
+	return false
+}
+
+// addCertificate attaches the given fingerprint to the account in the store.
+func addCertificate(tx *buntdb.Tx, accountKey, certfp string) error {
+	certKey := fmt.Sprintf(keyCertToAccount, certfp)
+	if _, err := tx.Get(certKey); err == nil {
+		return errCertfpInUse
+	}
+	creds, err := loadAccountCredentials(tx, accountKey)
+	if err != nil {
+		return err
+	}
+	if maxAccountCertificates <= len(creds.certificates()) {
+		return errTooManyCertfps
+	}
+	if creds.Certificate == "" {
+		creds.Certificate = certfp
+	} else {
+		creds.Certificates = append(creds.Certificates, certfp)
+	}
+	credText, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	tx.Set(fmt.Sprintf(keyAccountCredentials, accountKey), string(credText), nil)
+	tx.Set(certKey, accountKey, nil)
+	return nil
+}
+
+// removeCertificate detaches the given fingerprint from the account in the store.
+func removeCertificate(tx *buntdb.Tx, accountKey, certfp string) error {
+	creds, err := loadAccountCredentials(tx, accountKey)
+	if err != nil {
+		return err
+	}
+	if !creds.hasCertificate(certfp) {
+		return errCertfpNotAttached
+	}
+	if creds.Certificate == certfp {
+		creds.Certificate = ""
+	}
+	var remaining []string
+	for _, fp := range creds.Certificates {
+		if fp != certfp {
+			remaining = append(remaining, fp)
+		}
+	}
+	creds.Certificates = remaining
+	credText, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	tx.Set(fmt.Sprintf(keyAccountCredentials, accountKey), string(credText), nil)
+	tx.Delete(fmt.Sprintf(keyCertToAccount, certfp))
+	return nil
+}
+
+// nickservCert handles NickServ CERT, which manages the certificate fingerprints that can be
+// used to log into your account with SASL EXTERNAL.
+//
+// CERT LIST | CERT ADD [<fingerprint>] | CERT DEL <fingerprint>
+func (server *Server) nickservCert(client *Client, params []string, rb *ResponseBuffer) {
+	if client.account == &NoAccount {
+		rb.NickServNotice("You must be logged into an account to manage its certificate fingerprints")
+		return
+	}
+	accountKey, _ := CasefoldName(client.account.Name)
+
+	subcommand := "list"
+	if 0 < len(params) {
+		subcommand = strings.ToLower(params[0])
+	}
+
+	switch subcommand {
+	case "list":
+		var creds *AccountCredentials
+		err := server.store.View(func(tx *buntdb.Tx) error {
+			var err error
+			creds, err = loadAccountCredentials(tx, accountKey)
+			return err
+		})
+		if err != nil || len(creds.certificates()) == 0 {
+			rb.NickServNotice("Your account has no certificate fingerprints")
+			return
+		}
+		rb.NickServNotice("Certificate fingerprints for your account:")
+		for _, certfp := range creds.certificates() {
+			rb.NickServNotice(certfp)
+		}
+	case "add", "del":
+		certfp := client.certfp
+		if 1 < len(params) {
+			certfp = params[1]
+		} else if subcommand == "del" || certfp == "" {
+			rb.NickServNotice(fmt.Sprintf("Syntax: CERT %s <fingerprint>", strings.ToUpper(subcommand)))
+			return
+		}
+		certfp, err := normalizeCertfp(certfp)
+		if err != nil {
+			rb.NickServNotice(err.Error())
+			return
+		}
+		if !server.checkWritable(client, "NICKSERV", rb) {
+			return
+		}
+
+		err = server.store.Update(func(tx *buntdb.Tx) error {
+			if subcommand == "add" {
+				return addCertificate(tx, accountKey, certfp)
+			}
+			return removeCertificate(tx, accountKey, certfp)
+		})
+		switch err {
+		case nil:
+		case errCertfpInUse, errCertfpNotAttached, errTooManyCertfps:
+			rb.NickServNotice(err.Error())
+			return
+		default:
+			rb.NickServNotice("Could not update your certificate fingerprints")
+			server.logger.Error("internal", fmt.Sprintf("Could not update certfps for account %s: %s", client.account.Name, err.Error()))
+			return
+		}
+
+		if subcommand == "add" {
+			rb.NickServNotice(fmt.Sprintf("Added certificate fingerprint %s to your account", certfp))
+		} else {
+			rb.NickServNotice(fmt.Sprintf("Removed certificate fingerprint %s from your account", certfp))
+		}
+	default:
+		rb.NickServNotice("Syntax: CERT LIST | CERT ADD [<fingerprint>] | CERT DEL <fingerprint>")
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+const (
+	// challengeLength is how many random bytes we encrypt for each challenge.
+	challengeLength = 32
+	// challengeLifetime is how long clients have to answer a challenge.
+	challengeLifetime = 5 * time.Minute
+	// challengeLineLength is how much of the encrypted challenge we send on each line.
+	challengeLineLength = 400
+)
+
+// operChallenge is a CHALLENGE login that's waiting for the client's response.
+type operChallenge struct {
+	name     string
+	response []byte
+	expires  time.Time
+}
+
+// loadChallengeKey reads an RSA public key from the given PEM file.
+func loadChallengeKey(path string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("File does not contain a PEM-encoded key")
+	}
+
+	var key interface{}
+	if block.Type == "RSA PUBLIC KEY" {
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, isRSA := key.(*rsa.PublicKey)
+	if !isRSA {
+		return nil, errors.New("Key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// CHALLENGE <name>
+// CHALLENGE +<response>
+//
+// This works the same way as the ratbox CHALLENGE command, so existing tools like `respond`
+// can be used to answer challenges. The server encrypts some random bytes with the oper's
+// public key, and the client proves they have the private key by sending back the base64'd
+// SHA1 hash of those bytes. The oper's password never crosses the wire.
+func challengeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	if strings.HasPrefix(msg.Params[0], "+") {
+		challenge := client.operChallenge
+		client.operChallenge = nil
+		response, err := base64.StdEncoding.DecodeString(msg.Params[0][1:])
+		if challenge == nil || time.Now().After(challenge.expires) || err != nil || subtle.ConstantTimeCompare(response, challenge.response) != 1 {
+			rb.Send(nil, server.name, ERR_PASSWDMISMATCH, client.nick, "Password incorrect")
+			server.logger.Info("opers", fmt.Sprintf("Client %s failed a CHALLENGE login", client.nickMaskString))
+			return false
+		}
+		// the oper may have been removed while the challenge was pending
+		if server.operators[challenge.name].PublicKey == nil {
+			rb.Send(nil, server.name, ERR_NOOPERHOST, client.nick, "No appropriate operator blocks were found for your host")
+			return false
+		}
+		server.operUp(client, challenge.name, "challenge", rb)
+		return false
+	}
+
+	name, err := CasefoldName(msg.Params[0])
+	key := server.operators[name].PublicKey
+	if err != nil || key == nil {
+		rb.Send(nil, server.name, ERR_NOOPERHOST, client.nick, "No appropriate operator blocks were found for your host")
+		return false
+	}
+
+	secret := make([]byte, challengeLength)
+	var encrypted []byte
+	_, err = rand.Read(secret)
+	if err == nil {
+		encrypted, err = rsa.EncryptOAEP(sha1.New(), rand.Reader, key, secret, nil)
+	}
+	if err != nil {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "CHALLENGE", "Could not create challenge")
+		server.logger.Error("internal", fmt.Sprintf("Could not create CHALLENGE for oper %s: %s", name, err.Error()))
+		return false
+	}
+	hash := sha1.Sum(secret)
+	client.operChallenge = &operChallenge{
+		name:     name,
+		response: hash[:],
+		expires:  time.Now().Add(challengeLifetime),
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(encrypted)
+	for 0 < len(encoded) {
+		line := encoded
+		if challengeLineLength < len(line) {
+			line = line[:challengeLineLength]
+		}
+		encoded = encoded[len(line):]
+		rb.Send(nil, server.name, RPL_RSACHALLENGE2, client.nick, line)
+	}
+	rb.Send(nil, server.name, RPL_ENDOFRSACHALLENGE2, client.nick, "End of CHALLENGE")
+	return false
+}
@@ -9,29 +9,51 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
 	"time"
 
 	"sync"
 
 	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/history"
 	"github.com/tidwall/buntdb"
 )
 
 // Channel represents a channel that clients can join.
 type Channel struct {
+	// fanoutBytes counts the message bytes relayed to members, it must be accessed atomically,
+	// so it comes first to keep it 64-bit aligned on 32-bit platforms
+	fanoutBytes uint64
+
 	flags          ModeSet
+	history        *history.Buffer
+	invites        map[*Client]time.Time // when each invite to +i expires
+	invitesMutex   sync.Mutex
 	lists          map[Mode]*UserMaskSet
 	key            string
 	membersMutex   sync.RWMutex
 	members        MemberSet
 	name           string
 	nameCasefolded string
+	pasteLines     int
+	pasteWindow    time.Duration
 	server         *Server
+	slowMode       time.Duration
+	slowModeMutex  sync.Mutex // used when checking and updating slowModeTimes
+	slowModeTimes  map[*Client]time.Time
 	createdTime    time.Time
 	topic          string
 	topicSetBy     string
 	topicSetTime   time.Time
 	userLimit      uint64
+	urlAllowlist   []string
+	urlPolicy      string
+	wordFilters    []compiledWordFilter
+	webhook        *ChannelWebhook
+	webhookMutex   sync.Mutex
+
+	pendingModesMutex sync.Mutex
+	pendingModes      []pendingModeChanges
 }
 
 // NewChannel creates a new channel from a `Server` and a `name`
@@ -44,7 +66,8 @@ func NewChannel(s *Server, name string, addDefaultModes bool) *Channel {
 	}
 
 	channel := &Channel{
-		flags: make(ModeSet),
+		flags:   make(ModeSet),
+		invites: make(map[*Client]time.Time),
 		lists: map[Mode]*UserMaskSet{
 			BanMask:    NewUserMaskSet(),
 			ExceptMask: NewUserMaskSet(),
@@ -54,6 +77,11 @@ func NewChannel(s *Server, name string, addDefaultModes bool) *Channel {
 		name:           name,
 		nameCasefolded: casefoldedName,
 		server:         s,
+		slowModeTimes:  make(map[*Client]time.Time),
+	}
+
+	if s.historyEnabled {
+		channel.history = history.NewBuffer(casefoldedName, s.historyChannelLength, s.coldHistory)
 	}
 
 	if addDefaultModes {
@@ -80,17 +108,24 @@ func (channel *Channel) isEmptyNoMutex() bool {
 }
 
 // Names sends the list of users joined to the channel to the given client.
-func (channel *Channel) Names(client *Client) {
+func (channel *Channel) Names(client *Client, rb *ResponseBuffer) {
 	channel.membersMutex.RLock()
 	defer channel.membersMutex.RUnlock()
 
-	channel.namesNoMutex(client)
+	// secret channels don't show their members to outsiders
+	if channel.flags[Secret] && !channel.members.Has(client) && !client.hasFlag(Operator) {
+		rb.Send(nil, client.server.name, RPL_ENDOFNAMES, client.nick, channel.name, "End of NAMES list")
+		return
+	}
+	channel.namesNoMutex(client, rb)
 }
 
-func (channel *Channel) namesNoMutex(client *Client) {
+func (channel *Channel) namesNoMutex(client *Client, rb *ResponseBuffer) {
 	currentNicks := channel.nicksNoMutex(client)
-	// assemble and send replies
-	maxNamLen := 480 - len(client.server.name) - len(client.nick)
+	// maxNamLen is how long the list of names in each RPL_NAMREPLY can be, so the line stays
+	// under 512 bytes once the server name, the client's nick and the channel name are added.
+	// names are counted as sent, so full nickmasks with userhost-in-names are split properly
+	maxNamLen := 480 - len(client.server.name) - len(client.nick) - len(channel.name)
 	var buffer string
 	for _, nick := range currentNicks {
 		if buffer == "" {
@@ -99,7 +134,7 @@ func (channel *Channel) namesNoMutex(client *Client) {
 		}
 
 		if len(buffer)+1+len(nick) > maxNamLen {
-			client.Send(nil, client.server.name, RPL_NAMREPLY, client.nick, "=", channel.name, buffer)
+			rb.Send(nil, client.server.name, RPL_NAMREPLY, client.nick, "=", channel.name, buffer)
 			buffer = nick
 			continue
 		}
@@ -108,8 +143,10 @@ func (channel *Channel) namesNoMutex(client *Client) {
 		buffer += nick
 	}
 
-	client.Send(nil, client.server.name, RPL_NAMREPLY, client.nick, "=", channel.name, buffer)
-	client.Send(nil, client.server.name, RPL_ENDOFNAMES, client.nick, channel.name, "End of NAMES list")
+	if buffer != "" {
+		rb.Send(nil, client.server.name, RPL_NAMREPLY, client.nick, "=", channel.name, buffer)
+	}
+	rb.Send(nil, client.server.name, RPL_ENDOFNAMES, client.nick, channel.name, "End of NAMES list")
 }
 
 // ClientIsAtLeast returns whether the client has at least the given channel privilege.
@@ -164,18 +201,22 @@ func (modes ModeSet) Prefixes(isMultiPrefix bool) string {
 }
 
 func (channel *Channel) nicksNoMutex(target *Client) []string {
-	isMultiPrefix := (target != nil) && target.capabilities[MultiPrefix]
-	isUserhostInNames := (target != nil) && target.capabilities[UserhostInNames]
-	nicks := make([]string, len(channel.members))
-	i := 0
+	isMultiPrefix := (target != nil) && target.hasCapability(MultiPrefix)
+	isUserhostInNames := (target != nil) && target.hasCapability(UserhostInNames)
+	// invisible members are hidden from people outside the channel
+	showInvisible := target == nil || target.hasFlag(Operator) || channel.members.Has(target)
+	var nicks []string
 	for client, modes := range channel.members {
-		nicks[i] += modes.Prefixes(isMultiPrefix)
+		if client.hasFlag(Invisible) && !showInvisible {
+			continue
+		}
+		nick := modes.Prefixes(isMultiPrefix)
 		if isUserhostInNames {
-			nicks[i] += client.nickMaskString
+			nick += client.nickMaskString
 		} else {
-			nicks[i] += client.nick
+			nick += client.nick
 		}
-		i++
+		nicks = append(nicks, nick)
 	}
 	return nicks
 }
@@ -183,10 +224,12 @@ func (channel *Channel) nicksNoMutex(target *Client) []string {
 // <mode> <mode params>
 func (channel *Channel) modeStringNoLock(client *Client) (str string) {
 	// RLock()
-	isMember := client.flags[Operator] || channel.members.Has(client)
+	isMember := client.hasFlag(Operator) || channel.members.Has(client)
 	// RUnlock()
 	showKey := isMember && (channel.key != "")
 	showUserLimit := channel.userLimit > 0
+	showSlowMode := channel.slowMode > 0
+	showPasteThreshold := channel.pasteLines > 0
 
 	// flags with args
 	if showKey {
@@ -195,6 +238,12 @@ func (channel *Channel) modeStringNoLock(client *Client) (str string) {
 	if showUserLimit {
 		str += UserLimit.String()
 	}
+	if showSlowMode {
+		str += SlowMode.String()
+	}
+	if showPasteThreshold {
+		str += PasteThreshold.String()
+	}
 
 	// flags
 	for mode := range channel.flags {
@@ -211,6 +260,12 @@ func (channel *Channel) modeStringNoLock(client *Client) (str string) {
 	if showUserLimit {
 		str += " " + strconv.FormatUint(channel.userLimit, 10)
 	}
+	if showSlowMode {
+		str += " " + strconv.Itoa(int(channel.slowMode.Seconds()))
+	}
+	if showPasteThreshold {
+		str += fmt.Sprintf(" %d:%d", channel.pasteLines, int(channel.pasteWindow.Seconds()))
+	}
 
 	return str
 }
@@ -227,7 +282,7 @@ func (channel *Channel) CheckKey(key string) bool {
 
 // Join joins the given client to this channel (if they can be joined).
 //TODO(dan): /SAJOIN and maybe a ForceJoin function?
-func (channel *Channel) Join(client *Client, key string) {
+func (channel *Channel) Join(client *Client, key string, rb *ResponseBuffer) {
 	channel.membersMutex.Lock()
 	defer channel.membersMutex.Unlock()
 	if channel.members.Has(client) {
@@ -236,39 +291,73 @@ func (channel *Channel) Join(client *Client, key string) {
 	}
 
 	if channel.IsFull() {
-		client.Send(nil, client.server.name, ERR_CHANNELISFULL, channel.name, "Cannot join channel (+l)")
+		rb.Send(nil, client.server.name, ERR_CHANNELISFULL, channel.name, "Cannot join channel (+l)")
+		return
+	}
+
+	// invite tokens get past +k and +i, but not bans
+	var inviteToken string
+	if strings.HasPrefix(strings.ToLower(key), inviteTokenPrefix) {
+		info := client.server.inviteTokens.Get(key)
+		if info != nil && info.Channel == channel.nameCasefolded && info.usable(time.Now()) {
+			inviteToken = info.Token
+		}
+	}
+
+	if inviteToken == "" && !channel.CheckKey(key) {
+		rb.Send(nil, client.server.name, ERR_BADCHANNELKEY, channel.name, "Cannot join channel (+k)")
 		return
 	}
 
-	if !channel.CheckKey(key) {
-		client.Send(nil, client.server.name, ERR_BADCHANNELKEY, channel.name, "Cannot join channel (+k)")
+	if channel.flags[SecureOnly] && !client.hasFlag(TLS) {
+		rb.Send(nil, client.server.name, "FAIL", "JOIN", "SECURE_ONLY_CHANNEL", channel.name, "Cannot join channel (+z), you must be connected with TLS")
 		return
 	}
 
-	isInvited := channel.lists[InviteMask].Match(client.nickMaskCasefolded)
-	if channel.flags[InviteOnly] && !isInvited {
-		client.Send(nil, client.server.name, ERR_INVITEONLYCHAN, channel.name, "Cannot join channel (+i)")
+	hasInvite := channel.hasInvite(client)
+	isInvited := hasInvite || channel.lists[InviteMask].Match(client.nickMaskCasefolded)
+	if channel.flags[InviteOnly] && !isInvited && inviteToken == "" {
+		rb.Send(nil, client.server.name, ERR_INVITEONLYCHAN, channel.name, "Cannot join channel (+i)")
 		return
 	}
 
 	if channel.lists[BanMask].Match(client.nickMaskCasefolded) &&
 		!isInvited &&
 		!channel.lists[ExceptMask].Match(client.nickMaskCasefolded) {
-		client.Send(nil, client.server.name, ERR_BANNEDFROMCHAN, channel.name, "Cannot join channel (+b)")
+		rb.Send(nil, client.server.name, ERR_BANNEDFROMCHAN, channel.name, "Cannot join channel (+b)")
 		return
 	}
 
+	if inviteToken != "" {
+		// someone else may have used up the token while we were checking
+		if !client.server.inviteTokens.Use(inviteToken, channel.nameCasefolded, client) {
+			rb.Send(nil, client.server.name, ERR_INVITEONLYCHAN, channel.name, "Cannot join channel (invite token has been used up)")
+			return
+		}
+		client.server.logger.Info("join", fmt.Sprintf("%s joined channel %s with invite token %s", client.nick, channel.name, inviteToken))
+	}
+	if hasInvite {
+		channel.removeInvite(client)
+	}
+
 	client.server.logger.Debug("join", fmt.Sprintf("%s joined channel %s", client.nick, channel.name))
 
 	for member := range channel.members {
-		if member.capabilities[ExtendedJoin] {
-			member.Send(nil, client.nickMaskString, "JOIN", channel.name, client.account.Name, client.realname)
+		// the joining client's own JOIN is a reply to their command
+		send := member.SendFromClient
+		if member == client {
+			send = rb.SendFromClient
+		}
+		if member.hasCapability(ExtendedJoin) {
+			send("", client, nil, "JOIN", channel.name, client.account.Name, client.realname)
 		} else {
-			member.Send(nil, client.nickMaskString, "JOIN", channel.name)
+			send("", client, nil, "JOIN", channel.name)
 		}
 	}
 
+	client.stateMutex.Lock()
 	client.channels.Add(channel)
+	client.stateMutex.Unlock()
 	channel.members.Add(client)
 
 	// give channel mode if necessary
@@ -285,10 +374,10 @@ func (channel *Channel) Join(client *Client, key string) {
 				givenMode = &ChannelOperator
 			}
 		} else {
-			// we should only do this on registered channels
-			if client.account != nil && client.account.Name == chanReg.Founder {
-				channel.members[client][ChannelFounder] = true
-				givenMode = &ChannelFounder
+			// we should only do this on registered channels, and not while they're locked
+			if mode := chanReg.accessMode(client.account); mode != 0 && !channelLocked(tx, chanReg) {
+				channel.members[client][mode] = true
+				givenMode = &mode
 			}
 			if len(channel.members) == 1 {
 				// apply other details if new channel
@@ -306,80 +395,96 @@ func (channel *Channel) Join(client *Client, key string) {
 				for _, mask := range chanReg.Invitelist {
 					channel.lists[InviteMask].Add(mask)
 				}
+				channel.wordFilters = compileWordFilters(chanReg.WordFilters)
+				channel.urlPolicy = chanReg.URLPolicy
+				channel.urlAllowlist = chanReg.URLAllowlist
+				webhook := chanReg.Webhook
+				channel.setWebhook(&webhook)
 			}
 		}
 		return nil
 	})
 
-	if client.capabilities[ExtendedJoin] {
-		client.Send(nil, client.nickMaskString, "JOIN", channel.name, client.account.Name, client.realname)
+	if client.hasCapability(ExtendedJoin) {
+		rb.SendFromClient("", client, nil, "JOIN", channel.name, client.account.Name, client.realname)
 	} else {
-		client.Send(nil, client.nickMaskString, "JOIN", channel.name)
+		rb.SendFromClient("", client, nil, "JOIN", channel.name)
+	}
+	channel.getTopicNoMutex(client, rb) // we already have Lock
+	channel.namesNoMutex(client, rb)
+	if lines := client.account.SettingInt(AccountSettingAutoreplayLines); 0 < lines && channel.history != nil {
+		client.replayHistoryItems(channel.name, channel.history.Latest(lines), rb)
 	}
-	channel.getTopicNoMutex(client) // we already have Lock
-	channel.namesNoMutex(client)
 	if givenMode != nil {
-		for member := range channel.members {
-			member.Send(nil, client.server.name, "MODE", channel.name, fmt.Sprintf("+%v", *givenMode), client.nick)
-		}
+		channel.queueModeChangesNoMutex(client.server.name, ModeChanges{{
+			mode: *givenMode,
+			op:   Add,
+			arg:  client.nick,
+		}})
 	}
+	channel.sendWebhook(WebhookEventJoin, client, webhookPayload{})
 }
 
 // Part parts the given client from this channel, with the given message.
-func (channel *Channel) Part(client *Client, message string) {
+func (channel *Channel) Part(client *Client, message string, rb *ResponseBuffer) {
 	channel.membersMutex.Lock()
 	defer channel.membersMutex.Unlock()
 
 	if !channel.members.Has(client) {
-		client.Send(nil, client.server.name, ERR_NOTONCHANNEL, channel.name, "You're not on that channel")
+		rb.Send(nil, client.server.name, ERR_NOTONCHANNEL, channel.name, "You're not on that channel")
 		return
 	}
 
 	for member := range channel.members {
-		member.Send(nil, client.nickMaskString, "PART", channel.name, message)
+		if member == client {
+			rb.SendFromClient("", client, nil, "PART", channel.name, message)
+		} else {
+			member.SendFromClient("", client, nil, "PART", channel.name, message)
+		}
 	}
 	channel.quitNoMutex(client)
+	channel.sendWebhook(WebhookEventPart, client, webhookPayload{Message: message})
 
 	client.server.logger.Debug("part", fmt.Sprintf("%s left channel %s", client.nick, channel.name))
 }
 
 // GetTopic sends the channel topic to the given client.
-func (channel *Channel) GetTopic(client *Client) {
+func (channel *Channel) GetTopic(client *Client, rb *ResponseBuffer) {
 	channel.membersMutex.RLock()
 	defer channel.membersMutex.RUnlock()
 
-	channel.getTopicNoMutex(client)
+	channel.getTopicNoMutex(client, rb)
 }
 
 // GetTopic sends the channel topic to the given client without getting the membersMutex.
 // This is required because of channel joins.
-func (channel *Channel) getTopicNoMutex(client *Client) {
+func (channel *Channel) getTopicNoMutex(client *Client, rb *ResponseBuffer) {
 	if !channel.members.Has(client) {
-		client.Send(nil, client.server.name, ERR_NOTONCHANNEL, client.nick, channel.name, "You're not on that channel")
+		rb.Send(nil, client.server.name, ERR_NOTONCHANNEL, client.nick, channel.name, "You're not on that channel")
 		return
 	}
 
 	if channel.topic == "" {
-		client.Send(nil, client.server.name, RPL_NOTOPIC, client.nick, channel.name, "No topic is set")
+		rb.Send(nil, client.server.name, RPL_NOTOPIC, client.nick, channel.name, "No topic is set")
 		return
 	}
 
-	client.Send(nil, client.server.name, RPL_TOPIC, client.nick, channel.name, channel.topic)
-	client.Send(nil, client.server.name, RPL_TOPICTIME, client.nick, channel.name, channel.topicSetBy, strconv.FormatInt(channel.topicSetTime.Unix(), 10))
+	rb.Send(nil, client.server.name, RPL_TOPIC, client.nick, channel.name, channel.topic)
+	rb.Send(nil, client.server.name, RPL_TOPICTIME, client.nick, channel.name, channel.topicSetBy, strconv.FormatInt(channel.topicSetTime.Unix(), 10))
 }
 
 // SetTopic sets the topic of this channel, if the client is allowed to do so.
-func (channel *Channel) SetTopic(client *Client, topic string) {
+func (channel *Channel) SetTopic(client *Client, topic string, rb *ResponseBuffer) {
 	channel.membersMutex.RLock()
 	defer channel.membersMutex.RUnlock()
 
-	if !(client.flags[Operator] || channel.members.Has(client)) {
-		client.Send(nil, client.server.name, ERR_NOTONCHANNEL, channel.name, "You're not on that channel")
+	if !(client.hasFlag(Operator) || channel.members.Has(client)) {
+		rb.Send(nil, client.server.name, ERR_NOTONCHANNEL, channel.name, "You're not on that channel")
 		return
 	}
 
 	if channel.flags[OpOnlyTopic] && !channel.ClientIsAtLeast(client, ChannelOperator) {
-		client.Send(nil, client.server.name, ERR_CHANOPRIVSNEEDED, channel.name, "You're not a channel operator")
+		rb.Send(nil, client.server.name, ERR_CHANOPRIVSNEEDED, channel.name, "You're not a channel operator")
 		return
 	}
 
@@ -392,10 +497,18 @@ func (channel *Channel) SetTopic(client *Client, topic string) {
 	channel.topicSetTime = time.Now()
 
 	for member := range channel.members {
-		member.Send(nil, client.nickMaskString, "TOPIC", channel.name, channel.topic)
+		if member == client {
+			rb.SendFromClient("", client, nil, "TOPIC", channel.name, channel.topic)
+		} else {
+			member.SendFromClient("", client, nil, "TOPIC", channel.name, channel.topic)
+		}
 	}
+	channel.sendWebhook(WebhookEventTopic, client, webhookPayload{Topic: topic})
 
 	// update saved channel topic for registered chans
+	if client.server.isReadOnly() {
+		return
+	}
 	client.server.registeredChannelsMutex.Lock()
 	defer client.server.registeredChannelsMutex.Unlock()
 
@@ -409,6 +522,16 @@ func (channel *Channel) SetTopic(client *Client, topic string) {
 		chanInfo.Topic = topic
 		chanInfo.TopicSetBy = client.nickMaskString
 		chanInfo.TopicSetTime = time.Now()
+		var accountName string
+		if client.account != &NoAccount {
+			accountName = client.account.Name
+		}
+		chanInfo.addTopicHistory(TopicHistoryEntry{
+			Topic:   topic,
+			SetBy:   client.nickMaskString,
+			Account: accountName,
+			SetAt:   chanInfo.TopicSetTime,
+		}, client.server.channelRegistration.TopicHistoryLength)
 		client.server.saveChannelNoMutex(tx, channel.nameCasefolded, *chanInfo)
 		return nil
 	})
@@ -419,7 +542,7 @@ func (channel *Channel) CanSpeak(client *Client) bool {
 	channel.membersMutex.RLock()
 	defer channel.membersMutex.RUnlock()
 
-	if client.flags[Operator] {
+	if client.hasFlag(Operator) {
 		return true
 	}
 	if channel.flags[NoOutside] && !channel.members.Has(client) {
@@ -434,15 +557,52 @@ func (channel *Channel) CanSpeak(client *Client) bool {
 	return true
 }
 
+// CheckSlowMode returns true if the given client can send a message to the channel under
+// slow mode, and records that they've done so. If they can't, it also returns how long
+// they need to wait.
+func (channel *Channel) CheckSlowMode(client *Client) (bool, time.Duration) {
+	channel.membersMutex.RLock()
+	interval := channel.slowMode
+	exempt := client.hasFlag(Operator) || channel.clientIsAtLeastNoMutex(client, Voice)
+	channel.membersMutex.RUnlock()
+
+	if interval == 0 || exempt {
+		return true, 0
+	}
+
+	channel.slowModeMutex.Lock()
+	defer channel.slowModeMutex.Unlock()
+
+	now := time.Now()
+	lastTime, exists := channel.slowModeTimes[client]
+	if exists && now.Sub(lastTime) < interval {
+		return false, interval - now.Sub(lastTime)
+	}
+	channel.slowModeTimes[client] = now
+	return true, 0
+}
+
+// sendSlowModeFail tells the client that their message was blocked by the channel's slow mode.
+func (channel *Channel) sendSlowModeFail(client *Client, command string, wait time.Duration, rb *ResponseBuffer) {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	rb.Send(nil, client.server.name, "FAIL", command, "SLOW_MODE", channel.name, strconv.Itoa(seconds), fmt.Sprintf("This channel is in slow mode, you must wait %d seconds before sending another message", seconds))
+}
+
 // TagMsg sends a tag message to everyone in this channel who can accept them.
-func (channel *Channel) TagMsg(msgid string, minPrefix *Mode, clientOnlyTags *map[string]ircmsg.TagValue, client *Client) {
-	channel.sendMessage(msgid, "TAGMSG", []Capability{MessageTags}, minPrefix, clientOnlyTags, client, nil)
+func (channel *Channel) TagMsg(msgid string, minPrefix *Mode, clientOnlyTags *map[string]ircmsg.TagValue, client *Client, rb *ResponseBuffer) {
+	// reactions are stored so clients can rebuild them from history, other tags
+	// (like typing notifications) are only useful at the time they're sent
+	if channel.history != nil && minPrefix == nil && isReaction(clientOnlyTags) {
+		channel.history.Add(client.historyItem(history.Tagmsg, msgid, clientOnlyTags, ""))
+	}
+
+	channel.sendMessage(msgid, "TAGMSG", []Capability{MessageTags}, minPrefix, clientOnlyTags, client, nil, rb)
 }
 
 // sendMessage sends a given message to everyone on this channel.
-func (channel *Channel) sendMessage(msgid, cmd string, requiredCaps []Capability, minPrefix *Mode, clientOnlyTags *map[string]ircmsg.TagValue, client *Client, message *string) {
+func (channel *Channel) sendMessage(msgid, cmd string, requiredCaps []Capability, minPrefix *Mode, clientOnlyTags *map[string]ircmsg.TagValue, client *Client, message *string, rb *ResponseBuffer) {
 	if !channel.CanSpeak(client) {
-		client.Send(nil, client.server.name, ERR_CANNOTSENDTOCHAN, channel.name, "Cannot send to channel")
+		rb.Send(nil, client.server.name, ERR_CANNOTSENDTOCHAN, channel.name, "Cannot send to channel")
 		return
 	}
 
@@ -459,13 +619,16 @@ func (channel *Channel) sendMessage(msgid, cmd string, requiredCaps []Capability
 			// STATUSMSG
 			continue
 		}
-		if member == client && !client.capabilities[EchoMessage] {
+		if member == client && !client.hasCapability(EchoMessage) {
+			continue
+		}
+		if member.ignores.IsSilenced(client.nickMaskCasefolded) {
 			continue
 		}
 
 		canReceive := true
 		for _, capName := range requiredCaps {
-			if !member.capabilities[capName] {
+			if !member.hasCapability(capName) {
 				canReceive = false
 			}
 		}
@@ -474,34 +637,54 @@ func (channel *Channel) sendMessage(msgid, cmd string, requiredCaps []Capability
 		}
 
 		var messageTagsToUse *map[string]ircmsg.TagValue
-		if member.capabilities[MessageTags] {
+		if member.hasCapability(MessageTags) {
 			messageTagsToUse = clientOnlyTags
 		}
 
+		// the sender's echo is a reply to their command
+		send := member.SendFromClient
+		if member == client {
+			send = rb.SendFromClient
+		}
 		if message == nil {
-			member.SendFromClient(msgid, client, messageTagsToUse, cmd, channel.name)
+			send(msgid, client, messageTagsToUse, cmd, channel.name)
 		} else {
-			member.SendFromClient(msgid, client, messageTagsToUse, cmd, channel.name, *message)
+			send(msgid, client, messageTagsToUse, cmd, channel.name, *message)
 		}
 	}
 }
 
 // SplitPrivMsg sends a private message to everyone in this channel.
-func (channel *Channel) SplitPrivMsg(msgid string, minPrefix *Mode, clientOnlyTags *map[string]ircmsg.TagValue, client *Client, message SplitMessage) {
-	channel.sendSplitMessage(msgid, "PRIVMSG", minPrefix, clientOnlyTags, client, &message)
+func (channel *Channel) SplitPrivMsg(msgid string, minPrefix *Mode, clientOnlyTags *map[string]ircmsg.TagValue, client *Client, message SplitMessage, rb *ResponseBuffer) {
+	channel.sendSplitMessage(msgid, "PRIVMSG", minPrefix, clientOnlyTags, client, &message, rb)
 }
 
 // SplitNotice sends a private message to everyone in this channel.
-func (channel *Channel) SplitNotice(msgid string, minPrefix *Mode, clientOnlyTags *map[string]ircmsg.TagValue, client *Client, message SplitMessage) {
-	channel.sendSplitMessage(msgid, "NOTICE", minPrefix, clientOnlyTags, client, &message)
+func (channel *Channel) SplitNotice(msgid string, minPrefix *Mode, clientOnlyTags *map[string]ircmsg.TagValue, client *Client, message SplitMessage, rb *ResponseBuffer) {
+	channel.sendSplitMessage(msgid, "NOTICE", minPrefix, clientOnlyTags, client, &message, rb)
 }
 
-func (channel *Channel) sendSplitMessage(msgid, cmd string, minPrefix *Mode, clientOnlyTags *map[string]ircmsg.TagValue, client *Client, message *SplitMessage) {
+func (channel *Channel) sendSplitMessage(msgid, cmd string, minPrefix *Mode, clientOnlyTags *map[string]ircmsg.TagValue, client *Client, message *SplitMessage, rb *ResponseBuffer) {
 	if !channel.CanSpeak(client) {
-		client.Send(nil, client.server.name, ERR_CANNOTSENDTOCHAN, channel.name, "Cannot send to channel")
+		rb.Send(nil, client.server.name, ERR_CANNOTSENDTOCHAN, channel.name, "Cannot send to channel")
 		return
 	}
 
+	// STATUSMSG isn't stored, since it's not visible to everyone in the channel
+	if channel.history != nil && minPrefix == nil {
+		itemType := history.Privmsg
+		if cmd == "NOTICE" {
+			itemType = history.Notice
+		}
+		channel.history.Add(client.historyItem(itemType, msgid, clientOnlyTags, message.ForMaxLine))
+	}
+	if cmd == "PRIVMSG" {
+		channel.recordMissedHighlights(client, msgid, clientOnlyTags, message.ForMaxLine)
+	}
+	if minPrefix == nil {
+		channel.sendWebhook(WebhookEventMessage, client, webhookPayload{Command: cmd, Message: message.ForMaxLine})
+	}
+
 	channel.membersMutex.RLock()
 	defer channel.membersMutex.RUnlock()
 
@@ -515,18 +698,32 @@ func (channel *Channel) sendSplitMessage(msgid, cmd string, minPrefix *Mode, cli
 			// STATUSMSG
 			continue
 		}
-		if member == client && !client.capabilities[EchoMessage] {
+		if member == client && !client.hasCapability(EchoMessage) {
+			continue
+		}
+		if member.ignores.IsSilenced(client.nickMaskCasefolded) {
 			continue
 		}
 		var tagsToUse *map[string]ircmsg.TagValue
-		if member.capabilities[MessageTags] {
+		if member.hasCapability(MessageTags) {
 			tagsToUse = clientOnlyTags
 		}
 
+		// the sender's echo is a reply to their command
+		if member == client {
+			if message == nil {
+				rb.SendFromClient(msgid, client, tagsToUse, cmd, channel.name)
+			} else {
+				rb.SendSplitMsgFromClient(msgid, client, tagsToUse, cmd, channel.name, *message)
+				channel.addFanout(member, message)
+			}
+			continue
+		}
 		if message == nil {
 			member.SendFromClient(msgid, client, tagsToUse, cmd, channel.name)
 		} else {
 			member.SendSplitMsgFromClient(msgid, client, tagsToUse, cmd, channel.name, *message)
+			channel.addFanout(member, message)
 		}
 	}
 }
@@ -557,24 +754,24 @@ func (channel *Channel) applyModeFlag(client *Client, mode Mode,
 }
 
 func (channel *Channel) applyModeMemberNoMutex(client *Client, mode Mode,
-	op ModeOp, nick string) *ModeChange {
+	op ModeOp, nick string, rb *ResponseBuffer) *ModeChange {
 	// requires Lock()
 
 	if nick == "" {
 		//TODO(dan): shouldn't this be handled before it reaches this function?
-		client.Send(nil, client.server.name, ERR_NEEDMOREPARAMS, "MODE", "Not enough parameters")
+		rb.Send(nil, client.server.name, ERR_NEEDMOREPARAMS, "MODE", "Not enough parameters")
 		return nil
 	}
 
 	casefoldedName, err := CasefoldName(nick)
 	target := channel.server.clients.Get(casefoldedName)
 	if err != nil || target == nil {
-		client.Send(nil, client.server.name, ERR_NOSUCHNICK, nick, "No such nick")
+		rb.Send(nil, client.server.name, ERR_NOSUCHNICK, nick, "No such nick")
 		return nil
 	}
 
 	if !channel.members.Has(target) {
-		client.Send(nil, client.server.name, ERR_USERNOTINCHANNEL, client.nick, channel.name, "They aren't on that channel")
+		rb.Send(nil, client.server.name, ERR_USERNOTINCHANNEL, client.nick, channel.name, "They aren't on that channel")
 		return nil
 	}
 
@@ -605,7 +802,7 @@ func (channel *Channel) applyModeMemberNoMutex(client *Client, mode Mode,
 }
 
 // ShowMaskList shows the given list to the client.
-func (channel *Channel) ShowMaskList(client *Client, mode Mode) {
+func (channel *Channel) ShowMaskList(client *Client, mode Mode, rb *ResponseBuffer) {
 	// choose appropriate modes
 	var rpllist, rplendoflist string
 	if mode == BanMask {
@@ -621,12 +818,12 @@ func (channel *Channel) ShowMaskList(client *Client, mode Mode) {
 
 	// send out responses
 	for mask := range channel.lists[mode].masks {
-		client.Send(nil, client.server.name, rpllist, client.nick, channel.name, mask)
+		rb.Send(nil, client.server.name, rpllist, client.nick, channel.name, mask)
 	}
-	client.Send(nil, client.server.name, rplendoflist, client.nick, channel.name, "End of list")
+	rb.Send(nil, client.server.name, rplendoflist, client.nick, channel.name, "End of list")
 }
 
-func (channel *Channel) applyModeMask(client *Client, mode Mode, op ModeOp, mask string) bool {
+func (channel *Channel) applyModeMask(client *Client, mode Mode, op ModeOp, mask string, rb *ResponseBuffer) bool {
 	list := channel.lists[mode]
 	if list == nil {
 		// This should never happen, but better safe than panicky.
@@ -634,12 +831,12 @@ func (channel *Channel) applyModeMask(client *Client, mode Mode, op ModeOp, mask
 	}
 
 	if (op == List) || (mask == "") {
-		channel.ShowMaskList(client, mode)
+		channel.ShowMaskList(client, mode, rb)
 		return false
 	}
 
 	if !channel.ClientIsAtLeast(client, ChannelOperator) {
-		client.Send(nil, client.server.name, ERR_CHANOPRIVSNEEDED, channel.name, "You're not a channel operator")
+		rb.Send(nil, client.server.name, ERR_CHANOPRIVSNEEDED, channel.name, "You're not a channel operator")
 		return false
 	}
 
@@ -668,26 +865,32 @@ func (channel *Channel) Quit(client *Client, friends *ClientSet) {
 
 func (channel *Channel) quitNoMutex(client *Client) {
 	channel.members.Remove(client)
+	client.stateMutex.Lock()
 	client.channels.Remove(channel)
+	client.stateMutex.Unlock()
+
+	channel.slowModeMutex.Lock()
+	delete(channel.slowModeTimes, client)
+	channel.slowModeMutex.Unlock()
 
 	if channel.isEmptyNoMutex() {
 		channel.server.channels.Remove(channel)
 	}
 }
 
-func (channel *Channel) kickNoMutex(client *Client, target *Client, comment string) {
+func (channel *Channel) kickNoMutex(client *Client, target *Client, comment string, rb *ResponseBuffer) {
 	// needs a Lock()
 
-	if !(client.flags[Operator] || channel.members.Has(client)) {
-		client.Send(nil, client.server.name, ERR_NOTONCHANNEL, channel.name, "You're not on that channel")
+	if !(client.hasFlag(Operator) || channel.members.Has(client)) {
+		rb.Send(nil, client.server.name, ERR_NOTONCHANNEL, channel.name, "You're not on that channel")
 		return
 	}
 	if !channel.clientIsAtLeastNoMutex(client, ChannelOperator) {
-		client.Send(nil, client.server.name, ERR_CANNOTSENDTOCHAN, channel.name, "Cannot send to channel")
+		rb.Send(nil, client.server.name, ERR_CANNOTSENDTOCHAN, channel.name, "Cannot send to channel")
 		return
 	}
 	if !channel.members.Has(target) {
-		client.Send(nil, client.server.name, ERR_USERNOTINCHANNEL, client.nick, channel.name, "They aren't on that channel")
+		rb.Send(nil, client.server.name, ERR_USERNOTINCHANNEL, client.nick, channel.name, "They aren't on that channel")
 		return
 	}
 
@@ -696,15 +899,39 @@ func (channel *Channel) kickNoMutex(client *Client, target *Client, comment stri
 	}
 
 	for member := range channel.members {
-		member.Send(nil, client.nickMaskString, "KICK", channel.name, target.nick, comment)
+		if member == client {
+			rb.SendFromClient("", client, nil, "KICK", channel.name, target.nick, comment)
+		} else {
+			member.SendFromClient("", client, nil, "KICK", channel.name, target.nick, comment)
+		}
 	}
 	channel.quitNoMutex(target)
 }
 
+// kickInsecureNoMutex kicks the members who aren't using TLS, after the given client has set
+// the channel secure-only.
+func (channel *Channel) kickInsecureNoMutex(client *Client) {
+	// needs a Lock()
+
+	var insecure []*Client
+	for member := range channel.members {
+		if !member.hasFlag(TLS) {
+			insecure = append(insecure, member)
+		}
+	}
+	for _, target := range insecure {
+		for member := range channel.members {
+			member.SendFromClient("", client, nil, "KICK", channel.name, target.nick, "This channel is now secure-only (+z), reconnect using TLS to rejoin")
+		}
+		channel.quitNoMutex(target)
+	}
+}
+
 // Invite invites the given client to the channel, if the inviter can do so.
-func (channel *Channel) Invite(invitee *Client, inviter *Client) {
-	if channel.flags[InviteOnly] && !channel.ClientIsAtLeast(inviter, ChannelOperator) {
-		inviter.Send(nil, inviter.server.name, ERR_CHANOPRIVSNEEDED, channel.name, "You're not a channel operator")
+func (channel *Channel) Invite(invitee *Client, inviter *Client, rb *ResponseBuffer) {
+	config := inviter.server.channelInvites
+	if config.opsOnly(channel) && !channel.ClientIsAtLeast(inviter, ChannelOperator) {
+		rb.Send(nil, inviter.server.name, ERR_CHANOPRIVSNEEDED, channel.name, "You're not a channel operator")
 		return
 	}
 
@@ -712,26 +939,34 @@ func (channel *Channel) Invite(invitee *Client, inviter *Client) {
 	defer channel.membersMutex.RUnlock()
 
 	if !channel.members.Has(inviter) {
-		inviter.Send(nil, inviter.server.name, ERR_NOTONCHANNEL, channel.name, "You're not on that channel")
+		rb.Send(nil, inviter.server.name, ERR_NOTONCHANNEL, channel.name, "You're not on that channel")
 		return
 	}
 
-	//TODO(dan): handle this more nicely, keep a list of last X invited channels on invitee rather than explicitly modifying the invite list?
-	if channel.flags[InviteOnly] {
-		channel.lists[InviteMask].Add(invitee.nickMaskCasefolded)
+	if !inviter.server.allowInvite(inviter) {
+		rb.Send(nil, inviter.server.name, ERR_UNKNOWNERROR, inviter.nick, "INVITE", "You're sending invites too quickly, try again later")
+		return
+	}
+	// invites the invitee doesn't want look like they went through, so they can't be used
+	// to find out who's ignoring who
+	accepted := invitee.acceptsInviteFrom(inviter)
+	if channel.flags[InviteOnly] && accepted {
+		channel.addInvite(invitee, config.Expiry)
 	}
 
 	// send invite-notify
 	for member := range channel.members {
-		if member.capabilities[InviteNotify] && member != inviter && member != invitee && channel.ClientIsAtLeast(member, Halfop) {
-			member.Send(nil, inviter.nickMaskString, "INVITE", invitee.nick, channel.name)
+		if member.hasCapability(InviteNotify) && member != inviter && member != invitee && channel.ClientIsAtLeast(member, Halfop) {
+			member.SendFromClient("", inviter, nil, "INVITE", invitee.nick, channel.name)
 		}
 	}
 
 	//TODO(dan): should inviter.server.name here be inviter.nickMaskString ?
-	inviter.Send(nil, inviter.server.name, RPL_INVITING, invitee.nick, channel.name)
-	invitee.Send(nil, inviter.nickMaskString, "INVITE", invitee.nick, channel.name)
-	if invitee.flags[Away] {
-		inviter.Send(nil, inviter.server.name, RPL_AWAY, invitee.nick, invitee.awayMessage)
+	rb.Send(nil, inviter.server.name, RPL_INVITING, invitee.nick, channel.name)
+	if accepted {
+		invitee.SendFromClient("", inviter, nil, "INVITE", invitee.nick, channel.name)
+	}
+	if invitee.hasFlag(Away) {
+		rb.Send(nil, inviter.server.name, RPL_AWAY, invitee.nick, invitee.awayMessage)
 	}
 }
@@ -0,0 +1,214 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/oragono/oragono/irc/sno"
+	"github.com/tidwall/buntdb"
+)
+
+// channelSuccession is what happened to a channel when its founder's account was dropped.
+type channelSuccession struct {
+	channelKey string
+	name       string
+	oldFounder string
+	// newFounder is the account that now owns the channel, or empty if no one could take
+	// it over and it was unregistered.
+	newFounder string
+}
+
+// pickSuccessor returns the casefolded name of the account that should take over the channel
+// from its founder: the successor they chose, or else whoever's highest on the access list.
+// It returns an empty string if no one can.
+func pickSuccessor(tx *buntdb.Tx, chanReg *RegisteredChannel, founderKey string) string {
+	usable := func(accountKey string) bool {
+		if accountKey == "" || accountKey == founderKey {
+			return false
+		}
+		if _, err := tx.Get(fmt.Sprintf(keyAccountVerified, accountKey)); err != nil {
+			return false
+		}
+		return loadAccountSuspension(tx, accountKey) == nil
+	}
+
+	if successorKey, err := CasefoldName(chanReg.Successor); err == nil && usable(successorKey) {
+		return successorKey
+	}
+
+	var candidates []string
+	for accountKey := range chanReg.AccessList {
+		if usable(accountKey) {
+			candidates = append(candidates, accountKey)
+		}
+	}
+	// highest mode first, then by name so it's predictable
+	sort.Slice(candidates, func(i, j int) bool {
+		iMode, jMode := chanReg.AccessList[candidates[i]], chanReg.AccessList[candidates[j]]
+		if iMode != jMode {
+			return modeIsAbove(iMode, jMode)
+		}
+		return candidates[i] < candidates[j]
+	})
+	if 0 < len(candidates) {
+		return candidates[0]
+	}
+	return ""
+}
+
+// handOverChannelsNoMutex gives the channels founded by the given account, which is being
+// dropped, to their successors. Channels no one can take over are unregistered.
+func (server *Server) handOverChannelsNoMutex(tx *buntdb.Tx, accountKey string) (successions []channelSuccession) {
+	// requires registeredChannelsMutex
+
+	founderPrefix := strings.TrimSuffix(keyChannelFounder, "%s")
+	var channelKeys []string
+	tx.AscendKeys(founderPrefix+"*", func(key, founder string) bool {
+		if founderKey, err := CasefoldName(founder); err == nil && founderKey == accountKey {
+			channelKeys = append(channelKeys, strings.TrimPrefix(key, founderPrefix))
+		}
+		return true
+	})
+
+	for _, channelKey := range channelKeys {
+		chanReg := server.loadChannelNoMutex(tx, channelKey)
+		if chanReg == nil {
+			continue
+		}
+		succession := channelSuccession{
+			channelKey: channelKey,
+			name:       chanReg.Name,
+			oldFounder: chanReg.Founder,
+		}
+
+		successorKey := pickSuccessor(tx, chanReg, accountKey)
+		if successorKey == "" {
+			server.deleteChannelNoMutex(tx, channelKey)
+			successions = append(successions, succession)
+			continue
+		}
+		succession.newFounder, _ = tx.Get(fmt.Sprintf(keyAccountName, successorKey))
+		chanReg.Founder = succession.newFounder
+		chanReg.Successor = ""
+		delete(chanReg.AccessList, successorKey)
+		server.saveChannelNoMutex(tx, channelKey, *chanReg)
+		successions = append(successions, succession)
+	}
+	return successions
+}
+
+// announceChannelSuccessions tells the affected channels and opers about the channels that
+// were handed over (or unregistered) when their founder's account was dropped. It's called
+// from the account expiry goroutine too, so it mustn't be called with any of the server's
+// mutexes held.
+func (server *Server) announceChannelSuccessions(successions []channelSuccession) {
+	chanservMask := fmt.Sprintf("ChanServ!services@%s", server.name)
+	for _, succession := range successions {
+		var message string
+		if succession.newFounder == "" {
+			message = fmt.Sprintf("%s has been unregistered, because its founder's account was dropped and no one could take it over", succession.name)
+			server.logger.Info("chanserv", fmt.Sprintf("Channel %s unregistered, founder %s was dropped", succession.name, succession.oldFounder))
+			server.snomasks.Send(sno.LocalChannels, fmt.Sprintf(ircfmt.Unescape("Channel $c[grey][$r%s$c[grey]] unregistered, its founder was dropped"), succession.name))
+		} else {
+			message = fmt.Sprintf("%s now belongs to %s, because its founder's account was dropped", succession.name, succession.newFounder)
+			server.logger.Info("chanserv", fmt.Sprintf("Channel %s passed from %s to %s", succession.name, succession.oldFounder, succession.newFounder))
+			server.snomasks.Send(sno.LocalChannels, fmt.Sprintf(ircfmt.Unescape("Channel $c[grey][$r%s$c[grey]] passed to successor $c[grey][$r%s$c[grey]]"), succession.name, succession.newFounder))
+
+			// if the account isn't loaded, none of its clients are around to tell
+			newFounderKey, _ := CasefoldName(succession.newFounder)
+			if account, exists := server.getAccount(newFounderKey); exists {
+				for _, accountClient := range account.getClients() {
+					accountClient.ChanServNotice(fmt.Sprintf("You are now the founder of %s", succession.name))
+				}
+			}
+		}
+
+		channel := server.channels.Get(succession.channelKey)
+		if channel == nil {
+			continue
+		}
+		channel.membersMutex.Lock()
+		for member := range channel.members {
+			member.Send(nil, chanservMask, "NOTICE", channel.name, message)
+		}
+		if succession.newFounder != "" {
+			newFounderKey, _ := CasefoldName(succession.newFounder)
+			for _, change := range channel.accountModeChangesNoMutex(newFounderKey, Add, ChannelFounder) {
+				// the new founder's own client is the one that'd hear about any problems
+				nickname, _ := CasefoldName(change.arg)
+				newFounderClient := server.clients.Get(nickname)
+				if newFounderClient != nil {
+					channel.chanservModeNoMutex(newFounderClient, ModeChanges{change}, NewResponseBuffer(newFounderClient))
+				}
+			}
+		}
+		channel.membersMutex.Unlock()
+	}
+}
+
+// chanservSuccessor handles the ChanServ SUCCESSOR command, which sets the account that takes
+// over a registered channel if its founder's account is dropped.
+//
+// SUCCESSOR <channel> [<account>|NONE]
+func (server *Server) chanservSuccessor(client *Client, params []string, rb *ResponseBuffer) {
+	if len(params) < 1 {
+		rb.ChanServNotice("Syntax: SUCCESSOR <channel> [<account>|NONE]")
+		return
+	}
+	channelKey, _, chanReg := server.loadRegisteredChannel(client, params[0], rb)
+	if chanReg == nil {
+		return
+	}
+	if chanReg.accessMode(client.account) != ChannelFounder && !client.hasFlag(Operator) {
+		rb.ChanServNotice(fmt.Sprintf("Only the founder of %s can see or change its successor", chanReg.Name))
+		return
+	}
+	if len(params) < 2 {
+		if chanReg.Successor == "" {
+			rb.ChanServNotice(fmt.Sprintf("%s has no successor, so it'll go to whoever's highest on its access list", chanReg.Name))
+		} else {
+			rb.ChanServNotice(fmt.Sprintf("The successor of %s is %s", chanReg.Name, chanReg.Successor))
+		}
+		return
+	}
+	if chanReg.accessMode(client.account) != ChannelFounder {
+		rb.ChanServNotice(fmt.Sprintf("Only the founder of %s can change its successor", chanReg.Name))
+		return
+	}
+
+	var successor string
+	if strings.ToLower(params[1]) != "none" {
+		account := server.loadAccountByName(params[1])
+		if account == nil {
+			rb.ChanServNotice(fmt.Sprintf("The account %s isn't registered", params[1]))
+			return
+		}
+		if account.Name == chanReg.Founder {
+			rb.ChanServNotice("You can't be your own successor")
+			return
+		}
+		successor = account.Name
+	}
+	if !server.checkWritable(client, "CHANSERV", rb) {
+		return
+	}
+
+	server.registeredChannelsMutex.Lock()
+	server.store.Update(func(tx *buntdb.Tx) error {
+		chanReg.Successor = successor
+		server.saveChannelNoMutex(tx, channelKey, *chanReg)
+		return nil
+	})
+	server.registeredChannelsMutex.Unlock()
+
+	if successor == "" {
+		rb.ChanServNotice(fmt.Sprintf("%s no longer has a successor", chanReg.Name))
+	} else {
+		rb.ChanServNotice(fmt.Sprintf("%s will go to %s if your account is dropped", chanReg.Name, successor))
+	}
+}
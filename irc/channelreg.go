@@ -25,8 +25,36 @@ const (
 	keyChannelBanlist      = "channel.banlist %s"
 	keyChannelExceptlist   = "channel.exceptlist %s"
 	keyChannelInvitelist   = "channel.invitelist %s"
+	keyChannelWordFilters  = "channel.wordfilters %s"
+	keyChannelURLPolicy    = "channel.urlpolicy %s"
+	keyChannelURLAllowlist = "channel.urlallowlist %s"
+	keyChannelAccessList   = "channel.accesslist %s"
+	keyChannelTopicHistory = "channel.topichistory %s"
+	keyChannelSuccessor    = "channel.successor %s"
+	keyChannelWebhook      = "channel.webhook %s"
 )
 
+// channelKeyFormats are all the keys that a registered channel's data is stored under.
+var channelKeyFormats = []string{
+	keyChannelExists,
+	keyChannelName,
+	keyChannelRegTime,
+	keyChannelFounder,
+	keyChannelTopic,
+	keyChannelTopicSetBy,
+	keyChannelTopicSetTime,
+	keyChannelBanlist,
+	keyChannelExceptlist,
+	keyChannelInvitelist,
+	keyChannelWordFilters,
+	keyChannelURLPolicy,
+	keyChannelURLAllowlist,
+	keyChannelAccessList,
+	keyChannelTopicHistory,
+	keyChannelSuccessor,
+	keyChannelWebhook,
+}
+
 var (
 	errChanExists = errors.New("Channel already exists")
 )
@@ -51,11 +79,43 @@ type RegisteredChannel struct {
 	Exceptlist []string
 	// Invitelist represents the invite exceptions set on the channel.
 	Invitelist []string
+	// WordFilters represents the words filtered from the channel's messages.
+	WordFilters []WordFilter
+	// URLPolicy controls who can post links in the channel.
+	URLPolicy string
+	// URLAllowlist represents the domains that can always be linked to in the channel.
+	URLAllowlist []string
+	// AccessList maps casefolded account names to the channel mode they get when they join.
+	AccessList map[string]Mode
+	// TopicHistory holds the most recent topics set on the channel, oldest first.
+	TopicHistory []TopicHistoryEntry
+	// Successor is the account that takes over the channel if the founder's account is dropped.
+	Successor string
+	// Webhook is where the channel's events are sent, if anywhere.
+	Webhook ChannelWebhook
+}
+
+// accessMode returns the channel mode that the given account gets on this channel, or 0 if
+// it doesn't get one.
+func (chanReg *RegisteredChannel) accessMode(account *ClientAccount) Mode {
+	if account == nil || account == &NoAccount {
+		return 0
+	}
+	if account.Name == chanReg.Founder {
+		return ChannelFounder
+	}
+	accountKey, err := CasefoldName(account.Name)
+	if err != nil {
+		return 0
+	}
+	return chanReg.AccessList[accountKey]
 }
 
 // deleteChannelNoMutex deletes a given channel from our store.
 func (server *Server) deleteChannelNoMutex(tx *buntdb.Tx, channelKey string) {
-	tx.Delete(fmt.Sprintf(keyChannelExists, channelKey))
+	for _, format := range channelKeyFormats {
+		tx.Delete(fmt.Sprintf(format, channelKey))
+	}
 	server.registeredChannels[channelKey] = nil
 }
 
@@ -76,6 +136,7 @@ func (server *Server) loadChannelNoMutex(tx *buntdb.Tx, channelKey string) *Regi
 	regTime, _ := tx.Get(fmt.Sprintf(keyChannelRegTime, channelKey))
 	regTimeInt, _ := strconv.ParseInt(regTime, 10, 64)
 	founder, _ := tx.Get(fmt.Sprintf(keyChannelFounder, channelKey))
+	successor, _ := tx.Get(fmt.Sprintf(keyChannelSuccessor, channelKey))
 	topic, _ := tx.Get(fmt.Sprintf(keyChannelTopic, channelKey))
 	topicSetBy, _ := tx.Get(fmt.Sprintf(keyChannelTopicSetBy, channelKey))
 	topicSetTime, _ := tx.Get(fmt.Sprintf(keyChannelTopicSetTime, channelKey))
@@ -83,6 +144,12 @@ func (server *Server) loadChannelNoMutex(tx *buntdb.Tx, channelKey string) *Regi
 	banlistString, _ := tx.Get(fmt.Sprintf(keyChannelBanlist, channelKey))
 	exceptlistString, _ := tx.Get(fmt.Sprintf(keyChannelExceptlist, channelKey))
 	invitelistString, _ := tx.Get(fmt.Sprintf(keyChannelInvitelist, channelKey))
+	wordFiltersString, _ := tx.Get(fmt.Sprintf(keyChannelWordFilters, channelKey))
+	urlPolicy, _ := tx.Get(fmt.Sprintf(keyChannelURLPolicy, channelKey))
+	urlAllowlistString, _ := tx.Get(fmt.Sprintf(keyChannelURLAllowlist, channelKey))
+	accessListString, _ := tx.Get(fmt.Sprintf(keyChannelAccessList, channelKey))
+	topicHistoryString, _ := tx.Get(fmt.Sprintf(keyChannelTopicHistory, channelKey))
+	webhookString, _ := tx.Get(fmt.Sprintf(keyChannelWebhook, channelKey))
 
 	var banlist []string
 	_ = json.Unmarshal([]byte(banlistString), &banlist)
@@ -90,6 +157,16 @@ func (server *Server) loadChannelNoMutex(tx *buntdb.Tx, channelKey string) *Regi
 	_ = json.Unmarshal([]byte(exceptlistString), &exceptlist)
 	var invitelist []string
 	_ = json.Unmarshal([]byte(invitelistString), &invitelist)
+	var wordFilters []WordFilter
+	_ = json.Unmarshal([]byte(wordFiltersString), &wordFilters)
+	var urlAllowlist []string
+	_ = json.Unmarshal([]byte(urlAllowlistString), &urlAllowlist)
+	accessList := make(map[string]Mode)
+	_ = json.Unmarshal([]byte(accessListString), &accessList)
+	var topicHistory []TopicHistoryEntry
+	_ = json.Unmarshal([]byte(topicHistoryString), &topicHistory)
+	var webhook ChannelWebhook
+	_ = json.Unmarshal([]byte(webhookString), &webhook)
 
 	chanInfo := RegisteredChannel{
 		Name:         name,
@@ -101,6 +178,13 @@ func (server *Server) loadChannelNoMutex(tx *buntdb.Tx, channelKey string) *Regi
 		Banlist:      banlist,
 		Exceptlist:   exceptlist,
 		Invitelist:   invitelist,
+		WordFilters:  wordFilters,
+		URLPolicy:    urlPolicy,
+		URLAllowlist: urlAllowlist,
+		AccessList:   accessList,
+		TopicHistory: topicHistory,
+		Successor:    successor,
+		Webhook:      webhook,
 	}
 	server.registeredChannels[channelKey] = &chanInfo
 
@@ -109,10 +193,17 @@ func (server *Server) loadChannelNoMutex(tx *buntdb.Tx, channelKey string) *Regi
 
 // saveChannelNoMutex saves a channel to the store.
 func (server *Server) saveChannelNoMutex(tx *buntdb.Tx, channelKey string, channelInfo RegisteredChannel) {
+	saveRegisteredChannel(tx, channelKey, channelInfo)
+	server.registeredChannels[channelKey] = &channelInfo
+}
+
+// saveRegisteredChannel writes a channel's registration to the store.
+func saveRegisteredChannel(tx *buntdb.Tx, channelKey string, channelInfo RegisteredChannel) {
 	tx.Set(fmt.Sprintf(keyChannelExists, channelKey), "1", nil)
 	tx.Set(fmt.Sprintf(keyChannelName, channelKey), channelInfo.Name, nil)
 	tx.Set(fmt.Sprintf(keyChannelRegTime, channelKey), strconv.FormatInt(channelInfo.RegisteredAt.Unix(), 10), nil)
 	tx.Set(fmt.Sprintf(keyChannelFounder, channelKey), channelInfo.Founder, nil)
+	tx.Set(fmt.Sprintf(keyChannelSuccessor, channelKey), channelInfo.Successor, nil)
 	tx.Set(fmt.Sprintf(keyChannelTopic, channelKey), channelInfo.Topic, nil)
 	tx.Set(fmt.Sprintf(keyChannelTopicSetBy, channelKey), channelInfo.TopicSetBy, nil)
 	tx.Set(fmt.Sprintf(keyChannelTopicSetTime, channelKey), strconv.FormatInt(channelInfo.TopicSetTime.Unix(), 10), nil)
@@ -123,6 +214,15 @@ func (server *Server) saveChannelNoMutex(tx *buntdb.Tx, channelKey string, chann
 	tx.Set(fmt.Sprintf(keyChannelExceptlist, channelKey), string(exceptlistString), nil)
 	invitelistString, _ := json.Marshal(channelInfo.Invitelist)
 	tx.Set(fmt.Sprintf(keyChannelInvitelist, channelKey), string(invitelistString), nil)
-
-	server.registeredChannels[channelKey] = &channelInfo
+	wordFiltersString, _ := json.Marshal(channelInfo.WordFilters)
+	tx.Set(fmt.Sprintf(keyChannelWordFilters, channelKey), string(wordFiltersString), nil)
+	tx.Set(fmt.Sprintf(keyChannelURLPolicy, channelKey), channelInfo.URLPolicy, nil)
+	urlAllowlistString, _ := json.Marshal(channelInfo.URLAllowlist)
+	tx.Set(fmt.Sprintf(keyChannelURLAllowlist, channelKey), string(urlAllowlistString), nil)
+	accessListString, _ := json.Marshal(channelInfo.AccessList)
+	tx.Set(fmt.Sprintf(keyChannelAccessList, channelKey), string(accessListString), nil)
+	topicHistoryString, _ := json.Marshal(channelInfo.TopicHistory)
+	tx.Set(fmt.Sprintf(keyChannelTopicHistory, channelKey), string(topicHistoryString), nil)
+	webhookString, _ := json.Marshal(channelInfo.Webhook)
+	tx.Set(fmt.Sprintf(keyChannelWebhook, channelKey), string(webhookString), nil)
 }
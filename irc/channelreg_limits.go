@@ -0,0 +1,93 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	// keyAccountChannelRegs holds the times the account registered channels in the last day, as JSON.
+	keyAccountChannelRegs = "account.channelregs %s"
+
+	// opers with this capability aren't held to the channel registration limits
+	chanregOverrideCapab = "oper:chanreg_override"
+)
+
+var (
+	errChannelLimitReached = errors.New("Account owns the maximum number of channels")
+)
+
+// accountChannelCount returns how many registered channels the given account founded.
+func accountChannelCount(tx *buntdb.Tx, accountKey string) int {
+	var count int
+	tx.AscendKeys(strings.Replace(keyChannelFounder, "%s", "*", 1), func(key, founder string) bool {
+		if founderKey, err := CasefoldName(founder); err == nil && founderKey == accountKey {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+// loadAccountChannelRegs returns the times the given account registered channels in the last day.
+func loadAccountChannelRegs(tx *buntdb.Tx, accountKey string) []time.Time {
+	regsText, err := tx.Get(fmt.Sprintf(keyAccountChannelRegs, accountKey))
+	if err != nil {
+		return nil
+	}
+	var regs []time.Time
+	json.Unmarshal([]byte(regsText), &regs)
+
+	cutoff := time.Now().Add(-24 * time.Hour)
+	var recent []time.Time
+	for _, regTime := range regs {
+		if regTime.After(cutoff) {
+			recent = append(recent, regTime)
+		}
+	}
+	return recent
+}
+
+// checkChannelRegLimits returns a message saying why the account can't register another
+// channel, or an empty string if it can.
+func (conf *ChannelRegistrationConfig) checkChannelRegLimits(tx *buntdb.Tx, accountKey string) string {
+	if 0 < conf.MaxChannelsPerAccount && conf.MaxChannelsPerAccount <= accountChannelCount(tx, accountKey) {
+		return fmt.Sprintf("You already own the maximum of %d channels", conf.MaxChannelsPerAccount)
+	}
+
+	regs := loadAccountChannelRegs(tx, accountKey)
+	if 0 < conf.MaxPerDay && conf.MaxPerDay <= len(regs) {
+		return fmt.Sprintf("You can only register %d channels a day, try again later", conf.MaxPerDay)
+	}
+	if 0 < conf.MaxPerHour {
+		var lastHour int
+		cutoff := time.Now().Add(-time.Hour)
+		for _, regTime := range regs {
+			if regTime.After(cutoff) {
+				lastHour++
+			}
+		}
+		if conf.MaxPerHour <= lastHour {
+			return fmt.Sprintf("You can only register %d channels an hour, try again later", conf.MaxPerHour)
+		}
+	}
+	return ""
+}
+
+// addAccountChannelReg records that the account just registered a channel.
+func addAccountChannelReg(tx *buntdb.Tx, accountKey string) {
+	regs := append(loadAccountChannelRegs(tx, accountKey), time.Now())
+	regsText, err := json.Marshal(regs)
+	if err != nil {
+		return
+	}
+	tx.Set(fmt.Sprintf(keyAccountChannelRegs, accountKey), string(regsText), nil)
+}
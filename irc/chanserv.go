@@ -5,6 +5,7 @@ package irc
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -15,8 +16,8 @@ import (
 )
 
 // csHandler handles the /CS and /CHANSERV commands
-func csHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
-	server.chanservReceivePrivmsg(client, strings.Join(msg.Params, " "))
+func csHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	server.chanservReceivePrivmsg(client, strings.Join(msg.Params, " "), rb)
 	return false
 }
 
@@ -26,10 +27,10 @@ func (server *Server) chanservReceiveNotice(client *Client, message string) {
 
 // ChanServNotice sends the client a notice from ChanServ.
 func (client *Client) ChanServNotice(text string) {
-	client.Send(nil, fmt.Sprintf("ChanServ!services@%s", client.server.name), "NOTICE", client.nick, text)
+	NewResponseBuffer(client).ChanServNotice(text)
 }
 
-func (server *Server) chanservReceivePrivmsg(client *Client, message string) {
+func (server *Server) chanservReceivePrivmsg(client *Client, message string, rb *ResponseBuffer) {
 	var params []string
 	for _, p := range strings.Split(message, " ") {
 		if len(p) > 0 {
@@ -37,7 +38,7 @@ func (server *Server) chanservReceivePrivmsg(client *Client, message string) {
 		}
 	}
 	if len(params) < 1 {
-		client.ChanServNotice("You need to run a command")
+		rb.ChanServNotice("You need to run a command")
 		//TODO(dan): dump CS help here
 		return
 	}
@@ -47,12 +48,15 @@ func (server *Server) chanservReceivePrivmsg(client *Client, message string) {
 
 	if command == "register" {
 		if len(params) < 2 {
-			client.ChanServNotice("Syntax: REGISTER <channel>")
+			rb.ChanServNotice("Syntax: REGISTER <channel>")
 			return
 		}
 
 		if !server.channelRegistrationEnabled {
-			client.ChanServNotice("Channel registration is not enabled")
+			rb.ChanServNotice("Channel registration is not enabled")
+			return
+		}
+		if !server.checkWritable(client, "CHANSERV", rb) {
 			return
 		}
 
@@ -62,33 +66,40 @@ func (server *Server) chanservReceivePrivmsg(client *Client, message string) {
 		channelName := params[1]
 		channelKey, err := CasefoldChannel(channelName)
 		if err != nil {
-			client.ChanServNotice("Channel name is not valid")
+			rb.ChanServNotice("Channel name is not valid")
 			return
 		}
 
 		channelInfo := server.channels.Get(channelKey)
 		if channelInfo == nil {
-			client.ChanServNotice("You must be an oper on the channel to register it")
+			rb.ChanServNotice("You must be an oper on the channel to register it")
 			return
 		}
 
 		if !channelInfo.ClientIsAtLeast(client, ChannelOperator) {
-			client.ChanServNotice("You must be an oper on the channel to register it")
+			rb.ChanServNotice("You must be an oper on the channel to register it")
 			return
 		}
 
 		server.store.Update(func(tx *buntdb.Tx) error {
 			currentChan := server.loadChannelNoMutex(tx, channelKey)
 			if currentChan != nil {
-				client.ChanServNotice("Channel is already registered")
+				rb.ChanServNotice("Channel is already registered")
 				return nil
 			}
 
 			account := client.account
 			if account == &NoAccount {
-				client.ChanServNotice("You must be logged in to register a channel")
+				rb.ChanServNotice("You must be logged in to register a channel")
 				return nil
 			}
+			accountKey, _ := CasefoldName(account.Name)
+			if !client.HasCapabs(chanregOverrideCapab) {
+				if reason := server.channelRegistration.checkChannelRegLimits(tx, accountKey); reason != "" {
+					rb.ChanServNotice(reason)
+					return nil
+				}
+			}
 
 			chanRegInfo := RegisteredChannel{
 				Name:         channelName,
@@ -99,8 +110,9 @@ func (server *Server) chanservReceivePrivmsg(client *Client, message string) {
 				TopicSetTime: channelInfo.topicSetTime,
 			}
 			server.saveChannelNoMutex(tx, channelKey, chanRegInfo)
+			addAccountChannelReg(tx, accountKey)
 
-			client.ChanServNotice(fmt.Sprintf("Channel %s successfully registered", channelName))
+			rb.ChanServNotice(fmt.Sprintf("Channel %s successfully registered", channelName))
 
 			server.logger.Info("chanserv", fmt.Sprintf("Client %s registered channel %s", client.nick, channelName))
 			server.snomasks.Send(sno.LocalChannels, fmt.Sprintf(ircfmt.Unescape("Channel registered $c[grey][$r%s$c[grey]] by $c[grey][$r%s$c[grey]]"), channelName, client.nickMaskString))
@@ -109,19 +121,332 @@ func (server *Server) chanservReceivePrivmsg(client *Client, message string) {
 			defer channelInfo.membersMutex.Unlock()
 
 			// give them founder privs
-			change := channelInfo.applyModeMemberNoMutex(client, ChannelFounder, Add, client.nickCasefolded)
+			change := channelInfo.applyModeMemberNoMutex(client, ChannelFounder, Add, client.nickCasefolded, rb)
 			if change != nil {
-				//TODO(dan): we should change the name of String and make it return a slice here
-				//TODO(dan): unify this code with code in modes.go
-				args := append([]string{channelName}, strings.Split(change.String(), " ")...)
-				for member := range channelInfo.members {
-					member.Send(nil, fmt.Sprintf("ChanServ!services@%s", client.server.name), "MODE", args...)
-				}
+				channelInfo.sendModeChangesNoMutex(fmt.Sprintf("ChanServ!services@%s", client.server.name), ModeChanges{*change})
 			}
 
 			return nil
 		})
+	} else if command == "wordfilter" {
+		server.chanservWordFilter(client, params[1:], rb)
+	} else if command == "urlpolicy" {
+		server.chanservURLPolicy(client, params[1:], rb)
+	} else if command == "op" || command == "deop" {
+		server.chanservOp(client, command, params[1:], rb)
+	} else if command == "amode" {
+		server.chanservAmode(client, params[1:], rb)
+	} else if command == "transfer" {
+		server.chanservTransfer(client, params[1:], rb)
+	} else if command == "info" {
+		server.chanservInfo(client, params[1:], rb)
+	} else if command == "successor" {
+		server.chanservSuccessor(client, params[1:], rb)
+	} else if command == "topichistory" {
+		server.chanservTopicHistory(client, params[1:], rb)
+	} else if command == "webhook" {
+		server.chanservWebhook(client, params[1:], rb)
+	} else {
+		rb.ChanServNotice("Sorry, I don't know that command")
+	}
+}
+
+// modeIsAbove returns true if the given channel privilege mode outranks the other one.
+func modeIsAbove(mode, other Mode) bool {
+	ranks := Modes{ChannelFounder, ChannelAdmin, ChannelOperator, Halfop, Voice}
+	for _, rank := range ranks {
+		if rank == mode {
+			return mode != other
+		} else if rank == other {
+			return false
+		}
+	}
+	return false
+}
+
+// chanservModeNoMutex applies the given member mode changes to the channel, and tells its
+// members about them as ChanServ.
+func (channel *Channel) chanservModeNoMutex(client *Client, changes ModeChanges, rb *ResponseBuffer) {
+	// requires Lock()
+
+	var applied ModeChanges
+	for _, change := range changes {
+		appliedChange := channel.applyModeMemberNoMutex(client, change.mode, change.op, change.arg, rb)
+		if appliedChange != nil {
+			applied = append(applied, *appliedChange)
+		}
+	}
+	if len(applied) == 0 {
+		return
+	}
+	channel.queueModeChangesNoMutex(fmt.Sprintf("ChanServ!services@%s", channel.server.name), applied)
+}
+
+// accountModeChangesNoMutex returns the changes that give (or take away) the given mode
+// for every member of the channel logged into the given account.
+func (channel *Channel) accountModeChangesNoMutex(accountKey string, op ModeOp, mode Mode) (changes ModeChanges) {
+	// requires Lock()
+
+	for member := range channel.members {
+		if member.account == &NoAccount {
+			continue
+		}
+		memberAccountKey, _ := CasefoldName(member.account.Name)
+		if memberAccountKey == accountKey {
+			changes = append(changes, ModeChange{op: op, mode: mode, arg: member.nick})
+		}
+	}
+	return changes
+}
+
+// loadRegisteredChannel returns the casefolded name, live channel and registration of the
+// given channel, telling the client if it isn't registered. The live channel is nil if no
+// one's in it.
+func (server *Server) loadRegisteredChannel(client *Client, channelName string, rb *ResponseBuffer) (string, *Channel, *RegisteredChannel) {
+	channelKey, err := CasefoldChannel(channelName)
+	if err != nil {
+		rb.ChanServNotice("Channel name is not valid")
+		return "", nil, nil
+	}
+
+	var chanReg *RegisteredChannel
+	server.registeredChannelsMutex.Lock()
+	server.store.View(func(tx *buntdb.Tx) error {
+		chanReg = server.loadChannelNoMutex(tx, channelKey)
+		return nil
+	})
+	server.registeredChannelsMutex.Unlock()
+	if chanReg == nil {
+		rb.ChanServNotice(fmt.Sprintf("%s is not registered", channelName))
+		return "", nil, nil
+	}
+	return channelKey, server.channels.Get(channelKey), chanReg
+}
+
+// chanservOp handles the ChanServ OP and DEOP commands, which let people on the channel's
+// access list op and deop themselves or others.
+//
+// OP <channel> [<nick>] | DEOP <channel> [<nick>]
+func (server *Server) chanservOp(client *Client, command string, params []string, rb *ResponseBuffer) {
+	if len(params) < 1 {
+		rb.ChanServNotice(fmt.Sprintf("Syntax: %s <channel> [<nick>]", strings.ToUpper(command)))
+		return
+	}
+	_, channel, chanReg := server.loadRegisteredChannel(client, params[0], rb)
+	if chanReg == nil || server.refuseLockedChannel(client, chanReg, rb) {
+		return
+	}
+	if channel == nil {
+		rb.ChanServNotice(fmt.Sprintf("No one is in %s", chanReg.Name))
+		return
+	}
+	access := chanReg.accessMode(client.account)
+	if access != ChannelOperator && !modeIsAbove(access, ChannelOperator) {
+		rb.ChanServNotice(fmt.Sprintf("You need to be a channel operator on %s's access list to do that", chanReg.Name))
+		return
+	}
+
+	nick := client.nick
+	if 1 < len(params) {
+		nick = params[1]
+	}
+	// the access list decides who can op and deop who, not who got ops first
+	if target := server.clients.Get(nick); target != nil && target != client {
+		targetAccess := chanReg.accessMode(target.account)
+		if targetAccess != 0 && !modeIsAbove(access, targetAccess) {
+			rb.ChanServNotice(fmt.Sprintf("You don't have enough access on %s to change %s's modes", chanReg.Name, target.nick))
+			return
+		}
+	}
+	op := Add
+	if command == "deop" {
+		op = Remove
+	}
+
+	channel.membersMutex.Lock()
+	defer channel.membersMutex.Unlock()
+	channel.chanservModeNoMutex(client, ModeChanges{{op: op, mode: ChannelOperator, arg: nick}}, rb)
+}
+
+// chanservAmode handles the ChanServ AMODE command, which manages the modes that accounts get
+// when they join a registered channel. The founder can give out any mode, and admins can give
+// out the modes below theirs.
+//
+// AMODE <channel> [{+|-}<mode> <account>]
+func (server *Server) chanservAmode(client *Client, params []string, rb *ResponseBuffer) {
+	if len(params) < 1 {
+		rb.ChanServNotice("Syntax: AMODE <channel> [{+|-}<mode> <account>]")
+		return
+	}
+	channelKey, channel, chanReg := server.loadRegisteredChannel(client, params[0], rb)
+	if chanReg == nil {
+		return
+	}
+
+	if len(params) < 3 {
+		if len(chanReg.AccessList) == 0 {
+			rb.ChanServNotice(fmt.Sprintf("%s has no one on its access list", chanReg.Name))
+			return
+		}
+		rb.ChanServNotice(fmt.Sprintf("Access list for %s:", chanReg.Name))
+		var entries []string
+		for accountKey, mode := range chanReg.AccessList {
+			entries = append(entries, fmt.Sprintf("%s +%s", accountKey, mode.String()))
+		}
+		sort.Strings(entries)
+		for _, entry := range entries {
+			rb.ChanServNotice(entry)
+		}
+		return
+	}
+	if server.refuseLockedChannel(client, chanReg, rb) {
+		return
+	}
+
+	changes, unknown := ParseChannelModeChanges(params[1], params[2])
+	if len(unknown) != 0 || len(changes) != 1 || changes[0].mode == ChannelFounder || ChannelModePrefixes[changes[0].mode] == "" {
+		rb.ChanServNotice("Mode must be one of +a, +o, +h or +v (or - to remove it)")
+		return
+	}
+	change := changes[0]
+	if !modeIsAbove(chanReg.accessMode(client.account), change.mode) {
+		rb.ChanServNotice(fmt.Sprintf("You don't have enough access on %s to do that", chanReg.Name))
+		return
+	}
+	accountKey, err := CasefoldName(change.arg)
+	if err != nil || server.loadAccountByName(accountKey) == nil {
+		rb.ChanServNotice(fmt.Sprintf("The account %s isn't registered", change.arg))
+		return
+	}
+	if !server.checkWritable(client, "CHANSERV", rb) {
+		return
+	}
+
+	oldMode := chanReg.AccessList[accountKey]
+	if change.op == Remove && oldMode != change.mode {
+		rb.ChanServNotice(fmt.Sprintf("%s doesn't have +%s on %s", accountKey, change.mode.String(), chanReg.Name))
+		return
+	}
+	if oldMode != 0 && !modeIsAbove(chanReg.accessMode(client.account), oldMode) {
+		rb.ChanServNotice(fmt.Sprintf("You don't have enough access on %s to change %s's mode", chanReg.Name, accountKey))
+		return
+	}
+
+	server.registeredChannelsMutex.Lock()
+	server.store.Update(func(tx *buntdb.Tx) error {
+		if chanReg.AccessList == nil {
+			chanReg.AccessList = make(map[string]Mode)
+		}
+		if change.op == Add {
+			chanReg.AccessList[accountKey] = change.mode
+		} else {
+			delete(chanReg.AccessList, accountKey)
+		}
+		server.saveChannelNoMutex(tx, channelKey, *chanReg)
+		return nil
+	})
+	server.registeredChannelsMutex.Unlock()
+
+	if change.op == Add {
+		rb.ChanServNotice(fmt.Sprintf("%s now gets +%s on %s", accountKey, change.mode.String(), chanReg.Name))
 	} else {
-		client.ChanServNotice("Sorry, I don't know that command")
+		rb.ChanServNotice(fmt.Sprintf("%s no longer gets +%s on %s", accountKey, change.mode.String(), chanReg.Name))
+	}
+
+	// bring the people logged into that account up to date
+	if channel != nil {
+		channel.membersMutex.Lock()
+		var liveChanges ModeChanges
+		if oldMode != 0 && oldMode != change.mode {
+			liveChanges = append(liveChanges, channel.accountModeChangesNoMutex(accountKey, Remove, oldMode)...)
+		}
+		liveChanges = append(liveChanges, channel.accountModeChangesNoMutex(accountKey, change.op, change.mode)...)
+		channel.chanservModeNoMutex(client, liveChanges, rb)
+		channel.membersMutex.Unlock()
+	}
+}
+
+// chanservTransfer handles the ChanServ TRANSFER command, which gives a registered channel to
+// another account.
+//
+// TRANSFER <channel> <account>
+func (server *Server) chanservTransfer(client *Client, params []string, rb *ResponseBuffer) {
+	if len(params) < 2 {
+		rb.ChanServNotice("Syntax: TRANSFER <channel> <account>")
+		return
+	}
+	channelKey, channel, chanReg := server.loadRegisteredChannel(client, params[0], rb)
+	if chanReg == nil || server.refuseLockedChannel(client, chanReg, rb) {
+		return
+	}
+	if chanReg.accessMode(client.account) != ChannelFounder {
+		rb.ChanServNotice(fmt.Sprintf("Only the founder of %s can transfer it", chanReg.Name))
+		return
+	}
+	newFounder := server.loadAccountByName(params[1])
+	if newFounder == nil {
+		rb.ChanServNotice(fmt.Sprintf("The account %s isn't registered", params[1]))
+		return
+	}
+	if newFounder.Name == chanReg.Founder {
+		rb.ChanServNotice(fmt.Sprintf("%s already owns %s", newFounder.Name, chanReg.Name))
+		return
+	}
+	if !server.checkWritable(client, "CHANSERV", rb) {
+		return
+	}
+
+	oldFounderKey, _ := CasefoldName(chanReg.Founder)
+	newFounderKey, _ := CasefoldName(newFounder.Name)
+	server.registeredChannelsMutex.Lock()
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		// channels can't be handed over to get around the ownership limit
+		maxChannels := server.channelRegistration.MaxChannelsPerAccount
+		if 0 < maxChannels && maxChannels <= accountChannelCount(tx, newFounderKey) && !client.HasCapabs(chanregOverrideCapab) {
+			return errChannelLimitReached
+		}
+		chanReg.Founder = newFounder.Name
+		delete(chanReg.AccessList, newFounderKey)
+		server.saveChannelNoMutex(tx, channelKey, *chanReg)
+		return nil
+	})
+	server.registeredChannelsMutex.Unlock()
+	if err == errChannelLimitReached {
+		rb.ChanServNotice(fmt.Sprintf("%s already owns the maximum of %d channels", newFounder.Name, server.channelRegistration.MaxChannelsPerAccount))
+		return
+	}
+
+	rb.ChanServNotice(fmt.Sprintf("%s has been transferred to %s", chanReg.Name, newFounder.Name))
+	server.logger.Info("chanserv", fmt.Sprintf("Client %s transferred channel %s to %s", client.nick, chanReg.Name, newFounder.Name))
+	server.snomasks.Send(sno.LocalChannels, fmt.Sprintf(ircfmt.Unescape("Channel $c[grey][$r%s$c[grey]] transferred to $c[grey][$r%s$c[grey]] by $c[grey][$r%s$c[grey]]"), chanReg.Name, newFounder.Name, client.nickMaskString))
+
+	if channel != nil {
+		channel.membersMutex.Lock()
+		changes := channel.accountModeChangesNoMutex(oldFounderKey, Remove, ChannelFounder)
+		changes = append(changes, channel.accountModeChangesNoMutex(newFounderKey, Add, ChannelFounder)...)
+		channel.chanservModeNoMutex(client, changes, rb)
+		channel.membersMutex.Unlock()
+	}
+}
+
+// chanservInfo handles the ChanServ INFO command, which shows information about a registered
+// channel.
+//
+// INFO <channel>
+func (server *Server) chanservInfo(client *Client, params []string, rb *ResponseBuffer) {
+	if len(params) < 1 {
+		rb.ChanServNotice("Syntax: INFO <channel>")
+		return
+	}
+	_, _, chanReg := server.loadRegisteredChannel(client, params[0], rb)
+	if chanReg == nil {
+		return
+	}
+	rb.ChanServNotice(fmt.Sprintf("Information for %s:", chanReg.Name))
+	rb.ChanServNotice(fmt.Sprintf("Founder: %s", chanReg.Founder))
+	rb.ChanServNotice(fmt.Sprintf("Registered: %s", chanReg.RegisteredAt.UTC().Format(time.RFC1123)))
+	rb.ChanServNotice(fmt.Sprintf("Access list entries: %d", len(chanReg.AccessList)))
+	if server.isChannelLocked(chanReg) {
+		rb.ChanServNotice("This channel is locked, because its founder's account is suspended")
 	}
 }
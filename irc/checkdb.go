@@ -0,0 +1,204 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/buntdb"
+)
+
+// accountReverseKeyPrefixes returns the prefixes of the account keys that find an account by
+// something else (a certificate, external subject, API key or grouped nick), and so have the
+// account in their value instead of in the key itself.
+func accountReverseKeyPrefixes() []string {
+	return []string{
+		strings.TrimSuffix(keyCertToAccount, "%s"),
+		strings.TrimSuffix(keyAccountOAuth2Subject, "%s"),
+		strings.TrimSuffix(keyAPIKeyToAccount, "%s"),
+		strings.TrimSuffix(keyGroupedNick, "%s"),
+	}
+}
+
+// CheckDBResult is what CheckDB found wrong with a database.
+type CheckDBResult struct {
+	Problems []string
+}
+
+func (result *CheckDBResult) problem(format string, args ...interface{}) {
+	result.Problems = append(result.Problems, fmt.Sprintf(format, args...))
+}
+
+// CheckDB checks that everything in the database at the given path points at accounts and
+// channels that exist: account data, grouped nicks, vhosts, and channel founders, successors
+// and access lists. If repair is set, the problems it finds are fixed by deleting what's left
+// over, and handing founderless channels over like their founder's account was dropped. The
+// server shouldn't be running while this is done.
+func CheckDB(path string, repair bool) (*CheckDBResult, error) {
+	// opening a datastore that isn't there would create an empty one
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("Failed to open datastore: %s", err.Error())
+	}
+	store, err := buntdb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open datastore: %s", err.Error())
+	}
+	defer store.Close()
+
+	var result CheckDBResult
+	check := func(tx *buntdb.Tx) error {
+		version, _ := tx.Get(keySchemaVersion)
+		if version != latestDbSchema {
+			return errDbOutOfDate
+		}
+		checkChannels(tx, &result, repair)
+		checkAccountKeys(tx, &result, repair)
+		return nil
+	}
+	if repair {
+		err = store.Update(check)
+	} else {
+		err = store.View(check)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// existingKeys returns the casefolded names of the accounts or channels with the given
+// exists key.
+func existingKeys(tx *buntdb.Tx, existsKey string) map[string]bool {
+	prefix := strings.TrimSuffix(existsKey, "%s")
+	existing := make(map[string]bool)
+	tx.AscendKeys(prefix+"*", func(key, value string) bool {
+		existing[strings.TrimPrefix(key, prefix)] = true
+		return true
+	})
+	return existing
+}
+
+// checkChannels checks that registered channels' founders, successors and access lists are
+// accounts that exist, and that there's no data left over from unregistered channels.
+func checkChannels(tx *buntdb.Tx, result *CheckDBResult, repair bool) {
+	accounts := existingKeys(tx, keyAccountExists)
+	channels := existingKeys(tx, keyChannelExists)
+	// handing channels over uses the same code as dropping accounts, which caches channels
+	server := &Server{registeredChannels: make(map[string]*RegisteredChannel)}
+
+	// channels whose founder doesn't exist are handed over, or unregistered if no one can
+	// take them, just like they would have been if the founder's account had been dropped
+	missingFounders := make(map[string]bool)
+	var invalidFounders []string
+	for channelKey := range channels {
+		founder, _ := tx.Get(fmt.Sprintf(keyChannelFounder, channelKey))
+		founderKey, err := CasefoldName(founder)
+		if err != nil {
+			// no one can be found to hand these over to, so they can only be unregistered
+			result.problem("channel %s has an invalid founder [%s]", channelKey, founder)
+			invalidFounders = append(invalidFounders, channelKey)
+		} else if !accounts[founderKey] {
+			result.problem("channel %s has a founder that doesn't exist [%s]", channelKey, founder)
+			missingFounders[founderKey] = true
+		}
+	}
+	if repair {
+		for founderKey := range missingFounders {
+			server.handOverChannelsNoMutex(tx, founderKey)
+		}
+		for _, channelKey := range invalidFounders {
+			server.deleteChannelNoMutex(tx, channelKey)
+		}
+		channels = existingKeys(tx, keyChannelExists)
+	}
+
+	var channelKeys []string
+	for channelKey := range channels {
+		channelKeys = append(channelKeys, channelKey)
+	}
+	sort.Strings(channelKeys)
+	for _, channelKey := range channelKeys {
+		chanReg := server.loadChannelNoMutex(tx, channelKey)
+		if chanReg == nil {
+			continue
+		}
+		changed := false
+		if chanReg.Successor != "" {
+			successorKey, err := CasefoldName(chanReg.Successor)
+			if err != nil || !accounts[successorKey] {
+				result.problem("channel %s has a successor that doesn't exist [%s]", chanReg.Name, chanReg.Successor)
+				chanReg.Successor = ""
+				changed = true
+			}
+		}
+		for accountKey := range chanReg.AccessList {
+			if !accounts[accountKey] {
+				result.problem("channel %s has an account on its access list that doesn't exist [%s]", chanReg.Name, accountKey)
+				delete(chanReg.AccessList, accountKey)
+				changed = true
+			}
+		}
+		if changed && repair {
+			server.saveChannelNoMutex(tx, channelKey, *chanReg)
+		}
+	}
+
+	// data for channels that aren't registered
+	var leftover []string
+	tx.AscendKeys("channel.*", func(key, value string) bool {
+		space := strings.LastIndex(key, " ")
+		if space != -1 && !channels[key[space+1:]] {
+			result.problem("%s belongs to a channel that isn't registered", key)
+			leftover = append(leftover, key)
+		}
+		return true
+	})
+	if repair {
+		for _, key := range leftover {
+			tx.Delete(key)
+		}
+	}
+}
+
+// checkAccountKeys checks that all the account data (including grouped nicks, vhosts and
+// certificates) belongs to accounts that exist, and that no nick is grouped with one account
+// while being the name of another.
+func checkAccountKeys(tx *buntdb.Tx, result *CheckDBResult, repair bool) {
+	accounts := existingKeys(tx, keyAccountExists)
+	reversePrefixes := accountReverseKeyPrefixes()
+	groupedNickPrefix := strings.TrimSuffix(keyGroupedNick, "%s")
+
+	var leftover []string
+	tx.AscendKeys("account.*", func(key, value string) bool {
+		for _, prefix := range reversePrefixes {
+			if strings.HasPrefix(key, prefix) {
+				if !accounts[value] {
+					result.problem("%s points at an account that doesn't exist [%s]", key, value)
+					leftover = append(leftover, key)
+				} else if prefix == groupedNickPrefix {
+					nickname := strings.TrimPrefix(key, prefix)
+					if accounts[nickname] && nickname != value {
+						result.problem("%s is grouped with %s, but it's also the name of an account", nickname, value)
+						leftover = append(leftover, key)
+					}
+				}
+				return true
+			}
+		}
+		space := strings.LastIndex(key, " ")
+		if space != -1 && !accounts[key[space+1:]] {
+			result.problem("%s belongs to an account that doesn't exist", key)
+			leftover = append(leftover, key)
+		}
+		return true
+	})
+	if repair {
+		for _, key := range leftover {
+			tx.Delete(key)
+		}
+	}
+}
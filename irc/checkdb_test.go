@@ -0,0 +1,150 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tidwall/buntdb"
+)
+
+func TestCheckAccountKeys(t *testing.T) {
+	store, err := buntdb.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	good := map[string]string{
+		fmt.Sprintf(keyAccountExists, "alice"):    "1",
+		fmt.Sprintf(keyAccountName, "alice"):      "Alice",
+		fmt.Sprintf(keyAccountExists, "bob"):      "1",
+		fmt.Sprintf(keyAccountVerified, "bob"):    "1",
+		fmt.Sprintf(keyGroupedNick, "alice_"):     "alice",
+		fmt.Sprintf(keyCertToAccount, testCertfp): "bob",
+	}
+	bad := map[string]string{
+		// data for an account that doesn't exist
+		fmt.Sprintf(keyAccountName, "carol"): "Carol",
+		// reverse keys pointing at an account that doesn't exist
+		fmt.Sprintf(keyGroupedNick, "carol_"):     "carol",
+		fmt.Sprintf(keyCertToAccount, "deadbeef"): "carol",
+		// a nick grouped with one account while being the name of another
+		fmt.Sprintf(keyGroupedNick, "bob"): "alice",
+	}
+	store.Update(func(tx *buntdb.Tx) error {
+		for _, keys := range []map[string]string{good, bad} {
+			for key, value := range keys {
+				tx.Set(key, value, nil)
+			}
+		}
+		return nil
+	})
+
+	for _, repair := range []bool{false, true} {
+		var result CheckDBResult
+		check := func(tx *buntdb.Tx) error {
+			checkAccountKeys(tx, &result, repair)
+			return nil
+		}
+		if repair {
+			store.Update(check)
+		} else {
+			store.View(check)
+		}
+		if len(result.Problems) != len(bad) {
+			t.Errorf("repair %v: expected %d problems, got %q", repair, len(bad), result.Problems)
+		}
+	}
+
+	// repairing deleted exactly the bad keys, so there's nothing left to find
+	store.View(func(tx *buntdb.Tx) error {
+		for key := range good {
+			if _, err := tx.Get(key); err != nil {
+				t.Errorf("%s: expected the key to be kept", key)
+			}
+		}
+		for key := range bad {
+			if _, err := tx.Get(key); err != buntdb.ErrNotFound {
+				t.Errorf("%s: expected the key to be deleted", key)
+			}
+		}
+		var result CheckDBResult
+		checkAccountKeys(tx, &result, false)
+		if len(result.Problems) != 0 {
+			t.Errorf("expected no problems after repairing, got %q", result.Problems)
+		}
+		return nil
+	})
+}
+
+func TestCheckChannels(t *testing.T) {
+	store, err := buntdb.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	store.Update(func(tx *buntdb.Tx) error {
+		createVerifiedAccount(tx, "alice", "Alice", &AccountCredentials{})
+		createVerifiedAccount(tx, "bob", "Bob", &AccountCredentials{})
+		for channelKey, chanReg := range map[string]RegisteredChannel{
+			"#good": {Name: "#good", Founder: "Alice", Successor: "Bob", AccessList: map[string]Mode{"bob": ChannelOperator}},
+			// a successor and access list entry that don't exist
+			"#stale": {Name: "#stale", Founder: "Alice", Successor: "Carol", AccessList: map[string]Mode{"carol": ChannelOperator, "bob": Voice}},
+			// a founder that doesn't exist, who Bob takes over from
+			"#orphan": {Name: "#orphan", Founder: "Dave", Successor: "Bob"},
+			// a founder no one can be found for
+			"#invalid": {Name: "#invalid", Founder: ""},
+		} {
+			saveRegisteredChannel(tx, channelKey, chanReg)
+		}
+		// data for a channel that isn't registered
+		tx.Set(fmt.Sprintf(keyChannelTopic, "#gone"), "hello", nil)
+		return nil
+	})
+
+	for _, repair := range []bool{false, true} {
+		var result CheckDBResult
+		check := func(tx *buntdb.Tx) error {
+			checkChannels(tx, &result, repair)
+			return nil
+		}
+		if repair {
+			store.Update(check)
+		} else {
+			store.View(check)
+		}
+		if len(result.Problems) != 5 {
+			t.Errorf("repair %v: expected 5 problems, got %q", repair, result.Problems)
+		}
+	}
+
+	store.View(func(tx *buntdb.Tx) error {
+		server := &Server{registeredChannels: make(map[string]*RegisteredChannel)}
+		if chanReg := server.loadChannelNoMutex(tx, "#good"); chanReg == nil || chanReg.Successor != "Bob" || chanReg.AccessList["bob"] != ChannelOperator {
+			t.Errorf("expected #good to be left alone, got %+v", chanReg)
+		}
+		if chanReg := server.loadChannelNoMutex(tx, "#stale"); chanReg == nil || chanReg.Successor != "" || len(chanReg.AccessList) != 1 {
+			t.Errorf("expected #stale to lose its missing successor and access, got %+v", chanReg)
+		}
+		if chanReg := server.loadChannelNoMutex(tx, "#orphan"); chanReg == nil || chanReg.Founder != "Bob" {
+			t.Errorf("expected #orphan to be handed over to Bob, got %+v", chanReg)
+		}
+		if chanReg := server.loadChannelNoMutex(tx, "#invalid"); chanReg != nil {
+			t.Errorf("expected #invalid to be unregistered, got %+v", chanReg)
+		}
+		if _, err := tx.Get(fmt.Sprintf(keyChannelTopic, "#gone")); err != buntdb.ErrNotFound {
+			t.Errorf("expected the unregistered channel's topic to be deleted")
+		}
+
+		var result CheckDBResult
+		checkChannels(tx, &result, false)
+		if len(result.Problems) != 0 {
+			t.Errorf("expected no problems after repairing, got %q", result.Problems)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+// setVhost changes the client's displayed hostname to the given vhost, or back to their
+// real hostname if it's empty. Everything that changes the displayed hostname should go
+// through here, so the people who can see the client hear about it.
+func (client *Client) setVhost(vhost string) {
+	if client.vhost == vhost {
+		return
+	}
+
+	oldNickMask := client.nickMaskString
+	client.vhost = vhost
+	client.updateNickMask()
+	if client.nickMaskString != oldNickMask {
+		client.announceHostChange(oldNickMask)
+	}
+}
+
+// announceHostChange tells everyone who can see the client that their hostname changed.
+// Clients with chghost get a CHGHOST line, and the others see the client quit and rejoin
+// their channels, since that's the only way to update the hostname they know about.
+func (client *Client) announceHostChange(oldNickMask string) {
+	// CHGHOST comes from the old nickmask
+	for fClient := range client.Friends(ChgHost) {
+		fClient.sendFromClientAs("", client, oldNickMask, nil, "CHGHOST", client.username, client.hostname)
+	}
+
+	quitSent := make(ClientSet)
+	for channel := range client.channels {
+		channel.membersMutex.RLock()
+		var modeString string
+		var modeArgs []string
+		for _, mode := range (Modes{ChannelFounder, ChannelAdmin, ChannelOperator, Halfop, Voice}) {
+			if channel.members.HasMode(client, mode) {
+				modeString += mode.String()
+				modeArgs = append(modeArgs, client.nick)
+			}
+		}
+
+		for member := range channel.members {
+			if member == client || member.hasCapability(ChgHost) {
+				continue
+			}
+			if !quitSent.Has(member) {
+				member.sendFromClientAs("", client, oldNickMask, nil, "QUIT", "Changing host")
+				quitSent.Add(member)
+			}
+			if member.hasCapability(ExtendedJoin) {
+				member.SendFromClient("", client, nil, "JOIN", channel.name, client.account.Name, client.realname)
+			} else {
+				member.SendFromClient("", client, nil, "JOIN", channel.name)
+			}
+			if modeString != "" {
+				member.Send(nil, client.server.name, "MODE", append([]string{channel.name, "+" + modeString}, modeArgs...)...)
+			}
+		}
+		channel.membersMutex.RUnlock()
+	}
+
+	// the client only needs to be told if they can't get CHGHOST
+	if !client.hasCapability(ChgHost) {
+		client.Send(nil, client.server.name, RPL_HOSTHIDDEN, client.nick, client.hostname, "is now your displayed host")
+	}
+}
@@ -14,11 +14,14 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/goshuirc/irc-go/ircfmt"
 	"github.com/goshuirc/irc-go/ircmsg"
 	ident "github.com/oragono/go-ident"
+	"github.com/oragono/oragono/irc/ratelimit"
 	"github.com/oragono/oragono/irc/sno"
 )
 
@@ -29,6 +32,8 @@ const (
 	QuitTimeout = time.Minute
 	// IdentTimeoutSeconds is how many seconds before our ident (username) check times out.
 	IdentTimeoutSeconds = 5
+	// IRCv3TimestampFormat is the format used for server-time tags.
+	IRCv3TimestampFormat = "2006-01-02T15:04:05.999Z"
 )
 
 var (
@@ -40,51 +45,87 @@ var (
 
 // Client is an IRC client.
 type Client struct {
-	account            *ClientAccount
-	atime              time.Time
-	authorized         bool
-	awayMessage        string
-	capabilities       CapabilitySet
-	capState           CapState
-	capVersion         CapVersion
-	certfp             string
-	channels           ChannelSet
-	class              *OperClass
-	ctime              time.Time
-	destroyMutex       sync.Mutex
-	exitedSnomaskSent  bool
-	flags              map[Mode]bool
-	hasQuit            bool
-	hops               int
-	hostname           string
-	idleTimer          *time.Timer
-	isDestroyed        bool
-	isQuitting         bool
-	monitoring         map[string]bool
-	nick               string
-	nickCasefolded     string
-	nickMaskCasefolded string
-	nickMaskString     string // cache for nickmask string since it's used with lots of replies
-	operName           string
-	quitMessageSent    bool
-	quitMutex          sync.Mutex
-	quitTimer          *time.Timer
+	// lineReceived is when the line being handled was read as a UnixNano, or 0 between
+	// lines. It must be accessed atomically, so it comes first to keep it 64-bit aligned on
+	// 32-bit platforms.
+	lineReceived int64
+
+	account    *ClientAccount
+	atime      time.Time
+	authorized bool
+	// passLogin holds the account credentials given with PASS, until registration.
+	passLogin                 string
+	awayMessage               string
+	capabilities              CapabilitySet
+	capabilitiesMutex         sync.RWMutex
+	capState                  CapState
+	capVersion                CapVersion
+	certfp                    string
+	channels                  ChannelSet
+	class                     *OperClass
+	commandBucket             *ratelimit.TokenBucket // for fakelag, see fakelag()
+	fakelagged                bool                   // true while the client's commands are being slowed down
+	connectionClass           *ConnectionClass
+	connectionClassMutex      sync.RWMutex   // protects connectionClass and the two fields below, see connectionClassInfo()
+	connectionClassOverridden bool           // true if an oper moved the client to their current class
+	connectionClassReason     string         // why the client is in their current class
+	overLimits                limitsExceeded // limits the client went over when they connected, see checkExceededLimits()
+	ctime                     time.Time
+	destroyMutex              sync.Mutex
+	exitedSnomaskSent         bool
+	flags                     map[Mode]bool
+	flagsMutex                sync.RWMutex // protects flags, which other clients' goroutines check, see hasFlag()
+	hasQuit                   bool
+	hops                      int
+	hostname                  string
+	idleTimer                 *time.Timer
+	ignores                   *IgnoreLists
+	isDestroyed               bool
+	isQuitting                bool
+	listenerConfig            *ListenerConfig
+	monitoring                map[string]bool
+	nick                      string
+	nickCasefolded            string
+	nickMaskCasefolded        string
+	nickMaskString            string         // cache for nickmask string since it's used with lots of replies
+	operChallenge             *operChallenge // pending CHALLENGE login, if there is one
+	operName                  string
+	pastes                    map[string]*pasteState // recent lines sent to each channel, for paste detection
+	quitMessageSent           bool
+	// quitMessage is what the client's friends are told when they leave.
+	quitMessage    string
+	quitMutex      sync.Mutex
+	quitTimer      *time.Timer
+	plaintextTimer *time.Timer
+	nickTimer      *time.Timer
+	// nickEnforcementDue is the casefolded nickname to enforce once the client's goroutine
+	// gets to it, and nickEnforcementID changes whenever enforcement is started or stopped.
+	// both are protected by timerMutex
+	nickEnforcementDue string
+	nickEnforcementID  uint64
 	rawHostname        string
 	realname           string
 	registered         bool
-	saslInProgress     bool
-	saslMechanism      string
-	saslValue          string
-	server             *Server
-	socket             *Socket
-	timerMutex         sync.Mutex
-	username           string
-	vhost              string
-	whoisLine          string
+	batchCounter       uint32
+	// multiline is the multiline batch the client is sending, if there is one.
+	multiline      *multilineBatch
+	saslInProgress bool
+	saslMechanism  string
+	saslValue      string
+	scramSession   *scramSession
+	server         *Server
+	socket         *Socket
+	stateMutex     sync.RWMutex // held while the nick, masks, username, hostname, account, channels and operName change, see details()
+	timerMutex     sync.Mutex
+	typingTimes    map[string]time.Time // when we last relayed a typing notification from this client, by target
+	username       string
+	vhost          string
+	whoisChannels  string // which channels WHOIS shows, if the client has changed it
+	whoisLine      string
 }
 
 // NewClient returns a client with all the appropriate info setup.
-func NewClient(server *Server, conn net.Conn, isTLS bool) *Client {
+func NewClient(server *Server, conn net.Conn, isTLS bool, listenerConfig *ListenerConfig, overLimits limitsExceeded) *Client {
 	now := time.Now()
 	socket := NewSocket(conn, server.MaxSendQBytes)
 	go socket.RunSocketWriter()
@@ -97,20 +138,28 @@ func NewClient(server *Server, conn net.Conn, isTLS bool) *Client {
 		channels:       make(ChannelSet),
 		ctime:          now,
 		flags:          make(map[Mode]bool),
+		ignores:        NewIgnoreLists(),
+		listenerConfig: listenerConfig,
 		monitoring:     make(map[string]bool),
+		pastes:         make(map[string]*pasteState),
 		server:         server,
 		socket:         &socket,
+		typingTimes:    make(map[string]time.Time),
 		account:        &NoAccount,
 		nick:           "*", // * is used until actual nick is given
 		nickCasefolded: "*",
 		nickMaskString: "*", // * is used until actual nick is given
+		overLimits:     overLimits,
 	}
 	if isTLS {
 		client.flags[TLS] = true
 
 		// error is not useful to us here anyways so we can ignore it
 		client.certfp, _ = client.socket.CertFP()
+		server.liftExceededLimits(client)
 	}
+	class, reason := server.matchConnectionClass(client.IP(), isTLS)
+	client.setConnectionClass(class, reason, false)
 	if server.checkIdent {
 		_, serverPortString, err := net.SplitHostPort(conn.LocalAddr().String())
 		serverPort, _ := strconv.Atoi(serverPortString)
@@ -130,7 +179,9 @@ func NewClient(server *Server, conn net.Conn, isTLS bool) *Client {
 			_, err := CasefoldName(username) // ensure it's a valid username
 			if err == nil {
 				client.Notice("*** Found your username")
+				client.stateMutex.Lock()
 				client.username = username
+				client.stateMutex.Unlock()
 				// we don't need to updateNickMask here since nickMask is not used for anything yet
 			} else {
 				client.Notice("*** Got a malformed username, ignoring")
@@ -139,6 +190,9 @@ func NewClient(server *Server, conn net.Conn, isTLS bool) *Client {
 			client.Notice("*** Could not find your username")
 		}
 	}
+	if !client.checkPlaintextDeprecation() {
+		return client
+	}
 	client.Touch()
 	go client.run()
 
@@ -147,7 +201,7 @@ func NewClient(server *Server, conn net.Conn, isTLS bool) *Client {
 
 // IP returns the IP address of this client.
 func (client *Client) IP() net.IP {
-	return net.ParseIP(IPString(client.socket.conn.RemoteAddr()))
+	return net.ParseIP(IPString(client.socket.RemoteAddr()))
 }
 
 // IPString returns the IP address of this client as a string.
@@ -166,10 +220,10 @@ func (client *Client) IPString() string {
 func (client *Client) maxlens() (int, int) {
 	maxlenTags := 512
 	maxlenRest := 512
-	if client.capabilities[MessageTags] {
+	if client.hasCapability(MessageTags) {
 		maxlenTags = 4096
 	}
-	if client.capabilities[MaxLine] {
+	if client.hasCapability(MaxLine) {
 		if client.server.limits.LineLen.Tags > maxlenTags {
 			maxlenTags = client.server.limits.LineLen.Tags
 		}
@@ -184,46 +238,120 @@ func (client *Client) run() {
 	var line string
 	var msg ircmsg.IrcMessage
 
+	defer func() {
+		if r := recover(); r != nil {
+			client.handlePanic(r, msg.Command, line)
+		}
+
+		// ensure client connection gets closed
+		client.destroy()
+	}()
+
 	// Set the hostname for this client
-	client.rawHostname = AddrLookupHostname(client.socket.conn.RemoteAddr())
+	client.rawHostname = AddrLookupHostname(client.socket.RemoteAddr())
 
 	for {
+		atomic.StoreInt64(&client.lineReceived, 0)
 		line, err = client.socket.Read()
 		if err != nil {
 			client.Quit("connection closed")
 			break
 		}
+		atomic.StoreInt64(&client.lineReceived, time.Now().UnixNano())
+
+		// protected nicknames whose grace period has ended are enforced before anything else
+		client.runNickEnforcement()
+		if client.isQuitting {
+			break
+		}
 
 		maxlenTags, maxlenRest := client.maxlens()
 
 		client.server.logger.Debug("userinput ", client.nick, "<- ", line)
 
-		msg, err = ircmsg.ParseLineMaxLen(line, maxlenTags, maxlenRest)
-		if err == ircmsg.ErrorLineIsEmpty {
+		// convert legacy charsets to UTF-8 before anything else looks at the line
+		if client.listenerConfig.Encoding != nil && !utf8.ValidString(line) {
+			decoded, err := client.listenerConfig.Encoding.NewDecoder().String(line)
+			if err == nil {
+				line = decoded
+			}
+		}
+
+		linePolicy := client.server.linePolicy
+		line, err = linePolicy.Sanitise(line, maxlenTags, maxlenRest)
+		if err == nil {
+			msg, err = ircmsg.ParseLineMaxLen(line, maxlenTags, maxlenRest)
+			if err == ircmsg.ErrorLineIsEmpty {
+				continue
+			} else if err == nil {
+				err = linePolicy.Check(msg)
+			}
+		}
+		if err != nil {
+			client.server.lineStats.record(err)
+			if err == errLineInvalidUTF8 && linePolicy.UTF8Only {
+				client.Send(nil, client.server.name, "FAIL", "*", "INVALID_UTF8", "Message rejected, this network only allows UTF-8 encoded text")
+				continue
+			}
+			if linePolicy.Strict {
+				client.Quit("received malformed line")
+				break
+			}
+			client.Send(nil, client.server.name, ERR_UNKNOWNERROR, client.nick, "*", fmt.Sprintf("Dropped malformed line: %s", err.Error()))
 			continue
-		} else if err != nil {
-			client.Quit("received malformed line")
-			break
+		}
+
+		// lines in a multiline batch are held until the batch is closed
+		if client.addToMultiline(msg) {
+			// each line counts towards fakelag, like it would if it was sent on its own
+			client.fakelag()
+			continue
+		}
+
+		// everything we send back while handling a labeled command is a reply to it
+		rb := NewResponseBuffer(client)
+		if label, exists := msg.Tags["label"]; exists && client.hasCapability(LabeledResponse) {
+			rb.Label = label.Value
 		}
 
 		cmd, exists := Commands[msg.Command]
 		if !exists {
 			if len(msg.Command) > 0 {
-				client.Send(nil, client.server.name, ERR_UNKNOWNCOMMAND, client.nick, msg.Command, "Unknown command")
+				rb.Send(nil, client.server.name, ERR_UNKNOWNCOMMAND, client.nick, msg.Command, "Unknown command")
 			} else {
-				client.Send(nil, client.server.name, ERR_UNKNOWNCOMMAND, client.nick, "lastcmd", "No command given")
+				rb.Send(nil, client.server.name, ERR_UNKNOWNCOMMAND, client.nick, "lastcmd", "No command given")
 			}
+			rb.Finish()
 			continue
 		}
 
-		isExiting = cmd.Run(client.server, client, msg)
+		client.fakelag()
+		isExiting = cmd.Run(client.server, client, msg, rb)
+		rb.Finish()
+		client.runNickEnforcement()
 		if isExiting || client.isQuitting {
 			break
 		}
 	}
+}
+
+// handlePanic logs a crash report for a panic that happened while handling this
+// client's input, and makes sure only this client gets disconnected because of it.
+func (client *Client) handlePanic(r interface{}, command string, line string) {
+	server := client.server
+	count := atomic.AddUint64(&server.clientPanics, 1)
+
+	// only keep the start of the line, the rest isn't useful and could be huge
+	if len(line) > 100 {
+		line = line[:100] + "..."
+	}
+
+	server.logger.Error("internal", fmt.Sprintf("Panic encountered while handling client [%s] command [%s]: %v", client.nickMaskString, command, r))
+	server.logger.Error("internal", fmt.Sprintf("Partial line: %q", line))
+	server.logger.Error("internal", fmt.Sprintf("Stack trace:\n%s", debug.Stack()))
+	server.snomasks.Send(sno.LocalAccouncements, fmt.Sprintf(ircfmt.Unescape("Internal error while handling client $c[grey][$r%s$c[grey]] command $c[grey][$r%s$c[grey]], disconnecting them (%d crashes so far)"), client.nick, command, count))
 
-	// ensure client connection gets closed
-	client.destroy()
+	client.Quit("Internal server error")
 }
 
 //
@@ -312,6 +440,25 @@ func (client *Client) HasNick() bool {
 	return client.nick != "" && client.nick != "*"
 }
 
+// hasFlag returns true if the client has the given user mode. Use this when the client
+// could be changing their modes at the same time, like when checking another client.
+func (client *Client) hasFlag(mode Mode) bool {
+	client.flagsMutex.RLock()
+	defer client.flagsMutex.RUnlock()
+	return client.flags[mode]
+}
+
+// setFlag adds or removes the given user mode.
+func (client *Client) setFlag(mode Mode, on bool) {
+	client.flagsMutex.Lock()
+	defer client.flagsMutex.Unlock()
+	if on {
+		client.flags[mode] = true
+	} else {
+		delete(client.flags, mode)
+	}
+}
+
 // HasUsername returns true if the client's username is set (used in registration).
 func (client *Client) HasUsername() bool {
 	return client.username != "" && client.username != "*"
@@ -336,6 +483,8 @@ func (client *Client) HasCapabs(capabs ...string) bool {
 func (client *Client) ModeString() (str string) {
 	str = "+"
 
+	client.flagsMutex.RLock()
+	defer client.flagsMutex.RUnlock()
 	for flag := range client.flags {
 		str += flag.String()
 	}
@@ -350,7 +499,7 @@ func (client *Client) Friends(Capabilities ...Capability) ClientSet {
 	// make sure that I have the right caps
 	hasCaps := true
 	for _, Cap := range Capabilities {
-		if !client.capabilities[Cap] {
+		if !client.hasCapability(Cap) {
 			hasCaps = false
 			break
 		}
@@ -361,11 +510,12 @@ func (client *Client) Friends(Capabilities ...Capability) ClientSet {
 
 	for channel := range client.channels {
 		channel.membersMutex.RLock()
+	members:
 		for member := range channel.members {
 			// make sure they have all the required caps
 			for _, Cap := range Capabilities {
-				if !member.capabilities[Cap] {
-					continue
+				if !member.hasCapability(Cap) {
+					continue members
 				}
 			}
 			friends.Add(member)
@@ -382,27 +532,62 @@ func (client *Client) updateNick() {
 		log.Println(fmt.Sprintf("ERROR: Nick [%s] couldn't be casefolded... this should never happen. Printing stacktrace.", client.nick))
 		debug.PrintStack()
 	}
+	client.stateMutex.Lock()
 	client.nickCasefolded = casefoldedName
+	client.stateMutex.Unlock()
 }
 
 // updateNickMask updates the casefolded nickname and nickmask.
 func (client *Client) updateNickMask() {
 	client.updateNick()
 
+	hostname := client.rawHostname
 	if len(client.vhost) > 0 {
-		client.hostname = client.vhost
-	} else {
-		client.hostname = client.rawHostname
+		hostname = client.vhost
 	}
+	nickMaskString := fmt.Sprintf("%s!%s@%s", client.nick, client.username, hostname)
 
-	client.nickMaskString = fmt.Sprintf("%s!%s@%s", client.nick, client.username, client.hostname)
-
-	nickMaskCasefolded, err := Casefold(client.nickMaskString)
+	nickMaskCasefolded, err := Casefold(nickMaskString)
 	if err != nil {
-		log.Println(fmt.Sprintf("ERROR: Nickmask [%s] couldn't be casefolded... this should never happen. Printing stacktrace.", client.nickMaskString))
+		log.Println(fmt.Sprintf("ERROR: Nickmask [%s] couldn't be casefolded... this should never happen. Printing stacktrace.", nickMaskString))
 		debug.PrintStack()
 	}
+
+	client.stateMutex.Lock()
+	client.hostname = hostname
+	client.nickMaskString = nickMaskString
 	client.nickMaskCasefolded = nickMaskCasefolded
+	client.stateMutex.Unlock()
+}
+
+// clientDetails is a snapshot of the parts of a client that other goroutines look at.
+type clientDetails struct {
+	nick               string
+	nickMaskCasefolded string
+	username           string
+	hostname           string
+	accountName        string
+	operName           string
+	channelCount       int
+}
+
+// details returns the client's nick, account and so on, for goroutines other than the
+// client's own.
+func (client *Client) details() (details clientDetails) {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	details = clientDetails{
+		nick:               client.nick,
+		nickMaskCasefolded: client.nickMaskCasefolded,
+		username:           client.username,
+		hostname:           client.hostname,
+		operName:           client.operName,
+		channelCount:       len(client.channels),
+	}
+	if client.account != &NoAccount {
+		details.accountName = client.account.Name
+	}
+	return
 }
 
 // AllNickmasks returns all the possible nickmasks for the client.
@@ -423,7 +608,7 @@ func (client *Client) AllNickmasks() []string {
 		masks = append(masks, mask)
 	}
 
-	mask2, err := Casefold(fmt.Sprintf("%s!%s@%s", client.nick, client.username, IPString(client.socket.conn.RemoteAddr())))
+	mask2, err := Casefold(fmt.Sprintf("%s!%s@%s", client.nick, client.username, IPString(client.socket.RemoteAddr())))
 	if err == nil && mask2 != mask {
 		masks = append(masks, mask2)
 	}
@@ -440,24 +625,32 @@ func (client *Client) SetNickname(nickname string) error {
 
 	err := client.server.clients.Add(client, nickname)
 	if err == nil {
+		client.stateMutex.Lock()
 		client.nick = nickname
+		client.stateMutex.Unlock()
 		client.updateNick()
 	}
 	return err
 }
 
 // ChangeNickname changes the existing nickname of the client.
-func (client *Client) ChangeNickname(nickname string) error {
+func (client *Client) ChangeNickname(nickname string, rb *ResponseBuffer) error {
 	origNickMask := client.nickMaskString
 	err := client.server.clients.Replace(client.nick, nickname, client)
 	if err == nil {
 		client.server.logger.Debug("nick", fmt.Sprintf("%s changed nickname to %s", client.nick, nickname))
 		client.server.snomasks.Send(sno.LocalNicks, fmt.Sprintf(ircfmt.Unescape("$%s$r changed nickname to %s"), client.nick, nickname))
 		client.server.whoWas.Append(client)
+		client.stateMutex.Lock()
 		client.nick = nickname
+		client.stateMutex.Unlock()
 		client.updateNickMask()
 		for friend := range client.Friends() {
-			friend.Send(nil, origNickMask, "NICK", nickname)
+			if friend == client {
+				rb.Send(client.fromClientTags("", client, nil), origNickMask, "NICK", nickname)
+			} else {
+				friend.sendFromClientAs("", client, origNickMask, nil, "NICK", nickname)
+			}
 		}
 	}
 	return err
@@ -468,6 +661,9 @@ func (client *Client) Quit(message string) {
 	client.quitMutex.Lock()
 	defer client.quitMutex.Unlock()
 	if !client.quitMessageSent {
+		message = client.cleanQuitMessage(message)
+		client.quitMessage = message
+
 		quitMsg := ircmsg.MakeMessage(nil, client.nickMaskString, "QUIT", message)
 		quitLine, _ := quitMsg.Line()
 
@@ -499,19 +695,33 @@ func (client *Client) destroy() {
 
 	// remove from connection limits
 	ipaddr := client.IP()
-	// this check shouldn't be required but eh
 	if ipaddr != nil {
 		client.server.connectionLimitsMutex.Lock()
+		if client.overLimits.connectionLimit {
+			client.server.connectionLimits.RemovePendingClient(ipaddr)
+		}
 		client.server.connectionLimits.RemoveClient(ipaddr)
 		client.server.connectionLimitsMutex.Unlock()
+		client.server.connectionThrottleMutex.Lock()
+		if client.overLimits.throttle {
+			client.server.connectionThrottle.RemovePendingClient(ipaddr)
+		}
+		client.server.connectionThrottleMutex.Unlock()
 	}
+	client.server.cloneDetectorMutex.Lock()
+	client.server.cloneDetector.RemoveClient(client)
+	client.server.cloneDetectorMutex.Unlock()
 
-	// remove from opers list
-	_, exists := client.server.currentOpers[client]
-	if exists {
-		delete(client.server.currentOpers, client)
+	// the account was used up until now
+	if client.account != &NoAccount {
+		client.server.setAccountLastSeen(client.account.Name)
 	}
 
+	// remove from opers list
+	client.server.currentOpersMutex.Lock()
+	delete(client.server.currentOpers, client)
+	client.server.currentOpersMutex.Unlock()
+
 	// alert monitors
 	for _, mClient := range client.server.monitoring[client.nickCasefolded] {
 		mClient.Send(nil, client.server.name, RPL_MONOFFLINE, mClient.nick, client.nick)
@@ -537,52 +747,62 @@ func (client *Client) destroy() {
 	if client.quitTimer != nil {
 		client.quitTimer.Stop()
 	}
+	client.timerMutex.Lock()
+	if client.plaintextTimer != nil {
+		client.plaintextTimer.Stop()
+	}
+	if client.nickTimer != nil {
+		client.nickTimer.Stop()
+	}
+	client.timerMutex.Unlock()
 
 	client.socket.Close()
+	atomic.AddUint64(&client.server.closedBytesIn, client.socket.BytesIn())
+	atomic.AddUint64(&client.server.closedBytesOut, client.socket.BytesOut())
 
 	// send quit messages to friends
+	quitMessage := client.quitMessage
+	if quitMessage == "" {
+		quitMessage = "Exited"
+	}
 	for friend := range friends {
-		//TODO(dan): store quit message in user, if exists use that instead here
-		friend.Send(nil, client.nickMaskString, "QUIT", "Exited")
+		friend.SendFromClient("", client, nil, "QUIT", quitMessage)
 	}
 	if !client.exitedSnomaskSent {
 		client.server.snomasks.Send(sno.LocalQuits, fmt.Sprintf(ircfmt.Unescape("%s$r exited the network"), client.nick))
 	}
 }
 
-// SendSplitMsgFromClient sends an IRC PRIVMSG/NOTICE coming from a specific client.
-// Adds account-tag to the line as well.
-func (client *Client) SendSplitMsgFromClient(msgid string, from *Client, tags *map[string]ircmsg.TagValue, command, target string, message SplitMessage) {
-	if client.capabilities[MaxLine] {
-		client.SendFromClient(msgid, from, tags, command, target, message.ForMaxLine)
-	} else {
-		for _, str := range message.For512 {
-			client.SendFromClient(msgid, from, tags, command, target, str)
-		}
-	}
-}
-
 // SendFromClient sends an IRC line coming from a specific client.
 // Adds account-tag to the line as well.
 func (client *Client) SendFromClient(msgid string, from *Client, tags *map[string]ircmsg.TagValue, command string, params ...string) error {
-	// attach account-tag
-	if client.capabilities[AccountTag] && from.account != &NoAccount {
-		if tags == nil {
-			tags = ircmsg.MakeTags("account", from.account.Name)
-		} else {
-			(*tags)["account"] = ircmsg.MakeTagValue(from.account.Name)
+	return client.sendFromClientAs(msgid, from, from.nickMaskString, tags, command, params...)
+}
+
+// sendFromClientAs is SendFromClient with the given prefix, for lines like NICK where the
+// client's nickmask has already changed.
+func (client *Client) sendFromClientAs(msgid string, from *Client, prefix string, tags *map[string]ircmsg.TagValue, command string, params ...string) error {
+	return client.Send(client.fromClientTags(msgid, from, tags), prefix, command, params...)
+}
+
+// fromClientTags returns the tags for a line sent to this client from the given client.
+func (client *Client) fromClientTags(msgid string, from *Client, tags *map[string]ircmsg.TagValue) *map[string]ircmsg.TagValue {
+	// the same tags are often sent to a lot of clients, so don't change them for everyone
+	addTag := func(name, value string) {
+		newTags := ircmsg.MakeTags(name, value)
+		if tags != nil {
+			for tagName, tagValue := range *tags {
+				(*newTags)[tagName] = tagValue
+			}
 		}
+		tags = newTags
 	}
-	// attach message-id
-	if len(msgid) > 0 && client.capabilities[MessageIDs] {
-		if tags == nil {
-			tags = ircmsg.MakeTags("draft/msgid", msgid)
-		} else {
-			(*tags)["draft/msgid"] = ircmsg.MakeTagValue(msgid)
-		}
+	// attach account-tag
+	if client.hasCapability(AccountTag) && from.account != &NoAccount {
+		addTag("account", from.account.Name)
 	}
-
-	return client.Send(tags, from.nickMaskString, command, params...)
+	// attach message-id and the time it was received
+	return client.withMessageID(tags, msgid)
 }
 
 var (
@@ -598,15 +818,29 @@ var (
 	}
 )
 
+// replyTime returns the server-time for a line we're sending the client. Numerics are replies
+// to the line the client's sent, so they get the time it was received. Everything else gets
+// the current time.
+func (client *Client) replyTime(command string) time.Time {
+	if len(command) == 3 && '0' <= command[0] && command[0] <= '9' {
+		if received := atomic.LoadInt64(&client.lineReceived); received != 0 {
+			return time.Unix(0, received).UTC()
+		}
+	}
+	return time.Now().UTC()
+}
+
 // Send sends an IRC line to the client.
 func (client *Client) Send(tags *map[string]ircmsg.TagValue, prefix string, command string, params ...string) error {
-	// attach server-time
-	if client.capabilities[ServerTime] {
-		t := time.Now().UTC().Format("2006-01-02T15:04:05.999Z")
-		if tags == nil {
-			tags = ircmsg.MakeTags("time", t)
-		} else {
-			(*tags)["time"] = ircmsg.MakeTagValue(t)
+	// attach server-time, unless we're sending an older message (i.e. history) that already has one
+	if client.hasCapability(ServerTime) {
+		var exists bool
+		if tags != nil {
+			_, exists = (*tags)["time"]
+		}
+		if !exists {
+			// the same tags are often sent to a lot of clients, so don't change them for everyone
+			tags = tagsWith(tags, "time", client.replyTime(command).Format(IRCv3TimestampFormat))
 		}
 	}
 
@@ -645,18 +879,22 @@ func (client *Client) Send(tags *map[string]ircmsg.TagValue, prefix string, comm
 	client.server.logger.Debug("useroutput", client.nick, " ->", strings.TrimRight(line, "\r\n"))
 
 	client.socket.Write(line)
+	if client.socket.SendQWarning() {
+		client.warnSendQ()
+	}
 	return nil
 }
 
 // Notice sends the client a notice from the server.
 func (client *Client) Notice(text string) {
+	NewResponseBuffer(client).Notice(text)
+}
+
+// noticeLines wraps the given text into lines short enough to be sent to the client as notices.
+func (client *Client) noticeLines(text string) []string {
 	limit := 400
-	if client.capabilities[MaxLine] {
+	if client.hasCapability(MaxLine) {
 		limit = client.server.limits.LineLen.Rest - 110
 	}
-	lines := wordWrap(text, limit)
-
-	for _, line := range lines {
-		client.Send(nil, client.server.name, "NOTICE", client.nick, line)
-	}
+	return wordWrap(text, limit)
 }
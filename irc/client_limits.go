@@ -0,0 +1,110 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+)
+
+const (
+	// MaxClientsReject rejects all new clients once the server is full.
+	MaxClientsReject = "reject"
+	// MaxClientsSASLOnly only lets clients that have authenticated with SASL register once the server is full.
+	MaxClientsSASLOnly = "sasl-only"
+	// MaxClientsExemptOnly only lets clients from exempted IPs/networks connect once the server is full.
+	MaxClientsExemptOnly = "exempt-only"
+)
+
+// MaxClients manages the soft limit on how many clients can be connected to the server.
+type MaxClients struct {
+	enabled bool
+	// limit is the number of clients at which we consider the server full
+	limit int
+	// behavior is what we do with new clients once the server is full
+	behavior string
+
+	// exemptedIPs holds IPs and networks that can still connect once the server is full,
+	// unless the behavior is to reject everyone
+	exemptedIPs ipExemptions
+}
+
+// isExempt returns true if the given address is exempt from the client limit.
+func (mc *MaxClients) isExempt(addr net.IP) bool {
+	if addr == nil {
+		return false
+	}
+	return mc.exemptedIPs.contains(addr)
+}
+
+// CanConnect returns true if a new connection from the given address should be accepted,
+// given the current number of clients.
+func (mc *MaxClients) CanConnect(addr net.IP, current int) bool {
+	if !mc.enabled || current < mc.limit {
+		return true
+	}
+
+	switch mc.behavior {
+	case MaxClientsSASLOnly:
+		// SASL happens after the connection is accepted, so we check these clients at registration
+		return true
+	case MaxClientsExemptOnly:
+		return mc.isExempt(addr)
+	default:
+		return false
+	}
+}
+
+// CanRegister returns true if the given client can complete registration, given the current
+// number of clients (which includes the client itself).
+func (mc *MaxClients) CanRegister(addr net.IP, current int, authenticated bool) bool {
+	if !mc.enabled || current <= mc.limit {
+		return true
+	}
+
+	switch mc.behavior {
+	case MaxClientsSASLOnly:
+		return authenticated || mc.isExempt(addr)
+	case MaxClientsExemptOnly:
+		return mc.isExempt(addr)
+	default:
+		return false
+	}
+}
+
+// Limit returns the maximum number of clients, or 0 if there is no limit.
+func (mc *MaxClients) Limit() int {
+	if !mc.enabled {
+		return 0
+	}
+	return mc.limit
+}
+
+// Remaining returns how many more clients can connect before the server is full,
+// or -1 if there is no limit.
+func (mc *MaxClients) Remaining(current int) int {
+	if !mc.enabled {
+		return -1
+	}
+	if current >= mc.limit {
+		return 0
+	}
+	return mc.limit - current
+}
+
+// NewMaxClients returns a new client limit handler.
+func NewMaxClients(config MaxClientsConfig) (*MaxClients, error) {
+	var mc MaxClients
+	mc.enabled = config.Enabled
+	mc.limit = config.Limit
+	mc.behavior = config.Behavior
+
+	// assemble exempted nets
+	var err error
+	mc.exemptedIPs, err = parseExemptions(config.Exempted, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mc, nil
+}
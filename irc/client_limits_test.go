@@ -0,0 +1,47 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMaxClientsBehaviors(t *testing.T) {
+	exempt := net.ParseIP("10.0.0.5")
+	other := net.ParseIP("203.0.113.5")
+
+	cases := []struct {
+		behavior string
+		addr     net.IP
+		sasl     bool
+		connect  bool
+		register bool
+	}{
+		{MaxClientsReject, other, false, false, false},
+		{MaxClientsReject, exempt, false, false, false},
+		{MaxClientsReject, other, true, false, false},
+		{MaxClientsExemptOnly, other, false, false, false},
+		{MaxClientsExemptOnly, exempt, false, true, true},
+		{MaxClientsExemptOnly, other, true, false, false},
+		{MaxClientsSASLOnly, other, false, true, false},
+		{MaxClientsSASLOnly, other, true, true, true},
+		{MaxClientsSASLOnly, exempt, false, true, true},
+	}
+	for _, c := range cases {
+		mc, err := NewMaxClients(MaxClientsConfig{Enabled: true, Limit: 10, Behavior: c.behavior, Exempted: []string{"10.0.0.0/8"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !mc.CanConnect(c.addr, 9) || !mc.CanRegister(c.addr, 10, false) {
+			t.Errorf("%s: expected clients to be let in while the server isn't full", c.behavior)
+		}
+		if connect := mc.CanConnect(c.addr, 10); connect != c.connect {
+			t.Errorf("%s from %s: expected CanConnect to be %v, got %v", c.behavior, c.addr, c.connect, connect)
+		}
+		if register := mc.CanRegister(c.addr, 11, c.sasl); register != c.register {
+			t.Errorf("%s from %s with SASL %v: expected CanRegister to be %v, got %v", c.behavior, c.addr, c.sasl, c.register, register)
+		}
+	}
+}
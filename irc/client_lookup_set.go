@@ -161,11 +161,12 @@ func (clients *ClientLookupSet) AllWithCaps(caps ...Capability) (set ClientSet)
 	clients.ByNickMutex.RLock()
 	defer clients.ByNickMutex.RUnlock()
 	var client *Client
+nextClient:
 	for _, client = range clients.ByNick {
 		// make sure they have all the required caps
 		for _, Cap := range caps {
-			if !client.capabilities[Cap] {
-				continue
+			if !client.hasCapability(Cap) {
+				continue nextClient
 			}
 		}
 
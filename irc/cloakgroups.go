@@ -0,0 +1,338 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/oragono/oragono/irc/sno"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	keyCloakGroup = "cloakgroup %s"
+)
+
+var (
+	errCloakGroupExists   = errors.New("Cloak group already exists")
+	errNoSuchCloakGroup   = errors.New("Cloak group does not exist")
+	errInvalidCloakPrefix = errors.New("Cloak group namespace is invalid")
+)
+
+// CloakGroup is a vhost namespace (such as project/foo/*) whose cloaks can be handed out
+// by its managers, without needing an oper.
+type CloakGroup struct {
+	// Namespace is the vhost prefix, without the trailing "/*".
+	Namespace string
+	// Managers holds the casefolded names of the accounts that can assign cloaks in this group.
+	Managers []string
+	// CreatedBy is the oper who created the group.
+	CreatedBy string
+	// CreatedAt is when the group was created.
+	CreatedAt time.Time
+}
+
+// IsManager returns true if the given (casefolded) account can assign cloaks in this group.
+func (group *CloakGroup) IsManager(accountKey string) bool {
+	for _, manager := range group.Managers {
+		if manager == accountKey {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains returns true if the given vhost is inside this group's namespace.
+func (group *CloakGroup) Contains(vhost string) bool {
+	vhost = strings.ToLower(vhost)
+	return strings.HasPrefix(vhost, group.Namespace+"/") && len(group.Namespace)+1 < len(vhost)
+}
+
+// normalizeCloakNamespace turns a namespace like "Project/Foo/*" into "project/foo".
+func normalizeCloakNamespace(namespace string) (string, error) {
+	namespace = strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(namespace), "*"), "/")
+	if !isValidVhost(namespace) || strings.Contains(namespace, "*") {
+		return "", errInvalidCloakPrefix
+	}
+	return namespace, nil
+}
+
+// loadCloakGroups loads every cloak group from the store.
+func (server *Server) loadCloakGroups() []*CloakGroup {
+	var groups []*CloakGroup
+	server.store.View(func(tx *buntdb.Tx) error {
+		tx.AscendKeys("cloakgroup *", func(key, value string) bool {
+			var group CloakGroup
+			if json.Unmarshal([]byte(value), &group) == nil {
+				groups = append(groups, &group)
+			}
+			return true
+		})
+		return nil
+	})
+	return groups
+}
+
+// loadCloakGroup loads the given cloak group from the store.
+func loadCloakGroup(tx *buntdb.Tx, namespace string) (*CloakGroup, error) {
+	groupString, err := tx.Get(fmt.Sprintf(keyCloakGroup, namespace))
+	if err == buntdb.ErrNotFound {
+		return nil, errNoSuchCloakGroup
+	} else if err != nil {
+		return nil, err
+	}
+	var group CloakGroup
+	err = json.Unmarshal([]byte(groupString), &group)
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// saveCloakGroup saves the given cloak group to the store.
+func saveCloakGroup(tx *buntdb.Tx, group *CloakGroup) error {
+	groupBytes, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	_, _, err = tx.Set(fmt.Sprintf(keyCloakGroup, group.Namespace), string(groupBytes), nil)
+	return err
+}
+
+// cloakGroupFor returns the group whose namespace contains the given vhost, if any.
+func (server *Server) cloakGroupFor(vhost string) *CloakGroup {
+	var found *CloakGroup
+	for _, group := range server.loadCloakGroups() {
+		// prefer the most specific namespace
+		if group.Contains(vhost) && (found == nil || len(found.Namespace) < len(group.Namespace)) {
+			found = group
+		}
+	}
+	return found
+}
+
+// loadAccountByName returns the given account, loading it from the store if necessary. The
+// accounts map is only touched through getAccount and loadAccount, which hold accountsMutex,
+// so this is safe to call from any client's goroutine.
+func (server *Server) loadAccountByName(name string) *ClientAccount {
+	accountKey, err := CasefoldName(name)
+	if err != nil {
+		return nil
+	}
+	if account, exists := server.getAccount(accountKey); exists {
+		return account
+	}
+
+	var account *ClientAccount
+	server.store.View(func(tx *buntdb.Tx) error {
+		_, err := tx.Get(fmt.Sprintf(keyAccountExists, accountKey))
+		if err == nil {
+			account = loadAccount(server, tx, accountKey)
+		}
+		return nil
+	})
+	return account
+}
+
+// hostservGroup handles the HostServ GROUP subcommands, which are oper-only apart from LIST.
+func (server *Server) hostservGroup(client *Client, params []string, rb *ResponseBuffer) {
+	if len(params) < 1 {
+		rb.HostServNotice("Syntax: GROUP <CREATE|DROP|ADDMANAGER|DELMANAGER|LIST> [namespace] [account]")
+		return
+	}
+	subcommand := strings.ToLower(params[0])
+
+	if subcommand == "list" {
+		accountKey, _ := CasefoldName(client.account.Name)
+		isOper := client.HasCapabs("vhosts")
+		var count int
+		for _, group := range server.loadCloakGroups() {
+			if isOper || group.IsManager(accountKey) {
+				rb.HostServNotice(fmt.Sprintf("%s/* - managed by: %s", group.Namespace, strings.Join(group.Managers, ", ")))
+				count++
+			}
+		}
+		if count == 0 {
+			rb.HostServNotice("There are no cloak groups to show")
+		}
+		return
+	}
+
+	if !client.HasCapabs("vhosts") {
+		rb.HostServNotice("Insufficient privileges")
+		return
+	}
+	if len(params) < 2 {
+		rb.HostServNotice("You need to give a namespace")
+		return
+	}
+	if !server.checkWritable(client, "HOSTSERV", rb) {
+		return
+	}
+	namespace, err := normalizeCloakNamespace(params[1])
+	if err != nil {
+		rb.HostServNotice("That namespace is invalid")
+		return
+	}
+
+	if subcommand == "create" {
+		err = server.store.Update(func(tx *buntdb.Tx) error {
+			_, err := loadCloakGroup(tx, namespace)
+			if err == nil {
+				return errCloakGroupExists
+			} else if err != errNoSuchCloakGroup {
+				return err
+			}
+			return saveCloakGroup(tx, &CloakGroup{
+				Namespace: namespace,
+				CreatedBy: client.nick,
+				CreatedAt: time.Now(),
+			})
+		})
+		if err == errCloakGroupExists {
+			rb.HostServNotice("That cloak group already exists")
+			return
+		} else if err != nil {
+			rb.HostServNotice("Could not create cloak group")
+			return
+		}
+		rb.HostServNotice(fmt.Sprintf("Created cloak group %s/*", namespace))
+		server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("%s$r created cloak group $c[grey][$r%s/*$c[grey]]"), client.nick, namespace))
+	} else if subcommand == "drop" {
+		err = server.store.Update(func(tx *buntdb.Tx) error {
+			_, err := tx.Delete(fmt.Sprintf(keyCloakGroup, namespace))
+			if err == buntdb.ErrNotFound {
+				return errNoSuchCloakGroup
+			}
+			return err
+		})
+		if err == errNoSuchCloakGroup {
+			rb.HostServNotice("That cloak group does not exist")
+			return
+		} else if err != nil {
+			rb.HostServNotice("Could not drop cloak group")
+			return
+		}
+		// existing cloaks stay as they are, they just can't be managed anymore
+		rb.HostServNotice(fmt.Sprintf("Dropped cloak group %s/*", namespace))
+		server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("%s$r dropped cloak group $c[grey][$r%s/*$c[grey]]"), client.nick, namespace))
+	} else if subcommand == "addmanager" || subcommand == "delmanager" {
+		if len(params) < 3 {
+			rb.HostServNotice("You need to give an account name")
+			return
+		}
+		account := server.loadAccountByName(params[2])
+		if account == nil {
+			rb.HostServNotice("That account does not exist")
+			return
+		}
+		accountKey, _ := CasefoldName(account.Name)
+
+		err = server.store.Update(func(tx *buntdb.Tx) error {
+			group, err := loadCloakGroup(tx, namespace)
+			if err != nil {
+				return err
+			}
+			if subcommand == "addmanager" {
+				if !group.IsManager(accountKey) {
+					group.Managers = append(group.Managers, accountKey)
+				}
+			} else {
+				group.Managers, _ = removeIgnoreEntry(group.Managers, accountKey)
+			}
+			return saveCloakGroup(tx, group)
+		})
+		if err == errNoSuchCloakGroup {
+			rb.HostServNotice("That cloak group does not exist")
+			return
+		} else if err != nil {
+			rb.HostServNotice("Could not update cloak group")
+			return
+		}
+		if subcommand == "addmanager" {
+			rb.HostServNotice(fmt.Sprintf("%s can now assign cloaks in %s/*", account.Name, namespace))
+		} else {
+			rb.HostServNotice(fmt.Sprintf("%s can no longer assign cloaks in %s/*", account.Name, namespace))
+		}
+	} else {
+		rb.HostServNotice("Sorry, I don't know that GROUP subcommand")
+	}
+}
+
+// canManageCloak returns true if the client can assign or remove the given cloak.
+func (client *Client) canManageCloak(vhost string) bool {
+	group := client.server.cloakGroupFor(vhost)
+	if group == nil {
+		return false
+	}
+	if client.HasCapabs("vhosts") {
+		return true
+	}
+	accountKey, _ := CasefoldName(client.account.Name)
+	return group.IsManager(accountKey)
+}
+
+// hostservAssign handles the HostServ ASSIGN and UNASSIGN subcommands, which let cloak
+// group managers set the cloaks of accounts in their namespaces.
+func (server *Server) hostservAssign(client *Client, assign bool, params []string, rb *ResponseBuffer) {
+	if (assign && len(params) < 2) || len(params) < 1 {
+		if assign {
+			rb.HostServNotice("Syntax: ASSIGN <account> <vhost>")
+		} else {
+			rb.HostServNotice("Syntax: UNASSIGN <account>")
+		}
+		return
+	}
+
+	account := server.loadAccountByName(params[0])
+	if account == nil {
+		rb.HostServNotice("That account does not exist")
+		return
+	}
+	if !server.checkWritable(client, "HOSTSERV", rb) {
+		return
+	}
+
+	var vhost string
+	if assign {
+		vhost = strings.ToLower(params[1])
+		if !isValidVhost(vhost) {
+			rb.HostServNotice("That vhost is invalid")
+			return
+		}
+		if !client.canManageCloak(vhost) {
+			rb.HostServNotice("That vhost isn't in a cloak group you manage")
+			return
+		}
+	} else {
+		if account.Vhost == "" {
+			rb.HostServNotice("That account doesn't have a vhost")
+			return
+		}
+		if !client.canManageCloak(account.Vhost) {
+			rb.HostServNotice("That account's vhost isn't in a cloak group you manage")
+			return
+		}
+	}
+
+	err := server.setAccountVhost(account, vhost)
+	if err != nil {
+		rb.HostServNotice("Could not save the vhost")
+		server.logger.Error("hostserv", fmt.Sprintf("Could not save vhost for account %s: %s", account.Name, err.Error()))
+		return
+	}
+
+	if assign {
+		rb.HostServNotice(fmt.Sprintf("%s now has the vhost %s", account.Name, vhost))
+		server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("%s$r assigned vhost $c[grey][$r%s$c[grey]] to account $c[grey][$r%s$c[grey]]"), client.nick, vhost, account.Name))
+	} else {
+		rb.HostServNotice(fmt.Sprintf("Removed the vhost from %s", account.Name))
+		server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("%s$r removed the vhost from account $c[grey][$r%s$c[grey]]"), client.nick, account.Name))
+	}
+}
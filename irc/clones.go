@@ -0,0 +1,138 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/oragono/oragono/irc/sno"
+)
+
+// CloneDetectionConfig controls the warnings opers get about lots of clients connecting from
+// the same subnet. Unlike the connection limits, clones aren't refused.
+type CloneDetectionConfig struct {
+	Enabled     bool
+	CidrLenIPv4 int `yaml:"cidr-len-ipv4"`
+	CidrLenIPv6 int `yaml:"cidr-len-ipv6"`
+	// Threshold is how many clients can connect from a subnet before they're clones.
+	Threshold int
+	Exempted  []string
+}
+
+// CloneDetector keeps track of how many registered clients are connected from each subnet.
+type CloneDetector struct {
+	enabled   bool
+	ipv4Mask  net.IPMask
+	ipv6Mask  net.IPMask
+	threshold int
+	// subnets holds subnet -> the clients connected from there
+	subnets map[string]map[*Client]bool
+	// clientSubnets holds client -> the subnet they were counted in
+	clientSubnets map[*Client]string
+
+	exemptedIPs ipExemptions
+}
+
+// NewCloneDetector returns a new clone detector.
+func NewCloneDetector(config CloneDetectionConfig) (*CloneDetector, error) {
+	cd := CloneDetector{
+		enabled:       config.Enabled,
+		ipv4Mask:      net.CIDRMask(config.CidrLenIPv4, 32),
+		ipv6Mask:      net.CIDRMask(config.CidrLenIPv6, 128),
+		threshold:     config.Threshold,
+		subnets:       make(map[string]map[*Client]bool),
+		clientSubnets: make(map[*Client]string),
+	}
+	if cd.enabled && cd.threshold < 1 {
+		return nil, fmt.Errorf("Clone detection threshold must be at least 1")
+	}
+
+	var err error
+	cd.exemptedIPs, err = parseExemptions(config.Exempted, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cd, nil
+}
+
+// subnet returns the subnet the given address is counted in, or an empty string if it's exempt.
+func (cd *CloneDetector) subnet(addr net.IP) string {
+	if cd.exemptedIPs.contains(addr) {
+		return ""
+	}
+
+	var network net.IPNet
+	if addr.To4() == nil {
+		network = net.IPNet{IP: addr.Mask(cd.ipv6Mask), Mask: cd.ipv6Mask}
+	} else {
+		network = net.IPNet{IP: addr.To4().Mask(cd.ipv4Mask), Mask: cd.ipv4Mask}
+	}
+	return network.String()
+}
+
+// AddClient counts the given client, returning their subnet and how many clients are now
+// connected from it. warn is true if opers should hear about it: when the subnet first goes
+// over the threshold, and each time it goes over by another threshold's worth.
+func (cd *CloneDetector) AddClient(client *Client) (subnet string, count int, warn bool) {
+	ipaddr := client.IP()
+	if !cd.enabled || ipaddr == nil {
+		return "", 0, false
+	}
+	subnet = cd.subnet(ipaddr)
+	if subnet == "" {
+		return "", 0, false
+	}
+
+	if cd.subnets[subnet] == nil {
+		cd.subnets[subnet] = make(map[*Client]bool)
+	}
+	cd.subnets[subnet][client] = true
+	cd.clientSubnets[client] = subnet
+
+	count = len(cd.subnets[subnet])
+	warn = cd.threshold < count && (count-cd.threshold-1)%cd.threshold == 0
+	return subnet, count, warn
+}
+
+// RemoveClient stops counting the given client.
+func (cd *CloneDetector) RemoveClient(client *Client) {
+	subnet, exists := cd.clientSubnets[client]
+	if !exists {
+		return
+	}
+	delete(cd.clientSubnets, client)
+	delete(cd.subnets[subnet], client)
+	if len(cd.subnets[subnet]) == 0 {
+		delete(cd.subnets, subnet)
+	}
+}
+
+// Clones returns the client's subnet and how many clients are connected from it, if that's
+// over the threshold.
+func (cd *CloneDetector) Clones(client *Client) (subnet string, count int) {
+	subnet, exists := cd.clientSubnets[client]
+	if !exists {
+		return "", 0
+	}
+	count = len(cd.subnets[subnet])
+	if count <= cd.threshold {
+		return "", 0
+	}
+	return subnet, count
+}
+
+// checkClones counts the newly-registered client, and warns opers if they're a clone.
+func (server *Server) checkClones(client *Client) {
+	server.cloneDetectorMutex.Lock()
+	subnet, count, warn := server.cloneDetector.AddClient(client)
+	server.cloneDetectorMutex.Unlock()
+
+	if warn {
+		server.logger.Info("clones", fmt.Sprintf("%d clients connected from %s, the latest is %s", count, subnet, client.nickMaskString))
+		server.snomasks.Send(sno.LocalClones, fmt.Sprintf(ircfmt.Unescape("$c[grey][$r%d$c[grey]] clients connected from $c[grey][$r%s$c[grey]], the latest is $c[grey][$r%s$c[grey]]"), count, subnet, client.nickMaskString))
+	}
+}
@@ -9,7 +9,7 @@ import "github.com/goshuirc/irc-go/ircmsg"
 
 // Command represents a command accepted from a client.
 type Command struct {
-	handler           func(server *Server, client *Client, msg ircmsg.IrcMessage) bool
+	handler           func(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool
 	oper              bool
 	usablePreReg      bool
 	leaveClientActive bool // if true, leaves the client active time alone. reversed because we can't default a struct element to True
@@ -19,21 +19,29 @@ type Command struct {
 }
 
 // Run runs this command with the given client/message.
-func (cmd *Command) Run(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func (cmd *Command) Run(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	if client.isGuest() && !guestAllowed(client, msg) {
+		rb.Send(nil, server.name, "FAIL", msg.Command, "GUEST_VIEW_ONLY", "Guest connections can only watch, connect normally to take part")
+		return false
+	}
 	if !client.registered && !cmd.usablePreReg {
-		client.Send(nil, server.name, ERR_NOTREGISTERED, client.nick, "You need to register before you can use that command")
+		rb.Send(nil, server.name, ERR_NOTREGISTERED, client.nick, "You need to register before you can use that command")
 		return false
 	}
-	if cmd.oper && !client.flags[Operator] {
-		client.Send(nil, server.name, ERR_NOPRIVILEGES, client.nick, "Permission Denied - You're not an IRC operator")
+	if server.passwordResetBlocks(client, msg) {
+		rb.Send(nil, server.name, "FAIL", msg.Command, "PASSWORD_RESET_REQUIRED", "You must set a new password with /NS SET PASSWORD <new password> before you can do that")
+		return false
+	}
+	if cmd.oper && !client.hasFlag(Operator) {
+		rb.Send(nil, server.name, ERR_NOPRIVILEGES, client.nick, "Permission Denied - You're not an IRC operator")
 		return false
 	}
 	if len(cmd.capabs) > 0 && !client.HasCapabs(cmd.capabs...) {
-		client.Send(nil, server.name, ERR_NOPRIVILEGES, client.nick, "Permission Denied")
+		rb.Send(nil, server.name, ERR_NOPRIVILEGES, client.nick, "Permission Denied")
 		return false
 	}
 	if len(msg.Params) < cmd.minParams {
-		client.Send(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, msg.Command, "Not enough parameters")
+		rb.Send(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, msg.Command, "Not enough parameters")
 		return false
 	}
 	if !cmd.leaveClientActive {
@@ -43,10 +51,12 @@ func (cmd *Command) Run(server *Server, client *Client, msg ircmsg.IrcMessage) b
 	if client.registered && !cmd.leaveClientIdle {
 		client.Touch()
 	}
-	exiting := cmd.handler(server, client, msg)
+	exiting := cmd.handler(server, client, msg, rb)
 
-	// after each command, see if we can send registration to the client
+	// after each command, see if we can send registration to the client. the replies to
+	// the command go out first, since registering isn't a reply to it
 	if !client.registered {
+		rb.Finish()
 		server.tryRegister(client)
 	}
 
@@ -59,6 +69,14 @@ var Commands = map[string]Command{
 		handler:   accHandler,
 		minParams: 3,
 	},
+	"ACCEPT": {
+		handler:   acceptHandler,
+		minParams: 1,
+	},
+	"ACCOUNTSTATUS": {
+		handler:   accountStatusHandler,
+		minParams: 1,
+	},
 	"AMBIANCE": {
 		handler:   sceneHandler,
 		minParams: 2,
@@ -72,15 +90,33 @@ var Commands = map[string]Command{
 		handler:   awayHandler,
 		minParams: 0,
 	},
+	"BANDWIDTH": {
+		handler:   bandwidthHandler,
+		minParams: 0,
+		oper:      true,
+	},
+	"BATCH": {
+		handler:   batchHandler,
+		minParams: 1,
+	},
 	"CAP": {
 		handler:      capHandler,
 		usablePreReg: true,
 		minParams:    1,
 	},
+	"CHALLENGE": {
+		handler:   challengeHandler,
+		minParams: 1,
+	},
 	"CHANSERV": {
 		handler:   csHandler,
 		minParams: 1,
 	},
+	"CLASSINFO": {
+		handler:   classinfoHandler,
+		minParams: 1,
+		oper:      true,
+	},
 	"CS": {
 		handler:   csHandler,
 		minParams: 1,
@@ -94,6 +130,20 @@ var Commands = map[string]Command{
 		minParams: 1,
 		oper:      true,
 	},
+	"DMHISTORY": {
+		handler:   dmhistoryHandler,
+		minParams: 1,
+	},
+	"FEATURES": {
+		handler:   featuresHandler,
+		minParams: 0,
+		oper:      true,
+	},
+	"FINDUSER": {
+		handler:   finduserHandler,
+		minParams: 2,
+		oper:      true,
+	},
 	"HELP": {
 		handler:   helpHandler,
 		minParams: 0,
@@ -102,10 +152,30 @@ var Commands = map[string]Command{
 		handler:   helpHandler,
 		minParams: 0,
 	},
+	"HIGHLIGHT": {
+		handler:   highlightHandler,
+		minParams: 0,
+	},
+	"HISTORY": {
+		handler:   historyHandler,
+		minParams: 1,
+	},
+	"HOSTSERV": {
+		handler:   hsHandler,
+		minParams: 1,
+	},
+	"HS": {
+		handler:   hsHandler,
+		minParams: 1,
+	},
 	"INVITE": {
 		handler:   inviteHandler,
 		minParams: 2,
 	},
+	"INVITETOKEN": {
+		handler:   invitetokenHandler,
+		minParams: 1,
+	},
 	"ISON": {
 		handler:   isonHandler,
 		minParams: 1,
@@ -129,6 +199,10 @@ var Commands = map[string]Command{
 		minParams: 1,
 		oper:      true,
 	},
+	"LINKS": {
+		handler:   linksHandler,
+		minParams: 0,
+	},
 	"LIST": {
 		handler:   listHandler,
 		minParams: 0,
@@ -137,6 +211,14 @@ var Commands = map[string]Command{
 		handler:   lusersHandler,
 		minParams: 0,
 	},
+	"MAP": {
+		handler:   mapHandler,
+		minParams: 0,
+	},
+	"MENTIONS": {
+		handler:   mentionsHandler,
+		minParams: 0,
+	},
 	"MODE": {
 		handler:   modeHandler,
 		minParams: 1,
@@ -180,7 +262,7 @@ var Commands = map[string]Command{
 	},
 	"OPER": {
 		handler:   operHandler,
-		minParams: 2,
+		minParams: 1,
 	},
 	"PART": {
 		handler:   partHandler,
@@ -207,10 +289,26 @@ var Commands = map[string]Command{
 		handler:   privmsgHandler,
 		minParams: 2,
 	},
+	"READONLY": {
+		handler:   readonlyHandler,
+		minParams: 0,
+		oper:      true,
+		capabs:    []string{"oper:readonly"},
+	},
+	"RELAYMSG": {
+		handler:   relaymsgHandler,
+		minParams: 3,
+	},
 	"RENAME": {
 		handler:   renameHandler,
 		minParams: 2,
 	},
+	"RULEREPORT": {
+		handler:   ruleReportHandler,
+		minParams: 0,
+		oper:      true,
+		capabs:    []string{"oper:local_ban"},
+	},
 	"SANICK": {
 		handler:   sanickHandler,
 		minParams: 2,
@@ -225,6 +323,33 @@ var Commands = map[string]Command{
 		handler:   sceneHandler,
 		minParams: 2,
 	},
+	"SETBOT": {
+		handler:   setbotHandler,
+		minParams: 2,
+		oper:      true,
+		capabs:    []string{"oper:bots"},
+	},
+	"SETCLASS": {
+		handler:   setclassHandler,
+		minParams: 2,
+		oper:      true,
+		capabs:    []string{"oper:classes"},
+	},
+	"SILENCE": {
+		handler:   silenceHandler,
+		minParams: 0,
+	},
+	"STARTTLS": {
+		handler:      starttlsHandler,
+		usablePreReg: true,
+		minParams:    0,
+	},
+	"SUSPEND": {
+		handler:   suspendHandler,
+		minParams: 1,
+		oper:      true,
+		capabs:    []string{"oper:suspend"},
+	},
 	"TAGMSG": {
 		handler:   tagmsgHandler,
 		minParams: 1,
@@ -258,6 +383,12 @@ var Commands = map[string]Command{
 		minParams: 1,
 		oper:      true,
 	},
+	"UNSUSPEND": {
+		handler:   unsuspendHandler,
+		minParams: 1,
+		oper:      true,
+		capabs:    []string{"oper:suspend"},
+	},
 	"USER": {
 		handler:      userHandler,
 		usablePreReg: true,
@@ -279,6 +410,10 @@ var Commands = map[string]Command{
 		handler:   whoisHandler,
 		minParams: 1,
 	},
+	"WHOISCHANNELS": {
+		handler:   whoischannelsHandler,
+		minParams: 0,
+	},
 	"WHOWAS": {
 		handler:   whowasHandler,
 		minParams: 1,
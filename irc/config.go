@@ -6,18 +6,23 @@
 package irc
 
 import (
+	"crypto/rsa"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"strings"
 	"time"
 
 	"github.com/oragono/oragono/irc/custime"
 	"github.com/oragono/oragono/irc/logger"
+	"github.com/oragono/oragono/irc/objectstore"
 
 	"code.cloudfoundry.org/bytefmt"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
 
 	"gopkg.in/yaml.v2"
 )
@@ -33,6 +38,25 @@ type TLSListenConfig struct {
 	Key  string
 }
 
+// ListenerConfig defines extra options for a specific listener.
+type ListenerConfig struct {
+	Charset  string
+	Encoding encoding.Encoding `yaml:"-"`
+	Guest    GuestListenerConfig
+	TCP      TCPListenerConfig
+	// MaxConnections is how many connections the listener can have open at once, with 0
+	// meaning unlimited.
+	MaxConnections       int `yaml:"max-connections"`
+	Priority             string
+	PlaintextDeprecation PlaintextDeprecationConfig `yaml:"plaintext-deprecation"`
+	StartTLS             StartTLSConfig             `yaml:"starttls"`
+	// RequireSASL turns away clients that haven't logged in with SASL by the time they
+	// finish registering.
+	RequireSASL bool `yaml:"require-sasl"`
+	// PassLogin lets clients log into their account with PASS, if the server has no password.
+	PassLogin bool `yaml:"pass-login"`
+}
+
 // Config returns the TLS contiguration assicated with this TLSListenConfig.
 func (conf *TLSListenConfig) Config() (*tls.Config, error) {
 	cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
@@ -54,31 +78,85 @@ func (conf *PassConfig) PasswordBytes() []byte {
 	return bytes
 }
 
+// MissedHighlightsConfig controls the highlights we store for users who aren't around to see them.
+type MissedHighlightsConfig struct {
+	Enabled bool
+	Length  int
+}
+
+// NetworkMapConfig controls what MAP and LINKS show, and who they're shown to.
+type NetworkMapConfig struct {
+	Visibility     string
+	ShowUserCounts bool `yaml:"show-user-counts"`
+	Description    string
+}
+
+// NickCollisionConfig controls what happens when a client can't use the nickname they asked for.
+type NickCollisionConfig struct {
+	Policy      string
+	GuestPrefix string `yaml:"guest-prefix"`
+}
+
+// ExternalLinksConfig controls linking accounts to external identities, like GitHub handles.
+type ExternalLinksConfig struct {
+	Enabled             bool
+	Services            []string
+	TokenLifetimeString string        `yaml:"token-lifetime"`
+	TokenLifetime       time.Duration `yaml:"token-lifetime-real"`
+}
+
+// ServiceIsEnabled returns true if accounts can be linked to the given (lowercase) service.
+func (conf *ExternalLinksConfig) ServiceIsEnabled(service string) bool {
+	for _, enabled := range conf.Services {
+		if strings.ToLower(enabled) == service {
+			return true
+		}
+	}
+	return false
+}
+
+// BotConfig controls the limits given to accounts that opers have marked as bots.
+type BotConfig struct {
+	MaxTargets               int    `yaml:"max-targets"`
+	MonitorEntries           int    `yaml:"monitor-entries"`
+	ExemptFromPasteDetection bool   `yaml:"exempt-from-paste-detection"`
+	RelaymsgSeparators       string `yaml:"relaymsg-separators"`
+}
+
+// VHostConfig controls the vhosts that users can give themselves.
+type VHostConfig struct {
+	OfferList []string `yaml:"offer-list"`
+	// UserRequests lets users ask for any vhost with HostServ REQUEST, for opers to approve.
+	UserRequests         bool          `yaml:"user-requests"`
+	ChangeCooldownString string        `yaml:"change-cooldown"`
+	ChangeCooldown       time.Duration `yaml:"change-cooldown-real"`
+}
+
 // AccountRegistrationConfig controls account registration.
 type AccountRegistrationConfig struct {
-	Enabled          bool
-	EnabledCallbacks []string `yaml:"enabled-callbacks"`
-	Callbacks        struct {
-		Mailto struct {
-			Server string
-			Port   int
-			TLS    struct {
-				Enabled            bool
-				InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
-				ServerName         string `yaml:"servername"`
-			}
-			Username             string
-			Password             string
-			Sender               string
-			VerifyMessageSubject string `yaml:"verify-message-subject"`
-			VerifyMessage        string `yaml:"verify-message"`
-		}
+	Enabled bool
+	// VerifyTimeout is how long users have to verify their account.
+	VerifyTimeoutString string        `yaml:"verify-timeout"`
+	VerifyTimeout       time.Duration `yaml:"verify-timeout-real"`
+	EnabledCallbacks    []string      `yaml:"enabled-callbacks"`
+	Callbacks           struct {
+		Mailto  MailtoConfig
+		SMS     SMSConfig
+		Captcha CaptchaConfig
 	}
 }
 
 // ChannelRegistrationConfig controls channel registration.
 type ChannelRegistrationConfig struct {
 	Enabled bool
+	// MaxChannelsPerAccount is how many channels one account can own, or 0 for no limit.
+	MaxChannelsPerAccount int `yaml:"max-channels-per-account"`
+	// MaxPerHour and MaxPerDay are how many channels one account can register in an hour
+	// and in a day, or 0 for no limit.
+	MaxPerHour int `yaml:"max-per-hour"`
+	MaxPerDay  int `yaml:"max-per-day"`
+	// TopicHistoryLength is how many of each channel's recent topics are kept.
+	TopicHistoryLength int `yaml:"topic-history-length"`
 }
 
 // OperClassConfig defines a specific operator class.
@@ -95,7 +173,11 @@ type OperConfig struct {
 	Vhost     string
 	WhoisLine string `yaml:"whois-line"`
 	Password  string
-	Modes     string
+	// PublicKey is the path to a PEM-encoded RSA public key, for logging in with CHALLENGE.
+	PublicKey string `yaml:"public-key"`
+	// Account lets clients logged into the given account oper up without a password.
+	Account string
+	Modes   string
 }
 
 // PasswordBytes returns the bytes represented by the password hash.
@@ -109,8 +191,11 @@ func (conf *OperConfig) PasswordBytes() []byte {
 
 // RestAPIConfig controls the integrated REST API.
 type RestAPIConfig struct {
-	Enabled bool
-	Listen  string
+	Enabled         bool
+	Listen          string
+	TrustedGateways []string             `yaml:"trusted-gateways"`
+	APIKeys         APIKeysConfig        `yaml:"api-keys"`
+	MessageGateway  MessageGatewayConfig `yaml:"message-gateway"`
 }
 
 // ConnectionLimitsConfig controls the automated connection limits.
@@ -136,6 +221,84 @@ type ConnectionThrottleConfig struct {
 	Exempted           []string
 }
 
+// RateLimitConfig controls how many times something can happen within a window.
+type RateLimitConfig struct {
+	Limit        int
+	WindowString string        `yaml:"window"`
+	Window       time.Duration `yaml:"window-real"`
+}
+
+// load parses the window. If neither the limit nor the window are given, the limit is
+// missing from the config and the given default is used instead, so older configs don't
+// end up without it. A limit of 0 with a window means no limit.
+func (conf *RateLimitConfig) load(defaultLimit RateLimitConfig) (err error) {
+	if conf.Limit == 0 && conf.WindowString == "" {
+		*conf = defaultLimit
+	}
+	if conf.Limit < 1 {
+		return nil
+	}
+	conf.Window, err = time.ParseDuration(conf.WindowString)
+	return err
+}
+
+// CommandFloodConfig controls how quickly clients can send commands before they're slowed down.
+type CommandFloodConfig struct {
+	Enabled        bool
+	Burst          int
+	IntervalString string        `yaml:"interval"`
+	Interval       time.Duration `yaml:"interval-real"`
+}
+
+// RateLimitsConfig controls the rate limits on client commands, SASL, registration and invites.
+type RateLimitsConfig struct {
+	Commands      CommandFloodConfig
+	SASLAttempts  RateLimitConfig `yaml:"sasl-attempts"`
+	Registrations RateLimitConfig
+	Invites       RateLimitConfig
+	AccountStatus RateLimitConfig `yaml:"account-status"`
+	APIMessages   RateLimitConfig `yaml:"api-messages"`
+}
+
+// MaxClientsConfig controls the soft limit on connected clients.
+type MaxClientsConfig struct {
+	Enabled  bool
+	Limit    int
+	Behavior string `yaml:"when-full"`
+	Exempted []string
+}
+
+// LineParsingConfig controls how strictly we handle the lines clients send us.
+type LineParsingConfig struct {
+	Mode        string
+	MaxTags     int    `yaml:"max-tags"`
+	InvalidUTF8 string `yaml:"invalid-utf8"`
+	// LongMessages is what we do with messages too long to relay to clients without maxline.
+	LongMessages string `yaml:"long-messages"`
+}
+
+// UTF8OnlyConfig controls the UTF8ONLY server mode.
+type UTF8OnlyConfig struct {
+	Enabled bool
+	NonUTF8 string `yaml:"non-utf8"`
+}
+
+// TypingConfig controls how typing notifications are relayed.
+type TypingConfig struct {
+	MaxChannelSize    int           `yaml:"max-channel-size"`
+	MinIntervalString string        `yaml:"min-interval"`
+	MinInterval       time.Duration `yaml:"min-interval-real"`
+}
+
+// PasteDetectionConfig controls how we handle clients pasting lots of lines into channels.
+type PasteDetectionConfig struct {
+	Enabled      bool
+	Lines        int
+	WindowString string        `yaml:"window"`
+	Window       time.Duration `yaml:"window-real"`
+	Action       string
+}
+
 // LoggingConfig controls a single logging method.
 type LoggingConfig struct {
 	Method        string
@@ -177,6 +340,33 @@ func (sts *STSConfig) Value() string {
 	return val
 }
 
+// HistoryConfig controls message history storage.
+type HistoryConfig struct {
+	Enabled        bool
+	ChannelLength  int                         `yaml:"channel-length"`
+	ColdStorage    HistoryColdStorageConfig    `yaml:"cold-storage"`
+	DirectMessages HistoryDirectMessagesConfig `yaml:"direct-messages"`
+	Retraction     HistoryRetractionConfig     `yaml:"retraction"`
+}
+
+// HistoryDirectMessagesConfig controls the opt-in history of users' private messages.
+type HistoryDirectMessagesConfig struct {
+	Enabled         bool
+	Length          int
+	RetentionString string        `yaml:"retention"`
+	Retention       time.Duration `yaml:"retention-real"`
+}
+
+// HistoryColdStorageConfig controls the on-disk tier of message history.
+type HistoryColdStorageConfig struct {
+	Enabled                  bool
+	Path                     string
+	RetentionString          string        `yaml:"retention"`
+	Retention                time.Duration `yaml:"retention-real"`
+	CompactionIntervalString string        `yaml:"compaction-interval"`
+	CompactionInterval       time.Duration `yaml:"compaction-interval-real"`
+}
+
 // StackImpactConfig is the config used for StackImpact's profiling.
 type StackImpactConfig struct {
 	Enabled  bool
@@ -197,33 +387,78 @@ type Config struct {
 		Listen             []string
 		Wslisten           string                      `yaml:"ws-listen"`
 		TLSListeners       map[string]*TLSListenConfig `yaml:"tls-listeners"`
+		ListenerOptions    map[string]*ListenerConfig  `yaml:"listener-options"`
 		STS                STSConfig
-		RestAPI            RestAPIConfig `yaml:"rest-api"`
-		CheckIdent         bool          `yaml:"check-ident"`
+		RestAPI            RestAPIConfig       `yaml:"rest-api"`
+		ControlSocket      ControlSocketConfig `yaml:"control-socket"`
+		MailGateway        MailGatewayConfig   `yaml:"mail-gateway"`
+		CheckIdent         bool                `yaml:"check-ident"`
 		MOTD               string
 		MaxSendQString     string `yaml:"max-sendq"`
 		MaxSendQBytes      uint64
 		ConnectionLimits   ConnectionLimitsConfig   `yaml:"connection-limits"`
+		CloneDetection     CloneDetectionConfig     `yaml:"clone-detection"`
 		ConnectionThrottle ConnectionThrottleConfig `yaml:"connection-throttling"`
+		MaxClients         MaxClientsConfig         `yaml:"max-clients"`
+		LineParsing        LineParsingConfig        `yaml:"line-parsing"`
+		UTF8Only           UTF8OnlyConfig           `yaml:"utf8only"`
+		Typing             TypingConfig             `yaml:"typing-notifications"`
+		PasteDetection     PasteDetectionConfig     `yaml:"paste-detection"`
+		NickCollision      NickCollisionConfig      `yaml:"nick-collision"`
+		NetworkMap         NetworkMapConfig         `yaml:"network-map"`
+		WhoisChannels      string                   `yaml:"whois-channels"`
+		RateLimits         RateLimitsConfig         `yaml:"rate-limits"`
+		QuitMessages       QuitMessagesConfig       `yaml:"quit-messages"`
+		StructuredNotices  bool                     `yaml:"structured-notices"`
 	}
 
 	Datastore struct {
-		Path string
+		Path      string
+		ReadOnly  bool `yaml:"read-only"`
+		Snapshots SnapshotConfig
 	}
 
 	Accounts struct {
 		Registration          AccountRegistrationConfig
-		AuthenticationEnabled bool `yaml:"authentication-enabled"`
+		AuthenticationEnabled bool                   `yaml:"authentication-enabled"`
+		MissedHighlights      MissedHighlightsConfig `yaml:"missed-highlights"`
+		VHosts                VHostConfig            `yaml:"vhosts"`
+		ExternalLinks         ExternalLinksConfig    `yaml:"external-links"`
+		Bots                  BotConfig
+		LDAP                  LDAPConfig
+		OAuth2                OAuth2Config
+		NickServ              NickServConfig
+		NickEnforcement       NickEnforcementConfig `yaml:"nick-enforcement"`
+		PasswordReset         PasswordResetConfig   `yaml:"password-reset"`
+		Expiry                AccountExpiryConfig
 	}
 
 	Channels struct {
 		Registration ChannelRegistrationConfig
+		// KickInsecureMembers kicks members who aren't using TLS when +z is set.
+		KickInsecureMembers bool                 `yaml:"kick-insecure-members"`
+		ModeCoalescing      ModeCoalescingConfig `yaml:"mode-coalescing"`
+		Invites             InvitesConfig
+		Webhooks            WebhooksConfig
 	}
 
+	History HistoryConfig
+
 	OperClasses map[string]*OperClassConfig `yaml:"oper-classes"`
 
 	Opers map[string]*OperConfig
 
+	ConnClasses map[string]*ConnectionClassConfig `yaml:"connection-classes"`
+
+	Networks map[string]*NetworkConfig
+
+	Schedules       map[string]*ScheduleConfig `yaml:"-"`
+	ActiveSchedules []string                   `yaml:"-"`
+	// Warnings holds the problems found in the config that didn't stop it from loading.
+	Warnings []ConfigWarning `yaml:"-"`
+	// Features holds the state of each feature, and where it comes from.
+	Features []Feature `yaml:"-"`
+
 	Logging []LoggingConfig
 
 	Debug struct {
@@ -231,15 +466,22 @@ type Config struct {
 	}
 
 	Limits struct {
-		AwayLen        uint          `yaml:"awaylen"`
-		ChanListModes  uint          `yaml:"chan-list-modes"`
-		ChannelLen     uint          `yaml:"channellen"`
-		KickLen        uint          `yaml:"kicklen"`
-		MonitorEntries uint          `yaml:"monitor-entries"`
-		NickLen        uint          `yaml:"nicklen"`
-		TopicLen       uint          `yaml:"topiclen"`
-		WhowasEntries  uint          `yaml:"whowas-entries"`
-		LineLen        LineLenConfig `yaml:"linelen"`
+		AwayLen            uint          `yaml:"awaylen"`
+		ChanListModes      uint          `yaml:"chan-list-modes"`
+		ChannelLen         uint          `yaml:"channellen"`
+		KickLen            uint          `yaml:"kicklen"`
+		MonitorEntries     uint          `yaml:"monitor-entries"`
+		NickLen            uint          `yaml:"nicklen"`
+		TopicLen           uint          `yaml:"topiclen"`
+		WhowasEntries      uint          `yaml:"whowas-entries"`
+		LineLen            LineLenConfig `yaml:"linelen"`
+		Multiline          MultilineConfig
+		WildcardWhoResults uint `yaml:"wildcard-who-results"`
+		OperWhoResults     uint `yaml:"oper-who-results"`
+		Modes              uint
+		// TargMax replaces the default target limits for the given commands.
+		TargMax     map[string]int `yaml:"targmax"`
+		TargMaxReal map[string]int `yaml:"targmax-real"`
 	}
 }
 
@@ -320,12 +562,70 @@ func (conf *Config) OperatorClasses() (*map[string]OperClass, error) {
 	return &ocs, nil
 }
 
+// ConnectionClassConfig defines a connection class, and which connections are put in it.
+type ConnectionClassConfig struct {
+	IPs            []string
+	TLSOnly        bool   `yaml:"tls-only"`
+	MaxSendQString string `yaml:"max-sendq"`
+	MonitorEntries int    `yaml:"monitor-entries"`
+	MaxTargets     int    `yaml:"max-targets"`
+	// QuitMessages replaces the server's quit message settings for clients in this class.
+	QuitMessages *QuitMessagesConfig `yaml:"quit-messages"`
+}
+
+// ConnectionClasses returns a map of assembled connection classes from the given config.
+func (conf *Config) ConnectionClasses() (map[string]*ConnectionClass, error) {
+	classes := make(map[string]*ConnectionClass)
+	for name, info := range conf.ConnClasses {
+		if name == "default" {
+			return nil, errors.New("Connection class name [default] is reserved for clients that don't match any class")
+		}
+
+		class := ConnectionClass{
+			Name:           name,
+			TLSOnly:        info.TLSOnly,
+			MonitorEntries: info.MonitorEntries,
+			MaxTargets:     info.MaxTargets,
+			QuitMessages:   info.QuitMessages,
+		}
+		if info.MaxSendQString != "" {
+			var err error
+			class.MaxSendQBytes, err = bytefmt.ToBytes(info.MaxSendQString)
+			if err != nil {
+				return nil, fmt.Errorf("Could not parse max-sendq of connection class [%s]: %s", name, err.Error())
+			}
+		}
+
+		for _, cidr := range info.IPs {
+			ipaddr := net.ParseIP(cidr)
+			_, netaddr, err := net.ParseCIDR(cidr)
+			if ipaddr != nil {
+				// single addresses are stored as networks so they can be compared
+				bits := 128
+				if ipaddr.To4() != nil {
+					ipaddr = ipaddr.To4()
+					bits = 32
+				}
+				netaddr = &net.IPNet{IP: ipaddr, Mask: net.CIDRMask(bits, bits)}
+			} else if err != nil {
+				return nil, fmt.Errorf("Could not parse IP/network [%s] of connection class [%s]", cidr, name)
+			}
+			class.Networks = append(class.Networks, *netaddr)
+		}
+
+		classes[name] = &class
+	}
+	return classes, nil
+}
+
 // Oper represents a single assembled operator's config.
 type Oper struct {
 	Class     *OperClass
 	WhoisLine string
 	Vhost     string
 	Pass      []byte
+	PublicKey *rsa.PublicKey
+	Account   string // casefolded
 	Modes     string
 }
 
@@ -341,7 +641,24 @@ func (conf *Config) Operators(oc *map[string]OperClass) (map[string]Oper, error)
 			return nil, fmt.Errorf("Could not casefold oper name: %s", err.Error())
 		}
 
-		oper.Pass = opConf.PasswordBytes()
+		if opConf.Password == "" && opConf.PublicKey == "" && opConf.Account == "" {
+			return nil, fmt.Errorf("Could not load operator [%s] - they need a password, public-key or account to log in with", name)
+		}
+		if opConf.Password != "" {
+			oper.Pass = opConf.PasswordBytes()
+		}
+		if opConf.PublicKey != "" {
+			oper.PublicKey, err = loadChallengeKey(opConf.PublicKey)
+			if err != nil {
+				return nil, fmt.Errorf("Could not load public key for operator [%s]: %s", name, err.Error())
+			}
+		}
+		if opConf.Account != "" {
+			oper.Account, err = CasefoldName(opConf.Account)
+			if err != nil {
+				return nil, fmt.Errorf("Could not load operator [%s] - account [%s] is not valid", name, opConf.Account)
+			}
+		}
 		oper.Vhost = opConf.Vhost
 		class, exists := (*oc)[opConf.Class]
 		if !exists {
@@ -361,6 +678,19 @@ func (conf *Config) Operators(oc *map[string]OperClass) (map[string]Oper, error)
 	return operators, nil
 }
 
+// ListenerConfigs returns the extra options for each listener, with defaults filled in.
+func (conf *Config) ListenerConfigs() map[string]*ListenerConfig {
+	configs := make(map[string]*ListenerConfig)
+	for _, addr := range conf.Server.Listen {
+		listenerConfig := conf.Server.ListenerOptions[addr]
+		if listenerConfig == nil {
+			listenerConfig = &ListenerConfig{}
+		}
+		configs[addr] = listenerConfig
+	}
+	return configs
+}
+
 // TLSListeners returns a list of TLS listeners and their configs.
 func (conf *Config) TLSListeners() map[string]*tls.Config {
 	tlsListeners := make(map[string]*tls.Config)
@@ -386,10 +716,18 @@ func LoadConfig(filename string) (config *Config, err error) {
 		return nil, err
 	}
 
+	// apply the overrides of any schedules that are running right now
+	data, schedules, activeSchedules, err := applySchedules(data, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
 	err = yaml.Unmarshal(data, &config)
 	if err != nil {
 		return nil, err
 	}
+	config.Schedules = schedules
+	config.ActiveSchedules = activeSchedules
 
 	// we need this so PasswordBytes returns the correct info
 	if config.Server.Password != "" {
@@ -408,12 +746,25 @@ func LoadConfig(filename string) (config *Config, err error) {
 	if config.Datastore.Path == "" {
 		return nil, errors.New("Datastore path missing")
 	}
+	if config.Datastore.Snapshots.Enabled {
+		config.Datastore.Snapshots.Interval, err = custime.ParseDuration(config.Datastore.Snapshots.IntervalString)
+		if err != nil || config.Datastore.Snapshots.Interval < time.Minute {
+			return nil, fmt.Errorf("Could not parse datastore snapshots interval (must be at least a minute): %s", config.Datastore.Snapshots.IntervalString)
+		}
+		_, err = objectstore.NewClient(config.Datastore.Snapshots.S3)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse datastore snapshots s3 config: %s", err.Error())
+		}
+	}
 	if len(config.Server.Listen) == 0 {
 		return nil, errors.New("Server listening addresses missing")
 	}
 	if config.Limits.NickLen < 1 || config.Limits.ChannelLen < 2 || config.Limits.AwayLen < 1 || config.Limits.KickLen < 1 || config.Limits.TopicLen < 1 {
 		return nil, errors.New("Limits aren't setup properly, check them and make them sane")
 	}
+	if config.Server.ControlSocket.Enabled && config.Server.ControlSocket.Path == "" {
+		return nil, errors.New("Control socket is enabled but has no path")
+	}
 	if config.Server.STS.Enabled {
 		config.Server.STS.Duration, err = custime.ParseDuration(config.Server.STS.DurationString)
 		if err != nil {
@@ -433,9 +784,294 @@ func LoadConfig(filename string) (config *Config, err error) {
 			return nil, fmt.Errorf("Could not parse connection-throttle ban-duration: %s", err.Error())
 		}
 	}
+	if config.Server.RateLimits.Commands.Enabled {
+		config.Server.RateLimits.Commands.Interval, err = time.ParseDuration(config.Server.RateLimits.Commands.IntervalString)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse rate-limits commands interval: %s", err.Error())
+		}
+		if config.Server.RateLimits.Commands.Burst < 1 {
+			return nil, errors.New("Rate-limits commands burst must be at least 1")
+		}
+	}
+	err = config.Server.RateLimits.SASLAttempts.load(defaultSASLAttemptsLimit)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse rate-limits sasl-attempts window: %s", err.Error())
+	}
+	err = config.Server.RateLimits.Registrations.load(defaultRegistrationsLimit)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse rate-limits registrations window: %s", err.Error())
+	}
+	err = config.Server.RateLimits.Invites.load(defaultInvitesLimit)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse rate-limits invites window: %s", err.Error())
+	}
+	err = config.Server.RateLimits.AccountStatus.load(defaultAccountStatusLimit)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse rate-limits account-status window: %s", err.Error())
+	}
+	err = config.Server.RateLimits.APIMessages.load(defaultAPIMessagesLimit)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse rate-limits api-messages window: %s", err.Error())
+	}
+	for addr, listenerConfig := range config.Server.ListenerOptions {
+		if listenerConfig.Charset != "" {
+			listenerConfig.Encoding, err = ianaindex.IANA.Encoding(listenerConfig.Charset)
+			if err != nil || listenerConfig.Encoding == nil {
+				return nil, fmt.Errorf("Could not find charset [%s] for listener %s", listenerConfig.Charset, addr)
+			}
+		}
+		err = listenerConfig.TCP.load()
+		if err != nil {
+			return nil, fmt.Errorf("Could not load tcp options for listener %s: %s", addr, err.Error())
+		}
+		err = listenerConfig.loadLimits()
+		if err != nil {
+			return nil, fmt.Errorf("Could not load limits for listener %s: %s", addr, err.Error())
+		}
+		err = listenerConfig.PlaintextDeprecation.load()
+		if err != nil {
+			return nil, fmt.Errorf("Could not load plaintext-deprecation for listener %s: %s", addr, err.Error())
+		}
+		err = listenerConfig.StartTLS.load(config.Server.TLSListeners)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load starttls for listener %s: %s", addr, err.Error())
+		}
+		if listenerConfig.Guest.Enabled {
+			if len(listenerConfig.Guest.Channels) == 0 {
+				return nil, fmt.Errorf("Guest listener %s has no channels", addr)
+			}
+			for _, name := range listenerConfig.Guest.Channels {
+				_, err = CasefoldChannel(name)
+				if err != nil {
+					return nil, fmt.Errorf("Guest listener %s has an invalid channel: %s", addr, name)
+				}
+			}
+		}
+	}
+	if config.Server.MaxClients.Enabled {
+		if config.Server.MaxClients.Limit < 1 {
+			return nil, errors.New("max-clients limit must be at least 1")
+		}
+		switch config.Server.MaxClients.Behavior {
+		case "":
+			config.Server.MaxClients.Behavior = MaxClientsReject
+		case MaxClientsReject, MaxClientsSASLOnly, MaxClientsExemptOnly:
+		default:
+			return nil, fmt.Errorf("Could not parse max-clients when-full behavior: %s", config.Server.MaxClients.Behavior)
+		}
+	}
+	switch config.Server.LineParsing.Mode {
+	case "", "strict", "lenient":
+	default:
+		return nil, fmt.Errorf("Could not parse line-parsing mode: %s", config.Server.LineParsing.Mode)
+	}
+	switch config.Server.LineParsing.InvalidUTF8 {
+	case "":
+		config.Server.LineParsing.InvalidUTF8 = InvalidUTF8Allow
+	case InvalidUTF8Allow, InvalidUTF8Reject, InvalidUTF8Strip, InvalidUTF8Replace:
+	default:
+		return nil, fmt.Errorf("Could not parse line-parsing invalid-utf8 policy: %s", config.Server.LineParsing.InvalidUTF8)
+	}
+	switch config.Server.LineParsing.LongMessages {
+	case "":
+		config.Server.LineParsing.LongMessages = LongMessagesSplit
+	case LongMessagesSplit, LongMessagesTruncate, LongMessagesReject:
+	default:
+		return nil, fmt.Errorf("Could not parse line-parsing long-messages policy: %s", config.Server.LineParsing.LongMessages)
+	}
+	if config.Server.UTF8Only.Enabled {
+		switch config.Server.UTF8Only.NonUTF8 {
+		case "":
+			config.Server.UTF8Only.NonUTF8 = UTF8OnlyReject
+		case UTF8OnlyReject, UTF8OnlyTranscode:
+		default:
+			return nil, fmt.Errorf("Could not parse utf8only non-utf8 behavior: %s", config.Server.UTF8Only.NonUTF8)
+		}
+	}
+	if config.Server.Typing.MinIntervalString != "" {
+		config.Server.Typing.MinInterval, err = time.ParseDuration(config.Server.Typing.MinIntervalString)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse typing-notifications min-interval: %s", err.Error())
+		}
+	}
+	if config.Server.PasteDetection.Enabled {
+		if config.Server.PasteDetection.Lines < 1 {
+			return nil, errors.New("paste-detection lines must be at least 1")
+		}
+		config.Server.PasteDetection.Window, err = time.ParseDuration(config.Server.PasteDetection.WindowString)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse paste-detection window: %s", err.Error())
+		}
+		switch config.Server.PasteDetection.Action {
+		case "":
+			config.Server.PasteDetection.Action = PasteActionTruncate
+		case PasteActionFakelag, PasteActionTruncate:
+		default:
+			return nil, fmt.Errorf("Could not parse paste-detection action: %s", config.Server.PasteDetection.Action)
+		}
+	}
+	err = config.Server.RestAPI.APIKeys.load()
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse rest-api api-keys: %s", err.Error())
+	}
+	err = config.Server.RestAPI.MessageGateway.load()
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse rest-api message-gateway: %s", err.Error())
+	}
+	err = config.Server.MailGateway.load()
+	if err != nil {
+		return nil, fmt.Errorf("Could not load mail-gateway config: %s", err.Error())
+	}
+	for _, gateway := range config.Server.RestAPI.TrustedGateways {
+		_, _, err := net.ParseCIDR(gateway)
+		if net.ParseIP(gateway) == nil && err != nil {
+			return nil, fmt.Errorf("Could not parse rest-api trusted gateway [%s]", gateway)
+		}
+	}
+	switch config.Server.NetworkMap.Visibility {
+	case "":
+		config.Server.NetworkMap.Visibility = NetworkMapEveryone
+	case NetworkMapEveryone, NetworkMapOpers:
+	default:
+		return nil, fmt.Errorf("Could not parse network-map visibility: %s", config.Server.NetworkMap.Visibility)
+	}
+	switch config.Server.WhoisChannels {
+	case "":
+		config.Server.WhoisChannels = WhoisChannelsAll
+	case WhoisChannelsAll, WhoisChannelsShared, WhoisChannelsNone:
+	default:
+		return nil, fmt.Errorf("Could not parse whois-channels setting: %s", config.Server.WhoisChannels)
+	}
+	switch config.Server.NickCollision.Policy {
+	case "":
+		config.Server.NickCollision.Policy = NickCollisionReject
+	case NickCollisionReject, NickCollisionGuest, NickCollisionSuffix:
+	default:
+		return nil, fmt.Errorf("Could not parse nick-collision policy: %s", config.Server.NickCollision.Policy)
+	}
+	if config.Server.NickCollision.GuestPrefix == "" {
+		config.Server.NickCollision.GuestPrefix = "Guest"
+	}
+	if config.Accounts.MissedHighlights.Enabled && config.Accounts.MissedHighlights.Length < 1 {
+		return nil, errors.New("Accounts missed-highlights length must be at least 1")
+	}
+	if config.Accounts.ExternalLinks.Enabled {
+		config.Accounts.ExternalLinks.TokenLifetime, err = custime.ParseDuration(config.Accounts.ExternalLinks.TokenLifetimeString)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse external-links token-lifetime: %s", err.Error())
+		}
+	}
+	err = config.Accounts.LDAP.load()
+	if err != nil {
+		return nil, fmt.Errorf("Could not load ldap config: %s", err.Error())
+	}
+	err = config.Accounts.OAuth2.load()
+	if err != nil {
+		return nil, fmt.Errorf("Could not load oauth2 config: %s", err.Error())
+	}
+	err = config.Accounts.NickServ.load()
+	if err != nil {
+		return nil, fmt.Errorf("Could not load nickserv config: %s", err.Error())
+	}
+	err = config.Accounts.NickEnforcement.load()
+	if err != nil {
+		return nil, fmt.Errorf("Could not load nick-enforcement config: %s", err.Error())
+	}
+	config.Accounts.Registration.VerifyTimeout = defaultVerifyTimeout
+	if config.Accounts.Registration.VerifyTimeoutString != "" {
+		config.Accounts.Registration.VerifyTimeout, err = custime.ParseDuration(config.Accounts.Registration.VerifyTimeoutString)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse registration verify-timeout: %s", err.Error())
+		}
+	}
+	err = config.Accounts.Registration.Callbacks.Mailto.load()
+	if err != nil {
+		return nil, fmt.Errorf("Could not load mailto config: %s", err.Error())
+	}
+	err = config.Accounts.Registration.Callbacks.SMS.load()
+	if err != nil {
+		return nil, fmt.Errorf("Could not load sms config: %s", err.Error())
+	}
+	err = config.Accounts.Registration.Callbacks.Captcha.load()
+	if err != nil {
+		return nil, fmt.Errorf("Could not load captcha config: %s", err.Error())
+	}
+	err = config.Accounts.PasswordReset.load()
+	if err != nil {
+		return nil, fmt.Errorf("Could not load password-reset config: %s", err.Error())
+	}
+	err = config.Accounts.Expiry.load()
+	if err != nil {
+		return nil, fmt.Errorf("Could not load account expiry config: %s", err.Error())
+	}
+	config.Limits.TargMaxReal, err = loadTargMax(config.Limits.TargMax)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load targmax limits: %s", err.Error())
+	}
+	err = config.Channels.ModeCoalescing.load()
+	if err != nil {
+		return nil, fmt.Errorf("Could not load mode-coalescing config: %s", err.Error())
+	}
+	err = config.Channels.Invites.load()
+	if err != nil {
+		return nil, fmt.Errorf("Could not load channel invites config: %s", err.Error())
+	}
+	err = config.Channels.Webhooks.load()
+	if err != nil {
+		return nil, fmt.Errorf("Could not load channel webhooks config: %s", err.Error())
+	}
+	if config.Accounts.Bots.RelaymsgSeparators == "" {
+		config.Accounts.Bots.RelaymsgSeparators = "/"
+	}
+	if config.Accounts.VHosts.ChangeCooldownString != "" {
+		config.Accounts.VHosts.ChangeCooldown, err = custime.ParseDuration(config.Accounts.VHosts.ChangeCooldownString)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse vhosts change-cooldown: %s", err.Error())
+		}
+	}
+	if !config.History.Enabled {
+		// private message history relies on history being enabled overall
+		config.History.DirectMessages.Enabled = false
+	}
+	if config.History.Enabled {
+		if config.History.ChannelLength < 1 {
+			return nil, errors.New("History channel-length must be at least 1")
+		}
+		if config.History.ColdStorage.Enabled {
+			if config.History.ColdStorage.Path == "" {
+				return nil, errors.New("History cold-storage path missing")
+			}
+			config.History.ColdStorage.Retention, err = custime.ParseDuration(config.History.ColdStorage.RetentionString)
+			if err != nil {
+				return nil, fmt.Errorf("Could not parse history cold-storage retention: %s", err.Error())
+			}
+			config.History.ColdStorage.CompactionInterval, err = time.ParseDuration(config.History.ColdStorage.CompactionIntervalString)
+			if err != nil {
+				return nil, fmt.Errorf("Could not parse history cold-storage compaction-interval: %s", err.Error())
+			}
+		}
+		if config.History.DirectMessages.Enabled {
+			if config.History.DirectMessages.Length < 1 {
+				return nil, errors.New("History direct-messages length must be at least 1")
+			}
+			config.History.DirectMessages.Retention, err = custime.ParseDuration(config.History.DirectMessages.RetentionString)
+			if err != nil {
+				return nil, fmt.Errorf("Could not parse history direct-messages retention: %s", err.Error())
+			}
+		}
+		if config.History.Retraction.OnKill || config.History.Retraction.OnBan {
+			config.History.Retraction.Window, err = custime.ParseDuration(config.History.Retraction.WindowString)
+			if err != nil {
+				return nil, fmt.Errorf("Could not parse history retraction window: %s", err.Error())
+			}
+		}
+	}
 	if config.Limits.LineLen.Tags < 512 || config.Limits.LineLen.Rest < 512 {
 		return nil, errors.New("Line lengths must be 512 or greater (check the linelen section under server->limits)")
 	}
+	if config.Limits.Multiline.MaxBytes < 0 || config.Limits.Multiline.MaxLines < 0 {
+		return nil, errors.New("Multiline limits can't be negative (check the multiline section under limits)")
+	}
 	var newLogConfigs []LoggingConfig
 	for _, logConfig := range config.Logging {
 		// methods
@@ -487,5 +1123,13 @@ func LoadConfig(filename string) (config *Config, err error) {
 		return nil, fmt.Errorf("Could not parse maximum SendQ size (make sure it only contains whole numbers): %s", err.Error())
 	}
 
+	var raw interface{}
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+	config.Warnings = lintConfig(raw, config)
+	config.Features = loadFeatures(raw, config)
+
 	return config, nil
 }
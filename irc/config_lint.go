@@ -0,0 +1,170 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// deprecatedConfigKeys maps config keys that still work, but shouldn't be used, to the keys
+// that replace them.
+var deprecatedConfigKeys = map[string]string{
+	// PassConfig is embedded in the server section, so its password can also be set here
+	"server.passconfig": "server.password",
+}
+
+// ConfigWarning is a problem with the config that doesn't stop it from loading, like a
+// misspelt key that's being ignored.
+type ConfigWarning struct {
+	// Key is where the problem is, like server.rest-api.listen
+	Key     string
+	Message string
+}
+
+func (warning ConfigWarning) String() string {
+	return fmt.Sprintf("%s: %s", warning.Key, warning.Message)
+}
+
+// configFields returns the fields of a config struct, by the key they have in the config.
+func configFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+		name := tag[0]
+		if 1 < len(tag) && tag[1] == "inline" {
+			for key, inlineField := range configFields(field.Type) {
+				fields[key] = inlineField
+			}
+			continue
+		}
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+// lintConfigKeys compares the raw config against the type it's loaded into, and warns about
+// keys that are ignored, deprecated or only meant to be set by us.
+func lintConfigKeys(raw interface{}, t reflect.Type, path string, warnings *[]ConfigWarning) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	keyPath := func(key interface{}) string {
+		if path == "" {
+			return fmt.Sprint(key)
+		}
+		return fmt.Sprintf("%s.%v", path, key)
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		values, ok := raw.(map[interface{}]interface{})
+		if !ok {
+			return
+		}
+		fields := configFields(t)
+		for key, value := range values {
+			name := fmt.Sprint(key)
+			if replacement, deprecated := deprecatedConfigKeys[keyPath(key)]; deprecated {
+				*warnings = append(*warnings, ConfigWarning{keyPath(key), fmt.Sprintf("This is deprecated, use %s instead", replacement)})
+				continue
+			}
+			field, known := fields[name]
+			if !known {
+				*warnings = append(*warnings, ConfigWarning{keyPath(key), "Unknown key, it's being ignored"})
+				continue
+			}
+			if _, parsed := fields[strings.TrimSuffix(name, "-real")]; strings.HasSuffix(name, "-real") && parsed {
+				*warnings = append(*warnings, ConfigWarning{keyPath(key), fmt.Sprintf("This is worked out from %s, set that instead", strings.TrimSuffix(name, "-real"))})
+				continue
+			}
+			lintConfigKeys(value, field.Type, keyPath(key), warnings)
+		}
+	case reflect.Map:
+		values, ok := raw.(map[interface{}]interface{})
+		if !ok {
+			return
+		}
+		for key, value := range values {
+			lintConfigKeys(value, t.Elem(), keyPath(key), warnings)
+		}
+	case reflect.Slice:
+		values, ok := raw.([]interface{})
+		if !ok {
+			return
+		}
+		for i, value := range values {
+			lintConfigKeys(value, t.Elem(), fmt.Sprintf("%s[%d]", path, i), warnings)
+		}
+	}
+}
+
+// lintKeyFile warns if a private key can be read by other users on this system.
+func lintKeyFile(key, filename string, warnings *[]ConfigWarning) {
+	if filename == "" || runtime.GOOS == "windows" {
+		return
+	}
+	info, err := os.Stat(filename)
+	if err == nil && info.Mode().Perm()&0077 != 0 {
+		*warnings = append(*warnings, ConfigWarning{key, fmt.Sprintf("%s can be read by other users (mode %o), it should be chmod 600", filename, info.Mode().Perm())})
+	}
+}
+
+// lintConfigValues warns about settings that work, but are probably a mistake.
+func lintConfigValues(config *Config) (warnings []ConfigWarning) {
+	for addr, listener := range config.Server.TLSListeners {
+		lintKeyFile(fmt.Sprintf("server.tls-listeners.%s.key", addr), listener.Key, &warnings)
+	}
+	for name, network := range config.Networks {
+		if network.TLS != nil {
+			lintKeyFile(fmt.Sprintf("networks.%s.tls.key", name), network.TLS.Key, &warnings)
+		}
+	}
+	lintKeyFile("accounts.registration.callbacks.mailto.dkim.key-file", config.Accounts.Registration.Callbacks.Mailto.DKIM.KeyFile, &warnings)
+
+	restAPI := config.Server.RestAPI
+	for i, gateway := range restAPI.TrustedGateways {
+		_, network, err := net.ParseCIDR(gateway)
+		if err != nil {
+			continue
+		}
+		if ones, _ := network.Mask.Size(); ones == 0 {
+			warnings = append(warnings, ConfigWarning{fmt.Sprintf("server.rest-api.trusted-gateways[%d]", i), fmt.Sprintf("%s trusts every address", gateway)})
+		}
+	}
+	return warnings
+}
+
+// lintConfig returns the warnings for the given config, sorted by key.
+func lintConfig(raw interface{}, config *Config) []ConfigWarning {
+	var warnings []ConfigWarning
+	// schedules are loaded on their own, before the rest of the config
+	if sections, ok := raw.(map[interface{}]interface{}); ok {
+		if schedules, exists := sections["schedules"]; exists {
+			lintConfigKeys(schedules, reflect.TypeOf(config.Schedules), "schedules", &warnings)
+			delete(sections, "schedules")
+		}
+	}
+	lintConfigKeys(raw, reflect.TypeOf(config), "", &warnings)
+	warnings = append(warnings, lintConfigValues(config)...)
+	sort.SliceStable(warnings, func(i, j int) bool {
+		return warnings[i].Key < warnings[j].Key
+	})
+	return warnings
+}
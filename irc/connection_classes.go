@@ -0,0 +1,200 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/sno"
+)
+
+// ConnectionClass is a class that connecting clients are put into based on where they're
+// connecting from, which can raise or lower their limits.
+type ConnectionClass struct {
+	Name           string
+	Networks       []net.IPNet
+	TLSOnly        bool
+	MaxSendQBytes  uint64
+	MonitorEntries int
+	MaxTargets     int
+	QuitMessages   *QuitMessagesConfig
+}
+
+// matchConnectionClass returns the class the given connection should be put in, along with
+// why. If no class matches, nil is returned.
+func (server *Server) matchConnectionClass(addr net.IP, isTLS bool) (*ConnectionClass, string) {
+	var names []string
+	for name := range server.connectionClasses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// the class with the most specific matching network wins
+	var bestClass *ConnectionClass
+	var bestNetwork net.IPNet
+	bestSize := -1
+	for _, name := range names {
+		class := server.connectionClasses[name]
+		if class.TLSOnly && !isTLS {
+			continue
+		}
+		for _, network := range class.Networks {
+			size, _ := network.Mask.Size()
+			if network.Contains(addr) && bestSize < size {
+				bestClass = class
+				bestNetwork = network
+				bestSize = size
+			}
+		}
+	}
+
+	if bestClass == nil {
+		return nil, "no class matched, using the default limits"
+	}
+	reason := fmt.Sprintf("matched network %s", bestNetwork.String())
+	if bestClass.TLSOnly {
+		reason += " over TLS"
+	}
+	return bestClass, reason
+}
+
+// setConnectionClass puts the client into the given class (or the default limits, if nil).
+// overridden is true if an oper moved them there.
+func (client *Client) setConnectionClass(class *ConnectionClass, reason string, overridden bool) {
+	client.connectionClassMutex.Lock()
+	client.connectionClass = class
+	client.connectionClassReason = reason
+	client.connectionClassOverridden = overridden
+	client.connectionClassMutex.Unlock()
+
+	if class != nil && class.MaxSendQBytes != 0 {
+		client.socket.SetMaxSendQ(class.MaxSendQBytes)
+	} else {
+		client.socket.SetMaxSendQ(client.server.MaxSendQBytes)
+	}
+}
+
+// connectionClassInfo returns the client's connection class, why they're in it, and whether
+// an oper moved them there.
+func (client *Client) connectionClassInfo() (class *ConnectionClass, reason string, overridden bool) {
+	client.connectionClassMutex.RLock()
+	defer client.connectionClassMutex.RUnlock()
+	return client.connectionClass, client.connectionClassReason, client.connectionClassOverridden
+}
+
+// getConnectionClass returns the client's connection class, or nil if they have the default
+// limits.
+func (client *Client) getConnectionClass() *ConnectionClass {
+	client.connectionClassMutex.RLock()
+	defer client.connectionClassMutex.RUnlock()
+	return client.connectionClass
+}
+
+// connectionClassName returns the name of the client's connection class.
+func (client *Client) connectionClassName() string {
+	class := client.getConnectionClass()
+	if class == nil {
+		return "default"
+	}
+	return class.Name
+}
+
+// maxTargets returns how many targets the client can send a PRIVMSG or NOTICE to at once.
+func (client *Client) maxTargets() int {
+	limit := maxTargets
+	if class := client.getConnectionClass(); class != nil && class.MaxTargets != 0 {
+		limit = class.MaxTargets
+	}
+	// bots get whichever limit is higher
+	if client.isBot() && limit < client.server.bots.MaxTargets {
+		limit = client.server.bots.MaxTargets
+	}
+	return limit
+}
+
+// maxMonitorEntries returns how many nicks the client can MONITOR.
+func (client *Client) maxMonitorEntries() int {
+	limit := client.server.limits.MonitorEntries
+	if class := client.getConnectionClass(); class != nil && class.MonitorEntries != 0 {
+		limit = class.MonitorEntries
+	}
+	if client.isBot() && limit < client.server.bots.MonitorEntries {
+		limit = client.server.bots.MonitorEntries
+	}
+	return limit
+}
+
+// updateConnectionClasses moves clients into the (possibly changed) classes after a rehash.
+// Clients that were moved by an oper stay in the class they were moved to, if it still exists.
+func (server *Server) updateConnectionClasses() {
+	server.clients.ByNickMutex.RLock()
+	defer server.clients.ByNickMutex.RUnlock()
+
+	for _, client := range server.clients.ByNick {
+		oldClass, oldReason, overridden := client.connectionClassInfo()
+		if overridden && oldClass != nil {
+			class, exists := server.connectionClasses[oldClass.Name]
+			if exists {
+				client.setConnectionClass(class, oldReason, true)
+				continue
+			}
+		}
+		class, reason := server.matchConnectionClass(client.IP(), client.hasFlag(TLS))
+		client.setConnectionClass(class, reason, false)
+	}
+}
+
+// CLASSINFO <nick>
+func classinfoHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	nickname, err := CasefoldName(msg.Params[0])
+	target := server.clients.Get(nickname)
+	if err != nil || target == nil {
+		rb.Send(nil, server.name, ERR_NOSUCHNICK, client.nick, msg.Params[0], "No such nick")
+		return false
+	}
+
+	class, reason, _ := target.connectionClassInfo()
+	rb.Notice(fmt.Sprintf("%s is in connection class %s (%s)", target.nick, target.connectionClassName(), reason))
+	sendQ := target.socket.MaxSendQ()
+	targets := target.maxTargets()
+	monitorEntries := target.maxMonitorEntries()
+	rb.Notice(fmt.Sprintf("Limits: sendq %s bytes, %d targets, %d monitor entries", strconv.FormatUint(sendQ, 10), targets, monitorEntries))
+	if class != nil && class.TLSOnly {
+		rb.Notice("This class only matches TLS connections")
+	}
+	return false
+}
+
+// SETCLASS <nick> <class>
+func setclassHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	nickname, err := CasefoldName(msg.Params[0])
+	target := server.clients.Get(nickname)
+	if err != nil || target == nil {
+		rb.Send(nil, server.name, ERR_NOSUCHNICK, client.nick, msg.Params[0], "No such nick")
+		return false
+	}
+
+	var class *ConnectionClass
+	if msg.Params[1] != "default" {
+		var exists bool
+		class, exists = server.connectionClasses[msg.Params[1]]
+		if !exists {
+			rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "SETCLASS", msg.Params[1], "No such connection class")
+			return false
+		}
+	}
+
+	oldClassName := target.connectionClassName()
+	target.setConnectionClass(class, fmt.Sprintf("moved by %s from class %s", client.operName, oldClassName), true)
+
+	rb.Notice(fmt.Sprintf("Moved %s from connection class %s to %s", target.nick, oldClassName, target.connectionClassName()))
+	server.logger.Info("opers", fmt.Sprintf("Oper %s [%s] moved %s from connection class %s to %s", client.nick, client.operName, target.nickMaskString, oldClassName, target.connectionClassName()))
+	server.snomasks.Send(sno.LocalOpers, fmt.Sprintf(ircfmt.Unescape("%s$r moved $c[grey][$r%s$c[grey]] from connection class $c[grey][$r%s$c[grey]] to $c[grey][$r%s$c[grey]]"), client.nick, target.nick, oldClassName, target.connectionClassName()))
+	return false
+}
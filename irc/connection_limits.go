@@ -7,12 +7,167 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 )
 
 var (
 	errTooManyClients = errors.New("Too many clients in subnet")
 )
 
+// limitsExceeded is which connection limits a client went over when they connected. They're
+// only let through like this if the limits have exempted accounts or certfps, and only a few
+// of them can be waiting to be checked at once.
+type limitsExceeded struct {
+	connectionLimit bool
+	throttle        bool
+}
+
+// liftExceededLimits stops holding the client to the connection limits they went over when
+// they connected, if they're exempt from them. It's called as soon as we know who they are:
+// after their TLS handshake, when they log in with SASL, and when they register.
+func (server *Server) liftExceededLimits(client *Client) {
+	server.connectionLimitsMutex.Lock()
+	if client.overLimits.connectionLimit && server.connectionLimits.Exempts(client) {
+		server.connectionLimits.RemovePendingClient(client.IP())
+		client.overLimits.connectionLimit = false
+	}
+	server.connectionLimitsMutex.Unlock()
+
+	server.connectionThrottleMutex.Lock()
+	if client.overLimits.throttle && server.connectionThrottle.Exempts(client) {
+		server.connectionThrottle.RemovePendingClient(client.IP())
+		client.overLimits.throttle = false
+	}
+	server.connectionThrottleMutex.Unlock()
+}
+
+// checkExceededLimits is called when a client that went over the connection limits when they
+// connected registers. If they're exempt they're let through, otherwise they're disconnected
+// like they would've been when they connected.
+func (server *Server) checkExceededLimits(client *Client) bool {
+	server.liftExceededLimits(client)
+
+	if client.overLimits.connectionLimit {
+		client.socket.SetFinalData(tooManyClientsBytes)
+		client.quitMessageSent = true
+		client.destroy()
+		return false
+	}
+
+	if client.overLimits.throttle {
+		server.connectionThrottleMutex.Lock()
+		server.banThrottledIP(client.IP())
+		banMessage := string(server.connectionThrottle.BanMessageBytes)
+		server.connectionThrottleMutex.Unlock()
+		client.socket.SetFinalData(banMessage)
+		client.quitMessageSent = true
+		client.destroy()
+		return false
+	}
+	return true
+}
+
+// ipExemptions are the IPs and networks that are exempt from a limit.
+type ipExemptions struct {
+	ips  map[string]bool
+	nets []net.IPNet
+}
+
+// contains returns true if the given address is exempted.
+func (ie *ipExemptions) contains(addr net.IP) bool {
+	if ie.ips[addr.String()] {
+		return true
+	}
+	for _, ex := range ie.nets {
+		if ex.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseExemptions parses a list of exempted IPs and networks. If identities isn't nil,
+// account:<name> and certfp:<fingerprint> entries are allowed too, and added to it.
+func parseExemptions(entries []string, identities *identityExemptions) (ipExemptions, error) {
+	exemptions := ipExemptions{ips: make(map[string]bool)}
+	for _, entry := range entries {
+		if identities != nil {
+			isIdentity, err := identities.add(entry)
+			if err != nil {
+				return exemptions, err
+			} else if isIdentity {
+				continue
+			}
+		}
+		if ipaddr := net.ParseIP(entry); ipaddr != nil {
+			exemptions.ips[ipaddr.String()] = true
+			continue
+		}
+		_, netaddr, err := net.ParseCIDR(entry)
+		if err != nil {
+			return exemptions, fmt.Errorf("Could not parse exempted IP/network [%s]", entry)
+		}
+		exemptions.nets = append(exemptions.nets, *netaddr)
+	}
+	return exemptions, nil
+}
+
+// identityExemptions are the accounts and certfps that are exempt from a limit. Unlike IPs,
+// we only know these once the client's logged in or finished their TLS handshake, so clients
+// that go over the limit are let through and checked again when they register.
+type identityExemptions struct {
+	accounts map[string]bool
+	certfps  map[string]bool
+}
+
+// add adds the given exempted entry if it's an account:<name> or certfp:<fingerprint>,
+// returning false if it's something else (an IP or network).
+func (ie *identityExemptions) add(entry string) (bool, error) {
+	var err error
+	if strings.HasPrefix(entry, "account:") {
+		name := strings.TrimPrefix(entry, "account:")
+		name, err = CasefoldName(name)
+		if err != nil {
+			return true, fmt.Errorf("Could not parse exempted account [%s]", entry)
+		}
+		if ie.accounts == nil {
+			ie.accounts = make(map[string]bool)
+		}
+		ie.accounts[name] = true
+		return true, nil
+	}
+	if strings.HasPrefix(entry, "certfp:") {
+		certfp, err := normalizeCertfp(strings.TrimPrefix(entry, "certfp:"))
+		if err != nil {
+			return true, fmt.Errorf("Could not parse exempted certfp [%s]", entry)
+		}
+		if ie.certfps == nil {
+			ie.certfps = make(map[string]bool)
+		}
+		ie.certfps[certfp] = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// any returns true if any accounts or certfps are exempted.
+func (ie *identityExemptions) any() bool {
+	return 0 < len(ie.accounts) || 0 < len(ie.certfps)
+}
+
+// exempts returns true if the client is logged into an exempted account or is using an
+// exempted certfp.
+func (ie *identityExemptions) exempts(client *Client) bool {
+	if client.certfp != "" && ie.certfps[client.certfp] {
+		return true
+	}
+	if client.account != &NoAccount {
+		accountKey, _ := CasefoldName(client.account.Name)
+		return ie.accounts[accountKey]
+	}
+	return false
+}
+
 // ConnectionLimits manages the automated client connection limits.
 type ConnectionLimits struct {
 	enabled  bool
@@ -23,10 +178,13 @@ type ConnectionLimits struct {
 	// population holds IP -> count of clients connected from there
 	population map[string]int
 
-	// exemptedIPs holds IPs that are exempt from limits
-	exemptedIPs map[string]bool
-	// exemptedNets holds networks that are exempt from limits
-	exemptedNets []net.IPNet
+	// exemptedIPs holds IPs and networks that are exempt from limits
+	exemptedIPs ipExemptions
+	// exemptedIdentities holds accounts and certfps that are exempt from limits
+	exemptedIdentities identityExemptions
+	// pending holds IP -> count of clients that went over the limit, and are waiting to see
+	// if they're exempt. They're also counted in population.
+	pending map[string]int
 }
 
 // maskAddr masks the given IPv4/6 address with our cidr limit masks.
@@ -51,14 +209,9 @@ func (cl *ConnectionLimits) AddClient(addr net.IP, force bool) error {
 
 	// check exempted lists
 	// we don't track populations for exempted addresses or nets - this is by design
-	if cl.exemptedIPs[addr.String()] {
+	if cl.exemptedIPs.contains(addr) {
 		return nil
 	}
-	for _, ex := range cl.exemptedNets {
-		if ex.Contains(addr) {
-			return nil
-		}
-	}
 
 	// check population
 	cl.maskAddr(addr)
@@ -73,6 +226,60 @@ func (cl *ConnectionLimits) AddClient(addr net.IP, force bool) error {
 	return nil
 }
 
+// WouldAllow returns true if a new client from the given address would be allowed, without
+// adding them to our population.
+func (cl *ConnectionLimits) WouldAllow(addr net.IP) bool {
+	if !cl.enabled {
+		return true
+	}
+
+	if cl.exemptedIPs.contains(addr) {
+		return true
+	}
+
+	return cl.population[addr.String()]+1 <= cl.subnetLimit
+}
+
+// ChecksAtRegistration returns true if clients over the limit should be let through, because they might
+// log into an exempted account or use an exempted certfp.
+func (cl *ConnectionLimits) ChecksAtRegistration() bool {
+	return cl.enabled && cl.exemptedIdentities.any()
+}
+
+// AddPendingClient adds a client that went over the limit to our population, to be let
+// through until we know if they're exempt. Only as many of these as the limit allows can be
+// waiting from an address at once, otherwise it returns an error.
+func (cl *ConnectionLimits) AddPendingClient(addr net.IP) error {
+	addrString := addr.String()
+	limit := cl.subnetLimit
+	if limit < 1 {
+		limit = 1
+	}
+	if limit <= cl.pending[addrString] {
+		return errTooManyClients
+	}
+	cl.pending[addrString]++
+	cl.population[addrString]++
+	return nil
+}
+
+// RemovePendingClient stops counting the given address's client as waiting to be checked,
+// once they're found to be exempt or they disconnect. They stay in our population until
+// RemoveClient is called.
+func (cl *ConnectionLimits) RemovePendingClient(addr net.IP) {
+	addrString := addr.String()
+	cl.pending[addrString]--
+	if cl.pending[addrString] <= 0 {
+		delete(cl.pending, addrString)
+	}
+}
+
+// Exempts returns true if the client is logged into an exempted account or is using an
+// exempted certfp.
+func (cl *ConnectionLimits) Exempts(client *Client) bool {
+	return cl.exemptedIdentities.exempts(client)
+}
+
 // RemoveClient removes the given address from our population
 func (cl *ConnectionLimits) RemoveClient(addr net.IP) {
 	if !cl.enabled {
@@ -94,7 +301,7 @@ func NewConnectionLimits(config ConnectionLimitsConfig) (*ConnectionLimits, erro
 	cl.enabled = config.Enabled
 
 	cl.population = make(map[string]int)
-	cl.exemptedIPs = make(map[string]bool)
+	cl.pending = make(map[string]int)
 
 	cl.ipv4Mask = net.CIDRMask(config.CidrLenIPv4, 32)
 	cl.ipv6Mask = net.CIDRMask(config.CidrLenIPv6, 128)
@@ -102,20 +309,11 @@ func NewConnectionLimits(config ConnectionLimitsConfig) (*ConnectionLimits, erro
 	// this is so that CL config can be used to allow ONLY clients from exempted IPs/nets
 	cl.subnetLimit = config.IPsPerCidr
 
-	// assemble exempted nets
-	for _, cidr := range config.Exempted {
-		ipaddr := net.ParseIP(cidr)
-		_, netaddr, err := net.ParseCIDR(cidr)
-
-		if ipaddr == nil && err != nil {
-			return nil, fmt.Errorf("Could not parse exempted IP/network [%s]", cidr)
-		}
-
-		if ipaddr != nil {
-			cl.exemptedIPs[ipaddr.String()] = true
-		} else {
-			cl.exemptedNets = append(cl.exemptedNets, *netaddr)
-		}
+	// assemble exempted nets, accounts and certfps
+	var err error
+	cl.exemptedIPs, err = parseExemptions(config.Exempted, &cl.exemptedIdentities)
+	if err != nil {
+		return nil, err
 	}
 
 	return &cl, nil
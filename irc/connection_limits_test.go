@@ -0,0 +1,135 @@
+// Copyright (c) 2016-2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+var testCertfp = strings.Repeat("ab", 32)
+
+func TestIdentityExemptions(t *testing.T) {
+	var ie identityExemptions
+	for _, c := range []struct {
+		entry      string
+		isIdentity bool
+		valid      bool
+	}{
+		{"account:Alice", true, true},
+		{"certfp:" + strings.ToUpper(testCertfp), true, true},
+		{"certfp:abcd", true, false},
+		{"account:", true, false},
+		{"10.0.0.0/8", false, true},
+		{"127.0.0.1", false, true},
+	} {
+		isIdentity, err := ie.add(c.entry)
+		if isIdentity != c.isIdentity || (err == nil) != c.valid {
+			t.Errorf("%q: expected isIdentity %v and valid %v, got %v and %v", c.entry, c.isIdentity, c.valid, isIdentity, err)
+		}
+	}
+	if !ie.any() {
+		t.Fatal("expected exemptions to have been added")
+	}
+
+	for _, c := range []struct {
+		client *Client
+		exempt bool
+	}{
+		{&Client{account: &ClientAccount{Name: "alice"}}, true},
+		{&Client{account: &ClientAccount{Name: "bob"}}, false},
+		{&Client{account: &NoAccount, certfp: testCertfp}, true},
+		{&Client{account: &NoAccount, certfp: strings.Repeat("cd", 32)}, false},
+		{&Client{account: &NoAccount}, false},
+	} {
+		if exempt := ie.exempts(c.client); exempt != c.exempt {
+			t.Errorf("account %q certfp %q: expected exempt to be %v, got %v", c.client.account.Name, c.client.certfp, c.exempt, exempt)
+		}
+	}
+}
+
+func TestParseExemptions(t *testing.T) {
+	var ie identityExemptions
+	exemptions, err := parseExemptions([]string{"192.0.2.1", "10.0.0.0/8", "2001:db8::/32", "account:alice"}, &ie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ie.accounts["alice"] {
+		t.Error("expected the account to be exempted")
+	}
+	for _, c := range []struct {
+		addr   string
+		exempt bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"10.1.2.3", true},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	} {
+		if exempt := exemptions.contains(net.ParseIP(c.addr)); exempt != c.exempt {
+			t.Errorf("%s: expected exempt to be %v, got %v", c.addr, c.exempt, exempt)
+		}
+	}
+
+	for _, entries := range [][]string{
+		{"not an address"},
+		{"10.0.0.0/33"},
+		{"account:"},
+	} {
+		if _, err := parseExemptions(entries, &ie); err == nil {
+			t.Errorf("%q: expected an error", entries)
+		}
+	}
+	// accounts and certfps are only allowed when we can check them
+	if _, err := parseExemptions([]string{"account:alice"}, nil); err == nil {
+		t.Error("expected an account to be refused without identity exemptions")
+	}
+}
+
+// clients over the limit are let through while there are exempted accounts, but they're
+// counted, and only a few of them can be waiting at once.
+func TestConnectionLimitsPending(t *testing.T) {
+	cl, err := NewConnectionLimits(ConnectionLimitsConfig{
+		Enabled:     true,
+		CidrLenIPv4: 32,
+		CidrLenIPv6: 64,
+		IPsPerCidr:  1,
+		Exempted:    []string{"account:alice"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cl.ChecksAtRegistration() {
+		t.Fatal("expected clients over the limit to be checked at registration")
+	}
+
+	addr := net.ParseIP("192.0.2.1")
+	if err := cl.AddClient(addr, false); err != nil {
+		t.Fatalf("first client was refused: %s", err.Error())
+	}
+	if err := cl.AddClient(addr, false); err != errTooManyClients {
+		t.Fatalf("expected second client to be over the limit, got %v", err)
+	}
+	if err := cl.AddPendingClient(addr); err != nil {
+		t.Fatalf("first pending client was refused: %s", err.Error())
+	}
+	if err := cl.AddPendingClient(addr); err != errTooManyClients {
+		t.Fatalf("expected second pending client to be refused, got %v", err)
+	}
+	if cl.population[addr.String()] != 2 {
+		t.Errorf("expected the pending client to be counted, population is %d", cl.population[addr.String()])
+	}
+
+	// the pending client disconnects
+	cl.RemovePendingClient(addr)
+	cl.RemoveClient(addr)
+	if cl.population[addr.String()] != 1 || cl.pending[addr.String()] != 0 {
+		t.Errorf("expected population 1 and nothing pending, got %d and %d", cl.population[addr.String()], cl.pending[addr.String()])
+	}
+	if err := cl.AddPendingClient(addr); err != nil {
+		t.Errorf("pending client was refused after the last one left: %s", err.Error())
+	}
+}
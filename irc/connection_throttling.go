@@ -9,32 +9,31 @@ import (
 	"time"
 
 	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/ratelimit"
 )
 
-// ThrottleDetails holds the connection-throttling details for a subnet/IP.
-type ThrottleDetails struct {
-	Start       time.Time
-	ClientCount int
-}
-
 // ConnectionThrottle manages automated client connection throttling.
 type ConnectionThrottle struct {
-	enabled     bool
-	ipv4Mask    net.IPMask
-	ipv6Mask    net.IPMask
-	subnetLimit int
-	duration    time.Duration
-	population  map[string]ThrottleDetails
+	enabled    bool
+	ipv4Mask   net.IPMask
+	ipv6Mask   net.IPMask
+	population *ratelimit.Keyed
 
 	// used by the server to ban clients that go over this limit
 	BanDuration     time.Duration
 	BanMessage      string
 	BanMessageBytes []byte
 
-	// exemptedIPs holds IPs that are exempt from limits
-	exemptedIPs map[string]bool
-	// exemptedNets holds networks that are exempt from limits
-	exemptedNets []net.IPNet
+	// exemptedIPs holds IPs and networks that are exempt from limits
+	exemptedIPs ipExemptions
+	// exemptedIdentities holds accounts and certfps that are exempt from limits
+	exemptedIdentities identityExemptions
+	// subnetLimit is how many connections a subnet can make in the duration, which is also
+	// how many clients over the throttle can be waiting to see if they're exempt
+	subnetLimit int
+	// pending holds subnet -> count of clients that went over the throttle, and are waiting
+	// to see if they're exempt
+	pending map[string]int
 }
 
 // maskAddr masks the given IPv4/6 address with our cidr limit masks.
@@ -56,10 +55,7 @@ func (ct *ConnectionThrottle) ResetFor(addr net.IP) {
 		return
 	}
 
-	// remove
-	ct.maskAddr(addr)
-	addrString := addr.String()
-	delete(ct.population, addrString)
+	ct.population.Reset(ct.maskAddr(addr).String())
 }
 
 // AddClient introduces a new client connection if possible. If we can't, throws an error instead.
@@ -69,34 +65,68 @@ func (ct *ConnectionThrottle) AddClient(addr net.IP) error {
 	}
 
 	// check exempted lists
-	if ct.exemptedIPs[addr.String()] {
+	if ct.exemptedIPs.contains(addr) {
 		return nil
 	}
-	for _, ex := range ct.exemptedNets {
-		if ex.Contains(addr) {
-			return nil
-		}
-	}
 
 	// check throttle
-	ct.maskAddr(addr)
-	addrString := addr.String()
-
-	details, exists := ct.population[addrString]
-	if !exists || details.Start.Add(ct.duration).Before(time.Now()) {
-		details = ThrottleDetails{
-			Start: time.Now(),
-		}
+	if !ct.population.Allow(ct.maskAddr(addr).String()) {
+		return errTooManyClients
 	}
 
-	if details.ClientCount+1 > ct.subnetLimit {
+	return nil
+}
+
+// ChecksAtRegistration returns true if clients over the throttle should be let through,
+// because they might log into an exempted account or use an exempted certfp.
+func (ct *ConnectionThrottle) ChecksAtRegistration() bool {
+	return ct.enabled && ct.exemptedIdentities.any()
+}
+
+// Exempts returns true if the client is logged into an exempted account or is using an
+// exempted certfp.
+func (ct *ConnectionThrottle) Exempts(client *Client) bool {
+	return ct.exemptedIdentities.exempts(client)
+}
+
+// AddPendingClient lets through a client that went over the throttle until we know if
+// they're exempt. Only as many of these as the throttle allows can be waiting from a subnet
+// at once, otherwise it returns an error.
+func (ct *ConnectionThrottle) AddPendingClient(addr net.IP) error {
+	key := ct.maskAddr(addr).String()
+	limit := ct.subnetLimit
+	if limit < 1 {
+		limit = 1
+	}
+	if limit <= ct.pending[key] {
 		return errTooManyClients
 	}
+	ct.pending[key]++
+	return nil
+}
 
-	details.ClientCount++
-	ct.population[addrString] = details
+// RemovePendingClient stops counting the given address's client as waiting to be checked,
+// once they're found to be exempt or they disconnect.
+func (ct *ConnectionThrottle) RemovePendingClient(addr net.IP) {
+	key := ct.maskAddr(addr).String()
+	ct.pending[key]--
+	if ct.pending[key] <= 0 {
+		delete(ct.pending, key)
+	}
+}
 
-	return nil
+// WouldAllow returns true if a new connection from the given address would be allowed,
+// without counting it towards the throttle.
+func (ct *ConnectionThrottle) WouldAllow(addr net.IP) bool {
+	if !ct.enabled {
+		return true
+	}
+
+	if ct.exemptedIPs.contains(addr) {
+		return true
+	}
+
+	return ct.population.WouldAllow(ct.maskAddr(addr).String())
 }
 
 // NewConnectionThrottle returns a new client connection throttler.
@@ -104,14 +134,16 @@ func NewConnectionThrottle(config ConnectionThrottleConfig) (*ConnectionThrottle
 	var ct ConnectionThrottle
 	ct.enabled = config.Enabled
 
-	ct.population = make(map[string]ThrottleDetails)
-	ct.exemptedIPs = make(map[string]bool)
+	subnetLimit := config.ConnectionsPerCidr
+	duration := config.Duration
+	ct.subnetLimit = subnetLimit
+	ct.pending = make(map[string]int)
+	ct.population = ratelimit.NewKeyed(func() ratelimit.Limiter {
+		return ratelimit.NewSlidingWindow(subnetLimit, duration)
+	})
 
 	ct.ipv4Mask = net.CIDRMask(config.CidrLenIPv4, 32)
 	ct.ipv6Mask = net.CIDRMask(config.CidrLenIPv6, 128)
-	ct.subnetLimit = config.ConnectionsPerCidr
-
-	ct.duration = config.Duration
 
 	ct.BanDuration = config.BanDuration
 	ct.BanMessage = config.BanMessage
@@ -122,20 +154,10 @@ func NewConnectionThrottle(config ConnectionThrottleConfig) (*ConnectionThrottle
 	}
 	ct.BanMessageBytes = []byte(msg)
 
-	// assemble exempted nets
-	for _, cidr := range config.Exempted {
-		ipaddr := net.ParseIP(cidr)
-		_, netaddr, err := net.ParseCIDR(cidr)
-
-		if ipaddr == nil && err != nil {
-			return nil, fmt.Errorf("Could not parse exempted IP/network [%s]", cidr)
-		}
-
-		if ipaddr != nil {
-			ct.exemptedIPs[ipaddr.String()] = true
-		} else {
-			ct.exemptedNets = append(ct.exemptedNets, *netaddr)
-		}
+	// assemble exempted nets, accounts and certfps
+	ct.exemptedIPs, err = parseExemptions(config.Exempted, &ct.exemptedIdentities)
+	if err != nil {
+		return nil, err
 	}
 
 	return &ct, nil
@@ -0,0 +1,572 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/goshuirc/irc-go/ircmatch"
+	"github.com/oragono/oragono/irc/custime"
+	"github.com/oragono/oragono/irc/sno"
+	"github.com/tidwall/buntdb"
+)
+
+// controlName is who control socket actions are attributed to in logs and snomasks.
+const controlName = "<control socket>"
+
+// ControlProtocolVersion is the version of the control socket protocol that we speak. It's
+// bumped whenever a change could break existing tools.
+const ControlProtocolVersion = 1
+
+var (
+	errControlUnknownCommand = errors.New("Unknown command, try: help")
+	errControlNeedMoreParams = errors.New("Not enough parameters")
+	errControlReadOnly       = errors.New("The server is in read-only mode")
+	errControlVersion        = fmt.Errorf("Unsupported protocol version, this server speaks version %d", ControlProtocolVersion)
+	errNoSuchAccount         = errors.New("Account does not exist")
+)
+
+// ControlSocketConfig controls the local admin socket used by `oragono admin`. Anyone who can
+// open the socket file can run admin commands, so access is controlled with its permissions.
+type ControlSocketConfig struct {
+	Enabled bool
+	Path    string
+}
+
+// ControlRequest is a command sent over the control socket, as a line of JSON.
+type ControlRequest struct {
+	// Version is the protocol version the client speaks, with 0 meaning the current one.
+	Version int      `json:"version,omitempty"`
+	Command string   `json:"command"`
+	Params  []string `json:"params,omitempty"`
+}
+
+// ControlResponse is the reply to a ControlRequest, as a line of JSON.
+type ControlResponse struct {
+	Version int `json:"version"`
+	// Lines are the human-readable result, shown by `oragono admin`.
+	Lines []string `json:"lines,omitempty"`
+	// Data is the machine-readable result, for commands that have one.
+	Data  interface{} `json:"data,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// ControlStatus is the data returned by the status command.
+type ControlStatus struct {
+	Name          string `json:"name"`
+	Network       string `json:"network"`
+	Version       string `json:"version"`
+	Uptime        int64  `json:"uptime"` // in seconds
+	Clients       int    `json:"clients"`
+	MaxClients    int    `json:"max-clients"`
+	Opers         int    `json:"opers"`
+	Channels      int    `json:"channels"`
+	ClientCrashes uint64 `json:"client-crashes"`
+	ReadOnly      bool   `json:"read-only"`
+}
+
+// ControlClient is a client, as returned by the clients command.
+type ControlClient struct {
+	Nick      string    `json:"nick"`
+	Username  string    `json:"username"`
+	Hostname  string    `json:"hostname"`
+	IP        string    `json:"ip"`
+	Account   string    `json:"account,omitempty"`
+	Oper      string    `json:"oper,omitempty"`
+	Channels  int       `json:"channels"`
+	Connected time.Time `json:"connected"`
+}
+
+// ControlBans is the data returned by the kline and dline list commands.
+type ControlBans map[string]IPBanInfo
+
+// controlCommand runs a control socket command, returning the lines to show the admin and
+// optionally some data for tools to use.
+type controlCommand struct {
+	handler   func(server *Server, params []string) (lines []string, data interface{}, err error)
+	minParams int
+	help      string
+}
+
+var controlCommands map[string]controlCommand
+
+func init() {
+	// set up here to avoid an initialization loop with the help command
+	controlCommands = map[string]controlCommand{
+		"help": {
+			handler: controlHelp,
+			help:    "help: show this list",
+		},
+		"rehash": {
+			handler: controlRehash,
+			help:    "rehash: reload the config file",
+		},
+		"status": {
+			handler: controlStatus,
+			help:    "status: show client, channel and oper counts",
+		},
+		"clients": {
+			handler: controlClients,
+			help:    "clients [<mask>]: list the connected clients, or the ones matching the mask",
+		},
+		"kline": {
+			handler:   controlKLine,
+			minParams: 1,
+			help:      "kline add [<duration>] <mask> [<reason>] | kline del <mask> | kline list",
+		},
+		"dline": {
+			handler:   controlDLine,
+			minParams: 1,
+			help:      "dline add [<duration>] <ip/net> [<reason>] | dline del <ip/net> | dline list",
+		},
+		"account": {
+			handler:   controlAccount,
+			minParams: 2,
+			help:      "account info <name> | account resetpass <name>",
+		},
+	}
+	// older name for status
+	controlCommands["stats"] = controlCommands["status"]
+}
+
+// startControlSocket starts listening for admin commands on the control socket.
+func (server *Server) startControlSocket() error {
+	path := server.controlSocket.Path
+	// clean up after a server that didn't shut down properly
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	// the socket's created in a directory only we can get into, and only linked to its real
+	// path once its permissions are set, so no one else can connect to it in between
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".oragono-control")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	tempPath := filepath.Join(dir, "control.sock")
+
+	listener, err := net.Listen("unix", tempPath)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tempPath, 0600)
+	if err == nil {
+		// like listening, this fails if something's already at the path
+		err = os.Link(tempPath, path)
+	}
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	server.controlListener = listener
+	server.controlListenerPath = path
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.handleControlConn(conn)
+		}
+	}()
+	return nil
+}
+
+// stopControlSocket stops listening on the control socket and removes it.
+func (server *Server) stopControlSocket() {
+	if server.controlListener != nil {
+		server.controlListener.Close()
+		// closing only removes the path the socket was created at, not the one it was linked to
+		os.Remove(server.controlListenerPath)
+		server.controlListener = nil
+		server.controlListenerPath = ""
+	}
+}
+
+// handleControlConn runs the commands sent over a control socket connection.
+func (server *Server) handleControlConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	encoder := json.NewEncoder(conn)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			return
+		}
+
+		var request ControlRequest
+		response := ControlResponse{
+			Version: ControlProtocolVersion,
+		}
+		err = json.Unmarshal(line, &request)
+		if err != nil {
+			response.Error = fmt.Sprintf("Could not parse request: %s", err.Error())
+		} else {
+			response.Lines, response.Data, err = server.runControlCommand(request)
+			if err != nil {
+				response.Error = err.Error()
+			}
+		}
+
+		if encoder.Encode(response) != nil {
+			return
+		}
+	}
+}
+
+// runControlCommand runs the given control socket command.
+func (server *Server) runControlCommand(request ControlRequest) ([]string, interface{}, error) {
+	if request.Version != 0 && request.Version != ControlProtocolVersion {
+		return nil, nil, errControlVersion
+	}
+	command, exists := controlCommands[strings.ToLower(request.Command)]
+	if !exists {
+		return nil, nil, errControlUnknownCommand
+	}
+	if len(request.Params) < command.minParams {
+		return nil, nil, errControlNeedMoreParams
+	}
+	server.logger.Debug("control", fmt.Sprintf("Running control command: %s", strings.Join(append([]string{request.Command}, request.Params...), " ")))
+	return command.handler(server, request.Params)
+}
+
+func controlHelp(server *Server, params []string) ([]string, interface{}, error) {
+	var lines []string
+	for name, command := range controlCommands {
+		if name != "stats" {
+			lines = append(lines, command.help)
+		}
+	}
+	sort.Strings(lines)
+	return lines, nil, nil
+}
+
+func controlRehash(server *Server, params []string) ([]string, interface{}, error) {
+	server.logger.Info("rehash", fmt.Sprintf("Rehash started by %s", controlName))
+	err := server.rehash()
+	if err != nil {
+		server.logger.Error("rehash", fmt.Sprintln("Failed to rehash:", err.Error()))
+		return nil, nil, err
+	}
+	server.snomasks.Send(sno.LocalOpers, fmt.Sprintf("%s rehashed the server", controlName))
+	return []string{"Rehashed"}, nil, nil
+}
+
+// operCount returns how many clients are opered up.
+func (server *Server) operCount() int {
+	server.currentOpersMutex.RLock()
+	defer server.currentOpersMutex.RUnlock()
+	return len(server.currentOpers)
+}
+
+func controlStatus(server *Server, params []string) ([]string, interface{}, error) {
+	status := ControlStatus{
+		Name:          server.name,
+		Network:       server.networkName,
+		Version:       SemVer,
+		Uptime:        int64(time.Since(server.ctime).Seconds()),
+		Clients:       server.clients.Count(),
+		Opers:         server.operCount(),
+		Channels:      server.channels.Len(),
+		ClientCrashes: atomic.LoadUint64(&server.clientPanics),
+		ReadOnly:      server.isReadOnly(),
+	}
+	server.maxClientsMutex.Lock()
+	status.MaxClients = server.maxClients.Limit()
+	server.maxClientsMutex.Unlock()
+
+	lines := []string{
+		fmt.Sprintf("Server: %s on %s (Oragono v%s)", status.Name, status.Network, status.Version),
+		fmt.Sprintf("Uptime: %s", time.Duration(status.Uptime)*time.Second),
+		fmt.Sprintf("Clients: %d (limit %d)", status.Clients, status.MaxClients),
+		fmt.Sprintf("Opers online: %d", status.Opers),
+		fmt.Sprintf("Channels: %d", status.Channels),
+		fmt.Sprintf("Client crashes: %d", status.ClientCrashes),
+	}
+	if status.ReadOnly {
+		lines = append(lines, "The server is in read-only mode")
+	}
+	return lines, status, nil
+}
+
+func controlClients(server *Server, params []string) ([]string, interface{}, error) {
+	var matcher *ircmatch.Matcher
+	if 0 < len(params) {
+		mask, err := Casefold(params[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		match := ircmatch.MakeMatch(mask)
+		matcher = &match
+	}
+
+	clients := []ControlClient{}
+	server.clients.ByNickMutex.RLock()
+	for _, client := range server.clients.ByNick {
+		details := client.details()
+		if matcher != nil && !matcher.Match(details.nickMaskCasefolded) {
+			continue
+		}
+		info := ControlClient{
+			Nick:      details.nick,
+			Username:  details.username,
+			Hostname:  details.hostname,
+			IP:        client.IPString(),
+			Channels:  details.channelCount,
+			Account:   details.accountName,
+			Connected: client.ctime,
+		}
+		if client.hasFlag(Operator) {
+			info.Oper = details.operName
+		}
+		clients = append(clients, info)
+	}
+	server.clients.ByNickMutex.RUnlock()
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Nick < clients[j].Nick
+	})
+
+	var lines []string
+	for _, info := range clients {
+		line := fmt.Sprintf("%s!%s@%s [%s] connected %s", info.Nick, info.Username, info.Hostname, info.IP, info.Connected.UTC().Format(time.RFC1123))
+		if info.Account != "" {
+			line += fmt.Sprintf(", account %s", info.Account)
+		}
+		if info.Oper != "" {
+			line += fmt.Sprintf(", oper %s", info.Oper)
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, fmt.Sprintf("%d clients", len(clients)))
+	return lines, clients, nil
+}
+
+// controlBanLines describes the given bans for the admin.
+func controlBanLines(bans map[string]IPBanInfo, kind string) []string {
+	var lines []string
+	for mask, info := range bans {
+		line := fmt.Sprintf("%s: %s", mask, info.OperReason)
+		if info.Time != nil {
+			line += fmt.Sprintf(" (expires %s)", info.Time.Expires.UTC().Format(time.RFC1123))
+		}
+		if info.Observe {
+			line += " (observed)"
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	if len(lines) == 0 {
+		lines = []string{fmt.Sprintf("There are no %ss", kind)}
+	}
+	return lines
+}
+
+// controlBanParams parses the `[<duration>] <mask> [<reason>]` params used when adding bans.
+func controlBanParams(params []string) (mask string, banTime *IPRestrictTime, reason string) {
+	duration, err := custime.ParseDuration(params[0])
+	if err == nil && 1 < len(params) {
+		banTime = &IPRestrictTime{
+			Duration: duration,
+			Expires:  time.Now().Add(duration),
+		}
+		params = params[1:]
+	}
+	reason = "No reason given"
+	if 1 < len(params) {
+		reason = strings.Join(params[1:], " ")
+	}
+	return params[0], banTime, reason
+}
+
+func controlKLine(server *Server, params []string) ([]string, interface{}, error) {
+	switch strings.ToLower(params[0]) {
+	case "list":
+		bans := server.klines.AllBans()
+		return controlBanLines(bans, "K-Line"), ControlBans(bans), nil
+	case "add":
+		if len(params) < 2 {
+			return nil, nil, errControlNeedMoreParams
+		}
+		if server.isReadOnly() {
+			return nil, nil, errControlReadOnly
+		}
+
+		mask, banTime, reason := controlBanParams(params[1:])
+		mask = canonicalizeKLineMask(strings.ToLower(mask))
+		err := server.addKLine(mask, banTime, reason, reason, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		server.logger.Info("opers", fmt.Sprintf("%s added K-Line for %s", controlName, mask))
+		server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("%s$r added K-Line for %s"), controlName, mask))
+		return []string{fmt.Sprintf("Added K-Line for %s", mask)}, nil, nil
+	case "del":
+		if len(params) < 2 {
+			return nil, nil, errControlNeedMoreParams
+		}
+		if server.isReadOnly() {
+			return nil, nil, errControlReadOnly
+		}
+		mask := canonicalizeKLineMask(params[1])
+		err := server.removeKLine(mask)
+		if err != nil {
+			return nil, nil, err
+		}
+		server.logger.Info("opers", fmt.Sprintf("%s removed K-Line for %s", controlName, mask))
+		server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("%s$r removed K-Line for %s"), controlName, mask))
+		return []string{fmt.Sprintf("Removed K-Line for %s", mask)}, nil, nil
+	}
+	return nil, nil, errControlUnknownCommand
+}
+
+func controlDLine(server *Server, params []string) ([]string, interface{}, error) {
+	switch strings.ToLower(params[0]) {
+	case "list":
+		bans := server.dlines.AllBans()
+		return controlBanLines(bans, "D-Line"), ControlBans(bans), nil
+	case "add":
+		if len(params) < 2 {
+			return nil, nil, errControlNeedMoreParams
+		}
+		if server.isReadOnly() {
+			return nil, nil, errControlReadOnly
+		}
+
+		host, banTime, reason := controlBanParams(params[1:])
+		hostAddr, hostNet, hostString, err := parseDLineHost(host)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = server.addDLine(hostAddr, hostNet, hostString, banTime, reason, reason)
+		if err != nil {
+			return nil, nil, err
+		}
+		server.logger.Info("opers", fmt.Sprintf("%s added D-Line for %s", controlName, hostString))
+		server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("%s$r added D-Line for %s"), controlName, hostString))
+		return []string{fmt.Sprintf("Added D-Line for %s", hostString)}, nil, nil
+	case "del":
+		if len(params) < 2 {
+			return nil, nil, errControlNeedMoreParams
+		}
+		if server.isReadOnly() {
+			return nil, nil, errControlReadOnly
+		}
+		hostAddr, hostNet, hostString, err := parseDLineHost(params[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		err = server.removeDLine(hostAddr, hostNet, hostString)
+		if err != nil {
+			return nil, nil, err
+		}
+		server.logger.Info("opers", fmt.Sprintf("%s removed D-Line for %s", controlName, hostString))
+		server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("%s$r removed D-Line for %s"), controlName, hostString))
+		return []string{fmt.Sprintf("Removed D-Line for %s", hostString)}, nil, nil
+	}
+	return nil, nil, errControlUnknownCommand
+}
+
+func controlAccount(server *Server, params []string) ([]string, interface{}, error) {
+	accountKey, err := CasefoldName(params[1])
+	if err != nil {
+		return nil, nil, errNoSuchAccount
+	}
+
+	switch strings.ToLower(params[0]) {
+	case "info":
+		var lines []string
+		err = server.store.View(func(tx *buntdb.Tx) error {
+			_, err := tx.Get(fmt.Sprintf(keyAccountExists, accountKey))
+			if err != nil {
+				return errNoSuchAccount
+			}
+			name, _ := tx.Get(fmt.Sprintf(keyAccountName, accountKey))
+			_, verifiedErr := tx.Get(fmt.Sprintf(keyAccountVerified, accountKey))
+			_, resetErr := tx.Get(fmt.Sprintf(keyAccountPasswordReset, accountKey))
+			lines = append(lines, fmt.Sprintf("Account: %s", name))
+			lines = append(lines, fmt.Sprintf("Verified: %t", verifiedErr == nil))
+			lines = append(lines, fmt.Sprintf("Password reset required: %t", resetErr == nil))
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if account := server.loadAccountByName(accountKey); account != nil {
+			lines = append(lines, fmt.Sprintf("Registered: %s", account.RegisteredAt.UTC().Format(time.RFC1123)))
+			lines = append(lines, fmt.Sprintf("Clients logged in: %d", len(account.getClients())))
+		}
+		return lines, nil, nil
+	case "resetpass":
+		if server.isReadOnly() {
+			return nil, nil, errControlReadOnly
+		}
+		password, err := server.resetAccountPassword(accountKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		server.logger.Info("accounts", fmt.Sprintf("%s reset the password for account %s", controlName, accountKey))
+		return []string{fmt.Sprintf("New password for %s: %s", accountKey, password), "They must set a new password when they next log in"}, nil, nil
+	}
+	return nil, nil, errControlUnknownCommand
+}
+
+// ControlConn is a connection to a running server's control socket.
+type ControlConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// DialControl connects to the control socket at the given path.
+func DialControl(path string) (*ControlConn, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &ControlConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}, nil
+}
+
+// Run sends a command to the server and returns its response.
+func (cc *ControlConn) Run(command string, params []string) (*ControlResponse, error) {
+	err := json.NewEncoder(cc.conn).Encode(ControlRequest{
+		Version: ControlProtocolVersion,
+		Command: command,
+		Params:  params,
+	})
+	if err != nil {
+		return nil, err
+	}
+	line, err := cc.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var response ControlResponse
+	err = json.Unmarshal(line, &response)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// Close closes the connection.
+func (cc *ControlConn) Close() error {
+	return cc.conn.Close()
+}
@@ -0,0 +1,30 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package irc
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockDatastore takes a lock on the datastore at the given path, which is held until the
+// returned file is closed. It returns errDatastoreInUse if something else holds it.
+func lockDatastore(path string) (*os.File, error) {
+	file, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		return nil, errDatastoreInUse
+	} else if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
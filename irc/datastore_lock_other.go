@@ -0,0 +1,17 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package irc
+
+import (
+	"os"
+)
+
+// lockDatastore would lock the datastore, but file locks aren't supported here, so nothing
+// stops two processes from using the datastore at once.
+func lockDatastore(path string) (*os.File, error) {
+	return nil, nil
+}
@@ -10,14 +10,15 @@ import (
 	"runtime"
 	"runtime/debug"
 	"runtime/pprof"
+	"sync/atomic"
 	"time"
 
 	"github.com/goshuirc/irc-go/ircmsg"
 )
 
 // DEBUG GCSTATS/NUMGOROUTINE/etc
-func debugHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
-	if !client.flags[Operator] {
+func debugHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	if !client.hasFlag(Operator) {
 		return false
 	}
 
@@ -29,48 +30,60 @@ func debugHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 		}
 		debug.ReadGCStats(&stats)
 
-		client.Notice(fmt.Sprintf("last GC:     %s", stats.LastGC.Format(time.RFC1123)))
-		client.Notice(fmt.Sprintf("num GC:      %d", stats.NumGC))
-		client.Notice(fmt.Sprintf("pause total: %s", stats.PauseTotal))
-		client.Notice(fmt.Sprintf("pause quantiles min%%: %s", stats.PauseQuantiles[0]))
-		client.Notice(fmt.Sprintf("pause quantiles 25%%:  %s", stats.PauseQuantiles[1]))
-		client.Notice(fmt.Sprintf("pause quantiles 50%%:  %s", stats.PauseQuantiles[2]))
-		client.Notice(fmt.Sprintf("pause quantiles 75%%:  %s", stats.PauseQuantiles[3]))
-		client.Notice(fmt.Sprintf("pause quantiles max%%: %s", stats.PauseQuantiles[4]))
+		rb.Notice(fmt.Sprintf("last GC:     %s", stats.LastGC.Format(time.RFC1123)))
+		rb.Notice(fmt.Sprintf("num GC:      %d", stats.NumGC))
+		rb.Notice(fmt.Sprintf("pause total: %s", stats.PauseTotal))
+		rb.Notice(fmt.Sprintf("pause quantiles min%%: %s", stats.PauseQuantiles[0]))
+		rb.Notice(fmt.Sprintf("pause quantiles 25%%:  %s", stats.PauseQuantiles[1]))
+		rb.Notice(fmt.Sprintf("pause quantiles 50%%:  %s", stats.PauseQuantiles[2]))
+		rb.Notice(fmt.Sprintf("pause quantiles 75%%:  %s", stats.PauseQuantiles[3]))
+		rb.Notice(fmt.Sprintf("pause quantiles max%%: %s", stats.PauseQuantiles[4]))
+
+	case "CRASHES":
+		count := atomic.LoadUint64(&server.clientPanics)
+		rb.Notice(fmt.Sprintf("client crashes: %d", count))
+
+	case "LINESTATS":
+		stats := &server.lineStats
+		rb.Notice(fmt.Sprintf("rejected lines, too long:      %d", atomic.LoadUint64(&stats.TooLong)))
+		rb.Notice(fmt.Sprintf("rejected lines, too many tags: %d", atomic.LoadUint64(&stats.TooManyTags)))
+		rb.Notice(fmt.Sprintf("rejected lines, invalid utf-8: %d", atomic.LoadUint64(&stats.InvalidUTF8)))
+		rb.Notice(fmt.Sprintf("rejected lines, NUL/CR chars:  %d", atomic.LoadUint64(&stats.Injection)))
+		rb.Notice(fmt.Sprintf("rejected lines, malformed:     %d", atomic.LoadUint64(&stats.Malformed)))
 
 	case "NUMGOROUTINE":
 		count := runtime.NumGoroutine()
-		client.Notice(fmt.Sprintf("num goroutines: %d", count))
+		rb.Notice(fmt.Sprintf("num goroutines: %d", count))
 
 	case "PROFILEHEAP":
 		profFile := "ergonomadic.mprof"
 		file, err := os.Create(profFile)
 		if err != nil {
-			client.Notice(fmt.Sprintf("error: %s", err))
+			rb.Notice(fmt.Sprintf("error: %s", err))
 			break
 		}
 		defer file.Close()
 		pprof.Lookup("heap").WriteTo(file, 0)
-		client.Notice(fmt.Sprintf("written to %s", profFile))
+		rb.Notice(fmt.Sprintf("written to %s", profFile))
 
 	case "STARTCPUPROFILE":
 		profFile := "ergonomadic.prof"
 		file, err := os.Create(profFile)
 		if err != nil {
-			client.Notice(fmt.Sprintf("error: %s", err))
+			rb.Notice(fmt.Sprintf("error: %s", err))
 			break
 		}
 		if err := pprof.StartCPUProfile(file); err != nil {
 			defer file.Close()
-			client.Notice(fmt.Sprintf("error: %s", err))
+			rb.Notice(fmt.Sprintf("error: %s", err))
 			break
 		}
 
-		client.Notice(fmt.Sprintf("CPU profile writing to %s", profFile))
+		rb.Notice(fmt.Sprintf("CPU profile writing to %s", profFile))
 
 	case "STOPCPUPROFILE":
 		pprof.StopCPUProfile()
-		client.Notice(fmt.Sprintf("CPU profiling stopped"))
+		rb.Notice(fmt.Sprintf("CPU profiling stopped"))
 	}
 	return false
 }
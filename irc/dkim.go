@@ -0,0 +1,126 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	// dkimSignedHeaders are the headers we sign, if the message has them.
+	dkimSignedHeaders = []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type"}
+
+	dkimWhitespace = regexp.MustCompile(`[ \t]+`)
+)
+
+// DKIMConfig signs outgoing email, so that receiving servers can tell it really came from
+// the sender's domain. The public key needs to be published in DNS at
+// <selector>._domainkey.<domain>.
+type DKIMConfig struct {
+	Domain   string
+	Selector string
+	KeyFile  string `yaml:"key-file"`
+	key      *rsa.PrivateKey
+}
+
+// Enabled returns true if mail should be signed.
+func (conf *DKIMConfig) Enabled() bool {
+	return conf.key != nil
+}
+
+// load reads the signing key.
+func (conf *DKIMConfig) load() error {
+	if conf.KeyFile == "" {
+		return nil
+	}
+	if conf.Domain == "" || conf.Selector == "" {
+		return errors.New("domain and selector must be set")
+	}
+	keyBytes, err := ioutil.ReadFile(conf.KeyFile)
+	if err != nil {
+		return fmt.Errorf("Could not read key-file: %s", err.Error())
+	}
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return errors.New("key-file has no PEM data in it")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, pkcs8Err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if pkcs8Err != nil {
+			return fmt.Errorf("Could not parse key-file: %s", err.Error())
+		}
+		var isRSA bool
+		key, isRSA = parsed.(*rsa.PrivateKey)
+		if !isRSA {
+			return errors.New("key-file must be an RSA key")
+		}
+	}
+	conf.key = key
+	return nil
+}
+
+// dkimRelaxedHeader canonicalizes a header with the relaxed algorithm (RFC 6376 3.4.2).
+func dkimRelaxedHeader(name, value string) string {
+	value = strings.Replace(value, "\r\n", "", -1)
+	value = strings.TrimSpace(dkimWhitespace.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value
+}
+
+// dkimRelaxedBody canonicalizes a body with the relaxed algorithm (RFC 6376 3.4.4).
+func dkimRelaxedBody(body string) string {
+	lines := strings.Split(strings.Replace(body, "\r\n", "\n", -1), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(dkimWhitespace.ReplaceAllString(line, " "), " ")
+	}
+	for 0 < len(lines) && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// sign returns the DKIM-Signature header for a message with the given headers and body.
+func (conf *DKIMConfig) sign(headers [][2]string, body string) (string, error) {
+	bodyHash := sha256.Sum256([]byte(dkimRelaxedBody(body)))
+
+	var signedNames []string
+	var canonical bytes.Buffer
+	for _, name := range dkimSignedHeaders {
+		for _, header := range headers {
+			if strings.EqualFold(header[0], name) {
+				canonical.WriteString(dkimRelaxedHeader(header[0], header[1]))
+				canonical.WriteString("\r\n")
+				signedNames = append(signedNames, strings.ToLower(name))
+				break
+			}
+		}
+	}
+
+	signature := fmt.Sprintf("v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		conf.Domain, conf.Selector, time.Now().Unix(), strings.Join(signedNames, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))
+	canonical.WriteString(dkimRelaxedHeader("DKIM-Signature", signature))
+
+	hash := sha256.Sum256([]byte(canonical.String()))
+	signed, err := rsa.SignPKCS1v15(rand.Reader, conf.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return signature + base64.StdEncoding.EncodeToString(signed), nil
+}
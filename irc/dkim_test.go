@@ -0,0 +1,110 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// the examples from RFC 6376 3.4.5
+func TestDKIMRelaxedCanonicalization(t *testing.T) {
+	for _, c := range []struct {
+		name, value, canonical string
+	}{
+		{"A", " X", "a:X"},
+		{"B ", " Y\t\r\n\tZ  ", "b:Y Z"},
+	} {
+		if canonical := dkimRelaxedHeader(c.name, c.value); canonical != c.canonical {
+			t.Errorf("%q: expected %q, got %q", c.name, c.canonical, canonical)
+		}
+	}
+
+	for _, c := range []struct {
+		body, canonical string
+	}{
+		{" C \r\nD \t E\r\n\r\n\r\n", " C\r\nD E\r\n"},
+		{"no line ending", "no line ending\r\n"},
+		{"\r\n\r\n", ""},
+		{"", ""},
+	} {
+		if canonical := dkimRelaxedBody(c.body); canonical != c.canonical {
+			t.Errorf("%q: expected %q, got %q", c.body, c.canonical, canonical)
+		}
+	}
+}
+
+func TestDKIMSign(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile, err := ioutil.TempFile("", "oragono-dkim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name())
+	pem.Encode(keyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	keyFile.Close()
+
+	conf := DKIMConfig{Domain: "example.com", Selector: "irc", KeyFile: keyFile.Name()}
+	if err := conf.load(); err != nil {
+		t.Fatal(err)
+	}
+	if !conf.Enabled() {
+		t.Fatal("expected signing to be enabled")
+	}
+
+	headers := [][2]string{
+		{"From", "ExampleNet <noreply@example.com>"},
+		{"To", "alice@example.org"},
+		{"X-Unsigned", "not signed"},
+		{"Subject", "Verify  your account"},
+	}
+	body := "Your code is 1234\r\n\r\n"
+	signature, err := conf.sign(headers, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(signature, "; ") {
+		kv := strings.SplitN(tag, "=", 2)
+		tags[kv[0]] = kv[1]
+	}
+	if tags["d"] != "example.com" || tags["s"] != "irc" || tags["h"] != "from:to:subject" {
+		t.Errorf("unexpected signature tags: %q", signature)
+	}
+	bodyHash := sha256.Sum256([]byte("Your code is 1234\r\n"))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bodyHash[:]) {
+		t.Errorf("unexpected body hash %s", tags["bh"])
+	}
+
+	// check it like a receiving server would
+	signed := "from:ExampleNet <noreply@example.com>\r\nto:alice@example.org\r\nsubject:Verify your account\r\n" +
+		dkimRelaxedHeader("DKIM-Signature", strings.TrimSuffix(signature, tags["b"]))
+	hash := sha256.Sum256([]byte(signed))
+	b, _ := base64.StdEncoding.DecodeString(tags["b"])
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], b); err != nil {
+		t.Errorf("signature didn't verify: %s", err.Error())
+	}
+
+	for _, bad := range []DKIMConfig{
+		{KeyFile: keyFile.Name()},
+		{Domain: "example.com", Selector: "irc", KeyFile: keyFile.Name() + ".missing"},
+	} {
+		if err := bad.load(); err == nil {
+			t.Errorf("%+v: expected the config to be refused", bad)
+		}
+	}
+}
@@ -26,7 +26,8 @@ const (
 )
 
 var (
-	errNoExistingBan = errors.New("Ban does not exist")
+	errNoExistingBan    = errors.New("Ban does not exist")
+	errInvalidDLineHost = errors.New("Could not parse IP address or CIDR network")
 )
 
 // IPRestrictTime contains the expiration info about the given IP.
@@ -50,6 +51,8 @@ type IPBanInfo struct {
 	OperReason string `json:"oper_reason"`
 	// Time holds details about the duration, if it exists.
 	Time *IPRestrictTime `json:"time"`
+	// Observe is true for K-Lines that only log and count the clients they match.
+	Observe bool `json:"observe,omitempty"`
 }
 
 // dLineAddr contains the address itself and expiration time for a given network.
@@ -170,10 +173,10 @@ func (dm *DLineManager) CheckIP(addr net.IP) (isBanned bool, info *IPBanInfo) {
 				// ban on network has expired, remove it from our blocked list
 				netsToRemove = append(netsToRemove, netInfo.Network)
 			} else {
-				return true, &addrInfo.Info
+				return true, &netInfo.Info
 			}
 		} else {
-			return true, &addrInfo.Info
+			return true, &netInfo.Info
 		}
 	}
 
@@ -187,10 +190,13 @@ func (dm *DLineManager) CheckIP(addr net.IP) (isBanned bool, info *IPBanInfo) {
 }
 
 // DLINE [ANDKILL] [MYSELF] [duration] <ip>/<net> [ON <server>] [reason [| oper reason]]
-func dlineHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func dlineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	// check oper permissions
 	if !client.class.Capabilities["oper:local_ban"] {
-		client.Send(nil, server.name, ERR_NOPRIVS, client.nick, msg.Command, "Insufficient oper privs")
+		rb.Send(nil, server.name, ERR_NOPRIVS, client.nick, msg.Command, "Insufficient oper privs")
+		return false
+	}
+	if !server.checkWritable(client, msg.Command, rb) {
 		return false
 	}
 
@@ -220,43 +226,31 @@ func dlineHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 
 	// get host
 	if len(msg.Params) < currentArg+1 {
-		client.Send(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, msg.Command, "Not enough parameters")
+		rb.Send(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, msg.Command, "Not enough parameters")
 		return false
 	}
-	hostString := msg.Params[currentArg]
+	hostAddr, hostNet, hostString, err := parseDLineHost(msg.Params[currentArg])
 	currentArg++
-
-	// check host
-	var hostAddr net.IP
-	var hostNet *net.IPNet
-
-	_, hostNet, err = net.ParseCIDR(hostString)
 	if err != nil {
-		hostAddr = net.ParseIP(hostString)
-	}
-
-	if hostAddr == nil && hostNet == nil {
-		client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, "Could not parse IP address or CIDR network")
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, "Could not parse IP address or CIDR network")
 		return false
 	}
 
 	if hostNet == nil {
-		hostString = hostAddr.String()
 		if !dlineMyself && hostAddr.Equal(client.IP()) {
-			client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, "This ban matches you. To DLINE yourself, you must use the command:  /DLINE MYSELF <arguments>")
+			rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, "This ban matches you. To DLINE yourself, you must use the command:  /DLINE MYSELF <arguments>")
 			return false
 		}
 	} else {
-		hostString = hostNet.String()
 		if !dlineMyself && hostNet.Contains(client.IP()) {
-			client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, "This ban matches you. To DLINE yourself, you must use the command:  /DLINE MYSELF <arguments>")
+			rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, "This ban matches you. To DLINE yourself, you must use the command:  /DLINE MYSELF <arguments>")
 			return false
 		}
 	}
 
 	// check remote
 	if len(msg.Params) > currentArg && msg.Params[currentArg] == "ON" {
-		client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, "Remote servers not yet supported")
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, "Remote servers not yet supported")
 		return false
 	}
 
@@ -287,44 +281,18 @@ func dlineHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 		}
 	}
 
-	info := IPBanInfo{
-		Reason:     reason,
-		OperReason: operReason,
-		Time:       banTime,
-	}
-
-	// save in datastore
-	err = server.store.Update(func(tx *buntdb.Tx) error {
-		dlineKey := fmt.Sprintf(keyDlineEntry, hostString)
-
-		// assemble json from ban info
-		b, err := json.Marshal(info)
-		if err != nil {
-			return err
-		}
-
-		tx.Set(dlineKey, string(b), nil)
-
-		return nil
-	})
-
+	err = server.addDLine(hostAddr, hostNet, hostString, banTime, reason, operReason)
 	if err != nil {
-		client.Notice(fmt.Sprintf("Could not successfully save new D-LINE: %s", err.Error()))
+		rb.Notice(fmt.Sprintf("Could not successfully save new D-LINE: %s", err.Error()))
 		return false
 	}
 
-	if hostNet == nil {
-		server.dlines.AddIP(hostAddr, banTime, reason, operReason)
-	} else {
-		server.dlines.AddNetwork(*hostNet, banTime, reason, operReason)
-	}
-
 	var snoDescription string
 	if durationIsUsed {
-		client.Notice(fmt.Sprintf("Added temporary (%s) D-Line for %s", duration.String(), hostString))
+		rb.Notice(fmt.Sprintf("Added temporary (%s) D-Line for %s", duration.String(), hostString))
 		snoDescription = fmt.Sprintf(ircfmt.Unescape("%s$r added temporary (%s) D-Line for %s"), client.nick, duration.String(), hostString)
 	} else {
-		client.Notice(fmt.Sprintf("Added D-Line for %s", hostString))
+		rb.Notice(fmt.Sprintf("Added D-Line for %s", hostString))
 		snoDescription = fmt.Sprintf(ircfmt.Unescape("%s$r added D-Line for %s"), client.nick, hostString)
 	}
 	server.snomasks.Send(sno.LocalXline, snoDescription)
@@ -352,6 +320,9 @@ func dlineHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 
 		for _, mcl := range clientsToKill {
 			mcl.exitedSnomaskSent = true
+			if server.historyRetraction.OnBan {
+				server.retractRecentMessages(mcl, fmt.Sprintf("Banned (%s)", reason))
+			}
 			mcl.Quit(fmt.Sprintf("You have been banned from this server (%s)", reason))
 			if mcl == client {
 				killClient = true
@@ -369,38 +340,86 @@ func dlineHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 	return killClient
 }
 
-func unDLineHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func unDLineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	// check oper permissions
 	if !client.class.Capabilities["oper:local_unban"] {
-		client.Send(nil, server.name, ERR_NOPRIVS, client.nick, msg.Command, "Insufficient oper privs")
+		rb.Send(nil, server.name, ERR_NOPRIVS, client.nick, msg.Command, "Insufficient oper privs")
+		return false
+	}
+	if !server.checkWritable(client, msg.Command, rb) {
 		return false
 	}
 
 	// get host
-	hostString := msg.Params[0]
-
-	// check host
-	var hostAddr net.IP
-	var hostNet *net.IPNet
-
-	_, hostNet, err := net.ParseCIDR(hostString)
+	hostAddr, hostNet, hostString, err := parseDLineHost(msg.Params[0])
 	if err != nil {
-		hostAddr = net.ParseIP(hostString)
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, "Could not parse IP address or CIDR network")
+		return false
 	}
 
-	if hostAddr == nil && hostNet == nil {
-		client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, "Could not parse IP address or CIDR network")
+	err = server.removeDLine(hostAddr, hostNet, hostString)
+	if err != nil {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, fmt.Sprintf("Could not remove ban [%s]", err.Error()))
 		return false
 	}
 
+	rb.Notice(fmt.Sprintf("Removed D-Line for %s", hostString))
+	server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("%s$r removed D-Line for %s"), client.nick, hostString))
+	return false
+}
+
+// parseDLineHost parses the IP address or CIDR network of a D-Line, returning whichever one
+// it is along with its canonical form.
+func parseDLineHost(hostString string) (hostAddr net.IP, hostNet *net.IPNet, canonical string, err error) {
+	_, hostNet, err = net.ParseCIDR(hostString)
+	if err == nil {
+		return nil, hostNet, hostNet.String(), nil
+	}
+	hostAddr = net.ParseIP(hostString)
+	if hostAddr == nil {
+		return nil, nil, "", errInvalidDLineHost
+	}
+	return hostAddr, nil, hostAddr.String(), nil
+}
+
+// addDLine saves a D-Line for the given IP address or network to the datastore and starts
+// enforcing it.
+func (server *Server) addDLine(hostAddr net.IP, hostNet *net.IPNet, hostString string, banTime *IPRestrictTime, reason string, operReason string) error {
+	info := IPBanInfo{
+		Reason:     reason,
+		OperReason: operReason,
+		Time:       banTime,
+	}
+
+	// save in datastore
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		dlineKey := fmt.Sprintf(keyDlineEntry, hostString)
+
+		// assemble json from ban info
+		b, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+
+		tx.Set(dlineKey, string(b), nil)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
 	if hostNet == nil {
-		hostString = hostAddr.String()
+		server.dlines.AddIP(hostAddr, banTime, reason, operReason)
 	} else {
-		hostString = hostNet.String()
+		server.dlines.AddNetwork(*hostNet, banTime, reason, operReason)
 	}
+	return nil
+}
 
-	// save in datastore
-	err = server.store.Update(func(tx *buntdb.Tx) error {
+// removeDLine removes a D-Line from the datastore and stops enforcing it.
+func (server *Server) removeDLine(hostAddr net.IP, hostNet *net.IPNet, hostString string) error {
+	err := server.store.Update(func(tx *buntdb.Tx) error {
 		dlineKey := fmt.Sprintf(keyDlineEntry, hostString)
 
 		// check if it exists or not
@@ -414,10 +433,8 @@ func unDLineHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool
 		tx.Delete(dlineKey)
 		return nil
 	})
-
 	if err != nil {
-		client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, fmt.Sprintf("Could not remove ban [%s]", err.Error()))
-		return false
+		return err
 	}
 
 	if hostNet == nil {
@@ -425,10 +442,7 @@ func unDLineHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool
 	} else {
 		server.dlines.RemoveNetwork(*hostNet)
 	}
-
-	client.Notice(fmt.Sprintf("Removed D-Line for %s", hostString))
-	server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("%s$r removed D-Line for %s"), client.nick, hostString))
-	return false
+	return nil
 }
 
 func (s *Server) loadDLines() {
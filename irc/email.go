@@ -0,0 +1,326 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+const (
+	defaultMailPort = 25
+	mailTimeout     = 30 * time.Second
+
+	defaultVerifyMessageSubject = "Verify your account on {{.NetworkName}}"
+	defaultVerifyMessage        = `Thanks for registering the account {{.Account}} on {{.NetworkName}}.
+
+To finish registering, connect to IRC and run:
+
+/ACC VERIFY {{.Account}} {{.Code}}
+
+This code expires in {{.Expiry}}.`
+
+	defaultResetMessageSubject = "Password reset for {{.Account}}"
+	defaultResetMessage        = `Someone (hopefully you) asked to reset the password for the account {{.Account}} on {{.NetworkName}}.
+
+To set a new password, connect to IRC and run:
+
+/NS RESETPASS {{.Account}} {{.Code}} <new password>
+
+This code expires in {{.Expiry}}. If you didn't ask for this, you can ignore this email.`
+
+	defaultExpiryMessageSubject = "Your account {{.Account}} is about to expire"
+	defaultExpiryMessage        = `The account {{.Account}} on {{.NetworkName}} hasn't been used in a while, and will be dropped in {{.Expiry}}.
+
+To keep it, connect to IRC and log into it.`
+)
+
+var (
+	errMailNotConfigured = errors.New("Email isn't set up on this server")
+	errInvalidEmail      = errors.New("That email address is invalid")
+)
+
+// MailtoConfig is how we send email, for the mailto callback, password resets and account
+// expiry warnings.
+//
+// The messages are Go templates (https://golang.org/pkg/text/template/), which can use
+// {{.NetworkName}}, {{.Account}}, {{.Code}} and {{.Expiry}}. If an HTML message is set, it's
+// sent along with the text one, and clients show whichever they prefer.
+type MailtoConfig struct {
+	Server string
+	Port   int
+	TLS    struct {
+		Enabled            bool
+		InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+		ServerName         string `yaml:"servername"`
+	}
+	Username             string
+	Password             string
+	Sender               string
+	VerifyMessageSubject string `yaml:"verify-message-subject"`
+	VerifyMessage        string `yaml:"verify-message"`
+	VerifyMessageHTML    string `yaml:"verify-message-html"`
+	ResetMessageSubject  string `yaml:"reset-message-subject"`
+	ResetMessage         string `yaml:"reset-message"`
+	ResetMessageHTML     string `yaml:"reset-message-html"`
+	ExpiryMessageSubject string `yaml:"expiry-message-subject"`
+	ExpiryMessage        string `yaml:"expiry-message"`
+	ExpiryMessageHTML    string `yaml:"expiry-message-html"`
+	DKIM                 DKIMConfig
+
+	verifyTemplate *emailTemplate
+	resetTemplate  *emailTemplate
+	expiryTemplate *emailTemplate
+}
+
+// emailTemplate is a parsed email, ready to be filled in.
+type emailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// emailData is what email templates are filled in with.
+type emailData struct {
+	NetworkName string
+	Account     string
+	Code        string
+	Expiry      string
+}
+
+// newEmailTemplate parses an email's templates, using the defaults for the subject and text
+// if they aren't given.
+func newEmailTemplate(name, subject, text, html, defaultSubject, defaultText string) (*emailTemplate, error) {
+	if subject == "" {
+		subject = defaultSubject
+	}
+	if text == "" {
+		text = defaultText
+	}
+	var tmpl emailTemplate
+	var err error
+	tmpl.subject, err = texttemplate.New(name + "-subject").Parse(subject)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.text, err = texttemplate.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if html != "" {
+		tmpl.html, err = htmltemplate.New(name + "-html").Parse(html)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &tmpl, nil
+}
+
+// load parses the message templates and the DKIM key.
+func (conf *MailtoConfig) load() (err error) {
+	conf.verifyTemplate, err = newEmailTemplate("verify-message", conf.VerifyMessageSubject, conf.VerifyMessage, conf.VerifyMessageHTML, defaultVerifyMessageSubject, defaultVerifyMessage)
+	if err != nil {
+		return fmt.Errorf("Could not parse verify message: %s", err.Error())
+	}
+	conf.resetTemplate, err = newEmailTemplate("reset-message", conf.ResetMessageSubject, conf.ResetMessage, conf.ResetMessageHTML, defaultResetMessageSubject, defaultResetMessage)
+	if err != nil {
+		return fmt.Errorf("Could not parse reset message: %s", err.Error())
+	}
+	conf.expiryTemplate, err = newEmailTemplate("expiry-message", conf.ExpiryMessageSubject, conf.ExpiryMessage, conf.ExpiryMessageHTML, defaultExpiryMessageSubject, defaultExpiryMessage)
+	if err != nil {
+		return fmt.Errorf("Could not parse expiry message: %s", err.Error())
+	}
+	err = conf.DKIM.load()
+	if err != nil {
+		return fmt.Errorf("Could not load dkim config: %s", err.Error())
+	}
+	return nil
+}
+
+// Enabled returns true if we know how to send email.
+func (conf *MailtoConfig) Enabled() bool {
+	return conf.Server != "" && conf.Sender != ""
+}
+
+// normalizeEmail checks the given address, returning it without any display name.
+func normalizeEmail(address string) (string, error) {
+	if strings.ContainsAny(address, "\r\n") {
+		return "", errInvalidEmail
+	}
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || !strings.Contains(parsed.Address, "@") {
+		return "", errInvalidEmail
+	}
+	return parsed.Address, nil
+}
+
+// randomMailToken returns a random string for message IDs and MIME boundaries.
+func randomMailToken() string {
+	token := make([]byte, 16)
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+// quotedPrintable encodes a message part, so long lines and non-ASCII text get through.
+func quotedPrintable(text string) string {
+	var buf bytes.Buffer
+	writer := quotedprintable.NewWriter(&buf)
+	writer.Write([]byte(strings.Replace(text, "\n", "\r\n", -1)))
+	writer.Close()
+	return buf.String()
+}
+
+// composeMail fills in the template and returns the whole message, signed if DKIM is set up.
+func (conf *MailtoConfig) composeMail(recipient string, tmpl *emailTemplate, data emailData) ([]byte, error) {
+	var subject, text, html bytes.Buffer
+	err := tmpl.subject.Execute(&subject, data)
+	if err != nil {
+		return nil, err
+	}
+	err = tmpl.text.Execute(&text, data)
+	if err != nil {
+		return nil, err
+	}
+	if tmpl.html != nil {
+		err = tmpl.html.Execute(&html, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	senderDomain := conf.Sender[strings.LastIndex(conf.Sender, "@")+1:]
+	headers := [][2]string{
+		{"From", conf.Sender},
+		{"To", recipient},
+		{"Subject", mime.QEncoding.Encode("utf-8", strings.Replace(subject.String(), "\n", " ", -1))},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@%s>", randomMailToken(), senderDomain)},
+		{"MIME-Version", "1.0"},
+	}
+	var body string
+	if tmpl.html == nil {
+		headers = append(headers, [2]string{"Content-Type", "text/plain; charset=utf-8"}, [2]string{"Content-Transfer-Encoding", "quoted-printable"})
+		body = quotedPrintable(text.String())
+	} else {
+		boundary := randomMailToken()
+		headers = append(headers, [2]string{"Content-Type", fmt.Sprintf("multipart/alternative; boundary=%s", boundary)})
+		body = fmt.Sprintf("--%[1]s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n%[2]s\r\n--%[1]s\r\nContent-Type: text/html; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n%[3]s\r\n--%[1]s--\r\n",
+			boundary, quotedPrintable(text.String()), quotedPrintable(html.String()))
+	}
+
+	if conf.DKIM.Enabled() {
+		signature, err := conf.DKIM.sign(headers, body)
+		if err != nil {
+			return nil, err
+		}
+		headers = append([][2]string{{"DKIM-Signature", signature}}, headers...)
+	}
+
+	var message bytes.Buffer
+	for _, header := range headers {
+		fmt.Fprintf(&message, "%s: %s\r\n", header[0], header[1])
+	}
+	message.WriteString("\r\n")
+	message.WriteString(body)
+	return message.Bytes(), nil
+}
+
+// sendTemplate fills in the template and emails it to the given address.
+func (conf *MailtoConfig) sendTemplate(recipient string, tmpl *emailTemplate, data emailData) error {
+	if !conf.Enabled() {
+		return errMailNotConfigured
+	}
+	message, err := conf.composeMail(recipient, tmpl, data)
+	if err != nil {
+		return err
+	}
+	return conf.sendMail(recipient, message)
+}
+
+// sendMail sends a complete message to the given address.
+func (conf *MailtoConfig) sendMail(recipient string, message []byte) error {
+	port := conf.Port
+	if port == 0 {
+		port = defaultMailPort
+	}
+	addr := net.JoinHostPort(conf.Server, strconv.Itoa(port))
+	tlsConfig := &tls.Config{
+		ServerName:         conf.TLS.ServerName,
+		InsecureSkipVerify: conf.TLS.InsecureSkipVerify,
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = conf.Server
+	}
+
+	dialer := &net.Dialer{Timeout: mailTimeout}
+	var conn net.Conn
+	var err error
+	if conf.TLS.Enabled {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(mailTimeout))
+
+	smtpClient, err := smtp.NewClient(conn, conf.Server)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer smtpClient.Close()
+
+	// use STARTTLS whenever we can, since the message can have secrets in it
+	if !conf.TLS.Enabled {
+		if ok, _ := smtpClient.Extension("STARTTLS"); ok {
+			err = smtpClient.StartTLS(tlsConfig)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if conf.Username != "" {
+		err = smtpClient.Auth(smtp.PlainAuth("", conf.Username, conf.Password, conf.Server))
+		if err != nil {
+			return err
+		}
+	}
+	err = smtpClient.Mail(conf.Sender)
+	if err != nil {
+		return err
+	}
+	err = smtpClient.Rcpt(recipient)
+	if err != nil {
+		return err
+	}
+	writer, err := smtpClient.Data()
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(message)
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	return smtpClient.Quit()
+}
@@ -0,0 +1,246 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/oragono/oragono/irc/sno"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	keyAccountLinks = "account.links %s"
+	keyLinkToken    = "linktoken %s"
+
+	// linkTokenLen is how many random bytes are in a link verification token.
+	linkTokenLen = 16
+)
+
+var (
+	errInvalidLinkService = errors.New("That service can't be linked")
+	errInvalidLinkHandle  = errors.New("That handle is invalid")
+	errInvalidLinkToken   = errors.New("That token is invalid or has expired")
+)
+
+// AccountLinks holds the external identities (like GitHub or Matrix handles) that an
+// account has proven it owns.
+type AccountLinks struct {
+	stateMutex sync.RWMutex
+
+	// Links holds service -> handle.
+	Links map[string]string
+	// Public is true if the links should be shown in WHOIS.
+	Public bool
+}
+
+// pendingLink is an external identity waiting for an IRC account to claim it.
+type pendingLink struct {
+	Service string
+	Handle  string
+}
+
+// List returns the account's links, formatted like "service:handle" and sorted.
+func (al *AccountLinks) List() []string {
+	al.stateMutex.RLock()
+	defer al.stateMutex.RUnlock()
+
+	var links []string
+	for service, handle := range al.Links {
+		links = append(links, fmt.Sprintf("%s:%s", service, handle))
+	}
+	sort.Strings(links)
+	return links
+}
+
+// IsPublic returns true if the links should be shown in WHOIS.
+func (al *AccountLinks) IsPublic() bool {
+	al.stateMutex.RLock()
+	defer al.stateMutex.RUnlock()
+	return al.Public
+}
+
+// loadAccountLinks loads an account's external links from the store.
+func loadAccountLinks(tx *buntdb.Tx, accountKey string) *AccountLinks {
+	links := &AccountLinks{}
+	linksString, err := tx.Get(fmt.Sprintf(keyAccountLinks, accountKey))
+	if err == nil {
+		json.Unmarshal([]byte(linksString), links)
+	}
+	if links.Links == nil {
+		links.Links = make(map[string]string)
+	}
+	return links
+}
+
+// saveAccountLinks saves the account's external links to the store.
+func (server *Server) saveAccountLinks(account *ClientAccount) error {
+	account.Links.stateMutex.RLock()
+	linksBytes, err := json.Marshal(account.Links)
+	account.Links.stateMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	accountKey, _ := CasefoldName(account.Name)
+	return server.store.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(fmt.Sprintf(keyAccountLinks, accountKey), string(linksBytes), nil)
+		return err
+	})
+}
+
+// createLinkToken creates a token that lets an IRC account claim the given external identity.
+// The caller is trusted to have already verified that the user owns that identity.
+func (server *Server) createLinkToken(service string, handle string) (string, error) {
+	config := server.externalLinks
+	service = strings.ToLower(service)
+	if !config.Enabled || !config.ServiceIsEnabled(service) {
+		return "", errInvalidLinkService
+	}
+	if len(handle) < 1 || 100 < len(handle) || strings.ContainsAny(handle, " \r\n") {
+		return "", errInvalidLinkHandle
+	}
+
+	tokenBytes := make([]byte, linkTokenLen)
+	_, err := rand.Read(tokenBytes)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	pendingBytes, err := json.Marshal(pendingLink{
+		Service: service,
+		Handle:  handle,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = server.store.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(fmt.Sprintf(keyLinkToken, token), string(pendingBytes), &buntdb.SetOptions{Expires: true, TTL: config.TokenLifetime})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// claimLinkToken uses up the given token, returning the identity it was created for.
+func (server *Server) claimLinkToken(token string) (*pendingLink, error) {
+	var pending pendingLink
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		pendingString, err := tx.Delete(fmt.Sprintf(keyLinkToken, token))
+		if err != nil {
+			return errInvalidLinkToken
+		}
+		return json.Unmarshal([]byte(pendingString), &pending)
+	})
+	if err != nil {
+		return nil, errInvalidLinkToken
+	}
+	return &pending, nil
+}
+
+// nickservLinks handles the NickServ LINK, UNLINK and LINKS subcommands.
+func (server *Server) nickservLinks(client *Client, command string, params []string, rb *ResponseBuffer) {
+	if !server.externalLinks.Enabled {
+		rb.NickServNotice("Linking external accounts is disabled")
+		return
+	}
+	if client.account == &NoAccount {
+		rb.NickServNotice("You must be logged into an account to link external accounts")
+		return
+	}
+	if (command == "link" || command == "unlink" || 0 < len(params)) && !server.checkWritable(client, "NICKSERV", rb) {
+		return
+	}
+	account := client.account
+
+	if command == "link" {
+		if len(params) < 1 {
+			rb.NickServNotice("Syntax: LINK <token>")
+			return
+		}
+		pending, err := server.claimLinkToken(params[0])
+		if err != nil {
+			rb.NickServNotice(err.Error())
+			return
+		}
+
+		account.Links.stateMutex.Lock()
+		account.Links.Links[pending.Service] = pending.Handle
+		account.Links.stateMutex.Unlock()
+
+		err = server.saveAccountLinks(account)
+		if err != nil {
+			rb.NickServNotice("Could not save your linked accounts")
+			server.logger.Error("internal", fmt.Sprintf("Could not save links for account %s: %s", account.Name, err.Error()))
+			return
+		}
+		rb.NickServNotice(fmt.Sprintf("Your account is now linked to %s:%s", pending.Service, pending.Handle))
+		server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Account $c[grey][$r%s$c[grey]] linked to $c[grey][$r%s:%s$c[grey]]"), account.Name, pending.Service, pending.Handle))
+	} else if command == "unlink" {
+		if len(params) < 1 {
+			rb.NickServNotice("Syntax: UNLINK <service>")
+			return
+		}
+		service := strings.ToLower(params[0])
+
+		account.Links.stateMutex.Lock()
+		_, exists := account.Links.Links[service]
+		delete(account.Links.Links, service)
+		account.Links.stateMutex.Unlock()
+
+		if !exists {
+			rb.NickServNotice(fmt.Sprintf("Your account isn't linked to %s", service))
+			return
+		}
+		err := server.saveAccountLinks(account)
+		if err != nil {
+			rb.NickServNotice("Could not save your linked accounts")
+			return
+		}
+		rb.NickServNotice(fmt.Sprintf("Your account is no longer linked to %s", service))
+	} else if command == "links" {
+		if 0 < len(params) {
+			setting := strings.ToLower(params[0])
+			if setting != "public" && setting != "private" {
+				rb.NickServNotice("Syntax: LINKS [PUBLIC|PRIVATE]")
+				return
+			}
+
+			account.Links.stateMutex.Lock()
+			account.Links.Public = setting == "public"
+			account.Links.stateMutex.Unlock()
+
+			err := server.saveAccountLinks(account)
+			if err != nil {
+				rb.NickServNotice("Could not save your linked accounts")
+				return
+			}
+			if setting == "public" {
+				rb.NickServNotice("Your linked accounts are now shown in WHOIS")
+			} else {
+				rb.NickServNotice("Your linked accounts are no longer shown in WHOIS")
+			}
+			return
+		}
+
+		links := account.Links.List()
+		if len(links) == 0 {
+			rb.NickServNotice("Your account isn't linked to any external accounts")
+			return
+		}
+		rb.NickServNotice(fmt.Sprintf("Your account is linked to: %s", strings.Join(links, ", ")))
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+// Feature is part of the server that can be turned on or off in the config.
+type Feature struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	// Source is where the current state comes from: the config key that sets it, or that
+	// key followed by (default) if it's not in the config file.
+	Source string `json:"source"`
+	// Changed is true if the last rehash turned the feature on or off.
+	Changed bool `json:"changed,omitempty"`
+}
+
+// configFeatures are the features we report, and the config keys that control them.
+var configFeatures = []struct {
+	name    string
+	key     string
+	enabled func(config *Config) bool
+}{
+	{"account-registration", "accounts.registration.enabled", func(c *Config) bool { return c.Accounts.Registration.Enabled }},
+	{"sasl-plain", "accounts.authentication-enabled", func(c *Config) bool { return c.Accounts.AuthenticationEnabled }},
+	{"sasl-external", "accounts.authentication-enabled", func(c *Config) bool { return c.Accounts.AuthenticationEnabled }},
+	{"sasl-scram-sha-256", "accounts.authentication-enabled", func(c *Config) bool { return c.Accounts.AuthenticationEnabled }},
+	{"ldap", "accounts.ldap.enabled", func(c *Config) bool { return c.Accounts.LDAP.Enabled }},
+	{"oauth2", "accounts.oauth2.enabled", func(c *Config) bool { return c.Accounts.OAuth2.Enabled }},
+	{"nick-enforcement", "accounts.nick-enforcement.enabled", func(c *Config) bool { return c.Accounts.NickEnforcement.Enabled }},
+	{"password-reset", "accounts.password-reset.enabled", func(c *Config) bool { return c.Accounts.PasswordReset.Enabled }},
+	{"account-expiry", "accounts.expiry.enabled", func(c *Config) bool { return c.Accounts.Expiry.Enabled }},
+	{"missed-highlights", "accounts.missed-highlights.enabled", func(c *Config) bool { return c.Accounts.MissedHighlights.Enabled }},
+	{"external-links", "accounts.external-links.enabled", func(c *Config) bool { return c.Accounts.ExternalLinks.Enabled }},
+	{"vhost-requests", "accounts.vhosts.user-requests", func(c *Config) bool { return c.Accounts.VHosts.UserRequests }},
+	{"channel-registration", "channels.registration.enabled", func(c *Config) bool { return c.Channels.Registration.Enabled }},
+	{"mode-coalescing", "channels.mode-coalescing.enabled", func(c *Config) bool { return c.Channels.ModeCoalescing.Enabled }},
+	{"history", "history.enabled", func(c *Config) bool { return c.History.Enabled }},
+	{"history-cold-storage", "history.cold-storage.enabled", func(c *Config) bool { return c.History.ColdStorage.Enabled }},
+	{"history-direct-messages", "history.direct-messages.enabled", func(c *Config) bool { return c.History.DirectMessages.Enabled }},
+	{"sts", "server.sts.enabled", func(c *Config) bool { return c.Server.STS.Enabled }},
+	{"websockets", "server.ws-listen", func(c *Config) bool { return c.Server.Wslisten != "" }},
+	{"ident", "server.check-ident", func(c *Config) bool { return c.Server.CheckIdent }},
+	{"utf8only", "server.utf8only.enabled", func(c *Config) bool { return c.Server.UTF8Only.Enabled }},
+	{"paste-detection", "server.paste-detection.enabled", func(c *Config) bool { return c.Server.PasteDetection.Enabled }},
+	{"max-clients", "server.max-clients.enabled", func(c *Config) bool { return c.Server.MaxClients.Enabled }},
+	{"connection-limits", "server.connection-limits.enabled", func(c *Config) bool { return c.Server.ConnectionLimits.Enabled }},
+	{"connection-throttling", "server.connection-throttling.enabled", func(c *Config) bool { return c.Server.ConnectionThrottle.Enabled }},
+	{"command-fakelag", "server.rate-limits.commands.enabled", func(c *Config) bool { return c.Server.RateLimits.Commands.Enabled }},
+	{"rest-api", "server.rest-api.enabled", func(c *Config) bool { return c.Server.RestAPI.Enabled }},
+	{"api-keys", "server.rest-api.api-keys.enabled", func(c *Config) bool { return c.Server.RestAPI.APIKeys.Enabled }},
+	{"message-gateway", "server.rest-api.message-gateway.enabled", func(c *Config) bool { return c.Server.RestAPI.MessageGateway.Enabled }},
+	{"control-socket", "server.control-socket.enabled", func(c *Config) bool { return c.Server.ControlSocket.Enabled }},
+	{"mail-gateway", "server.mail-gateway.enabled", func(c *Config) bool { return c.Server.MailGateway.Enabled }},
+	{"snapshots", "datastore.snapshots.enabled", func(c *Config) bool { return c.Datastore.Snapshots.Enabled }},
+	{"read-only", "datastore.read-only", func(c *Config) bool { return c.Datastore.ReadOnly }},
+}
+
+// rawConfigHasKey returns true if the dotted key is set in the raw config.
+func rawConfigHasKey(raw interface{}, key string) bool {
+	for _, name := range strings.Split(key, ".") {
+		values, ok := raw.(map[interface{}]interface{})
+		if !ok {
+			return false
+		}
+		raw, ok = values[name]
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// loadFeatures returns the state of each feature in the given config.
+func loadFeatures(raw interface{}, config *Config) []Feature {
+	features := make([]Feature, len(configFeatures))
+	for i, feature := range configFeatures {
+		features[i] = Feature{
+			Name:    feature.name,
+			Enabled: feature.enabled(config),
+			Source:  feature.key,
+		}
+		if !rawConfigHasKey(raw, feature.key) {
+			features[i].Source += " (default)"
+		}
+	}
+	return features
+}
+
+// markChangedFeatures sets Changed on the features that were turned on or off since the old ones.
+func markChangedFeatures(old, features []Feature) {
+	enabled := make(map[string]bool)
+	for _, feature := range old {
+		enabled[feature.Name] = feature.Enabled
+	}
+	for i, feature := range features {
+		wasEnabled, exists := enabled[feature.Name]
+		features[i].Changed = exists && wasEnabled != feature.Enabled
+	}
+}
+
+// Features returns the current state of each feature.
+func (server *Server) Features() []Feature {
+	server.rehashMutex.Lock()
+	features := make([]Feature, len(server.features))
+	copy(features, server.features)
+	server.rehashMutex.Unlock()
+
+	// opers can change this one without a rehash
+	readOnly := server.isReadOnly()
+	for i, feature := range features {
+		if feature.Name == "read-only" && feature.Enabled != readOnly {
+			features[i].Enabled = readOnly
+			features[i].Source = "READONLY command"
+		}
+	}
+	return features
+}
+
+// FEATURES [<name>]
+func featuresHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	var name string
+	if 0 < len(msg.Params) {
+		name = strings.ToLower(msg.Params[0])
+	}
+
+	var found bool
+	for _, feature := range server.Features() {
+		if name != "" && feature.Name != name {
+			continue
+		}
+		found = true
+		state := "off"
+		if feature.Enabled {
+			state = "on"
+		}
+		line := fmt.Sprintf("%s: %s, from %s", feature.Name, state, feature.Source)
+		if feature.Changed {
+			line += ", changed by the last rehash"
+		}
+		rb.Notice(line)
+	}
+	if !found {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "FEATURES", msg.Params[0], "No such feature")
+	}
+	return false
+}
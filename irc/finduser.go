@@ -0,0 +1,121 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/goshuirc/irc-go/ircmatch"
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+const (
+	// findUserDefaultResults is how many clients FINDUSER shows if the oper doesn't say.
+	findUserDefaultResults = 20
+	// findUserMaxResults is the most clients FINDUSER will ever show at once.
+	findUserMaxResults = 200
+)
+
+// findUserMatcher returns a function that says whether a client matches the given FINDUSER
+// search. Patterns without wildcards match any part of the field.
+func findUserMatcher(field, pattern string) (func(client *Client) bool, error) {
+	if field == "ip" {
+		if ipaddr := net.ParseIP(pattern); ipaddr != nil {
+			return func(client *Client) bool {
+				return ipaddr.Equal(client.IP())
+			}, nil
+		}
+		_, network, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse IP address or network [%s]", pattern)
+		}
+		return func(client *Client) bool {
+			ipaddr := client.IP()
+			return ipaddr != nil && network.Contains(ipaddr)
+		}, nil
+	}
+
+	// a pattern without wildcards matches anywhere, so partial searches work
+	pattern = strings.ToLower(pattern)
+	if !strings.ContainsAny(pattern, "*?") {
+		pattern = "*" + pattern + "*"
+	}
+	matcher := ircmatch.MakeMatch(pattern)
+	matches := func(value string) bool {
+		return value != "" && matcher.Match(strings.ToLower(value))
+	}
+
+	switch field {
+	case "nick":
+		return func(client *Client) bool { return matches(client.nick) }, nil
+	case "user", "ident":
+		return func(client *Client) bool { return matches(client.username) }, nil
+	case "realname":
+		return func(client *Client) bool { return matches(client.realname) }, nil
+	case "host":
+		return func(client *Client) bool { return matches(client.rawHostname) || matches(client.hostname) }, nil
+	case "account":
+		return func(client *Client) bool { return client.account != &NoAccount && matches(client.account.Name) }, nil
+	case "certfp":
+		return func(client *Client) bool { return matches(client.certfp) }, nil
+	}
+	return nil, fmt.Errorf("Unknown field %s, it must be one of NICK USER REALNAME HOST IP ACCOUNT CERTFP", strings.ToUpper(field))
+}
+
+// FINDUSER <field> <pattern> [<max results>]
+func finduserHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	matcher, err := findUserMatcher(strings.ToLower(msg.Params[0]), msg.Params[1])
+	if err != nil {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "FINDUSER", err.Error())
+		return false
+	}
+
+	maxResults := findUserDefaultResults
+	if 2 < len(msg.Params) {
+		maxResults, err = strconv.Atoi(msg.Params[2])
+		if err != nil || maxResults < 1 {
+			rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "FINDUSER", msg.Params[2], "Max results must be a positive number")
+			return false
+		}
+		if findUserMaxResults < maxResults {
+			maxResults = findUserMaxResults
+		}
+	}
+
+	var found []*Client
+	server.clients.ByNickMutex.RLock()
+	for _, target := range server.clients.ByNick {
+		if target.registered && matcher(target) {
+			found = append(found, target)
+		}
+	}
+	server.clients.ByNickMutex.RUnlock()
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].nickCasefolded < found[j].nickCasefolded
+	})
+
+	for i, target := range found {
+		if i == maxResults {
+			break
+		}
+		details := fmt.Sprintf("%s [%s]", target.nickMaskString, target.IPString())
+		if target.account != &NoAccount {
+			details += fmt.Sprintf(" account:%s", target.account.Name)
+		}
+		if target.certfp != "" {
+			details += fmt.Sprintf(" certfp:%s", target.certfp)
+		}
+		rb.Notice(fmt.Sprintf("%s :%s", details, target.realname))
+	}
+	if len(found) <= maxResults {
+		rb.Notice(fmt.Sprintf("End of FINDUSER, %d clients matched", len(found)))
+	} else {
+		rb.Notice(fmt.Sprintf("End of FINDUSER, showed %d of the %d clients that matched", maxResults, len(found)))
+	}
+	return false
+}
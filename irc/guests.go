@@ -0,0 +1,98 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+// GuestListenerConfig turns a listener into a view-only one, for things like letting people
+// watch a conference channel live without registering. Clients on the listener are joined to
+// the given channels, and can't speak or join other channels.
+type GuestListenerConfig struct {
+	Enabled  bool
+	Channels []string
+}
+
+var (
+	// guestCommands are the commands that guests can use. Everything else is refused, so
+	// new commands don't accidentally let guests speak.
+	guestCommands = map[string]bool{
+		"CAP":      true,
+		"HELP":     true,
+		"HELPOP":   true,
+		"HISTORY":  true,
+		"ISON":     true,
+		"LIST":     true,
+		"LUSERS":   true,
+		"MOTD":     true,
+		"NAMES":    true,
+		"PART":     true,
+		"PASS":     true,
+		"PING":     true,
+		"PONG":     true,
+		"QUIT":     true,
+		"TIME":     true,
+		"USER":     true,
+		"USERHOST": true,
+		"VERSION":  true,
+		"WHO":      true,
+		"WHOIS":    true,
+		"WHOWAS":   true,
+	}
+)
+
+// isGuest returns true if the client connected on a guest listener.
+func (client *Client) isGuest() bool {
+	return client.listenerConfig != nil && client.listenerConfig.Guest.Enabled
+}
+
+// guestAllowed returns true if the guest can use the given command.
+func guestAllowed(client *Client, msg ircmsg.IrcMessage) bool {
+	command := strings.ToUpper(msg.Command)
+	switch command {
+	case "NICK":
+		// they need a nickname to register, but changing it afterwards is a way to speak
+		return !client.registered
+	case "TOPIC":
+		// they can see the topic, but not change it
+		return len(msg.Params) < 2
+	case "MODE":
+		// same with modes
+		return len(msg.Params) < 2
+	}
+	return guestCommands[command]
+}
+
+// guestReason returns the PART or QUIT reason to show for the client, which is dropped for
+// guests since it would let them speak.
+func (client *Client) guestReason(reason string) string {
+	if client.isGuest() {
+		return ""
+	}
+	return reason
+}
+
+// joinGuestChannels joins a newly-registered guest to their listener's channels. Channels that
+// don't exist are skipped, so that guests never end up as channel operators.
+func (server *Server) joinGuestChannels(client *Client) {
+	server.channelJoinPartMutex.Lock()
+	defer server.channelJoinPartMutex.Unlock()
+
+	for _, name := range client.listenerConfig.Guest.Channels {
+		casefoldedName, err := CasefoldChannel(name)
+		if err != nil {
+			continue
+		}
+		channel := server.channels.Get(casefoldedName)
+		if channel == nil {
+			server.logger.Debug("join", fmt.Sprintf("Not joining guest %s to %s, since it doesn't exist", client.nick, name))
+			continue
+		}
+		channel.Join(client, "", NewResponseBuffer(client))
+	}
+}
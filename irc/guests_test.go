@@ -0,0 +1,57 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+func TestGuestAllowed(t *testing.T) {
+	cases := []struct {
+		line       string
+		registered bool
+		allowed    bool
+	}{
+		{"NICK guest", false, true},
+		{"NICK other", true, false},
+		{"USER u 0 * :real name", false, true},
+		{"TOPIC #chan", true, true},
+		{"TOPIC #chan :new topic", true, false},
+		{"MODE #chan", true, true},
+		{"MODE #chan +m", true, false},
+		{"PART #chan :bye", true, true},
+		{"QUIT :bye", true, true},
+		{"WHOIS someone", true, true},
+		{"PRIVMSG #chan :hi", true, false},
+		{"NOTICE #chan :hi", true, false},
+		{"TAGMSG #chan", true, false},
+		{"JOIN #other", true, false},
+		{"AWAY :away", true, false},
+	}
+	for _, c := range cases {
+		msg, err := ircmsg.ParseLine(c.line)
+		if err != nil {
+			t.Fatalf("couldn't parse %q: %s", c.line, err.Error())
+		}
+		client := &Client{registered: c.registered}
+		if allowed := guestAllowed(client, msg); allowed != c.allowed {
+			t.Errorf("%q (registered: %v): expected allowed to be %v, got %v", c.line, c.registered, c.allowed, allowed)
+		}
+	}
+}
+
+func TestGuestReason(t *testing.T) {
+	guest := &Client{listenerConfig: &ListenerConfig{}}
+	guest.listenerConfig.Guest.Enabled = true
+	if reason := guest.guestReason("come visit my site"); reason != "" {
+		t.Errorf("expected a guest's reason to be dropped, got %q", reason)
+	}
+
+	client := &Client{}
+	if reason := client.guestReason("bye"); reason != "bye" {
+		t.Errorf("expected a normal client's reason to be kept, got %q", reason)
+	}
+}
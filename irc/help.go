@@ -39,6 +39,8 @@ Oragono supports the following channel modes:
 
   +b  |  Client masks that are banned from the channel (e.g. *!*@127.0.0.1)
   +e  |  Client masks that are exempted from bans.
+  +F  |  Paste threshold, in the form <lines>:<seconds>. Clients sending more
+      |  lines than this in the given time are slowed down or cut off.
   +I  |  Client masks that are exempted from the invite-only flag.
   +i  |  Invite-only mode, only invited clients can join the channel.
   +k  |  Key required when joining the channel.
@@ -49,6 +51,10 @@ Oragono supports the following channel modes:
   +r  |  Only registered users can talk in the channel.
   +s  |  Secret mode, channel won't show up in /LIST or whois replies.
   +t  |  Only channel opers can modify the topic.
+  +T  |  Typing notifications aren't relayed to the channel.
+  +W  |  Slow mode, members must wait the given number of seconds between
+      |  messages (voiced members and above are exempt).
+  +z  |  Secure-only mode, only clients connected with TLS can join.
 
 = Prefixes =
 
@@ -62,9 +68,11 @@ Oragono supports the following channel modes:
 Oragono supports the following user modes:
 
   +a  |  User is marked as being away. This mode is set with the /AWAY command.
+  +g  |  Caller ID, only users on your accept list can message you (see /HELP ACCEPT).
   +i  |  User is marked as invisible (their channels are hidden from whois replies).
   +o  |  User is an IRC operator.
   +s  |  Server Notice Masks (see help with /HELPOP snomasks).
+  +S  |  Only clients connected via TLS can send you private messages.
   +Z  |  User is connected via TLS.`
 	snomaskHelpText = `== Server Notice Masks ==
 
@@ -74,6 +82,7 @@ Oragono supports the following server notice masks for operators:
   c  |  Local client connections.
   j  |  Local channel actions.
   k  |  Local kills.
+  l  |  Local clones (lots of clients from the same subnet).
   n  |  Local nick changes.
   o  |  Local oper actions.
   q  |  Local quits.
@@ -99,6 +108,29 @@ ACC VERIFY <accountname> <auth_code>
 
 Used in account registration. See the relevant specs for more info:
 http://oragono.io/specs.html`,
+	},
+	"accountstatus": {
+		text: `ACCOUNTSTATUS <nickname>{,<nickname>}
+
+Shows the account each of the given users is logged into, and whether they own
+their nick, in a form that's easy for bots to read. Each user gets a reply of:
+
+    <nickname> <account> <status>
+
+where <account> is * if they aren't logged in, and <status> is one of:
+
+    identified  logged into the account that owns their nick
+    loggedin    logged in, but their nick isn't owned by their account
+    registered  not logged in, and their nick is owned by an account
+    none        not logged in, and their nick isn't registered`,
+	},
+	"accept": {
+		text: `ACCEPT <nick>{,<nick>}
+
+Manages your accept list, the users that can message you while you have the
+caller ID mode (+g) set. Prefix a nick with - to remove it from the list, and
+use ACCEPT * to view the list. If you're logged into an account, your accept
+list is shared between all your connections.`,
 	},
 	"ambiance": {
 		text: `AMBIANCE <target> <text to be sent>
@@ -110,12 +142,29 @@ The AMBIANCE command is used to send a scene notification to the given target.`,
 
 Used during SASL authentication. See the IRCv3 specs for more info:
 http://ircv3.net/specs/extensions/sasl-3.1.html`,
+	},
+	"bandwidth": {
+		oper: true,
+		text: `BANDWIDTH [<count>]
+
+Shows how much data the server has sent and received, along with the users
+who have sent (top talkers) and been sent the most, and the channels that
+have relayed the most message data to their members. Up to 10 of each are
+listed unless you ask for more.`,
 	},
 	"away": {
 		text: `AWAY [message]
 
 If [message] is sent, marks you away. If [message] is not sent, marks you no
 longer away.`,
+	},
+	"batch": {
+		text: `BATCH {+,-}<reference> [<type> [<params>...]]
+
+Sends a batch of lines. Clients that have negotiated the draft/multiline
+capability can send a message of several lines as a draft/multiline batch,
+which is relayed all at once to clients that support it, and as separate
+lines to clients that don't.`,
 	},
 	"cap": {
 		text: `CAP <subcommand> [:<capabilities>]
@@ -123,16 +172,79 @@ longer away.`,
 Used in capability negotiation. See the IRCv3 specs for more info:
 http://ircv3.net/specs/core/capability-negotiation-3.1.html
 http://ircv3.net/specs/core/capability-negotiation-3.2.html`,
+	},
+	"challenge": {
+		text: `CHALLENGE <name>
+CHALLENGE +<response>
+
+Logs in as an IRC operator without sending a password. The server replies with
+a challenge encrypted with the oper's public key, and you reply with the
+response from a tool like ratbox-respond, which needs the matching private key.`,
 	},
 	"chanserv": {
 		text: `CHANSERV <subcommand> [params]
 
-ChanServ controls channel registrations.`,
+ChanServ controls channel registrations. The subcommands are:
+
+    REGISTER <channel>
+Registers the given channel to your account. The server may limit how many
+channels you can own, and how many you can register in an hour or a day.
+
+    OP <channel> [<nick>]
+    DEOP <channel> [<nick>]
+Ops or deops you (or the given nick) on a registered channel. You need to be on
+the channel's access list as an operator or above.
+
+    AMODE <channel> [{+|-}<mode> <account>]
+Lists or changes the channel's access list, the modes accounts get when they
+join. <mode> can be a, o, h or v. The founder can give out any of these, and
+admins can give out the ones below admin.
+
+    TRANSFER <channel> <account>
+Gives the channel to another account. Only the founder can do this.
+
+    INFO <channel>
+Shows who founded a registered channel and when.
+
+    SUCCESSOR <channel> [<account>|NONE]
+Sets the account that takes over a registered channel if your account is
+dropped or expires. Without one, the channel goes to whoever's highest on its
+access list, and it's unregistered if there's no one.
+
+    TOPICHISTORY <channel>
+Lists the topics recently set on a registered channel, who set them and when.
+
+    WORDFILTER <channel> <ADD|DEL|LIST> [<word> [<action>]]
+Manages the words filtered from a registered channel's messages. <action> is
+what happens when someone says the word, and can be one of "replace", "block"
+(the default), "kick" or "ban". "observe" lets messages through and only counts
+them, so you can see what a filter would catch before enforcing it. LIST shows
+how many messages each filter has matched.
+
+    URLPOLICY <channel> [SET <policy> | ALLOW <domain> | DISALLOW <domain>]
+Views or changes who can post links in a registered channel. <policy> can be
+"off" (the default), "unregistered" (users must be logged in), "voice" (users
+must be voiced) or "allowlist" (only links to allowed domains). Links to
+allowed domains can always be posted.
+
+    WEBHOOK <channel> [SET <url> | EVENTS <event> [<event>...] | SECRET | OFF]
+Posts what happens in a registered channel to a URL, as JSON. <event> can be
+"message", "join", "part" or "topic", new webhooks get everything except
+messages. Each post is signed with a secret that's shown when the webhook is set
+and can be changed with SECRET, using HMAC-SHA256 in the X-Oragono-Signature
+header. Only the founder can do this.`,
+	},
+	"classinfo": {
+		oper: true,
+		text: `CLASSINFO <nickname>
+
+Shows which connection class the given user is in, why they're in it, and the
+limits it gives them.`,
 	},
 	"cs": {
 		text: `CS <subcommand> [params]
 
-ChanServ controls channel registrations.`,
+ChanServ controls channel registrations. See the help for "CHANSERV".`,
 	},
 	"debug": {
 		oper: true,
@@ -140,7 +252,9 @@ ChanServ controls channel registrations.`,
 
 Prints debug information about the IRCd. <option> can be one of:
 
+* CRASHES: Number of client connections killed by internal errors.
 * GCSTATS: Garbage control statistics.
+* LINESTATS: Number of malformed lines we've rejected from clients.
 * NUMGOROUTINE: Number of goroutines in use.
 * STARTCPUPROFILE: Starts the CPU profiler.
 * STOPCPUPROFILE: Stops the CPU profiler.
@@ -172,6 +286,38 @@ from. If "MYSELF" is not given, trying to DLINE yourself will result in an error
 ON <server> specifies that the ban is to be set on that specific server.
 
 [reason] and [oper reason], if they exist, are separated by a vertical bar (|).`,
+	},
+	"dmhistory": {
+		text: `DMHISTORY <ON|OFF|WIPE|STATUS>
+
+Controls whether the private messages you send and receive are stored on the
+server, so you can replay them later with HISTORY <nick> (for instance, from
+another device). This is scoped to your account, and is off by default.
+
+* ON: Start storing your private messages.
+* OFF: Stop storing your private messages, and remove the stored ones.
+* WIPE: Remove your stored private messages.
+* STATUS: Shows whether your private messages are being stored.`,
+	},
+
+	"finduser": {
+		oper: true,
+		text: `FINDUSER <field> <pattern> [<max results>]
+
+Searches the connected users, showing their full details. <field> is one of
+NICK, USER, REALNAME, HOST, ACCOUNT or CERTFP, which take a pattern like
+*bot* (a pattern without wildcards matches any part of the field), or IP,
+which takes an IP address or CIDR network like 192.0.2.0/24.
+
+Up to 20 users are shown unless you ask for more, and never more than 200.`,
+	},
+	"features": {
+		oper: true,
+		text: `FEATURES [feature]
+
+Shows whether each of the server's optional features is on or off, the config
+key that controls it (or "(default)" when the key isn't in the config file),
+and whether the last REHASH turned it on or off.`,
 	},
 	"help": {
 		text: `HELP <argument>
@@ -182,12 +328,82 @@ Get an explanation of <argument>, or "index" for a list of help topics.`,
 		text: `HELPOP <argument>
 
 Get an explanation of <argument>, or "index" for a list of help topics.`,
+	},
+	"history": {
+		text: `HISTORY <target> [<limit>]
+
+Replays the most recent messages sent to the given channel (up to <limit>
+messages, or 20 if not given). You must be on the channel to see its history.
+If you have the message-tags capability, reactions are replayed as well.
+
+If <target> is a nickname, replays your private messages with that user. This
+only works if you're storing your private messages (see DMHISTORY).`,
+	},
+	"highlight": {
+		text: `HIGHLIGHT [{+|-}<keyword>]
+
+Manages your highlight keywords, the words that are treated as mentions of you.
+With no parameters, lists your keywords. If you're logged into an account, your
+keywords are shared between all your connections.`,
+	},
+	"hostserv": {
+		text: `HOSTSERV <subcommand> [params]
+
+HostServ lets you choose a vhost for your account. Subcommands:
+
+OFFERLIST        - Lists the vhosts you can take.
+TAKE <number>    - Takes the given vhost from the offer list.
+OFF              - Removes your vhost.
+REQUEST <vhost>  - Asks the opers for the given vhost.
+
+Cloak group managers can also use:
+
+ASSIGN <account> <vhost>   - Gives an account a vhost in a group you manage.
+UNASSIGN <account>         - Removes an account's vhost from a group you manage.
+GROUP LIST                 - Lists the cloak groups you manage.
+
+Opers with the "vhosts" capability can manage cloak groups (like project/foo/*):
+
+GROUP CREATE <namespace>              - Creates a cloak group.
+GROUP DROP <namespace>                - Removes a cloak group.
+GROUP ADDMANAGER <namespace> <account> - Lets an account assign cloaks in the group.
+GROUP DELMANAGER <namespace> <account> - Stops an account assigning cloaks in the group.
+
+They can also review vhost requests and set anyone's vhost:
+
+WAITING                      - Lists the vhost requests waiting for approval.
+APPROVE <account>            - Gives an account the vhost it requested.
+REJECT <account> [<reason>]  - Rejects an account's vhost request.
+SET <account> <vhost>        - Sets an account's vhost.
+DEL <account>                - Removes an account's vhost.
+
+You must be logged into an account to use HostServ.`,
+	},
+	"hs": {
+		text: `HS <subcommand> [params]
+
+HostServ lets you choose a vhost for your account. See HOSTSERV for details.`,
 	},
 	"invite": {
 		text: `INVITE <nickname> <channel>
 
 Invites the given user to the given channel, so long as you have the
-appropriate channel privs.`,
+appropriate channel privs. Invites to invite-only (+i) channels expire after a
+while, and are used up when the user joins.`,
+	},
+	"invitetoken": {
+		text: `INVITETOKEN <channel> [CREATE [<uses>] [<lifetime>] | LIST | INFO <token> | REVOKE <token>]
+
+Manages the invite tokens for a channel you're an operator on. Anyone can join
+the channel with a token using JOIN <channel> <token>, even if it's invite-only
+(+i) or has a key (+k). Bans still apply.
+
+CREATE makes a new token. By default tokens can be used once and expire after a
+day, but you can give the number of uses (0 for unlimited) and a lifetime like
+2h30m (0 to never expire).
+
+LIST shows the channel's tokens, INFO shows who used a token and when, and
+REVOKE stops a token from working. Tokens don't survive a server restart.`,
 	},
 	"ison": {
 		text: `ISON <nickname>{ <nickname>}
@@ -214,7 +430,7 @@ supplied.`,
 	},
 	"kline": {
 		oper: true,
-		text: `KLINE [ANDKILL] [MYSELF] [duration] <mask> [ON <server>] [reason [| oper reason]]
+		text: `KLINE [ANDKILL] [MYSELF] [OBSERVE] [duration] <mask> [ON <server>] [reason [| oper reason]]
 
 Bans a mask from connecting to the server. If the duration is given then only for that
 long. The reason is shown to the user themselves, but everyone else will see a standard
@@ -227,6 +443,10 @@ Bans are saved across subsequent launches of the server.
 "MYSELF" is required when the KLINE matches the address the person applying it is connected
 from. If "MYSELF" is not given, trying to KLINE yourself will result in an error.
 
+"OBSERVE" adds the ban without enforcing it. Clients it matches are logged and
+counted instead, see RULEREPORT. Setting the KLINE again without "OBSERVE"
+enforces it.
+
 [duration] can be of the following forms:
 	1y 12mo 31d 10h 8m 13s
 
@@ -237,6 +457,12 @@ from. If "MYSELF" is not given, trying to KLINE yourself will result in an error
 ON <server> specifies that the ban is to be set on that specific server.
 
 [reason] and [oper reason], if they exist, are separated by a vertical bar (|).`,
+	},
+	"links": {
+		text: `LINKS [[<remote server>] <server mask>]
+
+Lists the servers on the network that match the given mask. Depending on the
+server's config, this may only be available to opers.`,
 	},
 	"list": {
 		text: `LIST [<channel>{,<channel>}] [<elistcond>{,<elistcond>}]
@@ -251,6 +477,19 @@ channels). <elistcond>s modify how the channels are selected.`,
 Shows statistics about the size of the network. If <mask> is given, only
 returns stats for servers matching the given mask.  If <server> is given, the
 command is processed by that server.`,
+	},
+	"map": {
+		text: `MAP
+
+Shows a map of the servers on the network. Depending on the server's config,
+this may only be available to opers.`,
+	},
+	"mentions": {
+		text: `MENTIONS [<limit>|CLEAR]
+
+Shows the highlights of your nick or keywords (see HIGHLIGHT) that happened
+while all of your clients were away, up to <limit> (or 20 if not given). CLEAR
+removes them.`,
 	},
 	"mode": {
 		text: `MODE <target> [<modestring> [<mode arguments>...]]
@@ -299,7 +538,50 @@ Sets your nickname to the new given one.`,
 	"nickserv": {
 		text: `NICKSERV <subcommand> [params]
 
-NickServ controls accounts and user registrations.`,
+NickServ controls accounts and user registrations. Subcommands:
+
+REGISTER <password>       - Registers an account named after your current nickname,
+                            and logs you into it.
+IDENTIFY [<account>] <password>
+                          - Logs you into an account. Defaults to your nickname.
+LOGOUT                    - Logs you out of your account.
+DROP [<password>]         - Deletes the account you're logged into.
+INFO [<account>]          - Shows information about an account.
+GHOST <nickname>          - Disconnects someone using your account or its nickname.
+REGAIN [<nickname>]       - Takes back one of your account's nicknames from whoever's
+                            using it, renaming them (or disconnecting them if
+                            they're logged into your account).
+GROUP                     - Groups your current nickname with your account, so it's
+                            protected and can be used to log in.
+UNGROUP [<nickname>]      - Removes a grouped nickname from your account.
+LINK <token>              - Links your account to an external identity, using a
+                            token from a service like your project's website.
+UNLINK <service>          - Removes the link to the given service.
+LINKS [PUBLIC|PRIVATE]    - Lists your links, or sets whether they're shown in WHOIS.
+SET PASSWORD <password>   - Changes your account's password.
+SET EMAIL <address|OFF>   - Sets the address that password reset codes are sent to.
+SENDPASS <account>        - Emails a password reset code to the account's address.
+RESETPASS <account> <code> <password>
+                          - Sets a new password using a code from SENDPASS.
+SET ENFORCE <ON|OFF|DEFAULT>
+                          - Sets whether other people are stopped from using your
+                            account's nickname.
+GET [<setting>]           - Shows your account's settings.
+SET <setting> <value|DEFAULT>
+                          - Changes one of your account's settings: LANGUAGE,
+                            AUTOREPLAY-LINES (lines of history sent when you join
+                            a channel) or PRIVATE-INFO (hides your details from
+                            INFO).
+CERT LIST                 - Lists the certificate fingerprints on your account.
+CERT ADD [<fingerprint>]  - Lets the given certificate log into your account with
+                            SASL EXTERNAL. Defaults to the one you're using now.
+CERT DEL <fingerprint>    - Removes a certificate fingerprint from your account.
+APIKEY LIST               - Lists your account's API keys.
+APIKEY ADD <name> [<scopes>]
+                          - Makes an API key that bots can use with the REST API to
+                            act as your account. Scopes are a comma-separated list
+                            of message, history and settings, and default to all.
+APIKEY DEL <name>         - Deletes an API key.`,
 	},
 	"notice": {
 		text: `NOTICE <target>{,<target>} <text to be sent>
@@ -326,9 +608,10 @@ Requires the roleplay mode (+E) to be set on the target.`,
 NickServ controls accounts and user registrations.`,
 	},
 	"oper": {
-		text: `OPER <name> <password>
+		text: `OPER <name> [<password>]
 
-If the correct details are given, gives you IRCop privs.`,
+If the correct details are given, gives you IRCop privs. If the oper is tied to
+an account and you're logged into it, you don't need to give a password.`,
 	},
 	"part": {
 		text: `PART <channel>{,<channel>} [reason]
@@ -382,6 +665,44 @@ opers. For more specific information on mode characters, see the help for
 		text: `SCENE <target> <text to be sent>
 
 The SCENE command is used to send a scene notification to the given target.`,
+	},
+	"setbot": {
+		oper: true,
+		text: `SETBOT <account> <ON|OFF>
+
+Marks the given account as a bot, or removes the mark. Clients logged into bot
+accounts get higher target and MONITOR limits, can skip paste detection, and
+can use RELAYMSG.`,
+	},
+	"setclass": {
+		oper: true,
+		text: `SETCLASS <nickname> <class>
+
+Moves the given user into another connection class (or "default"), changing
+their limits straight away. This is logged, and the user stays in the class
+until they disconnect.`,
+	},
+	"silence": {
+		text: `SILENCE [{+|-}<mask>{,{+|-}<mask>}]
+
+Manages your silence list, the users whose messages you don't want to receive.
+With no parameters, lists the masks you're silencing. If you're logged into an
+account, your silence list is shared between all your connections.`,
+	},
+	"starttls": {
+		text: `STARTTLS
+
+Upgrades your connection to TLS, on plaintext ports that allow it. This can only
+be used before you've registered.`,
+	},
+	"suspend": {
+		oper: true,
+		text: `SUSPEND <account> [<reason>]
+
+Suspends the given account. Clients logged into it are logged out, no one can
+log into it, its nicknames are no longer protected, and the channels it founded
+are locked until it's unsuspended. The reason is shown to opers in NickServ
+INFO.`,
 	},
 	"tagmsg": {
 		text: `@+client-only-tags TAGMSG <target>{,<target>}
@@ -393,12 +714,36 @@ specs for more info: http://ircv3.net/specs/core/message-tags-3.3.html`,
 		text: `QUIT [reason]
 
 Indicates that you're leaving the server, and shows everyone the given reason.`,
+	},
+	"relaymsg": {
+		text: `RELAYMSG <channel> <nick> <message>
+
+Sends a message to the channel as if it came from the given nick, for bots that
+relay messages from other networks. The nick has to contain one of the network's
+relay separators (usually "/"). Only bots and opers can use this command.`,
+	},
+	"readonly": {
+		oper: true,
+		text: `READONLY [ON [<reason>]|OFF]
+
+Turns read-only maintenance mode on or off, or shows whether it's on. While the
+server is read-only, clients can still connect and chat, but anything that would
+be saved to the datastore (like account registrations and settings changes) is
+refused.`,
 	},
 	"rehash": {
 		oper: true,
 		text: `REHASH
 
 Reloads the config file and updates TLS certificates on listeners`,
+	},
+	"rulereport": {
+		oper: true,
+		text: `RULEREPORT
+
+Shows the observed K-Lines and word filters, which only count what they match,
+along with how many clients and messages they've matched and how many connected
+clients each K-Line would ban now.`,
 	},
 	"time": {
 		text: `TIME [server]
@@ -430,6 +775,12 @@ Removes an existing ban on a mask.
 For example:
 	dan
 	dan!5*@127.*`,
+	},
+	"unsuspend": {
+		oper: true,
+		text: `UNSUSPEND <account>
+
+Lifts the suspension from the given account.`,
 	},
 	"user": {
 		text: `USER <username> 0 * <realname>
@@ -448,14 +799,33 @@ Shows information about the given users. Takes up to 10 nicknames.`,
 Views the version of software and the RPL_ISUPPORT tokens for the given server.`,
 	},
 	"who": {
-		text: `WHO <name> [o]
+		text: `WHO <name> [<flags>]
 
-Returns information for the given user.`,
+Returns information for the given user.
+
+Opers can give these flags to search for users in other ways:
+
+o - Only shows opers. WHO * o lists every oper.
+a - <name> is an account, and every client logged into it is shown.
+i - <name> is an IP address or CIDR, like 10.0.0.0/8, and every client
+    connecting from it is shown.`,
 	},
 	"whois": {
 		text: `WHOIS <client>{,<client>}
 
 Returns information for the given user(s).`,
+	},
+	"whoischannels": {
+		text: `WHOISCHANNELS [ALL|SHARED|NONE|DEFAULT]
+
+Controls which of your channels are shown when other users WHOIS you. If you're
+logged into an account, this is saved to your account. With no parameters,
+shows your current setting. Opers can always see all of your channels.
+
+* ALL: Show all of your channels, apart from secret ones.
+* SHARED: Only show the channels you share with whoever's asking.
+* NONE: Don't show any of your channels.
+* DEFAULT: Use the server's default setting.`,
 	},
 	"whowas": {
 		text: `WHOWAS <nickname>
@@ -575,7 +945,7 @@ Information:
 }
 
 // sendHelp sends the client help of the given string.
-func (client *Client) sendHelp(name string, text string) {
+func (client *Client) sendHelp(name string, text string, rb *ResponseBuffer) {
 	splitName := strings.Split(name, " ")
 	textLines := strings.Split(text, "\n")
 
@@ -583,45 +953,45 @@ func (client *Client) sendHelp(name string, text string) {
 		args := splitName
 		args = append(args, line)
 		if i == 0 {
-			client.Send(nil, client.server.name, RPL_HELPSTART, args...)
+			rb.Send(nil, client.server.name, RPL_HELPSTART, args...)
 		} else {
-			client.Send(nil, client.server.name, RPL_HELPTXT, args...)
+			rb.Send(nil, client.server.name, RPL_HELPTXT, args...)
 		}
 	}
 	args := splitName
 	args = append(args, "End of /HELPOP")
-	client.Send(nil, client.server.name, RPL_ENDOFHELP, args...)
+	rb.Send(nil, client.server.name, RPL_ENDOFHELP, args...)
 }
 
 // helpHandler returns the appropriate help for the given query.
-func helpHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func helpHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	argument := strings.ToLower(strings.TrimSpace(strings.Join(msg.Params, " ")))
 
 	if len(argument) < 1 {
 		client.sendHelp("HELPOP", `HELPOP <argument>
 
-Get an explanation of <argument>, or "index" for a list of help topics.`)
+Get an explanation of <argument>, or "index" for a list of help topics.`, rb)
 		return false
 	}
 
 	// handle index
 	if argument == "index" {
-		if client.flags[Operator] {
-			client.sendHelp("HELP", HelpIndexOpers)
+		if client.hasFlag(Operator) {
+			client.sendHelp("HELP", HelpIndexOpers, rb)
 		} else {
-			client.sendHelp("HELP", HelpIndex)
+			client.sendHelp("HELP", HelpIndex, rb)
 		}
 		return false
 	}
 
 	helpHandler, exists := Help[argument]
 
-	if exists && (!helpHandler.oper || (helpHandler.oper && client.flags[Operator])) {
-		client.sendHelp(strings.ToUpper(argument), helpHandler.text)
+	if exists && (!helpHandler.oper || (helpHandler.oper && client.hasFlag(Operator))) {
+		client.sendHelp(strings.ToUpper(argument), helpHandler.text, rb)
 	} else {
 		args := msg.Params
 		args = append(args, "Help not found")
-		client.Send(nil, server.name, ERR_HELPNOTFOUND, args...)
+		rb.Send(nil, server.name, ERR_HELPNOTFOUND, args...)
 	}
 
 	return false
@@ -0,0 +1,144 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/history"
+)
+
+// containsWord returns true if the given (lowercase) word appears in the message as a
+// whole word, ignoring case.
+func containsWord(message string, word string) bool {
+	message = strings.ToLower(message)
+	for offset := 0; offset < len(message); {
+		index := strings.Index(message[offset:], word)
+		if index == -1 {
+			return false
+		}
+		start := offset + index
+		end := start + len(word)
+
+		before, _ := utf8.DecodeLastRuneInString(message[:start])
+		after, _ := utf8.DecodeRuneInString(message[end:])
+		if (start == 0 || !isWordRune(before)) && (end == len(message) || !isWordRune(after)) {
+			return true
+		}
+		offset = start + 1
+	}
+	return false
+}
+
+// isWordRune returns true if the given rune can be part of a word.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_'
+}
+
+// isDetached returns true if every client logged into the account is away, so they
+// won't see highlights as they happen.
+func (account *ClientAccount) isDetached() bool {
+	for _, client := range account.getClients() {
+		if !client.hasFlag(Away) {
+			return false
+		}
+	}
+	return true
+}
+
+// recordMissedHighlights checks a message sent to the channel against its members'
+// highlight keywords, and stores it for any of them whose accounts are detached.
+func (channel *Channel) recordMissedHighlights(client *Client, msgid string, clientOnlyTags *map[string]ircmsg.TagValue, message string) {
+	if !client.server.missedHighlights.Enabled {
+		return
+	}
+
+	channel.membersMutex.RLock()
+	defer channel.membersMutex.RUnlock()
+
+	var item *history.Item
+	recorded := make(map[*ClientAccount]bool)
+	for member := range channel.members {
+		account := member.account
+		if member == client || account == &NoAccount || account.MissedHighlights == nil || recorded[account] {
+			continue
+		}
+		if !account.isDetached() || member.ignores.IsSilenced(client.nickMaskCasefolded) {
+			continue
+		}
+
+		highlighted := containsWord(message, member.nickCasefolded)
+		if !highlighted {
+			for _, word := range member.ignores.HighlightWords() {
+				if containsWord(message, word) {
+					highlighted = true
+					break
+				}
+			}
+		}
+		if !highlighted {
+			continue
+		}
+
+		if item == nil {
+			newItem := client.historyItem(history.Privmsg, msgid, clientOnlyTags, message)
+			newItem.Target = channel.name
+			item = &newItem
+		}
+		account.MissedHighlights.Add(*item)
+		recorded[account] = true
+	}
+}
+
+// sendMissedHighlightsStatus tells the client if they have any missed highlights waiting.
+func (client *Client) sendMissedHighlightsStatus(rb *ResponseBuffer) {
+	if client.account == &NoAccount || client.account.MissedHighlights == nil {
+		return
+	}
+
+	count := client.account.MissedHighlights.Len()
+	if 0 < count {
+		rb.Notice(fmt.Sprintf("You were highlighted %d times while you were away, use MENTIONS to see them", count))
+	}
+}
+
+// MENTIONS [<limit>|CLEAR]
+func mentionsHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	if client.account == &NoAccount || client.account.MissedHighlights == nil {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "MENTIONS", "Missed highlights are not being stored for you")
+		return false
+	}
+	highlights := client.account.MissedHighlights
+
+	limit := defaultHistoryReplay
+	if 0 < len(msg.Params) {
+		if strings.ToUpper(msg.Params[0]) == "CLEAR" {
+			highlights.Clear()
+			rb.Notice("Your missed highlights have been cleared")
+			return false
+		}
+
+		var err error
+		limit, err = strconv.Atoi(msg.Params[0])
+		if err != nil || limit < 1 {
+			rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "MENTIONS", "Invalid limit")
+			return false
+		}
+	}
+
+	items := highlights.Latest(limit)
+	if len(items) == 0 {
+		rb.Notice("You have no missed highlights")
+		return false
+	}
+	for _, item := range items {
+		client.replayHistoryItems(item.Target, []history.Item{item}, rb)
+	}
+	return false
+}
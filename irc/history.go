@@ -0,0 +1,434 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/history"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	// defaultHistoryReplay is how many lines HISTORY returns if a limit isn't given.
+	defaultHistoryReplay = 20
+	// maxHistoryReplay is the most lines HISTORY will return at once.
+	maxHistoryReplay = 100
+
+	// replyTag contains the msgid of the message being replied or reacted to.
+	replyTag = "+draft/reply"
+	// reactTag contains a reaction to the message given in the reply tag.
+	reactTag = "+draft/react"
+
+	// keyAccountDMHistoryItems holds the private messages an account has stored, as JSON.
+	keyAccountDMHistoryItems = "account.dmhistory.items %s"
+)
+
+// historyItem returns a history item for a message sent by this client.
+func (client *Client) historyItem(itemType history.ItemType, msgid string, clientOnlyTags *map[string]ircmsg.TagValue, message string) history.Item {
+	item := history.Item{
+		Type:     itemType,
+		Time:     messageTime(msgid),
+		Nickmask: client.nickMaskString,
+		Message:  message,
+		Msgid:    msgid,
+	}
+	if client.account != &NoAccount {
+		item.AccountName = client.account.Name
+	}
+	if clientOnlyTags != nil {
+		item.Tags = make(map[string]string)
+		for name, value := range *clientOnlyTags {
+			item.Tags[name] = value.Value
+		}
+	}
+	return item
+}
+
+// validateReferenceTags checks the reply and reaction tags in the given client-only tags
+// against this channel's history, and returns the tags without any that reference
+// messages we don't know about (or nil if there are no tags left).
+func (channel *Channel) validateReferenceTags(tags *map[string]ircmsg.TagValue) *map[string]ircmsg.TagValue {
+	if tags == nil || channel.history == nil {
+		return tags
+	}
+	_, hasReply := (*tags)[replyTag]
+	_, hasReact := (*tags)[reactTag]
+	if !hasReply && !hasReact {
+		return tags
+	}
+
+	newTags := make(map[string]ircmsg.TagValue)
+	for name, value := range *tags {
+		newTags[name] = value
+	}
+	if hasReply {
+		if _, exists := channel.history.Find(newTags[replyTag].Value, messageTime(newTags[replyTag].Value)); !exists {
+			delete(newTags, replyTag)
+		}
+	}
+	// reactions only make sense alongside the message they're reacting to
+	if _, exists := newTags[replyTag]; !exists || newTags[reactTag].Value == "" {
+		delete(newTags, reactTag)
+	}
+
+	if len(newTags) == 0 {
+		return nil
+	}
+	return &newTags
+}
+
+// isReaction returns true if the given client-only tags contain a reaction.
+func isReaction(tags *map[string]ircmsg.TagValue) bool {
+	if tags == nil {
+		return false
+	}
+	_, exists := (*tags)[reactTag]
+	return exists
+}
+
+// replayHistoryItems sends the given history items to the client in a chathistory batch, as
+// if they were being sent to the given target.
+func (client *Client) replayHistoryItems(target string, items []history.Item, rb *ResponseBuffer) {
+	if len(items) == 0 {
+		return
+	}
+	batch := rb.StartBatch(nil, BatchChathistory, target)
+	defer batch.End()
+
+	for _, item := range items {
+		tags := make(map[string]ircmsg.TagValue)
+		if client.hasCapability(ServerTime) {
+			tags["time"] = ircmsg.MakeTagValue(item.Time.UTC().Format(IRCv3TimestampFormat))
+		}
+		if client.hasCapability(AccountTag) && item.AccountName != "" {
+			tags["account"] = ircmsg.MakeTagValue(item.AccountName)
+		}
+		if client.hasCapability(MessageIDs) && item.Msgid != "" {
+			tags["draft/msgid"] = ircmsg.MakeTagValue(item.Msgid)
+		}
+		if client.hasCapability(MessageTags) {
+			for name, value := range item.Tags {
+				tags[name] = ircmsg.MakeTagValue(value)
+			}
+		}
+
+		switch item.Type {
+		case history.Privmsg, history.Notice:
+			command := "PRIVMSG"
+			if item.Type == history.Notice {
+				command = "NOTICE"
+			}
+			if client.hasCapability(MaxLine) {
+				batch.Send(&tags, item.Nickmask, command, target, item.Message)
+			} else {
+				for _, line := range wordWrap(item.Message, 400) {
+					batch.Send(&tags, item.Nickmask, command, target, line)
+				}
+			}
+		case history.Tagmsg:
+			if client.hasCapability(MessageTags) {
+				batch.Send(&tags, item.Nickmask, "TAGMSG", target)
+			}
+		}
+	}
+}
+
+// recordDirectMessage stores a private message in the history of the sender and
+// recipient's accounts, if they've opted in.
+func (server *Server) recordDirectMessage(client, target *Client, itemType history.ItemType, msgid string, clientOnlyTags *map[string]ircmsg.TagValue, message string) {
+	if !server.historyDirectMessages.Enabled {
+		return
+	}
+
+	item := client.historyItem(itemType, msgid, clientOnlyTags, message)
+	item.Target = target.nick
+
+	server.addDirectMessageHistory(client.account, item)
+	if target.account != client.account {
+		server.addDirectMessageHistory(target.account, item)
+	}
+}
+
+// addDirectMessageHistory stores a private message in the account's history, if they've
+// opted in.
+func (server *Server) addDirectMessageHistory(account *ClientAccount, item history.Item) {
+	buffer := account.getHistory()
+	if buffer == nil {
+		return
+	}
+	buffer.Add(item)
+	server.saveDirectMessageHistory(account, buffer)
+}
+
+// loadDirectMessageHistory loads the account's stored private messages from the store. The
+// ones that have passed the retention period are pruned when the history is next used, so
+// the account's clients can be told about them.
+func (server *Server) loadDirectMessageHistory(tx *buntdb.Tx, accountKey string) *history.Buffer {
+	buffer := history.NewBuffer(accountKey, server.historyDirectMessages.Length, nil)
+
+	itemsString, _ := tx.Get(fmt.Sprintf(keyAccountDMHistoryItems, accountKey))
+	var items []history.Item
+	_ = json.Unmarshal([]byte(itemsString), &items)
+	for _, item := range items {
+		buffer.Add(item)
+	}
+	return buffer
+}
+
+// pruneDirectMessageHistory removes the account's private messages that have passed the
+// retention period, and counts them so the account's clients can be told.
+func (server *Server) pruneDirectMessageHistory(account *ClientAccount, buffer *history.Buffer) {
+	expired := buffer.Prune(time.Now().Add(-server.historyDirectMessages.Retention))
+	if expired == 0 {
+		return
+	}
+	account.addExpiredHistory(expired)
+	server.saveDirectMessageHistory(account, buffer)
+}
+
+// saveDirectMessageHistory writes the account's private messages to the store, so they're
+// kept when the account's unloaded or the server restarts.
+func (server *Server) saveDirectMessageHistory(account *ClientAccount, buffer *history.Buffer) {
+	// in read-only mode, messages are only kept in memory
+	if server.isReadOnly() {
+		return
+	}
+
+	accountKey, _ := CasefoldName(account.Name)
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		// the buffer's read inside the transaction, so a save that's racing with this one
+		// can't overwrite newer messages with older ones
+		itemsBytes, err := json.Marshal(buffer.Latest(server.historyDirectMessages.Length))
+		if err != nil {
+			return err
+		}
+		_, _, err = tx.Set(fmt.Sprintf(keyAccountDMHistoryItems, accountKey), string(itemsBytes), nil)
+		return err
+	})
+	if err != nil {
+		server.logger.Error("internal", fmt.Sprintf("Could not save private message history for account %s: %s", account.Name, err.Error()))
+	}
+}
+
+// wipeDirectMessageHistory removes the account's stored private messages, from memory and
+// from the store.
+func (server *Server) wipeDirectMessageHistory(account *ClientAccount, buffer *history.Buffer) error {
+	buffer.Clear()
+	account.takeExpiredHistory()
+	accountKey, _ := CasefoldName(account.Name)
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(fmt.Sprintf(keyAccountDMHistoryItems, accountKey))
+		return err
+	})
+	if err == buntdb.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// directMessageHistory returns up to limit of the latest private messages between
+// this client's account and the given nick.
+func (client *Client) directMessageHistory(nick string, limit int) []history.Item {
+	return client.server.accountDirectMessageHistory(client.account, nick, limit)
+}
+
+// accountDirectMessageHistory returns up to limit of the latest private messages between
+// the given account and nick, or with anyone if nick is blank. It returns nothing if the
+// account doesn't have history enabled.
+func (server *Server) accountDirectMessageHistory(account *ClientAccount, nick string, limit int) []history.Item {
+	buffer := account.getHistory()
+	if buffer == nil {
+		return nil
+	}
+	server.pruneDirectMessageHistory(account, buffer)
+
+	var items []history.Item
+	for _, item := range buffer.Latest(server.historyDirectMessages.Length) {
+		sender, _ := CasefoldName(strings.SplitN(item.Nickmask, "!", 2)[0])
+		recipient, _ := CasefoldName(item.Target)
+		if nick == "" || sender == nick || recipient == nick {
+			items = append(items, item)
+		}
+	}
+
+	if limit < len(items) {
+		items = items[len(items)-limit:]
+	}
+	return items
+}
+
+// sendDirectMessageHistoryStatus tells the client whether their private messages are being stored.
+func (client *Client) sendDirectMessageHistoryStatus(rb *ResponseBuffer) {
+	buffer := client.account.getHistory()
+	if buffer == nil {
+		return
+	}
+
+	client.server.pruneDirectMessageHistory(client.account, buffer)
+	expired := client.account.takeExpiredHistory()
+	retention := client.server.historyDirectMessages.Retention
+	rb.Notice(fmt.Sprintf("Your private messages are being stored on this server for %s, use DMHISTORY OFF to stop this", retention.String()))
+	if 0 < expired {
+		rb.Notice(fmt.Sprintf("%d of your stored private messages have passed that time and have been removed", expired))
+	}
+}
+
+// setAccountDMHistory turns storing the account's private messages on or off. Turning it
+// off removes the messages that were stored.
+func (server *Server) setAccountDMHistory(account *ClientAccount, enabled bool) error {
+	accountKey, _ := CasefoldName(account.Name)
+	if enabled {
+		if account.getHistory() != nil {
+			return nil
+		}
+		err := server.store.Update(func(tx *buntdb.Tx) error {
+			_, _, err := tx.Set(fmt.Sprintf(keyAccountDMHistory, accountKey), "1", nil)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		account.setHistory(history.NewBuffer(accountKey, server.historyDirectMessages.Length, nil))
+		return nil
+	}
+
+	buffer := account.getHistory()
+	if buffer == nil {
+		return nil
+	}
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(fmt.Sprintf(keyAccountDMHistory, accountKey))
+		return err
+	})
+	if err != nil && err != buntdb.ErrNotFound {
+		return err
+	}
+	account.setHistory(nil)
+	return server.wipeDirectMessageHistory(account, buffer)
+}
+
+// DMHISTORY <ON|OFF|WIPE|STATUS>
+func dmhistoryHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	if !server.historyDirectMessages.Enabled {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "DMHISTORY", "Private message history is not enabled on this server")
+		return false
+	}
+	if client.account == &NoAccount {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "DMHISTORY", "You must be logged into an account to store your private messages")
+		return false
+	}
+
+	account := client.account
+	retention := server.historyDirectMessages.Retention
+
+	switch strings.ToUpper(msg.Params[0]) {
+	case "ON":
+		if account.getHistory() == nil {
+			if !server.checkWritable(client, "DMHISTORY", rb) {
+				return false
+			}
+			err := server.setAccountDMHistory(account, true)
+			if err != nil {
+				rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "DMHISTORY", "Could not save setting")
+				return false
+			}
+		}
+		rb.Notice(fmt.Sprintf("Your private messages will now be stored for %s, so you can replay them with HISTORY <nick>", retention.String()))
+	case "OFF":
+		if account.getHistory() != nil {
+			if !server.checkWritable(client, "DMHISTORY", rb) {
+				return false
+			}
+			err := server.setAccountDMHistory(account, false)
+			if err != nil {
+				rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "DMHISTORY", "Could not save setting")
+				return false
+			}
+		}
+		rb.Notice("Your private messages are no longer being stored, and your stored messages have been removed")
+	case "WIPE":
+		if buffer := account.getHistory(); buffer != nil {
+			if !server.checkWritable(client, "DMHISTORY", rb) {
+				return false
+			}
+			err := server.wipeDirectMessageHistory(account, buffer)
+			if err != nil {
+				rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "DMHISTORY", "Could not remove your stored messages")
+				return false
+			}
+		}
+		rb.Notice("Your stored private messages have been removed")
+	case "STATUS":
+		if buffer := account.getHistory(); buffer == nil {
+			rb.Notice("Your private messages are not being stored")
+		} else {
+			rb.Notice(fmt.Sprintf("Your private messages are being stored for %s (%d messages stored)", retention.String(), buffer.Len()))
+		}
+	default:
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "DMHISTORY", msg.Params[0], "Unknown subcommand")
+	}
+	return false
+}
+
+// HISTORY <target> [<limit>]
+func historyHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	limit := defaultHistoryReplay
+	if len(msg.Params) > 1 {
+		var err error
+		limit, err = strconv.Atoi(msg.Params[1])
+		if err != nil || limit < 1 {
+			rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "HISTORY", "Invalid limit")
+			return false
+		}
+	}
+	if limit > maxHistoryReplay {
+		limit = maxHistoryReplay
+	}
+
+	target, err := CasefoldChannel(msg.Params[0])
+	if err != nil {
+		// private message history
+		nick, err := CasefoldName(msg.Params[0])
+		if err != nil {
+			rb.Send(nil, server.name, ERR_NOSUCHNICK, client.nick, msg.Params[0], "No such nick")
+			return false
+		}
+		if client.account.getHistory() == nil {
+			rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "HISTORY", "You are not storing your private messages, see DMHISTORY")
+			return false
+		}
+		for _, item := range client.directMessageHistory(nick, limit) {
+			client.replayHistoryItems(item.Target, []history.Item{item}, rb)
+		}
+		return false
+	}
+
+	channel := server.channels.Get(target)
+	if channel == nil {
+		rb.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, msg.Params[0], "No such channel")
+		return false
+	}
+
+	channel.membersMutex.RLock()
+	isMember := channel.members.Has(client)
+	channel.membersMutex.RUnlock()
+	if !isMember {
+		rb.Send(nil, server.name, ERR_NOTONCHANNEL, client.nick, channel.name, "You're not on that channel")
+		return false
+	}
+
+	if channel.history == nil {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "HISTORY", "History is not enabled on this server")
+		return false
+	}
+
+	client.replayHistoryItems(channel.name, channel.history.Latest(limit), rb)
+	return false
+}
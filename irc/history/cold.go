@@ -0,0 +1,220 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	// keyItem is target, then the item's time (as zero-padded unix nanoseconds so keys sort
+	// properly), then the order it was written in. The lines of a multiline message all have
+	// the same time, so the time alone isn't enough to keep them apart.
+	keyItem       = "history %s %020d %020d"
+	keyItemTime   = "history %s %020d "
+	keyItemPrefix = "history %s "
+
+	// demotionQueueLength is how many items can be waiting to be written to disk
+	demotionQueueLength = 1024
+)
+
+type demotion struct {
+	target string
+	item   Item
+}
+
+// ColdStore is the on-disk (cold) tier of history storage. Items are written to it
+// in the background as they fall out of the in-memory buffers, expire after the
+// retention period, and the file is compacted periodically.
+type ColdStore struct {
+	sequence  uint64 // accessed atomically, first so it's 64-bit aligned
+	db        *buntdb.DB
+	retention time.Duration
+	demotions chan demotion
+	quit      chan bool
+}
+
+// OpenColdStore opens (or creates) the cold history store at the given path.
+func OpenColdStore(path string, retention time.Duration, compactionInterval time.Duration) (*ColdStore, error) {
+	db, err := buntdb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cs := &ColdStore{
+		db:        db,
+		retention: retention,
+		demotions: make(chan demotion, demotionQueueLength),
+		quit:      make(chan bool),
+	}
+
+	go cs.run(compactionInterval)
+
+	return cs, nil
+}
+
+// Demote queues the given item to be written to disk.
+func (cs *ColdStore) Demote(target string, item Item) {
+	select {
+	case cs.demotions <- demotion{target: target, item: item}:
+	default:
+		// queue is full, we'd rather lose old history than block message delivery
+	}
+}
+
+// run writes demoted items to disk and compacts the store, until the store is closed.
+func (cs *ColdStore) run(compactionInterval time.Duration) {
+	if compactionInterval <= 0 {
+		compactionInterval = time.Hour
+	}
+	compaction := time.NewTicker(compactionInterval)
+	defer compaction.Stop()
+
+	for {
+		select {
+		case d := <-cs.demotions:
+			cs.write(d)
+		case <-compaction.C:
+			cs.Compact()
+		case <-cs.quit:
+			return
+		}
+	}
+}
+
+// write stores a single item on disk.
+func (cs *ColdStore) write(d demotion) {
+	itemBytes, err := json.Marshal(d.item)
+	if err != nil {
+		return
+	}
+
+	var opts *buntdb.SetOptions
+	if 0 < cs.retention {
+		ttl := cs.retention - time.Since(d.item.Time)
+		if ttl <= 0 {
+			// already expired
+			return
+		}
+		opts = &buntdb.SetOptions{Expires: true, TTL: ttl}
+	}
+
+	cs.db.Update(func(tx *buntdb.Tx) error {
+		sequence := atomic.AddUint64(&cs.sequence, 1)
+		_, _, err := tx.Set(fmt.Sprintf(keyItem, d.target, d.item.Time.UnixNano(), sequence), string(itemBytes), opts)
+		return err
+	})
+}
+
+// Before returns up to limit of the latest items for the given target that happened before
+// the given time, oldest first.
+func (cs *ColdStore) Before(target string, before time.Time, limit int) []Item {
+	var items []Item
+
+	cs.db.View(func(tx *buntdb.Tx) error {
+		prefix := fmt.Sprintf(keyItemPrefix, target)
+		return tx.DescendRange("", fmt.Sprintf(keyItemTime, target, before.UnixNano()), prefix, func(key, value string) bool {
+			var item Item
+			if json.Unmarshal([]byte(value), &item) == nil {
+				items = append(items, item)
+			}
+			return len(items) < limit
+		})
+	})
+
+	// reverse so they're oldest first
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+	return items
+}
+
+// Find returns the stored item for the given target with the given msgid, which happened
+// at the given time. Items are stored by time, so only the items from that moment are checked.
+func (cs *ColdStore) Find(target string, msgid string, at time.Time) (item Item, found bool) {
+	cs.db.View(func(tx *buntdb.Tx) error {
+		prefix := fmt.Sprintf(keyItemTime, target, at.UnixNano())
+		return tx.AscendGreaterOrEqual("", prefix, func(key, value string) bool {
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			var stored Item
+			if json.Unmarshal([]byte(value), &stored) == nil && stored.Msgid == msgid {
+				item, found = stored, true
+				return false
+			}
+			return true
+		})
+	})
+	return
+}
+
+// DeleteTarget removes every stored item for the given target.
+func (cs *ColdStore) DeleteTarget(target string) {
+	cs.db.Update(func(tx *buntdb.Tx) error {
+		var keys []string
+		prefix := fmt.Sprintf(keyItemPrefix, target)
+		tx.AscendGreaterOrEqual("", prefix, func(key, value string) bool {
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			keys = append(keys, key)
+			return true
+		})
+		for _, key := range keys {
+			tx.Delete(key)
+		}
+		return nil
+	})
+}
+
+// DeleteMatching removes the stored items for the given target that happened after the given
+// time and match the given function, and returns them.
+func (cs *ColdStore) DeleteMatching(target string, since time.Time, match func(item Item) bool) []Item {
+	var deleted []Item
+	cs.db.Update(func(tx *buntdb.Tx) error {
+		var keys []string
+		prefix := fmt.Sprintf(keyItemPrefix, target)
+		tx.AscendGreaterOrEqual("", fmt.Sprintf(keyItemTime, target, since.UnixNano()+1), func(key, value string) bool {
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			var item Item
+			if json.Unmarshal([]byte(value), &item) == nil && match(item) {
+				keys = append(keys, key)
+				deleted = append(deleted, item)
+			}
+			return true
+		})
+		for _, key := range keys {
+			tx.Delete(key)
+		}
+		return nil
+	})
+	return deleted
+}
+
+// Compact rewrites the store on disk, dropping expired and deleted items.
+func (cs *ColdStore) Compact() error {
+	return cs.db.Shrink()
+}
+
+// Close flushes any queued items and closes the store.
+func (cs *ColdStore) Close() error {
+	close(cs.quit)
+	for {
+		select {
+		case d := <-cs.demotions:
+			cs.write(d)
+		default:
+			return cs.db.Close()
+		}
+	}
+}
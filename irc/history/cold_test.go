@@ -0,0 +1,93 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package history
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestColdStoreFind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oragono-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cs, err := OpenColdStore(filepath.Join(dir, "history.db"), 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	at := time.Unix(0, 1500000000000000000)
+	cs.write(demotion{target: "#chan", item: Item{Time: at, Msgid: "1500000000000000000-1", Message: "hi"}})
+
+	cases := []struct {
+		target string
+		msgid  string
+		at     time.Time
+		found  bool
+	}{
+		{"#chan", "1500000000000000000-1", at, true},
+		{"#chan", "1500000000000000000-2", at, false},
+		{"#chan", "1500000000000000001-1", at.Add(1), false},
+		{"#other", "1500000000000000000-1", at, false},
+	}
+	for _, c := range cases {
+		item, found := cs.Find(c.target, c.msgid, c.at)
+		if found != c.found {
+			t.Errorf("%s %s: expected found to be %v, got %v", c.target, c.msgid, c.found, found)
+		} else if found && item.Message != "hi" {
+			t.Errorf("%s %s: found the wrong item: %#v", c.target, c.msgid, item)
+		}
+	}
+}
+
+func TestColdStoreMultiline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oragono-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cs, err := OpenColdStore(filepath.Join(dir, "history.db"), 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+
+	// every line of a multiline message has the same time
+	at := time.Unix(0, 1500000000000000000)
+	var msgids []string
+	for i := 0; i < 12; i++ {
+		msgid := fmt.Sprintf("1500000000000000000-1-%d", i)
+		msgids = append(msgids, msgid)
+		cs.write(demotion{target: "#chan", item: Item{Time: at, Msgid: msgid, Message: fmt.Sprintf("line %d", i)}})
+	}
+
+	items := cs.Before("#chan", at.Add(1), 100)
+	if len(items) != len(msgids) {
+		t.Fatalf("expected %d lines, got %d", len(msgids), len(items))
+	}
+	for i, item := range items {
+		if item.Msgid != msgids[i] {
+			t.Errorf("line %d: expected %s, got %s", i, msgids[i], item.Msgid)
+		}
+	}
+	if items := cs.Before("#chan", at, 100); len(items) != 0 {
+		t.Errorf("expected no lines before the message, got %d", len(items))
+	}
+
+	for i, msgid := range msgids {
+		item, found := cs.Find("#chan", msgid, at)
+		if !found {
+			t.Errorf("%s: expected to find the line", msgid)
+		} else if item.Message != fmt.Sprintf("line %d", i) {
+			t.Errorf("%s: found the wrong line: %#v", msgid, item)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+// Package history stores the message history of channels, with recent messages
+// kept in memory and older ones optionally moved to disk.
+package history
+
+import (
+	"sync"
+	"time"
+)
+
+// ItemType is the type of a history item.
+type ItemType uint
+
+const (
+	// Privmsg is a PRIVMSG.
+	Privmsg ItemType = iota
+	// Notice is a NOTICE.
+	Notice
+	// Tagmsg is a TAGMSG.
+	Tagmsg
+)
+
+// Item represents a single message stored in history.
+type Item struct {
+	Type        ItemType          `json:"type"`
+	Time        time.Time         `json:"time"`
+	Nickmask    string            `json:"nickmask"`
+	Target      string            `json:"target,omitempty"`
+	AccountName string            `json:"account,omitempty"`
+	Message     string            `json:"message,omitempty"`
+	Msgid       string            `json:"msgid,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+// Buffer is the in-memory (hot) history of a single target. It's a ring buffer,
+// and once it's full the oldest items are demoted to the cold store (if there is one).
+type Buffer struct {
+	sync.RWMutex
+
+	target string
+	cold   *ColdStore
+
+	buffer []Item
+	start  int
+	length int
+}
+
+// NewBuffer returns a new history buffer for the given target, holding up to size items in memory.
+func NewBuffer(target string, size int, cold *ColdStore) *Buffer {
+	if size < 1 {
+		size = 1
+	}
+	return &Buffer{
+		target: target,
+		cold:   cold,
+		buffer: make([]Item, size),
+	}
+}
+
+// Add adds the given item to the buffer.
+func (hb *Buffer) Add(item Item) {
+	hb.Lock()
+	defer hb.Unlock()
+
+	if hb.length == len(hb.buffer) {
+		// full, so demote the oldest item and overwrite it
+		if hb.cold != nil {
+			hb.cold.Demote(hb.target, hb.buffer[hb.start])
+		}
+		hb.buffer[hb.start] = item
+		hb.start = (hb.start + 1) % len(hb.buffer)
+		return
+	}
+
+	hb.buffer[(hb.start+hb.length)%len(hb.buffer)] = item
+	hb.length++
+}
+
+// hotItems returns all the items held in memory, oldest first.
+func (hb *Buffer) hotItems() []Item {
+	items := make([]Item, hb.length)
+	for i := 0; i < hb.length; i++ {
+		items[i] = hb.buffer[(hb.start+i)%len(hb.buffer)]
+	}
+	return items
+}
+
+// Latest returns up to limit of the latest items, oldest first. If there aren't
+// enough items in memory, older ones are retrieved from the cold store.
+func (hb *Buffer) Latest(limit int) []Item {
+	hb.RLock()
+	items := hb.hotItems()
+	hb.RUnlock()
+
+	if limit < len(items) {
+		return items[len(items)-limit:]
+	}
+
+	if hb.cold != nil && len(items) < limit {
+		before := time.Now()
+		if 0 < len(items) {
+			before = items[0].Time
+		}
+		older := hb.cold.Before(hb.target, before, limit-len(items))
+		items = append(older, items...)
+	}
+
+	return items
+}
+
+// Find returns the item with the given msgid, which happened at the given time, checking the
+// cold store if it isn't in memory.
+func (hb *Buffer) Find(msgid string, at time.Time) (Item, bool) {
+	hb.RLock()
+	for i := 0; i < hb.length; i++ {
+		item := hb.buffer[(hb.start+i)%len(hb.buffer)]
+		if item.Msgid == msgid {
+			hb.RUnlock()
+			return item, true
+		}
+	}
+	hb.RUnlock()
+
+	if hb.cold != nil {
+		return hb.cold.Find(hb.target, msgid, at)
+	}
+	return Item{}, false
+}
+
+// Prune removes items that happened before the given time from memory, and returns
+// how many were removed.
+func (hb *Buffer) Prune(before time.Time) int {
+	hb.Lock()
+	defer hb.Unlock()
+
+	var removed int
+	for 0 < hb.length && hb.buffer[hb.start].Time.Before(before) {
+		hb.buffer[hb.start] = Item{}
+		hb.start = (hb.start + 1) % len(hb.buffer)
+		hb.length--
+		removed++
+	}
+	return removed
+}
+
+// Retract removes the items that happened after the given time and match the given function,
+// including the ones in the cold store, and returns them.
+func (hb *Buffer) Retract(since time.Time, match func(item Item) bool) []Item {
+	hb.Lock()
+	var retracted []Item
+	kept := make([]Item, len(hb.buffer))
+	var keptLength int
+	for _, item := range hb.hotItems() {
+		if item.Time.After(since) && match(item) {
+			retracted = append(retracted, item)
+		} else {
+			kept[keptLength] = item
+			keptLength++
+		}
+	}
+	hb.buffer = kept
+	hb.start = 0
+	hb.length = keptLength
+	hb.Unlock()
+
+	if hb.cold != nil {
+		retracted = append(hb.cold.DeleteMatching(hb.target, since, match), retracted...)
+	}
+	return retracted
+}
+
+// Clear removes every item from this buffer, including the ones in the cold store.
+func (hb *Buffer) Clear() {
+	hb.Lock()
+	defer hb.Unlock()
+
+	hb.buffer = make([]Item, len(hb.buffer))
+	hb.start = 0
+	hb.length = 0
+
+	if hb.cold != nil {
+		hb.cold.DeleteTarget(hb.target)
+	}
+}
+
+// Len returns the number of items held in memory.
+func (hb *Buffer) Len() int {
+	hb.RLock()
+	defer hb.RUnlock()
+	return hb.length
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/sno"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	keyAccountVhost        = "account.vhost %s"
+	keyAccountVhostChanged = "account.vhost.changed %s"
+)
+
+// hsHandler handles the /HS and /HOSTSERV commands
+func hsHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	server.hostservReceivePrivmsg(client, strings.Join(msg.Params, " "), rb)
+	return false
+}
+
+func (server *Server) hostservReceiveNotice(client *Client, message string) {
+	// do nothing
+}
+
+// HostServNotice sends the client a notice from HostServ.
+func (client *Client) HostServNotice(text string) {
+	NewResponseBuffer(client).HostServNotice(text)
+}
+
+// isValidVhost returns true if the given vhost can be used as a hostname.
+func isValidVhost(vhost string) bool {
+	if len(vhost) < 1 || 64 < len(vhost) || strings.HasPrefix(vhost, ".") || strings.HasSuffix(vhost, ".") {
+		return false
+	}
+	for _, char := range vhost {
+		if !(('a' <= char && char <= 'z') || ('A' <= char && char <= 'Z') || ('0' <= char && char <= '9') || strings.ContainsRune(".-_/:", char)) {
+			return false
+		}
+	}
+	return true
+}
+
+// vhostOffers returns the vhosts on the offer list, filled in for the given account name.
+func (server *Server) vhostOffers(accountName string) []string {
+	var offers []string
+	for _, style := range server.vhosts.OfferList {
+		offers = append(offers, strings.Replace(style, "<account>", strings.ToLower(accountName), -1))
+	}
+	return offers
+}
+
+// applyAccountVhost sets the client's vhost to their account's one, if they have one.
+func (client *Client) applyAccountVhost() {
+	// oper vhosts take precedence
+	if client.account == &NoAccount || client.account.Vhost == "" || client.hasFlag(Operator) {
+		return
+	}
+	client.setVhost(client.account.Vhost)
+	client.HostServNotice(fmt.Sprintf("Your vhost %s has been activated", client.account.Vhost))
+}
+
+// setAccountVhost stores the given vhost on the client's account and applies it to all of
+// the account's clients.
+func (server *Server) setAccountVhost(account *ClientAccount, vhost string) error {
+	accountKey, _ := CasefoldName(account.Name)
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		var err error
+		if vhost == "" {
+			_, err = tx.Delete(fmt.Sprintf(keyAccountVhost, accountKey))
+			if err == buntdb.ErrNotFound {
+				err = nil
+			}
+		} else {
+			_, _, err = tx.Set(fmt.Sprintf(keyAccountVhost, accountKey), vhost, nil)
+		}
+		if err != nil {
+			return err
+		}
+		_, _, err = tx.Set(fmt.Sprintf(keyAccountVhostChanged, accountKey), strconv.FormatInt(time.Now().Unix(), 10), nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	account.Vhost = vhost
+	account.VhostChanged = time.Now()
+	for _, accountClient := range account.getClients() {
+		if !accountClient.hasFlag(Operator) {
+			accountClient.setVhost(vhost)
+		}
+	}
+	return nil
+}
+
+func (server *Server) hostservReceivePrivmsg(client *Client, message string, rb *ResponseBuffer) {
+	var params []string
+	for _, p := range strings.Split(message, " ") {
+		if len(p) > 0 {
+			params = append(params, p)
+		}
+	}
+	if len(params) < 1 {
+		rb.HostServNotice("You need to run a command")
+		return
+	}
+
+	command := strings.ToLower(params[0])
+	server.logger.Debug("hostserv", fmt.Sprintf("Client %s ran command %s", client.nick, command))
+
+	// opers can manage vhosts without being logged in
+	switch command {
+	case "waiting", "approve", "reject", "set", "del":
+		server.hostservOper(client, command, params[1:], rb)
+		return
+	}
+
+	if client.account == &NoAccount {
+		rb.HostServNotice("You must be logged into an account to use HostServ")
+		return
+	}
+	account := client.account
+
+	if command == "offerlist" {
+		offers := server.vhostOffers(account.Name)
+		if len(offers) == 0 {
+			rb.HostServNotice("There are no vhosts on offer")
+			return
+		}
+		rb.HostServNotice("These vhosts are on offer, use TAKE <number> to use one:")
+		for i, offer := range offers {
+			rb.HostServNotice(fmt.Sprintf("%d: %s", i+1, offer))
+		}
+	} else if command == "take" {
+		if len(params) < 2 {
+			rb.HostServNotice("Syntax: TAKE <number>")
+			return
+		}
+		offers := server.vhostOffers(account.Name)
+		number, err := strconv.Atoi(params[1])
+		if err != nil || number < 1 || len(offers) < number {
+			rb.HostServNotice("That isn't a vhost on offer, see OFFERLIST")
+			return
+		}
+		vhost := offers[number-1]
+		if !isValidVhost(vhost) {
+			rb.HostServNotice("That vhost can't be used with your account name")
+			return
+		}
+
+		cooldown := server.vhosts.ChangeCooldown
+		if 0 < cooldown && time.Since(account.VhostChanged) < cooldown {
+			rb.HostServNotice(fmt.Sprintf("You can only change your vhost once every %s, please try again later", cooldown.String()))
+			return
+		}
+		if !server.checkWritable(client, "HOSTSERV", rb) {
+			return
+		}
+
+		err = server.setAccountVhost(account, vhost)
+		if err != nil {
+			rb.HostServNotice("Could not save your vhost")
+			server.logger.Error("hostserv", fmt.Sprintf("Could not save vhost for account %s: %s", account.Name, err.Error()))
+			return
+		}
+		rb.HostServNotice(fmt.Sprintf("Your vhost is now %s", vhost))
+		server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Account $c[grey][$r%s$c[grey]] took vhost $c[grey][$r%s$c[grey]]"), account.Name, vhost))
+	} else if command == "request" {
+		server.hostservRequest(client, params[1:], rb)
+	} else if command == "group" {
+		server.hostservGroup(client, params[1:], rb)
+	} else if command == "assign" || command == "unassign" {
+		server.hostservAssign(client, command == "assign", params[1:], rb)
+	} else if command == "off" {
+		if account.Vhost == "" {
+			rb.HostServNotice("You don't have a vhost")
+			return
+		}
+		if !server.checkWritable(client, "HOSTSERV", rb) {
+			return
+		}
+		err := server.setAccountVhost(account, "")
+		if err != nil {
+			rb.HostServNotice("Could not remove your vhost")
+			return
+		}
+		rb.HostServNotice("Your vhost has been removed")
+	} else {
+		rb.HostServNotice("Sorry, I don't know that command")
+	}
+}
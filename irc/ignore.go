@@ -0,0 +1,377 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmatch"
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	// maxSilenceEntries is how many masks can be on a SILENCE list.
+	maxSilenceEntries = 32
+	// maxAcceptEntries is how many nicks can be on an ACCEPT list.
+	maxAcceptEntries = 32
+	// maxHighlightEntries is how many highlight keywords can be set.
+	maxHighlightEntries = 32
+
+	// callerIDNotifyInterval is how often we tell a +g client that someone's trying to message them.
+	callerIDNotifyInterval = time.Minute
+)
+
+// IgnoreLists holds a user's SILENCE list, caller-ID ACCEPT list and highlight keywords.
+// Clients logged into the same account share the same lists, and they're stored with the
+// account so they persist across connections.
+type IgnoreLists struct {
+	stateMutex sync.RWMutex
+
+	// Silence holds the casefolded masks of clients whose messages are ignored.
+	Silence []string
+	// Accept holds the casefolded nicks of clients that can message us while we're +g.
+	Accept []string
+	// Highlights holds the keywords that should be treated as mentions.
+	Highlights []string
+
+	// lastCallerIDNotify is when we last told the user someone tried to message them while +g.
+	lastCallerIDNotify time.Time
+}
+
+// NewIgnoreLists returns a new, empty set of ignore lists.
+func NewIgnoreLists() *IgnoreLists {
+	return &IgnoreLists{}
+}
+
+// IsSilenced returns true if the given (casefolded) nickmask matches the SILENCE list.
+func (il *IgnoreLists) IsSilenced(nickmask string) bool {
+	il.stateMutex.RLock()
+	defer il.stateMutex.RUnlock()
+
+	for _, mask := range il.Silence {
+		if ircmatch.MakeMatch(mask).Match(nickmask) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAccepted returns true if the given (casefolded) nick is on the ACCEPT list.
+func (il *IgnoreLists) IsAccepted(nick string) bool {
+	il.stateMutex.RLock()
+	defer il.stateMutex.RUnlock()
+
+	for _, accepted := range il.Accept {
+		if accepted == nick {
+			return true
+		}
+	}
+	return false
+}
+
+// HighlightWords returns a copy of the highlight keywords.
+func (il *IgnoreLists) HighlightWords() []string {
+	il.stateMutex.RLock()
+	defer il.stateMutex.RUnlock()
+
+	return append([]string(nil), il.Highlights...)
+}
+
+// shouldNotifyCallerID returns true if we should tell the user that someone tried to
+// message them while they're +g, and records that we've done so.
+func (il *IgnoreLists) shouldNotifyCallerID() bool {
+	il.stateMutex.Lock()
+	defer il.stateMutex.Unlock()
+
+	if time.Since(il.lastCallerIDNotify) < callerIDNotifyInterval {
+		return false
+	}
+	il.lastCallerIDNotify = time.Now()
+	return true
+}
+
+// Merge adds the entries from the given lists to these ones.
+func (il *IgnoreLists) Merge(other *IgnoreLists) {
+	other.stateMutex.RLock()
+	silence := append([]string(nil), other.Silence...)
+	accept := append([]string(nil), other.Accept...)
+	highlights := append([]string(nil), other.Highlights...)
+	other.stateMutex.RUnlock()
+
+	il.stateMutex.Lock()
+	defer il.stateMutex.Unlock()
+
+	il.Silence = mergeIgnoreList(il.Silence, silence, maxSilenceEntries)
+	il.Accept = mergeIgnoreList(il.Accept, accept, maxAcceptEntries)
+	il.Highlights = mergeIgnoreList(il.Highlights, highlights, maxHighlightEntries)
+}
+
+// mergeIgnoreList adds the new entries to the given list, up to the given length.
+func mergeIgnoreList(list []string, newEntries []string, maxLength int) []string {
+	for _, entry := range newEntries {
+		list, _ = addIgnoreEntry(list, entry, maxLength)
+	}
+	return list
+}
+
+// addIgnoreEntry adds an entry to the given list, returning false if the list is full.
+func addIgnoreEntry(list []string, entry string, maxLength int) ([]string, bool) {
+	for _, existing := range list {
+		if existing == entry {
+			return list, true
+		}
+	}
+	if maxLength <= len(list) {
+		return list, false
+	}
+	return append(list, entry), true
+}
+
+// removeIgnoreEntry removes an entry from the given list, returning false if it wasn't there.
+func removeIgnoreEntry(list []string, entry string) ([]string, bool) {
+	var newList []string
+	for _, existing := range list {
+		if existing != entry {
+			newList = append(newList, existing)
+		}
+	}
+	return newList, len(newList) != len(list)
+}
+
+// loadIgnoreLists loads an account's ignore lists from the store.
+func loadIgnoreLists(tx *buntdb.Tx, accountKey string) *IgnoreLists {
+	lists := NewIgnoreLists()
+	listsString, err := tx.Get(fmt.Sprintf(keyAccountIgnores, accountKey))
+	if err == nil {
+		json.Unmarshal([]byte(listsString), lists)
+	}
+	return lists
+}
+
+// saveIgnoreLists saves the client's ignore lists to their account, if they're logged in.
+func (client *Client) saveIgnoreLists() {
+	// in read-only mode, changes only last until the client disconnects
+	if client.account == &NoAccount || client.server.isReadOnly() {
+		return
+	}
+
+	client.ignores.stateMutex.RLock()
+	listsBytes, err := json.Marshal(client.ignores)
+	client.ignores.stateMutex.RUnlock()
+	if err != nil {
+		return
+	}
+
+	accountKey, _ := CasefoldName(client.account.Name)
+	err = client.server.store.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(fmt.Sprintf(keyAccountIgnores, accountKey), string(listsBytes), nil)
+		return err
+	})
+	if err != nil {
+		client.server.logger.Error("internal", fmt.Sprintf("Could not save ignore lists for account %s: %s", client.account.Name, err.Error()))
+	}
+}
+
+// canMessage returns true if the sender can send a private message to this client,
+// taking this client's SILENCE list, caller-ID and secure-messages modes into account. If
+// the sender is blocked by caller-ID, both sides are told about it (unless it's a notice).
+func (client *Client) canMessage(sender *Client, isNotice bool) bool {
+	if sender == client {
+		return true
+	}
+	// this is about the transport, so opers don't get past it either
+	if client.hasFlag(SecureMessages) && !sender.hasFlag(TLS) {
+		if !isNotice {
+			sender.warnNotice("PRIVMSG", "SECURE_MESSAGES_ONLY", []string{client.nick}, fmt.Sprintf("%s only accepts private messages from clients connected with TLS (user mode +S)", client.nick))
+		}
+		return false
+	}
+	if sender.hasFlag(Operator) {
+		return true
+	}
+	if client.ignores.IsSilenced(sender.nickMaskCasefolded) {
+		return false
+	}
+	if client.hasFlag(CallerID) && !client.ignores.IsAccepted(sender.nickCasefolded) {
+		if isNotice {
+			return false
+		}
+		sender.Send(nil, client.server.name, RPL_TARGUMODEG, sender.nick, client.nick, "is in +g mode (server-side ignore)")
+		if client.ignores.shouldNotifyCallerID() {
+			sender.Send(nil, client.server.name, RPL_TARGNOTIFY, sender.nick, client.nick, "has been informed that you messaged them")
+			client.Send(nil, client.server.name, RPL_UMODEGMSG, client.nick, sender.nick, fmt.Sprintf("%s@%s", sender.username, sender.hostname), "is messaging you, and you have umode +g")
+		}
+		return false
+	}
+	return true
+}
+
+// SILENCE [{+|-}<mask>]
+func silenceHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	lists := client.ignores
+
+	if len(msg.Params) < 1 {
+		lists.stateMutex.RLock()
+		for _, mask := range lists.Silence {
+			rb.Send(nil, server.name, RPL_SILELIST, client.nick, mask)
+		}
+		lists.stateMutex.RUnlock()
+		rb.Send(nil, server.name, RPL_ENDOFSILELIST, client.nick, "End of Silence List")
+		return false
+	}
+
+	var changed bool
+	for _, param := range strings.Split(msg.Params[0], ",") {
+		op := Add
+		if strings.HasPrefix(param, "-") || strings.HasPrefix(param, "+") {
+			op = ModeOp(param[0])
+			param = param[1:]
+		}
+		if len(param) < 1 {
+			continue
+		}
+
+		mask, err := Casefold(ExpandUserHost(param))
+		if err != nil {
+			continue
+		}
+
+		var success bool
+		lists.stateMutex.Lock()
+		if op == Add {
+			lists.Silence, success = addIgnoreEntry(lists.Silence, mask, maxSilenceEntries)
+		} else {
+			lists.Silence, success = removeIgnoreEntry(lists.Silence, mask)
+		}
+		lists.stateMutex.Unlock()
+
+		if op == Add && !success {
+			rb.Send(nil, server.name, ERR_SILELISTFULL, client.nick, mask, "Your silence list is full")
+			continue
+		}
+		if success {
+			changed = true
+			rb.Send(nil, client.nickMaskString, "SILENCE", op.String()+mask)
+		}
+	}
+
+	if changed {
+		client.saveIgnoreLists()
+	}
+	return false
+}
+
+// ACCEPT <nick>{,<nick>}
+func acceptHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	lists := client.ignores
+
+	if msg.Params[0] == "*" {
+		lists.stateMutex.RLock()
+		accepted := append([]string(nil), lists.Accept...)
+		lists.stateMutex.RUnlock()
+		if 0 < len(accepted) {
+			rb.Send(nil, server.name, RPL_ACCEPTLIST, append([]string{client.nick}, accepted...)...)
+		}
+		rb.Send(nil, server.name, RPL_ENDOFACCEPT, client.nick, "End of /ACCEPT list")
+		return false
+	}
+
+	var changed bool
+	for _, param := range strings.Split(msg.Params[0], ",") {
+		remove := strings.HasPrefix(param, "-")
+		if remove {
+			param = param[1:]
+		}
+
+		nick, err := CasefoldName(param)
+		if err != nil || len(nick) < 1 {
+			rb.Send(nil, server.name, ERR_NOSUCHNICK, client.nick, param, "No such nick")
+			continue
+		}
+
+		if !remove && lists.IsAccepted(nick) {
+			rb.Send(nil, server.name, ERR_ACCEPTEXIST, client.nick, param, "is already on your accept list")
+			continue
+		}
+
+		var success bool
+		lists.stateMutex.Lock()
+		if remove {
+			lists.Accept, success = removeIgnoreEntry(lists.Accept, nick)
+		} else {
+			lists.Accept, success = addIgnoreEntry(lists.Accept, nick, maxAcceptEntries)
+		}
+		lists.stateMutex.Unlock()
+
+		if remove && !success {
+			rb.Send(nil, server.name, ERR_ACCEPTNOT, client.nick, param, "is not on your accept list")
+		} else if !success {
+			rb.Send(nil, server.name, ERR_ACCEPTFULL, client.nick, "Accept list is full")
+		} else {
+			changed = true
+		}
+	}
+
+	if changed {
+		client.saveIgnoreLists()
+	}
+	return false
+}
+
+// HIGHLIGHT [{+|-}<keyword>]
+func highlightHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	lists := client.ignores
+
+	if len(msg.Params) < 1 {
+		words := lists.HighlightWords()
+		if len(words) == 0 {
+			rb.Notice("You have no highlight keywords set")
+		} else {
+			rb.Notice(fmt.Sprintf("Your highlight keywords are: %s", strings.Join(words, ", ")))
+		}
+		return false
+	}
+
+	param := msg.Params[0]
+	remove := strings.HasPrefix(param, "-")
+	if remove || strings.HasPrefix(param, "+") {
+		param = param[1:]
+	}
+	word := strings.ToLower(param)
+	if len(word) < 1 {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "HIGHLIGHT", "Keyword must not be empty")
+		return false
+	}
+
+	var success bool
+	lists.stateMutex.Lock()
+	if remove {
+		lists.Highlights, success = removeIgnoreEntry(lists.Highlights, word)
+	} else {
+		lists.Highlights, success = addIgnoreEntry(lists.Highlights, word, maxHighlightEntries)
+	}
+	lists.stateMutex.Unlock()
+
+	if remove && !success {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "HIGHLIGHT", word, "Keyword is not in your highlight list")
+		return false
+	} else if !success {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "HIGHLIGHT", fmt.Sprintf("You can only have %s highlight keywords", strconv.Itoa(maxHighlightEntries)))
+		return false
+	}
+
+	if remove {
+		rb.Notice(fmt.Sprintf("Removed highlight keyword: %s", word))
+	} else {
+		rb.Notice(fmt.Sprintf("Added highlight keyword: %s", word))
+	}
+	client.saveIgnoreLists()
+	return false
+}
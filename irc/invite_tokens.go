@@ -0,0 +1,304 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/custime"
+)
+
+const (
+	// inviteTokenPrefix marks JOIN keys that are invite tokens.
+	inviteTokenPrefix = "inv-"
+
+	defaultInviteTokenLifetime = 24 * time.Hour
+	maxInviteTokensPerChannel  = 50
+	// inviteTokenHistory is how long we remember tokens after they stop working, so ops can
+	// still see who used them.
+	inviteTokenHistory = 7 * 24 * time.Hour
+)
+
+var (
+	errInviteTokenInvalid  = errors.New("That invite token is invalid or has expired")
+	errTooManyInviteTokens = errors.New("This channel has too many invite tokens, revoke some first")
+)
+
+// InviteTokenUse records a client joining a channel with an invite token.
+type InviteTokenUse struct {
+	Nick    string
+	Account string
+	Time    time.Time
+}
+
+// InviteToken lets clients join a channel, bypassing +i and +k.
+type InviteToken struct {
+	Token     string
+	Channel   string // casefolded
+	CreatedBy string
+	CreatedAt time.Time
+	// Expires is when the token stops working, if it's set.
+	Expires time.Time
+	// MaxUses is how many times the token can be used, with 0 meaning unlimited.
+	MaxUses int
+	Uses    []InviteTokenUse
+}
+
+// usable returns true if the token can still be used at the given time.
+func (it *InviteToken) usable(now time.Time) bool {
+	if !it.Expires.IsZero() && !now.Before(it.Expires) {
+		return false
+	}
+	return it.MaxUses == 0 || len(it.Uses) < it.MaxUses
+}
+
+// lastActive returns the last time the token was used or could have been used.
+func (it *InviteToken) lastActive() time.Time {
+	last := it.CreatedAt
+	if 0 < len(it.Uses) {
+		last = it.Uses[len(it.Uses)-1].Time
+	}
+	if !it.Expires.IsZero() && last.Before(it.Expires) {
+		last = it.Expires
+	}
+	return last
+}
+
+// InviteTokenManager holds the invite tokens for the server's channels. Tokens are kept in
+// memory, so they last until the server restarts.
+type InviteTokenManager struct {
+	sync.Mutex
+	tokens map[string]*InviteToken
+}
+
+// NewInviteTokenManager returns an empty InviteTokenManager.
+func NewInviteTokenManager() *InviteTokenManager {
+	return &InviteTokenManager{
+		tokens: make(map[string]*InviteToken),
+	}
+}
+
+// pruneNoMutex forgets the tokens that stopped working a while ago. The lock must be held.
+func (itm *InviteTokenManager) pruneNoMutex(now time.Time) {
+	for token, info := range itm.tokens {
+		if !info.usable(now) && inviteTokenHistory < now.Sub(info.lastActive()) {
+			delete(itm.tokens, token)
+		}
+	}
+}
+
+// Create makes a new invite token for the given channel.
+func (itm *InviteTokenManager) Create(channel, createdBy string, maxUses int, lifetime time.Duration) (*InviteToken, error) {
+	buf := make([]byte, 10)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	itm.Lock()
+	defer itm.Unlock()
+	now := time.Now()
+	itm.pruneNoMutex(now)
+	if maxInviteTokensPerChannel <= len(itm.listNoMutex(channel)) {
+		return nil, errTooManyInviteTokens
+	}
+
+	info := &InviteToken{
+		Token:     inviteTokenPrefix + strings.ToLower(base32.StdEncoding.EncodeToString(buf)),
+		Channel:   channel,
+		CreatedBy: createdBy,
+		CreatedAt: now,
+		MaxUses:   maxUses,
+	}
+	if 0 < lifetime {
+		info.Expires = now.Add(lifetime)
+	}
+	itm.tokens[info.Token] = info
+	return info, nil
+}
+
+// Use records the client using the given token to join the channel, returning false if the
+// token isn't valid for that channel.
+func (itm *InviteTokenManager) Use(token, channel string, client *Client) bool {
+	itm.Lock()
+	defer itm.Unlock()
+	info := itm.tokens[strings.ToLower(token)]
+	now := time.Now()
+	if info == nil || info.Channel != channel || !info.usable(now) {
+		return false
+	}
+	info.Uses = append(info.Uses, InviteTokenUse{
+		Nick:    client.nick,
+		Account: client.account.Name,
+		Time:    now,
+	})
+	return true
+}
+
+// Get returns a copy of the given token's info, or nil if it doesn't exist. Tokens that have
+// been used up or have expired are still returned for a while, so check usable() before
+// letting anyone in with it.
+func (itm *InviteTokenManager) Get(token string) *InviteToken {
+	itm.Lock()
+	defer itm.Unlock()
+	info := itm.tokens[strings.ToLower(token)]
+	if info == nil {
+		return nil
+	}
+	infoCopy := *info
+	infoCopy.Uses = append([]InviteTokenUse(nil), info.Uses...)
+	return &infoCopy
+}
+
+// listNoMutex returns the channel's tokens, oldest first. The lock must be held.
+func (itm *InviteTokenManager) listNoMutex(channel string) []*InviteToken {
+	var tokens []*InviteToken
+	for _, info := range itm.tokens {
+		if info.Channel == channel {
+			tokens = append(tokens, info)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens
+}
+
+// List returns copies of the channel's tokens, oldest first.
+func (itm *InviteTokenManager) List(channel string) []InviteToken {
+	itm.Lock()
+	defer itm.Unlock()
+	itm.pruneNoMutex(time.Now())
+	var tokens []InviteToken
+	for _, info := range itm.listNoMutex(channel) {
+		infoCopy := *info
+		infoCopy.Uses = append([]InviteTokenUse(nil), info.Uses...)
+		tokens = append(tokens, infoCopy)
+	}
+	return tokens
+}
+
+// Revoke removes the given token from the channel, returning false if it doesn't exist.
+func (itm *InviteTokenManager) Revoke(token, channel string) bool {
+	itm.Lock()
+	defer itm.Unlock()
+	token = strings.ToLower(token)
+	info := itm.tokens[token]
+	if info == nil || info.Channel != channel {
+		return false
+	}
+	delete(itm.tokens, token)
+	return true
+}
+
+// describeInviteToken returns a short description of the token's limits.
+func describeInviteToken(info *InviteToken) string {
+	uses := "unlimited uses"
+	if 0 < info.MaxUses {
+		uses = fmt.Sprintf("%d of %d uses", len(info.Uses), info.MaxUses)
+	} else if 0 < len(info.Uses) {
+		uses = fmt.Sprintf("%d uses, unlimited", len(info.Uses))
+	}
+	expires := "never expires"
+	if !info.Expires.IsZero() {
+		verb := "expires"
+		if !time.Now().Before(info.Expires) {
+			verb = "expired"
+		}
+		expires = fmt.Sprintf("%s %s", verb, info.Expires.UTC().Format(time.RFC1123))
+	}
+	return fmt.Sprintf("%s, %s, made by %s", uses, expires, info.CreatedBy)
+}
+
+// INVITETOKEN <channel> [CREATE [<uses>] [<lifetime>] | LIST | INFO <token> | REVOKE <token>]
+func invitetokenHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	channelKey, err := CasefoldChannel(msg.Params[0])
+	channel := server.channels.Get(channelKey)
+	if err != nil || channel == nil {
+		rb.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, msg.Params[0], "No such channel")
+		return false
+	}
+	if !channel.ClientIsAtLeast(client, ChannelOperator) {
+		rb.Send(nil, server.name, ERR_CHANOPRIVSNEEDED, client.nick, channel.name, "You're not a channel operator")
+		return false
+	}
+
+	subcommand := "list"
+	if 1 < len(msg.Params) {
+		subcommand = strings.ToLower(msg.Params[1])
+	}
+
+	switch subcommand {
+	case "create":
+		maxUses := 1
+		lifetime := defaultInviteTokenLifetime
+		if 2 < len(msg.Params) {
+			maxUses, err = strconv.Atoi(msg.Params[2])
+			if err != nil || maxUses < 0 {
+				rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "INVITETOKEN", msg.Params[2], "Uses must be a number, or 0 for unlimited")
+				return false
+			}
+		}
+		if 3 < len(msg.Params) {
+			lifetime, err = custime.ParseDuration(msg.Params[3])
+			if err != nil || lifetime < 0 {
+				rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "INVITETOKEN", msg.Params[3], "Lifetime must be a duration like 2h30m, or 0 to never expire")
+				return false
+			}
+		}
+
+		info, err := server.inviteTokens.Create(channelKey, client.nick, maxUses, lifetime)
+		if err != nil {
+			rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "INVITETOKEN", channel.name, err.Error())
+			return false
+		}
+		rb.Notice(fmt.Sprintf("Created invite token %s for %s (%s). Use it with: /JOIN %s %s", info.Token, channel.name, describeInviteToken(info), channel.name, info.Token))
+	case "list":
+		tokens := server.inviteTokens.List(channelKey)
+		if len(tokens) == 0 {
+			rb.Notice(fmt.Sprintf("%s has no invite tokens", channel.name))
+			return false
+		}
+		rb.Notice(fmt.Sprintf("Invite tokens for %s:", channel.name))
+		for _, info := range tokens {
+			rb.Notice(fmt.Sprintf("%s: %s", info.Token, describeInviteToken(&info)))
+		}
+	case "info":
+		if len(msg.Params) < 3 {
+			rb.Send(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, "INVITETOKEN", "Not enough parameters")
+			return false
+		}
+		info := server.inviteTokens.Get(msg.Params[2])
+		if info == nil || info.Channel != channelKey {
+			rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "INVITETOKEN", msg.Params[2], "No such invite token")
+			return false
+		}
+		rb.Notice(fmt.Sprintf("%s: %s", info.Token, describeInviteToken(info)))
+		for _, use := range info.Uses {
+			rb.Notice(fmt.Sprintf("Used by %s (account %s) at %s", use.Nick, use.Account, use.Time.UTC().Format(time.RFC1123)))
+		}
+	case "revoke":
+		if len(msg.Params) < 3 {
+			rb.Send(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, "INVITETOKEN", "Not enough parameters")
+			return false
+		}
+		if !server.inviteTokens.Revoke(msg.Params[2], channelKey) {
+			rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "INVITETOKEN", msg.Params[2], "No such invite token")
+			return false
+		}
+		rb.Notice(fmt.Sprintf("Revoked invite token %s", msg.Params[2]))
+	default:
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "INVITETOKEN", msg.Params[1], "Subcommand must be CREATE, LIST, INFO or REVOKE")
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultInviteExpiry = time.Hour
+
+	// these are the channels where only channel operators can INVITE
+	invitesOpsOnlyInviteOnly = "invite-only"
+	invitesOpsOnlyAlways     = "always"
+	invitesOpsOnlyNever      = "never"
+)
+
+// InvitesConfig controls who can INVITE people to channels, how long invites last, and who
+// has to put up with receiving them.
+type InvitesConfig struct {
+	// OpsOnly is where only channel operators can INVITE: invite-only (+i) channels, all
+	// channels, or never.
+	OpsOnly string `yaml:"ops-only"`
+	// Expiry is how long an invite to a +i channel can be used for.
+	ExpiryString string        `yaml:"expiry"`
+	Expiry       time.Duration `yaml:"expiry-real"`
+	// RespectCallerID drops invites to +g users from people they haven't accepted.
+	RespectCallerID bool `yaml:"respect-callerid"`
+}
+
+// load checks the config and parses the expiry.
+func (conf *InvitesConfig) load() (err error) {
+	switch conf.OpsOnly {
+	case "":
+		conf.OpsOnly = invitesOpsOnlyInviteOnly
+	case invitesOpsOnlyInviteOnly, invitesOpsOnlyAlways, invitesOpsOnlyNever:
+	default:
+		return fmt.Errorf("Unknown ops-only setting %s, it must be invite-only, always or never", conf.OpsOnly)
+	}
+	conf.Expiry = defaultInviteExpiry
+	if conf.ExpiryString != "" {
+		conf.Expiry, err = time.ParseDuration(conf.ExpiryString)
+		if err != nil {
+			return fmt.Errorf("Could not parse expiry: %s", err.Error())
+		}
+		if conf.Expiry <= 0 {
+			return errors.New("expiry must be positive")
+		}
+	}
+	return nil
+}
+
+// opsOnly returns true if only channel operators can INVITE people to the channel.
+func (conf *InvitesConfig) opsOnly(channel *Channel) bool {
+	switch conf.OpsOnly {
+	case invitesOpsOnlyAlways:
+		return true
+	case invitesOpsOnlyNever:
+		return false
+	}
+	return channel.flags[InviteOnly]
+}
+
+// acceptsInviteFrom returns true if the client wants to hear about invites from the inviter,
+// taking their SILENCE list and caller-ID mode into account.
+func (client *Client) acceptsInviteFrom(inviter *Client) bool {
+	if inviter == client || inviter.hasFlag(Operator) {
+		return true
+	}
+	if client.ignores.IsSilenced(inviter.nickMaskCasefolded) {
+		return false
+	}
+	if client.server.channelInvites.RespectCallerID && client.hasFlag(CallerID) && !client.ignores.IsAccepted(inviter.nickCasefolded) {
+		inviter.Send(nil, client.server.name, RPL_TARGUMODEG, inviter.nick, client.nick, "is in +g mode (server-side ignore)")
+		return false
+	}
+	return true
+}
+
+// addInvite lets the client join the channel past +i until the invite expires.
+func (channel *Channel) addInvite(client *Client, expiry time.Duration) {
+	channel.invitesMutex.Lock()
+	defer channel.invitesMutex.Unlock()
+
+	now := time.Now()
+	for invitee, expires := range channel.invites {
+		if expires.Before(now) {
+			delete(channel.invites, invitee)
+		}
+	}
+	channel.invites[client] = now.Add(expiry)
+}
+
+// hasInvite returns true if the client has an invite to the channel that hasn't expired.
+func (channel *Channel) hasInvite(client *Client) bool {
+	channel.invitesMutex.Lock()
+	defer channel.invitesMutex.Unlock()
+
+	expires, exists := channel.invites[client]
+	if exists && expires.Before(time.Now()) {
+		delete(channel.invites, client)
+		return false
+	}
+	return exists
+}
+
+// removeInvite uses up the client's invite to the channel.
+func (channel *Channel) removeInvite(client *Client) {
+	channel.invitesMutex.Lock()
+	delete(channel.invites, client)
+	channel.invitesMutex.Unlock()
+}
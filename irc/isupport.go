@@ -138,9 +138,9 @@ func (il *ISupportList) RegenerateCachedReply() {
 }
 
 // RplISupport outputs our ISUPPORT lines to the client. This is used on connection and in VERSION responses.
-func (client *Client) RplISupport() {
+func (client *Client) RplISupport(rb *ResponseBuffer) {
 	for _, tokenline := range client.server.isupport.CachedReply {
 		// ugly trickery ahead
-		client.Send(nil, client.server.name, RPL_ISUPPORT, append([]string{client.nick}, tokenline...)...)
+		rb.Send(nil, client.server.name, RPL_ISUPPORT, append([]string{client.nick}, tokenline...)...)
 	}
 }
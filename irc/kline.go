@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/goshuirc/irc-go/ircfmt"
@@ -24,12 +25,17 @@ const (
 
 // KLineInfo contains the address itself and expiration time for a given network.
 type KLineInfo struct {
+	// Matches is how many clients the ban has matched since it was added or loaded. It must
+	// be accessed atomically, so it comes first to keep it 64-bit aligned on 32-bit platforms.
+	Matches uint64
 	// Mask that is blocked.
 	Mask string
 	// Matcher, to facilitate fast matching.
 	Matcher ircmatch.Matcher
 	// Info contains information on the ban.
 	Info IPBanInfo
+	// Since is when the ban was added or loaded.
+	Since time.Time
 }
 
 // KLineManager manages and klines.
@@ -57,7 +63,7 @@ func (km *KLineManager) AllBans() map[string]IPBanInfo {
 }
 
 // AddMask adds to the blocked list.
-func (km *KLineManager) AddMask(mask string, length *IPRestrictTime, reason string, operReason string) {
+func (km *KLineManager) AddMask(mask string, length *IPRestrictTime, reason string, operReason string, observe bool) {
 	kln := KLineInfo{
 		Mask:    mask,
 		Matcher: ircmatch.MakeMatch(mask),
@@ -65,7 +71,9 @@ func (km *KLineManager) AddMask(mask string, length *IPRestrictTime, reason stri
 			Time:       length,
 			Reason:     reason,
 			OperReason: operReason,
+			Observe:    observe,
 		},
+		Since: time.Now(),
 	}
 	km.entries[mask] = &kln
 }
@@ -76,11 +84,15 @@ func (km *KLineManager) RemoveMask(mask string) {
 }
 
 // CheckMasks returns whether or not the hostmask(s) are banned, and how long they are banned for.
+// Observed K-Lines never ban anyone.
 func (km *KLineManager) CheckMasks(masks ...string) (isBanned bool, info *IPBanInfo) {
 	// check networks
 	var masksToRemove []string
 
 	for _, entryInfo := range km.entries {
+		if entryInfo.Info.Observe {
+			continue
+		}
 		var matches bool
 		for _, mask := range masks {
 			if entryInfo.Matcher.Match(mask) {
@@ -113,11 +125,45 @@ func (km *KLineManager) CheckMasks(masks ...string) (isBanned bool, info *IPBanI
 	return false, nil
 }
 
-// KLINE [ANDKILL] [MYSELF] [duration] <mask> [ON <server>] [reason [| oper reason]]
-func klineHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+// ObserveMasks counts a match against each observed K-Line that covers the hostmask(s), and
+// returns the masks of those K-Lines.
+func (km *KLineManager) ObserveMasks(masks ...string) (matched []string) {
+	for _, entryInfo := range km.entries {
+		if !entryInfo.Info.Observe || (entryInfo.Info.Time != nil && entryInfo.Info.Time.IsExpired()) {
+			continue
+		}
+		for _, mask := range masks {
+			if entryInfo.Matcher.Match(mask) {
+				atomic.AddUint64(&entryInfo.Matches, 1)
+				matched = append(matched, entryInfo.Mask)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// Observed returns the observed K-Lines, sorted by mask.
+func (km *KLineManager) Observed() (observed []*KLineInfo) {
+	for _, entryInfo := range km.entries {
+		if entryInfo.Info.Observe {
+			observed = append(observed, entryInfo)
+		}
+	}
+	sort.Slice(observed, func(i, j int) bool {
+		return observed[i].Mask < observed[j].Mask
+	})
+	return observed
+}
+
+// KLINE [ANDKILL] [MYSELF] [OBSERVE] [duration] <mask> [ON <server>] [reason [| oper reason]]
+func klineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	// check oper permissions
 	if !client.class.Capabilities["oper:local_ban"] {
-		client.Send(nil, server.name, ERR_NOPRIVS, client.nick, msg.Command, "Insufficient oper privs")
+		rb.Send(nil, server.name, ERR_NOPRIVS, client.nick, msg.Command, "Insufficient oper privs")
+		return false
+	}
+	if !server.checkWritable(client, msg.Command, rb) {
 		return false
 	}
 
@@ -138,6 +184,18 @@ func klineHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 		currentArg++
 	}
 
+	// "KLINE OBSERVE" adds a ban that only logs and counts the clients it would have banned,
+	// so opers can see how many people it'd hit before enforcing it
+	var observe bool
+	if len(msg.Params) > currentArg+1 && strings.ToLower(msg.Params[currentArg]) == "observe" {
+		observe = true
+		currentArg++
+	}
+	if observe && andKill {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, "Observed K-Lines don't kill anyone, set it again without OBSERVE to enforce it")
+		return false
+	}
+
 	// duration
 	duration, err := custime.ParseDuration(msg.Params[currentArg])
 	durationIsUsed := err == nil
@@ -147,31 +205,24 @@ func klineHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 
 	// get mask
 	if len(msg.Params) < currentArg+1 {
-		client.Send(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, msg.Command, "Not enough parameters")
+		rb.Send(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, msg.Command, "Not enough parameters")
 		return false
 	}
-	mask := strings.ToLower(msg.Params[currentArg])
+	mask := canonicalizeKLineMask(strings.ToLower(msg.Params[currentArg]))
 	currentArg++
 
-	// check mask
-	if !strings.Contains(mask, "!") && !strings.Contains(mask, "@") {
-		mask = mask + "!*@*"
-	} else if !strings.Contains(mask, "@") {
-		mask = mask + "@*"
-	}
-
 	matcher := ircmatch.MakeMatch(mask)
 
 	for _, clientMask := range client.AllNickmasks() {
-		if !klineMyself && matcher.Match(clientMask) {
-			client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, "This ban matches you. To KLINE yourself, you must use the command:  /KLINE MYSELF <arguments>")
+		if !klineMyself && !observe && matcher.Match(clientMask) {
+			rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, "This ban matches you. To KLINE yourself, you must use the command:  /KLINE MYSELF <arguments>")
 			return false
 		}
 	}
 
 	// check remote
 	if len(msg.Params) > currentArg && msg.Params[currentArg] == "ON" {
-		client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, "Remote servers not yet supported")
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, "Remote servers not yet supported")
 		return false
 	}
 
@@ -202,40 +253,21 @@ func klineHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 		}
 	}
 
-	info := IPBanInfo{
-		Reason:     reason,
-		OperReason: operReason,
-		Time:       banTime,
-	}
-
-	// save in datastore
-	err = server.store.Update(func(tx *buntdb.Tx) error {
-		klineKey := fmt.Sprintf(keyKlineEntry, mask)
-
-		// assemble json from ban info
-		b, err := json.Marshal(info)
-		if err != nil {
-			return err
-		}
-
-		tx.Set(klineKey, string(b), nil)
-
-		return nil
-	})
-
+	err = server.addKLine(mask, banTime, reason, operReason, observe)
 	if err != nil {
-		client.Notice(fmt.Sprintf("Could not successfully save new K-LINE: %s", err.Error()))
+		rb.Notice(fmt.Sprintf("Could not successfully save new K-LINE: %s", err.Error()))
 		return false
 	}
 
-	server.klines.AddMask(mask, banTime, reason, operReason)
-
 	var snoDescription string
-	if durationIsUsed {
-		client.Notice(fmt.Sprintf("Added temporary (%s) K-Line for %s", duration.String(), mask))
+	if observe {
+		rb.Notice(fmt.Sprintf("Observing K-Line for %s, it currently matches %d clients. See RULEREPORT for its matches", mask, server.countKLineMatches(matcher)))
+		snoDescription = fmt.Sprintf(ircfmt.Unescape("%s$r added observed K-Line for %s"), client.nick, mask)
+	} else if durationIsUsed {
+		rb.Notice(fmt.Sprintf("Added temporary (%s) K-Line for %s", duration.String(), mask))
 		snoDescription = fmt.Sprintf(ircfmt.Unescape("%s$r added temporary (%s) K-Line for %s"), client.nick, duration.String(), mask)
 	} else {
-		client.Notice(fmt.Sprintf("Added K-Line for %s", mask))
+		rb.Notice(fmt.Sprintf("Added K-Line for %s", mask))
 		snoDescription = fmt.Sprintf(ircfmt.Unescape("%s$r added K-Line for %s"), client.nick, mask)
 	}
 	server.snomasks.Send(sno.LocalXline, snoDescription)
@@ -258,6 +290,9 @@ func klineHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 
 		for _, mcl := range clientsToKill {
 			mcl.exitedSnomaskSent = true
+			if server.historyRetraction.OnBan {
+				server.retractRecentMessages(mcl, fmt.Sprintf("Banned (%s)", reason))
+			}
 			mcl.Quit(fmt.Sprintf("You have been banned from this server (%s)", reason))
 			if mcl == client {
 				killClient = true
@@ -275,23 +310,73 @@ func klineHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 	return killClient
 }
 
-func unKLineHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func unKLineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	// check oper permissions
 	if !client.class.Capabilities["oper:local_unban"] {
-		client.Send(nil, server.name, ERR_NOPRIVS, client.nick, msg.Command, "Insufficient oper privs")
+		rb.Send(nil, server.name, ERR_NOPRIVS, client.nick, msg.Command, "Insufficient oper privs")
+		return false
+	}
+	if !server.checkWritable(client, msg.Command, rb) {
 		return false
 	}
 
 	// get host
-	mask := msg.Params[0]
+	mask := canonicalizeKLineMask(msg.Params[0])
+
+	err := server.removeKLine(mask)
+	if err != nil {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, fmt.Sprintf("Could not remove ban [%s]", err.Error()))
+		return false
+	}
+
+	rb.Notice(fmt.Sprintf("Removed K-Line for %s", mask))
+	server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("%s$r removed K-Line for %s"), client.nick, mask))
+	return false
+}
 
+// canonicalizeKLineMask fills in the missing parts of a K-Line mask.
+func canonicalizeKLineMask(mask string) string {
 	if !strings.Contains(mask, "!") && !strings.Contains(mask, "@") {
 		mask = mask + "!*@*"
 	} else if !strings.Contains(mask, "@") {
 		mask = mask + "@*"
 	}
+	return mask
+}
+
+// addKLine saves a K-Line to the datastore and starts enforcing (or observing) it.
+func (server *Server) addKLine(mask string, banTime *IPRestrictTime, reason string, operReason string, observe bool) error {
+	info := IPBanInfo{
+		Reason:     reason,
+		OperReason: operReason,
+		Time:       banTime,
+		Observe:    observe,
+	}
 
 	// save in datastore
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		klineKey := fmt.Sprintf(keyKlineEntry, mask)
+
+		// assemble json from ban info
+		b, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+
+		tx.Set(klineKey, string(b), nil)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	server.klines.AddMask(mask, banTime, reason, operReason, observe)
+	return nil
+}
+
+// removeKLine removes a K-Line from the datastore and stops enforcing it.
+func (server *Server) removeKLine(mask string) error {
 	err := server.store.Update(func(tx *buntdb.Tx) error {
 		klineKey := fmt.Sprintf(keyKlineEntry, mask)
 
@@ -306,17 +391,12 @@ func unKLineHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool
 		tx.Delete(klineKey)
 		return nil
 	})
-
 	if err != nil {
-		client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, fmt.Sprintf("Could not remove ban [%s]", err.Error()))
-		return false
+		return err
 	}
 
 	server.klines.RemoveMask(mask)
-
-	client.Notice(fmt.Sprintf("Removed K-Line for %s", mask))
-	server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("%s$r removed K-Line for %s"), client.nick, mask))
-	return false
+	return nil
 }
 
 func (s *Server) loadKLines() {
@@ -335,7 +415,7 @@ func (s *Server) loadKLines() {
 			json.Unmarshal([]byte(value), &info)
 
 			// add to the server
-			s.klines.AddMask(mask, info.Time, info.Reason, info.OperReason)
+			s.klines.AddMask(mask, info.Time, info.Reason, info.OperReason, info.Observe)
 
 			return true // true to continue I guess?
 		})
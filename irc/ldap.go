@@ -0,0 +1,203 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/oragono/oragono/irc/sno"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	defaultLDAPTimeout = 5 * time.Second
+)
+
+var (
+	errLDAPNoUser = errors.New("No such user in the directory")
+)
+
+// LDAPConfig lets account logins be checked against an LDAP or Active Directory server,
+// instead of (or as well as) the passwords stored by the built-in registration.
+type LDAPConfig struct {
+	Enabled bool
+	// URL is the server to connect to, like ldaps://ldap.example.com
+	URL           string
+	StartTLS      bool           `yaml:"start-tls"`
+	SkipTLSVerify bool           `yaml:"skip-tls-verify"`
+	RootCA        string         `yaml:"root-ca"`
+	RootCAs       *x509.CertPool `yaml:"-"`
+	// serverName is the URL's host, which the server's certificate is checked against.
+	serverName    string
+	TimeoutString string        `yaml:"timeout"`
+	Timeout       time.Duration `yaml:"timeout-real"`
+
+	// BindDN and BindPassword are the service account used to look users up. If BindDN is
+	// blank, users are looked up anonymously.
+	BindDN       string `yaml:"bind-dn"`
+	BindPassword string `yaml:"bind-password"`
+	BaseDN       string `yaml:"base-dn"`
+	// UserFilter finds the user's entry, with %s replaced by their account name.
+	UserFilter string `yaml:"user-filter"`
+
+	// Autocreate makes a local account the first time someone logs in with the directory.
+	Autocreate bool
+}
+
+// load checks the config and loads the root CA, if there is one.
+func (conf *LDAPConfig) load() (err error) {
+	if !conf.Enabled {
+		return nil
+	}
+	if conf.URL == "" || conf.BaseDN == "" || conf.UserFilter == "" {
+		return errors.New("url, base-dn and user-filter must be set")
+	}
+	serverURL, err := url.Parse(conf.URL)
+	if err != nil || serverURL.Hostname() == "" {
+		return fmt.Errorf("Could not parse url [%s]", conf.URL)
+	}
+	conf.serverName = serverURL.Hostname()
+	conf.Timeout = defaultLDAPTimeout
+	if conf.TimeoutString != "" {
+		conf.Timeout, err = time.ParseDuration(conf.TimeoutString)
+		if err != nil {
+			return fmt.Errorf("Could not parse timeout: %s", err.Error())
+		}
+	}
+	if conf.RootCA != "" {
+		pem, err := ioutil.ReadFile(conf.RootCA)
+		if err != nil {
+			return fmt.Errorf("Could not read root-ca: %s", err.Error())
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return errors.New("root-ca has no certificates in it")
+		}
+	}
+	return nil
+}
+
+// dial connects to the directory, and binds as the service account if there is one.
+func (conf *LDAPConfig) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         conf.serverName,
+		InsecureSkipVerify: conf.SkipTLSVerify,
+		RootCAs:            conf.RootCAs,
+	}
+	conn, err := ldap.DialURL(conf.URL, ldap.DialWithDialer(&net.Dialer{Timeout: conf.Timeout}), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(conf.Timeout)
+
+	if conf.StartTLS {
+		err = conn.StartTLS(tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if conf.BindDN != "" {
+		err = conn.Bind(conf.BindDN, conf.BindPassword)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// authenticate checks the given account name and password against the directory.
+func (conf *LDAPConfig) authenticate(accountName, password string) error {
+	// an empty password would be an unauthenticated bind, which always succeeds
+	if password == "" {
+		return errSaslFail
+	}
+
+	conn, err := conf.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	search := ldap.NewSearchRequest(
+		conf.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(conf.Timeout/time.Second), false,
+		fmt.Sprintf(conf.UserFilter, ldap.EscapeFilter(accountName)),
+		[]string{"dn"}, nil,
+	)
+	result, err := conn.Search(search)
+	if err != nil {
+		return err
+	}
+	if len(result.Entries) != 1 {
+		return errLDAPNoUser
+	}
+
+	err = conn.Bind(result.Entries[0].DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return errSaslFail
+	}
+	return err
+}
+
+// ldapAuthenticate returns true if the directory accepts the given account name and password.
+// Problems talking to the directory are logged, and count as a failure.
+func (server *Server) ldapAuthenticate(accountName, password string) bool {
+	config := server.ldap
+	if !config.Enabled {
+		return false
+	}
+	err := config.authenticate(accountName, password)
+	if err == nil {
+		return true
+	}
+	if err != errSaslFail && err != errLDAPNoUser {
+		server.logger.Error("accounts", fmt.Sprintf("Could not check login for %s with LDAP: %s", accountName, err.Error()))
+	}
+	return false
+}
+
+// ldapLoginToAccount logs the client into the given account after the directory has accepted
+// their password, creating the account if it doesn't exist yet and that's allowed.
+func (server *Server) ldapLoginToAccount(tx *buntdb.Tx, client *Client, accountKey, accountName string) error {
+	_, err := tx.Get(fmt.Sprintf(keyAccountExists, accountKey))
+	if err == buntdb.ErrNotFound {
+		if !server.ldap.Autocreate || server.isReadOnly() || accountNameTaken(tx, accountKey) {
+			return errSaslFail
+		}
+		// the password stays in the directory, this account can only be used through it
+		err = createPasswordlessAccount(tx, accountKey, accountName)
+		if err != nil {
+			return err
+		}
+
+		server.logger.Info("accounts", fmt.Sprintf("Created account %s from LDAP", accountName))
+		server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Account $c[grey][$r%s$c[grey]] created from LDAP"), accountName))
+	} else if err != nil {
+		return err
+	}
+
+	_, err = tx.Get(fmt.Sprintf(keyAccountVerified, accountKey))
+	if err != nil {
+		return errSaslFail
+	}
+	if loadAccountSuspension(tx, accountKey) != nil {
+		return errAccountSuspended
+	}
+	account, exists := server.getAccount(accountKey)
+	if !exists {
+		account = loadAccount(server, tx, accountKey)
+	}
+	client.LoginToAccount(account)
+	return nil
+}
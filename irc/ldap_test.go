@@ -0,0 +1,38 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+)
+
+func TestLDAPConfigServerName(t *testing.T) {
+	cases := []struct {
+		url        string
+		serverName string
+		valid      bool
+	}{
+		{"ldaps://ldap.example.com", "ldap.example.com", true},
+		{"ldap://ldap.example.com:389", "ldap.example.com", true},
+		{"ldaps://[2001:db8::1]:636", "2001:db8::1", true},
+		{"ldap.example.com", "", false},
+		{"ldaps://", "", false},
+	}
+	for _, c := range cases {
+		conf := LDAPConfig{
+			Enabled:    true,
+			URL:        c.url,
+			BaseDN:     "dc=example,dc=com",
+			UserFilter: "(uid=%s)",
+		}
+		err := conf.load()
+		if (err == nil) != c.valid {
+			t.Errorf("%q: expected valid to be %v, got error %v", c.url, c.valid, err)
+			continue
+		}
+		if conf.serverName != c.serverName {
+			t.Errorf("%q: expected server name %q, got %q", c.url, c.serverName, conf.serverName)
+		}
+	}
+}
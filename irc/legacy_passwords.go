@@ -0,0 +1,382 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var (
+	errLegacyHashMismatch    = errors.New("Password does not match the imported hash")
+	errLegacyHashUnsupported = errors.New("Unsupported imported password hash")
+)
+
+const (
+	// cryptAlphabet is the base64 alphabet used by crypt(3).
+	cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	// atheme's crypto/pbkdf2 module stores a 16-character salt followed by the hex
+	// PBKDF2-HMAC-SHA512 digest, with a fixed iteration count.
+	athemePBKDF2SaltLen    = 16
+	athemePBKDF2Iterations = 128000
+)
+
+// legacyHashChecker returns a func that checks passwords against a hash imported from other
+// services, or nil if it's not in a format we support. The hash is parsed straight away, so
+// this is also a cheap way to find out whether it's supported.
+//
+// Supported are bcrypt, the MD5, SHA-256 and SHA-512 crypt(3) formats, and the formats of
+// atheme's crypto/pbkdf2 and crypto/pbkdf2v2 modules.
+func legacyHashChecker(hash string) func(password string) error {
+	switch {
+	case strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$"):
+		return func(password string) error {
+			if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+				return errLegacyHashMismatch
+			}
+			return nil
+		}
+	case strings.HasPrefix(hash, "$1$"):
+		return cryptHashChecker(hash, md5Crypt)
+	case strings.HasPrefix(hash, "$5$"):
+		return cryptHashChecker(hash, func(password, salt []byte, rounds int) string {
+			return shaCrypt(sha256.New, sha256CryptOrder, password, salt, rounds)
+		})
+	case strings.HasPrefix(hash, "$6$"):
+		return cryptHashChecker(hash, func(password, salt []byte, rounds int) string {
+			return shaCrypt(sha512.New, sha512CryptOrder, password, salt, rounds)
+		})
+	case strings.HasPrefix(hash, "$z$"):
+		return athemePBKDF2V2Checker(hash)
+	case len(hash) == athemePBKDF2SaltLen+2*sha512.Size:
+		digest, err := hex.DecodeString(hash[athemePBKDF2SaltLen:])
+		if err != nil {
+			return nil
+		}
+		salt := []byte(hash[:athemePBKDF2SaltLen])
+		return func(password string) error {
+			key := pbkdf2.Key([]byte(password), salt, athemePBKDF2Iterations, sha512.Size, sha512.New)
+			return compareLegacyDigest(key, digest)
+		}
+	}
+	return nil
+}
+
+// legacyHashSupported returns true if we can check passwords against the imported hash.
+func legacyHashSupported(hash string) bool {
+	return legacyHashChecker(hash) != nil
+}
+
+// checkLegacyHash checks the password against a hash imported from other services.
+func checkLegacyHash(hash, password string) error {
+	checker := legacyHashChecker(hash)
+	if checker == nil {
+		return errLegacyHashUnsupported
+	}
+	return checker(password)
+}
+
+// compareLegacyDigest compares the digest of the given password with the stored one.
+func compareLegacyDigest(computed, stored []byte) error {
+	if subtle.ConstantTimeCompare(computed, stored) != 1 {
+		return errLegacyHashMismatch
+	}
+	return nil
+}
+
+// cryptHashChecker returns a func that checks passwords against a crypt(3) hash, formatted
+// like $<id>$[rounds=<rounds>$]<salt>$<digest>, or nil if it's malformed.
+func cryptHashChecker(hash string, crypt func(password, salt []byte, rounds int) string) func(password string) error {
+	fields := strings.Split(hash, "$")
+	rounds := 0
+	if 3 <= len(fields) && strings.HasPrefix(fields[2], "rounds=") {
+		var err error
+		rounds, err = strconv.Atoi(strings.TrimPrefix(fields[2], "rounds="))
+		if err != nil || rounds < 1 {
+			return nil
+		}
+		fields = append(fields[:2], fields[3:]...)
+	}
+	if len(fields) != 4 || fields[3] == "" {
+		return nil
+	}
+	salt, digest := []byte(fields[2]), []byte(fields[3])
+	return func(password string) error {
+		return compareLegacyDigest([]byte(crypt([]byte(password), salt, rounds)), digest)
+	}
+}
+
+// cryptBase64 encodes up to three bytes into n characters of crypt(3)'s base64.
+func cryptBase64(out []byte, b2, b1, b0 byte, n int) []byte {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; 0 < n; n-- {
+		out = append(out, cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+	return out
+}
+
+// md5Crypt returns the digest part of an MD5 crypt(3) hash, $1$. There's no rounds setting.
+func md5Crypt(password, salt []byte, rounds int) string {
+	if 8 < len(salt) {
+		salt = salt[:8]
+	}
+
+	alternate := md5.New()
+	alternate.Write(password)
+	alternate.Write(salt)
+	alternate.Write(password)
+	alternateSum := alternate.Sum(nil)
+
+	h := md5.New()
+	h.Write(password)
+	h.Write([]byte("$1$"))
+	h.Write(salt)
+	for i := len(password); 0 < i; i -= md5.Size {
+		if i < md5.Size {
+			h.Write(alternateSum[:i])
+		} else {
+			h.Write(alternateSum)
+		}
+	}
+	for i := len(password); i != 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(password[:1])
+		}
+	}
+	sum := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(password)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write(salt)
+		}
+		if i%7 != 0 {
+			h.Write(password)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(password)
+		}
+		sum = h.Sum(nil)
+	}
+
+	var out []byte
+	for i := 0; i+2 < len(md5CryptOrder); i += 3 {
+		out = cryptBase64(out, sum[md5CryptOrder[i]], sum[md5CryptOrder[i+1]], sum[md5CryptOrder[i+2]], 4)
+	}
+	return string(cryptBase64(out, 0, 0, sum[11], 2))
+}
+
+// md5CryptOrder, sha256CryptOrder and sha512CryptOrder are the orders that crypt(3) encodes
+// the bytes of the final digest in, three at a time. The bytes left over are encoded last.
+var (
+	md5CryptOrder = []int{
+		0, 6, 12, 1, 7, 13, 2, 8, 14, 3, 9, 15, 4, 10, 5,
+	}
+	sha256CryptOrder = []int{
+		0, 10, 20, 21, 1, 11, 12, 22, 2, 3, 13, 23, 24, 4, 14,
+		15, 25, 5, 6, 16, 26, 27, 7, 17, 18, 28, 8, 9, 19, 29,
+	}
+	sha512CryptOrder = []int{
+		0, 21, 42, 22, 43, 1, 44, 2, 23, 3, 24, 45, 25, 46, 4,
+		47, 5, 26, 6, 27, 48, 28, 49, 7, 50, 8, 29, 9, 30, 51,
+		31, 52, 10, 53, 11, 32, 12, 33, 54, 34, 55, 13, 56, 14, 35,
+		15, 36, 57, 37, 58, 16, 59, 17, 38, 18, 39, 60, 40, 61, 19,
+		62, 20, 41,
+	}
+)
+
+// shaCrypt returns the digest part of a SHA-256 or SHA-512 crypt(3) hash, $5$ or $6$. A
+// rounds of 0 means the default.
+func shaCrypt(newHash func() hash.Hash, order []int, password, salt []byte, rounds int) string {
+	if 16 < len(salt) {
+		salt = salt[:16]
+	}
+	if rounds == 0 {
+		rounds = 5000
+	} else if rounds < 1000 {
+		rounds = 1000
+	} else if 999999999 < rounds {
+		rounds = 999999999
+	}
+
+	alternate := newHash()
+	alternate.Write(password)
+	alternate.Write(salt)
+	alternate.Write(password)
+	alternateSum := alternate.Sum(nil)
+	size := len(alternateSum)
+
+	h := newHash()
+	h.Write(password)
+	h.Write(salt)
+	i := len(password)
+	for ; size < i; i -= size {
+		h.Write(alternateSum)
+	}
+	h.Write(alternateSum[:i])
+	for i := len(password); 0 < i; i >>= 1 {
+		if i&1 != 0 {
+			h.Write(alternateSum)
+		} else {
+			h.Write(password)
+		}
+	}
+	sum := h.Sum(nil)
+
+	// P and S are the password and salt, replaced by bytes of hashes of themselves
+	h = newHash()
+	for i := 0; i < len(password); i++ {
+		h.Write(password)
+	}
+	p := repeatBytes(h.Sum(nil), len(password))
+	h = newHash()
+	for i := 0; i < 16+int(sum[0]); i++ {
+		h.Write(salt)
+	}
+	s := repeatBytes(h.Sum(nil), len(salt))
+
+	for i := 0; i < rounds; i++ {
+		h := newHash()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(p)
+		}
+		sum = h.Sum(nil)
+	}
+
+	var out []byte
+	for i := 0; i+2 < len(order); i += 3 {
+		out = cryptBase64(out, sum[order[i]], sum[order[i+1]], sum[order[i+2]], 4)
+	}
+	if size == sha256.Size {
+		return string(cryptBase64(out, 0, sum[31], sum[30], 3))
+	}
+	return string(cryptBase64(out, 0, 0, sum[63], 2))
+}
+
+// repeatBytes repeats the bytes until they're the given length.
+func repeatBytes(b []byte, length int) []byte {
+	out := make([]byte, 0, length)
+	for len(out) < length {
+		remaining := length - len(out)
+		if remaining < len(b) {
+			out = append(out, b[:remaining]...)
+		} else {
+			out = append(out, b...)
+		}
+	}
+	return out
+}
+
+// athemePRF is one of the PRFs that atheme's crypto/pbkdf2v2 module can use.
+type athemePRF struct {
+	newHash func() hash.Hash
+	// base64Salt is set if the salt is stored base64-encoded, rather than used as it is.
+	base64Salt bool
+	// scram is set if the SCRAM ServerKey and StoredKey are stored instead of the digest.
+	scram bool
+}
+
+// athemePRFs are the PRFs supported by atheme's crypto/pbkdf2v2 module, by their number.
+var athemePRFs = map[int]athemePRF{
+	4:  {sha1.New, false, false},
+	5:  {sha256.New, false, false},
+	6:  {sha512.New, false, false},
+	24: {sha1.New, true, false},
+	25: {sha256.New, true, false},
+	26: {sha512.New, true, false},
+	44: {sha1.New, true, true},
+	45: {sha256.New, true, true},
+	46: {sha512.New, true, true},
+}
+
+// athemePBKDF2V2Checker returns a func that checks passwords against a hash from atheme's
+// crypto/pbkdf2v2 module, formatted like $z$<prf>$<iterations>$<salt>$<digest>, or nil if
+// it's malformed. The SCRAM PRFs store $<server key>$<stored key> instead of the digest.
+func athemePBKDF2V2Checker(hash string) func(password string) error {
+	fields := strings.Split(hash, "$")
+	if len(fields) < 6 {
+		return nil
+	}
+	prfNumber, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil
+	}
+	prf, ok := athemePRFs[prfNumber]
+	if !ok || (prf.scram && len(fields) != 7) || (!prf.scram && len(fields) != 6) {
+		return nil
+	}
+	iterations, err := strconv.Atoi(fields[3])
+	if err != nil || iterations < 1 {
+		return nil
+	}
+	salt := []byte(fields[4])
+	if prf.base64Salt {
+		salt, err = base64.StdEncoding.DecodeString(fields[4])
+		if err != nil {
+			return nil
+		}
+	}
+	stored := make([][]byte, len(fields)-5)
+	for i, field := range fields[5:] {
+		stored[i], err = base64.StdEncoding.DecodeString(field)
+		if err != nil {
+			return nil
+		}
+	}
+
+	return func(password string) error {
+		key := pbkdf2.Key([]byte(password), salt, iterations, prf.newHash().Size(), prf.newHash)
+		if !prf.scram {
+			return compareLegacyDigest(key, stored[0])
+		}
+		mac := hmac.New(prf.newHash, key)
+		mac.Write([]byte("Server Key"))
+		serverKey := mac.Sum(nil)
+		mac = hmac.New(prf.newHash, key)
+		mac.Write([]byte("Client Key"))
+		storedKey := prf.newHash()
+		storedKey.Write(mac.Sum(nil))
+		if compareLegacyDigest(serverKey, stored[0]) != nil || compareLegacyDigest(storedKey.Sum(nil), stored[1]) != nil {
+			return errLegacyHashMismatch
+		}
+		return nil
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckLegacyHash(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		hash     string
+		password string
+	}{
+		{"bcrypt", string(bcryptHash), "hunter2"},
+		{"md5 crypt", "$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/", "password"},
+		{"md5 crypt, long password", "$1$ab$ZTj46kRB5W/DcsgaphZJd/", "a much longer password than sixteen bytes"},
+		{"sha256 crypt", "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world!"},
+		{"sha256 crypt, rounds", "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA", "Hello world!"},
+		{"sha512 crypt", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!"},
+		{"sha512 crypt, long password", "$6$toolongsaltstrin$NVirTZ5Tx83KBWrMdJj7m25lH6WwrhQ4R9qAV0J0gLry6QbqpVF2c1ug2zZppfp5mUof3mYnTz2U.kJD7UtOx1", "a much longer password than sixty-four bytes, which takes a few more blocks"},
+		{"atheme pbkdf2v2", "$z$6$10000$c2FsdHNhbHRzYWx0$Yqw7hnYHkSGEMqxpK+IbLvUyi4HYPvfz4MP2CEROU/mmYa7O8craTLnE/8nUUTG0pTe1yOV8K5vAy/Hh9Hn9PQ==", "hunter2"},
+		{"atheme pbkdf2v2, base64 salt", "$z$25$10000$MDEyMzQ1Njc4OWFiY2RlZg==$XV63uRH3+zky8O+EPkxs1/g/ERMHARqzto/fRpgt2AM=", "hunter2"},
+		{"atheme pbkdf2v2, scram", "$z$45$4096$MDEyMzQ1Njc4OWFiY2RlZg==$4t0aPsdm+OD8h/VVwxMjgry9wezSEEHf1L5kcG4VJsw=$HJFePfOAb1GWwyOATbgkhasVp3hFg6hYYE7eNrTx7UA=", "hunter2"},
+		{"atheme pbkdf2", "abcdefghijklmnop07a61746578ce6b027ded856ac9f9ff5fafe3fd8c5be855a77e8e669c1372857a4faa39c46215f385e4cfa2da978b6ce07f97a8052cec9b984c54319f9323f66", "hunter2"},
+	}
+	for _, c := range cases {
+		if !legacyHashSupported(c.hash) {
+			t.Errorf("%s: expected the hash to be supported", c.name)
+			continue
+		}
+		if err := checkLegacyHash(c.hash, c.password); err != nil {
+			t.Errorf("%s: expected the password to match, got %v", c.name, err)
+		}
+		if err := checkLegacyHash(c.hash, c.password+"x"); err != errLegacyHashMismatch {
+			t.Errorf("%s: expected the wrong password not to match, got %v", c.name, err)
+		}
+	}
+
+	for _, hash := range []string{
+		"",
+		"plaintext",
+		"$3$$8846f7eaee8fb117ad06bdd830b7586c",
+		"$5$saltstring",
+		"$5$rounds=many$salt$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5",
+		"$z$99$10000$c2FsdA==$ZGlnZXN0",
+		"$z$45$4096$MDEyMzQ1Njc4OWFiY2RlZg==$4t0aPsdm+OD8h/VVwxMjgry9wezSEEHf1L5kcG4VJsw=",
+		"$z$25$10000$not base64$XV63uRH3+zky8O+EPkxs1/g/ERMHARqzto/fRpgt2AM=",
+	} {
+		if legacyHashSupported(hash) {
+			t.Errorf("%q: expected the hash not to be supported", hash)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+const (
+	// InvalidUTF8Allow passes lines with invalid UTF-8 through untouched.
+	InvalidUTF8Allow = "allow"
+	// InvalidUTF8Reject rejects lines that contain invalid UTF-8.
+	InvalidUTF8Reject = "reject"
+	// InvalidUTF8Strip removes invalid UTF-8 sequences from lines.
+	InvalidUTF8Strip = "strip"
+	// InvalidUTF8Replace replaces invalid UTF-8 sequences with the unicode replacement character.
+	InvalidUTF8Replace = "replace"
+
+	// UTF8OnlyReject rejects non-UTF-8 lines when in UTF8ONLY mode.
+	UTF8OnlyReject = "reject"
+	// UTF8OnlyTranscode converts non-UTF-8 lines to UTF-8 (assuming they're latin-1) when in UTF8ONLY mode.
+	UTF8OnlyTranscode = "transcode"
+)
+
+var (
+	errLineTooLong     = errors.New("Line is too long")
+	errLineTooManyTags = errors.New("Line has too many tags")
+	errLineInvalidUTF8 = errors.New("Line contains invalid UTF-8")
+	errLineInjection   = errors.New("Line contains NUL or CR characters")
+)
+
+// LineStats holds counts of the input lines we've rejected, by reason.
+// These must be accessed atomically.
+type LineStats struct {
+	TooLong     uint64
+	TooManyTags uint64
+	InvalidUTF8 uint64
+	Injection   uint64
+	Malformed   uint64
+}
+
+// record increments the counter for the given rejection reason.
+func (stats *LineStats) record(err error) {
+	switch err {
+	case errLineTooLong:
+		atomic.AddUint64(&stats.TooLong, 1)
+	case errLineTooManyTags:
+		atomic.AddUint64(&stats.TooManyTags, 1)
+	case errLineInvalidUTF8:
+		atomic.AddUint64(&stats.InvalidUTF8, 1)
+	case errLineInjection:
+		atomic.AddUint64(&stats.Injection, 1)
+	default:
+		atomic.AddUint64(&stats.Malformed, 1)
+	}
+}
+
+// LinePolicy controls how strictly we handle the lines that clients send us.
+type LinePolicy struct {
+	// Strict means clients are disconnected for sending bad lines, rather than just having them dropped.
+	Strict      bool
+	MaxTags     int
+	InvalidUTF8 string
+	// LongMessages is what we do with messages too long to relay to clients without maxline.
+	LongMessages string
+	// UTF8Only means we guarantee that every line we relay is valid UTF-8.
+	UTF8Only          bool
+	UTF8OnlyTranscode bool
+}
+
+// NewLinePolicy returns a new LinePolicy from the given config.
+func NewLinePolicy(config LineParsingConfig, utf8Config UTF8OnlyConfig) *LinePolicy {
+	return &LinePolicy{
+		Strict:            config.Mode != "lenient",
+		MaxTags:           config.MaxTags,
+		InvalidUTF8:       config.InvalidUTF8,
+		LongMessages:      config.LongMessages,
+		UTF8Only:          utf8Config.Enabled,
+		UTF8OnlyTranscode: utf8Config.NonUTF8 == UTF8OnlyTranscode,
+	}
+}
+
+// Sanitise checks a raw line before it gets parsed, and returns the line that should be
+// parsed instead (with invalid UTF-8 stripped or replaced, if configured).
+func (lp *LinePolicy) Sanitise(line string, maxlenTags, maxlenRest int) (string, error) {
+	// ircmsg enforces the exact limits when parsing, this just stops us spending
+	// time on lines that are obviously far too long
+	if len(line) > maxlenTags+maxlenRest {
+		return "", errLineTooLong
+	}
+
+	// Socket.Read strips the trailing CR/LF, so any that are left were injected
+	if strings.ContainsAny(line, "\x00\r") {
+		return "", errLineInjection
+	}
+
+	if utf8.ValidString(line) {
+		return line, nil
+	}
+
+	if lp.UTF8Only {
+		if lp.UTF8OnlyTranscode {
+			return transcodeLatin1(line), nil
+		}
+		return "", errLineInvalidUTF8
+	}
+
+	switch lp.InvalidUTF8 {
+	case InvalidUTF8Reject:
+		return "", errLineInvalidUTF8
+	case InvalidUTF8Strip:
+		return replaceInvalidUTF8(line, ""), nil
+	case InvalidUTF8Replace:
+		return replaceInvalidUTF8(line, string(utf8.RuneError)), nil
+	}
+	return line, nil
+}
+
+// replaceInvalidUTF8 replaces each run of invalid UTF-8 bytes in the given string.
+func replaceInvalidUTF8(str string, replacement string) string {
+	var buf bytes.Buffer
+	var lastInvalid bool
+	for i := 0; i < len(str); {
+		r, size := utf8.DecodeRuneInString(str[i:])
+		if r == utf8.RuneError && size == 1 {
+			if !lastInvalid {
+				buf.WriteString(replacement)
+			}
+			lastInvalid = true
+		} else {
+			buf.WriteString(str[i : i+size])
+			lastInvalid = false
+		}
+		i += size
+	}
+	return buf.String()
+}
+
+// transcodeLatin1 converts the given latin-1 string to UTF-8.
+func transcodeLatin1(str string) string {
+	runes := make([]rune, len(str))
+	for i := 0; i < len(str); i++ {
+		runes[i] = rune(str[i])
+	}
+	return string(runes)
+}
+
+// Check checks a parsed message against the policy.
+func (lp *LinePolicy) Check(msg ircmsg.IrcMessage) error {
+	if 0 < lp.MaxTags && lp.MaxTags < len(msg.Tags) {
+		return errLineTooManyTags
+	}
+	return nil
+}
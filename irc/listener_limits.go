@@ -0,0 +1,119 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+const (
+	// ListenerPriorityNormal is the default listener priority.
+	ListenerPriorityNormal = "normal"
+	// ListenerPriorityHigh listeners have their connections accepted before normal ones, and
+	// aren't held to the server's soft client limit. It's meant for staff or TLS-only ports
+	// that should keep working while the public ports are being flooded.
+	ListenerPriorityHigh = "high"
+)
+
+var (
+	listenerFullMsg      = ircmsg.MakeMessage(nil, "", "ERROR", "This port is full, please try again later or use another port")
+	listenerFullBytes, _ = listenerFullMsg.Line()
+)
+
+// loadLimits checks the listener's connection limit and priority.
+func (conf *ListenerConfig) loadLimits() error {
+	if conf.MaxConnections < 0 {
+		return fmt.Errorf("max-connections can't be negative")
+	}
+	switch conf.Priority {
+	case "":
+		conf.Priority = ListenerPriorityNormal
+	case ListenerPriorityNormal, ListenerPriorityHigh:
+	default:
+		return fmt.Errorf("priority must be %s or %s, not %s", ListenerPriorityNormal, ListenerPriorityHigh, conf.Priority)
+	}
+	return nil
+}
+
+// highPriority returns true if connections on this listener skip the queue.
+func (conf *ListenerConfig) highPriority() bool {
+	return conf != nil && conf.Priority == ListenerPriorityHigh
+}
+
+// requireSASL returns true if clients on the listener must log in with SASL to register.
+func (conf *ListenerConfig) requireSASL() bool {
+	return conf != nil && conf.RequireSASL
+}
+
+// ListenerConnections counts the open connections on each listener.
+type ListenerConnections struct {
+	sync.Mutex
+	counts map[string]int
+}
+
+// NewListenerConnections returns an empty ListenerConnections.
+func NewListenerConnections() *ListenerConnections {
+	return &ListenerConnections{
+		counts: make(map[string]int),
+	}
+}
+
+// Acquire counts a new connection on the given listener, returning false if the listener
+// already has the given number of connections. A limit of 0 means unlimited.
+func (lc *ListenerConnections) Acquire(addr string, limit int) bool {
+	lc.Lock()
+	defer lc.Unlock()
+	if 0 < limit && limit <= lc.counts[addr] {
+		return false
+	}
+	lc.counts[addr]++
+	return true
+}
+
+// Release stops counting a connection on the given listener.
+func (lc *ListenerConnections) Release(addr string) {
+	lc.Lock()
+	defer lc.Unlock()
+	lc.counts[addr]--
+	if lc.counts[addr] <= 0 {
+		delete(lc.counts, addr)
+	}
+}
+
+// Count returns how many connections are open on the given listener.
+func (lc *ListenerConnections) Count(addr string) int {
+	lc.Lock()
+	defer lc.Unlock()
+	return lc.counts[addr]
+}
+
+// countedConn is a connection that stops being counted against its listener once it closes.
+type countedConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	conns       *ListenerConnections
+	addr        string
+}
+
+// Close closes the connection, and releases its slot on the listener.
+func (conn *countedConn) Close() error {
+	conn.releaseOnce.Do(func() {
+		conn.conns.Release(conn.addr)
+	})
+	return conn.Conn.Close()
+}
+
+// queueConn passes a new connection to the server's main loop, ahead of the others if its
+// listener is high-priority.
+func (server *Server) queueConn(conn clientConn) {
+	if conn.Config.highPriority() {
+		server.priorityConns <- conn
+	} else {
+		server.newConns <- conn
+	}
+}
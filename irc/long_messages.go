@@ -0,0 +1,136 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+const (
+	// LongMessagesSplit splits long messages into several lines for clients without maxline.
+	LongMessagesSplit = "split"
+	// LongMessagesTruncate cuts long messages short for clients without maxline, and tags them.
+	LongMessagesTruncate = "truncate"
+	// LongMessagesReject refuses long messages, telling the sender with FAIL.
+	LongMessagesReject = "reject"
+
+	// truncatedTag marks messages that were cut short because they were too long.
+	truncatedTag = "oragono.io/truncated"
+)
+
+// SplitMessage represents a message that's been split for sending.
+type SplitMessage struct {
+	For512     []string
+	ForMaxLine string
+	// Truncated means For512 was cut short, rather than holding the whole message.
+	Truncated bool
+}
+
+// isGraphemeExtender returns true if the given rune is displayed as part of the character
+// before it, so text can't be cut just before it.
+func isGraphemeExtender(r rune) bool {
+	return unicode.Is(unicode.M, r) || unicode.Is(unicode.Variation_Selector, r) ||
+		r == '\u200d' || ('\U0001f3fb' <= r && r <= '\U0001f3ff')
+}
+
+// truncateGraphemes cuts the text down to at most maxBytes bytes, without splitting a UTF-8
+// sequence or separating a character from the combining characters after it.
+func truncateGraphemes(text string, maxBytes int) string {
+	if len(text) <= maxBytes {
+		return text
+	}
+	end := maxBytes
+	for 0 < end && !utf8.RuneStart(text[end]) {
+		end--
+	}
+	for 0 < end {
+		next, _ := utf8.DecodeRuneInString(text[end:])
+		last, size := utf8.DecodeLastRuneInString(text[:end])
+		if !isGraphemeExtender(next) && last != '\u200d' {
+			break
+		}
+		end -= size
+	}
+	return text[:end]
+}
+
+// splitGraphemes splits the text into lines of at most maxBytes bytes, at word boundaries
+// where it can and never in the middle of a character.
+func splitGraphemes(text string, maxBytes int) (lines []string) {
+	for maxBytes < len(text) {
+		line := truncateGraphemes(text, maxBytes)
+		if space := strings.LastIndexByte(line, ' '); maxBytes/2 < space {
+			line = line[:space+1]
+		}
+		if line == "" {
+			// a single character that's longer than the line, there's nothing better to do
+			_, size := utf8.DecodeRuneInString(text)
+			line = text[:size]
+		}
+		lines = append(lines, line)
+		text = text[len(line):]
+	}
+	return append(lines, text)
+}
+
+// relayLen returns how long a message from the client can be, for it to be relayed to the
+// given target in a 512-byte line.
+func (client *Client) relayLen(command, target string) int {
+	return relayLenFrom(client.nickMaskString, command, target)
+}
+
+// relayLenFrom returns the longest message that fits in one line sent with the given prefix.
+func relayLenFrom(prefix, command, target string) int {
+	// ":<nickmask> <command> <target> :<message>\r\n"
+	return 512 - len(prefix) - len(command) - len(target) - 7
+}
+
+// splitMessage prepares a PRIVMSG or NOTICE from the client for relaying to the target,
+// applying the long message policy for clients without maxline. It returns false if the
+// message should be refused.
+func (server *Server) splitMessage(client *Client, command, target, original string) (SplitMessage, bool) {
+	return server.splitMessageFrom(client.nickMaskString, command, target, original)
+}
+
+// splitMessageFrom is splitMessage for messages sent with the given prefix rather than a
+// client's own nickmask.
+func (server *Server) splitMessageFrom(prefix, command, target, original string) (SplitMessage, bool) {
+	newSplit := SplitMessage{
+		For512:     []string{original},
+		ForMaxLine: original,
+	}
+
+	maxBytes := relayLenFrom(prefix, command, target)
+	if len(original) <= maxBytes {
+		return newSplit, true
+	}
+
+	switch server.linePolicy.LongMessages {
+	case LongMessagesReject:
+		return newSplit, false
+	case LongMessagesTruncate:
+		newSplit.For512 = []string{truncateGraphemes(original, maxBytes)}
+		newSplit.Truncated = true
+	default:
+		newSplit.For512 = splitGraphemes(original, maxBytes)
+	}
+	return newSplit, true
+}
+
+// sendMessageTooLong tells the client their message to the target was refused for being
+// too long.
+func (client *Client) sendMessageTooLong(command, target string, rb *ResponseBuffer) {
+	rb.Send(nil, client.server.name, "FAIL", command, "MESSAGE_TOO_LONG", target, fmt.Sprintf("Message is too long, messages to %s can be at most %d bytes", target, client.relayLen(command, target)))
+}
+
+// SendSplitMsgFromClient sends an IRC PRIVMSG/NOTICE coming from a specific client.
+// Adds account-tag to the line as well.
+func (client *Client) SendSplitMsgFromClient(msgid string, from *Client, tags *map[string]ircmsg.TagValue, command, target string, message SplitMessage) {
+	NewResponseBuffer(client).SendSplitMsgFromClient(msgid, from, tags, command, target, message)
+}
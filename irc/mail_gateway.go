@@ -0,0 +1,399 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/oragono/oragono/irc/ratelimit"
+)
+
+const (
+	defaultMailGatewayMaxSize = 64 * 1024
+)
+
+var (
+	errMailNoText       = errors.New("The message has no plain text part")
+	errMailNoChannel    = errors.New("The channel for this address doesn't exist right now")
+	errMailRateLimited  = errors.New("Too many messages to this address, try again later")
+	errMailEmptyMessage = errors.New("The message is empty")
+)
+
+// MailGatewayConfig lets mail sent to some addresses be posted to channels, so things like
+// alerting systems that can only send email can still reach an ops channel. Mail is taken
+// with SMTP, usually handed over from your mail server or sent straight from the alerting
+// system.
+type MailGatewayConfig struct {
+	Enabled bool
+	Listen  string
+	// AllowedIPs are the IPs and networks that can connect to send mail. There's no login,
+	// so this should be your mail server or alerting system. Anyone can connect if it's empty.
+	AllowedIPs    []string `yaml:"allowed-ips"`
+	MaxSizeString string   `yaml:"max-size"`
+	MaxSize       uint64
+	Addresses     map[string]*MailGatewayAddressConfig
+
+	addresses  map[string]*MailGatewayAddressConfig
+	allowedIPs ipExemptions
+}
+
+// MailGatewayAddressConfig is an address that mail can be sent to, and where it's posted.
+type MailGatewayAddressConfig struct {
+	Channel string
+	// Nick is who the messages come from.
+	Nick    string
+	Privmsg bool
+	// AllowedSenders are who can send to this address, which can contain * and ? wildcards.
+	// Senders aren't verified, so this only stops mistakes, not someone who's trying.
+	AllowedSenders []string        `yaml:"allowed-senders"`
+	RateLimit      RateLimitConfig `yaml:"rate-limit"`
+
+	address string
+	channel string
+	senders []string
+	limiter *ratelimit.Keyed
+}
+
+// load checks the config and sets up each address.
+func (conf *MailGatewayConfig) load() (err error) {
+	if !conf.Enabled {
+		return nil
+	}
+	if conf.Listen == "" {
+		return errors.New("no listen address given")
+	}
+	conf.allowedIPs, err = parseExemptions(conf.AllowedIPs, nil)
+	if err != nil {
+		return fmt.Errorf("Could not parse allowed-ips: %s", err.Error())
+	}
+
+	conf.MaxSize = defaultMailGatewayMaxSize
+	if conf.MaxSizeString != "" {
+		conf.MaxSize, err = bytefmt.ToBytes(conf.MaxSizeString)
+		if err != nil {
+			return fmt.Errorf("Could not parse max-size: %s", err.Error())
+		}
+	}
+
+	conf.addresses = make(map[string]*MailGatewayAddressConfig)
+	for address, target := range conf.Addresses {
+		address = strings.ToLower(address)
+		if target == nil || !strings.Contains(address, "@") {
+			return fmt.Errorf("address %s is invalid", address)
+		}
+		if conf.addresses[address] != nil {
+			return fmt.Errorf("address %s is given more than once", address)
+		}
+		target.channel, err = CasefoldChannel(target.Channel)
+		if err != nil {
+			return fmt.Errorf("address %s has an invalid channel [%s]", address, target.Channel)
+		}
+		if _, err := CasefoldName(target.Nick); err != nil || strings.ContainsAny(target.Nick, "!@*?,:") {
+			return fmt.Errorf("address %s has an invalid nick [%s]", address, target.Nick)
+		}
+		target.senders = nil
+		for _, sender := range target.AllowedSenders {
+			mask := strings.ToLower(sender)
+			if _, err := path.Match(mask, ""); err != nil {
+				return fmt.Errorf("address %s has an invalid allowed sender [%s]", address, sender)
+			}
+			target.senders = append(target.senders, mask)
+		}
+		if 0 < target.RateLimit.Limit {
+			target.RateLimit.Window, err = time.ParseDuration(target.RateLimit.WindowString)
+			if err != nil {
+				return fmt.Errorf("Could not parse address %s rate-limit window: %s", address, err.Error())
+			}
+		}
+		target.address = address
+		target.limiter = newKeyedLimiter(target.RateLimit)
+		conf.addresses[address] = target
+	}
+	return nil
+}
+
+// allowsIP returns true if mail can be sent from the given IP.
+func (conf *MailGatewayConfig) allowsIP(ip net.IP) bool {
+	return len(conf.AllowedIPs) == 0 || conf.allowedIPs.contains(ip)
+}
+
+// allows returns true if the given sender can send mail to this address.
+func (target *MailGatewayAddressConfig) allows(sender string) bool {
+	if len(target.senders) == 0 {
+		return true
+	}
+	sender = strings.ToLower(sender)
+	for _, mask := range target.senders {
+		if matched, _ := path.Match(mask, sender); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// startMailGateway starts taking mail for the mail gateway.
+func (server *Server) startMailGateway() error {
+	listener, err := net.Listen("tcp", server.mailGateway.Listen)
+	if err != nil {
+		return err
+	}
+	server.mailListener = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.handleMailConn(conn)
+		}
+	}()
+	return nil
+}
+
+// stopMailGateway stops taking mail for the mail gateway.
+func (server *Server) stopMailGateway() {
+	if server.mailListener != nil {
+		server.mailListener.Close()
+		server.mailListener = nil
+	}
+}
+
+// parseMailPath gets the address out of a MAIL FROM:<address> or RCPT TO:<address> param.
+func parseMailPath(param, prefix string) (address string, ok bool) {
+	if len(param) < len(prefix) || strings.ToUpper(param[:len(prefix)]) != prefix {
+		return "", false
+	}
+	param = strings.TrimSpace(param[len(prefix):])
+	if strings.HasPrefix(param, "<") {
+		end := strings.Index(param, ">")
+		if end == -1 {
+			return "", false
+		}
+		return param[1:end], true
+	}
+	fields := strings.Fields(param)
+	if len(fields) == 0 {
+		return "", false
+	}
+	return fields[0], true
+}
+
+// handleMailConn takes mail over an SMTP connection.
+func (server *Server) handleMailConn(conn net.Conn) {
+	defer conn.Close()
+	conf := server.mailGateway
+	text := textproto.NewConn(conn)
+	reply := func(code int, message string) {
+		conn.SetWriteDeadline(time.Now().Add(mailTimeout))
+		text.PrintfLine("%d %s", code, message)
+	}
+
+	if ip := net.ParseIP(IPString(conn.RemoteAddr())); ip == nil || !conf.allowsIP(ip) {
+		server.logger.Debug("gateway", fmt.Sprintf("Refused mail connection from %s", conn.RemoteAddr().String()))
+		reply(554, "You can't send mail from this address")
+		return
+	}
+	reply(220, fmt.Sprintf("%s ESMTP mail gateway", server.name))
+	var from string
+	var haveFrom bool
+	var targets []*MailGatewayAddressConfig
+	for {
+		conn.SetReadDeadline(time.Now().Add(mailTimeout))
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := line
+		var param string
+		if space := strings.Index(line, " "); space != -1 {
+			verb, param = line[:space], line[space+1:]
+		}
+
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			reply(250, server.name)
+		case "EHLO":
+			text.PrintfLine("250-%s", server.name)
+			reply(250, fmt.Sprintf("SIZE %d", conf.MaxSize))
+		case "MAIL":
+			from, haveFrom = parseMailPath(param, "FROM:")
+			targets = nil
+			if !haveFrom {
+				reply(501, "Syntax: MAIL FROM:<address>")
+				continue
+			}
+			reply(250, "OK")
+		case "RCPT":
+			if !haveFrom {
+				reply(503, "Send MAIL first")
+				continue
+			}
+			to, ok := parseMailPath(param, "TO:")
+			if !ok {
+				reply(501, "Syntax: RCPT TO:<address>")
+				continue
+			}
+			target := conf.addresses[strings.ToLower(to)]
+			if target == nil {
+				reply(550, "No such address")
+				continue
+			}
+			if !target.allows(from) {
+				reply(550, "You can't send mail to this address")
+				continue
+			}
+			targets = append(targets, target)
+			reply(250, "OK")
+		case "DATA":
+			if len(targets) == 0 {
+				reply(503, "Send RCPT first")
+				continue
+			}
+			reply(354, "Send the message, ending with a . on its own line")
+			conn.SetReadDeadline(time.Now().Add(mailTimeout))
+			dotReader := text.DotReader()
+			data, err := ioutil.ReadAll(io.LimitReader(dotReader, int64(conf.MaxSize)+1))
+			if err != nil {
+				return
+			}
+			if uint64(len(data)) > conf.MaxSize {
+				// read the rest, so we're back in step with the client
+				_, err = io.Copy(ioutil.Discard, dotReader)
+				if err != nil {
+					return
+				}
+				reply(552, "The message is too big")
+			} else if err = server.deliverMail(from, targets, data); err != nil {
+				reply(451, err.Error())
+			} else {
+				reply(250, "OK")
+			}
+			from, haveFrom, targets = "", false, nil
+		case "RSET":
+			from, haveFrom, targets = "", false, nil
+			reply(250, "OK")
+		case "NOOP":
+			reply(250, "OK")
+		case "QUIT":
+			reply(221, "Bye")
+			return
+		default:
+			reply(502, "Command not implemented")
+		}
+	}
+}
+
+// deliverMail posts the given mail to the channels for each of its addresses.
+func (server *Server) deliverMail(from string, targets []*MailGatewayAddressConfig, data []byte) error {
+	lines, err := mailToLines(data)
+	if err != nil {
+		return err
+	}
+
+	for _, target := range targets {
+		channel := server.channels.Get(target.channel)
+		if channel == nil {
+			return errMailNoChannel
+		}
+		if target.limiter != nil && !target.limiter.Allow("") {
+			return errMailRateLimited
+		}
+		command := "NOTICE"
+		if target.Privmsg {
+			command = "PRIVMSG"
+		}
+		err = server.sendGatewayMessage(target.Nick, channel, command, lines)
+		if err != nil {
+			return err
+		}
+		server.logger.Debug("gateway", fmt.Sprintf("Mail from %s to %s posted %d lines to %s", from, target.address, len(lines), channel.name))
+	}
+	return nil
+}
+
+// mailToLines turns a mail into the lines posted to a channel, the subject followed by the
+// plain text of the message.
+func mailToLines(data []byte) (lines []string, err error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var decoder mime.WordDecoder
+	subject, err := decoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	body, err := mailText(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(subject+"\n"+body, "\n") {
+		line = strings.TrimSpace(strings.Replace(line, "\x00", "", -1))
+		if line != "" {
+			lines = append(lines, wordWrap(line, 400)...)
+		}
+	}
+	if len(lines) == 0 {
+		return nil, errMailEmptyMessage
+	}
+	if maxGatewayLines < len(lines) {
+		more := len(lines) - maxGatewayLines + 1
+		lines = append(lines[:maxGatewayLines-1], fmt.Sprintf("(%d more lines)", more))
+	}
+	return lines, nil
+}
+
+// mailText returns the plain text of a mail body, using the first text/plain part of
+// multipart mail.
+func mailText(contentType, encoding string, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return "", errMailNoText
+			} else if err != nil {
+				return "", err
+			}
+			text, err := mailText(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err == nil {
+				return text, nil
+			}
+		}
+	}
+	if mediaType != "text/plain" {
+		return "", errMailNoText
+	}
+
+	switch strings.ToLower(encoding) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	text, err := ioutil.ReadAll(body)
+	return string(text), err
+}
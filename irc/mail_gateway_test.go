@@ -0,0 +1,90 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMailToLines(t *testing.T) {
+	cases := []struct {
+		name  string
+		mail  string
+		lines []string
+		err   error
+	}{
+		{
+			"plain text",
+			"Subject: Disk full\r\n\r\n/var is at 99%\r\n\r\n  check it  \r\n",
+			[]string{"Disk full", "/var is at 99%", "check it"},
+			nil,
+		},
+		{
+			"encoded subject",
+			"Subject: =?utf-8?q?caf=C3=A9_is_down?=\r\n\r\nhello\r\n",
+			[]string{"café is down", "hello"},
+			nil,
+		},
+		{
+			"quoted-printable",
+			"Subject: qp\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nsoft=\r\nbreak =3D joined\r\n",
+			[]string{"qp", "softbreak = joined"},
+			nil,
+		},
+		{
+			"base64",
+			"Subject: b64\r\nContent-Transfer-Encoding: base64\r\n\r\naGVsbG8gd29ybGQ=\r\n",
+			[]string{"b64", "hello world"},
+			nil,
+		},
+		{
+			"multipart",
+			"Subject: parts\r\nContent-Type: multipart/alternative; boundary=xyz\r\n\r\n--xyz\r\nContent-Type: text/html\r\n\r\n<b>html</b>\r\n--xyz\r\nContent-Type: text/plain\r\n\r\nplain\r\n--xyz--\r\n",
+			[]string{"parts", "plain"},
+			nil,
+		},
+		{
+			"html only",
+			"Subject: html\r\nContent-Type: text/html\r\n\r\n<b>html</b>\r\n",
+			nil,
+			errMailNoText,
+		},
+		{
+			"multipart without text",
+			"Subject: parts\r\nContent-Type: multipart/mixed; boundary=xyz\r\n\r\n--xyz\r\nContent-Type: image/png\r\n\r\nPNG\r\n--xyz--\r\n",
+			nil,
+			errMailNoText,
+		},
+		{
+			"empty",
+			"Subject: \r\n\r\n \r\n\x00\r\n",
+			nil,
+			errMailEmptyMessage,
+		},
+	}
+	for _, c := range cases {
+		lines, err := mailToLines([]byte(c.mail))
+		if err != c.err {
+			t.Errorf("%s: expected error %v, got %v", c.name, c.err, err)
+		} else if !reflect.DeepEqual(lines, c.lines) {
+			t.Errorf("%s: expected %q, got %q", c.name, c.lines, lines)
+		}
+	}
+
+	// long mails are cut short, saying how much was left out
+	var body []string
+	for i := 0; i < 30; i++ {
+		body = append(body, fmt.Sprintf("line %d", i))
+	}
+	lines, err := mailToLines([]byte("Subject: long\r\n\r\n" + strings.Join(body, "\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != maxGatewayLines || lines[maxGatewayLines-1] != "(12 more lines)" {
+		t.Errorf("expected %d lines ending with the number left out, got %q", maxGatewayLines, lines)
+	}
+}
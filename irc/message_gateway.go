@@ -0,0 +1,224 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oragono/oragono/irc/history"
+	"github.com/oragono/oragono/irc/ratelimit"
+)
+
+// MessageGatewayConfig lets trusted services, like build servers and alerting systems, post
+// messages to channels through the REST API without connecting to IRC.
+type MessageGatewayConfig struct {
+	Enabled bool
+	Tokens  map[string]*GatewayTokenConfig
+}
+
+// GatewayTokenConfig is a token that can post to the message gateway.
+type GatewayTokenConfig struct {
+	Token string
+	// Nick is who the messages come from.
+	Nick string
+	// Channels are the channels the token can post to, which can contain * and ? wildcards.
+	Channels  []string
+	RateLimit RateLimitConfig `yaml:"rate-limit"`
+
+	name     string
+	channels []string
+	limiter  *ratelimit.Keyed
+}
+
+// load checks the config and sets up each token's rate limit.
+func (conf *MessageGatewayConfig) load() error {
+	if !conf.Enabled {
+		return nil
+	}
+	tokens := make(map[string]bool)
+	for name, token := range conf.Tokens {
+		if token == nil || token.Token == "" {
+			return fmt.Errorf("token %s has no token set", name)
+		}
+		if tokens[token.Token] {
+			return fmt.Errorf("token %s uses the same token as another one", name)
+		}
+		tokens[token.Token] = true
+		if _, err := CasefoldName(token.Nick); err != nil || strings.ContainsAny(token.Nick, "!@*?,:") {
+			return fmt.Errorf("token %s has an invalid nick [%s]", name, token.Nick)
+		}
+		if len(token.Channels) == 0 {
+			return fmt.Errorf("token %s can't post to any channels", name)
+		}
+		token.channels = nil
+		for _, channel := range token.Channels {
+			mask := strings.ToLower(channel)
+			if _, err := path.Match(mask, ""); err != nil || !strings.HasPrefix(mask, "#") {
+				return fmt.Errorf("token %s has an invalid channel [%s]", name, channel)
+			}
+			token.channels = append(token.channels, mask)
+		}
+		if 0 < token.RateLimit.Limit {
+			var err error
+			token.RateLimit.Window, err = time.ParseDuration(token.RateLimit.WindowString)
+			if err != nil {
+				return fmt.Errorf("Could not parse token %s rate-limit window: %s", name, err.Error())
+			}
+		}
+		token.name = name
+		token.limiter = newKeyedLimiter(token.RateLimit)
+	}
+	return nil
+}
+
+// lookup returns the token config for the given token, or nil if it isn't one of ours.
+func (conf *MessageGatewayConfig) lookup(token string) *GatewayTokenConfig {
+	// check them all, so the time taken doesn't give away which tokens are close
+	var found *GatewayTokenConfig
+	for _, tokenConfig := range conf.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(tokenConfig.Token)) == 1 {
+			found = tokenConfig
+		}
+	}
+	return found
+}
+
+// canPostTo returns true if the token can post to the given casefolded channel name.
+func (token *GatewayTokenConfig) canPostTo(channelName string) bool {
+	for _, mask := range token.channels {
+		if matched, _ := path.Match(mask, channelName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// maxGatewayLines is the most lines that can be posted in one request.
+	maxGatewayLines = 20
+)
+
+var (
+	errGatewayNickInUse = errors.New("Someone is using the gateway's nick")
+)
+
+// sendGatewayMessage posts the given lines to the channel from the given nick.
+func (server *Server) sendGatewayMessage(nick string, channel *Channel, command string, lines []string) error {
+	nickname, _ := CasefoldName(nick)
+	if server.clients.Get(nickname) != nil {
+		return errGatewayNickInUse
+	}
+	prefix := fmt.Sprintf("%s!gateway@%s", nick, server.name)
+	itemType := history.Privmsg
+	if command == "NOTICE" {
+		itemType = history.Notice
+	}
+
+	for _, line := range lines {
+		msgid := server.generateMessageID()
+		if channel.history != nil {
+			channel.history.Add(history.Item{
+				Type:     itemType,
+				Time:     messageTime(msgid),
+				Nickmask: prefix,
+				Message:  line,
+				Msgid:    msgid,
+			})
+		}
+
+		channel.membersMutex.RLock()
+		for member := range channel.members {
+			member.Send(member.withMessageID(nil, msgid), prefix, command, channel.name, line)
+		}
+		channel.membersMutex.RUnlock()
+	}
+	return nil
+}
+
+// gatewayMessageLines splits a message posted to the gateway into the lines to send, and
+// returns false if there's nothing to send or a line has characters that can't be relayed.
+func gatewayMessageLines(message string) (lines []string, valid bool) {
+	for _, line := range strings.Split(message, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.ContainsAny(line, "\r\n\x00") {
+			return nil, false
+		}
+		if line != "" {
+			lines = append(lines, wordWrap(line, 400)...)
+		}
+	}
+	return lines, len(lines) != 0
+}
+
+type restGatewayResp struct {
+	Sent  int    `json:"sent,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// restGatewayMessage posts a message to a `channel` from a gateway token's nick. Messages are
+// sent as a NOTICE unless `privmsg` is set, and can have several lines split by newlines.
+func restGatewayMessage(w http.ResponseWriter, r *http.Request) {
+	server := restAPIServer
+	conf := &server.restAPI.MessageGateway
+	if !conf.Enabled {
+		restReply(w, http.StatusNotFound, restGatewayResp{Error: "The message gateway is not enabled on this server"})
+		return
+	}
+
+	auth := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	var token *GatewayTokenConfig
+	if len(auth) == 2 && strings.ToLower(auth[0]) == "bearer" {
+		token = conf.lookup(strings.TrimSpace(auth[1]))
+	}
+	if token == nil {
+		restReply(w, http.StatusUnauthorized, restGatewayResp{Error: "Invalid token"})
+		return
+	}
+
+	channelName, err := CasefoldChannel(r.FormValue("channel"))
+	if err != nil || !token.canPostTo(channelName) {
+		restReply(w, http.StatusForbidden, restGatewayResp{Error: "This token can't post to that channel"})
+		return
+	}
+	channel := server.channels.Get(channelName)
+	if channel == nil {
+		restReply(w, http.StatusNotFound, restGatewayResp{Error: "No such channel"})
+		return
+	}
+
+	lines, valid := gatewayMessageLines(r.FormValue("message"))
+	if !valid {
+		restReply(w, http.StatusBadRequest, restGatewayResp{Error: "You must give a message"})
+		return
+	}
+	if maxGatewayLines < len(lines) {
+		restReply(w, http.StatusBadRequest, restGatewayResp{Error: fmt.Sprintf("Messages can be at most %d lines long", maxGatewayLines)})
+		return
+	}
+
+	if token.limiter != nil && !token.limiter.Allow("") {
+		w.Header().Set("Retry-After", strconv.Itoa(int(token.limiter.Wait("").Seconds())+1))
+		restReply(w, http.StatusTooManyRequests, restGatewayResp{Error: "Too many messages, try again later"})
+		return
+	}
+
+	command := "NOTICE"
+	if privmsg, _ := strconv.ParseBool(r.FormValue("privmsg")); privmsg {
+		command = "PRIVMSG"
+	}
+	err = server.sendGatewayMessage(token.Nick, channel, command, lines)
+	if err != nil {
+		restReply(w, http.StatusConflict, restGatewayResp{Error: err.Error()})
+		return
+	}
+	server.logger.Debug("gateway", fmt.Sprintf("Token %s posted %d lines to %s", token.name, len(lines), channel.name))
+	restReply(w, http.StatusOK, restGatewayResp{Sent: len(lines)})
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGatewayMessageLines(t *testing.T) {
+	cases := []struct {
+		message string
+		lines   []string
+		valid   bool
+	}{
+		{"deploy finished", []string{"deploy finished"}, true},
+		{"first\nsecond", []string{"first", "second"}, true},
+		{"first\r\n\r\nsecond\r\n", []string{"first", "second"}, true},
+		{"", nil, false},
+		{"\r\n\n", nil, false},
+		{"hi\rQUIT :bye", nil, false},
+		{"first\nsecond\r\rthird", nil, false},
+		{"hi\x00there", nil, false},
+	}
+	for _, c := range cases {
+		lines, valid := gatewayMessageLines(c.message)
+		if valid != c.valid || !reflect.DeepEqual(lines, c.lines) {
+			t.Errorf("%q: expected %q (valid %v), got %q (valid %v)", c.message, c.lines, c.valid, lines, valid)
+		}
+	}
+}
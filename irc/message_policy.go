@@ -0,0 +1,500 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	// WordFilterReplace replaces the filtered word with asterisks.
+	WordFilterReplace = "replace"
+	// WordFilterBlock blocks the message and tells the sender.
+	WordFilterBlock = "block"
+	// WordFilterKick blocks the message and kicks the sender from the channel.
+	WordFilterKick = "kick"
+	// WordFilterBan blocks the message, and bans and kicks the sender from the channel.
+	WordFilterBan = "ban"
+	// WordFilterObserve lets the message through, but logs and counts it, so ops can see
+	// what a filter would catch before enforcing it.
+	WordFilterObserve = "observe"
+
+	// URLPolicyOff lets anyone post links.
+	URLPolicyOff = "off"
+	// URLPolicyUnregistered blocks links from users who aren't logged into an account.
+	URLPolicyUnregistered = "unregistered"
+	// URLPolicyVoice blocks links from users who aren't voiced.
+	URLPolicyVoice = "voice"
+	// URLPolicyAllowlist only allows links to the channel's allowed domains.
+	URLPolicyAllowlist = "allowlist"
+)
+
+var (
+	// wordFilterSeverity orders the word filter actions, so the harshest one wins
+	// when a message matches multiple filters.
+	wordFilterSeverity = map[string]int{
+		WordFilterObserve: 0,
+		WordFilterReplace: 1,
+		WordFilterBlock:   2,
+		WordFilterKick:    3,
+		WordFilterBan:     4,
+	}
+
+	// urlExpression matches links in messages, with the link's hostname as the first
+	// or second submatch.
+	urlExpression = regexp.MustCompile(`(?i)\b[a-z][a-z0-9+.-]*://(?:[^\s/?#@]*@)?([^\s/?#:]+)|\bwww\.([^\s/?#:]+)`)
+)
+
+// WordFilter is a word that's filtered from a channel's messages, and what we do
+// when someone says it.
+type WordFilter struct {
+	Word   string
+	Action string
+}
+
+// compiledWordFilter is a WordFilter along with the expression that matches it.
+type compiledWordFilter struct {
+	WordFilter
+	expression *regexp.Regexp
+	// matches counts the messages this filter has matched since it was compiled, it must be
+	// accessed atomically
+	matches *uint64
+}
+
+// compileWordFilters returns the given word filters, compiled so they can be matched
+// against messages.
+func compileWordFilters(filters []WordFilter) []compiledWordFilter {
+	var compiled []compiledWordFilter
+	for _, filter := range filters {
+		if len(filter.Word) < 1 {
+			continue
+		}
+
+		// only match whole words, where that makes sense for the filtered word
+		expr := regexp.QuoteMeta(filter.Word)
+		first, _ := utf8.DecodeRuneInString(filter.Word)
+		last, _ := utf8.DecodeLastRuneInString(filter.Word)
+		if unicode.IsLetter(first) || unicode.IsNumber(first) {
+			expr = `\b` + expr
+		}
+		if unicode.IsLetter(last) || unicode.IsNumber(last) {
+			expr = expr + `\b`
+		}
+
+		expression, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			continue
+		}
+		compiled = append(compiled, compiledWordFilter{
+			WordFilter: filter,
+			expression: expression,
+			matches:    new(uint64),
+		})
+	}
+	return compiled
+}
+
+// applyMessagePolicy runs a message from the given client through this channel's message
+// policies. It returns the message that should be relayed (which may have been modified),
+// and false if the message shouldn't be relayed at all.
+func (channel *Channel) applyMessagePolicy(client *Client, command, message string) (string, bool) {
+	message, allowed := channel.filterMessage(client, command, message)
+	if !allowed || client.checkPaste(channel, false) {
+		return "", false
+	}
+	return message, true
+}
+
+// filterMessage runs a message from the given client through this channel's word filters
+// and URL policy, like applyMessagePolicy but without counting it towards paste detection.
+func (channel *Channel) filterMessage(client *Client, command, message string) (string, bool) {
+	channel.membersMutex.RLock()
+	filters := channel.wordFilters
+	urlPolicy := channel.urlPolicy
+	urlAllowlist := channel.urlAllowlist
+	exempt := client.hasFlag(Operator) || channel.clientIsAtLeastNoMutex(client, ChannelOperator)
+	voiced := channel.clientIsAtLeastNoMutex(client, Voice)
+	channel.membersMutex.RUnlock()
+
+	if exempt {
+		return message, true
+	}
+
+	message, action := channel.filterWords(filters, message, client.nickMaskString)
+	switch action {
+	case WordFilterBlock:
+		client.warnNotice(command, "FILTERED_WORD", []string{channel.name}, fmt.Sprintf("Your message to %s was blocked because it contains a filtered word", channel.name))
+		return "", false
+	case WordFilterKick:
+		channel.policyKick(client, "Your message contained a filtered word")
+		return "", false
+	case WordFilterBan:
+		channel.policyBan(client)
+		channel.policyKick(client, "Your message contained a filtered word")
+		return "", false
+	}
+
+	if !urlPolicyAllows(urlPolicy, urlAllowlist, client.account != &NoAccount, voiced, message) {
+		client.warnNotice(command, "LINK_NOT_ALLOWED", []string{channel.name}, fmt.Sprintf("Your message to %s was blocked because you can't post that link there", channel.name))
+		return "", false
+	}
+
+	return message, true
+}
+
+// filterWords runs a message from the given nickmask through the given word filters. It
+// returns the message with any replacements made, and the harshest action that matched.
+func (channel *Channel) filterWords(filters []compiledWordFilter, message, nickmask string) (string, string) {
+	var action string
+	for _, filter := range filters {
+		if !filter.expression.MatchString(message) {
+			continue
+		}
+		atomic.AddUint64(filter.matches, 1)
+		if filter.Action == WordFilterObserve {
+			channel.server.logger.Info("wordfilter", fmt.Sprintf("Observed word filter %s on %s matched a message from %s", filter.Word, channel.name, nickmask))
+			continue
+		}
+		if wordFilterSeverity[action] < wordFilterSeverity[filter.Action] {
+			action = filter.Action
+		}
+		if filter.Action == WordFilterReplace {
+			message = filter.expression.ReplaceAllStringFunc(message, func(word string) string {
+				return strings.Repeat("*", utf8.RuneCountInString(word))
+			})
+		}
+	}
+	return message, action
+}
+
+// urlPolicyAllows returns true if the given URL policy lets a sender who is (or isn't)
+// logged in and voiced post the links in the message.
+func urlPolicyAllows(urlPolicy string, allowlist []string, loggedIn, voiced bool, message string) bool {
+	switch urlPolicy {
+	case URLPolicyUnregistered:
+		if loggedIn {
+			return true
+		}
+	case URLPolicyVoice:
+		if voiced {
+			return true
+		}
+	case URLPolicyAllowlist:
+	default:
+		return true
+	}
+	return linksAreAllowed(message, allowlist)
+}
+
+// linksAreAllowed returns true if every link in the given message goes to one of the
+// allowed domains (or one of their subdomains).
+func linksAreAllowed(message string, allowlist []string) bool {
+	for _, match := range urlExpression.FindAllStringSubmatch(message, -1) {
+		hostname := match[1]
+		if hostname == "" {
+			// www. links have the rest of the hostname in the second submatch
+			hostname = "www." + match[2]
+		}
+		hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+
+		var allowed bool
+		for _, domain := range allowlist {
+			if hostname == domain || strings.HasSuffix(hostname, "."+domain) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// policyKick kicks the given client from the channel on behalf of ChanServ.
+func (channel *Channel) policyKick(target *Client, comment string) {
+	channel.membersMutex.Lock()
+	defer channel.membersMutex.Unlock()
+
+	if !channel.members.Has(target) {
+		return
+	}
+
+	source := fmt.Sprintf("ChanServ!services@%s", target.server.name)
+	for member := range channel.members {
+		member.Send(nil, source, "KICK", channel.name, target.nick, comment)
+	}
+	channel.quitNoMutex(target)
+}
+
+// policyBan bans the given client's host from the channel on behalf of ChanServ.
+func (channel *Channel) policyBan(target *Client) {
+	server := target.server
+	hostname := target.nickMaskString[strings.LastIndex(target.nickMaskString, "@")+1:]
+	mask := fmt.Sprintf("*!*@%s", hostname)
+
+	channel.membersMutex.Lock()
+	defer channel.membersMutex.Unlock()
+
+	if !channel.lists[BanMask].Add(mask) {
+		// already banned
+		return
+	}
+
+	channel.queueModeChangesNoMutex(fmt.Sprintf("ChanServ!services@%s", server.name), ModeChanges{{
+		mode: BanMask,
+		op:   Add,
+		arg:  mask,
+	}})
+
+	// save the ban if this is a registered channel
+	if server.isReadOnly() {
+		return
+	}
+	server.registeredChannelsMutex.Lock()
+	defer server.registeredChannelsMutex.Unlock()
+
+	server.store.Update(func(tx *buntdb.Tx) error {
+		chanInfo := server.loadChannelNoMutex(tx, channel.nameCasefolded)
+		if chanInfo == nil {
+			return nil
+		}
+
+		var banlist []string
+		for mask := range channel.lists[BanMask].masks {
+			banlist = append(banlist, mask)
+		}
+		chanInfo.Banlist = banlist
+
+		server.saveChannelNoMutex(tx, channel.nameCasefolded, *chanInfo)
+		return nil
+	})
+}
+
+// chanservWordFilter handles the ChanServ WORDFILTER command.
+func (server *Server) chanservWordFilter(client *Client, params []string, rb *ResponseBuffer) {
+	if len(params) < 2 {
+		rb.ChanServNotice("Syntax: WORDFILTER <channel> <ADD|DEL|LIST> [<word> [<action>]]")
+		return
+	}
+
+	channelKey, err := CasefoldChannel(params[0])
+	channel := server.channels.Get(channelKey)
+	if err != nil || channel == nil {
+		rb.ChanServNotice("Channel does not exist")
+		return
+	}
+	if !channel.ClientIsAtLeast(client, ChannelOperator) {
+		rb.ChanServNotice("You must be a channel operator to change the channel's word filters")
+		return
+	}
+
+	subcommand := strings.ToLower(params[1])
+	var word, action string
+	if subcommand == "add" || subcommand == "del" {
+		if len(params) < 3 {
+			rb.ChanServNotice("Syntax: WORDFILTER <channel> <ADD|DEL|LIST> [<word> [<action>]]")
+			return
+		}
+		word = strings.ToLower(params[2])
+	}
+	if subcommand == "add" {
+		action = WordFilterBlock
+		if 3 < len(params) {
+			action = strings.ToLower(params[3])
+		}
+		if _, exists := wordFilterSeverity[action]; !exists {
+			rb.ChanServNotice("Action must be one of: observe, replace, block, kick, ban")
+			return
+		}
+	}
+	if (subcommand == "add" || subcommand == "del") && !server.checkWritable(client, "CHANSERV", rb) {
+		return
+	}
+
+	var updated bool
+	var filters []WordFilter
+	matches := channel.wordFilterMatches()
+
+	server.registeredChannelsMutex.Lock()
+	server.store.Update(func(tx *buntdb.Tx) error {
+		chanReg := server.loadChannelNoMutex(tx, channelKey)
+		if chanReg == nil {
+			rb.ChanServNotice("Channel is not registered")
+			return nil
+		}
+
+		// any existing filter for the word gets replaced
+		for _, filter := range chanReg.WordFilters {
+			if filter.Word != word {
+				filters = append(filters, filter)
+			}
+		}
+
+		switch subcommand {
+		case "list":
+			if len(chanReg.WordFilters) == 0 {
+				rb.ChanServNotice(fmt.Sprintf("No words are being filtered on %s", chanReg.Name))
+				return nil
+			}
+			rb.ChanServNotice(fmt.Sprintf("Words being filtered on %s:", chanReg.Name))
+			for _, filter := range chanReg.WordFilters {
+				rb.ChanServNotice(fmt.Sprintf("%s (%s, %d matches)", filter.Word, filter.Action, matches[filter.Word]))
+			}
+			return nil
+		case "add":
+			filters = append(filters, WordFilter{Word: word, Action: action})
+			rb.ChanServNotice(fmt.Sprintf("Now filtering %s on %s (%s)", word, chanReg.Name, action))
+		case "del":
+			if len(filters) == len(chanReg.WordFilters) {
+				rb.ChanServNotice(fmt.Sprintf("%s isn't being filtered on %s", word, chanReg.Name))
+				return nil
+			}
+			rb.ChanServNotice(fmt.Sprintf("No longer filtering %s on %s", word, chanReg.Name))
+		default:
+			rb.ChanServNotice("Syntax: WORDFILTER <channel> <ADD|DEL|LIST> [<word> [<action>]]")
+			return nil
+		}
+
+		chanReg.WordFilters = filters
+		server.saveChannelNoMutex(tx, channelKey, *chanReg)
+		updated = true
+		return nil
+	})
+	server.registeredChannelsMutex.Unlock()
+
+	if updated {
+		compiled := compileWordFilters(filters)
+		channel.membersMutex.Lock()
+		// keep counting matches for words that are still filtered, so an observed filter's
+		// matches aren't lost when it's changed to enforce
+		for _, oldFilter := range channel.wordFilters {
+			for i := range compiled {
+				if compiled[i].Word == oldFilter.Word {
+					compiled[i].matches = oldFilter.matches
+				}
+			}
+		}
+		channel.wordFilters = compiled
+		channel.membersMutex.Unlock()
+	}
+}
+
+// wordFilterMatches returns how many messages each of the channel's word filters has matched.
+func (channel *Channel) wordFilterMatches() map[string]uint64 {
+	channel.membersMutex.RLock()
+	defer channel.membersMutex.RUnlock()
+
+	matches := make(map[string]uint64)
+	for _, filter := range channel.wordFilters {
+		matches[filter.Word] = atomic.LoadUint64(filter.matches)
+	}
+	return matches
+}
+
+// chanservURLPolicy handles the ChanServ URLPOLICY command.
+func (server *Server) chanservURLPolicy(client *Client, params []string, rb *ResponseBuffer) {
+	if len(params) < 1 {
+		rb.ChanServNotice("Syntax: URLPOLICY <channel> [SET <policy> | ALLOW <domain> | DISALLOW <domain>]")
+		return
+	}
+
+	channelKey, err := CasefoldChannel(params[0])
+	channel := server.channels.Get(channelKey)
+	if err != nil || channel == nil {
+		rb.ChanServNotice("Channel does not exist")
+		return
+	}
+	if !channel.ClientIsAtLeast(client, ChannelOperator) {
+		rb.ChanServNotice("You must be a channel operator to change the channel's link policy")
+		return
+	}
+
+	var subcommand, value string
+	if 1 < len(params) {
+		if len(params) < 3 {
+			rb.ChanServNotice("Syntax: URLPOLICY <channel> [SET <policy> | ALLOW <domain> | DISALLOW <domain>]")
+			return
+		}
+		subcommand = strings.ToLower(params[1])
+		value = strings.TrimSuffix(strings.ToLower(params[2]), ".")
+		if !server.checkWritable(client, "CHANSERV", rb) {
+			return
+		}
+	}
+
+	var updated bool
+	var policy string
+	var allowlist []string
+
+	server.registeredChannelsMutex.Lock()
+	server.store.Update(func(tx *buntdb.Tx) error {
+		chanReg := server.loadChannelNoMutex(tx, channelKey)
+		if chanReg == nil {
+			rb.ChanServNotice("Channel is not registered")
+			return nil
+		}
+
+		policy = chanReg.URLPolicy
+		for _, domain := range chanReg.URLAllowlist {
+			if domain != value {
+				allowlist = append(allowlist, domain)
+			}
+		}
+
+		switch subcommand {
+		case "":
+			if policy == "" {
+				policy = URLPolicyOff
+			}
+			rb.ChanServNotice(fmt.Sprintf("Link policy for %s is: %s", chanReg.Name, policy))
+			if 0 < len(chanReg.URLAllowlist) {
+				rb.ChanServNotice(fmt.Sprintf("Allowed domains: %s", strings.Join(chanReg.URLAllowlist, ", ")))
+			}
+			return nil
+		case "set":
+			switch value {
+			case URLPolicyOff, URLPolicyUnregistered, URLPolicyVoice, URLPolicyAllowlist:
+				policy = value
+			default:
+				rb.ChanServNotice("Policy must be one of: off, unregistered, voice, allowlist")
+				return nil
+			}
+			rb.ChanServNotice(fmt.Sprintf("Link policy for %s is now: %s", chanReg.Name, policy))
+		case "allow":
+			allowlist = append(allowlist, value)
+			rb.ChanServNotice(fmt.Sprintf("Links to %s are now always allowed on %s", value, chanReg.Name))
+		case "disallow":
+			if len(allowlist) == len(chanReg.URLAllowlist) {
+				rb.ChanServNotice(fmt.Sprintf("%s isn't an allowed domain on %s", value, chanReg.Name))
+				return nil
+			}
+			rb.ChanServNotice(fmt.Sprintf("%s is no longer an allowed domain on %s", value, chanReg.Name))
+		default:
+			rb.ChanServNotice("Syntax: URLPOLICY <channel> [SET <policy> | ALLOW <domain> | DISALLOW <domain>]")
+			return nil
+		}
+
+		chanReg.URLPolicy = policy
+		chanReg.URLAllowlist = allowlist
+		server.saveChannelNoMutex(tx, channelKey, *chanReg)
+		updated = true
+		return nil
+	})
+	server.registeredChannelsMutex.Unlock()
+
+	if updated {
+		channel.membersMutex.Lock()
+		channel.urlPolicy = policy
+		channel.urlAllowlist = allowlist
+		channel.membersMutex.Unlock()
+	}
+}
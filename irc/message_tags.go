@@ -5,6 +5,18 @@ package irc
 
 import "github.com/goshuirc/irc-go/ircmsg"
 
+// tagsWith returns a copy of the given tags with another tag added, so tags that are being
+// sent to lots of clients aren't changed for all of them.
+func tagsWith(tags *map[string]ircmsg.TagValue, name, value string) *map[string]ircmsg.TagValue {
+	newTags := ircmsg.MakeTags(name, value)
+	if tags != nil {
+		for tagName, tagValue := range *tags {
+			(*newTags)[tagName] = tagValue
+		}
+	}
+	return newTags
+}
+
 // GetClientOnlyTags takes a tag map and returns a map containing just the client-only tags from it.
 func GetClientOnlyTags(tags map[string]ircmsg.TagValue) *map[string]ircmsg.TagValue {
 	if len(tags) < 1 {
@@ -0,0 +1,161 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultModeCoalescingWindow = 250 * time.Millisecond
+	// maxModeLineArgsLen is how long the mode string and arguments of a MODE line can get,
+	// leaving plenty of room for the source and channel name.
+	maxModeLineArgsLen = 300
+)
+
+// ModeCoalescingConfig controls whether the mode changes that the server makes on its own,
+// like the modes people get when they join, are collected for a moment and sent out together.
+type ModeCoalescingConfig struct {
+	Enabled      bool
+	WindowString string        `yaml:"window"`
+	Window       time.Duration `yaml:"window-real"`
+}
+
+// load checks the config and parses the window.
+func (conf *ModeCoalescingConfig) load() (err error) {
+	if !conf.Enabled {
+		return nil
+	}
+	conf.Window = defaultModeCoalescingWindow
+	if conf.WindowString != "" {
+		conf.Window, err = time.ParseDuration(conf.WindowString)
+		if err != nil {
+			return fmt.Errorf("Could not parse window: %s", err.Error())
+		}
+		if conf.Window <= 0 {
+			return errors.New("window must be positive")
+		}
+	}
+	return nil
+}
+
+// pendingModeChanges are mode changes from a single source waiting to be sent.
+type pendingModeChanges struct {
+	source  string
+	changes ModeChanges
+}
+
+// lines splits the changes into the parameters of MODE lines for the given target. Each line
+// has at most maxModes changes that take an argument (or any number, if maxModes is 0), and
+// is kept short enough to fit in a line.
+func (changes ModeChanges) lines(target string, maxModes int) [][]string {
+	var lines [][]string
+	var line ModeChanges
+	var argModes, argsLen int
+	flush := func() {
+		if 0 < len(line) {
+			lines = append(lines, append([]string{target}, strings.Split(line.String(), " ")...))
+		}
+		line = nil
+		argModes = 0
+		argsLen = 0
+	}
+
+	for _, change := range changes {
+		changeLen := len(change.String()) + 1
+		if 0 < len(line) && (maxModeLineArgsLen < argsLen+changeLen || (change.arg != "" && 0 < maxModes && maxModes <= argModes)) {
+			flush()
+		}
+		line = append(line, change)
+		argsLen += changeLen
+		if change.arg != "" {
+			argModes++
+		}
+	}
+	flush()
+	return lines
+}
+
+// sendModeChangesNoMutex tells the channel's members about the given mode changes, split
+// into as few MODE lines as the MODES limit allows.
+func (channel *Channel) sendModeChangesNoMutex(source string, changes ModeChanges) {
+	// requires RLock()
+
+	for _, args := range changes.lines(channel.name, channel.server.limits.Modes) {
+		for member := range channel.members {
+			member.Send(nil, source, "MODE", args...)
+		}
+	}
+}
+
+// sendModeChangesFromClientNoMutex is sendModeChangesNoMutex for changes that a client made,
+// so the lines carry their account tag.
+func (channel *Channel) sendModeChangesFromClientNoMutex(client *Client, changes ModeChanges) {
+	// requires RLock()
+
+	for _, args := range changes.lines(channel.name, channel.server.limits.Modes) {
+		for member := range channel.members {
+			member.SendFromClient("", client, nil, "MODE", args...)
+		}
+	}
+}
+
+// queueModeChangesNoMutex tells the channel's members about mode changes that the server
+// made. If mode coalescing is enabled these wait for the coalescing window, so that changes
+// made in quick succession go out in the same MODE lines.
+func (channel *Channel) queueModeChangesNoMutex(source string, changes ModeChanges) {
+	// requires RLock()
+
+	conf := channel.server.modeCoalescing
+	if !conf.Enabled {
+		channel.sendModeChangesNoMutex(source, changes)
+		return
+	}
+
+	channel.pendingModesMutex.Lock()
+	defer channel.pendingModesMutex.Unlock()
+	for i := range channel.pendingModes {
+		if channel.pendingModes[i].source == source {
+			channel.pendingModes[i].changes = append(channel.pendingModes[i].changes, changes...)
+			return
+		}
+	}
+	channel.pendingModes = append(channel.pendingModes, pendingModeChanges{
+		source:  source,
+		changes: changes,
+	})
+	if len(channel.pendingModes) == 1 {
+		time.AfterFunc(conf.Window, channel.flushModeChanges)
+	}
+}
+
+// flushModeChanges sends out the queued mode changes. Changes to members who've left since
+// are dropped.
+func (channel *Channel) flushModeChanges() {
+	channel.pendingModesMutex.Lock()
+	pending := channel.pendingModes
+	channel.pendingModes = nil
+	channel.pendingModesMutex.Unlock()
+
+	channel.membersMutex.RLock()
+	defer channel.membersMutex.RUnlock()
+
+	for _, batch := range pending {
+		var changes ModeChanges
+		for _, change := range batch.changes {
+			if _, isMemberMode := ChannelModePrefixes[change.mode]; isMemberMode {
+				nickname, err := CasefoldName(change.arg)
+				member := channel.server.clients.Get(nickname)
+				if err != nil || member == nil || !channel.members.Has(member) {
+					continue
+				}
+			}
+			changes = append(changes, change)
+		}
+		channel.sendModeChangesNoMutex(batch.source, changes)
+	}
+}
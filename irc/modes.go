@@ -6,8 +6,10 @@
 package irc
 
 import (
+	"errors"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/goshuirc/irc-go/ircmsg"
 	"github.com/oragono/oragono/irc/sno"
@@ -97,11 +99,13 @@ func (modes Modes) String() string {
 // User Modes
 const (
 	Away            Mode = 'a'
+	CallerID        Mode = 'g'
 	Invisible       Mode = 'i'
 	LocalOperator   Mode = 'O'
 	Operator        Mode = 'o'
 	Restricted      Mode = 'r'
 	ServerNotice    Mode = 's'
+	SecureMessages  Mode = 'S'
 	TLS             Mode = 'Z'
 	UserRoleplaying Mode = 'E'
 	WallOps         Mode = 'w'
@@ -110,7 +114,7 @@ const (
 var (
 	// SupportedUserModes are the user modes that we actually support (modifying).
 	SupportedUserModes = Modes{
-		Away, Invisible, Operator, ServerNotice, UserRoleplaying,
+		Away, CallerID, Invisible, Operator, ServerNotice, UserRoleplaying, SecureMessages,
 	}
 	// supportedUserModesString acts as a cache for when we introduce users
 	supportedUserModesString = SupportedUserModes.String()
@@ -127,8 +131,12 @@ const (
 	Moderated       Mode = 'm' // flag
 	NoOutside       Mode = 'n' // flag
 	OpOnlyTopic     Mode = 't' // flag
+	PasteThreshold  Mode = 'F' // flag arg
+	NoTyping        Mode = 'T' // flag
 	RegisteredOnly  Mode = 'r' // flag
 	Secret          Mode = 's' // flag
+	SecureOnly      Mode = 'z' // flag
+	SlowMode        Mode = 'W' // flag arg
 	UserLimit       Mode = 'l' // flag arg
 )
 
@@ -142,7 +150,8 @@ var (
 	// SupportedChannelModes are the channel modes that we support.
 	SupportedChannelModes = Modes{
 		BanMask, ExceptMask, InviteMask, InviteOnly, Key, NoOutside,
-		OpOnlyTopic, Secret, UserLimit, ChanRoleplaying,
+		OpOnlyTopic, Secret, UserLimit, ChanRoleplaying, NoTyping, SlowMode,
+		PasteThreshold, SecureOnly,
 	}
 	// supportedChannelModesString acts as a cache for when we introduce users
 	supportedChannelModesString = SupportedChannelModes.String()
@@ -167,6 +176,15 @@ var (
 	}
 )
 
+const (
+	// maxSlowModeInterval is the longest interval that can be set with the slow mode.
+	maxSlowModeInterval = 24 * time.Hour
+)
+
+var (
+	errInvalidSlowMode = errors.New("Slow mode interval is invalid")
+)
+
 //
 // channel membership prefixes
 //
@@ -208,13 +226,13 @@ func GetLowestChannelModePrefix(prefixes string) *Mode {
 //
 
 // MODE <target> [<modestring> [<mode arguments>...]]
-func modeHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func modeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	_, errChan := CasefoldChannel(msg.Params[0])
 
 	if errChan == nil {
-		return cmodeHandler(server, client, msg)
+		return cmodeHandler(server, client, msg, rb)
 	}
-	return umodeHandler(server, client, msg)
+	return umodeHandler(server, client, msg, rb)
 }
 
 // ParseUserModeChanges returns the valid changes, and the list of unknown chars.
@@ -281,29 +299,29 @@ func (client *Client) applyUserModeChanges(force bool, changes ModeChanges) Mode
 
 	for _, change := range changes {
 		switch change.mode {
-		case Invisible, WallOps, UserRoleplaying, Operator, LocalOperator:
+		case Invisible, WallOps, UserRoleplaying, Operator, LocalOperator, CallerID, SecureMessages:
 			switch change.op {
 			case Add:
 				if !force && (change.mode == Operator || change.mode == LocalOperator) {
 					continue
 				}
 
-				if client.flags[change.mode] {
+				if client.hasFlag(change.mode) {
 					continue
 				}
-				client.flags[change.mode] = true
+				client.setFlag(change.mode, true)
 				applied = append(applied, change)
 
 			case Remove:
-				if !client.flags[change.mode] {
+				if !client.hasFlag(change.mode) {
 					continue
 				}
-				delete(client.flags, change.mode)
+				client.setFlag(change.mode, false)
 				applied = append(applied, change)
 			}
 
 		case ServerNotice:
-			if !client.flags[Operator] {
+			if !client.hasFlag(Operator) {
 				continue
 			}
 			var masks []sno.Mask
@@ -329,23 +347,23 @@ func (client *Client) applyUserModeChanges(force bool, changes ModeChanges) Mode
 }
 
 // MODE <target> [<modestring> [<mode arguments>...]]
-func umodeHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func umodeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	nickname, err := CasefoldName(msg.Params[0])
 
 	target := server.clients.Get(nickname)
 
 	if err != nil || target == nil {
 		if len(msg.Params[0]) > 0 {
-			client.Send(nil, server.name, ERR_NOSUCHNICK, client.nick, msg.Params[0], "No such nick")
+			rb.Send(nil, server.name, ERR_NOSUCHNICK, client.nick, msg.Params[0], "No such nick")
 		}
 		return false
 	}
 
 	if client != target && msg.Command != "SAMODE" {
 		if len(msg.Params) > 1 {
-			client.Send(nil, server.name, ERR_USERSDONTMATCH, client.nick, "Can't change modes for other users")
+			rb.Send(nil, server.name, ERR_USERSDONTMATCH, client.nick, "Can't change modes for other users")
 		} else {
-			client.Send(nil, server.name, ERR_USERSDONTMATCH, client.nick, "Can't view modes for other users")
+			rb.Send(nil, server.name, ERR_USERSDONTMATCH, client.nick, "Can't view modes for other users")
 		}
 		return false
 	}
@@ -360,7 +378,7 @@ func umodeHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 
 		// alert for unknown mode changes
 		for char := range unknown {
-			client.Send(nil, server.name, ERR_UNKNOWNMODE, client.nick, string(char), "is an unknown mode character to me")
+			rb.Send(nil, server.name, ERR_UNKNOWNMODE, client.nick, string(char), "is an unknown mode character to me")
 		}
 		if len(unknown) == 1 && len(changes) == 0 {
 			return false
@@ -371,13 +389,13 @@ func umodeHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 	}
 
 	if len(applied) > 0 {
-		client.Send(nil, client.nickMaskString, "MODE", target.nick, applied.String())
+		rb.SendFromClient("", client, nil, "MODE", target.nick, applied.String())
 	} else if client == target {
-		client.Send(nil, target.nickMaskString, RPL_UMODEIS, target.nick, target.ModeString())
-		if client.flags[LocalOperator] || client.flags[Operator] {
+		rb.Send(nil, target.nickMaskString, RPL_UMODEIS, target.nick, target.ModeString())
+		if client.hasFlag(LocalOperator) || client.hasFlag(Operator) {
 			masks := server.snomasks.String(client)
 			if 0 < len(masks) {
-				client.Send(nil, target.nickMaskString, RPL_SNOMASKIS, target.nick, masks, "Server notice masks")
+				rb.Send(nil, target.nickMaskString, RPL_SNOMASKIS, target.nick, masks, "Server notice masks")
 			}
 		}
 	}
@@ -427,7 +445,7 @@ func ParseChannelModeChanges(params ...string) (ModeChanges, map[rune]bool) {
 				} else {
 					continue
 				}
-			case Key, UserLimit:
+			case Key, UserLimit, SlowMode, PasteThreshold:
 				// don't require value when removing
 				if change.op == Add {
 					if len(params) > skipArgs {
@@ -467,8 +485,28 @@ func ParseChannelModeChanges(params ...string) (ModeChanges, map[rune]bool) {
 	return changes, unknown
 }
 
+// parseSlowModeInterval parses the argument of the slow mode, which is either a number
+// of seconds or a duration like "30s".
+func parseSlowModeInterval(arg string) (time.Duration, error) {
+	var interval time.Duration
+	seconds, err := strconv.ParseUint(arg, 10, 32)
+	if err == nil {
+		interval = time.Duration(seconds) * time.Second
+	} else {
+		interval, err = time.ParseDuration(arg)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if interval < time.Second || maxSlowModeInterval < interval {
+		return 0, errInvalidSlowMode
+	}
+	return interval, nil
+}
+
 // ApplyChannelModeChanges applies a given set of mode changes.
-func ApplyChannelModeChanges(channel *Channel, client *Client, isSamode bool, changes ModeChanges) ModeChanges {
+func ApplyChannelModeChanges(channel *Channel, client *Client, isSamode bool, changes ModeChanges, rb *ResponseBuffer) ModeChanges {
 	// so we only output one warning for each list type when full
 	listFullWarned := make(map[Mode]bool)
 
@@ -483,7 +521,7 @@ func ApplyChannelModeChanges(channel *Channel, client *Client, isSamode bool, ch
 		if isSamode && ChannelModePrefixes[change.mode] == "" && !clientIsOp {
 			if !alreadySentPrivError {
 				alreadySentPrivError = true
-				client.Send(nil, client.server.name, ERR_CHANOPRIVSNEEDED, channel.name, "You're not a channel operator")
+				rb.Send(nil, client.server.name, ERR_CHANOPRIVSNEEDED, channel.name, "You're not a channel operator")
 			}
 			continue
 		}
@@ -494,12 +532,12 @@ func ApplyChannelModeChanges(channel *Channel, client *Client, isSamode bool, ch
 			list := channel.lists[change.mode]
 			if list == nil {
 				// This should never happen, but better safe than panicky.
-				client.Send(nil, client.server.name, ERR_UNKNOWNERROR, client.nick, "MODE", "Could not complete MODE command")
+				rb.Send(nil, client.server.name, ERR_UNKNOWNERROR, client.nick, "MODE", "Could not complete MODE command")
 				return changes
 			}
 
 			if (change.op == List) || (mask == "") {
-				channel.ShowMaskList(client, change.mode)
+				channel.ShowMaskList(client, change.mode, rb)
 				continue
 			}
 
@@ -513,7 +551,7 @@ func ApplyChannelModeChanges(channel *Channel, client *Client, isSamode bool, ch
 			case Add:
 				if len(list.masks) >= client.server.limits.ChanListModes {
 					if !listFullWarned[change.mode] {
-						client.Send(nil, client.server.name, ERR_BANLISTFULL, client.nick, channel.name, change.mode.String(), "Channel list is full")
+						rb.Send(nil, client.server.name, ERR_BANLISTFULL, client.nick, channel.name, change.mode.String(), "Channel list is full")
 						listFullWarned[change.mode] = true
 					}
 					continue
@@ -541,6 +579,36 @@ func ApplyChannelModeChanges(channel *Channel, client *Client, isSamode bool, ch
 				applied = append(applied, change)
 			}
 
+		case SlowMode:
+			switch change.op {
+			case Add:
+				interval, err := parseSlowModeInterval(change.arg)
+				if err == nil {
+					channel.slowMode = interval
+					applied = append(applied, change)
+				}
+
+			case Remove:
+				channel.slowMode = 0
+				applied = append(applied, change)
+			}
+
+		case PasteThreshold:
+			switch change.op {
+			case Add:
+				lines, window, err := parsePasteThreshold(change.arg)
+				if err == nil {
+					channel.pasteLines = lines
+					channel.pasteWindow = window
+					applied = append(applied, change)
+				}
+
+			case Remove:
+				channel.pasteLines = 0
+				channel.pasteWindow = 0
+				applied = append(applied, change)
+			}
+
 		case Key:
 			switch change.op {
 			case Add:
@@ -551,12 +619,17 @@ func ApplyChannelModeChanges(channel *Channel, client *Client, isSamode bool, ch
 			}
 			applied = append(applied, change)
 
-		case InviteOnly, Moderated, NoOutside, OpOnlyTopic, RegisteredOnly, Secret, ChanRoleplaying:
+		case InviteOnly, Moderated, NoOutside, OpOnlyTopic, RegisteredOnly, Secret, ChanRoleplaying, NoTyping, SecureOnly:
 			switch change.op {
 			case Add:
 				if channel.flags[change.mode] {
 					continue
 				}
+				// otherwise they'd lock themselves out, or kick themselves
+				if change.mode == SecureOnly && !client.hasFlag(TLS) && !isSamode {
+					rb.Send(nil, client.server.name, "FAIL", "MODE", "SECURE_ONLY_CHANNEL", channel.name, "You must be connected with TLS to set +z")
+					continue
+				}
 				channel.flags[change.mode] = true
 				applied = append(applied, change)
 
@@ -601,13 +674,13 @@ func ApplyChannelModeChanges(channel *Channel, client *Client, isSamode bool, ch
 				} else {
 					if !alreadySentPrivError {
 						alreadySentPrivError = true
-						client.Send(nil, client.server.name, ERR_CHANOPRIVSNEEDED, channel.name, "You're not a channel operator")
+						rb.Send(nil, client.server.name, ERR_CHANOPRIVSNEEDED, channel.name, "You're not a channel operator")
 					}
 					continue
 				}
 			}
 
-			change := channel.applyModeMemberNoMutex(client, change.mode, change.op, change.arg)
+			change := channel.applyModeMemberNoMutex(client, change.mode, change.op, change.arg, rb)
 			if change != nil {
 				applied = append(applied, *change)
 			}
@@ -618,12 +691,12 @@ func ApplyChannelModeChanges(channel *Channel, client *Client, isSamode bool, ch
 }
 
 // MODE <target> [<modestring> [<mode arguments>...]]
-func cmodeHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func cmodeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	channelName, err := CasefoldChannel(msg.Params[0])
 	channel := server.channels.Get(channelName)
 
 	if err != nil || channel == nil {
-		client.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, msg.Params[0], "No such channel")
+		rb.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, msg.Params[0], "No such channel")
 		return false
 	}
 
@@ -640,14 +713,18 @@ func cmodeHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 
 		// alert for unknown mode changes
 		for char := range unknown {
-			client.Send(nil, server.name, ERR_UNKNOWNMODE, client.nick, string(char), "is an unknown mode character to me")
+			rb.Send(nil, server.name, ERR_UNKNOWNMODE, client.nick, string(char), "is an unknown mode character to me")
 		}
 		if len(unknown) == 1 && len(changes) == 0 {
 			return false
 		}
 
+		if msg.Command != "SAMODE" {
+			changes = changes.limit(server.limits.Modes)
+		}
+
 		// apply mode changes
-		applied = ApplyChannelModeChanges(channel, client, msg.Command == "SAMODE", changes)
+		applied = ApplyChannelModeChanges(channel, client, msg.Command == "SAMODE", changes, rb)
 	}
 
 	// save changes to banlist/exceptlist/invexlist
@@ -663,7 +740,7 @@ func cmodeHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 	}
 
 	server.registeredChannelsMutex.Lock()
-	if 0 < len(applied) && server.registeredChannels[channel.nameCasefolded] != nil && (banlistUpdated || exceptlistUpdated || invexlistUpdated) {
+	if 0 < len(applied) && server.registeredChannels[channel.nameCasefolded] != nil && (banlistUpdated || exceptlistUpdated || invexlistUpdated) && !server.isReadOnly() {
 		server.store.Update(func(tx *buntdb.Tx) error {
 			chanInfo := server.loadChannelNoMutex(tx, channel.nameCasefolded)
 
@@ -698,16 +775,17 @@ func cmodeHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 
 	// send out changes
 	if len(applied) > 0 {
-		//TODO(dan): we should change the name of String and make it return a slice here
-		args := append([]string{channel.name}, strings.Split(applied.String(), " ")...)
-		for member := range channel.members {
-			member.Send(nil, client.nickMaskString, "MODE", args...)
+		channel.sendModeChangesFromClientNoMutex(client, applied)
+		for _, change := range applied {
+			if change.mode == SecureOnly && change.op == Add && server.channelsKickInsecure && (msg.Command == "SAMODE" || channel.clientIsAtLeastNoMutex(client, ChannelOperator)) {
+				channel.kickInsecureNoMutex(client)
+			}
 		}
 	} else {
 		//TODO(dan): we should just make ModeString return a slice here
 		args := append([]string{client.nick, channel.name}, strings.Split(channel.modeStringNoLock(client), " ")...)
-		client.Send(nil, client.nickMaskString, RPL_CHANNELMODEIS, args...)
-		client.Send(nil, client.nickMaskString, RPL_CHANNELCREATED, client.nick, channel.name, strconv.FormatInt(channel.createdTime.Unix(), 10))
+		rb.Send(nil, client.nickMaskString, RPL_CHANNELMODEIS, args...)
+		rb.Send(nil, client.nickMaskString, RPL_CHANNELCREATED, client.nick, channel.name, strconv.FormatInt(channel.createdTime.Unix(), 10))
 	}
 	return false
 }
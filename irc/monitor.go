@@ -40,7 +40,7 @@ func (client *Client) clearMonitorList() {
 }
 
 var (
-	metadataSubcommands = map[string]func(server *Server, client *Client, msg ircmsg.IrcMessage) bool{
+	metadataSubcommands = map[string]func(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool{
 		"-": monitorRemoveHandler,
 		"+": monitorAddHandler,
 		"c": monitorClearHandler,
@@ -49,20 +49,20 @@ var (
 	}
 )
 
-func monitorHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func monitorHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	handler, exists := metadataSubcommands[strings.ToLower(msg.Params[0])]
 
 	if !exists {
-		client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "MONITOR", msg.Params[0], "Unknown subcommand")
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "MONITOR", msg.Params[0], "Unknown subcommand")
 		return false
 	}
 
-	return handler(server, client, msg)
+	return handler(server, client, msg, rb)
 }
 
-func monitorRemoveHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func monitorRemoveHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	if len(msg.Params) < 2 {
-		client.Send(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, msg.Command, "Not enough parameters")
+		rb.Send(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, msg.Command, "Not enough parameters")
 		return false
 	}
 
@@ -104,9 +104,9 @@ func monitorRemoveHandler(server *Server, client *Client, msg ircmsg.IrcMessage)
 	return false
 }
 
-func monitorAddHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func monitorAddHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	if len(msg.Params) < 2 {
-		client.Send(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, msg.Command, "Not enough parameters")
+		rb.Send(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, msg.Command, "Not enough parameters")
 		return false
 	}
 
@@ -122,8 +122,8 @@ func monitorAddHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bo
 		}
 
 		// check the monitor list length
-		if len(client.monitoring) >= server.limits.MonitorEntries {
-			client.Send(nil, server.name, ERR_MONLISTFULL, client.nick, strconv.Itoa(server.limits.MonitorEntries), strings.Join(targets, ","))
+		if len(client.monitoring) >= client.maxMonitorEntries() {
+			rb.Send(nil, server.name, ERR_MONLISTFULL, client.nick, strconv.Itoa(client.maxMonitorEntries()), strings.Join(targets, ","))
 			break
 		}
 
@@ -155,35 +155,35 @@ func monitorAddHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bo
 	}
 
 	if len(online) > 0 {
-		client.Send(nil, server.name, RPL_MONONLINE, client.nick, strings.Join(online, ","))
+		rb.Send(nil, server.name, RPL_MONONLINE, client.nick, strings.Join(online, ","))
 	}
 	if len(offline) > 0 {
-		client.Send(nil, server.name, RPL_MONOFFLINE, client.nick, strings.Join(offline, ","))
+		rb.Send(nil, server.name, RPL_MONOFFLINE, client.nick, strings.Join(offline, ","))
 	}
 
 	return false
 }
 
-func monitorClearHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func monitorClearHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	client.clearMonitorList()
 
 	return false
 }
 
-func monitorListHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func monitorListHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	var monitorList []string
 	for name := range client.monitoring {
 		monitorList = append(monitorList, name)
 	}
 
 	for _, line := range argsToStrings(maxLastArgLength, monitorList, ",") {
-		client.Send(nil, server.name, RPL_MONLIST, client.nick, line)
+		rb.Send(nil, server.name, RPL_MONLIST, client.nick, line)
 	}
 
 	return false
 }
 
-func monitorStatusHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func monitorStatusHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	var online []string
 	var offline []string
 
@@ -198,12 +198,12 @@ func monitorStatusHandler(server *Server, client *Client, msg ircmsg.IrcMessage)
 
 	if len(online) > 0 {
 		for _, line := range argsToStrings(maxLastArgLength, online, ",") {
-			client.Send(nil, server.name, RPL_MONONLINE, client.nick, line)
+			rb.Send(nil, server.name, RPL_MONONLINE, client.nick, line)
 		}
 	}
 	if len(offline) > 0 {
 		for _, line := range argsToStrings(maxLastArgLength, offline, ",") {
-			client.Send(nil, server.name, RPL_MONOFFLINE, client.nick, line)
+			rb.Send(nil, server.name, RPL_MONOFFLINE, client.nick, line)
 		}
 	}
 
@@ -0,0 +1,48 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+// generateMessageID returns a network-unique message ID. Every PRIVMSG, NOTICE and TAGMSG
+// gets one, which is sent with it as draft/msgid and stored with it in history, so clients
+// can reply to, react to and deduplicate messages.
+func (server *Server) generateMessageID() string {
+	return fmt.Sprintf("%s-%s", strconv.FormatInt(time.Now().UTC().UnixNano(), 10), strconv.FormatInt(rand.Int63(), 10))
+}
+
+// messageTime returns when the message with the given ID was received. Message IDs start
+// with that time, so every copy of a message (the sender's echo included) and its history
+// entry can be given the same time.
+func messageTime(msgid string) time.Time {
+	nanos, err := strconv.ParseInt(strings.SplitN(msgid, "-", 2)[0], 10, 64)
+	if err != nil {
+		return time.Now().UTC()
+	}
+	return time.Unix(0, nanos).UTC()
+}
+
+// withMessageID returns the given tags with the message's ID and time added, if the client's
+// asked for them. The tags aren't changed, since they're often sent to lots of clients.
+func (client *Client) withMessageID(tags *map[string]ircmsg.TagValue, msgid string) *map[string]ircmsg.TagValue {
+	if msgid == "" {
+		return tags
+	}
+	if client.hasCapability(MessageIDs) {
+		tags = tagsWith(tags, "draft/msgid", msgid)
+	}
+	// the time the message was received, rather than when it's sent to this client
+	if client.hasCapability(ServerTime) {
+		tags = tagsWith(tags, "time", messageTime(msgid).Format(IRCv3TimestampFormat))
+	}
+	return tags
+}
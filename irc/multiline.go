@@ -0,0 +1,389 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/history"
+)
+
+const (
+	// multilineConcatTag marks a line in a multiline batch that carries on from the line
+	// before it, rather than starting a new one.
+	multilineConcatTag = "draft/multiline-concat"
+)
+
+// MultilineConfig limits the multiline messages that clients can send. Setting max-bytes to 0
+// turns them off.
+type MultilineConfig struct {
+	MaxBytes int `yaml:"max-bytes"`
+	// MaxLines is how many lines a multiline message can have, or 0 for no limit.
+	MaxLines int `yaml:"max-lines"`
+}
+
+// Enabled returns true if clients can send multiline messages.
+func (conf MultilineConfig) Enabled() bool {
+	return 0 < conf.MaxBytes
+}
+
+// Value returns the value we advertise for the multiline capability.
+func (conf MultilineConfig) Value() string {
+	value := fmt.Sprintf("max-bytes=%d", conf.MaxBytes)
+	if 0 < conf.MaxLines {
+		value += fmt.Sprintf(",max-lines=%d", conf.MaxLines)
+	}
+	return value
+}
+
+// multilineLine is one of the lines of a multiline message.
+type multilineLine struct {
+	message string
+	concat  bool
+}
+
+// multilineBatch is a multiline message that a client is sending. Its lines are held until
+// the batch is closed, and then it's relayed all at once.
+type multilineBatch struct {
+	id     string
+	target string
+	// label is the label the batch was opened with, which its replies get once it's closed.
+	label   string
+	tags    *map[string]ircmsg.TagValue
+	command string
+	lines   []multilineLine
+	bytes   int
+	// fail is what the batch is refused with once it's closed (after FAIL BATCH), if anything
+	// was wrong with it.
+	fail []string
+}
+
+// messages returns the lines of the message as they're sent to clients without multiline,
+// with concat lines joined onto the line before them. Blank lines are left out.
+func (batch *multilineBatch) messages() (messages []string) {
+	var current string
+	for i, line := range batch.lines {
+		if 0 < i && !line.concat {
+			if current != "" {
+				messages = append(messages, current)
+			}
+			current = ""
+		}
+		current += line.message
+	}
+	if current != "" {
+		messages = append(messages, current)
+	}
+	return messages
+}
+
+// text returns the whole message, with its lines separated by newlines.
+func (batch *multilineBatch) text() string {
+	var text string
+	for i, line := range batch.lines {
+		if 0 < i && !line.concat {
+			text += "\n"
+		}
+		text += line.message
+	}
+	return text
+}
+
+// multilineMessageID returns the message ID for one of the lines of a multiline message,
+// which is what clients without multiline (and history) see it as.
+func multilineMessageID(msgid string, index int) string {
+	return fmt.Sprintf("%s-%d", msgid, index)
+}
+
+// BATCH {+,-}<reference> [<type> [<params>...]]
+func batchHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	reference := msg.Params[0]
+	if len(reference) < 2 {
+		rb.Send(nil, server.name, "FAIL", "BATCH", "MULTILINE_INVALID", "Invalid batch reference")
+		return false
+	}
+
+	if reference[0] == '+' {
+		if len(msg.Params) < 3 || msg.Params[1] != BatchMultiline || !client.hasCapability(Multiline) {
+			rb.Send(nil, server.name, "FAIL", "BATCH", "UNKNOWN_TYPE", "Only multiline batches can be sent")
+			return false
+		}
+		batch := &multilineBatch{
+			id:     reference[1:],
+			target: msg.Params[2],
+			tags:   GetClientOnlyTags(msg.Tags),
+		}
+		// the batch is answered once it's closed, rather than now
+		if label, exists := msg.Tags["label"]; exists && client.hasCapability(LabeledResponse) {
+			batch.label = label.Value
+			rb.Label = ""
+		}
+		client.multiline = batch
+		return false
+	}
+
+	batch := client.multiline
+	if reference[0] != '-' || batch == nil || batch.id != reference[1:] {
+		rb.Send(nil, server.name, "FAIL", "BATCH", "MULTILINE_INVALID", "No such batch")
+		return false
+	}
+	client.multiline = nil
+	if batch.label != "" {
+		rb.Label = batch.label
+	}
+	if batch.fail != nil {
+		rb.Send(nil, server.name, "FAIL", append([]string{"BATCH"}, batch.fail...)...)
+		return false
+	}
+	server.sendMultiline(client, batch, rb)
+	return false
+}
+
+// addToMultiline holds the given line if it's part of the multiline batch the client is
+// sending, returning true if it was.
+func (client *Client) addToMultiline(msg ircmsg.IrcMessage) bool {
+	batch := client.multiline
+	if batch == nil {
+		return false
+	}
+	reference, exists := msg.Tags["batch"]
+	if !exists || reference.Value != batch.id {
+		return false
+	}
+	if batch.fail != nil {
+		return true
+	}
+
+	limits := client.server.limits.Multiline
+	_, concat := msg.Tags[multilineConcatTag]
+	switch {
+	case (msg.Command != "PRIVMSG" && msg.Command != "NOTICE") || len(msg.Params) < 2:
+		batch.fail = []string{"MULTILINE_INVALID", "Multiline batches can only hold PRIVMSG and NOTICE lines"}
+	case batch.command != "" && msg.Command != batch.command:
+		batch.fail = []string{"MULTILINE_INVALID", "Multiline batches can't mix PRIVMSG and NOTICE lines"}
+	case msg.Params[0] != batch.target:
+		batch.fail = []string{"MULTILINE_INVALID_TARGET", batch.target, msg.Params[0], "Multiline batch lines must go to the batch's target"}
+	case concat && (len(batch.lines) == 0 || msg.Params[1] == ""):
+		batch.fail = []string{"MULTILINE_INVALID", "Concat lines can't be blank, or the first line of a batch"}
+	default:
+		batch.command = msg.Command
+		batch.bytes += len(msg.Params[1])
+		if !concat && 0 < len(batch.lines) {
+			// the newline between lines counts too
+			batch.bytes++
+		}
+		if limits.MaxBytes < batch.bytes {
+			batch.fail = []string{"MULTILINE_MAX_BYTES", strconv.Itoa(limits.MaxBytes), fmt.Sprintf("Multiline messages can be at most %d bytes", limits.MaxBytes)}
+		} else if 0 < limits.MaxLines && limits.MaxLines <= len(batch.lines) {
+			batch.fail = []string{"MULTILINE_MAX_LINES", strconv.Itoa(limits.MaxLines), fmt.Sprintf("Multiline messages can be at most %d lines", limits.MaxLines)}
+		} else {
+			batch.lines = append(batch.lines, multilineLine{
+				message: msg.Params[1],
+				concat:  concat,
+			})
+		}
+	}
+	return true
+}
+
+// splitMultiline prepares a multiline message for relaying to clients without multiline,
+// applying the long message policy to each of its lines. It returns false if the message
+// should be refused.
+func (server *Server) splitMultiline(client *Client, command, target string, batch *multilineBatch) (split []SplitMessage, allowed bool) {
+	for _, message := range batch.messages() {
+		lineSplit, allowed := server.splitMessage(client, command, target, message)
+		if !allowed {
+			return nil, false
+		}
+		split = append(split, lineSplit)
+	}
+	return split, true
+}
+
+// sendMultiline relays a multiline message that's been sent as a batch to its target.
+func (server *Server) sendMultiline(client *Client, batch *multilineBatch, rb *ResponseBuffer) {
+	if len(batch.lines) == 0 {
+		return
+	}
+	isNotice := batch.command == "NOTICE"
+	prefixes, targetString := SplitChannelMembershipPrefixes(batch.target)
+	lowestPrefix := GetLowestChannelModePrefix(prefixes)
+
+	target, err := CasefoldChannel(targetString)
+	if err == nil {
+		channel := server.channels.Get(target)
+		if channel == nil {
+			if !isNotice {
+				rb.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, targetString, "No such channel")
+			}
+			return
+		}
+		if !channel.CanSpeak(client) {
+			if !isNotice {
+				rb.Send(nil, client.server.name, ERR_CANNOTSENDTOCHAN, channel.name, "Cannot send to channel")
+			}
+			return
+		}
+		for i := range batch.lines {
+			message, allowed := channel.filterMessage(client, batch.command, batch.lines[i].message)
+			if !allowed {
+				return
+			}
+			batch.lines[i].message = message
+		}
+		if client.checkPaste(channel, true) {
+			rb.Send(nil, server.name, "FAIL", batch.command, "PASTE_DROPPED", channel.name, fmt.Sprintf("You're sending messages to %s too quickly, so your multiline message has been dropped", channel.name))
+			return
+		}
+		if allowed, wait := channel.CheckSlowMode(client); !allowed {
+			if !isNotice {
+				channel.sendSlowModeFail(client, batch.command, wait, rb)
+			}
+			return
+		}
+		split, allowed := server.splitMultiline(client, batch.command, channel.name, batch)
+		if !allowed {
+			client.sendMessageTooLong(batch.command, channel.name, rb)
+			return
+		}
+		msgid := server.generateMessageID()
+		channel.sendMultiline(msgid, lowestPrefix, channel.validateReferenceTags(batch.tags), client, batch, split, rb)
+		return
+	}
+
+	target, err = CasefoldName(targetString)
+	if target == "chanserv" || target == "hostserv" || server.isNickServ(target) {
+		rb.Send(nil, server.name, "FAIL", "BATCH", "MULTILINE_INVALID_TARGET", batch.target, "Multiline messages can't be sent to services")
+		return
+	}
+	user := server.clients.Get(target)
+	if err != nil || user == nil {
+		if !isNotice {
+			rb.Send(nil, server.name, ERR_NOSUCHNICK, targetString, "No such nick")
+		}
+		return
+	}
+	if !user.canMessage(client, isNotice) {
+		return
+	}
+	split, allowed := server.splitMultiline(client, batch.command, user.nick, batch)
+	if !allowed {
+		client.sendMessageTooLong(batch.command, user.nick, rb)
+		return
+	}
+	// the sender's echo gets the same tags, msgid and time as the target sees
+	userTags := batch.tags
+	if !user.hasCapability(MessageTags) {
+		userTags = nil
+	}
+	itemType := history.Privmsg
+	if isNotice {
+		itemType = history.Notice
+	}
+	msgid := server.generateMessageID()
+	for i, message := range split {
+		server.recordDirectMessage(client, user, itemType, multilineMessageID(msgid, i), batch.tags, message.ForMaxLine)
+	}
+	user.sendMultilineFromClient(msgid, client, userTags, batch.command, user.nick, batch, split, NewResponseBuffer(user))
+	if client.hasCapability(EchoMessage) {
+		echoTags := batch.tags
+		if !client.hasCapability(MessageTags) {
+			echoTags = nil
+		}
+		client.sendMultilineFromClient(msgid, client, echoTags, batch.command, user.nick, batch, split, rb)
+	}
+	if !isNotice && user.hasFlag(Away) {
+		rb.Send(nil, server.name, RPL_AWAY, user.nick, user.awayMessage)
+	}
+}
+
+// sendMultiline sends a multiline message to everyone in this channel. History and clients
+// without multiline get each of its lines as a separate message.
+func (channel *Channel) sendMultiline(msgid string, minPrefix *Mode, clientOnlyTags *map[string]ircmsg.TagValue, client *Client, batch *multilineBatch, split []SplitMessage, rb *ResponseBuffer) {
+	// STATUSMSG isn't stored, since it's not visible to everyone in the channel
+	for i, message := range split {
+		lineMsgid := multilineMessageID(msgid, i)
+		if channel.history != nil && minPrefix == nil {
+			itemType := history.Privmsg
+			if batch.command == "NOTICE" {
+				itemType = history.Notice
+			}
+			channel.history.Add(client.historyItem(itemType, lineMsgid, clientOnlyTags, message.ForMaxLine))
+		}
+		if batch.command == "PRIVMSG" {
+			channel.recordMissedHighlights(client, lineMsgid, clientOnlyTags, message.ForMaxLine)
+		}
+	}
+	if minPrefix == nil {
+		channel.sendWebhook(WebhookEventMessage, client, webhookPayload{Command: batch.command, Message: batch.text()})
+	}
+
+	channel.membersMutex.RLock()
+	defer channel.membersMutex.RUnlock()
+
+	// for STATUSMSG
+	var minPrefixMode Mode
+	if minPrefix != nil {
+		minPrefixMode = *minPrefix
+	}
+	for member := range channel.members {
+		if minPrefix != nil && !channel.ClientIsAtLeast(member, minPrefixMode) {
+			// STATUSMSG
+			continue
+		}
+		if member == client && !client.hasCapability(EchoMessage) {
+			continue
+		}
+		if member.ignores.IsSilenced(client.nickMaskCasefolded) {
+			continue
+		}
+		var tagsToUse *map[string]ircmsg.TagValue
+		if member.hasCapability(MessageTags) {
+			tagsToUse = clientOnlyTags
+		}
+		// the sender's echo is a reply to their command
+		memberRb := rb
+		if member != client {
+			memberRb = NewResponseBuffer(member)
+		}
+		member.sendMultilineFromClient(msgid, client, tagsToUse, batch.command, channel.name, batch, split, memberRb)
+		for i := range split {
+			channel.addFanout(member, &split[i])
+		}
+	}
+}
+
+// sendMultilineFromClient sends a multiline message coming from a specific client, as a
+// multiline batch if the client supports them, or as separate messages if not.
+func (client *Client) sendMultilineFromClient(msgid string, from *Client, tags *map[string]ircmsg.TagValue, command, target string, batch *multilineBatch, split []SplitMessage, rb *ResponseBuffer) {
+	if !client.hasCapability(Multiline) || !client.hasCapability(Batch) {
+		for i, message := range split {
+			rb.SendSplitMsgFromClient(multilineMessageID(msgid, i), from, tags, command, target, message)
+		}
+		return
+	}
+
+	var lineTags *map[string]ircmsg.TagValue
+	if client.hasCapability(AccountTag) && from.account != &NoAccount {
+		lineTags = ircmsg.MakeTags("account", from.account.Name)
+	}
+	concatTags := ircmsg.MakeTags(multilineConcatTag, nil)
+	if lineTags != nil {
+		for name, value := range *lineTags {
+			(*concatTags)[name] = value
+		}
+	}
+
+	multiline := rb.StartBatchFrom(from.nickMaskString, client.withMessageID(tags, msgid), BatchMultiline, target)
+	for _, line := range batch.lines {
+		if line.concat {
+			multiline.Send(concatTags, from.nickMaskString, command, target, line.message)
+		} else {
+			multiline.Send(lineTags, from.nickMaskString, command, target, line.message)
+		}
+	}
+	multiline.End()
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+func newMultilineTestClient(limits MultilineConfig) *Client {
+	server := &Server{}
+	server.limits.Multiline = limits
+	server.linePolicy = &LinePolicy{LongMessages: LongMessagesSplit}
+	return &Client{
+		server:         server,
+		nickMaskString: "alice!u@example.com",
+		multiline: &multilineBatch{
+			id:     "b",
+			target: "#chan",
+		},
+	}
+}
+
+func TestAddToMultiline(t *testing.T) {
+	cases := []struct {
+		name     string
+		limits   MultilineConfig
+		lines    []string
+		fail     string
+		messages []string
+		text     string
+	}{
+		{
+			name:     "separate lines",
+			limits:   MultilineConfig{MaxBytes: 4096},
+			lines:    []string{"@batch=b PRIVMSG #chan :hello", "@batch=b PRIVMSG #chan :world"},
+			messages: []string{"hello", "world"},
+			text:     "hello\nworld",
+		},
+		{
+			name:     "concat",
+			limits:   MultilineConfig{MaxBytes: 4096},
+			lines:    []string{"@batch=b PRIVMSG #chan :hel", "@batch=b;draft/multiline-concat PRIVMSG #chan :lo", "@batch=b PRIVMSG #chan :world"},
+			messages: []string{"hello", "world"},
+			text:     "hello\nworld",
+		},
+		{
+			name:     "blank lines aren't relayed separately",
+			limits:   MultilineConfig{MaxBytes: 4096},
+			lines:    []string{"@batch=b PRIVMSG #chan :hello", "@batch=b PRIVMSG #chan :", "@batch=b PRIVMSG #chan :world"},
+			messages: []string{"hello", "world"},
+			text:     "hello\n\nworld",
+		},
+		{
+			name:   "concat first line",
+			limits: MultilineConfig{MaxBytes: 4096},
+			lines:  []string{"@batch=b;draft/multiline-concat PRIVMSG #chan :hello"},
+			fail:   "MULTILINE_INVALID",
+		},
+		{
+			name:   "blank concat line",
+			limits: MultilineConfig{MaxBytes: 4096},
+			lines:  []string{"@batch=b PRIVMSG #chan :hello", "@batch=b;draft/multiline-concat PRIVMSG #chan :"},
+			fail:   "MULTILINE_INVALID",
+		},
+		{
+			name:   "mixed commands",
+			limits: MultilineConfig{MaxBytes: 4096},
+			lines:  []string{"@batch=b PRIVMSG #chan :hello", "@batch=b NOTICE #chan :world"},
+			fail:   "MULTILINE_INVALID",
+		},
+		{
+			name:   "wrong command",
+			limits: MultilineConfig{MaxBytes: 4096},
+			lines:  []string{"@batch=b TOPIC #chan :hello"},
+			fail:   "MULTILINE_INVALID",
+		},
+		{
+			name:   "wrong target",
+			limits: MultilineConfig{MaxBytes: 4096},
+			lines:  []string{"@batch=b PRIVMSG #other :hello"},
+			fail:   "MULTILINE_INVALID_TARGET",
+		},
+		{
+			// the newline between the lines makes this 11 bytes
+			name:   "max bytes",
+			limits: MultilineConfig{MaxBytes: 10},
+			lines:  []string{"@batch=b PRIVMSG #chan :hello", "@batch=b PRIVMSG #chan :world"},
+			fail:   "MULTILINE_MAX_BYTES",
+		},
+		{
+			name:     "max bytes with concat",
+			limits:   MultilineConfig{MaxBytes: 10},
+			lines:    []string{"@batch=b PRIVMSG #chan :hello", "@batch=b;draft/multiline-concat PRIVMSG #chan :world"},
+			messages: []string{"helloworld"},
+			text:     "helloworld",
+		},
+		{
+			name:   "max lines",
+			limits: MultilineConfig{MaxBytes: 4096, MaxLines: 2},
+			lines:  []string{"@batch=b PRIVMSG #chan :a", "@batch=b PRIVMSG #chan :b", "@batch=b PRIVMSG #chan :c"},
+			fail:   "MULTILINE_MAX_LINES",
+		},
+	}
+
+	for _, c := range cases {
+		client := newMultilineTestClient(c.limits)
+		for _, line := range c.lines {
+			msg, err := ircmsg.ParseLine(line)
+			if err != nil {
+				t.Fatalf("%s: couldn't parse %q: %s", c.name, line, err.Error())
+			}
+			if !client.addToMultiline(msg) {
+				t.Errorf("%s: %q wasn't added to the batch", c.name, line)
+			}
+		}
+
+		batch := client.multiline
+		if c.fail != "" {
+			if batch.fail == nil || batch.fail[0] != c.fail {
+				t.Errorf("%s: expected the batch to fail with %s, got %v", c.name, c.fail, batch.fail)
+			}
+			continue
+		}
+		if batch.fail != nil {
+			t.Errorf("%s: expected the batch to be fine, got %v", c.name, batch.fail)
+			continue
+		}
+		if messages := batch.messages(); !reflect.DeepEqual(messages, c.messages) {
+			t.Errorf("%s: expected messages %q, got %q", c.name, c.messages, messages)
+		}
+		if text := batch.text(); text != c.text {
+			t.Errorf("%s: expected text %q, got %q", c.name, c.text, text)
+		}
+	}
+}
+
+func TestAddToMultilineOtherLines(t *testing.T) {
+	client := newMultilineTestClient(MultilineConfig{MaxBytes: 4096})
+	for _, line := range []string{"PRIVMSG #chan :hello", "@batch=other PRIVMSG #chan :hello", "PING abc"} {
+		msg, _ := ircmsg.ParseLine(line)
+		if client.addToMultiline(msg) {
+			t.Errorf("%q was added to the batch", line)
+		}
+	}
+
+	client.multiline = nil
+	msg, _ := ircmsg.ParseLine("@batch=b PRIVMSG #chan :hello")
+	if client.addToMultiline(msg) {
+		t.Error("line was added without a batch open")
+	}
+}
+
+// clients without multiline get each line of the message separately, split like any other
+// message if it's too long for them.
+func TestSplitMultiline(t *testing.T) {
+	client := newMultilineTestClient(MultilineConfig{MaxBytes: 4096})
+	long := strings.Repeat("a", 600)
+	client.multiline.lines = []multilineLine{
+		{message: "hello"},
+		{message: long},
+	}
+
+	split, allowed := client.server.splitMultiline(client, "PRIVMSG", "#chan", client.multiline)
+	if !allowed {
+		t.Fatal("expected the message to be allowed")
+	}
+	if len(split) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(split))
+	}
+	if !reflect.DeepEqual(split[0].For512, []string{"hello"}) || split[0].ForMaxLine != "hello" {
+		t.Errorf("expected the first line to be left alone, got %+v", split[0])
+	}
+	if split[1].ForMaxLine != long || len(split[1].For512) < 2 || strings.Join(split[1].For512, "") != long {
+		t.Errorf("expected the long line to be split, got %d parts", len(split[1].For512))
+	}
+
+	client.server.linePolicy.LongMessages = LongMessagesReject
+	if _, allowed := client.server.splitMultiline(client, "PRIVMSG", "#chan", client.multiline); allowed {
+		t.Error("expected the message to be refused when long messages are rejected")
+	}
+}
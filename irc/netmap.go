@@ -0,0 +1,71 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+
+	"github.com/goshuirc/irc-go/ircmatch"
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+const (
+	// NetworkMapEveryone lets everyone see the network map.
+	NetworkMapEveryone = "everyone"
+	// NetworkMapOpers only lets opers see the network map.
+	NetworkMapOpers = "opers"
+)
+
+// canSeeNetworkMap returns true if the client can see the network map with MAP and LINKS.
+func (server *Server) canSeeNetworkMap(client *Client) bool {
+	return server.networkMap.Visibility == NetworkMapEveryone || client.hasFlag(Operator)
+}
+
+// serverDescription returns the description shown for this server in MAP and LINKS.
+func (server *Server) serverDescription() string {
+	if server.networkMap.Description != "" {
+		return server.networkMap.Description
+	}
+	return server.networkName
+}
+
+// MAP
+func mapHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	if !server.canSeeNetworkMap(client) {
+		rb.Send(nil, server.name, ERR_NOPRIVILEGES, client.nick, "Permission Denied - You're not an IRC operator")
+		return false
+	}
+
+	//TODO(dan): list linked servers here once we have them
+	line := server.name
+	if server.networkMap.ShowUserCounts {
+		line = fmt.Sprintf("%s [%d users]", server.name, server.clients.Count())
+	}
+	rb.Send(nil, server.name, RPL_MAP, client.nick, line)
+	rb.Send(nil, server.name, RPL_MAPEND, client.nick, "End of /MAP")
+	return false
+}
+
+// LINKS [[<remote server>] <server mask>]
+func linksHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	mask := "*"
+	if 0 < len(msg.Params) {
+		mask = msg.Params[len(msg.Params)-1]
+	}
+	if 1 < len(msg.Params) {
+		remote, err := Casefold(msg.Params[0])
+		if err != nil || !ircmatch.MakeMatch(remote).Match(server.nameCasefolded) {
+			rb.Send(nil, server.name, ERR_NOSUCHSERVER, client.nick, msg.Params[0], "No such server")
+			return false
+		}
+	}
+
+	// non-opers just get an empty list if they can't see the map, like with flattened links
+	maskCasefolded, err := Casefold(mask)
+	if err == nil && server.canSeeNetworkMap(client) && ircmatch.MakeMatch(maskCasefolded).Match(server.nameCasefolded) {
+		rb.Send(nil, server.name, RPL_LINKS, client.nick, server.name, server.name, fmt.Sprintf("0 %s", server.serverDescription()))
+	}
+	rb.Send(nil, server.name, RPL_ENDOFLINKS, client.nick, mask, "End of /LINKS list")
+	return false
+}
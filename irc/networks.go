@@ -0,0 +1,183 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/tls"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// sniHandshakeTimeout is how long we wait for a client's TLS handshake when we need
+	// to know which network they're connecting to.
+	sniHandshakeTimeout = 30 * time.Second
+)
+
+// NetworkConfig is a separate IRC network that's run in the same process as this one. It
+// has its own nicks, channels, accounts and datastore.
+type NetworkConfig struct {
+	// Config is the network's own config file.
+	Config string
+	// SNI is the list of hostnames that send clients on our TLS listeners to this network.
+	SNI []string `yaml:"sni"`
+	// TLS is the certificate used for clients that connect to this network using SNI.
+	TLS *TLSListenConfig `yaml:"tls"`
+}
+
+// virtualNetwork is a network that clients can reach using our TLS listeners.
+type virtualNetwork struct {
+	name      string
+	server    *Server
+	tlsConfig *tls.Config
+}
+
+// LoadNetworks loads the config files of the extra networks in the given config.
+func LoadNetworks(config *Config) (map[string]*Config, error) {
+	configs := make(map[string]*Config)
+	datastores := map[string]string{
+		filepath.Clean(config.Datastore.Path): "the main network",
+	}
+	hostnames := make(map[string]string)
+
+	for name, networkConfig := range config.Networks {
+		if networkConfig.Config == "" {
+			return nil, fmt.Errorf("Network %s has no config file", name)
+		}
+		netConfig, err := LoadConfig(networkConfig.Config)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load config for network %s: %s", name, err.Error())
+		}
+
+		if len(netConfig.Networks) != 0 {
+			return nil, fmt.Errorf("Network %s can't define its own networks", name)
+		}
+		if netConfig.Server.RestAPI.Enabled {
+			return nil, fmt.Errorf("Network %s can't enable the rest API, only the main network can", name)
+		}
+		if netConfig.Server.ControlSocket.Enabled {
+			return nil, fmt.Errorf("Network %s can't enable the control socket, only the main network can", name)
+		}
+		datastore := filepath.Clean(netConfig.Datastore.Path)
+		if other, exists := datastores[datastore]; exists {
+			return nil, fmt.Errorf("Network %s uses the same datastore as %s", name, other)
+		}
+		datastores[datastore] = "network " + name
+
+		for _, hostname := range networkConfig.SNI {
+			hostname = strings.ToLower(hostname)
+			if !IsHostname(hostname) {
+				return nil, fmt.Errorf("Network %s has an invalid SNI hostname: %s", name, hostname)
+			}
+			if other, exists := hostnames[hostname]; exists {
+				return nil, fmt.Errorf("SNI hostname %s is used by both %s and %s", hostname, other, name)
+			}
+			hostnames[hostname] = name
+		}
+
+		configs[name] = netConfig
+	}
+
+	return configs, nil
+}
+
+// AddNetwork lets clients reach the given network by connecting to one of our TLS
+// listeners using one of the network's SNI hostnames.
+func (server *Server) AddNetwork(name string, network *Server, config *NetworkConfig) error {
+	if len(config.SNI) == 0 {
+		return nil
+	}
+	if len(server.TLSListenerAddrs()) == 0 {
+		return fmt.Errorf("Network %s uses SNI, but we don't have any TLS listeners", name)
+	}
+
+	vnet := &virtualNetwork{
+		name:   name,
+		server: network,
+	}
+	if config.TLS != nil {
+		tlsConfig, err := config.TLS.Config()
+		if err != nil {
+			return fmt.Errorf("Could not load TLS certificate for network %s: %s", name, err.Error())
+		}
+		tlsConfig.ClientAuth = tls.RequestClientCert
+		vnet.tlsConfig = tlsConfig
+	}
+
+	server.networksMutex.Lock()
+	defer server.networksMutex.Unlock()
+	for _, hostname := range config.SNI {
+		server.networks[strings.ToLower(hostname)] = vnet
+	}
+	server.logger.Info("startup", fmt.Sprintf("Network %s is reachable on our TLS listeners as %s", name, strings.Join(config.SNI, ", ")))
+	return nil
+}
+
+// TLSListenerAddrs returns the addresses of our TLS listeners.
+func (server *Server) TLSListenerAddrs() []string {
+	server.listenerUpdateMutex.Lock()
+	defer server.listenerUpdateMutex.Unlock()
+	var addrs []string
+	for addr, li := range server.listeners {
+		if li.IsTLS {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// hasNetworks returns true if other networks can be reached using SNI.
+func (server *Server) hasNetworks() bool {
+	server.networksMutex.RLock()
+	defer server.networksMutex.RUnlock()
+	return len(server.networks) != 0
+}
+
+// networkForSNI returns the network that the given SNI hostname belongs to, or nil.
+func (server *Server) networkForSNI(hostname string) *virtualNetwork {
+	server.networksMutex.RLock()
+	defer server.networksMutex.RUnlock()
+	return server.networks[strings.ToLower(strings.TrimSuffix(hostname, "."))]
+}
+
+// sniConfig returns a function that gives clients the certificate of the network they're
+// connecting to, falling back to the listener's own config.
+func (server *Server) sniConfig(config *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		vnet := server.networkForSNI(hello.ServerName)
+		if vnet == nil || vnet.tlsConfig == nil {
+			return config, nil
+		}
+		return vnet.tlsConfig, nil
+	}
+}
+
+// routeConn completes the TLS handshake of a new connection, and passes it to the network
+// the client asked for using SNI.
+func (server *Server) routeConn(conn clientConn) {
+	tlsConn, isTLS := conn.Conn.(*tls.Conn)
+	if !isTLS {
+		server.queueConn(conn)
+		return
+	}
+
+	tlsConn.SetDeadline(time.Now().Add(sniHandshakeTimeout))
+	err := tlsConn.Handshake()
+	if err != nil {
+		server.logger.Debug("localconnect-ip", fmt.Sprintf("TLS handshake from %s failed: %s", IPString(conn.Conn.RemoteAddr()), err.Error()))
+		tlsConn.Close()
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	vnet := server.networkForSNI(tlsConn.ConnectionState().ServerName)
+	if vnet == nil {
+		server.queueConn(conn)
+		return
+	}
+	server.logger.Debug("localconnect-ip", fmt.Sprintf("Client connecting from %s to network %s", IPString(conn.Conn.RemoteAddr()), vnet.name))
+	vnet.server.queueConn(conn)
+}
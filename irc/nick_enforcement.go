@@ -0,0 +1,327 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	// keyAccountEnforce holds whether the account's nickname is protected, if the owner has
+	// changed it from the default.
+	keyAccountEnforce = "account.enforce %s"
+
+	// NickEnforcementRename changes the nickname of clients using a protected nickname.
+	NickEnforcementRename = "rename"
+	// NickEnforcementDisconnect disconnects clients using a protected nickname.
+	NickEnforcementDisconnect = "disconnect"
+
+	defaultNickEnforcementGracePeriod = 30 * time.Second
+)
+
+// NickEnforcementConfig protects registered nicknames, by giving clients that use one a little
+// while to log into its account before they're renamed or disconnected.
+type NickEnforcementConfig struct {
+	Enabled bool
+	Method  string
+	// Default is whether nicknames are protected when their owners haven't chosen.
+	Default           bool
+	GracePeriodString string        `yaml:"grace-period"`
+	GracePeriod       time.Duration `yaml:"grace-period-real"`
+}
+
+// load checks the config and parses the grace period.
+func (conf *NickEnforcementConfig) load() (err error) {
+	if !conf.Enabled {
+		return nil
+	}
+	switch conf.Method {
+	case "":
+		conf.Method = NickEnforcementRename
+	case NickEnforcementRename, NickEnforcementDisconnect:
+	default:
+		return fmt.Errorf("method must be %s or %s, not %s", NickEnforcementRename, NickEnforcementDisconnect, conf.Method)
+	}
+	conf.GracePeriod = defaultNickEnforcementGracePeriod
+	if conf.GracePeriodString != "" {
+		conf.GracePeriod, err = time.ParseDuration(conf.GracePeriodString)
+		if err != nil {
+			return fmt.Errorf("Could not parse grace-period: %s", err.Error())
+		}
+		if conf.GracePeriod < 0 {
+			return errors.New("grace-period can't be negative")
+		}
+	}
+	return nil
+}
+
+// nickIsProtected returns true if the given casefolded nickname belongs to a registered
+// account whose nicknames are being enforced.
+func (server *Server) nickIsProtected(nickname string) bool {
+	if !server.nickEnforcement.Enabled {
+		return false
+	}
+	protected := false
+	server.store.View(func(tx *buntdb.Tx) error {
+		accountKey := nickAccount(tx, nickname)
+		_, err := tx.Get(fmt.Sprintf(keyAccountVerified, accountKey))
+		if err != nil || loadAccountSuspension(tx, accountKey) != nil {
+			return nil
+		}
+		setting, err := tx.Get(fmt.Sprintf(keyAccountEnforce, accountKey))
+		if err == nil {
+			protected = setting == "on"
+		} else {
+			protected = server.nickEnforcement.Default
+		}
+		return nil
+	})
+	return protected
+}
+
+// ownsNick returns true if the client is logged into the account that owns the given
+// casefolded nickname, either as its name or one of its grouped nicknames.
+func (client *Client) ownsNick(nickname string) bool {
+	if client.account == &NoAccount {
+		return false
+	}
+	accountKey, _ := CasefoldName(client.account.Name)
+	if accountKey == nickname {
+		return true
+	}
+	var owner string
+	client.server.store.View(func(tx *buntdb.Tx) error {
+		owner = groupedNickAccount(tx, nickname)
+		return nil
+	})
+	return owner == accountKey
+}
+
+// checkNickEnforcement is called when the client registers or changes their nickname. If
+// they're using someone else's protected nickname, they're warned and given the grace period
+// to log in before it's enforced.
+func (client *Client) checkNickEnforcement(rb *ResponseBuffer) {
+	client.stopNickEnforcement()
+	nickname := client.nickCasefolded
+	if !client.registered || client.ownsNick(nickname) || !client.server.nickIsProtected(nickname) {
+		return
+	}
+
+	conf := client.server.nickEnforcement
+	if 0 < conf.GracePeriod {
+		var consequence string
+		if conf.Method == NickEnforcementDisconnect {
+			consequence = "you will be disconnected"
+		} else {
+			consequence = "your nickname will be changed"
+		}
+		rb.NickServNotice(fmt.Sprintf("The nickname %s is registered. Log in with /NS IDENTIFY <password> within %s, or %s", client.nick, conf.GracePeriod, consequence))
+	}
+
+	nick := client.nick
+	client.timerMutex.Lock()
+	client.nickEnforcementID++
+	id := client.nickEnforcementID
+	if conf.GracePeriod == 0 {
+		// enforced by the client's goroutine once it's done with the current command
+		client.nickEnforcementDue = nickname
+	} else {
+		client.nickTimer = time.AfterFunc(conf.GracePeriod, func() {
+			client.nickGracePeriodEnded(id, nickname, nick)
+		})
+	}
+	client.timerMutex.Unlock()
+}
+
+// stopNickEnforcement cancels any enforcement of the client's current nickname.
+func (client *Client) stopNickEnforcement() {
+	client.timerMutex.Lock()
+	client.nickEnforcementID++
+	client.nickEnforcementDue = ""
+	if client.nickTimer != nil {
+		client.nickTimer.Stop()
+		client.nickTimer = nil
+	}
+	client.timerMutex.Unlock()
+}
+
+// nickGracePeriodEnded runs on the grace period's timer. Like connectionTimeout it only
+// quits the client, and renames are left to the client's goroutine, which is woken with a
+// PING if it's waiting for input.
+func (client *Client) nickGracePeriodEnded(id uint64, nickname, nick string) {
+	client.timerMutex.Lock()
+	defer client.timerMutex.Unlock()
+	// the client changed nickname or logged in since the timer started
+	if id != client.nickEnforcementID {
+		return
+	}
+	client.nickTimer = nil
+	// the account could have been suspended since the timer started
+	if !client.server.nickIsProtected(nickname) {
+		return
+	}
+
+	if client.server.nickEnforcement.Method == NickEnforcementDisconnect {
+		client.server.logger.Info("accounts", fmt.Sprintf("Enforcing nickname %s by disconnecting its user", nick))
+		client.Quit(fmt.Sprintf("The nickname %s is registered, and you didn't log into it", nick))
+		client.isQuitting = true
+		client.socket.Close()
+		return
+	}
+	client.nickEnforcementDue = nickname
+	client.Send(nil, "", "PING", nick)
+}
+
+// runNickEnforcement enforces the client's nickname if its grace period has ended. It's
+// called by the client's goroutine, between commands.
+func (client *Client) runNickEnforcement() {
+	client.timerMutex.Lock()
+	nickname := client.nickEnforcementDue
+	client.nickEnforcementDue = ""
+	client.timerMutex.Unlock()
+	if nickname != "" {
+		client.enforceNick(nickname)
+	}
+}
+
+// enforceNick renames or disconnects the client if they're still using the given protected
+// nickname without having logged into its account.
+func (client *Client) enforceNick(nickname string) {
+	if client.isQuitting || client.nickCasefolded != nickname || client.ownsNick(nickname) {
+		return
+	}
+	// the account could have been suspended since the grace period started
+	if !client.server.nickIsProtected(nickname) {
+		return
+	}
+	server := client.server
+	server.logger.Info("accounts", fmt.Sprintf("Enforcing nickname %s on %s", client.nick, client.nickMaskString))
+
+	if server.nickEnforcement.Method == NickEnforcementDisconnect {
+		client.Quit(fmt.Sprintf("The nickname %s is registered, and you didn't log into it", client.nick))
+		client.isQuitting = true
+		return
+	}
+	client.renameFromProtectedNick()
+}
+
+// renameFromProtectedNick moves the client off a nickname they're not allowed to keep. If
+// that doesn't work they're disconnected, since they can't stay where they are.
+func (client *Client) renameFromProtectedNick() {
+	oldNick := client.nick
+	fallback := client.server.fallbackNick(oldNick)
+	if fallback == "" {
+		fallback = client.server.guestNick()
+	}
+	if fallback == "" || client.ChangeNickname(fallback, NewResponseBuffer(client)) != nil {
+		client.Quit(fmt.Sprintf("The nickname %s is registered, and you didn't log into it", oldNick))
+		client.isQuitting = true
+		client.socket.Close()
+		return
+	}
+	client.alertMonitors()
+	client.NickServNotice(fmt.Sprintf("The nickname %s is registered, so your nickname has been changed to %s", oldNick, fallback))
+	client.checkNickEnforcement(NewResponseBuffer(client))
+}
+
+// nickservSetEnforce handles NickServ SET ENFORCE, which controls whether the account's
+// nickname is protected.
+//
+// SET ENFORCE <ON|OFF|DEFAULT>
+func (server *Server) nickservSetEnforce(client *Client, params []string, rb *ResponseBuffer) {
+	if !server.nickEnforcement.Enabled {
+		rb.NickServNotice("Nickname enforcement is not enabled on this server")
+		return
+	}
+	if client.account == &NoAccount {
+		rb.NickServNotice("You must be logged into an account to change its settings")
+		return
+	}
+	if len(params) < 1 {
+		rb.NickServNotice("Syntax: SET ENFORCE <ON|OFF|DEFAULT>")
+		return
+	}
+	setting := strings.ToLower(params[0])
+	if setting != "on" && setting != "off" && setting != "default" {
+		rb.NickServNotice("Syntax: SET ENFORCE <ON|OFF|DEFAULT>")
+		return
+	}
+	if !server.checkWritable(client, "NICKSERV", rb) {
+		return
+	}
+
+	accountKey, _ := CasefoldName(client.account.Name)
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		var err error
+		if setting == "default" {
+			_, err = tx.Delete(fmt.Sprintf(keyAccountEnforce, accountKey))
+			if err == buntdb.ErrNotFound {
+				err = nil
+			}
+		} else {
+			_, _, err = tx.Set(fmt.Sprintf(keyAccountEnforce, accountKey), setting, nil)
+		}
+		return err
+	})
+	if err != nil {
+		rb.NickServNotice("Could not save setting")
+		server.logger.Error("internal", fmt.Sprintf("Could not save enforce setting for account %s: %s", client.account.Name, err.Error()))
+		return
+	}
+
+	if server.nickIsProtected(accountKey) {
+		rb.NickServNotice(fmt.Sprintf("The nickname %s is now protected", client.account.Name))
+	} else {
+		rb.NickServNotice(fmt.Sprintf("The nickname %s is no longer protected", client.account.Name))
+	}
+}
+
+// nickservRegain handles NickServ REGAIN, which takes back one of the nicknames of the account
+// the client is logged into. Whoever's using it is renamed, or disconnected if they're logged
+// into the same account.
+//
+// REGAIN [<nickname>]
+func (server *Server) nickservRegain(client *Client, params []string, rb *ResponseBuffer) {
+	if client.account == &NoAccount {
+		rb.NickServNotice("You must be logged into an account to use REGAIN")
+		return
+	}
+	nick := client.account.Name
+	if 0 < len(params) {
+		nick = params[0]
+	}
+	nickname, err := CasefoldName(nick)
+	if err != nil || !client.ownsNick(nickname) {
+		rb.NickServNotice(fmt.Sprintf("%s isn't one of your account's nicknames", nick))
+		return
+	}
+	if client.nickCasefolded == nickname {
+		rb.NickServNotice("You're already using that nickname")
+		return
+	}
+
+	target := server.clients.Get(nickname)
+	if target != nil {
+		server.logger.Info("accounts", fmt.Sprintf("%s used REGAIN on %s", client.nickMaskString, target.nickMaskString))
+		if target.account == client.account {
+			target.Quit(fmt.Sprintf("REGAIN command used by %s", client.nick))
+			target.destroy()
+		} else {
+			target.renameFromProtectedNick()
+		}
+	}
+
+	err = client.ChangeNickname(nick, rb)
+	if err != nil {
+		rb.NickServNotice(fmt.Sprintf("Could not change your nickname to %s", nick))
+		return
+	}
+	client.alertMonitors()
+	rb.NickServNotice(fmt.Sprintf("You have regained the nickname %s", client.nick))
+}
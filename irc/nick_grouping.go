@@ -0,0 +1,154 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	// keyGroupedNick maps a casefolded nickname to the account it's grouped with.
+	keyGroupedNick = "account.groupednick %s"
+
+	defaultMaxGroupedNicks = 5
+)
+
+var (
+	errTooManyGroupedNicks = errors.New("You have too many nicknames grouped with your account, ungroup one first")
+	errNickNotGrouped      = errors.New("Nickname isn't grouped with the account")
+)
+
+// groupedNickAccount returns the key of the account that the given casefolded nickname is
+// grouped with, or "" if it isn't grouped.
+func groupedNickAccount(tx *buntdb.Tx, nickname string) string {
+	accountKey, err := tx.Get(fmt.Sprintf(keyGroupedNick, nickname))
+	if err != nil {
+		return ""
+	}
+	return accountKey
+}
+
+// nickAccount returns the key of the account that owns the given casefolded nickname, either
+// because it's the account's name or because it's been grouped with it. If no account owns
+// it, the nickname is returned as-is.
+func nickAccount(tx *buntdb.Tx, nickname string) string {
+	if accountKey := groupedNickAccount(tx, nickname); accountKey != "" {
+		return accountKey
+	}
+	return nickname
+}
+
+// accountNameTaken returns true if a new account can't be made with the given casefolded
+// name, because there's already an account with it or it's been grouped with one.
+func accountNameTaken(tx *buntdb.Tx, accountKey string) bool {
+	_, err := tx.Get(fmt.Sprintf(keyAccountExists, accountKey))
+	return err != buntdb.ErrNotFound || groupedNickAccount(tx, accountKey) != ""
+}
+
+// groupedNicks returns the nicknames grouped with the given account, sorted.
+func groupedNicks(tx *buntdb.Tx, accountKey string) []string {
+	var nicks []string
+	prefix := strings.TrimSuffix(keyGroupedNick, "%s")
+	tx.AscendKeys(prefix+"*", func(key, value string) bool {
+		if value == accountKey {
+			nicks = append(nicks, strings.TrimPrefix(key, prefix))
+		}
+		return true
+	})
+	sort.Strings(nicks)
+	return nicks
+}
+
+// nickservGroup handles NickServ GROUP, which groups the client's current nickname with the
+// account they're logged into.
+//
+// GROUP
+func (server *Server) nickservGroup(client *Client, params []string, rb *ResponseBuffer) {
+	if client.account == &NoAccount {
+		rb.NickServNotice("You must be logged into an account to group your nickname with it")
+		return
+	}
+	if !server.checkWritable(client, "NICKSERV", rb) {
+		return
+	}
+	accountKey, _ := CasefoldName(client.account.Name)
+	nickname := client.nickCasefolded
+
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		if accountNameTaken(tx, nickname) {
+			return errAccountCreation
+		}
+		if server.nickserv.MaxGroupedNicks <= len(groupedNicks(tx, accountKey)) {
+			return errTooManyGroupedNicks
+		}
+		_, _, err := tx.Set(fmt.Sprintf(keyGroupedNick, nickname), accountKey, nil)
+		return err
+	})
+	switch err {
+	case nil:
+	case errAccountCreation:
+		rb.NickServNotice(fmt.Sprintf("The nickname %s is already registered", client.nick))
+		return
+	case errTooManyGroupedNicks:
+		rb.NickServNotice(err.Error())
+		return
+	default:
+		rb.NickServNotice("Could not group your nickname")
+		server.logger.Error("internal", fmt.Sprintf("Could not group nickname %s with account %s: %s", client.nick, client.account.Name, err.Error()))
+		return
+	}
+
+	server.logger.Info("accounts", fmt.Sprintf("Nickname %s grouped with account %s", client.nick, client.account.Name))
+	rb.NickServNotice(fmt.Sprintf("The nickname %s is now grouped with your account", client.nick))
+}
+
+// nickservUngroup handles NickServ UNGROUP, which removes a nickname from the account the
+// client is logged into. It defaults to the client's current nickname.
+//
+// UNGROUP [<nickname>]
+func (server *Server) nickservUngroup(client *Client, params []string, rb *ResponseBuffer) {
+	if client.account == &NoAccount {
+		rb.NickServNotice("You must be logged into an account to ungroup nicknames from it")
+		return
+	}
+	nick := client.nick
+	if 0 < len(params) {
+		nick = params[0]
+	}
+	nickname, err := CasefoldName(nick)
+	if err != nil {
+		rb.NickServNotice(fmt.Sprintf("%s isn't grouped with your account", nick))
+		return
+	}
+	if !server.checkWritable(client, "NICKSERV", rb) {
+		return
+	}
+	accountKey, _ := CasefoldName(client.account.Name)
+
+	err = server.store.Update(func(tx *buntdb.Tx) error {
+		if groupedNickAccount(tx, nickname) != accountKey {
+			return errNickNotGrouped
+		}
+		_, err := tx.Delete(fmt.Sprintf(keyGroupedNick, nickname))
+		return err
+	})
+	switch err {
+	case nil:
+	case errNickNotGrouped:
+		rb.NickServNotice(fmt.Sprintf("%s isn't grouped with your account", nick))
+		return
+	default:
+		rb.NickServNotice("Could not ungroup the nickname")
+		server.logger.Error("internal", fmt.Sprintf("Could not ungroup nickname %s from account %s: %s", nick, client.account.Name, err.Error()))
+		return
+	}
+
+	server.logger.Info("accounts", fmt.Sprintf("Nickname %s ungrouped from account %s", nick, client.account.Name))
+	rb.NickServNotice(fmt.Sprintf("The nickname %s is no longer grouped with your account", nick))
+}
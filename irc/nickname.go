@@ -6,11 +6,22 @@ package irc
 
 import (
 	"fmt"
+	"math/rand"
+	"strconv"
 	"strings"
 
 	"github.com/goshuirc/irc-go/ircmsg"
 )
 
+const (
+	// NickCollisionReject tells the client their nickname is in use.
+	NickCollisionReject = "reject"
+	// NickCollisionGuest gives the client a nickname like Guest12345.
+	NickCollisionGuest = "guest"
+	// NickCollisionSuffix adds underscores or digits to the nickname the client asked for.
+	NickCollisionSuffix = "suffix"
+)
+
 var (
 	restrictedNicknames = map[string]bool{
 		"=scene=":  true, // used for rp commands
@@ -20,7 +31,7 @@ var (
 )
 
 // NICK <nickname>
-func nickHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func nickHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	if !client.authorized {
 		client.Quit("Bad password")
 		return true
@@ -30,12 +41,12 @@ func nickHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 	nickname, err := CasefoldName(nicknameRaw)
 
 	if len(nicknameRaw) < 1 {
-		client.Send(nil, server.name, ERR_NONICKNAMEGIVEN, client.nick, "No nickname given")
+		rb.Send(nil, server.name, ERR_NONICKNAMEGIVEN, client.nick, "No nickname given")
 		return false
 	}
 
-	if err != nil || len(nicknameRaw) > server.limits.NickLen || restrictedNicknames[nickname] {
-		client.Send(nil, server.name, ERR_ERRONEUSNICKNAME, client.nick, nicknameRaw, "Erroneous nickname")
+	if err != nil || len(nicknameRaw) > server.limits.NickLen || restrictedNicknames[nickname] || server.isNickServ(nickname) {
+		rb.Send(nil, server.name, ERR_ERRONEUSNICKNAME, client.nick, nicknameRaw, "Erroneous nickname")
 		return false
 	}
 
@@ -45,26 +56,30 @@ func nickHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 
 	// bleh, this will be replaced and done below
 	if client.registered {
-		err = client.ChangeNickname(nicknameRaw)
+		err = client.ChangeNickname(nicknameRaw, rb)
 	} else {
 		err = client.SetNickname(nicknameRaw)
+		if err == ErrNicknameInUse {
+			err = client.assignFallbackNick(nicknameRaw, rb)
+		}
 	}
 	if err == ErrNicknameInUse {
-		client.Send(nil, server.name, ERR_NICKNAMEINUSE, client.nick, nicknameRaw, "Nickname is already in use")
+		rb.Send(nil, server.name, ERR_NICKNAMEINUSE, client.nick, nicknameRaw, "Nickname is already in use")
 		return false
 	} else if err != nil {
-		client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "NICK", fmt.Sprintf("Could not set or change nickname: %s", err.Error()))
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "NICK", fmt.Sprintf("Could not set or change nickname: %s", err.Error()))
 		return false
 	}
 	if client.registered {
 		client.alertMonitors()
+		client.checkNickEnforcement(rb)
 	}
 	server.tryRegister(client)
 	return false
 }
 
 // SANICK <oldnick> <nickname>
-func sanickHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func sanickHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	if !client.authorized {
 		client.Quit("Bad password")
 		return true
@@ -74,12 +89,12 @@ func sanickHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 	nickname, err := CasefoldName(msg.Params[1])
 
 	if len(nickname) < 1 {
-		client.Send(nil, server.name, ERR_NONICKNAMEGIVEN, client.nick, "No nickname given")
+		rb.Send(nil, server.name, ERR_NONICKNAMEGIVEN, client.nick, "No nickname given")
 		return false
 	}
 
-	if oerr != nil || err != nil || len(strings.TrimSpace(msg.Params[1])) > server.limits.NickLen || restrictedNicknames[nickname] {
-		client.Send(nil, server.name, ERR_ERRONEUSNICKNAME, client.nick, msg.Params[0], "Erroneous nickname")
+	if oerr != nil || err != nil || len(strings.TrimSpace(msg.Params[1])) > server.limits.NickLen || restrictedNicknames[nickname] || server.isNickServ(nickname) {
+		rb.Send(nil, server.name, ERR_ERRONEUSNICKNAME, client.nick, msg.Params[0], "Erroneous nickname")
 		return false
 	}
 
@@ -89,16 +104,81 @@ func sanickHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 
 	target := server.clients.Get(oldnick)
 	if target == nil {
-		client.Send(nil, server.name, ERR_NOSUCHNICK, msg.Params[0], "No such nick")
+		rb.Send(nil, server.name, ERR_NOSUCHNICK, msg.Params[0], "No such nick")
 		return false
 	}
 
 	//TODO(dan): There's probably some races here, we should be changing this in the primary server thread
 	if server.clients.Get(nickname) != nil && server.clients.Get(nickname) != target {
-		client.Send(nil, server.name, ERR_NICKNAMEINUSE, client.nick, msg.Params[0], "Nickname is already in use")
+		rb.Send(nil, server.name, ERR_NICKNAMEINUSE, client.nick, msg.Params[0], "Nickname is already in use")
 		return false
 	}
 
-	target.ChangeNickname(msg.Params[1])
+	target.ChangeNickname(msg.Params[1], NewResponseBuffer(target))
+	target.checkNickEnforcement(NewResponseBuffer(target))
 	return false
 }
+
+// nickIsAvailable returns true if the given nickname is valid and not in use.
+func (server *Server) nickIsAvailable(nickname string) bool {
+	casefoldedName, err := CasefoldName(nickname)
+	if err != nil || server.limits.NickLen < len(nickname) || restrictedNicknames[casefoldedName] || server.isNickServ(casefoldedName) {
+		return false
+	}
+	return server.clients.Get(casefoldedName) == nil
+}
+
+// guestNick returns an unused guest nickname, like Guest12345.
+func (server *Server) guestNick() string {
+	for i := 0; i < 20; i++ {
+		nickname := server.nickCollision.GuestPrefix + fmt.Sprintf("%05d", rand.Intn(100000))
+		if server.nickIsAvailable(nickname) {
+			return nickname
+		}
+	}
+	return ""
+}
+
+// fallbackNick returns an unused nickname to give a client instead of the one they asked
+// for, according to the nick collision policy. It returns "" if there isn't one.
+func (server *Server) fallbackNick(nickname string) string {
+	switch server.nickCollision.Policy {
+	case NickCollisionGuest:
+		return server.guestNick()
+	case NickCollisionSuffix:
+		suffixes := []string{"_", "__"}
+		for i := 1; i < 10; i++ {
+			suffixes = append(suffixes, strconv.Itoa(i))
+		}
+		for _, suffix := range suffixes {
+			if server.nickIsAvailable(nickname + suffix) {
+				return nickname + suffix
+			}
+		}
+		// we've run out of room or suffixes
+		return server.guestNick()
+	}
+	return ""
+}
+
+// assignFallbackNick gives the client a nickname in place of the one they asked for, which
+// is unavailable. This is used both at registration and when the client's nickname is being
+// enforced. If the policy is to reject the nickname, ErrNicknameInUse is returned.
+func (client *Client) assignFallbackNick(nickname string, rb *ResponseBuffer) error {
+	fallback := client.server.fallbackNick(nickname)
+	if fallback == "" {
+		return ErrNicknameInUse
+	}
+
+	var err error
+	if client.HasNick() {
+		err = client.ChangeNickname(fallback, rb)
+	} else {
+		err = client.SetNickname(fallback)
+	}
+	if err != nil {
+		return err
+	}
+	rb.Notice(fmt.Sprintf("The nickname %s is unavailable, so your nickname has been set to %s", nickname, fallback))
+	return nil
+}
@@ -4,14 +4,89 @@
 package irc
 
 import (
+	"fmt"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/goshuirc/irc-go/ircfmt"
 	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/sno"
+	"github.com/tidwall/buntdb"
 )
 
+const (
+	defaultNickServNick = "NickServ"
+)
+
+var (
+	// nickservCommands are the NickServ subcommands that can be enabled in the config.
+	nickservCommands = []string{"register", "identify", "drop", "set", "info", "ghost", "link", "unlink", "links", "cert", "apikey", "regain", "group", "ungroup", "sendpass", "resetpass", "get", "logout"}
+)
+
+// NickServConfig controls the NickServ pseudoclient.
+type NickServConfig struct {
+	// Nick is the name NickServ uses, and that users message it with.
+	Nick string
+	// EnabledCommands lists the subcommands users can run. If it's empty, they all are.
+	EnabledCommands []string `yaml:"enabled-commands"`
+
+	// MaxGroupedNicks is how many nicknames each account can group with GROUP.
+	MaxGroupedNicks int `yaml:"max-grouped-nicks"`
+
+	nickCasefolded string
+	commands       map[string]bool
+}
+
+// load checks the config and fills in the defaults.
+func (conf *NickServConfig) load() (err error) {
+	if conf.Nick == "" {
+		conf.Nick = defaultNickServNick
+	}
+	conf.nickCasefolded, err = CasefoldName(conf.Nick)
+	if err != nil {
+		return fmt.Errorf("nick %s is not valid", conf.Nick)
+	}
+	if conf.MaxGroupedNicks == 0 {
+		conf.MaxGroupedNicks = defaultMaxGroupedNicks
+	}
+
+	conf.commands = make(map[string]bool)
+	if len(conf.EnabledCommands) == 0 {
+		for _, command := range nickservCommands {
+			conf.commands[command] = true
+		}
+		return nil
+	}
+	for _, command := range conf.EnabledCommands {
+		command = strings.ToLower(command)
+		var known bool
+		for _, name := range nickservCommands {
+			if command == name {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown command %s in enabled-commands", command)
+		}
+		conf.commands[command] = true
+	}
+	return nil
+}
+
+// isNickServ returns true if the given casefolded nickname is NickServ's.
+func (server *Server) isNickServ(nickname string) bool {
+	return nickname == "nickserv" || nickname == server.nickserv.nickCasefolded
+}
+
+// NickServNotice sends the client a notice from NickServ.
+func (client *Client) NickServNotice(text string) {
+	NewResponseBuffer(client).NickServNotice(text)
+}
+
 // nsHandler handles the /NS and /NICKSERV commands
-func nsHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
-	server.nickservReceivePrivmsg(client, strings.Join(msg.Params, " "))
+func nsHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	server.nickservReceivePrivmsg(client, strings.Join(msg.Params, " "), rb)
 	return false
 }
 
@@ -19,6 +94,389 @@ func (server *Server) nickservReceiveNotice(client *Client, message string) {
 	// do nothing
 }
 
-func (server *Server) nickservReceivePrivmsg(client *Client, message string) {
-	client.Notice("NickServ is not yet implemented, sorry! To register an account, check /HELPOP REG")
+func (server *Server) nickservReceivePrivmsg(client *Client, message string, rb *ResponseBuffer) {
+	params := strings.Fields(message)
+	if len(params) < 1 {
+		server.nickservHelp(client, rb)
+		return
+	}
+
+	command := strings.ToLower(params[0])
+	server.logger.Debug("nickserv", fmt.Sprintf("Client %s ran command %s", client.nick, command))
+	if command == "help" {
+		server.nickservHelp(client, rb)
+		return
+	}
+	if !server.nickserv.commands[command] {
+		rb.NickServNotice(fmt.Sprintf("Unknown command %s, see /NS HELP", strings.ToUpper(command)))
+		return
+	}
+
+	switch command {
+	case "register":
+		server.nickservRegister(client, params[1:], rb)
+	case "identify":
+		server.nickservIdentify(client, params[1:], rb)
+	case "logout":
+		server.nickservLogout(client, rb)
+	case "drop":
+		server.nickservDrop(client, params[1:], rb)
+	case "set":
+		if 1 < len(params) && strings.ToLower(params[1]) == "password" {
+			server.nickservSetPassword(client, params[2:], rb)
+		} else if 1 < len(params) && strings.ToLower(params[1]) == "enforce" {
+			server.nickservSetEnforce(client, params[2:], rb)
+		} else if 1 < len(params) && strings.ToLower(params[1]) == "email" {
+			server.nickservSetEmail(client, params[2:], rb)
+		} else if 1 < len(params) {
+			server.nickservSetSetting(client, params[1], params[2:], rb)
+		} else {
+			rb.NickServNotice("Syntax: SET <PASSWORD|ENFORCE|EMAIL|setting> <value>")
+		}
+	case "get":
+		server.nickservGet(client, params[1:], rb)
+	case "info":
+		server.nickservInfo(client, params[1:], rb)
+	case "ghost":
+		server.nickservGhost(client, params[1:], rb)
+	case "regain":
+		server.nickservRegain(client, params[1:], rb)
+	case "group":
+		server.nickservGroup(client, params[1:], rb)
+	case "ungroup":
+		server.nickservUngroup(client, params[1:], rb)
+	case "sendpass":
+		server.nickservSendpass(client, params[1:], rb)
+	case "resetpass":
+		server.nickservResetpass(client, params[1:], rb)
+	case "link", "unlink", "links":
+		server.nickservLinks(client, command, params[1:], rb)
+	case "cert":
+		server.nickservCert(client, params[1:], rb)
+	case "apikey":
+		server.nickservAPIKey(client, params[1:], rb)
+	}
+}
+
+// nickservHelp lists the NickServ subcommands that are enabled.
+func (server *Server) nickservHelp(client *Client, rb *ResponseBuffer) {
+	var commands []string
+	for command := range server.nickserv.commands {
+		commands = append(commands, strings.ToUpper(command))
+	}
+	sort.Strings(commands)
+	rb.NickServNotice(fmt.Sprintf("%s controls accounts and user registrations. Commands: %s", server.nickserv.Nick, strings.Join(commands, ", ")))
+	rb.NickServNotice("See /HELPOP NICKSERV for what they do")
+}
+
+// nickservRegister handles NickServ REGISTER, which registers an account named after the
+// client's current nickname.
+//
+// REGISTER <password>
+func (server *Server) nickservRegister(client *Client, params []string, rb *ResponseBuffer) {
+	if !server.accountRegistration.Enabled {
+		rb.NickServNotice("Account registration is disabled")
+		return
+	}
+	var noCallback bool
+	for _, name := range server.accountRegistration.EnabledCallbacks {
+		if name == "*" {
+			noCallback = true
+		}
+	}
+	if !noCallback {
+		rb.NickServNotice("Accounts on this network need to be verified, register with /ACC REGISTER instead")
+		return
+	}
+	if len(params) < 1 {
+		rb.NickServNotice("Syntax: REGISTER <password>")
+		return
+	}
+	if !client.registered {
+		rb.NickServNotice("You need to connect before you can register your nickname")
+		return
+	}
+	if client.account != &NoAccount {
+		rb.NickServNotice(fmt.Sprintf("You're already logged in as %s", client.account.Name))
+		return
+	}
+	if !server.checkWritable(client, "NICKSERV", rb) {
+		return
+	}
+	if !server.allowRegistration(client) {
+		rb.NickServNotice("Too many accounts have been registered from your address recently, try again later")
+		return
+	}
+
+	accountName := client.nick
+	accountKey := client.nickCasefolded
+	password := strings.Join(params, " ")
+
+	var creds AccountCredentials
+	err := creds.setPassphrase(server.passwords, password)
+	if err != nil {
+		rb.NickServNotice("Could not register your account")
+		server.logger.Error("internal", fmt.Sprintf("Could not hash password for account %s: %s", accountName, err.Error()))
+		return
+	}
+
+	var account *ClientAccount
+	err = server.store.Update(func(tx *buntdb.Tx) error {
+		if accountNameTaken(tx, accountKey) {
+			return errAccountCreation
+		}
+		err := createVerifiedAccount(tx, accountKey, accountName, &creds)
+		if err != nil {
+			return err
+		}
+		account = loadAccount(server, tx, accountKey)
+		client.LoginToAccount(account)
+		return nil
+	})
+	if err == errAccountCreation {
+		rb.NickServNotice(fmt.Sprintf("The account %s is already registered", accountName))
+		return
+	} else if err != nil {
+		rb.NickServNotice("Could not register your account")
+		server.logger.Error("internal", fmt.Sprintf("Could not save account %s: %s", accountName, err.Error()))
+		return
+	}
+
+	server.logger.Info("accounts", fmt.Sprintf("Account %s registered with NickServ by %s", accountName, client.nickMaskString))
+	server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Account registered $c[grey][$r%s$c[grey]] by $c[grey][$r%s$c[grey]]"), accountName, client.nickMaskString))
+	rb.Send(nil, server.name, RPL_LOGGEDIN, client.nick, client.nickMaskString, account.Name, fmt.Sprintf("You are now logged in as %s", account.Name))
+	client.finishLogin(rb)
+	rb.NickServNotice(fmt.Sprintf("Account %s registered, you are now logged in", accountName))
+}
+
+// nickservIdentify handles NickServ IDENTIFY, which logs the client into an account.
+//
+// IDENTIFY [<account>] <password>
+func (server *Server) nickservIdentify(client *Client, params []string, rb *ResponseBuffer) {
+	if len(params) < 1 {
+		rb.NickServNotice("Syntax: IDENTIFY [<account>] <password>")
+		return
+	}
+	if client.account != &NoAccount {
+		rb.NickServNotice(fmt.Sprintf("You're already logged in as %s", client.account.Name))
+		return
+	}
+
+	accountName := client.nick
+	password := params[0]
+	if 1 < len(params) {
+		accountName = params[0]
+		password = strings.Join(params[1:], " ")
+	}
+	if !server.allowSaslAttempt(client) {
+		rb.NickServNotice("Too many login attempts, try again later")
+		return
+	}
+
+	err := server.passwordLogin(client, accountName, password)
+	if err == errAccountSuspended {
+		rb.NickServNotice("That account is suspended")
+		return
+	} else if err != nil {
+		rb.NickServNotice("Invalid account name or password")
+		return
+	}
+	rb.Send(nil, server.name, RPL_LOGGEDIN, client.nick, client.nickMaskString, client.account.Name, fmt.Sprintf("You are now logged in as %s", client.account.Name))
+	client.finishLogin(rb)
+	rb.NickServNotice(fmt.Sprintf("You are now logged in as %s", client.account.Name))
+}
+
+// nickservLogout handles NickServ LOGOUT, which logs the client out of their account.
+//
+// LOGOUT
+func (server *Server) nickservLogout(client *Client, rb *ResponseBuffer) {
+	if client.account == &NoAccount {
+		rb.NickServNotice("You're not logged into an account")
+		return
+	}
+	accountName := client.account.Name
+	client.logoutOfAccount(rb)
+	rb.NickServNotice(fmt.Sprintf("You are now logged out of %s", accountName))
+}
+
+// nickservDrop handles NickServ DROP, which deletes the account the client is logged into.
+// Accounts with a password need it to be given again, and ones without need the client to
+// be using one of the account's certificates.
+//
+// DROP [<password>]
+func (server *Server) nickservDrop(client *Client, params []string, rb *ResponseBuffer) {
+	if client.account == &NoAccount {
+		rb.NickServNotice("You must be logged into an account to drop it")
+		return
+	}
+	if !server.checkWritable(client, "NICKSERV", rb) {
+		return
+	}
+	account := client.account
+	accountKey, _ := CasefoldName(account.Name)
+	password := strings.Join(params, " ")
+
+	var successions []channelSuccession
+	server.registeredChannelsMutex.Lock()
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		creds, err := loadAccountCredentials(tx, accountKey)
+		if err != nil {
+			return err
+		}
+		if 0 < len(creds.PassphraseHash) {
+			if password == "" || server.passwords.CompareHashAndPassword(creds.PassphraseHash, creds.PassphraseSalt, password) != nil {
+				return errSaslFail
+			}
+		} else if client.certfp == "" || !creds.hasCertificate(client.certfp) {
+			return errSaslFail
+		}
+		successions = server.handOverChannelsNoMutex(tx, accountKey)
+		return dropAccount(tx, accountKey)
+	})
+	server.registeredChannelsMutex.Unlock()
+	if err == errSaslFail {
+		rb.NickServNotice("Syntax: DROP <password>, or connect with one of the account's certificates if it has no password")
+		return
+	} else if err != nil {
+		rb.NickServNotice("Could not drop your account")
+		server.logger.Error("internal", fmt.Sprintf("Could not drop account %s: %s", account.Name, err.Error()))
+		return
+	}
+
+	server.forgetAccount(accountKey)
+	for _, accountClient := range account.getClients() {
+		accountClient.logoutOfAccount(NewResponseBuffer(accountClient))
+		accountClient.NickServNotice(fmt.Sprintf("The account %s has been dropped", account.Name))
+	}
+	server.logger.Info("accounts", fmt.Sprintf("Account %s dropped by %s", account.Name, client.nickMaskString))
+	server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Account dropped $c[grey][$r%s$c[grey]] by $c[grey][$r%s$c[grey]]"), account.Name, client.nickMaskString))
+	server.announceChannelSuccessions(successions)
+}
+
+// dropAccount deletes everything stored for the given account.
+func dropAccount(tx *buntdb.Tx, accountKey string) error {
+	reversePrefixes := accountReverseKeyPrefixes()
+	var keys []string
+	err := tx.AscendKeys("account.*", func(key, value string) bool {
+		if strings.HasSuffix(key, " "+accountKey) {
+			keys = append(keys, key)
+			return true
+		}
+		for _, prefix := range reversePrefixes {
+			if strings.HasPrefix(key, prefix) && value == accountKey {
+				keys = append(keys, key)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		tx.Delete(key)
+	}
+	return nil
+}
+
+// nickservInfo handles NickServ INFO, which shows information about an account. Some of it is
+// only shown to the account's own clients and opers.
+//
+// INFO [<account>]
+func (server *Server) nickservInfo(client *Client, params []string, rb *ResponseBuffer) {
+	accountName := client.account.Name
+	if 0 < len(params) {
+		accountName = params[0]
+	} else if client.account == &NoAccount {
+		rb.NickServNotice("Syntax: INFO <account>")
+		return
+	}
+	// grouped nicknames show their account
+	if nickname, err := CasefoldName(accountName); err == nil {
+		server.store.View(func(tx *buntdb.Tx) error {
+			accountName = nickAccount(tx, nickname)
+			return nil
+		})
+	}
+	account := server.loadAccountByName(accountName)
+	if account == nil {
+		rb.NickServNotice(fmt.Sprintf("The account %s isn't registered", accountName))
+		return
+	}
+
+	rb.NickServNotice(fmt.Sprintf("Information for account %s:", account.Name))
+	if client.account != account && !client.hasFlag(Operator) && account.SettingOn(AccountSettingPrivateInfo) {
+		rb.NickServNotice("This account's details are private")
+		return
+	}
+	rb.NickServNotice(fmt.Sprintf("Registered: %s", account.RegisteredAt.UTC().Format(time.RFC1123)))
+	if account.Bot {
+		rb.NickServNotice("This account is a bot")
+	}
+	if account.Suspension != nil {
+		rb.NickServNotice("This account is suspended")
+		if client.hasFlag(Operator) {
+			suspension := account.Suspension
+			reason := suspension.Reason
+			if reason == "" {
+				reason = "no reason given"
+			}
+			rb.NickServNotice(fmt.Sprintf("Suspended by %s at %s: %s", suspension.SuspendedBy, suspension.SuspendedAt.UTC().Format(time.RFC1123), reason))
+		}
+	}
+	if client.account != account && !client.hasFlag(Operator) {
+		return
+	}
+	if account.Vhost != "" {
+		rb.NickServNotice(fmt.Sprintf("Vhost: %s", account.Vhost))
+	}
+	var grouped []string
+	server.store.View(func(tx *buntdb.Tx) error {
+		accountKey, _ := CasefoldName(account.Name)
+		grouped = groupedNicks(tx, accountKey)
+		return nil
+	})
+	if 0 < len(grouped) {
+		rb.NickServNotice(fmt.Sprintf("Grouped nicknames: %s", strings.Join(grouped, ", ")))
+	}
+	var nicks []string
+	for _, accountClient := range account.getClients() {
+		nicks = append(nicks, accountClient.nick)
+	}
+	if 0 < len(nicks) {
+		rb.NickServNotice(fmt.Sprintf("Logged in from: %s", strings.Join(nicks, ", ")))
+	}
+}
+
+// nickservGhost handles NickServ GHOST, which disconnects a client that's using your account
+// or your account's nickname.
+//
+// GHOST <nickname>
+func (server *Server) nickservGhost(client *Client, params []string, rb *ResponseBuffer) {
+	if client.account == &NoAccount {
+		rb.NickServNotice("You must be logged into an account to use GHOST")
+		return
+	}
+	if len(params) < 1 {
+		rb.NickServNotice("Syntax: GHOST <nickname>")
+		return
+	}
+	nickname, err := CasefoldName(params[0])
+	target := server.clients.Get(nickname)
+	if err != nil || target == nil {
+		rb.NickServNotice(fmt.Sprintf("No one is using the nickname %s", params[0]))
+		return
+	}
+	if target == client {
+		rb.NickServNotice("You can't GHOST yourself")
+		return
+	}
+	if target.account != client.account && !client.ownsNick(nickname) {
+		rb.NickServNotice(fmt.Sprintf("%s isn't using your account or its nickname", target.nick))
+		return
+	}
+
+	server.logger.Info("accounts", fmt.Sprintf("%s used GHOST on %s", client.nickMaskString, target.nickMaskString))
+	target.Quit(fmt.Sprintf("GHOST command used by %s", client.nick))
+	target.destroy()
+	rb.NickServNotice(fmt.Sprintf("%s has been disconnected", params[0]))
 }
@@ -19,6 +19,8 @@ const (
 	RPL_ISUPPORT                    = "005"
 	RPL_SNOMASKIS                   = "008"
 	RPL_BOUNCE                      = "010"
+	RPL_MAP                         = "015"
+	RPL_MAPEND                      = "017"
 	RPL_TRACELINK                   = "200"
 	RPL_TRACECONNECTING             = "201"
 	RPL_TRACEHANDSHAKE              = "202"
@@ -50,7 +52,12 @@ const (
 	RPL_TRACELOG                    = "261"
 	RPL_TRACEEND                    = "262"
 	RPL_TRYAGAIN                    = "263"
+	RPL_LOCALUSERS                  = "265"
+	RPL_SILELIST                    = "271"
+	RPL_ENDOFSILELIST               = "272"
 	RPL_WHOISCERTFP                 = "276"
+	RPL_ACCEPTLIST                  = "281"
+	RPL_ENDOFACCEPT                 = "282"
 	RPL_AWAY                        = "301"
 	RPL_USERHOST                    = "302"
 	RPL_ISON                        = "303"
@@ -64,6 +71,7 @@ const (
 	RPL_WHOISIDLE                   = "317"
 	RPL_ENDOFWHOIS                  = "318"
 	RPL_WHOISCHANNELS               = "319"
+	RPL_WHOISSPECIAL                = "320"
 	RPL_LIST                        = "322"
 	RPL_LISTEND                     = "323"
 	RPL_CHANNELMODEIS               = "324"
@@ -72,6 +80,7 @@ const (
 	RPL_NOTOPIC                     = "331"
 	RPL_TOPIC                       = "332"
 	RPL_TOPICTIME                   = "333"
+	RPL_WHOISBOT                    = "335"
 	RPL_WHOISACTUALLY               = "338"
 	RPL_INVITING                    = "341"
 	RPL_SUMMONING                   = "342"
@@ -101,6 +110,7 @@ const (
 	RPL_USERS                       = "393"
 	RPL_ENDOFUSERS                  = "394"
 	RPL_NOUSERS                     = "395"
+	RPL_HOSTHIDDEN                  = "396"
 	ERR_UNKNOWNERROR                = "400"
 	ERR_NOSUCHNICK                  = "401"
 	ERR_NOSUCHSERVER                = "402"
@@ -117,6 +127,7 @@ const (
 	ERR_NOTOPLEVEL                  = "413"
 	ERR_WILDTOPLEVEL                = "414"
 	ERR_BADMASK                     = "415"
+	ERR_TOOMANYMATCHES              = "416"
 	ERR_UNKNOWNCOMMAND              = "421"
 	ERR_NOMOTD                      = "422"
 	ERR_NOADMININFO                 = "423"
@@ -134,6 +145,9 @@ const (
 	ERR_SUMMONDISABLED              = "445"
 	ERR_USERSDISABLED               = "446"
 	ERR_NOTREGISTERED               = "451"
+	ERR_ACCEPTFULL                  = "456"
+	ERR_ACCEPTEXIST                 = "457"
+	ERR_ACCEPTNOT                   = "458"
 	ERR_NEEDMOREPARAMS              = "461"
 	ERR_ALREADYREGISTRED            = "462"
 	ERR_NOPERMFORHOST               = "463"
@@ -157,18 +171,28 @@ const (
 	ERR_NOOPERHOST                  = "491"
 	ERR_UMODEUNKNOWNFLAG            = "501"
 	ERR_USERSDONTMATCH              = "502"
+	ERR_SILELISTFULL                = "511"
 	ERR_HELPNOTFOUND                = "524"
 	ERR_CANNOTSENDRP                = "573"
+	RPL_STARTTLS                    = "670"
 	RPL_WHOISSECURE                 = "671"
+	ERR_STARTTLS                    = "691"
 	RPL_HELPSTART                   = "704"
 	RPL_HELPTXT                     = "705"
 	RPL_ENDOFHELP                   = "706"
+	RPL_TARGUMODEG                  = "716"
+	RPL_TARGNOTIFY                  = "717"
+	RPL_UMODEGMSG                   = "718"
 	ERR_NOPRIVS                     = "723"
 	RPL_MONONLINE                   = "730"
 	RPL_MONOFFLINE                  = "731"
 	RPL_MONLIST                     = "732"
 	RPL_ENDOFMONLIST                = "733"
 	ERR_MONLISTFULL                 = "734"
+	RPL_RSACHALLENGE2               = "740"
+	RPL_ACCOUNTSTATUS               = "750"
+	RPL_ENDOFACCOUNTSTATUS          = "751"
+	RPL_ENDOFRSACHALLENGE2          = "741"
 	RPL_LOGGEDIN                    = "900"
 	RPL_LOGGEDOUT                   = "901"
 	ERR_NICKLOCKED                  = "902"
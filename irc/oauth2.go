@@ -0,0 +1,242 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/oragono/oragono/irc/sno"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	// keyAccountOAuth2Subject maps an OAuth2 provider's subject ID to the account it logs into.
+	keyAccountOAuth2Subject = "account.oauth2.subject %s"
+
+	defaultOAuth2Timeout       = 5 * time.Second
+	defaultOAuth2UsernameClaim = "preferred_username"
+)
+
+var (
+	errOAuth2Inactive = errors.New("Token is not active")
+)
+
+// OAuth2Config lets clients log in with an access token from an OAuth2 or OpenID Connect
+// provider, using SASL OAUTHBEARER. Tokens are checked with the provider's introspection
+// endpoint (RFC 7662).
+type OAuth2Config struct {
+	Enabled          bool
+	IntrospectionURL string        `yaml:"introspection-url"`
+	ClientID         string        `yaml:"client-id"`
+	ClientSecret     string        `yaml:"client-secret"`
+	TimeoutString    string        `yaml:"timeout"`
+	Timeout          time.Duration `yaml:"timeout-real"`
+	// UsernameClaim is the claim that new accounts are named after.
+	UsernameClaim string `yaml:"username-claim"`
+	// Autocreate makes an account the first time someone logs in with a new subject.
+	Autocreate bool
+}
+
+// load checks the config and fills in the defaults.
+func (conf *OAuth2Config) load() (err error) {
+	if !conf.Enabled {
+		return nil
+	}
+	if conf.IntrospectionURL == "" {
+		return errors.New("introspection-url must be set")
+	}
+	conf.Timeout = defaultOAuth2Timeout
+	if conf.TimeoutString != "" {
+		conf.Timeout, err = time.ParseDuration(conf.TimeoutString)
+		if err != nil {
+			return fmt.Errorf("Could not parse timeout: %s", err.Error())
+		}
+	}
+	if conf.UsernameClaim == "" {
+		conf.UsernameClaim = defaultOAuth2UsernameClaim
+	}
+	return nil
+}
+
+// oauth2Identity is who the provider says a token belongs to.
+type oauth2Identity struct {
+	Subject  string
+	Username string
+}
+
+// introspect asks the provider who the given token belongs to.
+func (conf *OAuth2Config) introspect(token string) (*oauth2Identity, error) {
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+	req, err := http.NewRequest("POST", conf.IntrospectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if conf.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(conf.ClientID), url.QueryEscape(conf.ClientSecret))
+	}
+
+	httpClient := http.Client{Timeout: conf.Timeout}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Introspection endpoint returned %s", resp.Status)
+	}
+
+	var claims map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&claims)
+	if err != nil {
+		return nil, err
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, errOAuth2Inactive
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, errors.New("Introspection response has no subject")
+	}
+	username, _ := claims[conf.UsernameClaim].(string)
+	return &oauth2Identity{
+		Subject:  subject,
+		Username: username,
+	}, nil
+}
+
+// parseOAuthBearer returns the authzid and bearer token from an OAUTHBEARER message
+// (RFC 7628), which looks like: n,a=authzid,^Aauth=Bearer token^A^A
+func parseOAuthBearer(value []byte) (authzid, token string, err error) {
+	parts := bytes.Split(value, []byte{'\x01'})
+	gs2 := strings.Split(string(parts[0]), ",")
+	if len(gs2) < 2 || (gs2[0] != "n" && gs2[0] != "y") {
+		return "", "", errSaslFail
+	}
+	if strings.HasPrefix(gs2[1], "a=") {
+		authzid = scramUnescapeName(gs2[1][2:])
+	}
+	for _, part := range parts[1:] {
+		kv := string(part)
+		if strings.HasPrefix(kv, "auth=") {
+			auth := strings.SplitN(kv[len("auth="):], " ", 2)
+			if len(auth) == 2 && strings.ToLower(auth[0]) == "bearer" {
+				token = strings.TrimSpace(auth[1])
+			}
+		}
+	}
+	if token == "" {
+		return "", "", errSaslFail
+	}
+	return authzid, token, nil
+}
+
+// saslMechanisms returns the SASL mechanisms we advertise with the given config.
+func saslMechanisms(config *Config) string {
+	mechanisms := "PLAIN,EXTERNAL,SCRAM-SHA-256"
+	if config.Accounts.OAuth2.Enabled {
+		mechanisms += ",OAUTHBEARER"
+	}
+	return mechanisms
+}
+
+// oauth2LoginToAccount logs the client into the account mapped to the given identity,
+// creating it if that's allowed.
+func (server *Server) oauth2LoginToAccount(tx *buntdb.Tx, client *Client, identity *oauth2Identity, authzid string) error {
+	subjectKey := fmt.Sprintf(keyAccountOAuth2Subject, identity.Subject)
+	accountKey, err := tx.Get(subjectKey)
+	if err == buntdb.ErrNotFound {
+		if !server.oauth2.Autocreate || server.isReadOnly() {
+			return errSaslFail
+		}
+		accountName := identity.Username
+		if accountName == "" {
+			accountName = authzid
+		}
+		accountKey, err = CasefoldName(accountName)
+		if err != nil || accountName == "*" {
+			return errSaslFail
+		}
+		// don't let the provider take over accounts it didn't make
+		if accountNameTaken(tx, accountKey) {
+			return errSaslFail
+		}
+		err = createPasswordlessAccount(tx, accountKey, accountName)
+		if err != nil {
+			return err
+		}
+		tx.Set(subjectKey, accountKey, nil)
+
+		server.logger.Info("accounts", fmt.Sprintf("Created account %s from OAuth2 subject %s", accountName, identity.Subject))
+		server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Account $c[grey][$r%s$c[grey]] created from OAuth2"), accountName))
+	} else if err != nil {
+		return err
+	}
+
+	if authzid != "" {
+		authzKey, err := CasefoldName(authzid)
+		if err != nil || authzKey != accountKey {
+			return errSaslFail
+		}
+	}
+	_, err = tx.Get(fmt.Sprintf(keyAccountVerified, accountKey))
+	if err != nil {
+		return errSaslFail
+	}
+	if loadAccountSuspension(tx, accountKey) != nil {
+		return errAccountSuspended
+	}
+	account, exists := server.getAccount(accountKey)
+	if !exists {
+		account = loadAccount(server, tx, accountKey)
+	}
+	client.LoginToAccount(account)
+	return nil
+}
+
+// authOAuthBearerHandler parses the SASL OAUTHBEARER mechanism.
+func authOAuthBearerHandler(server *Server, client *Client, mechanism string, value []byte, rb *ResponseBuffer) bool {
+	config := server.oauth2
+	if !config.Enabled {
+		rb.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed: OAuth2 is not enabled")
+		return false
+	}
+	authzid, token, err := parseOAuthBearer(value)
+	if err != nil {
+		rb.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed: Invalid auth blob")
+		return false
+	}
+
+	// ask the provider outside the update, so it doesn't block the store
+	identity, err := config.introspect(token)
+	if err != nil {
+		if err != errOAuth2Inactive {
+			server.logger.Error("accounts", fmt.Sprintf("Could not check OAuth2 token: %s", err.Error()))
+		}
+		rb.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed")
+		return false
+	}
+
+	err = server.store.Update(func(tx *buntdb.Tx) error {
+		return server.oauth2LoginToAccount(tx, client, identity, authzid)
+	})
+	if err != nil {
+		rb.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed")
+		return false
+	}
+
+	client.successfulSaslAuth(rb)
+	return false
+}
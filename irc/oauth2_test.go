@@ -0,0 +1,143 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oragono/oragono/irc/logger"
+	"github.com/tidwall/buntdb"
+)
+
+func TestParseOAuthBearer(t *testing.T) {
+	cases := []struct {
+		value   string
+		authzid string
+		token   string
+		valid   bool
+	}{
+		{"n,,\x01auth=Bearer abc123\x01\x01", "", "abc123", true},
+		{"n,a=alice,\x01host=irc.example.com\x01auth=bearer abc123\x01\x01", "alice", "abc123", true},
+		{"y,a=al=2Cice,\x01auth=Bearer abc123\x01\x01", "al,ice", "abc123", true},
+		{"p=tls-unique,,\x01auth=Bearer abc123\x01\x01", "", "", false},
+		{"n,,\x01auth=Basic abc123\x01\x01", "", "", false},
+		{"n,,\x01auth=Bearer \x01\x01", "", "", false},
+		{"n,,", "", "", false},
+		{"", "", "", false},
+	}
+	for _, c := range cases {
+		authzid, token, err := parseOAuthBearer([]byte(c.value))
+		if (err == nil) != c.valid || authzid != c.authzid || token != c.token {
+			t.Errorf("%q: expected %q %q valid %v, got %q %q %v", c.value, c.authzid, c.token, c.valid, authzid, token, err)
+		}
+	}
+}
+
+func TestOAuth2Introspect(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "oragono" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		claims := map[string]map[string]interface{}{
+			"good":     {"active": true, "sub": "1234", "preferred_username": "alice"},
+			"nameless": {"active": true, "sub": "5678"},
+			"inactive": {"active": false, "sub": "1234"},
+			"nosub":    {"active": true},
+		}[r.FormValue("token")]
+		if claims == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(claims)
+	}))
+	defer endpoint.Close()
+
+	conf := OAuth2Config{
+		Enabled:          true,
+		IntrospectionURL: endpoint.URL,
+		ClientID:         "oragono",
+		ClientSecret:     "secret",
+	}
+	if err := conf.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		token    string
+		identity oauth2Identity
+		err      string
+	}{
+		{"good", oauth2Identity{Subject: "1234", Username: "alice"}, ""},
+		{"nameless", oauth2Identity{Subject: "5678"}, ""},
+		{"inactive", oauth2Identity{}, errOAuth2Inactive.Error()},
+		{"nosub", oauth2Identity{}, "no subject"},
+		{"unknown", oauth2Identity{}, "500"},
+	}
+	for _, c := range cases {
+		identity, err := conf.introspect(c.token)
+		if c.err == "" && (err != nil || *identity != c.identity) {
+			t.Errorf("%s: expected %+v, got %+v %v", c.token, c.identity, identity, err)
+		} else if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%s: expected an error containing %q, got %v", c.token, c.err, err)
+		}
+	}
+
+	conf.ClientSecret = "wrong"
+	if _, err := conf.introspect("good"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected the wrong client secret to be refused, got %v", err)
+	}
+}
+
+func TestOAuth2LoginToAccount(t *testing.T) {
+	server := newAccountsTestServer(t, "Bob")
+	server.logger, _ = logger.NewManager()
+	server.snomasks = NewSnoManager()
+	server.oauth2 = OAuth2Config{Enabled: true, Autocreate: true, Timeout: time.Second}
+
+	login := func(identity oauth2Identity, authzid string) (*Client, error) {
+		client := &Client{server: server, account: &NoAccount, ignores: NewIgnoreLists()}
+		err := server.store.Update(func(tx *buntdb.Tx) error {
+			return server.oauth2LoginToAccount(tx, client, &identity, authzid)
+		})
+		return client, err
+	}
+
+	// the first login makes the account, and later ones log into it
+	for i := 0; i < 2; i++ {
+		client, err := login(oauth2Identity{Subject: "1234", Username: "Alice"}, "")
+		if err != nil || client.account.Name != "Alice" {
+			t.Fatalf("login %d: expected to log into Alice, got %s %v", i, client.account.Name, err)
+		}
+	}
+	// even if the provider renames them
+	if client, err := login(oauth2Identity{Subject: "1234", Username: "Alicia"}, "alice"); err != nil || client.account.Name != "Alice" {
+		t.Errorf("expected the subject to stay mapped to Alice, got %s %v", client.account.Name, err)
+	}
+
+	for _, c := range []struct {
+		name     string
+		identity oauth2Identity
+		authzid  string
+	}{
+		{"someone else's account", oauth2Identity{Subject: "5678", Username: "Bob"}, ""},
+		{"mismatched authzid", oauth2Identity{Subject: "1234"}, "bob"},
+		{"no name", oauth2Identity{Subject: "9999"}, ""},
+		{"invalid name", oauth2Identity{Subject: "9999", Username: "*"}, ""},
+	} {
+		if _, err := login(c.identity, c.authzid); err != errSaslFail {
+			t.Errorf("%s: expected errSaslFail, got %v", c.name, err)
+		}
+	}
+
+	server.oauth2.Autocreate = false
+	if _, err := login(oauth2Identity{Subject: "9999", Username: "Carol"}, ""); err != errSaslFail {
+		t.Errorf("expected new subjects to be refused without autocreate, got %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+// Package objectstore is a small client for S3-compatible object storage, supporting just
+// what we need to store datastore snapshots.
+package objectstore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	amzDateFormat  = "20060102T150405Z"
+	amzShortFormat = "20060102"
+)
+
+var (
+	// ErrNotFound is returned when the object doesn't exist.
+	ErrNotFound = errors.New("Object does not exist")
+)
+
+// Config is the config for an S3-compatible bucket.
+type Config struct {
+	// Endpoint is the URL of the storage service, like https://s3.amazonaws.com.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string `yaml:"access-key"`
+	SecretKey string `yaml:"secret-key"`
+}
+
+// Object describes an object in the bucket.
+type Object struct {
+	Key          string
+	LastModified time.Time
+	Size         int64
+}
+
+// Client talks to an S3-compatible bucket, using path-style requests.
+type Client struct {
+	config   Config
+	endpoint *url.URL
+	http     *http.Client
+
+	// now returns the current time, and is replaced in tests.
+	now func() time.Time
+}
+
+// NewClient returns a client for the given bucket.
+func NewClient(config Config) (*Client, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, errors.New("Object storage needs an endpoint and a bucket")
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("Invalid object storage endpoint: %s", config.Endpoint)
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	return &Client{
+		config:   config,
+		endpoint: endpoint,
+		http:     &http.Client{Timeout: 10 * time.Minute},
+		now:      time.Now,
+	}, nil
+}
+
+// Put uploads an object.
+func (c *Client) Put(key string, data []byte) error {
+	resp, err := c.do("PUT", key, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get downloads an object.
+func (c *Client) Get(key string) ([]byte, error) {
+	resp, err := c.do("GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Delete removes an object.
+func (c *Client) Delete(key string) error {
+	resp, err := c.do("DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type listBucketResult struct {
+	Contents              []Object
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List returns the objects whose keys start with the given prefix, sorted by key.
+func (c *Client) List(prefix string) ([]Object, error) {
+	var objects []Object
+	var token string
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := c.do("GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse bucket listing: %s", err.Error())
+		}
+
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+// do sends a signed request for the given key, returning an error for non-2xx responses.
+func (c *Client) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	path := "/" + c.config.Bucket
+	if key != "" {
+		path += "/" + key
+	}
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(c.endpoint.Path, "/") + path
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, body)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && key != "" {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode < 200 || 299 < resp.StatusCode {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("Object storage returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+// sign adds an AWS signature version 4 to the request.
+func (c *Client) sign(req *http.Request, body []byte) {
+	now := c.now().UTC()
+	amzDate := now.Format(amzDateFormat)
+	payloadHash := hashHex(body)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{now.Format(amzShortFormat), c.config.Region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hashHex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := []byte("AWS4" + c.config.SecretKey)
+	for _, part := range []string{now.Format(amzShortFormat), c.config.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.config.AccessKey, scope, signedHeaders, signature))
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery returns the query string in the sorted, strictly-encoded form that
+// signatures are made over.
+func canonicalQuery(query url.Values) string {
+	var keys []string
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var params []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			params = append(params, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// uriEncode percent-encodes everything apart from unreserved characters (and slashes,
+// unless encodeSlash is true).
+func uriEncode(s string, encodeSlash bool) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ('A' <= ch && ch <= 'Z') || ('a' <= ch && ch <= 'z') || ('0' <= ch && ch <= '9') || ch == '-' || ch == '_' || ch == '.' || ch == '~' || (ch == '/' && !encodeSlash) {
+			buf.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", ch)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package objectstore
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fakeBucket is an in-memory S3 bucket that lists one object per page.
+type fakeBucket struct {
+	objects map[string][]byte
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") || r.Header.Get("x-amz-content-sha256") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/snaps") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/snaps"), "/")
+
+	switch {
+	case r.Method == "GET" && key == "":
+		var keys []string
+		for k := range b.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) && r.URL.Query().Get("continuation-token") < k {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		var result listBucketResult
+		if len(keys) != 0 {
+			result.Contents = []Object{{Key: keys[0], Size: int64(len(b.objects[keys[0]]))}}
+			result.IsTruncated = 1 < len(keys)
+			result.NextContinuationToken = keys[0]
+		}
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == "GET":
+		data, exists := b.objects[key]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case r.Method == "PUT":
+		b.objects[key], _ = ioutil.ReadAll(r.Body)
+	case r.Method == "DELETE":
+		delete(b.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestClient(t *testing.T) {
+	bucket := &fakeBucket{objects: make(map[string][]byte)}
+	ts := httptest.NewServer(bucket)
+	defer ts.Close()
+
+	c, err := NewClient(Config{
+		Endpoint:  ts.URL,
+		Bucket:    "snaps",
+		AccessKey: "key",
+		SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"db/b", "db/a", "other/c"} {
+		if err := c.Put(key, []byte("data "+key)); err != nil {
+			t.Fatalf("could not put %s: %s", key, err)
+		}
+	}
+
+	data, err := c.Get("db/a")
+	if err != nil || string(data) != "data db/a" {
+		t.Errorf("expected to get the object back, got %q, %v", data, err)
+	}
+	if _, err := c.Get("db/missing"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for a missing object, got %v", err)
+	}
+
+	objects, err := c.List("db/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || objects[0].Key != "db/a" || objects[1].Key != "db/b" {
+		t.Errorf("expected to list db/a and db/b across pages, got %v", objects)
+	}
+
+	if err := c.Delete("db/a"); err != nil {
+		t.Fatal(err)
+	}
+	objects, _ = c.List("db/")
+	if len(objects) != 1 || objects[0].Key != "db/b" {
+		t.Errorf("expected only db/b after deleting db/a, got %v", objects)
+	}
+}
+
+func TestURIEncode(t *testing.T) {
+	if enc := uriEncode("/snaps/a b+c~", false); enc != "/snaps/a%20b%2Bc~" {
+		t.Errorf("path encoded as %s", enc)
+	}
+	if enc := uriEncode("a/b", true); enc != "a%2Fb" {
+		t.Errorf("query value encoded as %s", enc)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// passLogin returns true if clients on the listener can log into their account with PASS.
+func (conf *ListenerConfig) passLogin() bool {
+	return conf != nil && conf.PassLogin
+}
+
+// tryPassLogin logs the client into the account they gave with PASS, for clients that don't
+// support SASL. PASS takes either <account>:<password>, or just the password of the account
+// matching the client's nickname. It's done just before the client finishes registering.
+func (server *Server) tryPassLogin(client *Client) {
+	credentials := client.passLogin
+	client.passLogin = ""
+	if credentials == "" || client.account != &NoAccount {
+		return
+	}
+
+	accountName := client.nick
+	password := credentials
+	if strings.Contains(credentials, ":") {
+		splitCredentials := strings.SplitN(credentials, ":", 2)
+		accountName, password = splitCredentials[0], splitCredentials[1]
+	}
+	if !server.allowSaslAttempt(client) {
+		client.Notice("Could not log in with PASS: too many login attempts, try again later")
+		return
+	}
+
+	err := server.passwordLogin(client, accountName, password)
+	if err == errAccountSuspended {
+		client.Notice("Could not log in with PASS: that account is suspended")
+		return
+	} else if err != nil {
+		client.Notice("Could not log in with PASS: invalid account name or password")
+		return
+	}
+	client.Send(nil, server.name, RPL_LOGGEDIN, client.nick, client.nickMaskString, client.account.Name, fmt.Sprintf("You are now logged in as %s", client.account.Name))
+	client.finishLogin(NewResponseBuffer(client))
+}
@@ -0,0 +1,273 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/oragono/oragono/irc/ratelimit"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	// keyAccountEmail is the email address that password reset codes are sent to.
+	keyAccountEmail = "account.email %s"
+	// keyAccountResetCode holds the hash of the account's current password reset code, and
+	// expires along with it.
+	keyAccountResetCode = "account.resetcode %s"
+
+	defaultResetCodeLifetime = time.Hour
+	resetCodeLen             = 16
+)
+
+// PasswordResetConfig lets users who've forgotten their password get a reset code sent to
+// their account's email address.
+type PasswordResetConfig struct {
+	Enabled            bool
+	CodeLifetimeString string          `yaml:"code-lifetime"`
+	CodeLifetime       time.Duration   `yaml:"code-lifetime-real"`
+	RateLimit          RateLimitConfig `yaml:"rate-limit"`
+	limiter            *ratelimit.Keyed
+}
+
+// load checks the config and sets up the rate limit.
+func (conf *PasswordResetConfig) load() (err error) {
+	if !conf.Enabled {
+		return nil
+	}
+	conf.CodeLifetime = defaultResetCodeLifetime
+	if conf.CodeLifetimeString != "" {
+		conf.CodeLifetime, err = time.ParseDuration(conf.CodeLifetimeString)
+		if err != nil {
+			return fmt.Errorf("Could not parse code-lifetime: %s", err.Error())
+		}
+	}
+	err = conf.RateLimit.load(defaultPasswordResetLimit)
+	if err != nil {
+		return fmt.Errorf("Could not parse rate-limit window: %s", err.Error())
+	}
+	conf.limiter = newKeyedLimiter(conf.RateLimit)
+	return nil
+}
+
+// resetCodeHash returns the hash of a reset code that we keep in the store.
+func resetCodeHash(code string) string {
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+// allowPasswordReset records a reset request for the given account from the client,
+// returning false if there have been too many recently.
+func (server *Server) allowPasswordReset(client *Client, accountKey string) bool {
+	limiter := server.passwordReset.limiter
+	if limiter == nil {
+		return true
+	}
+	// check both, so neither one address nor one account can be used to flood mailboxes
+	ipAllowed := limiter.Allow("ip " + client.IPString())
+	accountAllowed := limiter.Allow("account " + accountKey)
+	return ipAllowed && accountAllowed
+}
+
+// setAccountPassword replaces the account's password, and clears any pending reset.
+func setAccountPassword(tx *buntdb.Tx, passwords *PasswordManager, accountKey, password string) error {
+	creds, err := loadAccountCredentials(tx, accountKey)
+	if err != nil {
+		creds = &AccountCredentials{}
+	}
+	err = creds.setPassphrase(passwords, password)
+	if err != nil {
+		return err
+	}
+	credText, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	tx.Set(fmt.Sprintf(keyAccountCredentials, accountKey), string(credText), nil)
+	tx.Delete(fmt.Sprintf(keyAccountPasswordReset, accountKey))
+	tx.Delete(fmt.Sprintf(keyAccountResetCode, accountKey))
+	return nil
+}
+
+// nickservSetEmail handles NickServ SET EMAIL, which sets the address that password reset
+// codes are sent to.
+//
+// SET EMAIL <address|OFF>
+func (server *Server) nickservSetEmail(client *Client, params []string, rb *ResponseBuffer) {
+	if client.account == &NoAccount {
+		rb.NickServNotice("You must be logged into an account to change its settings")
+		return
+	}
+	if len(params) < 1 {
+		rb.NickServNotice("Syntax: SET EMAIL <address|OFF>")
+		return
+	}
+	var email string
+	if strings.ToLower(params[0]) != "off" {
+		var err error
+		email, err = normalizeEmail(strings.Join(params, " "))
+		if err != nil {
+			rb.NickServNotice(err.Error())
+			return
+		}
+	}
+	if !server.checkWritable(client, "NICKSERV", rb) {
+		return
+	}
+
+	accountKey, _ := CasefoldName(client.account.Name)
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		var err error
+		if email == "" {
+			_, err = tx.Delete(fmt.Sprintf(keyAccountEmail, accountKey))
+			if err == buntdb.ErrNotFound {
+				err = nil
+			}
+		} else {
+			_, _, err = tx.Set(fmt.Sprintf(keyAccountEmail, accountKey), email, nil)
+		}
+		return err
+	})
+	if err != nil {
+		rb.NickServNotice("Could not change your email address")
+		server.logger.Error("internal", fmt.Sprintf("Could not save email for account %s: %s", client.account.Name, err.Error()))
+		return
+	}
+
+	if email == "" {
+		rb.NickServNotice("Your email address has been removed")
+	} else {
+		rb.NickServNotice(fmt.Sprintf("Your email address is now %s", email))
+	}
+}
+
+// nickservSendpass handles NickServ SENDPASS, which emails a password reset code to the
+// given account's address.
+//
+// SENDPASS <account>
+func (server *Server) nickservSendpass(client *Client, params []string, rb *ResponseBuffer) {
+	config := server.passwordReset
+	if !config.Enabled || !server.mailto.Enabled() {
+		rb.NickServNotice("Password resets are not enabled on this server")
+		return
+	}
+	if len(params) < 1 {
+		rb.NickServNotice("Syntax: SENDPASS <account>")
+		return
+	}
+	accountKey, err := CasefoldName(params[0])
+	if err != nil {
+		rb.NickServNotice("That account name is invalid")
+		return
+	}
+	if !server.checkWritable(client, "NICKSERV", rb) {
+		return
+	}
+	if !server.allowPasswordReset(client, accountKey) {
+		rb.NickServNotice("Too many password resets have been requested recently, try again later")
+		return
+	}
+
+	codeBytes := make([]byte, resetCodeLen)
+	_, err = rand.Read(codeBytes)
+	if err != nil {
+		rb.NickServNotice("Could not reset your password")
+		return
+	}
+	code := hex.EncodeToString(codeBytes)
+
+	var accountName, email string
+	err = server.store.Update(func(tx *buntdb.Tx) error {
+		var err error
+		accountName, err = tx.Get(fmt.Sprintf(keyAccountName, accountKey))
+		if err != nil {
+			return err
+		}
+		email, err = tx.Get(fmt.Sprintf(keyAccountEmail, accountKey))
+		if err != nil {
+			return err
+		}
+		_, _, err = tx.Set(fmt.Sprintf(keyAccountResetCode, accountKey), resetCodeHash(code), &buntdb.SetOptions{Expires: true, TTL: config.CodeLifetime})
+		return err
+	})
+	// don't let people find out which accounts exist or have addresses this way
+	rb.NickServNotice(fmt.Sprintf("If %s has an email address, a reset code has been sent to it", params[0]))
+	if err == buntdb.ErrNotFound {
+		return
+	} else if err != nil {
+		server.logger.Error("internal", fmt.Sprintf("Could not save reset code for account %s: %s", accountKey, err.Error()))
+		return
+	}
+
+	mailto := server.mailto
+	data := emailData{
+		NetworkName: server.networkName,
+		Account:     accountName,
+		Code:        code,
+		Expiry:      config.CodeLifetime.String(),
+	}
+	server.logger.Info("accounts", fmt.Sprintf("Password reset for account %s requested by %s", accountName, client.nickMaskString))
+	go func() {
+		err := mailto.sendTemplate(email, mailto.resetTemplate, data)
+		if err != nil {
+			server.logger.Error("accounts", fmt.Sprintf("Could not send reset code for account %s: %s", accountName, err.Error()))
+		}
+	}()
+}
+
+// nickservResetpass handles NickServ RESETPASS, which sets a new password using an
+// emailed reset code.
+//
+// RESETPASS <account> <code> <new password>
+func (server *Server) nickservResetpass(client *Client, params []string, rb *ResponseBuffer) {
+	if !server.passwordReset.Enabled {
+		rb.NickServNotice("Password resets are not enabled on this server")
+		return
+	}
+	if len(params) < 3 {
+		rb.NickServNotice("Syntax: RESETPASS <account> <code> <new password>")
+		return
+	}
+	accountKey, err := CasefoldName(params[0])
+	if err != nil {
+		rb.NickServNotice("That reset code is invalid or has expired")
+		return
+	}
+	if !server.checkWritable(client, "NICKSERV", rb) {
+		return
+	}
+	password := strings.Join(params[2:], " ")
+
+	err = server.store.Update(func(tx *buntdb.Tx) error {
+		hash, err := tx.Get(fmt.Sprintf(keyAccountResetCode, accountKey))
+		if err != nil {
+			return errSaslFail
+		}
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(resetCodeHash(params[1]))) != 1 {
+			return errSaslFail
+		}
+		return setAccountPassword(tx, server.passwords, accountKey, password)
+	})
+	if err == errSaslFail {
+		rb.NickServNotice("That reset code is invalid or has expired")
+		return
+	} else if err != nil {
+		rb.NickServNotice("Could not reset your password")
+		server.logger.Error("internal", fmt.Sprintf("Could not save password for account %s: %s", accountKey, err.Error()))
+		return
+	}
+
+	if account, loaded := server.getAccount(accountKey); loaded {
+		account.PasswordResetRequired = false
+	}
+	server.logger.Info("accounts", fmt.Sprintf("Password for account %s reset by %s", accountKey, client.nickMaskString))
+	rb.NickServNotice("Your password has been changed, you can now log in with it")
+}
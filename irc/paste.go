@@ -0,0 +1,120 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// PasteActionFakelag slows down delivery of pasted lines so they don't flood the channel.
+	PasteActionFakelag = "fakelag"
+	// PasteActionTruncate drops pasted lines past the threshold and tells the sender.
+	// Either way, senders whose clients support multiline are told to send long text as a
+	// multiline message instead.
+	PasteActionTruncate = "truncate"
+)
+
+var (
+	errInvalidPasteThreshold = errors.New("Paste threshold is invalid")
+)
+
+// pasteState tracks the lines a client has recently sent to a channel.
+type pasteState struct {
+	start   time.Time
+	lines   int
+	dropped int
+}
+
+// parsePasteThreshold parses the argument of the paste threshold mode, which looks like
+// "<lines>:<seconds>".
+func parsePasteThreshold(arg string) (int, time.Duration, error) {
+	parts := strings.SplitN(arg, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, errInvalidPasteThreshold
+	}
+	lines, err := strconv.Atoi(parts[0])
+	if err != nil || lines < 1 {
+		return 0, 0, errInvalidPasteThreshold
+	}
+	seconds, err := strconv.Atoi(parts[1])
+	if err != nil || seconds < 1 || 3600 < seconds {
+		return 0, 0, errInvalidPasteThreshold
+	}
+	return lines, time.Duration(seconds) * time.Second, nil
+}
+
+// checkPaste records a line being sent to the given channel, and returns true if it's
+// part of a paste and should be dropped. With the fakelag action, this instead delays
+// the client until they're back under the threshold. A multiline batch counts as a
+// single line, since its size is already limited, and the caller tells the client if
+// it's dropped.
+func (client *Client) checkPaste(channel *Channel, batch bool) bool {
+	config := client.server.pasteDetection
+
+	channel.membersMutex.RLock()
+	lines, window := channel.pasteLines, channel.pasteWindow
+	exempt := client.hasFlag(Operator) || channel.clientIsAtLeastNoMutex(client, ChannelOperator)
+	channel.membersMutex.RUnlock()
+
+	if exempt || (client.isBot() && client.server.bots.ExemptFromPasteDetection) {
+		return false
+	}
+
+	// the channel's threshold overrides the server's
+	if lines == 0 {
+		if !config.Enabled {
+			return false
+		}
+		lines, window = config.Lines, config.Window
+	}
+
+	now := time.Now()
+	for name, state := range client.pastes {
+		if window <= now.Sub(state.start) {
+			delete(client.pastes, name)
+		}
+	}
+
+	state := client.pastes[channel.nameCasefolded]
+	if state == nil {
+		state = &pasteState{start: now}
+		client.pastes[channel.nameCasefolded] = state
+	}
+	state.lines++
+
+	if state.lines <= lines {
+		return false
+	}
+
+	// clients that support multiline can send long text as a single message, which only
+	// counts once, so they're pointed at that rather than at a pastebin
+	multiline := !batch && client.hasCapability(Multiline)
+
+	if config.Action == PasteActionFakelag {
+		if multiline && state.lines == lines+1 {
+			client.noteNotice("*", "PASTE_USE_MULTILINE", []string{channel.name}, fmt.Sprintf("You're sending lines to %s too quickly, so they're being slowed down. Please send long text as a multiline message", channel.name))
+		}
+		// pace the rest of the paste out to the threshold
+		time.Sleep(window / time.Duration(lines))
+		return false
+	}
+
+	if batch {
+		return true
+	}
+	if state.dropped == 0 {
+		if multiline {
+			client.noteNotice("*", "PASTE_USE_MULTILINE", []string{channel.name}, fmt.Sprintf("You're sending lines to %s too quickly, so the rest of your paste has been dropped. Please send long text as a multiline message", channel.name))
+		} else {
+			client.Notice(fmt.Sprintf("You're sending lines to %s too quickly, so the rest of your paste has been dropped. Please use a pastebin for long text", channel.name))
+		}
+	}
+	state.dropped++
+	return true
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+	"time"
+)
+
+// a multiline batch counts as a single line towards paste detection, however many lines
+// it has, since its size is already limited.
+func TestCheckPasteBatch(t *testing.T) {
+	server := &Server{}
+	server.pasteDetection = PasteDetectionConfig{
+		Enabled: true,
+		Lines:   2,
+		Window:  time.Minute,
+		Action:  PasteActionTruncate,
+	}
+	client := &Client{
+		server:  server,
+		account: &NoAccount,
+		pastes:  make(map[string]*pasteState),
+	}
+	channel := &Channel{
+		name:           "#chan",
+		nameCasefolded: "#chan",
+	}
+
+	for i := 0; i < 2; i++ {
+		if client.checkPaste(channel, true) {
+			t.Errorf("batch %d: expected the batch to be allowed", i)
+		}
+	}
+	if !client.checkPaste(channel, true) {
+		t.Error("expected the batch past the threshold to be dropped")
+	}
+	if state := client.pastes["#chan"]; state == nil || state.lines != 3 || state.dropped != 0 {
+		t.Errorf("expected each batch to count as one line, got %+v", state)
+	}
+}
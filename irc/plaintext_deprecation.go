@@ -0,0 +1,156 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+const (
+	// PlaintextDeprecationWarn lets plaintext clients connect, but tells them to move to TLS.
+	PlaintextDeprecationWarn = "warn"
+	// PlaintextDeprecationRedirect tells plaintext clients where the TLS port is, and then
+	// disconnects them.
+	PlaintextDeprecationRedirect = "redirect"
+)
+
+// PlaintextDeprecationConfig helps networks move their users off a plaintext listener, by
+// pointing them at the TLS port and optionally limiting how long they can stay.
+type PlaintextDeprecationConfig struct {
+	Enabled bool
+	Mode    string
+	// Message replaces the default notice. %d is replaced with the TLS port.
+	Message         string
+	TimeLimitString string        `yaml:"time-limit"`
+	TimeLimit       time.Duration `yaml:"time-limit-real"`
+}
+
+// load checks the config and parses the time limit.
+func (conf *PlaintextDeprecationConfig) load() (err error) {
+	if !conf.Enabled {
+		return nil
+	}
+	switch conf.Mode {
+	case "":
+		conf.Mode = PlaintextDeprecationWarn
+	case PlaintextDeprecationWarn, PlaintextDeprecationRedirect:
+	default:
+		return fmt.Errorf("mode must be %s or %s, not %s", PlaintextDeprecationWarn, PlaintextDeprecationRedirect, conf.Mode)
+	}
+	if conf.TimeLimitString != "" {
+		conf.TimeLimit, err = time.ParseDuration(conf.TimeLimitString)
+		if err != nil {
+			return fmt.Errorf("Could not parse time-limit: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// plaintextDeprecation returns the deprecation config that applies to the client, or nil if
+// they're fine where they are.
+func (client *Client) plaintextDeprecation() *PlaintextDeprecationConfig {
+	if client.hasFlag(TLS) || client.listenerConfig == nil || !client.listenerConfig.PlaintextDeprecation.Enabled {
+		return nil
+	}
+	return &client.listenerConfig.PlaintextDeprecation
+}
+
+// tlsPort returns the port that plaintext clients should move to, or 0 if we don't know of
+// one. The STS port is used if it's set, since that's where STS-aware clients will go.
+func (server *Server) tlsPort() int {
+	if server.stsEnabled {
+		if port := server.stsPort; 0 < port {
+			return port
+		}
+	}
+
+	server.listenerUpdateMutex.Lock()
+	var ports []int
+	for addr, listener := range server.listeners {
+		if !listener.IsTLS {
+			continue
+		}
+		_, portString, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.Atoi(portString)
+		if err == nil {
+			ports = append(ports, port)
+		}
+	}
+	server.listenerUpdateMutex.Unlock()
+
+	if len(ports) == 0 {
+		return 0
+	}
+	sort.Ints(ports)
+	return ports[0]
+}
+
+// plaintextDeprecationMessage returns the notice telling the client to move to TLS.
+func (server *Server) plaintextDeprecationMessage(conf *PlaintextDeprecationConfig) string {
+	port := server.tlsPort()
+	if conf.Message != "" {
+		return strings.Replace(conf.Message, "%d", strconv.Itoa(port), -1)
+	}
+	message := "This port is being phased out, please reconnect using TLS"
+	if 0 < port {
+		message += fmt.Sprintf(" on port %d", port)
+	}
+	if server.stsEnabled {
+		message += ". Clients that support STS will do this automatically"
+	}
+	if conf.Mode == PlaintextDeprecationWarn && 0 < conf.TimeLimit {
+		message += fmt.Sprintf(". Plaintext connections are closed after %s", conf.TimeLimit)
+	}
+	return message
+}
+
+// checkPlaintextDeprecation is called when a client connects, and tells plaintext clients
+// to move to TLS. It returns false if the client has been disconnected.
+func (client *Client) checkPlaintextDeprecation() bool {
+	conf := client.plaintextDeprecation()
+	if conf == nil {
+		return true
+	}
+	server := client.server
+	message := server.plaintextDeprecationMessage(conf)
+
+	if conf.Mode == PlaintextDeprecationRedirect {
+		// queued lines are dropped when we close the socket, so these go out as the final data
+		var finalData string
+		if port := server.tlsPort(); 0 < port {
+			bounceMsg := ircmsg.MakeMessage(nil, server.name, RPL_BOUNCE, client.nick, server.name, strconv.Itoa(port), message)
+			finalData, _ = bounceMsg.Line()
+		}
+		errorMsg := ircmsg.MakeMessage(nil, "", "ERROR", message)
+		errorLine, _ := errorMsg.Line()
+		client.socket.SetFinalData(finalData + errorLine)
+		client.quitMessageSent = true
+		client.destroy()
+		return false
+	}
+
+	client.Notice(message)
+	if 0 < conf.TimeLimit {
+		client.timerMutex.Lock()
+		client.plaintextTimer = time.AfterFunc(conf.TimeLimit, client.plaintextTimeLimitReached)
+		client.timerMutex.Unlock()
+	}
+	return true
+}
+
+// plaintextTimeLimitReached disconnects a plaintext client that's stayed too long.
+func (client *Client) plaintextTimeLimitReached() {
+	client.Quit("Plaintext connection time limit reached, please reconnect using TLS")
+	client.destroy()
+}
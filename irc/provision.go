@@ -0,0 +1,301 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/sno"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	keyAccountPasswordReset = "account.passwordreset %s"
+
+	// provisionPasswordChars are the characters used in generated passwords, leaving out
+	// ones that are easy to mix up.
+	provisionPasswordChars = "abcdefghjkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	// bcrypt only uses the first 72 bytes of what it hashes, and our salts take up 62 of them
+	provisionPasswordLength = 10
+)
+
+// ProvisionRecord is an account to create with ProvisionAccounts.
+type ProvisionRecord struct {
+	Account string
+	// Password is the account's initial password. If it's empty, one is generated.
+	Password string
+}
+
+// ProvisionResult is the outcome of creating one account with ProvisionAccounts.
+type ProvisionResult struct {
+	Account string `json:"account"`
+	// Password is the generated password, if one was generated.
+	Password string `json:"password,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ParseProvisionCSV reads accounts to provision from CSV lines that look like
+// `account[,password]`. Blank lines, lines starting with # and an `account` header are skipped.
+func ParseProvisionCSV(r io.Reader) ([]ProvisionRecord, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var records []ProvisionRecord
+	for line := 1; ; line++ {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		account := strings.TrimSpace(fields[0])
+		if account == "" || (line == 1 && strings.ToLower(account) == "account") {
+			continue
+		}
+		if 2 < len(fields) {
+			return nil, fmt.Errorf("Line %d has too many fields, expected account[,password]", line)
+		}
+		record := ProvisionRecord{Account: account}
+		if len(fields) == 2 {
+			record.Password = fields[1]
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// generatePassword returns a random password for a provisioned account.
+func generatePassword() (string, error) {
+	buf := make([]byte, provisionPasswordLength)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	for i, b := range buf {
+		buf[i] = provisionPasswordChars[int(b)%len(provisionPasswordChars)]
+	}
+	return string(buf), nil
+}
+
+// ProvisionAccounts creates the given accounts as already verified. Their users must set a
+// new password when they first log in.
+func ProvisionAccounts(store *buntdb.DB, passwords *PasswordManager, records []ProvisionRecord) []ProvisionResult {
+	var results []ProvisionResult
+	for _, record := range records {
+		result := ProvisionResult{Account: record.Account}
+		err := provisionAccount(store, passwords, record, &result)
+		if err != nil {
+			result.Password = ""
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// provisionAccount creates a single account, filling in the generated password if there is one.
+func provisionAccount(store *buntdb.DB, passwords *PasswordManager, record ProvisionRecord, result *ProvisionResult) error {
+	accountKey, err := CasefoldName(record.Account)
+	if err != nil || record.Account == "*" {
+		return errors.New("Account name is not valid")
+	}
+
+	password := record.Password
+	if password == "" {
+		password, err = generatePassword()
+		if err != nil {
+			return err
+		}
+		result.Password = password
+	}
+
+	var creds AccountCredentials
+	err = creds.setPassphrase(passwords, password)
+	if err != nil {
+		return err
+	}
+	credText, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+
+	return store.Update(func(tx *buntdb.Tx) error {
+		if accountNameTaken(tx, accountKey) {
+			return errors.New("Account already exists")
+		}
+
+		tx.Set(fmt.Sprintf(keyAccountExists, accountKey), "1", nil)
+		tx.Set(fmt.Sprintf(keyAccountName, accountKey), record.Account, nil)
+		tx.Set(fmt.Sprintf(keyAccountRegTime, accountKey), strconv.FormatInt(time.Now().Unix(), 10), nil)
+		tx.Set(fmt.Sprintf(keyAccountCredentials, accountKey), string(credText), nil)
+		tx.Set(fmt.Sprintf(keyAccountVerified, accountKey), "1", nil)
+		tx.Set(fmt.Sprintf(keyAccountPasswordReset, accountKey), "1", nil)
+		return nil
+	})
+}
+
+// ProvisionDB creates the given accounts in the datastore at the given path. The server must
+// not be running, use the rest API to provision accounts on a running server.
+func ProvisionDB(path string, records []ProvisionRecord) ([]ProvisionResult, error) {
+	store, err := buntdb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open datastore: %s", err.Error())
+	}
+	defer store.Close()
+
+	var passwords *PasswordManager
+	err = store.View(func(tx *buntdb.Tx) error {
+		passwords, err = loadPasswordManager(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ProvisionAccounts(store, passwords, records), nil
+}
+
+// loadPasswordManager returns a password manager using the datastore's salt.
+func loadPasswordManager(tx *buntdb.Tx) (*PasswordManager, error) {
+	saltString, err := tx.Get(keySalt)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve salt string: %s", err.Error())
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(saltString)
+	if err != nil {
+		return nil, err
+	}
+
+	pwm := NewPasswordManager(salt)
+	return &pwm, nil
+}
+
+// provisionAccounts creates accounts on the running server and tells the opers about it.
+func (server *Server) provisionAccounts(records []ProvisionRecord) []ProvisionResult {
+	results := ProvisionAccounts(server.store, server.passwords, records)
+	var created int
+	for _, result := range results {
+		if result.Error == "" {
+			created++
+		}
+	}
+	server.logger.Info("accounts", fmt.Sprintf("Provisioned %d of %d accounts", created, len(results)))
+	server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Provisioned $c[grey][$r%d$c[grey]] accounts"), created))
+	return results
+}
+
+// resetAccountPassword gives the account a new random password, which its user must change
+// when they next log in.
+func (server *Server) resetAccountPassword(accountKey string) (string, error) {
+	password, err := generatePassword()
+	if err != nil {
+		return "", err
+	}
+	var creds AccountCredentials
+	err = creds.setPassphrase(server.passwords, password)
+	if err != nil {
+		return "", err
+	}
+
+	err = server.store.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Get(fmt.Sprintf(keyAccountExists, accountKey))
+		if err != nil {
+			return errNoSuchAccount
+		}
+		// keep the certfps, but replace everything the old password could log in with
+		oldCreds, err := loadAccountCredentials(tx, accountKey)
+		if err == nil {
+			creds.Certificate = oldCreds.Certificate
+			creds.Certificates = oldCreds.Certificates
+		}
+		credText, err := json.Marshal(creds)
+		if err != nil {
+			return err
+		}
+		tx.Set(fmt.Sprintf(keyAccountCredentials, accountKey), string(credText), nil)
+		tx.Set(fmt.Sprintf(keyAccountPasswordReset, accountKey), "1", nil)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if account, exists := server.getAccount(accountKey); exists {
+		account.PasswordResetRequired = true
+	}
+	return password, nil
+}
+
+// passwordResetAllowed returns true if the client can use the given command while their
+// account is waiting for a new password.
+func (server *Server) passwordResetAllowed(msg ircmsg.IrcMessage) bool {
+	switch strings.ToUpper(msg.Command) {
+	case "NS", "NICKSERV", "QUIT", "PING", "PONG", "CAP", "HELP", "HELPOP":
+		return true
+	case "PRIVMSG":
+		if len(msg.Params) < 1 {
+			return false
+		}
+		target, err := CasefoldName(msg.Params[0])
+		return err == nil && server.isNickServ(target)
+	}
+	return false
+}
+
+// passwordResetBlocks returns true if the client can't use the given command until they've set
+// a new password. Clients that haven't registered yet (like ones that just logged in with SASL)
+// aren't stopped, so they can finish connecting and be told what to do.
+func (server *Server) passwordResetBlocks(client *Client, msg ircmsg.IrcMessage) bool {
+	return client.registered && client.needsPasswordReset() && !server.passwordResetAllowed(msg)
+}
+
+// needsPasswordReset returns true if the client is logged into an account that has to set
+// a new password before it can be used.
+func (client *Client) needsPasswordReset() bool {
+	return client.account != nil && client.account.PasswordResetRequired
+}
+
+// nickservSetPassword handles the NickServ SET PASSWORD command.
+func (server *Server) nickservSetPassword(client *Client, params []string, rb *ResponseBuffer) {
+	if client.account == &NoAccount {
+		rb.NickServNotice("You must be logged into an account to change its password")
+		return
+	}
+	if len(params) < 1 || params[0] == "" {
+		rb.NickServNotice("Syntax: SET PASSWORD <new password>")
+		return
+	}
+	if !server.checkWritable(client, "NICKSERV", rb) {
+		return
+	}
+	account := client.account
+	accountKey, _ := CasefoldName(account.Name)
+	password := strings.Join(params, " ")
+
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		return setAccountPassword(tx, server.passwords, accountKey, password)
+	})
+	if err != nil {
+		rb.NickServNotice("Could not change your password")
+		server.logger.Error("internal", fmt.Sprintf("Could not save password for account %s: %s", account.Name, err.Error()))
+		return
+	}
+
+	account.PasswordResetRequired = false
+	rb.NickServNotice("Your password has been changed")
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+func TestPasswordResetAllowed(t *testing.T) {
+	server := &Server{}
+	server.nickserv.nickCasefolded = "nickserv"
+
+	cases := []struct {
+		line    string
+		allowed bool
+	}{
+		{"NS SET PASSWORD hunter2", true},
+		{"NICKSERV SET PASSWORD hunter2", true},
+		{"PRIVMSG NickServ :SET PASSWORD hunter2", true},
+		{"QUIT :bye", true},
+		{"PING abc", true},
+		{"PONG abc", true},
+		{"CAP LS 302", true},
+		{"HELP", true},
+		{"PRIVMSG #chan :hi", false},
+		{"PRIVMSG", false},
+		{"JOIN #chan", false},
+		{"NICK newnick", false},
+		{"CS REGISTER #chan", false},
+	}
+	for _, c := range cases {
+		msg, err := ircmsg.ParseLine(c.line)
+		if err != nil {
+			t.Fatalf("couldn't parse %q: %s", c.line, err.Error())
+		}
+		if allowed := server.passwordResetAllowed(msg); allowed != c.allowed {
+			t.Errorf("%q: expected allowed to be %v, got %v", c.line, c.allowed, allowed)
+		}
+	}
+}
+
+// a provisioned account that logs in with SASL has to be able to finish registering, and is
+// only held to the password reset once it has.
+func TestPasswordResetAfterSASLLogin(t *testing.T) {
+	server := &Server{}
+	server.nickserv.nickCasefolded = "nickserv"
+	client := &Client{
+		account: &ClientAccount{
+			Name:                  "provisioned",
+			PasswordResetRequired: true,
+		},
+	}
+
+	for _, line := range []string{"CAP LS 302", "CAP REQ :sasl", "AUTHENTICATE PLAIN", "AUTHENTICATE +", "CAP END", "NICK provisioned", "USER u 0 * :real name"} {
+		msg, _ := ircmsg.ParseLine(line)
+		if server.passwordResetBlocks(client, msg) {
+			t.Errorf("%q was blocked before registration", line)
+		}
+	}
+
+	client.registered = true
+	for _, c := range []struct {
+		line    string
+		blocked bool
+	}{
+		{"JOIN #chan", true},
+		{"NICK other", true},
+		{"NS SET PASSWORD hunter2", false},
+	} {
+		msg, _ := ircmsg.ParseLine(c.line)
+		if blocked := server.passwordResetBlocks(client, msg); blocked != c.blocked {
+			t.Errorf("%q after registration: expected blocked to be %v, got %v", c.line, c.blocked, blocked)
+		}
+	}
+
+	client.account.PasswordResetRequired = false
+	msg, _ := ircmsg.ParseLine("JOIN #chan")
+	if server.passwordResetBlocks(client, msg) {
+		t.Error("JOIN was blocked after the password was reset")
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// formattingRegex matches IRC formatting codes: colours (including hex colours), bold,
+	// italics, underline, strikethrough, monospace, reverse and reset.
+	formattingRegex = regexp.MustCompile("\x03([0-9]{1,2}(,[0-9]{1,2})?)?|\x04([0-9a-fA-F]{6}(,[0-9a-fA-F]{6})?)?|[\x02\x0f\x11\x16\x1d\x1e\x1f]")
+)
+
+// QuitMessagesConfig controls how the messages clients quit with are shown to other people.
+type QuitMessagesConfig struct {
+	// MaxLength is the longest a quit message can be, in bytes, or 0 for no limit.
+	MaxLength int `yaml:"max-length"`
+	// Template is how the messages clients give with /QUIT are shown, with <message>
+	// replaced by what they said.
+	Template string
+	// StripFormatting removes colours and other formatting from quit messages.
+	StripFormatting bool `yaml:"strip-formatting"`
+}
+
+// stripFormatting removes IRC formatting codes from the given text.
+func stripFormatting(text string) string {
+	return formattingRegex.ReplaceAllString(text, "")
+}
+
+// quitMessagePolicy returns the quit message settings for the client's connection class.
+func (client *Client) quitMessagePolicy() *QuitMessagesConfig {
+	if class := client.getConnectionClass(); class != nil && class.QuitMessages != nil {
+		return class.QuitMessages
+	}
+	return &client.server.quitMessages
+}
+
+// userQuitMessage returns the quit message to use when the client quits with the given
+// message of their own.
+func (client *Client) userQuitMessage(message string) string {
+	if message == "" {
+		return "Quit"
+	}
+	template := client.quitMessagePolicy().Template
+	if template == "" {
+		template = "Quit: <message>"
+	}
+	return strings.Replace(template, "<message>", message, -1)
+}
+
+// cleanQuitMessage applies the formatting and length limits to a quit message. Every quit
+// message goes through this, whether the client quit, timed out or was killed.
+func (client *Client) cleanQuitMessage(message string) string {
+	policy := client.quitMessagePolicy()
+	if policy.StripFormatting {
+		message = stripFormatting(message)
+	}
+	if 0 < policy.MaxLength {
+		message = truncateGraphemes(message, policy.MaxLength)
+	}
+	return message
+}
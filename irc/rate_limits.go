@@ -0,0 +1,106 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"time"
+
+	"github.com/oragono/oragono/irc/ratelimit"
+)
+
+// the limits used when they're left out of the config, matching the ones in oragono.yaml
+var (
+	defaultSASLAttemptsLimit  = RateLimitConfig{Limit: 10, WindowString: "10m"}
+	defaultRegistrationsLimit = RateLimitConfig{Limit: 3, WindowString: "1h"}
+	defaultInvitesLimit       = RateLimitConfig{Limit: 10, WindowString: "10m"}
+	defaultAccountStatusLimit = RateLimitConfig{Limit: 30, WindowString: "1m"}
+	defaultAPIMessagesLimit   = RateLimitConfig{Limit: 20, WindowString: "1m"}
+	defaultPasswordResetLimit = RateLimitConfig{Limit: 3, WindowString: "1h"}
+)
+
+// newKeyedLimiter returns a per-key sliding window limiter for the given config, or nil if
+// the limit is disabled.
+func newKeyedLimiter(config RateLimitConfig) *ratelimit.Keyed {
+	if config.Limit < 1 {
+		return nil
+	}
+	return ratelimit.NewKeyed(func() ratelimit.Limiter {
+		return ratelimit.NewSlidingWindow(config.Limit, config.Window)
+	})
+}
+
+// updateRateLimits sets up the rate limiters from the given config. Limiters whose config
+// hasn't changed are kept, so rehashing doesn't reset them.
+func (server *Server) updateRateLimits(config RateLimitsConfig) {
+	if server.saslAttempts == nil || config.SASLAttempts != server.rateLimits.SASLAttempts {
+		server.saslAttempts = newKeyedLimiter(config.SASLAttempts)
+	}
+	if server.registrations == nil || config.Registrations != server.rateLimits.Registrations {
+		server.registrations = newKeyedLimiter(config.Registrations)
+	}
+	if server.inviteLimits == nil || config.Invites != server.rateLimits.Invites {
+		server.inviteLimits = newKeyedLimiter(config.Invites)
+	}
+	if server.accountStatusLimits == nil || config.AccountStatus != server.rateLimits.AccountStatus {
+		server.accountStatusLimits = newKeyedLimiter(config.AccountStatus)
+	}
+	if server.apiMessageLimits == nil || config.APIMessages != server.rateLimits.APIMessages {
+		server.apiMessageLimits = newKeyedLimiter(config.APIMessages)
+	}
+	server.rateLimits = config
+}
+
+// allowSaslAttempt records a SASL attempt from the client's IP, returning false if they've
+// made too many recently.
+func (server *Server) allowSaslAttempt(client *Client) bool {
+	limiter := server.saslAttempts
+	return limiter == nil || limiter.Allow(client.IPString())
+}
+
+// allowRegistration records an account registration from the client's IP, returning false
+// if they've made too many recently.
+func (server *Server) allowRegistration(client *Client) bool {
+	limiter := server.registrations
+	return limiter == nil || limiter.Allow(client.IPString())
+}
+
+// allowInvite records an INVITE from the client's IP, returning false if they've sent too
+// many recently. Opers aren't limited.
+func (server *Server) allowInvite(client *Client) bool {
+	limiter := server.inviteLimits
+	return limiter == nil || client.hasFlag(Operator) || limiter.Allow(client.IPString())
+}
+
+// allowAccountStatus records an ACCOUNTSTATUS lookup from the client's IP, returning false if
+// they've made too many recently. Opers and bots aren't limited.
+func (server *Server) allowAccountStatus(client *Client) bool {
+	limiter := server.accountStatusLimits
+	return limiter == nil || client.hasFlag(Operator) || client.isBot() || limiter.Allow(client.IPString())
+}
+
+// fakelag slows the client down if they're sending commands too quickly.
+func (client *Client) fakelag() {
+	config := client.server.rateLimits.Commands
+	if !config.Enabled || client.hasFlag(Operator) || client.isBot() {
+		return
+	}
+
+	bucket := client.commandBucket
+	if bucket == nil || bucket.Capacity != config.Burst || bucket.Interval != config.Interval {
+		bucket = ratelimit.NewTokenBucket(config.Burst, config.Interval)
+		client.commandBucket = bucket
+	}
+
+	now := time.Now()
+	if bucket.Allow(now) {
+		client.fakelagged = false
+		return
+	}
+	if !client.fakelagged {
+		client.fakelagged = true
+		client.noteNotice("*", "FAKELAG", nil, "You're sending commands too quickly, so they're being slowed down")
+	}
+	time.Sleep(bucket.Wait(now))
+	bucket.Allow(time.Now())
+}
@@ -0,0 +1,232 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+// Package ratelimit provides the rate limiters used across the server, for things like
+// connection throttling, command flood protection and limiting SASL attempts.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// pruneInterval is how often keyed limiters drop their idle entries.
+	pruneInterval = time.Minute
+)
+
+// Limiter decides whether events are allowed, based on the events that have come before.
+type Limiter interface {
+	// Allow records an event at the given time, returning false if it goes over the limit.
+	// Events that go over the limit aren't recorded.
+	Allow(now time.Time) bool
+	// WouldAllow returns true if an event at the given time would be allowed, without
+	// recording it.
+	WouldAllow(now time.Time) bool
+	// Wait returns how long it'll be until an event would be allowed.
+	Wait(now time.Time) time.Duration
+	// Idle returns true if the limiter is back in its starting state, so it can be thrown away.
+	Idle(now time.Time) bool
+}
+
+// TokenBucket is a limiter that allows bursts of up to Capacity events, refilling by one
+// event every Interval.
+type TokenBucket struct {
+	Capacity int
+	Interval time.Duration
+
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a full token bucket.
+func NewTokenBucket(capacity int, interval time.Duration) *TokenBucket {
+	return &TokenBucket{
+		Capacity: capacity,
+		Interval: interval,
+		tokens:   float64(capacity),
+	}
+}
+
+// refill adds the tokens that have built up since we last looked at the bucket.
+func (tb *TokenBucket) refill(now time.Time) {
+	if !tb.last.IsZero() && tb.last.Before(now) && 0 < tb.Interval {
+		tb.tokens += float64(now.Sub(tb.last)) / float64(tb.Interval)
+		if float64(tb.Capacity) < tb.tokens {
+			tb.tokens = float64(tb.Capacity)
+		}
+	}
+	if tb.last.IsZero() || tb.last.Before(now) {
+		tb.last = now
+	}
+}
+
+// Allow takes a token from the bucket, returning false if there aren't any left.
+func (tb *TokenBucket) Allow(now time.Time) bool {
+	tb.refill(now)
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// WouldAllow returns true if there's a token left in the bucket.
+func (tb *TokenBucket) WouldAllow(now time.Time) bool {
+	tb.refill(now)
+	return 1 <= tb.tokens
+}
+
+// Wait returns how long it'll be until there's a token in the bucket.
+func (tb *TokenBucket) Wait(now time.Time) time.Duration {
+	tb.refill(now)
+	if 1 <= tb.tokens {
+		return 0
+	}
+	return time.Duration((1 - tb.tokens) * float64(tb.Interval))
+}
+
+// Idle returns true if the bucket is full.
+func (tb *TokenBucket) Idle(now time.Time) bool {
+	tb.refill(now)
+	return float64(tb.Capacity) <= tb.tokens
+}
+
+// SlidingWindow is a limiter that allows up to Limit events within any Window.
+type SlidingWindow struct {
+	Limit  int
+	Window time.Duration
+
+	events []time.Time
+}
+
+// NewSlidingWindow returns an empty sliding window.
+func NewSlidingWindow(limit int, window time.Duration) *SlidingWindow {
+	return &SlidingWindow{
+		Limit:  limit,
+		Window: window,
+	}
+}
+
+// prune removes the events that have fallen out of the window.
+func (sw *SlidingWindow) prune(now time.Time) {
+	cutoff := now.Add(-sw.Window)
+	var i int
+	for i < len(sw.events) && !sw.events[i].After(cutoff) {
+		i++
+	}
+	sw.events = sw.events[i:]
+}
+
+// Allow records an event, returning false if there have already been too many in the window.
+func (sw *SlidingWindow) Allow(now time.Time) bool {
+	sw.prune(now)
+	if sw.Limit <= len(sw.events) {
+		return false
+	}
+	sw.events = append(sw.events, now)
+	return true
+}
+
+// WouldAllow returns true if another event would fit in the window.
+func (sw *SlidingWindow) WouldAllow(now time.Time) bool {
+	sw.prune(now)
+	return len(sw.events) < sw.Limit
+}
+
+// Wait returns how long it'll be until another event would fit in the window.
+func (sw *SlidingWindow) Wait(now time.Time) time.Duration {
+	sw.prune(now)
+	if len(sw.events) < sw.Limit || len(sw.events) == 0 {
+		return 0
+	}
+	return sw.events[len(sw.events)-sw.Limit].Add(sw.Window).Sub(now)
+}
+
+// Idle returns true if there are no events in the window.
+func (sw *SlidingWindow) Idle(now time.Time) bool {
+	sw.prune(now)
+	return len(sw.events) == 0
+}
+
+// Keyed holds a separate limiter for each key (such as an IP address or account name),
+// throwing away limiters once they're idle.
+type Keyed struct {
+	sync.Mutex
+
+	newLimiter func() Limiter
+	limiters   map[string]Limiter
+	lastPrune  time.Time
+
+	// now returns the current time, and is replaced in tests.
+	now func() time.Time
+}
+
+// NewKeyed returns a keyed limiter that uses the given function to make new limiters.
+func NewKeyed(newLimiter func() Limiter) *Keyed {
+	return &Keyed{
+		newLimiter: newLimiter,
+		limiters:   make(map[string]Limiter),
+		now:        time.Now,
+	}
+}
+
+// get returns the limiter for the given key, creating it if need be. The lock must be held.
+func (k *Keyed) get(key string, now time.Time) Limiter {
+	if pruneInterval <= now.Sub(k.lastPrune) {
+		for otherKey, limiter := range k.limiters {
+			if limiter.Idle(now) {
+				delete(k.limiters, otherKey)
+			}
+		}
+		k.lastPrune = now
+	}
+
+	limiter, exists := k.limiters[key]
+	if !exists {
+		limiter = k.newLimiter()
+		k.limiters[key] = limiter
+	}
+	return limiter
+}
+
+// Allow records an event for the given key, returning false if it goes over the limit.
+func (k *Keyed) Allow(key string) bool {
+	k.Lock()
+	defer k.Unlock()
+	now := k.now()
+	return k.get(key, now).Allow(now)
+}
+
+// WouldAllow returns true if an event for the given key would be allowed, without recording it.
+func (k *Keyed) WouldAllow(key string) bool {
+	k.Lock()
+	defer k.Unlock()
+	limiter, exists := k.limiters[key]
+	return !exists || limiter.WouldAllow(k.now())
+}
+
+// Wait returns how long it'll be until an event for the given key would be allowed.
+func (k *Keyed) Wait(key string) time.Duration {
+	k.Lock()
+	defer k.Unlock()
+	limiter, exists := k.limiters[key]
+	if !exists {
+		return 0
+	}
+	return limiter.Wait(k.now())
+}
+
+// Reset forgets the events recorded for the given key.
+func (k *Keyed) Reset(key string) {
+	k.Lock()
+	defer k.Unlock()
+	delete(k.limiters, key)
+}
+
+// Len returns how many keys are being tracked.
+func (k *Keyed) Len() int {
+	k.Lock()
+	defer k.Unlock()
+	return len(k.limiters)
+}
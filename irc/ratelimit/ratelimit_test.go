@@ -0,0 +1,140 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+var start = time.Date(2017, time.September, 1, 12, 0, 0, 0, time.UTC)
+
+func TestTokenBucket(t *testing.T) {
+	tb := NewTokenBucket(3, time.Second)
+
+	// a full bucket allows a burst
+	for i := 0; i < 3; i++ {
+		if !tb.Allow(start) {
+			t.Fatalf("event %d of the burst was not allowed", i+1)
+		}
+	}
+	if tb.Allow(start) {
+		t.Error("event past the burst was allowed")
+	}
+	if tb.Idle(start) {
+		t.Error("empty bucket is idle")
+	}
+	if wait := tb.Wait(start); wait != time.Second {
+		t.Errorf("expected to wait 1s, got %s", wait)
+	}
+
+	// half a token isn't enough
+	if tb.WouldAllow(start.Add(500 * time.Millisecond)) {
+		t.Error("event allowed before a token refilled")
+	}
+	if wait := tb.Wait(start.Add(500 * time.Millisecond)); wait != 500*time.Millisecond {
+		t.Errorf("expected to wait 500ms, got %s", wait)
+	}
+
+	// one token refills per interval
+	if !tb.Allow(start.Add(time.Second)) {
+		t.Error("event not allowed after a token refilled")
+	}
+	if tb.Allow(start.Add(time.Second)) {
+		t.Error("second event allowed after only one token refilled")
+	}
+
+	// the bucket never holds more than its capacity
+	later := start.Add(time.Hour)
+	if !tb.Idle(later) {
+		t.Error("bucket isn't idle after refilling")
+	}
+	for i := 0; i < 3; i++ {
+		tb.Allow(later)
+	}
+	if tb.Allow(later) {
+		t.Error("bucket refilled past its capacity")
+	}
+}
+
+func TestTokenBucketClockSkew(t *testing.T) {
+	tb := NewTokenBucket(1, time.Second)
+	if !tb.Allow(start) {
+		t.Fatal("first event was not allowed")
+	}
+	// going back in time shouldn't refill the bucket
+	if tb.Allow(start.Add(-time.Hour)) {
+		t.Error("event allowed after the clock went backwards")
+	}
+	if !tb.Allow(start.Add(time.Second)) {
+		t.Error("event not allowed after the clock recovered")
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	sw := NewSlidingWindow(2, time.Minute)
+
+	if !sw.Idle(start) {
+		t.Error("new window isn't idle")
+	}
+	if !sw.Allow(start) || !sw.Allow(start.Add(10*time.Second)) {
+		t.Fatal("events under the limit were not allowed")
+	}
+	if sw.WouldAllow(start.Add(20 * time.Second)) {
+		t.Error("event over the limit would be allowed")
+	}
+	if sw.Allow(start.Add(20 * time.Second)) {
+		t.Error("event over the limit was allowed")
+	}
+	if wait := sw.Wait(start.Add(20 * time.Second)); wait != 40*time.Second {
+		t.Errorf("expected to wait 40s, got %s", wait)
+	}
+
+	// the first event falls out of the window, making room for one more
+	if !sw.Allow(start.Add(time.Minute)) {
+		t.Error("event not allowed after the first one left the window")
+	}
+	if sw.Allow(start.Add(time.Minute)) {
+		t.Error("event allowed while the window is full")
+	}
+	if !sw.Idle(start.Add(3 * time.Minute)) {
+		t.Error("window isn't idle after all events left it")
+	}
+}
+
+func TestKeyed(t *testing.T) {
+	now := start
+	k := NewKeyed(func() Limiter {
+		return NewSlidingWindow(1, time.Minute)
+	})
+	k.now = func() time.Time { return now }
+
+	if !k.WouldAllow("a") {
+		t.Error("unknown key would not be allowed")
+	}
+	if !k.Allow("a") {
+		t.Error("first event for a was not allowed")
+	}
+	if k.Allow("a") {
+		t.Error("second event for a was allowed")
+	}
+	if !k.Allow("b") {
+		t.Error("keys are not limited separately")
+	}
+	if k.Wait("a") != time.Minute {
+		t.Errorf("expected to wait 1m for a, got %s", k.Wait("a"))
+	}
+
+	k.Reset("a")
+	if !k.Allow("a") {
+		t.Error("event for a was not allowed after resetting it")
+	}
+
+	// idle limiters are thrown away
+	now = start.Add(2 * pruneInterval)
+	k.Allow("c")
+	if k.Len() != 1 {
+		t.Errorf("expected idle keys to be pruned, still tracking %d keys", k.Len())
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/sno"
+)
+
+// isReadOnly returns true if the server is in read-only maintenance mode, where clients can
+// connect and chat but nothing is written to the datastore.
+func (server *Server) isReadOnly() bool {
+	server.readOnlyMutex.RLock()
+	defer server.readOnlyMutex.RUnlock()
+	return server.readOnly
+}
+
+// setReadOnly turns read-only maintenance mode on or off.
+func (server *Server) setReadOnly(readOnly bool, reason string) {
+	server.readOnlyMutex.Lock()
+	defer server.readOnlyMutex.Unlock()
+	server.readOnly = readOnly
+	server.readOnlyReason = reason
+}
+
+// checkWritable returns true if the datastore can be written to. If it can't, the client is
+// told why with a FAIL for the given command.
+func (server *Server) checkWritable(client *Client, command string, rb *ResponseBuffer) bool {
+	server.readOnlyMutex.RLock()
+	readOnly, reason := server.readOnly, server.readOnlyReason
+	server.readOnlyMutex.RUnlock()
+	if !readOnly {
+		return true
+	}
+
+	message := "The server is in read-only mode for maintenance, so changes can't be saved right now. Please try again later"
+	if reason != "" {
+		message = fmt.Sprintf("%s (%s)", message, reason)
+	}
+	rb.Send(nil, server.name, "FAIL", command, "READ_ONLY", message)
+	return false
+}
+
+// READONLY [ON [<reason>]|OFF]
+func readonlyHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	if len(msg.Params) < 1 {
+		server.readOnlyMutex.RLock()
+		readOnly, reason := server.readOnly, server.readOnlyReason
+		server.readOnlyMutex.RUnlock()
+		if !readOnly {
+			rb.Notice("The server is not in read-only mode")
+		} else if reason == "" {
+			rb.Notice("The server is in read-only mode")
+		} else {
+			rb.Notice(fmt.Sprintf("The server is in read-only mode: %s", reason))
+		}
+		return false
+	}
+
+	var readOnly bool
+	switch strings.ToUpper(msg.Params[0]) {
+	case "ON":
+		readOnly = true
+	case "OFF":
+	default:
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "READONLY", msg.Params[0], "Setting must be ON or OFF")
+		return false
+	}
+	var reason string
+	if readOnly && 1 < len(msg.Params) {
+		reason = strings.Join(msg.Params[1:], " ")
+	}
+
+	server.setReadOnly(readOnly, reason)
+	if readOnly {
+		rb.Notice("The server is now in read-only mode, nothing will be written to the datastore")
+		server.logger.Info("opers", fmt.Sprintf("%s turned on read-only mode: %s", client.nick, reason))
+		server.snomasks.Send(sno.LocalOpers, fmt.Sprintf(ircfmt.Unescape("%s$r turned on read-only mode $c[grey][$r%s$c[grey]]"), client.nick, reason))
+	} else {
+		rb.Notice("The server is no longer in read-only mode")
+		server.logger.Info("opers", fmt.Sprintf("%s turned off read-only mode", client.nick))
+		server.snomasks.Send(sno.LocalOpers, fmt.Sprintf("%s turned off read-only mode", client.nick))
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+// labeledLine is a reply that's being held back until the labeled command that caused it
+// has been handled.
+type labeledLine struct {
+	tags    *map[string]ircmsg.TagValue
+	prefix  string
+	command string
+	params  []string
+}
+
+// ResponseBuffer collects the replies to the command being handled. Handlers send their
+// replies through it rather than straight to the client, so that replies to a command with
+// a `label` tag can be labeled once the command's been handled. Without a label, replies are
+// sent straight away.
+type ResponseBuffer struct {
+	Label  string
+	target *Client
+	lines  []labeledLine
+	// bytes is roughly how much the held lines will take up once they're sent.
+	bytes int
+	// flushed is set once the held lines have been sent early, because there were too many
+	// to hold. Later replies are labeled (or put in batch) as they're sent.
+	flushed bool
+	batch   *ClientBatch
+	// finished is set once the command's been handled. Anything sent after this isn't a
+	// reply to it, so it's sent as-is.
+	finished bool
+}
+
+// NewResponseBuffer returns a new ResponseBuffer for replies to the given client.
+func NewResponseBuffer(target *Client) *ResponseBuffer {
+	return &ResponseBuffer{
+		target: target,
+	}
+}
+
+// Send sends a reply to the client, holding it back if it's a reply to a labeled command.
+func (rb *ResponseBuffer) Send(tags *map[string]ircmsg.TagValue, prefix string, command string, params ...string) error {
+	if rb.Label == "" || rb.finished {
+		return rb.target.Send(tags, prefix, command, params...)
+	}
+	if rb.flushed {
+		return rb.sendLabeled(tags, prefix, command, params...)
+	}
+
+	rb.lines = append(rb.lines, labeledLine{
+		tags:    tags,
+		prefix:  prefix,
+		command: command,
+		params:  append([]string(nil), params...),
+	})
+	rb.bytes += len(prefix) + len(command) + 4
+	for _, param := range params {
+		rb.bytes += len(param) + 1
+	}
+	if tags != nil {
+		for name, value := range *tags {
+			rb.bytes += len(name) + len(value.Value) + 2
+		}
+	}
+
+	// held lines don't count towards the sendq, so don't hold onto more than it could
+	if uint64(rb.bytes) > rb.target.socket.MaxSendQ()/2 {
+		rb.flush()
+	}
+	return nil
+}
+
+// sendLabeled sends a reply as part of the labeled response, after the held replies have
+// been flushed.
+func (rb *ResponseBuffer) sendLabeled(tags *map[string]ircmsg.TagValue, prefix string, command string, params ...string) error {
+	if rb.batch != nil {
+		return rb.batch.Send(tags, prefix, command, params...)
+	}
+	return rb.target.Send(tagsWith(tags, "label", rb.Label), prefix, command, params...)
+}
+
+// flush sends the replies held so far, starting the labeled-response batch for them if the
+// client supports it.
+func (rb *ResponseBuffer) flush() {
+	if rb.target.hasCapability(Batch) {
+		rb.batch = rb.target.StartBatch(ircmsg.MakeTags("label", rb.Label), BatchLabeledResponse)
+	}
+	rb.flushed = true
+	lines := rb.lines
+	rb.lines = nil
+	rb.bytes = 0
+	for _, line := range lines {
+		rb.sendLabeled(line.tags, line.prefix, line.command, line.params...)
+	}
+}
+
+// Finish sends the replies to the labeled command that was just handled. A command with no
+// replies gets an ACK, and several replies are sent in a batch to clients that support them.
+// Otherwise, every reply gets the label.
+func (rb *ResponseBuffer) Finish() {
+	if rb.finished {
+		return
+	}
+	rb.finished = true
+	if rb.Label == "" {
+		return
+	}
+
+	if rb.flushed {
+		if rb.batch != nil {
+			rb.batch.End()
+		}
+		return
+	}
+
+	if len(rb.lines) == 0 {
+		rb.target.Send(ircmsg.MakeTags("label", rb.Label), rb.target.server.name, "ACK")
+		return
+	}
+
+	if len(rb.lines) == 1 || !rb.target.hasCapability(Batch) {
+		for _, line := range rb.lines {
+			rb.target.Send(tagsWith(line.tags, "label", rb.Label), line.prefix, line.command, line.params...)
+		}
+	} else {
+		batch := rb.target.StartBatch(ircmsg.MakeTags("label", rb.Label), BatchLabeledResponse)
+		for _, line := range rb.lines {
+			batch.Send(line.tags, line.prefix, line.command, line.params...)
+		}
+		batch.End()
+	}
+	rb.lines = nil
+}
+
+// Notice sends the client a notice from the server.
+func (rb *ResponseBuffer) Notice(text string) {
+	for _, line := range rb.target.noticeLines(text) {
+		rb.Send(nil, rb.target.server.name, "NOTICE", rb.target.nick, line)
+	}
+}
+
+// NickServNotice sends the client a notice from NickServ.
+func (rb *ResponseBuffer) NickServNotice(text string) {
+	rb.Send(nil, fmt.Sprintf("%s!services@%s", rb.target.server.nickserv.Nick, rb.target.server.name), "NOTICE", rb.target.nick, text)
+}
+
+// ChanServNotice sends the client a notice from ChanServ.
+func (rb *ResponseBuffer) ChanServNotice(text string) {
+	rb.Send(nil, fmt.Sprintf("ChanServ!services@%s", rb.target.server.name), "NOTICE", rb.target.nick, text)
+}
+
+// HostServNotice sends the client a notice from HostServ.
+func (rb *ResponseBuffer) HostServNotice(text string) {
+	rb.Send(nil, fmt.Sprintf("HostServ!services@%s", rb.target.server.name), "NOTICE", rb.target.nick, text)
+}
+
+// SendFromClient sends a line from the given client, like the client's own echoed message.
+func (rb *ResponseBuffer) SendFromClient(msgid string, from *Client, tags *map[string]ircmsg.TagValue, command string, params ...string) error {
+	return rb.Send(rb.target.fromClientTags(msgid, from, tags), from.nickMaskString, command, params...)
+}
+
+// SendSplitMsgFromClient sends a message that's been split for clients without maxline.
+func (rb *ResponseBuffer) SendSplitMsgFromClient(msgid string, from *Client, tags *map[string]ircmsg.TagValue, command, target string, message SplitMessage) {
+	rb.SendSplitMsg(rb.target.fromClientTags(msgid, from, tags), from.nickMaskString, command, target, message)
+}
+
+// SendSplitMsg sends a split message with the given prefix, like RELAYMSG's relayed nicks.
+func (rb *ResponseBuffer) SendSplitMsg(tags *map[string]ircmsg.TagValue, prefix, command, target string, message SplitMessage) {
+	if rb.target.hasCapability(MaxLine) {
+		rb.Send(tags, prefix, command, target, message.ForMaxLine)
+		return
+	}
+
+	if message.Truncated && rb.target.hasCapability(MessageTags) {
+		newTags := ircmsg.MakeTags(truncatedTag, nil)
+		if tags != nil {
+			for name, value := range *tags {
+				(*newTags)[name] = value
+			}
+		}
+		tags = newTags
+	}
+	for _, str := range message.For512 {
+		rb.Send(tags, prefix, command, target, str)
+	}
+}
@@ -7,8 +7,10 @@ package irc
 
 import (
 	"encoding/json"
+	"net"
 	"net/http"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"fmt"
@@ -31,9 +33,12 @@ type restInfoResp struct {
 }
 
 type restStatusResp struct {
-	Clients  int `json:"clients"`
-	Opers    int `json:"opers"`
-	Channels int `json:"channels"`
+	Clients           int    `json:"clients"`
+	Opers             int    `json:"opers"`
+	Channels          int    `json:"channels"`
+	MaxClients        int    `json:"max-clients"`
+	RemainingCapacity int    `json:"remaining-capacity"`
+	ClientCrashes     uint64 `json:"client-crashes"`
 }
 
 type restXLinesResp struct {
@@ -51,9 +56,42 @@ type restAccountsResp struct {
 	Verified map[string]restAcct `json:"verified"`
 }
 
+type restPrecheckResp struct {
+	Allowed       bool       `json:"allowed"`
+	Reason        string     `json:"reason,omitempty"`
+	Message       string     `json:"message,omitempty"`
+	Expires       *time.Time `json:"expires,omitempty"`
+	AccountExists bool       `json:"account-exists"`
+}
+
+type restLinkTokenResp struct {
+	Token string `json:"token,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type restProvisionResp struct {
+	Accounts []ProvisionResult `json:"accounts,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+type restInviteResp struct {
+	Valid   bool       `json:"valid"`
+	Channel string     `json:"channel,omitempty"`
+	Topic   string     `json:"topic,omitempty"`
+	Members int        `json:"members,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+	// UsesLeft is how many more times the token can be used, or -1 for unlimited.
+	UsesLeft int `json:"uses-left,omitempty"`
+}
+
+type restFeaturesResp struct {
+	Features []Feature `json:"features"`
+}
+
 type restRehashResp struct {
 	Successful bool      `json:"successful"`
 	Error      string    `json:"error"`
+	Warnings   []string  `json:"warnings,omitempty"`
 	Time       time.Time `json:"time"`
 }
 
@@ -72,10 +110,28 @@ func restInfo(w http.ResponseWriter, r *http.Request) {
 }
 
 func restStatus(w http.ResponseWriter, r *http.Request) {
+	clientCount := restAPIServer.clients.Count()
+	restAPIServer.maxClientsMutex.Lock()
 	rs := restStatusResp{
-		Clients:  restAPIServer.clients.Count(),
-		Opers:    len(restAPIServer.operators),
-		Channels: restAPIServer.channels.Len(),
+		Clients:           clientCount,
+		Opers:             len(restAPIServer.operators),
+		Channels:          restAPIServer.channels.Len(),
+		MaxClients:        restAPIServer.maxClients.Limit(),
+		RemainingCapacity: restAPIServer.maxClients.Remaining(clientCount),
+		ClientCrashes:     atomic.LoadUint64(&restAPIServer.clientPanics),
+	}
+	restAPIServer.maxClientsMutex.Unlock()
+	b, err := json.Marshal(rs)
+	if err != nil {
+		fmt.Fprintln(w, restErr)
+	} else {
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func restFeatures(w http.ResponseWriter, r *http.Request) {
+	rs := restFeaturesResp{
+		Features: restAPIServer.Features(),
 	}
 	b, err := json.Marshal(rs)
 	if err != nil {
@@ -120,7 +176,7 @@ func restGetAccounts(w http.ResponseWriter, r *http.Request) {
 			var clients int
 			acct := restAPIServer.accounts[key]
 			if acct != nil {
-				clients = len(acct.Clients)
+				clients = len(acct.getClients())
 			}
 
 			if verified {
@@ -147,6 +203,223 @@ func restGetAccounts(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// restIsTrustedGateway returns true if the request comes from a trusted web gateway. If no
+// gateways are configured, nothing is trusted.
+func restIsTrustedGateway(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr := net.ParseIP(host)
+	if addr == nil {
+		return false
+	}
+
+	for _, gateway := range restAPIServer.restAPI.TrustedGateways {
+		_, network, err := net.ParseCIDR(gateway)
+		if err == nil && network.Contains(addr) {
+			return true
+		} else if err != nil && net.ParseIP(gateway).Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// restPrecheck lets web gateways check whether a user would be able to connect before they
+// actually open a connection, so they can show friendlier errors. Takes the `ip` of the user,
+// and optionally the `nick` and `account` they'd connect with.
+func restPrecheck(w http.ResponseWriter, r *http.Request) {
+	if !restIsTrustedGateway(r) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "{\"error\":\"You are not a trusted gateway\"}")
+		return
+	}
+
+	query := r.URL.Query()
+	addr := net.ParseIP(query.Get("ip"))
+	if addr == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "{\"error\":\"Invalid IP address\"}")
+		return
+	}
+	server := restAPIServer
+
+	rs := restPrecheckResp{
+		Allowed: true,
+	}
+
+	accountName := query.Get("account")
+	if accountName != "" {
+		accountKey, err := CasefoldName(accountName)
+		if err == nil {
+			server.store.View(func(tx *buntdb.Tx) error {
+				_, err := tx.Get(fmt.Sprintf(keyAccountVerified, accountKey))
+				rs.AccountExists = err == nil
+				return nil
+			})
+		}
+	}
+
+	nick := query.Get("nick")
+	if nick == "" {
+		nick = "*"
+	}
+	nickmask, _ := Casefold(fmt.Sprintf("%s!*@%s", nick, addr.String()))
+
+	isBanned, info := server.dlines.CheckIP(addr)
+	if !isBanned {
+		isBanned, info = server.klines.CheckMasks(nickmask)
+	}
+
+	server.maxClientsMutex.Lock()
+	canRegister := server.maxClients.CanRegister(addr, server.clients.Count()+1, rs.AccountExists)
+	server.maxClientsMutex.Unlock()
+
+	server.connectionLimitsMutex.Lock()
+	underLimit := server.connectionLimits.WouldAllow(addr)
+	server.connectionLimitsMutex.Unlock()
+
+	server.connectionThrottleMutex.Lock()
+	underThrottle := server.connectionThrottle.WouldAllow(addr)
+	server.connectionThrottleMutex.Unlock()
+
+	if isBanned {
+		rs.Allowed = false
+		rs.Reason = "banned"
+		rs.Message = fmt.Sprintf("You are banned from this server (%s)", info.Reason)
+		if info.Time != nil {
+			rs.Expires = &info.Time.Expires
+		}
+	} else if !canRegister {
+		rs.Allowed = false
+		rs.Reason = "server-full"
+		rs.Message = "This server is full, please try again later"
+	} else if !underLimit {
+		rs.Allowed = false
+		rs.Reason = "too-many-connections"
+		rs.Message = "Too many clients from your network"
+	} else if !underThrottle {
+		rs.Allowed = false
+		rs.Reason = "throttled"
+		rs.Message = server.connectionThrottle.BanMessage
+	}
+
+	b, err := json.Marshal(rs)
+	if err != nil {
+		fmt.Fprintln(w, restErr)
+	} else {
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+// restLinkToken lets a trusted web service that has verified a user's external identity
+// (`service` and `handle`) create a token, which the user then gives to NickServ LINK to
+// link that identity to their IRC account.
+func restLinkToken(w http.ResponseWriter, r *http.Request) {
+	if !restIsTrustedGateway(r) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "{\"error\":\"You are not a trusted gateway\"}")
+		return
+	}
+
+	if restAPIServer.isReadOnly() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "{\"error\":\"The server is in read-only mode\"}")
+		return
+	}
+
+	var rs restLinkTokenResp
+	token, err := restAPIServer.createLinkToken(r.FormValue("service"), r.FormValue("handle"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		rs.Error = err.Error()
+	} else {
+		rs.Token = token
+	}
+
+	b, err := json.Marshal(rs)
+	if err != nil {
+		fmt.Fprintln(w, restErr)
+	} else {
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+// restProvision creates accounts in bulk for managed communities. The body is CSV with lines
+// that look like `account[,password]`, and passwords are generated for accounts without one.
+// The accounts are already verified, and their users must set a new password when they first
+// log in.
+func restProvision(w http.ResponseWriter, r *http.Request) {
+	if !restIsTrustedGateway(r) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "{\"error\":\"You are not a trusted gateway\"}")
+		return
+	}
+	if restAPIServer.isReadOnly() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "{\"error\":\"The server is in read-only mode\"}")
+		return
+	}
+
+	var rs restProvisionResp
+	records, err := ParseProvisionCSV(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		rs.Error = err.Error()
+	} else {
+		rs.Accounts = restAPIServer.provisionAccounts(records)
+	}
+
+	b, err := json.Marshal(rs)
+	if err != nil {
+		fmt.Fprintln(w, restErr)
+	} else {
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+// restInvite lets web gateways turn an invite link into a channel to join. The gateway can
+// show the channel to the user, then join it on their behalf with `JOIN <channel> <token>`.
+func restInvite(w http.ResponseWriter, r *http.Request) {
+	if !restIsTrustedGateway(r) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "{\"error\":\"You are not a trusted gateway\"}")
+		return
+	}
+
+	var rs restInviteResp
+	info := restAPIServer.inviteTokens.Get(mux.Vars(r)["token"])
+	var channel *Channel
+	if info != nil && info.usable(time.Now()) {
+		channel = restAPIServer.channels.Get(info.Channel)
+	}
+	if channel == nil {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		rs.Valid = true
+		rs.Channel = channel.name
+		channel.membersMutex.RLock()
+		rs.Topic = channel.topic
+		rs.Members = len(channel.members)
+		channel.membersMutex.RUnlock()
+		if !info.Expires.IsZero() {
+			rs.Expires = &info.Expires
+		}
+		rs.UsesLeft = -1
+		if 0 < info.MaxUses {
+			rs.UsesLeft = info.MaxUses - len(info.Uses)
+		}
+	}
+
+	b, err := json.Marshal(rs)
+	if err != nil {
+		fmt.Fprintln(w, restErr)
+	} else {
+		fmt.Fprintln(w, string(b))
+	}
+}
+
 func restRehash(w http.ResponseWriter, r *http.Request) {
 	err := restAPIServer.rehash()
 
@@ -156,6 +429,12 @@ func restRehash(w http.ResponseWriter, r *http.Request) {
 	}
 	if err != nil {
 		rs.Error = err.Error()
+	} else {
+		restAPIServer.rehashMutex.Lock()
+		for _, warning := range restAPIServer.configWarnings {
+			rs.Warnings = append(rs.Warnings, warning.String())
+		}
+		restAPIServer.rehashMutex.Unlock()
 	}
 
 	b, err := json.Marshal(rs)
@@ -166,6 +445,20 @@ func restRehash(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func restBandwidth(w http.ResponseWriter, r *http.Request) {
+	count := defaultBandwidthEntries
+	if requested, err := strconv.Atoi(r.FormValue("count")); err == nil && 0 < requested {
+		count = minInt(requested, maxBandwidthEntries)
+	}
+	rs := restAPIServer.bandwidthStats(count)
+	b, err := json.Marshal(rs)
+	if err != nil {
+		fmt.Fprintln(w, restErr)
+	} else {
+		fmt.Fprintln(w, string(b))
+	}
+}
+
 func (s *Server) startRestAPI() {
 	// so handlers can ref it later
 	restAPIServer = s
@@ -177,12 +470,23 @@ func (s *Server) startRestAPI() {
 	rg := r.Methods("GET").Subrouter()
 	rg.HandleFunc("/info", restInfo)
 	rg.HandleFunc("/status", restStatus)
+	rg.HandleFunc("/bandwidth", restBandwidth)
+	rg.HandleFunc("/features", restFeatures)
 	rg.HandleFunc("/xlines", restGetXLines)
 	rg.HandleFunc("/accounts", restGetAccounts)
+	rg.HandleFunc("/precheck", restPrecheck)
+	rg.HandleFunc("/invites/{token}", restInvite)
+	rg.HandleFunc("/user/history", restUserHistory)
+	rg.HandleFunc("/user/settings", restUserSettings)
 
 	// PUT methods
 	rp := r.Methods("POST").Subrouter()
 	rp.HandleFunc("/rehash", restRehash)
+	rp.HandleFunc("/links/token", restLinkToken)
+	rp.HandleFunc("/accounts/provision", restProvision)
+	rp.HandleFunc("/user/message", restUserMessage)
+	rp.HandleFunc("/user/settings", restUserSettings)
+	rp.HandleFunc("/gateway/message", restGatewayMessage)
 
 	// start api
 	go http.ListenAndServe(s.restAPI.Listen, r)
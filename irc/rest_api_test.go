@@ -0,0 +1,48 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRestIsTrustedGateway(t *testing.T) {
+	server := &Server{restAPI: &RestAPIConfig{}}
+	restAPIServer = server
+	defer func() { restAPIServer = nil }()
+
+	cases := []struct {
+		gateways   []string
+		remoteAddr string
+		trusted    bool
+	}{
+		// with no gateways configured, nothing is trusted
+		{nil, "127.0.0.1:1234", false},
+		{nil, "203.0.113.5:1234", false},
+		{[]string{"127.0.0.1/8", "::1/128"}, "127.0.0.1:1234", true},
+		{[]string{"127.0.0.1/8", "::1/128"}, "[::1]:1234", true},
+		{[]string{"127.0.0.1/8", "::1/128"}, "203.0.113.5:1234", false},
+		{[]string{"203.0.113.5"}, "203.0.113.5:1234", true},
+		{[]string{"203.0.113.5"}, "203.0.113.6:1234", false},
+	}
+	for _, c := range cases {
+		server.restAPI.TrustedGateways = c.gateways
+		r := httptest.NewRequest("GET", "/v1/precheck", nil)
+		r.RemoteAddr = c.remoteAddr
+		if trusted := restIsTrustedGateway(r); trusted != c.trusted {
+			t.Errorf("%s with gateways %v: expected trusted to be %v, got %v", c.remoteAddr, c.gateways, c.trusted, trusted)
+		}
+	}
+
+	// the endpoints behind the check refuse untrusted requests
+	server.restAPI.TrustedGateways = nil
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/v1/accounts/provision", nil)
+	restProvision(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected provisioning without trusted gateways to be forbidden, got %d", w.Code)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/oragono/oragono/irc/history"
+	"github.com/oragono/oragono/irc/sno"
+)
+
+// HistoryRetractionConfig controls removing the recent messages of users who are
+// disconnected for abuse from channel history.
+type HistoryRetractionConfig struct {
+	// OnKill retracts the messages of users who are killed.
+	OnKill bool `yaml:"on-kill"`
+	// OnBan retracts the messages of users who are disconnected by a K-Line or D-Line.
+	OnBan        bool          `yaml:"on-ban"`
+	WindowString string        `yaml:"window"`
+	Window       time.Duration `yaml:"window-real"`
+}
+
+// Enabled returns true if messages are ever retracted.
+func (config HistoryRetractionConfig) Enabled() bool {
+	return config.OnKill || config.OnBan
+}
+
+// retractRecentMessages removes the messages the client sent to channels recently from their
+// history, and tells members with draft/message-redaction to hide them.
+func (server *Server) retractRecentMessages(client *Client, reason string) {
+	if !server.historyEnabled {
+		return
+	}
+	nickmask := client.nickMaskString
+	since := time.Now().Add(-server.historyRetraction.Window)
+	match := func(item history.Item) bool {
+		return item.Nickmask == nickmask
+	}
+
+	server.channels.ChansLock.RLock()
+	var channels []*Channel
+	for _, channel := range server.channels.Chans {
+		channels = append(channels, channel)
+	}
+	server.channels.ChansLock.RUnlock()
+
+	var total int
+	for _, channel := range channels {
+		if channel.history == nil {
+			continue
+		}
+		retracted := channel.history.Retract(since, match)
+		if len(retracted) == 0 {
+			continue
+		}
+		total += len(retracted)
+
+		channel.membersMutex.RLock()
+		for member := range channel.members {
+			if !member.hasCapability(MessageRedaction) {
+				continue
+			}
+			for _, item := range retracted {
+				if item.Msgid != "" {
+					member.Send(nil, server.name, "REDACT", channel.name, item.Msgid, reason)
+				}
+			}
+		}
+		channel.membersMutex.RUnlock()
+	}
+
+	if 0 < total {
+		server.logger.Info("history", fmt.Sprintf("Retracted %d recent messages from %s (%s)", total, nickmask, reason))
+		server.snomasks.Send(sno.LocalKills, fmt.Sprintf(ircfmt.Unescape("Retracted $c[grey][$r%d$c[grey]] recent messages from $c[grey][$r%s$c[grey]]"), total, client.nick))
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 
 	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/history"
 )
 
 const (
@@ -15,37 +16,37 @@ const (
 )
 
 // SCENE <target> <text to be sent>
-func sceneHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func sceneHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	target := msg.Params[0]
 	message := msg.Params[1]
 	sourceString := fmt.Sprintf(sceneNickMask, client.nick)
 
-	sendRoleplayMessage(server, client, sourceString, target, false, message)
+	sendRoleplayMessage(server, client, sourceString, target, false, message, rb)
 
 	return false
 }
 
 // NPC <target> <sourcenick> <text to be sent>
-func npcHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func npcHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	target := msg.Params[0]
 	fakeSource := msg.Params[1]
 	message := msg.Params[2]
 
 	_, err := CasefoldName(fakeSource)
 	if err != nil {
-		client.Send(nil, client.server.name, ERR_CANNOTSENDRP, target, "Fake source must be a valid nickname")
+		rb.Send(nil, client.server.name, ERR_CANNOTSENDRP, target, "Fake source must be a valid nickname")
 		return false
 	}
 
 	sourceString := fmt.Sprintf(npcNickMask, fakeSource, client.nick)
 
-	sendRoleplayMessage(server, client, sourceString, target, false, message)
+	sendRoleplayMessage(server, client, sourceString, target, false, message, rb)
 
 	return false
 }
 
 // NPCA <target> <sourcenick> <text to be sent>
-func npcaHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func npcaHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	target := msg.Params[0]
 	fakeSource := msg.Params[1]
 	message := msg.Params[2]
@@ -53,16 +54,16 @@ func npcaHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 
 	_, err := CasefoldName(fakeSource)
 	if err != nil {
-		client.Send(nil, client.server.name, ERR_CANNOTSENDRP, target, "Fake source must be a valid nickname")
+		rb.Send(nil, client.server.name, ERR_CANNOTSENDRP, target, "Fake source must be a valid nickname")
 		return false
 	}
 
-	sendRoleplayMessage(server, client, sourceString, target, true, message)
+	sendRoleplayMessage(server, client, sourceString, target, true, message, rb)
 
 	return false
 }
 
-func sendRoleplayMessage(server *Server, client *Client, source string, targetString string, isAction bool, message string) {
+func sendRoleplayMessage(server *Server, client *Client, source string, targetString string, isAction bool, message string, rb *ResponseBuffer) {
 	if isAction {
 		message = fmt.Sprintf("\x01ACTION %s (%s)\x01", message, client.nick)
 	} else {
@@ -73,48 +74,65 @@ func sendRoleplayMessage(server *Server, client *Client, source string, targetSt
 	if cerr == nil {
 		channel := server.channels.Get(target)
 		if channel == nil {
-			client.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, targetString, "No such channel")
+			rb.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, targetString, "No such channel")
 			return
 		}
 
 		if !channel.CanSpeak(client) {
-			client.Send(nil, client.server.name, ERR_CANNOTSENDTOCHAN, channel.name, "Cannot send to channel")
+			rb.Send(nil, client.server.name, ERR_CANNOTSENDTOCHAN, channel.name, "Cannot send to channel")
 			return
 		}
 
 		if !channel.flags[ChanRoleplaying] {
-			client.Send(nil, client.server.name, ERR_CANNOTSENDRP, channel.name, "Channel doesn't have roleplaying mode available")
+			rb.Send(nil, client.server.name, ERR_CANNOTSENDRP, channel.name, "Channel doesn't have roleplaying mode available")
 			return
 		}
 
+		msgid := server.generateMessageID()
+		if channel.history != nil {
+			channel.history.Add(history.Item{
+				Type:     history.Privmsg,
+				Time:     messageTime(msgid),
+				Nickmask: source,
+				Message:  message,
+				Msgid:    msgid,
+			})
+		}
+
 		channel.membersMutex.RLock()
 		for member := range channel.members {
-			if member == client && !client.capabilities[EchoMessage] {
+			if member == client && !client.hasCapability(EchoMessage) {
 				continue
 			}
-			member.Send(nil, source, "PRIVMSG", channel.name, message)
+			// the sender's echo is a reply to their command
+			send := member.Send
+			if member == client {
+				send = rb.Send
+			}
+			send(member.withMessageID(nil, msgid), source, "PRIVMSG", channel.name, message)
 		}
 		channel.membersMutex.RUnlock()
 	} else {
 		target, err := CasefoldName(targetString)
 		user := server.clients.Get(target)
 		if err != nil || user == nil {
-			client.Send(nil, server.name, ERR_NOSUCHNICK, target, "No such nick")
+			rb.Send(nil, server.name, ERR_NOSUCHNICK, target, "No such nick")
 			return
 		}
 
-		if !user.flags[UserRoleplaying] {
-			client.Send(nil, client.server.name, ERR_CANNOTSENDRP, user.nick, "User doesn't have roleplaying mode enabled")
+		if !user.hasFlag(UserRoleplaying) {
+			rb.Send(nil, client.server.name, ERR_CANNOTSENDRP, user.nick, "User doesn't have roleplaying mode enabled")
 			return
 		}
 
-		user.Send(nil, source, "PRIVMSG", user.nick, message)
-		if client.capabilities[EchoMessage] {
-			client.Send(nil, source, "PRIVMSG", user.nick, message)
+		msgid := server.generateMessageID()
+		user.Send(user.withMessageID(nil, msgid), source, "PRIVMSG", user.nick, message)
+		if client.hasCapability(EchoMessage) {
+			rb.Send(client.withMessageID(nil, msgid), source, "PRIVMSG", user.nick, message)
 		}
-		if user.flags[Away] {
+		if user.hasFlag(Away) {
 			//TODO(dan): possibly implement cooldown of away notifications to users
-			client.Send(nil, server.name, RPL_AWAY, user.nick, user.awayMessage)
+			rb.Send(nil, server.name, RPL_AWAY, user.nick, user.awayMessage)
 		}
 	}
 }
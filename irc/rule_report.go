@@ -0,0 +1,67 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmatch"
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+// countKLineMatches returns how many of the connected clients the given K-Line mask matches.
+func (server *Server) countKLineMatches(matcher ircmatch.Matcher) (count int) {
+	server.clients.ByNickMutex.RLock()
+	defer server.clients.ByNickMutex.RUnlock()
+
+	for _, mcl := range server.clients.ByNick {
+		for _, clientMask := range mcl.AllNickmasks() {
+			if matcher.Match(clientMask) {
+				count++
+				break
+			}
+		}
+	}
+	return count
+}
+
+// RULEREPORT
+func ruleReportHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	klines := server.klines.Observed()
+	if 0 < len(klines) {
+		rb.Notice("Observed K-Lines:")
+	}
+	for _, kline := range klines {
+		rb.Notice(fmt.Sprintf("%s: matched %d clients since %s, and would ban %d connected clients now (%s)", kline.Mask, atomic.LoadUint64(&kline.Matches), kline.Since.UTC().Format(time.RFC1123), server.countKLineMatches(kline.Matcher), kline.Info.OperReason))
+	}
+
+	var filterLines []string
+	server.channels.ChansLock.RLock()
+	for _, channel := range server.channels.Chans {
+		channel.membersMutex.RLock()
+		for _, filter := range channel.wordFilters {
+			if filter.Action == WordFilterObserve {
+				filterLines = append(filterLines, fmt.Sprintf("%s %s: matched %d messages", channel.name, filter.Word, atomic.LoadUint64(filter.matches)))
+			}
+		}
+		channel.membersMutex.RUnlock()
+	}
+	server.channels.ChansLock.RUnlock()
+	sort.Strings(filterLines)
+
+	if 0 < len(filterLines) {
+		rb.Notice("Observed word filters:")
+	}
+	for _, line := range filterLines {
+		rb.Notice(line)
+	}
+
+	if len(klines) == 0 && len(filterLines) == 0 {
+		rb.Notice("There are no observed K-Lines or word filters")
+	}
+	return false
+}
@@ -0,0 +1,236 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/oragono/oragono/irc/sno"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// scheduleCheckInterval is how often we check whether a schedule has started or ended.
+	scheduleCheckInterval = 15 * time.Second
+
+	scheduleTimeFormat = "15:04"
+	scheduleDateFormat = "2006-01-02 15:04"
+)
+
+var (
+	errInvalidScheduleTime = errors.New("Times must look like 23:30")
+	errInvalidScheduleDate = errors.New("Dates must look like 2017-09-01 18:00")
+	errInvalidScheduleDay  = errors.New("Days must be mon, tue, wed, thu, fri, sat or sun")
+	errEmptySchedule       = errors.New("Schedule has no times or dates")
+
+	scheduleDays = map[string]time.Weekday{
+		"sun": time.Sunday,
+		"mon": time.Monday,
+		"tue": time.Tuesday,
+		"wed": time.Wednesday,
+		"thu": time.Thursday,
+		"fri": time.Friday,
+		"sat": time.Saturday,
+	}
+)
+
+// ScheduleConfig is a set of config overrides that are applied during certain times, like
+// tighter registration rules at night or a different MOTD during an event.
+type ScheduleConfig struct {
+	// Start and End are the times of day (in the server's local time) the schedule runs
+	// between. If End is before Start, the schedule runs overnight.
+	Start string
+	End   string
+	// Days are the days of the week the schedule runs on, defaulting to every day.
+	Days []string
+	// From and Until limit the schedule to a one-off period, like an event.
+	From  string
+	Until string
+	// Overrides holds the config sections that are replaced while the schedule is running.
+	Overrides map[interface{}]interface{}
+
+	startMinute int
+	endMinute   int
+	days        map[time.Weekday]bool
+	from        time.Time
+	until       time.Time
+}
+
+// parse checks the schedule and fills in its parsed times.
+func (sc *ScheduleConfig) parse() error {
+	if (sc.Start == "") != (sc.End == "") {
+		return errors.New("Schedules need both a start and an end time")
+	}
+	if sc.Start == "" && sc.From == "" && sc.Until == "" {
+		return errEmptySchedule
+	}
+
+	sc.startMinute, sc.endMinute = -1, -1
+	if sc.Start != "" {
+		start, err := time.Parse(scheduleTimeFormat, sc.Start)
+		if err != nil {
+			return errInvalidScheduleTime
+		}
+		end, err := time.Parse(scheduleTimeFormat, sc.End)
+		if err != nil {
+			return errInvalidScheduleTime
+		}
+		sc.startMinute = start.Hour()*60 + start.Minute()
+		sc.endMinute = end.Hour()*60 + end.Minute()
+		if sc.startMinute == sc.endMinute {
+			return errors.New("Schedule start and end times can't be the same")
+		}
+	}
+
+	sc.days = make(map[time.Weekday]bool)
+	for _, day := range sc.Days {
+		name := strings.ToLower(day)
+		if 3 < len(name) {
+			name = name[:3]
+		}
+		weekday, exists := scheduleDays[name]
+		if !exists {
+			return errInvalidScheduleDay
+		}
+		sc.days[weekday] = true
+	}
+
+	var err error
+	if sc.From != "" {
+		sc.from, err = time.ParseInLocation(scheduleDateFormat, sc.From, time.Local)
+		if err != nil {
+			return errInvalidScheduleDate
+		}
+	}
+	if sc.Until != "" {
+		sc.until, err = time.ParseInLocation(scheduleDateFormat, sc.Until, time.Local)
+		if err != nil {
+			return errInvalidScheduleDate
+		}
+	}
+	return nil
+}
+
+// IsActive returns true if the schedule is running at the given time.
+func (sc *ScheduleConfig) IsActive(now time.Time) bool {
+	now = now.In(time.Local)
+	if !sc.from.IsZero() && now.Before(sc.from) {
+		return false
+	}
+	if !sc.until.IsZero() && !now.Before(sc.until) {
+		return false
+	}
+
+	day := now.Weekday()
+	if 0 <= sc.startMinute {
+		minute := now.Hour()*60 + now.Minute()
+		if sc.startMinute < sc.endMinute {
+			if minute < sc.startMinute || sc.endMinute <= minute {
+				return false
+			}
+		} else if minute < sc.endMinute {
+			// the early morning part of an overnight schedule belongs to the day it started on
+			day = now.AddDate(0, 0, -1).Weekday()
+		} else if minute < sc.startMinute {
+			return false
+		}
+	}
+
+	return len(sc.days) == 0 || sc.days[day]
+}
+
+// activeSchedules returns the names of the schedules running at the given time, sorted.
+func activeSchedules(schedules map[string]*ScheduleConfig, now time.Time) []string {
+	var names []string
+	for name, schedule := range schedules {
+		if schedule.IsActive(now) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mergeConfigSections replaces the keys in base with the ones in overrides, merging
+// sections that exist in both.
+func mergeConfigSections(base, overrides map[interface{}]interface{}) {
+	for key, value := range overrides {
+		baseSection, baseIsSection := base[key].(map[interface{}]interface{})
+		section, isSection := value.(map[interface{}]interface{})
+		if baseIsSection && isSection {
+			mergeConfigSections(baseSection, section)
+		} else {
+			base[key] = value
+		}
+	}
+}
+
+// applySchedules parses the schedules in the given config file, and returns the config file
+// with the overrides of the schedules running at the given time applied.
+func applySchedules(data []byte, now time.Time) ([]byte, map[string]*ScheduleConfig, []string, error) {
+	var scheduled struct {
+		Schedules map[string]*ScheduleConfig
+	}
+	err := yaml.Unmarshal(data, &scheduled)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for name, schedule := range scheduled.Schedules {
+		err = schedule.parse()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("Could not parse schedule %s: %s", name, err.Error())
+		}
+	}
+
+	active := activeSchedules(scheduled.Schedules, now)
+	if len(active) == 0 {
+		return data, scheduled.Schedules, nil, nil
+	}
+
+	var raw map[interface{}]interface{}
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// schedules are applied in name order, so later ones win
+	for _, name := range active {
+		mergeConfigSections(raw, scheduled.Schedules[name].Overrides)
+	}
+	data, err = yaml.Marshal(raw)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return data, scheduled.Schedules, active, nil
+}
+
+// checkSchedules rehashes the server if a schedule has started or ended since the
+// config was last loaded.
+func (server *Server) checkSchedules() {
+	if len(server.schedules) == 0 {
+		return
+	}
+	active := activeSchedules(server.schedules, time.Now())
+	if strings.Join(active, " ") == strings.Join(server.activeSchedules, " ") {
+		return
+	}
+
+	server.logger.Info("rehash", fmt.Sprintf("Rehashing because the running schedules changed from [%s] to [%s]", strings.Join(server.activeSchedules, ", "), strings.Join(active, ", ")))
+	err := server.rehash()
+	if err != nil {
+		server.logger.Error("rehash", fmt.Sprintln("Failed to rehash:", err.Error()))
+		// don't keep trying every few seconds, wait for the next change
+		server.activeSchedules = active
+		return
+	}
+	running := strings.Join(server.activeSchedules, ", ")
+	if running == "" {
+		running = "none"
+	}
+	server.snomasks.Send(sno.LocalOpers, fmt.Sprintf(ircfmt.Unescape("Config reloaded, running schedules are now $c[grey][$r%s$c[grey]]"), running))
+}
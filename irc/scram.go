@@ -0,0 +1,274 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/buntdb"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// scramIterations is the PBKDF2 iteration count for new SCRAM credentials, the minimum
+	// that RFC 7677 recommends.
+	scramIterations = 4096
+	scramSaltLen    = 16
+	scramNonceLen   = 18
+)
+
+var (
+	errScramMalformed      = errors.New("Malformed SCRAM message")
+	errScramChannelBinding = errors.New("Channel binding isn't supported")
+)
+
+// ScramCredentials is the SCRAM-SHA-256 verifier for an account's password. It lets clients
+// prove they know the password without ever sending it to us.
+type ScramCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewScramCredentials returns the SCRAM-SHA-256 verifier for the given password.
+func NewScramCredentials(password string) (*ScramCredentials, error) {
+	salt := make([]byte, scramSaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	saltedPassword := pbkdf2.Key([]byte(password), salt, scramIterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return &ScramCredentials{
+		Salt:       salt,
+		Iterations: scramIterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHMAC(saltedPassword, "Server Key"),
+	}, nil
+}
+
+// scramHMAC returns the HMAC-SHA-256 of the given message.
+func scramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// setPassphrase sets the account's passphrase hash and SCRAM credentials from the given
+// password.
+func (creds *AccountCredentials) setPassphrase(passwords *PasswordManager, password string) (err error) {
+	creds.PassphraseSalt, err = NewSalt()
+	if err != nil {
+		return err
+	}
+	creds.PassphraseHash, err = passwords.GenerateFromPassword(creds.PassphraseSalt, password)
+	if err != nil {
+		return err
+	}
+	creds.LegacyHash = ""
+	creds.SCRAMSHA256, err = NewScramCredentials(password)
+	return err
+}
+
+// scramSession holds the state of a client's SCRAM exchange between AUTHENTICATE lines.
+type scramSession struct {
+	accountKey      string
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	creds           *ScramCredentials
+	// verified is true once we've sent the server signature, and are waiting for the client
+	// to accept it.
+	verified bool
+}
+
+// scramAttributes splits a SCRAM message into its attributes.
+func scramAttributes(message string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(message, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			return nil, errScramMalformed
+		}
+		attrs[attr[:1]] = attr[2:]
+	}
+	return attrs, nil
+}
+
+// scramUnescapeName decodes the escaped commas and equals signs in a SCRAM username.
+func scramUnescapeName(name string) string {
+	return strings.Replace(strings.Replace(name, "=2C", ",", -1), "=3D", "=", -1)
+}
+
+// scramClientFirst handles the client-first-message, returning the server-first-message.
+func (server *Server) scramClientFirst(client *Client, message string) (string, error) {
+	// gs2-header is the channel binding flag and authzid, then the rest is the bare message
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 {
+		return "", errScramMalformed
+	}
+	switch {
+	case parts[0] == "n" || parts[0] == "y":
+	case strings.HasPrefix(parts[0], "p="):
+		return "", errScramChannelBinding
+	default:
+		return "", errScramMalformed
+	}
+	var authzid string
+	if parts[1] != "" {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return "", errScramMalformed
+		}
+		authzid = scramUnescapeName(parts[1][2:])
+	}
+
+	attrs, err := scramAttributes(parts[2])
+	if err != nil {
+		return "", err
+	}
+	if _, mandatoryExtension := attrs["m"]; mandatoryExtension || attrs["n"] == "" || attrs["r"] == "" {
+		return "", errScramMalformed
+	}
+	accountKey, err := CasefoldName(scramUnescapeName(attrs["n"]))
+	if err != nil {
+		return "", errSaslFail
+	}
+	if authzid != "" {
+		authzKey, err := CasefoldName(authzid)
+		if err != nil || authzKey != accountKey {
+			return "", errSaslFail
+		}
+	}
+
+	// accounts that only have a password in the LDAP directory, or that haven't logged in
+	// with PLAIN since SCRAM was supported, have no verifier. they fail the same way unknown
+	// accounts do so accounts can't be found this way, and clients fall back to PLAIN.
+	var creds *AccountCredentials
+	err = server.store.View(func(tx *buntdb.Tx) error {
+		// grouped nicknames log into their account
+		accountKey = nickAccount(tx, accountKey)
+
+		_, err := tx.Get(fmt.Sprintf(keyAccountVerified, accountKey))
+		if err != nil || loadAccountSuspension(tx, accountKey) != nil {
+			return errSaslFail
+		}
+		creds, err = loadAccountCredentials(tx, accountKey)
+		return err
+	})
+	if err != nil || creds.SCRAMSHA256 == nil {
+		return "", errSaslFail
+	}
+
+	nonceBytes := make([]byte, scramNonceLen)
+	_, err = rand.Read(nonceBytes)
+	if err != nil {
+		return "", err
+	}
+	session := &scramSession{
+		accountKey:      accountKey,
+		gs2Header:       parts[0] + "," + parts[1] + ",",
+		clientFirstBare: parts[2],
+		nonce:           attrs["r"] + base64.StdEncoding.EncodeToString(nonceBytes),
+		creds:           creds.SCRAMSHA256,
+	}
+	session.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", session.nonce, base64.StdEncoding.EncodeToString(session.creds.Salt), session.creds.Iterations)
+	client.scramSession = session
+	return session.serverFirst, nil
+}
+
+// scramClientFinal checks the client's proof in the client-final-message, returning the
+// server-final-message.
+func (session *scramSession) scramClientFinal(message string) (string, error) {
+	proofIndex := strings.LastIndex(message, ",p=")
+	if proofIndex == -1 {
+		return "", errScramMalformed
+	}
+	withoutProof := message[:proofIndex]
+	proof, err := base64.StdEncoding.DecodeString(message[proofIndex+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return "", errScramMalformed
+	}
+	attrs, err := scramAttributes(withoutProof)
+	if err != nil {
+		return "", err
+	}
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(session.gs2Header)) || attrs["r"] != session.nonce {
+		return "", errSaslFail
+	}
+
+	authMessage := session.clientFirstBare + "," + session.serverFirst + "," + withoutProof
+	clientSignature := scramHMAC(session.creds.StoredKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if !hmac.Equal(storedKey[:], session.creds.StoredKey) {
+		return "", errSaslFail
+	}
+
+	session.verified = true
+	serverSignature := scramHMAC(session.creds.ServerKey, authMessage)
+	return "v=" + base64.StdEncoding.EncodeToString(serverSignature), nil
+}
+
+// authScramHandler parses the SASL SCRAM-SHA-256 mechanism, which takes a few round trips.
+func authScramHandler(server *Server, client *Client, mechanism string, value []byte, rb *ResponseBuffer) bool {
+	session := client.scramSession
+
+	// the client accepted our signature, so we're done
+	if session != nil && session.verified {
+		client.scramSession = nil
+		if len(value) != 0 {
+			rb.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed")
+			return false
+		}
+		err := server.store.Update(func(tx *buntdb.Tx) error {
+			// they could have been suspended during the exchange
+			if loadAccountSuspension(tx, session.accountKey) != nil {
+				return errAccountSuspended
+			}
+			account, exists := server.getAccount(session.accountKey)
+			if !exists {
+				account = loadAccount(server, tx, session.accountKey)
+			}
+			client.LoginToAccount(account)
+			return nil
+		})
+		if err != nil {
+			rb.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed")
+			return false
+		}
+		client.successfulSaslAuth(rb)
+		return false
+	}
+
+	var response string
+	var err error
+	if session == nil {
+		response, err = server.scramClientFirst(client, string(value))
+	} else {
+		response, err = session.scramClientFinal(string(value))
+	}
+	if err != nil {
+		client.scramSession = nil
+		if err == errSaslFail {
+			rb.Send(nil, server.name, ERR_SASLFAIL, client.nick, "SASL authentication failed")
+		} else {
+			rb.Send(nil, server.name, ERR_SASLFAIL, client.nick, fmt.Sprintf("SASL authentication failed: %s", err.Error()))
+		}
+		return false
+	}
+	rb.Send(nil, server.name, "AUTHENTICATE", base64.StdEncoding.EncodeToString([]byte(response)))
+	return false
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/buntdb"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// scramClientFinalMessage returns the client-final-message a client with the given password
+// would send in reply to the server-first-message, and the server signature it expects back.
+func scramClientFinalMessage(password, gs2Header, clientFirstBare, serverFirst string) (string, string) {
+	attrs, _ := scramAttributes(serverFirst)
+	salt, _ := base64.StdEncoding.DecodeString(attrs["s"])
+	iterations, _ := strconv.Atoi(attrs["i"])
+
+	saltedPassword := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(gs2Header)) + ",r=" + attrs["r"]
+	authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+	clientSignature := scramHMAC(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	serverSignature := scramHMAC(scramHMAC(saltedPassword, "Server Key"), authMessage)
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), "v=" + base64.StdEncoding.EncodeToString(serverSignature)
+}
+
+// the example exchange from RFC 7677
+func TestScramRFC7677(t *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	saltedPassword := pbkdf2.Key([]byte("pencil"), salt, 4096, sha256.Size, sha256.New)
+	storedKey := sha256.Sum256(scramHMAC(saltedPassword, "Client Key"))
+	session := &scramSession{
+		gs2Header:       "n,,",
+		clientFirstBare: "n=user,r=rOprNGfwEbeRWgbNEkqO",
+		serverFirst:     "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		nonce:           "rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0",
+		creds: &ScramCredentials{
+			Salt:       salt,
+			Iterations: 4096,
+			StoredKey:  storedKey[:],
+			ServerKey:  scramHMAC(saltedPassword, "Server Key"),
+		},
+	}
+	serverFinal, err := session.scramClientFinal("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverFinal != "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=" || !session.verified {
+		t.Errorf("unexpected server-final-message %q", serverFinal)
+	}
+}
+
+func TestScramExchange(t *testing.T) {
+	server := newAccountsTestServer(t)
+	scramCreds, err := NewScramCredentials("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.store.Update(func(tx *buntdb.Tx) error {
+		createVerifiedAccount(tx, "alice", "Alice", &AccountCredentials{SCRAMSHA256: scramCreds})
+		tx.Set(fmt.Sprintf(keyGroupedNick, "alice_"), "alice", nil)
+		return createVerifiedAccount(tx, "bob", "Bob", &AccountCredentials{})
+	})
+
+	for _, c := range []struct {
+		name        string
+		password    string
+		clientFirst string
+		firstErr    error
+		finalErr    error
+	}{
+		{"success", "hunter2", "n,,n=alice,r=abcdef", nil, nil},
+		{"authzid", "hunter2", "n,a=ALICE,n=alice,r=abcdef", nil, nil},
+		{"wrong password", "hunter3", "n,,n=alice,r=abcdef", nil, errSaslFail},
+		{"other authzid", "hunter2", "n,a=bob,n=alice,r=abcdef", errSaslFail, nil},
+		{"channel binding", "hunter2", "p=tls-unique,,n=alice,r=abcdef", errScramChannelBinding, nil},
+		{"mandatory extension", "hunter2", "n,,m=ext,n=alice,r=abcdef", errScramMalformed, nil},
+		{"no nonce", "hunter2", "n,,n=alice", errScramMalformed, nil},
+		{"unknown account", "hunter2", "n,,n=carol,r=abcdef", errSaslFail, nil},
+		{"grouped nick", "hunter2", "n,,n=alice_,r=abcdef", nil, nil},
+		{"no credentials", "hunter2", "n,,n=bob,r=abcdef", errSaslFail, nil},
+	} {
+		client := &Client{}
+		serverFirst, err := server.scramClientFirst(client, c.clientFirst)
+		if err != c.firstErr {
+			t.Errorf("%s: expected %v from the client-first-message, got %v", c.name, c.firstErr, err)
+			continue
+		} else if err != nil {
+			continue
+		}
+		session := client.scramSession
+		if session == nil || !strings.HasPrefix(serverFirst, "r=abcdef") {
+			t.Errorf("%s: expected a session with the client's nonce, got %q", c.name, serverFirst)
+			continue
+		}
+
+		parts := strings.SplitN(c.clientFirst, ",", 3)
+		clientFinal, expected := scramClientFinalMessage(c.password, parts[0]+","+parts[1]+",", parts[2], serverFirst)
+		serverFinal, err := session.scramClientFinal(clientFinal)
+		if err != c.finalErr {
+			t.Errorf("%s: expected %v from the client-final-message, got %v", c.name, c.finalErr, err)
+		} else if err == nil && (serverFinal != expected || !session.verified) {
+			t.Errorf("%s: expected server signature %q, got %q", c.name, expected, serverFinal)
+		}
+	}
+
+	// a replayed or altered nonce is refused
+	client := &Client{}
+	serverFirst, err := server.scramClientFirst(client, "n,,n=alice,r=abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientFinal, _ := scramClientFinalMessage("hunter2", "n,,", "n=alice,r=abcdef", strings.Replace(serverFirst, "r=abcdef", "r=abcdeg", 1))
+	if _, err := client.scramSession.scramClientFinal(clientFinal); err != errSaslFail {
+		t.Errorf("expected an altered nonce to fail, got %v", err)
+	}
+}
+
+// a password reset has to stop the old password working with SCRAM as well as PLAIN
+func TestScramAfterPasswordReset(t *testing.T) {
+	server := newAccountsTestServer(t)
+	salt, err := NewSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwords := NewPasswordManager(salt)
+	server.passwords = &passwords
+
+	var creds AccountCredentials
+	err = creds.setPassphrase(server.passwords, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds.Certificate = "abcd"
+	server.store.Update(func(tx *buntdb.Tx) error {
+		return createVerifiedAccount(tx, "alice", "Alice", &creds)
+	})
+
+	newPassword, err := server.resetAccountPassword("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		password string
+		err      error
+	}{
+		{"hunter2", errSaslFail},
+		{newPassword, nil},
+	} {
+		client := &Client{}
+		serverFirst, err := server.scramClientFirst(client, "n,,n=alice,r=abcdef")
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientFinal, _ := scramClientFinalMessage(c.password, "n,,", "n=alice,r=abcdef", serverFirst)
+		if _, err := client.scramSession.scramClientFinal(clientFinal); err != c.err {
+			t.Errorf("%q: expected %v after the reset, got %v", c.password, c.err, err)
+		}
+	}
+
+	server.store.View(func(tx *buntdb.Tx) error {
+		newCreds, err := loadAccountCredentials(tx, "alice")
+		if err != nil || newCreds.Certificate != "abcd" {
+			t.Errorf("expected the certfp to survive the reset, got %+v", newCreds)
+		}
+		return nil
+	})
+}
@@ -8,11 +8,9 @@ package irc
 import (
 	"bufio"
 	"crypto/tls"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
 	"net/http"
 	"os"
@@ -25,7 +23,9 @@ import (
 
 	"github.com/goshuirc/irc-go/ircfmt"
 	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/history"
 	"github.com/oragono/oragono/irc/logger"
+	"github.com/oragono/oragono/irc/ratelimit"
 	"github.com/oragono/oragono/irc/sno"
 	"github.com/tidwall/buntdb"
 )
@@ -35,22 +35,33 @@ var (
 	tooManyClientsMsg      = ircmsg.MakeMessage(nil, "", "ERROR", "Too many clients from your network")
 	tooManyClientsBytes, _ = tooManyClientsMsg.Line()
 
+	serverFullMsg      = ircmsg.MakeMessage(nil, "", "ERROR", "This server is full, please try again later")
+	serverFullBytes, _ = serverFullMsg.Line()
+
 	bannedFromServerMsg      = ircmsg.MakeMessage(nil, "", "ERROR", "You are banned from this server (%s)")
 	bannedFromServerBytes, _ = bannedFromServerMsg.Line()
 
-	errDbOutOfDate = errors.New("Database schema is old")
+	errDbOutOfDate    = errors.New("Database schema is old")
+	errDatastoreInUse = errors.New("Datastore is in use by another process, stop the server first")
 )
 
 // Limits holds the maximum limits for various things such as topic lengths.
 type Limits struct {
-	AwayLen        int
-	ChannelLen     int
-	KickLen        int
-	MonitorEntries int
-	NickLen        int
-	TopicLen       int
-	ChanListModes  int
-	LineLen        LineLenLimits
+	AwayLen            int
+	ChannelLen         int
+	KickLen            int
+	MonitorEntries     int
+	NickLen            int
+	TopicLen           int
+	ChanListModes      int
+	LineLen            LineLenLimits
+	Multiline          MultilineConfig
+	WildcardWhoResults int
+	OperWhoResults     int
+	// Modes is how many mode changes with arguments go in one MODE line, or 0 for no limit.
+	Modes int
+	// TargMax is how many targets each command takes at once, or 0 for no limit.
+	TargMax map[string]int
 }
 
 // LineLenLimits holds the maximum limits for IRC lines.
@@ -63,6 +74,7 @@ type LineLenLimits struct {
 type ListenerInterface struct {
 	Listener net.Listener
 	Events   chan ListenerEvent
+	IsTLS    bool
 }
 
 const (
@@ -83,10 +95,23 @@ type ListenerEvent struct {
 
 // Server is the main Oragono server.
 type Server struct {
+	// fields accessed with sync/atomic come first, so they're 64-bit aligned on 32-bit platforms
+	clientPanics uint64 // number of client goroutines that have crashed
+	lineStats    LineStats
+	// bytes read from and sent to clients that have disconnected
+	closedBytesIn  uint64
+	closedBytesOut uint64
+
 	accountAuthenticationEnabled bool
 	accountRegistration          *AccountRegistration
 	accounts                     map[string]*ClientAccount
+	accountsMutex                sync.RWMutex
+	bots                         BotConfig
 	channelRegistrationEnabled   bool
+	channelRegistration          ChannelRegistrationConfig
+	channelsKickInsecure         bool
+	modeCoalescing               ModeCoalescingConfig
+	channelInvites               InvitesConfig
 	channels                     ChannelNameMap
 	channelJoinPartMutex         sync.Mutex // used when joining/parting channels to prevent stomping over each others' access and all
 	checkIdent                   bool
@@ -94,39 +119,106 @@ type Server struct {
 	commands                     chan Command
 	configFilename               string
 	connectionLimits             *ConnectionLimits
+	cloneDetector                *CloneDetector
+	cloneDetectorMutex           sync.Mutex
+	controlListener              net.Listener
+	controlListenerPath          string
+	controlSocket                ControlSocketConfig
+	connectionClasses            map[string]*ConnectionClass
 	connectionLimitsMutex        sync.Mutex // used when affecting the connection limiter, to make sure rehashing doesn't make things go out-of-whack
 	connectionThrottle           *ConnectionThrottle
 	connectionThrottleMutex      sync.Mutex // used when affecting the connection limiter, to make sure rehashing doesn't make things go out-of-whack
+	coldHistory                  *history.ColdStore
 	ctime                        time.Time
 	currentOpers                 map[*Client]bool
+	currentOpersMutex            sync.RWMutex // protects currentOpers, which the control socket reads
 	dlines                       *DLineManager
+	historyChannelLength         int
+	historyDirectMessages        HistoryDirectMessagesConfig
+	historyEnabled               bool
+	historyRetraction            HistoryRetractionConfig
+	inviteTokens                 *InviteTokenManager
 	isupport                     *ISupportList
 	klines                       *KLineManager
 	limits                       Limits
+	linePolicy                   *LinePolicy
+	listenerConfigs              map[string]*ListenerConfig
 	listenerEventActMutex        sync.Mutex
+	listenerConns                *ListenerConnections
 	listeners                    map[string]ListenerInterface
-	listenerUpdateMutex          sync.Mutex
+	listenerUpdateMutex          sync.Mutex // used when updating listeners and their configs
 	logger                       *logger.Manager
+	maxClients                   *MaxClients
+	maxClientsMutex              sync.Mutex // used when checking the client limit, so rehashing doesn't swap it out from under us
+	missedHighlights             MissedHighlightsConfig
 	MaxSendQBytes                uint64
 	monitoring                   map[string][]*Client
 	motdLines                    []string
 	name                         string
 	nameCasefolded               string
+	networkMap                   NetworkMapConfig
 	networkName                  string
+	networks                     map[string]*virtualNetwork // other networks that clients can reach using SNI, by hostname
+	networksMutex                sync.RWMutex
+	externalLinks                ExternalLinksConfig
+	ldap                         LDAPConfig
+	oauth2                       OAuth2Config
+	nickserv                     NickServConfig
+	nickEnforcement              NickEnforcementConfig
+	mailGateway                  MailGatewayConfig
+	mailListener                 net.Listener
+	mailto                       MailtoConfig
+	sms                          SMSConfig
+	captcha                      CaptchaConfig
+	captchaListener              net.Listener
+	passwordReset                PasswordResetConfig
+	accountExpiry                AccountExpiryConfig
+	accountExpiryMutex           sync.Mutex // protects accountExpiry and accountExpiryRunning
+	accountExpiryRunning         bool
+	nickCollision                NickCollisionConfig
+	quitMessages                 QuitMessagesConfig
+	structuredNotices            bool
 	newConns                     chan clientConn
+	priorityConns                chan clientConn
 	operators                    map[string]Oper
 	operclasses                  map[string]OperClass
+	pasteDetection               PasteDetectionConfig
 	password                     []byte
 	passwords                    *PasswordManager
+	rateLimits                   RateLimitsConfig
+	readOnly                     bool
+	readOnlyConfigured           bool // read-only setting in the config, so we can tell when it changes
+	readOnlyMutex                sync.RWMutex
+	readOnlyReason               string
 	registeredChannels           map[string]*RegisteredChannel
 	registeredChannelsMutex      sync.RWMutex
 	rehashMutex                  sync.Mutex
+	configWarnings               []ConfigWarning // from the last rehash
+	features                     []Feature
 	rehashSignal                 chan os.Signal
+	registrations                *ratelimit.Keyed
+	inviteLimits                 *ratelimit.Keyed
+	accountStatusLimits          *ratelimit.Keyed
+	apiMessageLimits             *ratelimit.Keyed
 	restAPI                      *RestAPIConfig
+	saslAttempts                 *ratelimit.Keyed
+	schedules                    map[string]*ScheduleConfig
+	activeSchedules              []string // names of the schedules that were running when the config was loaded
 	signals                      chan os.Signal
+	snapshots                    SnapshotConfig
+	snapshotMutex                sync.Mutex // protects the snapshot state below
+	snapshotRunning              bool
+	lastSnapshot                 time.Time
 	snomasks                     *SnoManager
 	store                        *buntdb.DB
+	storeLock                    *os.File // held while the datastore is open, so tools can tell it's in use
 	stsEnabled                   bool
+	stsPort                      int
+	typingPolicy                 *TypingPolicy
+	vhosts                       VHostConfig
+	webhooks                     WebhooksConfig
+	webhookQueue                 chan webhookDelivery
+	whoisChannels                string
 	whoWas                       *WhoWasList
 }
 
@@ -140,8 +232,9 @@ var (
 )
 
 type clientConn struct {
-	Conn  net.Conn
-	IsTLS bool
+	Conn   net.Conn
+	IsTLS  bool
+	Config *ListenerConfig
 }
 
 // NewServer returns a new Oragono server.
@@ -158,6 +251,10 @@ func NewServer(configFilename string, config *Config, logger *logger.Manager) (*
 			return nil, fmt.Errorf("Help entry does not exist for command %s", name)
 		}
 	}
+	for _, warning := range config.Warnings {
+		logger.Warning("config", warning.String())
+	}
+
 	// generate help indexes
 	HelpIndex = GenerateHelpIndex(false)
 	HelpIndexOpers = GenerateHelpIndex(true)
@@ -165,21 +262,35 @@ func NewServer(configFilename string, config *Config, logger *logger.Manager) (*
 	if config.Accounts.AuthenticationEnabled {
 		SupportedCapabilities[SASL] = true
 	}
+	CapValues[SASL] = saslMechanisms(config)
 
 	if config.Server.STS.Enabled {
 		SupportedCapabilities[STS] = true
 		CapValues[STS] = config.Server.STS.Value()
 	}
 
+	if config.History.Enabled && config.History.Retraction.Enabled() {
+		SupportedCapabilities[MessageRedaction] = true
+	}
+
 	if config.Limits.LineLen.Tags > 512 || config.Limits.LineLen.Rest > 512 {
 		SupportedCapabilities[MaxLine] = true
 		CapValues[MaxLine] = fmt.Sprintf("%d,%d", config.Limits.LineLen.Tags, config.Limits.LineLen.Rest)
 	}
 
+	if config.Limits.Multiline.Enabled() {
+		SupportedCapabilities[Multiline] = true
+		CapValues[Multiline] = config.Limits.Multiline.Value()
+	}
+
 	operClasses, err := config.OperatorClasses()
 	if err != nil {
 		return nil, fmt.Errorf("Error loading oper classes: %s", err.Error())
 	}
+	connectionClasses, err := config.ConnectionClasses()
+	if err != nil {
+		return nil, fmt.Errorf("Error loading connection classes: %s", err.Error())
+	}
 	opers, err := config.Operators(operClasses)
 	if err != nil {
 		return nil, fmt.Errorf("Error loading operators: %s", err.Error())
@@ -189,24 +300,46 @@ func NewServer(configFilename string, config *Config, logger *logger.Manager) (*
 	if err != nil {
 		return nil, fmt.Errorf("Error loading connection limits: %s", err.Error())
 	}
+	cloneDetector, err := NewCloneDetector(config.Server.CloneDetection)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading clone detection: %s", err.Error())
+	}
 	connectionThrottle, err := NewConnectionThrottle(config.Server.ConnectionThrottle)
 	if err != nil {
 		return nil, fmt.Errorf("Error loading connection throttler: %s", err.Error())
 	}
+	maxClients, err := NewMaxClients(config.Server.MaxClients)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading client limits: %s", err.Error())
+	}
 
 	server := &Server{
 		accountAuthenticationEnabled: config.Accounts.AuthenticationEnabled,
 		accounts:                     make(map[string]*ClientAccount),
+		bots:                         config.Accounts.Bots,
 		channelRegistrationEnabled:   config.Channels.Registration.Enabled,
+		channelRegistration:          config.Channels.Registration,
+		channelsKickInsecure:         config.Channels.KickInsecureMembers,
+		modeCoalescing:               config.Channels.ModeCoalescing,
+		channelInvites:               config.Channels.Invites,
 		channels:                     *NewChannelNameMap(),
 		checkIdent:                   config.Server.CheckIdent,
 		clients:                      NewClientLookupSet(),
 		commands:                     make(chan Command),
 		configFilename:               configFilename,
+		connectionClasses:            connectionClasses,
 		connectionLimits:             connectionLimits,
+		cloneDetector:                cloneDetector,
 		connectionThrottle:           connectionThrottle,
+		controlSocket:                config.Server.ControlSocket,
+		mailGateway:                  config.Server.MailGateway,
 		ctime:                        time.Now(),
 		currentOpers:                 make(map[*Client]bool),
+		historyChannelLength:         config.History.ChannelLength,
+		historyDirectMessages:        config.History.DirectMessages,
+		historyEnabled:               config.History.Enabled,
+		historyRetraction:            config.History.Retraction,
+		inviteTokens:                 NewInviteTokenManager(),
 		limits: Limits{
 			AwayLen:        int(config.Limits.AwayLen),
 			ChannelLen:     int(config.Limits.ChannelLen),
@@ -219,28 +352,72 @@ func NewServer(configFilename string, config *Config, logger *logger.Manager) (*
 				Tags: config.Limits.LineLen.Tags,
 				Rest: config.Limits.LineLen.Rest,
 			},
+			Multiline:          config.Limits.Multiline,
+			WildcardWhoResults: int(config.Limits.WildcardWhoResults),
+			OperWhoResults:     int(config.Limits.OperWhoResults),
+			Modes:              int(config.Limits.Modes),
+			TargMax:            config.Limits.TargMaxReal,
 		},
+		linePolicy:         NewLinePolicy(config.Server.LineParsing, config.Server.UTF8Only),
+		listenerConfigs:    config.ListenerConfigs(),
+		listenerConns:      NewListenerConnections(),
 		listeners:          make(map[string]ListenerInterface),
 		logger:             logger,
+		maxClients:         maxClients,
+		missedHighlights:   config.Accounts.MissedHighlights,
 		MaxSendQBytes:      config.Server.MaxSendQBytes,
 		monitoring:         make(map[string][]*Client),
 		name:               config.Server.Name,
 		nameCasefolded:     casefoldedName,
+		nickCollision:      config.Server.NickCollision,
+		quitMessages:       config.Server.QuitMessages,
+		structuredNotices:  config.Server.StructuredNotices,
+		networkMap:         config.Server.NetworkMap,
+		externalLinks:      config.Accounts.ExternalLinks,
+		ldap:               config.Accounts.LDAP,
+		oauth2:             config.Accounts.OAuth2,
+		nickserv:           config.Accounts.NickServ,
+		nickEnforcement:    config.Accounts.NickEnforcement,
+		mailto:             config.Accounts.Registration.Callbacks.Mailto,
+		features:           config.Features,
+		sms:                config.Accounts.Registration.Callbacks.SMS,
+		captcha:            config.Accounts.Registration.Callbacks.Captcha,
+		passwordReset:      config.Accounts.PasswordReset,
+		accountExpiry:      config.Accounts.Expiry,
 		networkName:        config.Network.Name,
+		networks:           make(map[string]*virtualNetwork),
 		newConns:           make(chan clientConn),
+		priorityConns:      make(chan clientConn),
 		operators:          opers,
 		operclasses:        *operClasses,
+		pasteDetection:     config.Server.PasteDetection,
 		registeredChannels: make(map[string]*RegisteredChannel),
 		rehashSignal:       make(chan os.Signal, 1),
 		restAPI:            &config.Server.RestAPI,
 		signals:            make(chan os.Signal, len(ServerExitSignals)),
 		snomasks:           NewSnoManager(),
 		stsEnabled:         config.Server.STS.Enabled,
+		stsPort:            config.Server.STS.Port,
+		typingPolicy:       NewTypingPolicy(config.Server.Typing),
+		vhosts:             config.Accounts.VHosts,
+		webhooks:           config.Channels.Webhooks,
+		webhookQueue:       make(chan webhookDelivery, webhookQueueLength),
+		whoisChannels:      config.Server.WhoisChannels,
 		whoWas:             NewWhoWasList(config.Limits.WhowasEntries),
 	}
+	server.updateRateLimits(config.Server.RateLimits)
+	server.schedules = config.Schedules
+	server.activeSchedules = config.ActiveSchedules
+	server.snapshots = config.Datastore.Snapshots
+	server.readOnly = config.Datastore.ReadOnly
+	server.readOnlyConfigured = config.Datastore.ReadOnly
 
 	// open data store
 	server.logger.Debug("startup", "Opening datastore")
+	server.storeLock, err = lockDatastore(config.Datastore.Path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to lock datastore: %s", err.Error())
+	}
 	db, err := buntdb.Open(config.Datastore.Path)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to open datastore: %s", err.Error())
@@ -262,6 +439,16 @@ func NewServer(configFilename string, config *Config, logger *logger.Manager) (*
 		return nil, errDbOutOfDate
 	}
 
+	// open cold history store
+	if config.History.Enabled && config.History.ColdStorage.Enabled {
+		server.logger.Debug("startup", "Opening history cold storage")
+		coldStorage := config.History.ColdStorage
+		server.coldHistory, err = history.OpenColdStore(coldStorage.Path, coldStorage.Retention, coldStorage.CompactionInterval)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open history cold storage: %s", err.Error())
+		}
+	}
+
 	// load *lines
 	server.logger.Debug("startup", "Loading D/Klines")
 	server.loadDLines()
@@ -270,45 +457,16 @@ func NewServer(configFilename string, config *Config, logger *logger.Manager) (*
 	// load password manager
 	server.logger.Debug("startup", "Loading passwords")
 	err = server.store.View(func(tx *buntdb.Tx) error {
-		saltString, err := tx.Get(keySalt)
-		if err != nil {
-			return fmt.Errorf("Could not retrieve salt string: %s", err.Error())
-		}
-
-		salt, err := base64.StdEncoding.DecodeString(saltString)
-		if err != nil {
-			return err
-		}
-
-		pwm := NewPasswordManager(salt)
-		server.passwords = &pwm
-		return nil
+		var err error
+		server.passwords, err = loadPasswordManager(tx)
+		return err
 	})
 	if err != nil {
 		return nil, fmt.Errorf("Could not load salt: %s", err.Error())
 	}
 
 	server.logger.Debug("startup", "Loading MOTD")
-	if config.Server.MOTD != "" {
-		file, err := os.Open(config.Server.MOTD)
-		if err == nil {
-			defer file.Close()
-
-			reader := bufio.NewReader(file)
-			for {
-				line, err := reader.ReadString('\n')
-				if err != nil {
-					break
-				}
-				line = strings.TrimRight(line, "\r\n")
-				// "- " is the required prefix for MOTD, we just add it here to make
-				// bursting it out to clients easier
-				line = fmt.Sprintf("- %s", line)
-
-				server.motdLines = append(server.motdLines, line)
-			}
-		}
-	}
+	server.motdLines = loadMOTD(config.Server.MOTD)
 
 	if config.Server.Password != "" {
 		server.password = config.Server.PasswordBytes()
@@ -338,6 +496,36 @@ func NewServer(configFilename string, config *Config, logger *logger.Manager) (*
 		server.startRestAPI()
 	}
 
+	// start the captcha pages if they're set up
+	if server.captcha.Enabled() {
+		err = server.startCaptchaListener()
+		if err != nil {
+			return nil, fmt.Errorf("Could not start captcha listener: %s", err.Error())
+		}
+		logger.Info("startup", fmt.Sprintf("%s captcha pages listening on %s", server.name, server.captcha.Listen))
+	}
+
+	// start control socket if enabled
+	if server.controlSocket.Enabled {
+		err = server.startControlSocket()
+		if err != nil {
+			return nil, fmt.Errorf("Could not start control socket: %s", err.Error())
+		}
+		logger.Info("startup", fmt.Sprintf("%s control socket listening on %s", server.name, server.controlSocket.Path))
+	}
+
+	// start mail gateway if enabled
+	if server.mailGateway.Enabled {
+		err = server.startMailGateway()
+		if err != nil {
+			return nil, fmt.Errorf("Could not start mail gateway: %s", err.Error())
+		}
+		logger.Info("startup", fmt.Sprintf("%s mail gateway listening on %s", server.name, server.mailGateway.Listen))
+	}
+
+	// webhooks are sent in the background, so slow receivers don't hold up channels
+	go server.runWebhooks()
+
 	return server, nil
 }
 
@@ -348,8 +536,9 @@ func (server *Server) setISupport() {
 	// add RPL_ISUPPORT tokens
 	server.isupport = NewISupportList()
 	server.isupport.Add("AWAYLEN", strconv.Itoa(server.limits.AwayLen))
+	server.isupport.Add("CALLERID", CallerID.String())
 	server.isupport.Add("CASEMAPPING", casemappingName)
-	server.isupport.Add("CHANMODES", strings.Join([]string{Modes{BanMask, ExceptMask, InviteMask}.String(), "", Modes{UserLimit, Key}.String(), Modes{InviteOnly, Moderated, NoOutside, OpOnlyTopic, ChanRoleplaying, Secret}.String()}, ","))
+	server.isupport.Add("CHANMODES", strings.Join([]string{Modes{BanMask, ExceptMask, InviteMask}.String(), "", Modes{UserLimit, Key, SlowMode, PasteThreshold}.String(), Modes{InviteOnly, Moderated, NoOutside, OpOnlyTopic, ChanRoleplaying, Secret, NoTyping, SecureOnly}.String()}, ","))
 	server.isupport.Add("CHANNELLEN", strconv.Itoa(server.limits.ChannelLen))
 	server.isupport.Add("CHANTYPES", "#")
 	server.isupport.Add("ELIST", "U")
@@ -358,16 +547,28 @@ func (server *Server) setISupport() {
 	server.isupport.Add("KICKLEN", strconv.Itoa(server.limits.KickLen))
 	server.isupport.Add("MAXLIST", fmt.Sprintf("beI:%s", strconv.Itoa(server.limits.ChanListModes)))
 	server.isupport.Add("MAXTARGETS", maxTargetsString)
-	server.isupport.Add("MODES", "")
+	if 0 < server.limits.Modes {
+		server.isupport.Add("MODES", strconv.Itoa(server.limits.Modes))
+	} else {
+		server.isupport.Add("MODES", "")
+	}
 	server.isupport.Add("MONITOR", strconv.Itoa(server.limits.MonitorEntries))
 	server.isupport.Add("NETWORK", server.networkName)
 	server.isupport.Add("NICKLEN", strconv.Itoa(server.limits.NickLen))
+	if server.nickCollision.Policy != NickCollisionReject {
+		server.isupport.Add("NICKFALLBACK", server.nickCollision.Policy)
+		server.isupport.Add("GUESTNICK", server.nickCollision.GuestPrefix)
+	}
 	server.isupport.Add("PREFIX", "(qaohv)~&@%+")
 	server.isupport.Add("RPCHAN", "E")
 	server.isupport.Add("RPUSER", "E")
+	server.isupport.Add("SILENCE", strconv.Itoa(maxSilenceEntries))
 	server.isupport.Add("STATUSMSG", "~&@%+")
-	server.isupport.Add("TARGMAX", fmt.Sprintf("NAMES:1,LIST:1,KICK:1,WHOIS:1,USERHOST:10,PRIVMSG:%s,TAGMSG:%s,NOTICE:%s,MONITOR:", maxTargetsString, maxTargetsString, maxTargetsString))
+	server.isupport.Add("TARGMAX", server.targMaxISupport())
 	server.isupport.Add("TOPICLEN", strconv.Itoa(server.limits.TopicLen))
+	if server.linePolicy.UTF8Only {
+		server.isupport.AddNoValue("UTF8ONLY")
+	}
 
 	// account registration
 	if server.accountRegistration.Enabled {
@@ -403,9 +604,21 @@ func (server *Server) Shutdown() {
 	}
 	server.clients.ByNickMutex.RUnlock()
 
+	server.stopControlSocket()
+	server.stopMailGateway()
+	server.stopCaptchaListener()
+
 	if err := server.store.Close(); err != nil {
 		server.logger.Error("shutdown", fmt.Sprintln("Could not close datastore:", err))
 	}
+	if server.storeLock != nil {
+		server.storeLock.Close()
+	}
+	if server.coldHistory != nil {
+		if err := server.coldHistory.Close(); err != nil {
+			server.logger.Error("shutdown", fmt.Sprintln("Could not close history cold storage:", err))
+		}
+	}
 }
 
 // Run starts the server.
@@ -413,6 +626,15 @@ func (server *Server) Run() {
 	// defer closing db/store
 	defer server.store.Close()
 
+	scheduleTicker := time.NewTicker(scheduleCheckInterval)
+	defer scheduleTicker.Stop()
+
+	snapshotTicker := time.NewTicker(snapshotCheckInterval)
+	defer snapshotTicker.Stop()
+
+	accountExpiryTicker := time.NewTicker(accountExpiryCheckInterval)
+	defer accountExpiryTicker.Stop()
+
 	done := false
 	for !done {
 		select {
@@ -420,6 +642,15 @@ func (server *Server) Run() {
 			server.Shutdown()
 			done = true
 
+		case <-scheduleTicker.C:
+			server.checkSchedules()
+
+		case <-snapshotTicker.C:
+			server.checkSnapshot()
+
+		case <-accountExpiryTicker.C:
+			server.checkAccountExpiry()
+
 		case <-server.rehashSignal:
 			server.logger.Info("rehash", "Rehashing due to SIGHUP")
 			err := server.rehash()
@@ -427,65 +658,116 @@ func (server *Server) Run() {
 				server.logger.Error("rehash", fmt.Sprintln("Failed to rehash:", err.Error()))
 			}
 
-		case conn := <-server.newConns:
-			// check connection limits
-			ipaddr := net.ParseIP(IPString(conn.Conn.RemoteAddr()))
-			if ipaddr != nil {
-				// check DLINEs
-				isBanned, info := server.dlines.CheckIP(ipaddr)
-				if isBanned {
-					banMessage := fmt.Sprintf(bannedFromServerBytes, info.Reason)
-					if info.Time != nil {
-						banMessage += fmt.Sprintf(" [%s]", info.Time.Duration.String())
-					}
-					conn.Conn.Write([]byte(banMessage))
-					conn.Conn.Close()
-					continue
-				}
+		case conn := <-server.priorityConns:
+			server.acceptConn(conn)
 
-				// check connection limits
-				server.connectionLimitsMutex.Lock()
-				err := server.connectionLimits.AddClient(ipaddr, false)
-				server.connectionLimitsMutex.Unlock()
-				if err != nil {
-					// too many connections from one client, tell the client and close the connection
-					// this might not show up properly on some clients, but our objective here is just to close it out before it has a load impact on us
-					conn.Conn.Write([]byte(tooManyClientsBytes))
-					conn.Conn.Close()
-					continue
+		case conn := <-server.newConns:
+			// let any waiting high-priority connections in first
+			for drained := false; !drained; {
+				select {
+				case priorityConn := <-server.priorityConns:
+					server.acceptConn(priorityConn)
+				default:
+					drained = true
 				}
+			}
+			server.acceptConn(conn)
+		}
+	}
+}
 
-				// check connection throttle
-				server.connectionThrottleMutex.Lock()
-				err = server.connectionThrottle.AddClient(ipaddr)
-				server.connectionThrottleMutex.Unlock()
-				if err != nil {
-					// too many connections too quickly from client, tell them and close the connection
-					length := &IPRestrictTime{
-						Duration: server.connectionThrottle.BanDuration,
-						Expires:  time.Now().Add(server.connectionThrottle.BanDuration),
-					}
-					server.dlines.AddIP(ipaddr, length, server.connectionThrottle.BanMessage, "Exceeded automated connection throttle")
+// acceptConn checks a new connection against the server's bans and limits, and starts a
+// client for it if it passes.
+func (server *Server) acceptConn(conn clientConn) {
+	// check connection limits
+	ipaddr := net.ParseIP(IPString(conn.Conn.RemoteAddr()))
+	if ipaddr != nil {
+		// check DLINEs
+		isBanned, info := server.dlines.CheckIP(ipaddr)
+		if isBanned {
+			banMessage := fmt.Sprintf(bannedFromServerBytes, info.Reason)
+			if info.Time != nil {
+				banMessage += fmt.Sprintf(" [%s]", info.Time.Duration.String())
+			}
+			conn.Conn.Write([]byte(banMessage))
+			conn.Conn.Close()
+			return
+		}
 
-					// reset ban on connectionThrottle
-					server.connectionThrottle.ResetFor(ipaddr)
+		// check the soft client limit
+		server.maxClientsMutex.Lock()
+		canConnect := server.maxClients.CanConnect(ipaddr, server.clients.Count())
+		server.maxClientsMutex.Unlock()
+		if !canConnect && !conn.Config.highPriority() {
+			conn.Conn.Write([]byte(serverFullBytes))
+			conn.Conn.Close()
+			return
+		}
 
-					// this might not show up properly on some clients, but our objective here is just to close it out before it has a load impact on us
-					conn.Conn.Write([]byte(server.connectionThrottle.BanMessageBytes))
-					conn.Conn.Close()
-					continue
-				}
+		// clients over the limits are let through if they might be exempt once they log in
+		var overLimits limitsExceeded
 
-				server.logger.Debug("localconnect-ip", fmt.Sprintf("Client connecting from %v", ipaddr))
-				// prolly don't need to alert snomasks on this, only on connection reg
+		// check connection limits
+		server.connectionLimitsMutex.Lock()
+		err := server.connectionLimits.AddClient(ipaddr, false)
+		if err != nil && server.connectionLimits.ChecksAtRegistration() {
+			err = server.connectionLimits.AddPendingClient(ipaddr)
+			overLimits.connectionLimit = err == nil
+		}
+		server.connectionLimitsMutex.Unlock()
+		if err != nil {
+			// too many connections from one client, tell the client and close the connection
+			// this might not show up properly on some clients, but our objective here is just to close it out before it has a load impact on us
+			conn.Conn.Write([]byte(tooManyClientsBytes))
+			conn.Conn.Close()
+			return
+		}
 
-				go NewClient(server, conn.Conn, conn.IsTLS)
-				continue
+		// check connection throttle
+		server.connectionThrottleMutex.Lock()
+		err = server.connectionThrottle.AddClient(ipaddr)
+		if err != nil && server.connectionThrottle.ChecksAtRegistration() {
+			err = server.connectionThrottle.AddPendingClient(ipaddr)
+			overLimits.throttle = err == nil
+		}
+		server.connectionThrottleMutex.Unlock()
+		if err != nil {
+			// they were counted towards the connection limits above
+			server.connectionLimitsMutex.Lock()
+			if overLimits.connectionLimit {
+				server.connectionLimits.RemovePendingClient(ipaddr)
 			}
+			server.connectionLimits.RemoveClient(ipaddr)
+			server.connectionLimitsMutex.Unlock()
+
+			// too many connections too quickly from client, tell them and close the connection
+			server.banThrottledIP(ipaddr)
+
+			// this might not show up properly on some clients, but our objective here is just to close it out before it has a load impact on us
+			conn.Conn.Write([]byte(server.connectionThrottle.BanMessageBytes))
+			conn.Conn.Close()
+			return
 		}
+
+		server.logger.Debug("localconnect-ip", fmt.Sprintf("Client connecting from %v", ipaddr))
+		// prolly don't need to alert snomasks on this, only on connection reg
+
+		go NewClient(server, conn.Conn, conn.IsTLS, conn.Config, overLimits)
 	}
 }
 
+// banThrottledIP D-Lines the given IP for going over the connection throttle.
+func (server *Server) banThrottledIP(ipaddr net.IP) {
+	length := &IPRestrictTime{
+		Duration: server.connectionThrottle.BanDuration,
+		Expires:  time.Now().Add(server.connectionThrottle.BanDuration),
+	}
+	server.dlines.AddIP(ipaddr, length, server.connectionThrottle.BanMessage, "Exceeded automated connection throttle")
+
+	// reset ban on connectionThrottle
+	server.connectionThrottle.ResetFor(ipaddr)
+}
+
 //
 // IRC protocol listeners
 //
@@ -503,14 +785,25 @@ func (server *Server) createListener(addr string, tlsMap map[string]*tls.Config)
 	listenerEventChannel := make(chan ListenerEvent, 1)
 
 	// make listener
-	listener, err := net.Listen("tcp", addr)
+	var tcpConfig TCPListenerConfig
+	if listenerConfig := server.listenerConfigs[addr]; listenerConfig != nil {
+		tcpConfig = listenerConfig.TCP
+	}
+	listener, err := listenTCP(addr, tcpConfig)
 	if err != nil {
 		log.Fatal(server, "listen error: ", err)
 	}
+	listener = &tcpOptionsListener{
+		Listener: listener,
+		server:   server,
+		addr:     addr,
+		isTLS:    listenTLS,
+	}
 
 	tlsString := "plaintext"
 	if listenTLS {
 		config.ClientAuth = tls.RequestClientCert
+		config.GetConfigForClient = server.sniConfig(config)
 		listener = tls.NewListener(listener, config)
 		tlsString = "TLS"
 	}
@@ -519,6 +812,7 @@ func (server *Server) createListener(addr string, tlsMap map[string]*tls.Config)
 	li := ListenerInterface{
 		Events:   listenerEventChannel,
 		Listener: listener,
+		IsTLS:    listenTLS,
 	}
 	server.listeners[addr] = li
 
@@ -531,12 +825,22 @@ func (server *Server) createListener(addr string, tlsMap map[string]*tls.Config)
 			conn, err := listener.Accept()
 
 			if err == nil {
+				server.listenerUpdateMutex.Lock()
+				listenerConfig := server.listenerConfigs[addr]
+				server.listenerUpdateMutex.Unlock()
+
 				newConn := clientConn{
-					Conn:  conn,
-					IsTLS: listenTLS,
+					Conn:   conn,
+					IsTLS:  listenTLS,
+					Config: listenerConfig,
 				}
 
-				server.newConns <- newConn
+				// we need to see the client's TLS handshake to know which network they want
+				if listenTLS && server.hasNetworks() {
+					go server.routeConn(newConn)
+				} else {
+					server.queueConn(newConn)
+				}
 			}
 
 			select {
@@ -555,21 +859,36 @@ func (server *Server) createListener(addr string, tlsMap map[string]*tls.Config)
 					listener.Close()
 
 					// make new listener
-					listener, err = net.Listen("tcp", addr)
+					server.listenerUpdateMutex.Lock()
+					var tcpConfig TCPListenerConfig
+					if listenerConfig := server.listenerConfigs[addr]; listenerConfig != nil {
+						tcpConfig = listenerConfig.TCP
+					}
+					server.listenerUpdateMutex.Unlock()
+					listener, err = listenTCP(addr, tcpConfig)
 					if err != nil {
 						log.Fatal(server, "listen error: ", err)
 					}
 
 					tlsString := "plaintext"
-					if event.NewConfig != nil {
+					listenTLS = event.NewConfig != nil
+					listener = &tcpOptionsListener{
+						Listener: listener,
+						server:   server,
+						addr:     addr,
+						isTLS:    listenTLS,
+					}
+					if listenTLS {
 						config = event.NewConfig
 						config.ClientAuth = tls.RequestClientCert
+						config.GetConfigForClient = server.sniConfig(config)
 						listener = tls.NewListener(listener, config)
 						tlsString = "TLS"
 					}
 
 					// update server ListenerInterface
 					li.Listener = listener
+					li.IsTLS = listenTLS
 					server.listenerUpdateMutex.Lock()
 					server.listeners[addr] = li
 					server.listenerUpdateMutex.Unlock()
@@ -589,7 +908,9 @@ func (server *Server) createListener(addr string, tlsMap map[string]*tls.Config)
 //
 
 func (server *Server) wslisten(addr string, tlsMap map[string]*TLSListenConfig) {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	// each network running in this process has its own websocket listener
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			server.logger.Error("ws", addr, fmt.Sprintf("%s method not allowed", r.Method))
 			return
@@ -609,10 +930,11 @@ func (server *Server) wslisten(addr string, tlsMap map[string]*TLSListenConfig)
 		}
 
 		newConn := clientConn{
-			Conn:  WSContainer{ws},
-			IsTLS: false, //TODO(dan): track TLS or not here properly
+			Conn:   WSContainer{ws},
+			IsTLS:  false, //TODO(dan): track TLS or not here properly
+			Config: &ListenerConfig{},
 		}
-		server.newConns <- newConn
+		server.queueConn(newConn)
 	})
 	go func() {
 		config, listenTLS := tlsMap[addr]
@@ -625,9 +947,9 @@ func (server *Server) wslisten(addr string, tlsMap map[string]*TLSListenConfig)
 		server.logger.Info("listeners", fmt.Sprintf("websocket listening on %s using %s.", addr, tlsString))
 
 		if listenTLS {
-			err = http.ListenAndServeTLS(addr, config.Cert, config.Key, nil)
+			err = http.ListenAndServeTLS(addr, config.Cert, config.Key, mux)
 		} else {
-			err = http.ListenAndServe(addr, nil)
+			err = http.ListenAndServe(addr, mux)
 		}
 		if err != nil {
 			server.logger.Error("listeners", fmt.Sprintf("listenAndServe error [%s]: %s", tlsString, err))
@@ -635,11 +957,6 @@ func (server *Server) wslisten(addr string, tlsMap map[string]*TLSListenConfig)
 	}()
 }
 
-// generateMessageID returns a network-unique message ID.
-func (server *Server) generateMessageID() string {
-	return fmt.Sprintf("%s-%s", strconv.FormatInt(time.Now().UTC().UnixNano(), 10), strconv.FormatInt(rand.Int63(), 10))
-}
-
 //
 // server functionality
 //
@@ -662,11 +979,51 @@ func (server *Server) tryRegister(c *Client) {
 		c.destroy()
 		return
 	}
+	// their nickmask isn't set until they've registered
+	nickmask := fmt.Sprintf("%s!%s@%s", c.nick, c.username, c.rawHostname)
+	for _, mask := range server.klines.ObserveMasks(c.AllNickmasks()...) {
+		server.logger.Info("opers", fmt.Sprintf("Observed K-Line %s matched %s", mask, nickmask))
+		server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("Observed K-Line $c[grey][$r%s$c[grey]] matched $c[grey][$r%s$c[grey]]"), mask, nickmask))
+	}
+
+	// log in with the account given with PASS
+	server.tryPassLogin(c)
+
+	// check SASL-only listeners
+	if c.account == &NoAccount && c.listenerConfig.requireSASL() {
+		// queued lines are dropped when we close the socket, so these go out as the final data
+		message := "You must log in with SASL to connect on this port"
+		failMsg := ircmsg.MakeMessage(nil, server.name, "FAIL", "*", "ACCOUNT_REQUIRED", message)
+		failLine, _ := failMsg.Line()
+		errorMsg := ircmsg.MakeMessage(nil, "", "ERROR", message)
+		errorLine, _ := errorMsg.Line()
+		c.socket.SetFinalData(failLine + errorLine)
+		c.quitMessageSent = true
+		c.destroy()
+		return
+	}
+
+	// check the connection limits they went over when they connected, now we know who they are
+	if !server.checkExceededLimits(c) {
+		return
+	}
+
+	// check the soft client limit
+	server.maxClientsMutex.Lock()
+	canRegister := server.maxClients.CanRegister(c.IP(), server.clients.Count(), c.account != &NoAccount)
+	server.maxClientsMutex.Unlock()
+	if !canRegister && !c.listenerConfig.highPriority() {
+		c.Send(nil, "", "ERROR", "This server is full, please try again later")
+		c.quitMessageSent = true
+		c.destroy()
+		return
+	}
 
 	// continue registration
 	server.logger.Debug("localconnect", fmt.Sprintf("Client registered [%s] [u:%s] [r:%s]", c.nick, c.username, c.realname))
 	server.snomasks.Send(sno.LocalConnects, fmt.Sprintf(ircfmt.Unescape("Client registered $c[grey][$r%s$c[grey]] [u:$r%s$c[grey]] [h:$r%s$c[grey]] [r:$r%s$c[grey]]"), c.nick, c.username, c.rawHostname, c.realname))
 	c.Register()
+	server.checkClones(c)
 
 	// send welcome text
 	//NOTE(dan): we specifically use the NICK here instead of the nickmask
@@ -676,26 +1033,61 @@ func (server *Server) tryRegister(c *Client) {
 	c.Send(nil, server.name, RPL_CREATED, c.nick, fmt.Sprintf("This server was created %s", server.ctime.Format(time.RFC1123)))
 	//TODO(dan): Look at adding last optional [<channel modes with a parameter>] parameter
 	c.Send(nil, server.name, RPL_MYINFO, c.nick, server.name, Ver, supportedUserModesString, supportedChannelModesString)
-	c.RplISupport()
-	server.MOTD(c)
+	c.RplISupport(NewResponseBuffer(c))
+	server.MOTD(c, NewResponseBuffer(c))
 	c.Send(nil, c.nickMaskString, RPL_UMODEIS, c.nick, c.ModeString())
 	if server.logger.DumpingRawInOut {
 		c.Notice("This server is in debug mode and is logging all user I/O. If you do not wish for everything you send to be readable by the server owner(s), please disconnect.")
 	}
+	if conf := c.plaintextDeprecation(); conf != nil {
+		c.Notice(server.plaintextDeprecationMessage(conf))
+	}
+	if c.isGuest() {
+		server.joinGuestChannels(c)
+	}
+	c.checkNickEnforcement(NewResponseBuffer(c))
+}
+
+// loadMOTD returns the lines of the given MOTD file, ready to be sent to clients.
+func loadMOTD(filename string) []string {
+	var lines []string
+	if filename == "" {
+		return lines
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return lines
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		line = strings.TrimRight(line, "\r\n")
+		// "- " is the required prefix for MOTD, we just add it here to make
+		// bursting it out to clients easier
+		line = fmt.Sprintf("- %s", line)
+
+		lines = append(lines, line)
+	}
+	return lines
 }
 
 // MOTD serves the Message of the Day.
-func (server *Server) MOTD(client *Client) {
+func (server *Server) MOTD(client *Client, rb *ResponseBuffer) {
 	if len(server.motdLines) < 1 {
-		client.Send(nil, server.name, ERR_NOMOTD, client.nick, "MOTD File is missing")
+		rb.Send(nil, server.name, ERR_NOMOTD, client.nick, "MOTD File is missing")
 		return
 	}
 
-	client.Send(nil, server.name, RPL_MOTDSTART, client.nick, fmt.Sprintf("- %s Message of the day - ", server.name))
+	rb.Send(nil, server.name, RPL_MOTDSTART, client.nick, fmt.Sprintf("- %s Message of the day - ", server.name))
 	for _, line := range server.motdLines {
-		client.Send(nil, server.name, RPL_MOTD, client.nick, line)
+		rb.Send(nil, server.name, RPL_MOTD, client.nick, line)
 	}
-	client.Send(nil, server.name, RPL_ENDOFMOTD, client.nick, "End of MOTD command")
+	rb.Send(nil, server.name, RPL_ENDOFMOTD, client.nick, "End of MOTD command")
 }
 
 //
@@ -703,23 +1095,27 @@ func (server *Server) MOTD(client *Client) {
 //
 
 // PASS <password>
-func passHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func passHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	if client.registered {
-		client.Send(nil, server.name, ERR_ALREADYREGISTRED, client.nick, "You may not reregister")
+		rb.Send(nil, server.name, ERR_ALREADYREGISTRED, client.nick, "You may not reregister")
 		return false
 	}
 
 	// if no password exists, skip checking
 	if len(server.password) == 0 {
 		client.authorized = true
+		// without a server password, PASS can be used to log into an account instead
+		if client.listenerConfig.passLogin() {
+			client.passLogin = msg.Params[0]
+		}
 		return false
 	}
 
 	// check the provided password
 	password := []byte(msg.Params[0])
 	if ComparePassword(server.password, password) != nil {
-		client.Send(nil, server.name, ERR_PASSWDMISMATCH, client.nick, "Password incorrect")
-		client.Send(nil, server.name, "ERROR", "Password incorrect")
+		rb.Send(nil, server.name, ERR_PASSWDMISMATCH, client.nick, "Password incorrect")
+		rb.Send(nil, server.name, "ERROR", "Password incorrect")
 		return true
 	}
 
@@ -728,9 +1124,9 @@ func passHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 }
 
 // USER <username> * 0 <realname>
-func userHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func userHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	if client.registered {
-		client.Send(nil, server.name, ERR_ALREADYREGISTRED, client.nick, "You may not reregister")
+		rb.Send(nil, server.name, ERR_ALREADYREGISTRED, client.nick, "You may not reregister")
 		return false
 	}
 
@@ -747,12 +1143,14 @@ func userHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 	//
 	_, err := CasefoldName(msg.Params[0])
 	if err != nil {
-		client.Send(nil, "", "ERROR", "Malformed username")
+		rb.Send(nil, "", "ERROR", "Malformed username")
 		return true
 	}
 
 	if !client.HasUsername() {
+		client.stateMutex.Lock()
 		client.username = "~" + msg.Params[0]
+		client.stateMutex.Unlock()
 		// don't bother updating nickmask here, it's not valid anyway
 	}
 	if client.realname == "" {
@@ -765,12 +1163,12 @@ func userHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 }
 
 // QUIT [<reason>]
-func quitHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
-	reason := "Quit"
+func quitHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	var reason string
 	if len(msg.Params) > 0 {
-		reason += ": " + msg.Params[0]
+		reason = client.guestReason(msg.Params[0])
 	}
-	client.Quit(reason)
+	client.Quit(client.userQuitMessage(reason))
 	return true
 }
 
@@ -779,20 +1177,20 @@ func quitHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 //
 
 // PING <server1> [<server2>]
-func pingHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
-	client.Send(nil, server.name, "PONG", msg.Params...)
+func pingHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	rb.Send(nil, server.name, "PONG", msg.Params...)
 	return false
 }
 
 // PONG <server> [ <server2> ]
-func pongHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func pongHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	// client gets touched when they send this command, so we don't need to do anything
 	return false
 }
 
 // RENAME <oldchan> <newchan> [<reason>]
 //TODO(dan): Clean up this function so it doesn't look like an eldrich horror... prolly by putting it into a server.renameChannel function.
-func renameHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func renameHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	// get lots of locks... make sure nobody touches anything while we're doing this
 	server.registeredChannelsMutex.Lock()
 	defer server.registeredChannelsMutex.Unlock()
@@ -810,19 +1208,19 @@ func renameHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 	casefoldedOldName, err := CasefoldChannel(oldName)
 	if err != nil {
 		//TODO(dan): Change this to ERR_CANNOTRENAME
-		client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "RENAME", oldName, "Old channel name is invalid")
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "RENAME", oldName, "Old channel name is invalid")
 		return false
 	}
 
 	channel := server.channels.Chans[casefoldedOldName]
 	if channel == nil {
-		client.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, oldName, "No such channel")
+		rb.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, oldName, "No such channel")
 		return false
 	}
 
 	//TODO(dan): allow IRCops to do this?
 	if !channel.ClientIsAtLeast(client, Operator) {
-		client.Send(nil, server.name, ERR_CHANOPRIVSNEEDED, client.nick, oldName, "Only chanops can rename channels")
+		rb.Send(nil, server.name, ERR_CHANOPRIVSNEEDED, client.nick, oldName, "Only chanops can rename channels")
 		return false
 	}
 
@@ -832,23 +1230,24 @@ func renameHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 	casefoldedNewName, err := CasefoldChannel(newName)
 	if err != nil {
 		//TODO(dan): Change this to ERR_CANNOTRENAME
-		client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "RENAME", newName, "New channel name is invalid")
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "RENAME", newName, "New channel name is invalid")
 		return false
 	}
 
 	newChannel := server.channels.Chans[casefoldedNewName]
 	if newChannel != nil {
 		//TODO(dan): Change this to ERR_CHANNAMEINUSE
-		client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "RENAME", newName, "New channel name is in use")
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "RENAME", newName, "New channel name is in use")
 		return false
 	}
 
-	var canEdit bool
+	var canEdit, registered bool
 	server.store.Update(func(tx *buntdb.Tx) error {
 		chanReg := server.loadChannelNoMutex(tx, casefoldedOldName)
 		if chanReg == nil || client.account == nil || client.account.Name == chanReg.Founder {
 			canEdit = true
 		}
+		registered = chanReg != nil
 
 		chanReg = server.loadChannelNoMutex(tx, casefoldedNewName)
 		if chanReg != nil {
@@ -858,7 +1257,10 @@ func renameHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 	})
 	if !canEdit {
 		//TODO(dan): Change this to ERR_CANNOTRENAME
-		client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "RENAME", oldName, "Only channel founders can change registered channels")
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "RENAME", oldName, "Only channel founders can change registered channels")
+		return false
+	}
+	if registered && !server.checkWritable(client, "RENAME", rb) {
 		return false
 	}
 
@@ -886,11 +1288,11 @@ func renameHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 
 	// send RENAME messages
 	for mcl := range channel.members {
-		if mcl.capabilities[Rename] {
-			mcl.Send(nil, client.nickMaskString, "RENAME", oldName, newName, reason)
+		if mcl.hasCapability(Rename) {
+			mcl.SendFromClient("", client, nil, "RENAME", oldName, newName, reason)
 		} else {
 			mcl.Send(nil, mcl.nickMaskString, "PART", oldName, fmt.Sprintf("Channel renamed: %s", reason))
-			if mcl.capabilities[ExtendedJoin] {
+			if mcl.hasCapability(ExtendedJoin) {
 				accountName := "*"
 				if mcl.account != nil {
 					accountName = mcl.account.Name
@@ -906,15 +1308,15 @@ func renameHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 }
 
 // JOIN <channel>{,<channel>} [<key>{,<key>}]
-func joinHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func joinHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	// kill JOIN 0 requests
 	if msg.Params[0] == "0" {
-		client.Notice("JOIN 0 is not allowed")
+		rb.Notice("JOIN 0 is not allowed")
 		return false
 	}
 
 	// handle regular JOINs
-	channels := strings.Split(msg.Params[0], ",")
+	channels := client.limitTargets("JOIN", strings.Split(msg.Params[0], ","), rb)
 	var keys []string
 	if len(msg.Params) > 1 {
 		keys = strings.Split(msg.Params[1], ",")
@@ -928,7 +1330,7 @@ func joinHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 		casefoldedName, err := CasefoldChannel(name)
 		if err != nil {
 			if len(name) > 0 {
-				client.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, name, "No such channel")
+				rb.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, name, "No such channel")
 			}
 			continue
 		}
@@ -936,7 +1338,7 @@ func joinHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 		channel := server.channels.Get(casefoldedName)
 		if channel == nil {
 			if len(casefoldedName) > server.limits.ChannelLen {
-				client.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, name, "No such channel")
+				rb.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, name, "No such channel")
 				continue
 			}
 			channel = NewChannel(server, name, true)
@@ -947,17 +1349,17 @@ func joinHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 			key = keys[i]
 		}
 
-		channel.Join(client, key)
+		channel.Join(client, key, rb)
 	}
 	return false
 }
 
 // PART <channel>{,<channel>} [<reason>]
-func partHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
-	channels := strings.Split(msg.Params[0], ",")
+func partHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	channels := client.limitTargets("PART", strings.Split(msg.Params[0], ","), rb)
 	var reason string //TODO(dan): if this isn't supplied here, make sure the param doesn't exist in the PART message sent to other users
 	if len(msg.Params) > 1 {
-		reason = msg.Params[1]
+		reason = client.guestReason(msg.Params[1])
 	}
 
 	// get lock
@@ -970,31 +1372,31 @@ func partHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 
 		if err != nil || channel == nil {
 			if len(chname) > 0 {
-				client.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, chname, "No such channel")
+				rb.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, chname, "No such channel")
 			}
 			continue
 		}
 
-		channel.Part(client, reason)
+		channel.Part(client, reason, rb)
 	}
 	return false
 }
 
 // TOPIC <channel> [<topic>]
-func topicHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func topicHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	name, err := CasefoldChannel(msg.Params[0])
 	channel := server.channels.Get(name)
 	if err != nil || channel == nil {
 		if len(msg.Params[0]) > 0 {
-			client.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, msg.Params[0], "No such channel")
+			rb.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, msg.Params[0], "No such channel")
 		}
 		return false
 	}
 
 	if len(msg.Params) > 1 {
-		channel.SetTopic(client, msg.Params[1])
+		channel.SetTopic(client, msg.Params[1], rb)
 	} else {
-		channel.GetTopic(client)
+		channel.GetTopic(client, rb)
 	}
 	return false
 }
@@ -1042,40 +1444,13 @@ func wordWrap(text string, lineWidth int) []string {
 	return lines
 }
 
-// SplitMessage represents a message that's been split for sending.
-type SplitMessage struct {
-	For512     []string
-	ForMaxLine string
-}
-
-func (server *Server) splitMessage(original string, origIs512 bool) SplitMessage {
-	var newSplit SplitMessage
-
-	newSplit.ForMaxLine = original
-
-	if !origIs512 {
-		newSplit.For512 = wordWrap(original, 400)
-	} else {
-		newSplit.For512 = []string{original}
-	}
-
-	return newSplit
-}
-
 // PRIVMSG <target>{,<target>} <message>
-func privmsgHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func privmsgHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	clientOnlyTags := GetClientOnlyTags(msg.Tags)
-	targets := strings.Split(msg.Params[0], ",")
+	targets := client.limitTargets("PRIVMSG", strings.Split(msg.Params[0], ","), rb)
 	message := msg.Params[1]
 
-	// split privmsg
-	splitMsg := server.splitMessage(message, !client.capabilities[MaxLine])
-
-	for i, targetString := range targets {
-		// max of four targets per privmsg
-		if i > maxTargets-1 {
-			break
-		}
+	for _, targetString := range targets {
 		prefixes, targetString := SplitChannelMembershipPrefixes(targetString)
 		lowestPrefix := GetLowestChannelModePrefix(prefixes)
 
@@ -1088,42 +1463,73 @@ func privmsgHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool
 		if err == nil {
 			channel := server.channels.Get(target)
 			if channel == nil {
-				client.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, targetString, "No such channel")
+				rb.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, targetString, "No such channel")
 				continue
 			}
 			if !channel.CanSpeak(client) {
-				client.Send(nil, client.server.name, ERR_CANNOTSENDTOCHAN, channel.name, "Cannot send to channel")
+				rb.Send(nil, client.server.name, ERR_CANNOTSENDTOCHAN, channel.name, "Cannot send to channel")
+				continue
+			}
+			channelMessage, allowed := channel.applyMessagePolicy(client, "PRIVMSG", message)
+			if !allowed {
+				continue
+			}
+			if allowed, wait := channel.CheckSlowMode(client); !allowed {
+				channel.sendSlowModeFail(client, "PRIVMSG", wait, rb)
+				continue
+			}
+			channelSplitMsg, allowed := server.splitMessage(client, "PRIVMSG", channel.name, channelMessage)
+			if !allowed {
+				client.sendMessageTooLong("PRIVMSG", channel.name, rb)
 				continue
 			}
 			msgid := server.generateMessageID()
-			channel.SplitPrivMsg(msgid, lowestPrefix, clientOnlyTags, client, splitMsg)
+			channel.SplitPrivMsg(msgid, lowestPrefix, channel.validateReferenceTags(clientOnlyTags), client, channelSplitMsg, rb)
 		} else {
 			target, err = CasefoldName(targetString)
 			if target == "chanserv" {
-				server.chanservReceivePrivmsg(client, message)
+				server.chanservReceivePrivmsg(client, message, rb)
 				continue
-			} else if target == "nickserv" {
-				server.nickservReceivePrivmsg(client, message)
+			} else if server.isNickServ(target) {
+				server.nickservReceivePrivmsg(client, message, rb)
+				continue
+			} else if target == "hostserv" {
+				server.hostservReceivePrivmsg(client, message, rb)
 				continue
 			}
 			user := server.clients.Get(target)
 			if err != nil || user == nil {
 				if len(target) > 0 {
-					client.Send(nil, server.name, ERR_NOSUCHNICK, target, "No such nick")
+					rb.Send(nil, server.name, ERR_NOSUCHNICK, target, "No such nick")
 				}
 				continue
 			}
-			if !user.capabilities[MessageTags] {
-				clientOnlyTags = nil
+			if !user.canMessage(client, false) {
+				continue
+			}
+			splitMsg, allowed := server.splitMessage(client, "PRIVMSG", user.nick, message)
+			if !allowed {
+				client.sendMessageTooLong("PRIVMSG", user.nick, rb)
+				continue
+			}
+			// the sender's echo gets the same tags, msgid and time as the target sees
+			userTags := clientOnlyTags
+			if !user.hasCapability(MessageTags) {
+				userTags = nil
 			}
 			msgid := server.generateMessageID()
-			user.SendSplitMsgFromClient(msgid, client, clientOnlyTags, "PRIVMSG", user.nick, splitMsg)
-			if client.capabilities[EchoMessage] {
-				client.SendSplitMsgFromClient(msgid, client, clientOnlyTags, "PRIVMSG", user.nick, splitMsg)
+			server.recordDirectMessage(client, user, history.Privmsg, msgid, clientOnlyTags, message)
+			user.SendSplitMsgFromClient(msgid, client, userTags, "PRIVMSG", user.nick, splitMsg)
+			if client.hasCapability(EchoMessage) {
+				echoTags := clientOnlyTags
+				if !client.hasCapability(MessageTags) {
+					echoTags = nil
+				}
+				rb.SendSplitMsgFromClient(msgid, client, echoTags, "PRIVMSG", user.nick, splitMsg)
 			}
-			if user.flags[Away] {
+			if user.hasFlag(Away) {
 				//TODO(dan): possibly implement cooldown of away notifications to users
-				client.Send(nil, server.name, RPL_AWAY, user.nick, user.awayMessage)
+				rb.Send(nil, server.name, RPL_AWAY, user.nick, user.awayMessage)
 			}
 		}
 	}
@@ -1131,20 +1537,16 @@ func privmsgHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool
 }
 
 // TAGMSG <target>{,<target>}
-func tagmsgHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func tagmsgHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	clientOnlyTags := GetClientOnlyTags(msg.Tags)
 	// no client-only tags, so we can drop it
 	if clientOnlyTags == nil {
 		return false
 	}
 
-	targets := strings.Split(msg.Params[0], ",")
+	targets := client.limitTargets("TAGMSG", strings.Split(msg.Params[0], ","), rb)
 
-	for i, targetString := range targets {
-		// max of four targets per privmsg
-		if i > maxTargets-1 {
-			break
-		}
+	for _, targetString := range targets {
 		prefixes, targetString := SplitChannelMembershipPrefixes(targetString)
 		lowestPrefix := GetLowestChannelModePrefix(prefixes)
 
@@ -1157,38 +1559,46 @@ func tagmsgHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 		if err == nil {
 			channel := server.channels.Get(target)
 			if channel == nil {
-				client.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, targetString, "No such channel")
+				rb.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, targetString, "No such channel")
 				continue
 			}
 			if !channel.CanSpeak(client) {
-				client.Send(nil, client.server.name, ERR_CANNOTSENDTOCHAN, channel.name, "Cannot send to channel")
+				rb.Send(nil, client.server.name, ERR_CANNOTSENDTOCHAN, channel.name, "Cannot send to channel")
+				continue
+			}
+			tags := server.typingPolicy.filterTags(client, target, channel, channel.validateReferenceTags(clientOnlyTags))
+			if tags == nil {
 				continue
 			}
 			msgid := server.generateMessageID()
 
-			channel.TagMsg(msgid, lowestPrefix, clientOnlyTags, client)
+			channel.TagMsg(msgid, lowestPrefix, tags, client, rb)
 		} else {
 			target, err = CasefoldName(targetString)
 			user := server.clients.Get(target)
 			if err != nil || user == nil {
 				if len(target) > 0 {
-					client.Send(nil, server.name, ERR_NOSUCHNICK, target, "No such nick")
+					rb.Send(nil, server.name, ERR_NOSUCHNICK, target, "No such nick")
 				}
 				continue
 			}
 			msgid := server.generateMessageID()
 
 			// end user can't receive tagmsgs
-			if !user.capabilities[MessageTags] {
+			if !user.hasCapability(MessageTags) || !user.canMessage(client, true) {
 				continue
 			}
-			user.SendFromClient(msgid, client, clientOnlyTags, "TAGMSG", user.nick)
-			if client.capabilities[EchoMessage] {
-				client.SendFromClient(msgid, client, clientOnlyTags, "TAGMSG", user.nick)
+			tags := server.typingPolicy.filterTags(client, target, nil, clientOnlyTags)
+			if tags == nil {
+				continue
+			}
+			user.SendFromClient(msgid, client, tags, "TAGMSG", user.nick)
+			if client.hasCapability(EchoMessage) && client.hasCapability(MessageTags) {
+				rb.SendFromClient(msgid, client, tags, "TAGMSG", user.nick)
 			}
-			if user.flags[Away] {
+			if user.hasFlag(Away) {
 				//TODO(dan): possibly implement cooldown of away notifications to users
-				client.Send(nil, server.name, RPL_AWAY, user.nick, user.awayMessage)
+				rb.Send(nil, server.name, RPL_AWAY, user.nick, user.awayMessage)
 			}
 		}
 	}
@@ -1197,7 +1607,13 @@ func tagmsgHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 
 // WhoisChannelsNames returns the common channel names between two users.
 func (client *Client) WhoisChannelsNames(target *Client) []string {
-	isMultiPrefix := target.capabilities[MultiPrefix]
+	isMultiPrefix := target.hasCapability(MultiPrefix)
+	privacy := client.whoisChannelsPrivacy()
+	canSeeAll := target.hasFlag(Operator) || target == client
+	if privacy == WhoisChannelsNone && !canSeeAll {
+		return nil
+	}
+
 	var chstrs []string
 	index := 0
 	for channel := range client.channels {
@@ -1205,7 +1621,11 @@ func (client *Client) WhoisChannelsNames(target *Client) []string {
 		defer channel.membersMutex.RUnlock()
 
 		// channel is secret and the target can't see it
-		if !target.flags[Operator] && channel.flags[Secret] && !channel.members.Has(target) {
+		if !target.hasFlag(Operator) && channel.flags[Secret] && !channel.members.Has(target) {
+			continue
+		}
+		// the client only shows the channels they share with the target
+		if privacy == WhoisChannelsShared && !canSeeAll && !channel.members.Has(target) {
 			continue
 		}
 		chstrs = append(chstrs, channel.members[client].Prefixes(isMultiPrefix)+channel.name)
@@ -1215,7 +1635,7 @@ func (client *Client) WhoisChannelsNames(target *Client) []string {
 }
 
 // WHOIS [ <target> ] <mask> *( "," <mask> )
-func whoisHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func whoisHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	var masksString string
 	//var target string
 
@@ -1227,123 +1647,194 @@ func whoisHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 	}
 
 	if len(strings.TrimSpace(masksString)) < 1 {
-		client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, "No masks given")
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, "No masks given")
 		return false
 	}
 
-	if client.flags[Operator] {
-		masks := strings.Split(masksString, ",")
+	masks := client.limitTargets("WHOIS", strings.Split(masksString, ","), rb)
+	if client.hasFlag(Operator) {
 		for _, mask := range masks {
 			casefoldedMask, err := Casefold(mask)
 			if err != nil {
-				client.Send(nil, client.server.name, ERR_NOSUCHNICK, mask, "No such nick")
+				rb.Send(nil, client.server.name, ERR_NOSUCHNICK, mask, "No such nick")
 				continue
 			}
 			matches := server.clients.FindAll(casefoldedMask)
 			if len(matches) == 0 {
-				client.Send(nil, client.server.name, ERR_NOSUCHNICK, mask, "No such nick")
+				rb.Send(nil, client.server.name, ERR_NOSUCHNICK, mask, "No such nick")
 				continue
 			}
 			for mclient := range matches {
-				client.getWhoisOf(mclient)
+				client.getWhoisOf(mclient, rb)
 			}
 		}
 	} else {
-		// only get the first request
-		casefoldedMask, err := Casefold(strings.Split(masksString, ",")[0])
-		mclient := server.clients.Get(casefoldedMask)
-		if err != nil || mclient == nil {
-			client.Send(nil, client.server.name, ERR_NOSUCHNICK, masksString, "No such nick")
-			// fall through, ENDOFWHOIS is always sent
-		} else {
-			client.getWhoisOf(mclient)
+		for _, mask := range masks {
+			casefoldedMask, err := Casefold(mask)
+			mclient := server.clients.Get(casefoldedMask)
+			if err != nil || mclient == nil {
+				rb.Send(nil, client.server.name, ERR_NOSUCHNICK, mask, "No such nick")
+				// fall through, ENDOFWHOIS is always sent
+			} else {
+				client.getWhoisOf(mclient, rb)
+			}
 		}
 	}
-	client.Send(nil, server.name, RPL_ENDOFWHOIS, client.nick, masksString, "End of /WHOIS list")
+	rb.Send(nil, server.name, RPL_ENDOFWHOIS, client.nick, masksString, "End of /WHOIS list")
 	return false
 }
 
-func (client *Client) getWhoisOf(target *Client) {
-	client.Send(nil, client.server.name, RPL_WHOISUSER, client.nick, target.nick, target.username, target.hostname, "*", target.realname)
+func (client *Client) getWhoisOf(target *Client, rb *ResponseBuffer) {
+	rb.Send(nil, client.server.name, RPL_WHOISUSER, client.nick, target.nick, target.username, target.hostname, "*", target.realname)
 
-	whoischannels := client.WhoisChannelsNames(target)
+	whoischannels := target.WhoisChannelsNames(client)
 	if whoischannels != nil {
-		client.Send(nil, client.server.name, RPL_WHOISCHANNELS, client.nick, target.nick, strings.Join(whoischannels, " "))
+		rb.Send(nil, client.server.name, RPL_WHOISCHANNELS, client.nick, target.nick, strings.Join(whoischannels, " "))
 	}
 	if target.class != nil {
-		client.Send(nil, client.server.name, RPL_WHOISOPERATOR, client.nick, target.nick, target.whoisLine)
+		rb.Send(nil, client.server.name, RPL_WHOISOPERATOR, client.nick, target.nick, target.whoisLine)
+	}
+	if client.hasFlag(Operator) || client == target {
+		rb.Send(nil, client.server.name, RPL_WHOISACTUALLY, client.nick, target.nick, fmt.Sprintf("%s@%s", target.username, LookupHostname(target.IPString())), target.IPString(), "Actual user@host, Actual IP")
 	}
-	if client.flags[Operator] || client == target {
-		client.Send(nil, client.server.name, RPL_WHOISACTUALLY, client.nick, target.nick, fmt.Sprintf("%s@%s", target.username, LookupHostname(target.IPString())), target.IPString(), "Actual user@host, Actual IP")
+	if target.hasFlag(TLS) {
+		rb.Send(nil, client.server.name, RPL_WHOISSECURE, client.nick, target.nick, "is using a secure connection")
 	}
-	if target.flags[TLS] {
-		client.Send(nil, client.server.name, RPL_WHOISSECURE, client.nick, target.nick, "is using a secure connection")
+	if target.certfp != "" && (client.hasFlag(Operator) || client == target) {
+		rb.Send(nil, client.server.name, RPL_WHOISCERTFP, client.nick, target.nick, fmt.Sprintf("has client certificate fingerprint %s", target.certfp))
 	}
-	if target.certfp != "" && (client.flags[Operator] || client == target) {
-		client.Send(nil, client.server.name, RPL_WHOISCERTFP, client.nick, target.nick, fmt.Sprintf("has client certificate fingerprint %s", target.certfp))
+	if target.isBot() {
+		rb.Send(nil, client.server.name, RPL_WHOISBOT, client.nick, target.nick, "is a bot")
 	}
-	client.Send(nil, client.server.name, RPL_WHOISIDLE, client.nick, target.nick, strconv.FormatUint(target.IdleSeconds(), 10), strconv.FormatInt(target.SignonTime(), 10), "seconds idle, signon time")
+	if client.hasFlag(Operator) {
+		client.server.cloneDetectorMutex.Lock()
+		subnet, clones := client.server.cloneDetector.Clones(target)
+		client.server.cloneDetectorMutex.Unlock()
+		if 0 < clones {
+			rb.Send(nil, client.server.name, RPL_WHOISSPECIAL, client.nick, target.nick, fmt.Sprintf("is one of %d clients connected from %s", clones, subnet))
+		}
+	}
+	if target.account != &NoAccount && target.account.Links != nil && (target.account.Links.IsPublic() || client.hasFlag(Operator) || client == target) {
+		for _, link := range target.account.Links.List() {
+			rb.Send(nil, client.server.name, RPL_WHOISSPECIAL, client.nick, target.nick, fmt.Sprintf("is linked to %s", link))
+		}
+	}
+	rb.Send(nil, client.server.name, RPL_WHOISIDLE, client.nick, target.nick, strconv.FormatUint(target.IdleSeconds(), 10), strconv.FormatInt(target.SignonTime(), 10), "seconds idle, signon time")
 }
 
 // RplWhoReplyNoMutex returns the WHO reply between one user and another channel/user.
 // <channel> <user> <host> <server> <nick> ( "H" / "G" ) ["*"] [ ( "@" / "+" ) ]
 // :<hopcount> <real name>
-func (target *Client) RplWhoReplyNoMutex(channel *Channel, client *Client) {
+func (target *Client) RplWhoReplyNoMutex(channel *Channel, client *Client, rb *ResponseBuffer) {
 	channelName := "*"
 	flags := ""
 
-	if client.flags[Away] {
+	if client.hasFlag(Away) {
 		flags = "G"
 	} else {
 		flags = "H"
 	}
-	if client.flags[Operator] {
+	if client.hasFlag(Operator) {
 		flags += "*"
 	}
 
 	if channel != nil {
-		flags += channel.members[client].Prefixes(target.capabilities[MultiPrefix])
+		flags += channel.members[client].Prefixes(target.hasCapability(MultiPrefix))
 		channelName = channel.name
 	}
-	target.Send(nil, target.server.name, RPL_WHOREPLY, target.nick, channelName, client.username, client.hostname, client.server.name, client.nick, flags, strconv.Itoa(client.hops)+" "+client.realname)
+	rb.Send(nil, target.server.name, RPL_WHOREPLY, target.nick, channelName, client.username, client.hostname, client.server.name, client.nick, flags, strconv.Itoa(client.hops)+" "+client.realname)
 }
 
-func whoChannel(client *Client, channel *Channel, friends ClientSet) {
+// whoChannel sends WHO replies for the channel's members. Invisible members are only
+// shown to other members of the channel, and secret channels are only shown to members.
+func whoChannel(client *Client, channel *Channel, sendReply func(*Channel, *Client)) {
 	channel.membersMutex.RLock()
 	defer channel.membersMutex.RUnlock()
 
+	isMember := client.hasFlag(Operator) || channel.members.Has(client)
+	if channel.flags[Secret] && !isMember {
+		return
+	}
 	for member := range channel.members {
-		if !client.flags[Invisible] || friends[client] {
-			client.RplWhoReplyNoMutex(channel, member)
+		if isMember || !member.hasFlag(Invisible) {
+			sendReply(channel, member)
+		}
+	}
+}
+
+// whoNick sends a WHO reply for the given client. If they share a channel with the client
+// asking, it's shown along with their prefixes there, so multi-prefix clients see them all.
+func whoNick(client *Client, target *Client, sendReply func(*Channel, *Client)) {
+	var shared *Channel
+	for channel := range target.channels {
+		channel.membersMutex.RLock()
+		isShared := channel.members.Has(client)
+		channel.membersMutex.RUnlock()
+		if isShared && (shared == nil || channel.nameCasefolded < shared.nameCasefolded) {
+			shared = channel
 		}
 	}
+	if shared == nil {
+		sendReply(nil, target)
+		return
+	}
+
+	shared.membersMutex.RLock()
+	defer shared.membersMutex.RUnlock()
+	// they could have parted since we looked
+	if shared.members.Has(target) {
+		sendReply(shared, target)
+	} else {
+		sendReply(nil, target)
+	}
+}
+
+// isWildcardWhoMask returns true if the given WHO mask could match lots of clients.
+func isWildcardWhoMask(mask string) bool {
+	return mask == "" || mask == "0" || strings.ContainsAny(mask, "*?")
 }
 
 // WHO [ <mask> [ "o" ] ]
-func whoHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func whoHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	// opers can filter by account, IP and oper status
+	if len(msg.Params) > 1 && msg.Params[1] != "" && client.hasFlag(Operator) {
+		server.operWhoFilter(client, msg.Params[0], msg.Params[1], rb)
+		return false
+	}
+
 	friends := client.Friends()
 
 	var mask string
 	if len(msg.Params) > 0 {
 		casefoldedMask, err := Casefold(msg.Params[0])
 		if err != nil {
-			client.Send(nil, server.name, ERR_UNKNOWNERROR, "WHO", "Mask isn't valid")
+			rb.Send(nil, server.name, ERR_UNKNOWNERROR, "WHO", "Mask isn't valid")
 			return false
 		}
 		mask = casefoldedMask
 	}
 
-	//TODO(dan): is this used and would I put this param in the Modern doc?
-	// if not, can we remove it?
-	//var operatorOnly bool
-	//if len(msg.Params) > 1 && msg.Params[1] == "o" {
-	//	operatorOnly = true
-	//}
+	// wildcard queries by non-opers are limited, so they can't be used to dump the user list
+	isWildcard := isWildcardWhoMask(mask)
+	var limit int
+	if isWildcard && !client.hasFlag(Operator) {
+		limit = server.limits.WildcardWhoResults
+	}
+	var count int
+	var truncated bool
+	sendReply := func(channel *Channel, target *Client) {
+		if 0 < limit && limit <= count {
+			truncated = true
+			return
+		}
+		client.RplWhoReplyNoMutex(channel, target, rb)
+		count++
+	}
 
-	if mask == "" {
+	if mask == "" || mask == "0" {
 		server.channels.ChansLock.RLock()
 		for _, channel := range server.channels.Chans {
-			whoChannel(client, channel, friends)
+			whoChannel(client, channel, sendReply)
 		}
 		server.channels.ChansLock.RUnlock()
 	} else if mask[0] == '#' {
@@ -1351,49 +1842,75 @@ func whoHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 		//TODO(dan): ^ only for opers
 		channel := server.channels.Get(mask)
 		if channel != nil {
-			whoChannel(client, channel, friends)
+			whoChannel(client, channel, sendReply)
 		}
 	} else {
 		for mclient := range server.clients.FindAll(mask) {
-			client.RplWhoReplyNoMutex(nil, mclient)
+			// invisible users only show up in wildcard queries for people they share a channel with
+			if isWildcard && mclient.hasFlag(Invisible) && !friends[mclient] && !client.hasFlag(Operator) {
+				continue
+			}
+			whoNick(client, mclient, sendReply)
 		}
 	}
 
-	client.Send(nil, server.name, RPL_ENDOFWHO, client.nick, mask, "End of WHO list")
+	if truncated {
+		rb.Send(nil, server.name, ERR_TOOMANYMATCHES, client.nick, "WHO", fmt.Sprintf("Too many matches, only showing the first %d", limit))
+	}
+	rb.Send(nil, server.name, RPL_ENDOFWHO, client.nick, mask, "End of WHO list")
 	return false
 }
 
 // OPER <name> <password>
-func operHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func operHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	name, err := CasefoldName(msg.Params[0])
 	if err != nil {
-		client.Send(nil, server.name, ERR_PASSWDMISMATCH, client.nick, "Password incorrect")
+		rb.Send(nil, server.name, ERR_PASSWDMISMATCH, client.nick, "Password incorrect")
 		return true
 	}
-	hash := server.operators[name].Pass
+	oper := server.operators[name]
+
+	// opers tied to an account don't need a password if they've logged into it
+	if len(msg.Params) < 2 {
+		accountKey, _ := CasefoldName(client.account.Name)
+		if oper.Account == "" || client.account == &NoAccount || accountKey != oper.Account {
+			rb.Send(nil, server.name, ERR_PASSWDMISMATCH, client.nick, "Password incorrect")
+			return true
+		}
+		server.operUp(client, name, "account", rb)
+		return false
+	}
+
+	hash := oper.Pass
 	password := []byte(msg.Params[1])
 
 	err = ComparePassword(hash, password)
 
 	if (hash == nil) || (err != nil) {
-		client.Send(nil, server.name, ERR_PASSWDMISMATCH, client.nick, "Password incorrect")
+		rb.Send(nil, server.name, ERR_PASSWDMISMATCH, client.nick, "Password incorrect")
 		return true
 	}
 
-	client.flags[Operator] = true
+	server.operUp(client, name, "password", rb)
+	return false
+}
+
+// operUp gives the client the privs of the named oper, once they've proven who they are
+// using the given method.
+func (server *Server) operUp(client *Client, name string, method string, rb *ResponseBuffer) {
+	client.stateMutex.Lock()
 	client.operName = name
+	client.stateMutex.Unlock()
+	client.setFlag(Operator, true)
 	client.class = server.operators[name].Class
+	server.currentOpersMutex.Lock()
 	server.currentOpers[client] = true
+	server.currentOpersMutex.Unlock()
 	client.whoisLine = server.operators[name].WhoisLine
 
 	// push new vhost if one is set
 	if len(server.operators[name].Vhost) > 0 {
-		for fClient := range client.Friends(ChgHost) {
-			fClient.SendFromClient("", client, nil, "CHGHOST", client.username, server.operators[name].Vhost)
-		}
-		// CHGHOST requires prefix nickmask to have original hostname, so do that before updating nickmask
-		client.vhost = server.operators[name].Vhost
-		client.updateNickMask()
+		client.setVhost(server.operators[name].Vhost)
 	}
 
 	// set new modes
@@ -1406,20 +1923,20 @@ func operHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 			for r := range unknownChanges {
 				runes += string(r)
 			}
-			client.Notice(fmt.Sprintf("Could not apply mode changes: +%s", runes))
+			rb.Notice(fmt.Sprintf("Could not apply mode changes: +%s", runes))
 		}
 	}
 
-	client.Send(nil, server.name, RPL_YOUREOPER, client.nick, "You are now an IRC operator")
+	rb.Send(nil, server.name, RPL_YOUREOPER, client.nick, "You are now an IRC operator")
 
 	applied = append(applied, ModeChange{
 		mode: Operator,
 		op:   Add,
 	})
-	client.Send(nil, server.name, "MODE", client.nick, applied.String())
+	rb.Send(nil, server.name, "MODE", client.nick, applied.String())
 
-	server.snomasks.Send(sno.LocalOpers, fmt.Sprintf(ircfmt.Unescape("Client opered up $c[grey][$r%s$c[grey], $r%s$c[grey]]"), client.nickMaskString, client.operName))
-	return false
+	server.logger.Info("opers", fmt.Sprintf("Client %s opered up as %s using %s", client.nickMaskString, client.operName, method))
+	server.snomasks.Send(sno.LocalOpers, fmt.Sprintf(ircfmt.Unescape("Client opered up $c[grey][$r%s$c[grey], $r%s$c[grey], $r%s$c[grey]]"), client.nickMaskString, client.operName, method))
 }
 
 // rehash reloads the config and applies the changes from the config file.
@@ -1437,6 +1954,10 @@ func (server *Server) rehash() error {
 	if err != nil {
 		return fmt.Errorf("Error rehashing config file config: %s", err.Error())
 	}
+	server.configWarnings = config.Warnings
+	for _, warning := range config.Warnings {
+		server.logger.Warning("config", warning.String())
+	}
 
 	// line lengths cannot be changed after launching the server
 	if server.limits.LineLen.Tags != config.Limits.LineLen.Tags || server.limits.LineLen.Rest != config.Limits.LineLen.Rest {
@@ -1455,21 +1976,40 @@ func (server *Server) rehash() error {
 		return fmt.Errorf("Error rehashing config file connection-throttle: %s", err.Error())
 	}
 
+	// confirm clone detection is fine
+	cloneDetector, err := NewCloneDetector(config.Server.CloneDetection)
+	if err != nil {
+		return fmt.Errorf("Error rehashing config file clone-detection: %s", err.Error())
+	}
+
+	// confirm client limits are fine
+	maxClients, err := NewMaxClients(config.Server.MaxClients)
+	if err != nil {
+		return fmt.Errorf("Error rehashing config file max-clients: %s", err.Error())
+	}
+
 	// confirm operator stuff all exists and is fine
 	operclasses, err := config.OperatorClasses()
 	if err != nil {
 		return fmt.Errorf("Error rehashing config file operclasses: %s", err.Error())
 	}
+	connectionClasses, err := config.ConnectionClasses()
+	if err != nil {
+		return fmt.Errorf("Error rehashing config file connection classes: %s", err.Error())
+	}
 	opers, err := config.Operators(operclasses)
 	if err != nil {
 		return fmt.Errorf("Error rehashing config file opers: %s", err.Error())
 	}
+	server.currentOpersMutex.RLock()
 	for client := range server.currentOpers {
 		_, exists := opers[client.operName]
 		if !exists {
+			server.currentOpersMutex.RUnlock()
 			return fmt.Errorf("Oper [%s] no longer exists (used by client [%s])", client.operName, client.nickMaskString)
 		}
 	}
+	server.currentOpersMutex.RUnlock()
 
 	// apply new connectionlimits
 	server.connectionLimitsMutex.Lock()
@@ -1488,6 +2028,23 @@ func (server *Server) rehash() error {
 	server.connectionThrottleMutex.Unlock()
 	server.connectionLimitsMutex.Unlock()
 
+	// recount clones, without warning about the ones that are already here
+	server.cloneDetectorMutex.Lock()
+	server.cloneDetector = cloneDetector
+	server.clients.ByNickMutex.RLock()
+	for _, client := range server.clients.ByNick {
+		if client.registered {
+			server.cloneDetector.AddClient(client)
+		}
+	}
+	server.clients.ByNickMutex.RUnlock()
+	server.cloneDetectorMutex.Unlock()
+
+	// apply new client limits
+	server.maxClientsMutex.Lock()
+	server.maxClients = maxClients
+	server.maxClientsMutex.Unlock()
+
 	// setup new and removed caps
 	addedCaps := make(CapabilitySet)
 	removedCaps := make(CapabilitySet)
@@ -1504,6 +2061,12 @@ func (server *Server) rehash() error {
 		SupportedCapabilities[SASL] = false
 		removedCaps[SASL] = true
 	}
+	saslValue := saslMechanisms(config)
+	if config.Accounts.AuthenticationEnabled && server.accountAuthenticationEnabled && saslValue != CapValues[SASL] {
+		// mechanisms changed
+		updatedCaps[SASL] = true
+	}
+	CapValues[SASL] = saslValue
 	server.accountAuthenticationEnabled = config.Accounts.AuthenticationEnabled
 
 	// STS
@@ -1526,6 +2089,31 @@ func (server *Server) rehash() error {
 		updatedCaps[STS] = true
 	}
 	server.stsEnabled = config.Server.STS.Enabled
+	server.stsPort = config.Server.STS.Port
+
+	// message redaction, which is only used when messages can be retracted from history
+	redactionEnabled := config.History.Enabled && config.History.Retraction.Enabled()
+	if redactionEnabled && !SupportedCapabilities[MessageRedaction] {
+		SupportedCapabilities[MessageRedaction] = true
+		addedCaps[MessageRedaction] = true
+	} else if !redactionEnabled && SupportedCapabilities[MessageRedaction] {
+		SupportedCapabilities[MessageRedaction] = false
+		removedCaps[MessageRedaction] = true
+	}
+
+	// multiline, whose limits are in its value
+	multilineValue := config.Limits.Multiline.Value()
+	if config.Limits.Multiline.Enabled() && !SupportedCapabilities[Multiline] {
+		SupportedCapabilities[Multiline] = true
+		addedCaps[Multiline] = true
+		CapValues[Multiline] = multilineValue
+	} else if !config.Limits.Multiline.Enabled() && SupportedCapabilities[Multiline] {
+		SupportedCapabilities[Multiline] = false
+		removedCaps[Multiline] = true
+	} else if config.Limits.Multiline.Enabled() && multilineValue != CapValues[Multiline] {
+		CapValues[Multiline] = multilineValue
+		updatedCaps[Multiline] = true
+	}
 
 	// burst new and removed caps
 	var capBurstClients ClientSet
@@ -1545,6 +2133,15 @@ func (server *Server) rehash() error {
 	if len(addedCaps) > 0 || len(removedCaps) > 0 {
 		capBurstClients = server.clients.AllWithCaps(CapNotify)
 
+		// removed caps are turned off for everyone, whether they hear about it or not
+		server.clients.ByNickMutex.RLock()
+		for _, sClient := range server.clients.ByNick {
+			for capab := range removedCaps {
+				sClient.setCapabilities(false, capab)
+			}
+		}
+		server.clients.ByNickMutex.RUnlock()
+
 		added[Cap301] = addedCaps.String(Cap301)
 		added[Cap302] = addedCaps.String(Cap302)
 		// removed never has values
@@ -1578,35 +2175,120 @@ func (server *Server) rehash() error {
 		Rest: config.Limits.LineLen.Rest,
 	}
 	server.limits = Limits{
-		AwayLen:        int(config.Limits.AwayLen),
-		ChannelLen:     int(config.Limits.ChannelLen),
-		KickLen:        int(config.Limits.KickLen),
-		MonitorEntries: int(config.Limits.MonitorEntries),
-		NickLen:        int(config.Limits.NickLen),
-		TopicLen:       int(config.Limits.TopicLen),
-		ChanListModes:  int(config.Limits.ChanListModes),
-		LineLen:        lineLenConfig,
-	}
+		AwayLen:            int(config.Limits.AwayLen),
+		ChannelLen:         int(config.Limits.ChannelLen),
+		KickLen:            int(config.Limits.KickLen),
+		MonitorEntries:     int(config.Limits.MonitorEntries),
+		NickLen:            int(config.Limits.NickLen),
+		TopicLen:           int(config.Limits.TopicLen),
+		ChanListModes:      int(config.Limits.ChanListModes),
+		LineLen:            lineLenConfig,
+		Multiline:          config.Limits.Multiline,
+		WildcardWhoResults: int(config.Limits.WildcardWhoResults),
+		OperWhoResults:     int(config.Limits.OperWhoResults),
+		Modes:              int(config.Limits.Modes),
+		TargMax:            config.Limits.TargMaxReal,
+	}
+	server.modeCoalescing = config.Channels.ModeCoalescing
+	server.channelInvites = config.Channels.Invites
+	server.webhooks = config.Channels.Webhooks
+	server.linePolicy = NewLinePolicy(config.Server.LineParsing, config.Server.UTF8Only)
+	server.typingPolicy = NewTypingPolicy(config.Server.Typing)
+	server.pasteDetection = config.Server.PasteDetection
+	server.missedHighlights = config.Accounts.MissedHighlights
+	server.vhosts = config.Accounts.VHosts
+	server.nickCollision = config.Server.NickCollision
+	server.quitMessages = config.Server.QuitMessages
+	server.structuredNotices = config.Server.StructuredNotices
+	server.networkMap = config.Server.NetworkMap
+	server.whoisChannels = config.Server.WhoisChannels
+	server.motdLines = loadMOTD(config.Server.MOTD)
+	server.updateRateLimits(config.Server.RateLimits)
+	server.schedules = config.Schedules
+	server.activeSchedules = config.ActiveSchedules
+	server.snapshots = config.Datastore.Snapshots
+	// only change read-only mode if the config changed, so we don't undo a READONLY command
+	if config.Datastore.ReadOnly != server.readOnlyConfigured {
+		server.setReadOnly(config.Datastore.ReadOnly, "")
+		server.readOnlyConfigured = config.Datastore.ReadOnly
+	}
+	server.externalLinks = config.Accounts.ExternalLinks
+	server.ldap = config.Accounts.LDAP
+	server.oauth2 = config.Accounts.OAuth2
+	server.nickserv = config.Accounts.NickServ
+	server.nickEnforcement = config.Accounts.NickEnforcement
+	server.mailto = config.Accounts.Registration.Callbacks.Mailto
+	server.sms = config.Accounts.Registration.Callbacks.SMS
+	oldCaptcha := server.captcha
+	server.captcha = config.Accounts.Registration.Callbacks.Captcha
+	server.passwordReset = config.Accounts.PasswordReset
+	server.accountExpiryMutex.Lock()
+	server.accountExpiry = config.Accounts.Expiry
+	server.accountExpiryMutex.Unlock()
+	server.bots = config.Accounts.Bots
 	server.operclasses = *operclasses
 	server.operators = opers
 	server.checkIdent = config.Server.CheckIdent
 
+	// the mail gateway's addresses apply to new connections straight away, but its listener
+	// is only restarted if it's been moved or turned on or off
+	oldMailGateway := server.mailGateway
+	server.mailGateway = config.Server.MailGateway
+	if oldMailGateway.Enabled != server.mailGateway.Enabled || oldMailGateway.Listen != server.mailGateway.Listen {
+		server.stopMailGateway()
+		if server.mailGateway.Enabled {
+			if err := server.startMailGateway(); err != nil {
+				server.logger.Error("rehash", fmt.Sprintf("Could not start mail gateway: %s", err.Error()))
+			} else {
+				server.logger.Info("rehash", fmt.Sprintf("%s mail gateway listening on %s", server.name, server.mailGateway.Listen))
+			}
+		}
+	}
+
+	// and the control socket, which keeps any connections that are already open
+	oldControlSocket := server.controlSocket
+	server.controlSocket = config.Server.ControlSocket
+	if oldControlSocket != server.controlSocket {
+		server.stopControlSocket()
+		if server.controlSocket.Enabled {
+			if err := server.startControlSocket(); err != nil {
+				server.logger.Error("rehash", fmt.Sprintf("Could not start control socket: %s", err.Error()))
+			} else {
+				server.logger.Info("rehash", fmt.Sprintf("%s control socket listening on %s", server.name, server.controlSocket.Path))
+			}
+		}
+	}
+
+	// the same goes for the captcha pages
+	if oldCaptcha.Enabled() != server.captcha.Enabled() || oldCaptcha.Listen != server.captcha.Listen {
+		server.stopCaptchaListener()
+		if server.captcha.Enabled() {
+			if err := server.startCaptchaListener(); err != nil {
+				server.logger.Error("rehash", fmt.Sprintf("Could not start captcha listener: %s", err.Error()))
+			} else {
+				server.logger.Info("rehash", fmt.Sprintf("%s captcha pages listening on %s", server.name, server.captcha.Listen))
+			}
+		}
+	}
+
 	// registration
 	accountReg := NewAccountRegistration(config.Accounts.Registration)
 	server.accountRegistration = &accountReg
 	server.channelRegistrationEnabled = config.Channels.Registration.Enabled
+	server.channelRegistration = config.Channels.Registration
+	server.channelsKickInsecure = config.Channels.KickInsecureMembers
 
-	// set new sendqueue size
-	if config.Server.MaxSendQBytes != server.MaxSendQBytes {
-		server.MaxSendQBytes = config.Server.MaxSendQBytes
+	// history, the cold storage can't be opened or closed after launching the server so
+	// these only apply to newly-created channels
+	server.historyEnabled = config.History.Enabled
+	server.historyRetraction = config.History.Retraction
+	server.historyChannelLength = config.History.ChannelLength
+	server.historyDirectMessages = config.History.DirectMessages
 
-		// update on all clients
-		server.clients.ByNickMutex.RLock()
-		for _, sClient := range server.clients.ByNick {
-			sClient.socket.MaxSendQBytes = config.Server.MaxSendQBytes
-		}
-		server.clients.ByNickMutex.RUnlock()
-	}
+	// set new sendqueue size and connection classes, and update them on all clients
+	server.MaxSendQBytes = config.Server.MaxSendQBytes
+	server.connectionClasses = connectionClasses
+	server.updateConnectionClasses()
 
 	// set RPL_ISUPPORT
 	oldISupportList := server.isupport
@@ -1623,6 +2305,11 @@ func (server *Server) rehash() error {
 	}
 	server.clients.ByNickMutex.RUnlock()
 
+	// update listener options, these apply to new connections
+	server.listenerUpdateMutex.Lock()
+	server.listenerConfigs = config.ListenerConfigs()
+	server.listenerUpdateMutex.Unlock()
+
 	// destroy old listeners
 	tlsListeners := config.TLSListeners()
 	for addr := range server.listeners {
@@ -1661,25 +2348,32 @@ func (server *Server) rehash() error {
 		}
 	}
 
+	markChangedFeatures(server.features, config.Features)
+	server.features = config.Features
 	return nil
 }
 
 // REHASH
-func rehashHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func rehashHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	server.logger.Info("rehash", fmt.Sprintf("REHASH command used by %s", client.nick))
 	err := server.rehash()
 
 	if err == nil {
-		client.Send(nil, server.name, RPL_REHASHING, client.nick, "ircd.yaml", "Rehashing")
+		rb.Send(nil, server.name, RPL_REHASHING, client.nick, "ircd.yaml", "Rehashing")
+		server.rehashMutex.Lock()
+		for _, warning := range server.configWarnings {
+			rb.Notice(fmt.Sprintf("Config warning: %s", warning.String()))
+		}
+		server.rehashMutex.Unlock()
 	} else {
 		server.logger.Error("rehash", fmt.Sprintln("Failed to rehash:", err.Error()))
-		client.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "REHASH", err.Error())
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "REHASH", err.Error())
 	}
 	return false
 }
 
 // AWAY [<message>]
-func awayHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func awayHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	var isAway bool
 	var text string
 	if len(msg.Params) > 0 {
@@ -1690,31 +2384,28 @@ func awayHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 		}
 	}
 
-	if isAway {
-		client.flags[Away] = true
-	} else {
-		delete(client.flags, Away)
-	}
+	client.setFlag(Away, isAway)
 	client.awayMessage = text
 
 	var op ModeOp
-	if client.flags[Away] {
+	if client.hasFlag(Away) {
 		op = Add
-		client.Send(nil, server.name, RPL_NOWAWAY, client.nick, "You have been marked as being away")
+		rb.Send(nil, server.name, RPL_NOWAWAY, client.nick, "You have been marked as being away")
 	} else {
 		op = Remove
-		client.Send(nil, server.name, RPL_UNAWAY, client.nick, "You are no longer marked as being away")
+		rb.Send(nil, server.name, RPL_UNAWAY, client.nick, "You are no longer marked as being away")
+		client.sendMissedHighlightsStatus(rb)
 	}
 	//TODO(dan): Should this be sent automagically as part of setting the flag/mode?
 	modech := ModeChanges{ModeChange{
 		mode: Away,
 		op:   op,
 	}}
-	client.Send(nil, server.name, "MODE", client.nick, client.nick, modech.String())
+	rb.Send(nil, server.name, "MODE", client.nick, client.nick, modech.String())
 
 	// dispatch away-notify
 	for friend := range client.Friends(AwayNotify) {
-		if client.flags[Away] {
+		if client.hasFlag(Away) {
 			friend.SendFromClient("", client, nil, "AWAY", client.awayMessage)
 		} else {
 			friend.SendFromClient("", client, nil, "AWAY")
@@ -1725,7 +2416,7 @@ func awayHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 }
 
 // ISON <nick>{ <nick>}
-func isonHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func isonHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	var nicks = msg.Params
 
 	var err error
@@ -1741,36 +2432,29 @@ func isonHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 		}
 	}
 
-	client.Send(nil, server.name, RPL_ISON, client.nick, strings.Join(nicks, " "))
+	rb.Send(nil, server.name, RPL_ISON, client.nick, strings.Join(nicks, " "))
 	return false
 }
 
 // MOTD [<target>]
-func motdHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func motdHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	//TODO(dan): hook this up when we have multiple servers I guess???
 	//var target string
 	//if len(msg.Params) > 0 {
 	//	target = msg.Params[0]
 	//}
 
-	server.MOTD(client)
+	server.MOTD(client, rb)
 	return false
 }
 
 // NOTICE <target>{,<target>} <message>
-func noticeHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func noticeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	clientOnlyTags := GetClientOnlyTags(msg.Tags)
-	targets := strings.Split(msg.Params[0], ",")
+	targets := client.limitTargets("NOTICE", strings.Split(msg.Params[0], ","), rb)
 	message := msg.Params[1]
 
-	// split privmsg
-	splitMsg := server.splitMessage(message, !client.capabilities[MaxLine])
-
-	for i, targetString := range targets {
-		// max of four targets per privmsg
-		if i > maxTargets-1 {
-			break
-		}
+	for _, targetString := range targets {
 		prefixes, targetString := SplitChannelMembershipPrefixes(targetString)
 		lowestPrefix := GetLowestChannelModePrefix(prefixes)
 
@@ -1785,8 +2469,21 @@ func noticeHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 				// errors silently ignored with NOTICE as per RFC
 				continue
 			}
+			channelMessage, allowed := channel.applyMessagePolicy(client, "NOTICE", message)
+			if !allowed {
+				continue
+			}
+			if allowed, _ := channel.CheckSlowMode(client); !allowed {
+				// errors silently ignored with NOTICE as per RFC
+				continue
+			}
+			channelSplitMsg, allowed := server.splitMessage(client, "NOTICE", channel.name, channelMessage)
+			if !allowed {
+				client.sendMessageTooLong("NOTICE", channel.name, rb)
+				continue
+			}
 			msgid := server.generateMessageID()
-			channel.SplitNotice(msgid, lowestPrefix, clientOnlyTags, client, splitMsg)
+			channel.SplitNotice(msgid, lowestPrefix, channel.validateReferenceTags(clientOnlyTags), client, channelSplitMsg, rb)
 		} else {
 			target, err := CasefoldName(targetString)
 			if err != nil {
@@ -1795,9 +2492,12 @@ func noticeHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 			if target == "chanserv" {
 				server.chanservReceiveNotice(client, message)
 				continue
-			} else if target == "nickserv" {
+			} else if server.isNickServ(target) {
 				server.nickservReceiveNotice(client, message)
 				continue
+			} else if target == "hostserv" {
+				server.hostservReceiveNotice(client, message)
+				continue
 			}
 
 			user := server.clients.Get(target)
@@ -1805,13 +2505,29 @@ func noticeHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 				// errors silently ignored with NOTICE as per RFC
 				continue
 			}
-			if !user.capabilities[MessageTags] {
-				clientOnlyTags = nil
+			if !user.canMessage(client, true) {
+				// errors silently ignored with NOTICE as per RFC
+				continue
+			}
+			splitMsg, allowed := server.splitMessage(client, "NOTICE", user.nick, message)
+			if !allowed {
+				client.sendMessageTooLong("NOTICE", user.nick, rb)
+				continue
+			}
+			// the sender's echo gets the same tags, msgid and time as the target sees
+			userTags := clientOnlyTags
+			if !user.hasCapability(MessageTags) {
+				userTags = nil
 			}
 			msgid := server.generateMessageID()
-			user.SendSplitMsgFromClient(msgid, client, clientOnlyTags, "NOTICE", user.nick, splitMsg)
-			if client.capabilities[EchoMessage] {
-				client.SendSplitMsgFromClient(msgid, client, clientOnlyTags, "NOTICE", user.nick, splitMsg)
+			server.recordDirectMessage(client, user, history.Notice, msgid, clientOnlyTags, message)
+			user.SendSplitMsgFromClient(msgid, client, userTags, "NOTICE", user.nick, splitMsg)
+			if client.hasCapability(EchoMessage) {
+				echoTags := clientOnlyTags
+				if !client.hasCapability(MessageTags) {
+					echoTags = nil
+				}
+				rb.SendSplitMsgFromClient(msgid, client, echoTags, "NOTICE", user.nick, splitMsg)
 			}
 		}
 	}
@@ -1819,14 +2535,16 @@ func noticeHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 }
 
 // KICK <channel>{,<channel>} <user>{,<user>} [<comment>]
-func kickHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func kickHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	channels := strings.Split(msg.Params[0], ",")
 	users := strings.Split(msg.Params[1], ",")
 	if (len(channels) != len(users)) && (len(users) != 1) {
-		client.Send(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, "KICK", "Not enough parameters")
+		rb.Send(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, "KICK", "Not enough parameters")
 		return false
 	}
 
+	channels = client.limitTargets("KICK", channels, rb)
+
 	var kicks [][]string
 	for index, channel := range channels {
 		if len(users) == 1 {
@@ -1846,14 +2564,14 @@ func kickHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 		casefoldedChname, err := CasefoldChannel(chname)
 		channel := server.channels.Get(casefoldedChname)
 		if err != nil || channel == nil {
-			client.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, chname, "No such channel")
+			rb.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, chname, "No such channel")
 			continue
 		}
 
 		casefoldedNickname, err := CasefoldName(nickname)
 		target := server.clients.Get(casefoldedNickname)
 		if err != nil || target == nil {
-			client.Send(nil, server.name, ERR_NOSUCHNICK, nickname, "No such nick")
+			rb.Send(nil, server.name, ERR_NOSUCHNICK, nickname, "No such nick")
 			continue
 		}
 
@@ -1882,9 +2600,9 @@ func kickHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 			if comment == "" {
 				comment = nickname
 			}
-			channel.kickNoMutex(client, target, comment)
+			channel.kickNoMutex(client, target, comment, rb)
 		} else {
-			client.Send(nil, client.server.name, ERR_CHANOPRIVSNEEDED, chname, "You're not a channel operator")
+			rb.Send(nil, client.server.name, ERR_CHANOPRIVSNEEDED, chname, "You're not a channel operator")
 		}
 
 		channel.membersMutex.Unlock()
@@ -1921,7 +2639,7 @@ func (matcher *elistMatcher) Matches(channel *Channel) bool {
 }
 
 // LIST [<channel>{,<channel>}] [<elistcond>{,<elistcond>}]
-func listHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func listHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	// get channels
 	var channels []string
 	for _, param := range msg.Params {
@@ -1934,6 +2652,8 @@ func listHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 		}
 	}
 
+	channels = client.limitTargets("LIST", channels, rb)
+
 	// get elist conditions
 	var matcher elistMatcher
 	for _, param := range msg.Params {
@@ -1964,60 +2684,60 @@ func listHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 	if len(channels) == 0 {
 		server.channels.ChansLock.RLock()
 		for _, channel := range server.channels.Chans {
-			if !client.flags[Operator] && channel.flags[Secret] {
+			if !client.hasFlag(Operator) && channel.flags[Secret] {
 				continue
 			}
 			if matcher.Matches(channel) {
-				client.RplList(channel)
+				client.RplList(channel, rb)
 			}
 		}
 		server.channels.ChansLock.RUnlock()
 	} else {
 		// limit regular users to only listing one channel
-		if !client.flags[Operator] {
+		if !client.hasFlag(Operator) {
 			channels = channels[:1]
 		}
 
 		for _, chname := range channels {
 			casefoldedChname, err := CasefoldChannel(chname)
 			channel := server.channels.Get(casefoldedChname)
-			if err != nil || channel == nil || (!client.flags[Operator] && channel.flags[Secret]) {
+			if err != nil || channel == nil || (!client.hasFlag(Operator) && channel.flags[Secret]) {
 				if len(chname) > 0 {
-					client.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, chname, "No such channel")
+					rb.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, chname, "No such channel")
 				}
 				continue
 			}
 			if matcher.Matches(channel) {
-				client.RplList(channel)
+				client.RplList(channel, rb)
 			}
 		}
 	}
-	client.Send(nil, server.name, RPL_LISTEND, client.nick, "End of LIST")
+	rb.Send(nil, server.name, RPL_LISTEND, client.nick, "End of LIST")
 	return false
 }
 
 // RplList returns the RPL_LIST numeric for the given channel.
-func (target *Client) RplList(channel *Channel) {
+func (target *Client) RplList(channel *Channel, rb *ResponseBuffer) {
 	channel.membersMutex.RLock()
 	defer channel.membersMutex.RUnlock()
 
 	// get the correct number of channel members
 	var memberCount int
-	if target.flags[Operator] || channel.members.Has(target) {
+	if target.hasFlag(Operator) || channel.members.Has(target) {
 		memberCount = len(channel.members)
 	} else {
 		for member := range channel.members {
-			if !member.flags[Invisible] {
+			if !member.hasFlag(Invisible) {
 				memberCount++
 			}
 		}
 	}
 
-	target.Send(nil, target.server.name, RPL_LIST, target.nick, channel.name, strconv.Itoa(memberCount), channel.topic)
+	rb.Send(nil, target.server.name, RPL_LIST, target.nick, channel.name, strconv.Itoa(memberCount), channel.topic)
 }
 
 // NAMES [<channel>{,<channel>}]
-func namesHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func namesHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	var channels []string
 	if len(msg.Params) > 0 {
 		channels = strings.Split(msg.Params[0], ",")
@@ -2030,89 +2750,95 @@ func namesHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 	if len(channels) == 0 {
 		server.channels.ChansLock.RLock()
 		for _, channel := range server.channels.Chans {
-			channel.Names(client)
+			if channel.flags[Secret] && !client.channels[channel] && !client.hasFlag(Operator) {
+				continue
+			}
+			channel.Names(client, rb)
 		}
 		server.channels.ChansLock.RUnlock()
 		return false
 	}
 
-	// limit regular users to only listing one channel
-	if !client.flags[Operator] {
-		channels = channels[:1]
-	}
+	channels = client.limitTargets("NAMES", channels, rb)
 
 	for _, chname := range channels {
 		casefoldedChname, err := CasefoldChannel(chname)
 		channel := server.channels.Get(casefoldedChname)
 		if err != nil || channel == nil {
 			if len(chname) > 0 {
-				client.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, chname, "No such channel")
+				rb.Send(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, chname, "No such channel")
 			}
 			continue
 		}
-		channel.Names(client)
+		channel.Names(client, rb)
 	}
 	return false
 }
 
 // VERSION [<server>]
-func versionHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func versionHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	var target string
 	if len(msg.Params) > 0 {
 		target = msg.Params[0]
 	}
 	casefoldedTarget, err := Casefold(target)
 	if target != "" && (err != nil || casefoldedTarget != server.nameCasefolded) {
-		client.Send(nil, server.name, ERR_NOSUCHSERVER, client.nick, target, "No such server")
+		rb.Send(nil, server.name, ERR_NOSUCHSERVER, client.nick, target, "No such server")
 		return false
 	}
 
-	client.Send(nil, server.name, RPL_VERSION, client.nick, Ver, server.name)
-	client.RplISupport()
+	rb.Send(nil, server.name, RPL_VERSION, client.nick, Ver, server.name)
+	client.RplISupport(rb)
 	return false
 }
 
 // INVITE <nickname> <channel>
-func inviteHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func inviteHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	nickname := msg.Params[0]
 	channelName := msg.Params[1]
 
 	casefoldedNickname, err := CasefoldName(nickname)
 	target := server.clients.Get(casefoldedNickname)
 	if err != nil || target == nil {
-		client.Send(nil, server.name, ERR_NOSUCHNICK, client.nick, nickname, "No such nick")
+		rb.Send(nil, server.name, ERR_NOSUCHNICK, client.nick, nickname, "No such nick")
 		return false
 	}
 
 	casefoldedChannelName, err := CasefoldChannel(channelName)
 	channel := server.channels.Get(casefoldedChannelName)
 	if err != nil || channel == nil {
-		client.Send(nil, server.name, RPL_INVITING, client.nick, target.nick, channelName)
-		target.Send(nil, client.nickMaskString, "INVITE", target.nick, channel.name)
-		return true
+		if !server.allowInvite(client) {
+			rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "INVITE", "You're sending invites too quickly, try again later")
+			return false
+		}
+		rb.Send(nil, server.name, RPL_INVITING, client.nick, target.nick, channelName)
+		if target.acceptsInviteFrom(client) {
+			target.SendFromClient("", client, nil, "INVITE", target.nick, channelName)
+		}
+		return false
 	}
 
-	channel.Invite(target, client)
+	channel.Invite(target, client, rb)
 	return false
 }
 
 // TIME [<server>]
-func timeHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func timeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	var target string
 	if len(msg.Params) > 0 {
 		target = msg.Params[0]
 	}
 	casefoldedTarget, err := Casefold(target)
 	if (target != "") && err != nil || (casefoldedTarget != server.nameCasefolded) {
-		client.Send(nil, server.name, ERR_NOSUCHSERVER, client.nick, target, "No such server")
+		rb.Send(nil, server.name, ERR_NOSUCHSERVER, client.nick, target, "No such server")
 		return false
 	}
-	client.Send(nil, server.name, RPL_TIME, client.nick, server.name, time.Now().Format(time.RFC1123))
+	rb.Send(nil, server.name, RPL_TIME, client.nick, server.name, time.Now().Format(time.RFC1123))
 	return false
 }
 
 // KILL <nickname> <comment>
-func killHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func killHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	nickname := msg.Params[0]
 	comment := "<no reason supplied>"
 	if len(msg.Params) > 1 {
@@ -2122,7 +2848,7 @@ func killHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 	casefoldedNickname, err := CasefoldName(nickname)
 	target := server.clients.Get(casefoldedNickname)
 	if err != nil || target == nil {
-		client.Send(nil, client.server.name, ERR_NOSUCHNICK, nickname, "No such nick")
+		rb.Send(nil, client.server.name, ERR_NOSUCHNICK, nickname, "No such nick")
 		return false
 	}
 
@@ -2130,6 +2856,9 @@ func killHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 
 	server.snomasks.Send(sno.LocalKills, fmt.Sprintf(ircfmt.Unescape("%s$r was killed by %s $c[grey][$r%s$c[grey]]"), target.nick, client.nick, comment))
 	target.exitedSnomaskSent = true
+	if server.historyRetraction.OnKill {
+		server.retractRecentMessages(target, quitMsg)
+	}
 
 	target.Quit(quitMsg)
 	target.destroy()
@@ -2137,7 +2866,7 @@ func killHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 }
 
 // WHOWAS <nickname> [<count> [<server>]]
-func whowasHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func whowasHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	nicknames := strings.Split(msg.Params[0], ",")
 
 	var count int64
@@ -2152,22 +2881,22 @@ func whowasHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 		results := server.whoWas.Find(nickname, count)
 		if len(results) == 0 {
 			if len(nickname) > 0 {
-				client.Send(nil, server.name, ERR_WASNOSUCHNICK, client.nick, nickname, "There was no such nickname")
+				rb.Send(nil, server.name, ERR_WASNOSUCHNICK, client.nick, nickname, "There was no such nickname")
 			}
 		} else {
 			for _, whoWas := range results {
-				client.Send(nil, server.name, RPL_WHOWASUSER, client.nick, whoWas.nickname, whoWas.username, whoWas.hostname, "*", whoWas.realname)
+				rb.Send(nil, server.name, RPL_WHOWASUSER, client.nick, whoWas.nickname, whoWas.username, whoWas.hostname, "*", whoWas.realname)
 			}
 		}
 		if len(nickname) > 0 {
-			client.Send(nil, server.name, RPL_ENDOFWHOWAS, client.nick, nickname, "End of WHOWAS")
+			rb.Send(nil, server.name, RPL_ENDOFWHOWAS, client.nick, nickname, "End of WHOWAS")
 		}
 	}
 	return false
 }
 
 // LUSERS [<mask> [<server>]]
-func lusersHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func lusersHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	//TODO(vegax87) Fix network statistics and additional parameters
 	var totalcount, invisiblecount, opercount int
 
@@ -2176,33 +2905,35 @@ func lusersHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
 
 	for _, onlineusers := range server.clients.ByNick {
 		totalcount++
-		if onlineusers.flags[Invisible] {
+		if onlineusers.hasFlag(Invisible) {
 			invisiblecount++
 		}
-		if onlineusers.flags[Operator] {
+		if onlineusers.hasFlag(Operator) {
 			opercount++
 		}
 	}
-	client.Send(nil, server.name, RPL_LUSERCLIENT, client.nick, fmt.Sprintf("There are %d users and %d invisible on %d server(s)", totalcount, invisiblecount, 1))
-	client.Send(nil, server.name, RPL_LUSEROP, client.nick, fmt.Sprintf("%d IRC Operators online", opercount))
-	client.Send(nil, server.name, RPL_LUSERCHANNELS, client.nick, fmt.Sprintf("%d channels formed", server.channels.Len()))
-	client.Send(nil, server.name, RPL_LUSERME, client.nick, fmt.Sprintf("I have %d clients and %d servers", totalcount, 1))
+	rb.Send(nil, server.name, RPL_LUSERCLIENT, client.nick, fmt.Sprintf("There are %d users and %d invisible on %d server(s)", totalcount, invisiblecount, 1))
+	rb.Send(nil, server.name, RPL_LUSEROP, client.nick, fmt.Sprintf("%d IRC Operators online", opercount))
+	rb.Send(nil, server.name, RPL_LUSERCHANNELS, client.nick, fmt.Sprintf("%d channels formed", server.channels.Len()))
+	rb.Send(nil, server.name, RPL_LUSERME, client.nick, fmt.Sprintf("I have %d clients and %d servers", totalcount, 1))
+	server.maxClientsMutex.Lock()
+	maxcount := server.maxClients.Limit()
+	server.maxClientsMutex.Unlock()
+	if maxcount > 0 {
+		rb.Send(nil, server.name, RPL_LOCALUSERS, client.nick, strconv.Itoa(totalcount), strconv.Itoa(maxcount), fmt.Sprintf("Current local users %d, max %d", totalcount, maxcount))
+	}
 	return false
 }
 
 // USERHOST <nickname> [<nickname> <nickname> ...]
-func userhostHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool {
+func userhostHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	returnedNicks := make(map[string]bool)
 
-	for i, nickname := range msg.Params {
-		if i >= 10 {
-			break
-		}
-
+	for _, nickname := range client.limitTargets("USERHOST", msg.Params, rb) {
 		casefoldedNickname, err := CasefoldName(nickname)
 		target := server.clients.Get(casefoldedNickname)
 		if err != nil || target == nil {
-			client.Send(nil, client.server.name, ERR_NOSUCHNICK, nickname, "No such nick")
+			rb.Send(nil, client.server.name, ERR_NOSUCHNICK, nickname, "No such nick")
 			return false
 		}
 		if returnedNicks[casefoldedNickname] {
@@ -2214,15 +2945,15 @@ func userhostHandler(server *Server, client *Client, msg ircmsg.IrcMessage) bool
 
 		var isOper, isAway string
 
-		if target.flags[Operator] {
+		if target.hasFlag(Operator) {
 			isOper = "*"
 		}
-		if target.flags[Away] {
+		if target.hasFlag(Away) {
 			isAway = "-"
 		} else {
 			isAway = "+"
 		}
-		client.Send(nil, client.server.name, RPL_USERHOST, client.nick, fmt.Sprintf("%s%s=%s%s@%s", target.nick, isOper, isAway, target.username, target.hostname))
+		rb.Send(nil, client.server.name, RPL_USERHOST, client.nick, fmt.Sprintf("%s%s=%s%s@%s", target.nick, isOper, isAway, target.username, target.hostname))
 	}
 
 	return false
@@ -0,0 +1,569 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errUnknownImportFormat = errors.New("Unknown database format, it must be atheme or anope")
+	errAnopeSQL            = errors.New("This looks like an SQL dump, export the database with Anope's db_flatfile module instead")
+)
+
+// ImportedAccount is an account read from another services package's database.
+type ImportedAccount struct {
+	Name string
+	// Password is the account's plaintext password, for databases that store them that way.
+	Password string
+	// PasswordHash is the account's password hash, if it's one we can check.
+	PasswordHash string
+	Email        string
+	RegisteredAt time.Time
+	LastSeen     time.Time
+	Vhost        string
+	Certfps      []string
+	// Nicks are the nicknames grouped with the account, not including its name.
+	Nicks []string
+}
+
+// ImportedChannel is a registered channel read from another services package's database.
+type ImportedChannel struct {
+	Name string
+	// Founder is the name of the founder's account.
+	Founder      string
+	RegisteredAt time.Time
+	Topic        string
+	TopicSetBy   string
+	TopicSetTime time.Time
+	// Access maps account names to the mode they get in the channel.
+	Access  map[string]Mode
+	Banlist []string
+}
+
+// ServicesDB is everything we can import from another services package's database.
+type ServicesDB struct {
+	Accounts []*ImportedAccount
+	Channels []*ImportedChannel
+}
+
+// ImportResult is the outcome of importing a database with ImportServicesDB.
+type ImportResult struct {
+	Accounts int
+	Nicks    int
+	Vhosts   int
+	Channels int
+	// NoPassword are the accounts imported without a password we can check. Their users must
+	// use NS SENDPASS or a certificate to get back into them.
+	NoPassword []string
+	// Skipped explains what couldn't be imported.
+	Skipped []string
+}
+
+// ParseServicesDB reads a database dump in the given format, atheme or anope.
+func ParseServicesDB(r io.Reader, format string) (*ServicesDB, error) {
+	switch strings.ToLower(format) {
+	case "atheme":
+		return ParseAthemeDB(r)
+	case "anope":
+		return ParseAnopeDB(r)
+	default:
+		return nil, errUnknownImportFormat
+	}
+}
+
+// parseUnixTime parses a unix timestamp from a database, returning the zero time if it's
+// missing or invalid.
+func parseUnixTime(value string) time.Time {
+	timestamp, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || timestamp <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(timestamp, 0)
+}
+
+// importedHash returns the password hash if it's one we can check passwords against.
+func importedHash(hash string) string {
+	if legacyHashSupported(hash) {
+		return hash
+	}
+	return ""
+}
+
+// importedAccessMode returns the channel mode given by a set of access flags. Atheme and Anope
+// use the same letters for these.
+func importedAccessMode(flags string) Mode {
+	switch {
+	case strings.ContainsAny(flags, "Fqa"):
+		return ChannelAdmin
+	case strings.ContainsAny(flags, "oO"):
+		return ChannelOperator
+	case strings.ContainsAny(flags, "hH"):
+		return Halfop
+	case strings.ContainsAny(flags, "vV"):
+		return Voice
+	}
+	return Mode(0)
+}
+
+// isHostmask returns true if the access entry is a mask rather than an account name.
+func isHostmask(target string) bool {
+	return strings.ContainsAny(target, "!@*?")
+}
+
+// ParseAthemeDB reads an Atheme OpenSEX database, as written by Atheme 7 and later.
+func ParseAthemeDB(r io.Reader) (*ServicesDB, error) {
+	db := new(ServicesDB)
+	accounts := make(map[string]*ImportedAccount)
+	channels := make(map[string]*ImportedChannel)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "MU":
+			// MU <id> <name> <pass> <email> <registered> <lastlogin> <flags> <language>
+			if len(fields) < 7 {
+				continue
+			}
+			account := &ImportedAccount{
+				Name:         fields[2],
+				Email:        fields[4],
+				RegisteredAt: parseUnixTime(fields[5]),
+				LastSeen:     parseUnixTime(fields[6]),
+			}
+			// passwords are only hashed if the account has the C flag
+			if 8 <= len(fields) && strings.HasPrefix(fields[7], "+") && !strings.Contains(fields[7], "C") {
+				account.Password = fields[3]
+			} else {
+				account.PasswordHash = importedHash(fields[3])
+			}
+			accounts[account.Name] = account
+			db.Accounts = append(db.Accounts, account)
+		case "MN":
+			// MN <account> <nick> <registered> <lastseen>
+			account := accounts[fields[1]]
+			if account != nil && 3 <= len(fields) && fields[2] != account.Name {
+				account.Nicks = append(account.Nicks, fields[2])
+			}
+		case "MCFP":
+			// MCFP <account> <fingerprint>
+			account := accounts[fields[1]]
+			if account != nil && 3 <= len(fields) {
+				account.Certfps = append(account.Certfps, fields[2])
+			}
+		case "MDU":
+			// MDU <account> <key> <value>
+			account := accounts[fields[1]]
+			if account != nil && 4 <= len(fields) && fields[2] == "private:usercloak" {
+				account.Vhost = fields[3]
+			}
+		case "MC":
+			// MC <channel> <registered> <used> <flags> ...
+			channel := &ImportedChannel{
+				Name:   fields[1],
+				Access: make(map[string]Mode),
+			}
+			if 3 <= len(fields) {
+				channel.RegisteredAt = parseUnixTime(fields[2])
+			}
+			channels[channel.Name] = channel
+			db.Channels = append(db.Channels, channel)
+		case "CA":
+			// CA <channel> <target> <flags> <modified> <setter>
+			channel := channels[fields[1]]
+			if channel == nil || len(fields) < 4 {
+				continue
+			}
+			target, flags := fields[2], fields[3]
+			if isHostmask(target) {
+				if strings.Contains(flags, "b") {
+					channel.Banlist = append(channel.Banlist, target)
+				}
+				continue
+			}
+			if strings.Contains(flags, "F") && channel.Founder == "" {
+				channel.Founder = target
+			}
+			if mode := importedAccessMode(flags); mode != Mode(0) {
+				channel.Access[target] = mode
+			}
+		case "MDC":
+			// MDC <channel> <key> <value>
+			channel := channels[fields[1]]
+			if channel == nil || len(fields) < 4 {
+				continue
+			}
+			value := strings.SplitN(line, " ", 4)[3]
+			switch fields[2] {
+			case "private:topic:text":
+				channel.Topic = value
+			case "private:topic:setter":
+				channel.TopicSetBy = value
+			case "private:topic:ts":
+				channel.TopicSetTime = parseUnixTime(value)
+			}
+		}
+	}
+	return db, scanner.Err()
+}
+
+// sqlStatements are how the lines of an SQL dump (from mysqldump or sqlite's .dump) start.
+var sqlStatements = []string{"CREATE TABLE", "INSERT INTO", "DROP TABLE", "LOCK TABLES", "BEGIN TRANSACTION", "PRAGMA", "SET ", "/*!", "-- MYSQL DUMP"}
+
+// isSQLStatement returns true if the line looks like it's from an SQL dump rather than a
+// flatfile database, which only has OBJECT, DATA and END lines.
+func isSQLStatement(line string) bool {
+	line = strings.ToUpper(strings.TrimSpace(line))
+	for _, statement := range sqlStatements {
+		if strings.HasPrefix(line, statement) {
+			return true
+		}
+	}
+	return false
+}
+
+// anopeObject is one OBJECT from an Anope flatfile database.
+type anopeObject struct {
+	kind string
+	data map[string]string
+}
+
+// ParseAnopeDB reads an Anope 2 flatfile database, as written by the db_flatfile module.
+func ParseAnopeDB(r io.Reader) (*ServicesDB, error) {
+	var objects []anopeObject
+	var current *anopeObject
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if current == nil && isSQLStatement(line) {
+			return nil, errAnopeSQL
+		}
+		fields := strings.SplitN(line, " ", 3)
+		switch fields[0] {
+		case "OBJECT":
+			if len(fields) < 2 {
+				continue
+			}
+			current = &anopeObject{kind: fields[1], data: make(map[string]string)}
+		case "DATA":
+			if current != nil && 2 <= len(fields) {
+				if len(fields) == 3 {
+					current.data[fields[1]] = fields[2]
+				} else {
+					current.data[fields[1]] = ""
+				}
+			}
+		case "END":
+			if current != nil {
+				objects = append(objects, *current)
+				current = nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	db := new(ServicesDB)
+	accounts := make(map[string]*ImportedAccount)
+	channels := make(map[string]*ImportedChannel)
+	for _, object := range objects {
+		data := object.data
+		switch object.kind {
+		case "NickCore":
+			account := &ImportedAccount{
+				Name:  data["display"],
+				Email: data["email"],
+			}
+			pass := strings.SplitN(data["pass"], ":", 2)
+			if len(pass) == 2 {
+				switch pass[0] {
+				case "bcrypt", "posix":
+					// enc_posix stores whatever the system's crypt(3) made
+					account.PasswordHash = importedHash(pass[1])
+				case "plain":
+					password, err := base64.StdEncoding.DecodeString(pass[1])
+					if err == nil {
+						account.Password = string(password)
+					}
+				}
+			}
+			account.Certfps = strings.Fields(data["cert"])
+			accounts[account.Name] = account
+			db.Accounts = append(db.Accounts, account)
+		case "ChannelInfo":
+			channel := &ImportedChannel{
+				Name:         data["name"],
+				Founder:      data["founder"],
+				RegisteredAt: parseUnixTime(data["time_registered"]),
+				Topic:        data["last_topic"],
+				TopicSetBy:   data["last_topic_setter"],
+				TopicSetTime: parseUnixTime(data["last_topic_time"]),
+				Access:       make(map[string]Mode),
+			}
+			channels[channel.Name] = channel
+			db.Channels = append(db.Channels, channel)
+		}
+	}
+
+	// nicks, access and akicks refer to the accounts and channels above
+	for _, object := range objects {
+		data := object.data
+		switch object.kind {
+		case "NickAlias":
+			account := accounts[data["nc"]]
+			if account == nil {
+				continue
+			}
+			if data["nick"] == account.Name {
+				account.RegisteredAt = parseUnixTime(data["time_registered"])
+				account.LastSeen = parseUnixTime(data["last_seen"])
+				account.Vhost = data["vhost_host"]
+			} else {
+				account.Nicks = append(account.Nicks, data["nick"])
+			}
+		case "ChanAccess":
+			channel := channels[data["ci"]]
+			if channel == nil || isHostmask(data["mask"]) {
+				continue
+			}
+			if mode := anopeAccessMode(data["provider"], data["data"]); mode != Mode(0) {
+				channel.Access[data["mask"]] = mode
+			}
+		case "AutoKick":
+			channel := channels[data["ci"]]
+			if channel != nil && isHostmask(data["mask"]) {
+				channel.Banlist = append(channel.Banlist, data["mask"])
+			}
+		}
+	}
+	return db, nil
+}
+
+// anopeAccessMode returns the channel mode given by an Anope access entry, which is stored
+// differently by each of Anope's access providers.
+func anopeAccessMode(provider, data string) Mode {
+	switch provider {
+	case "access/access":
+		// the default levels of SOP, AOP, HOP and VOP
+		level, _ := strconv.Atoi(data)
+		switch {
+		case 10 <= level:
+			return ChannelAdmin
+		case 5 <= level:
+			return ChannelOperator
+		case 4 <= level:
+			return Halfop
+		case 3 <= level:
+			return Voice
+		}
+	case "access/xop":
+		switch data {
+		case "QOP", "SOP":
+			return ChannelAdmin
+		case "AOP":
+			return ChannelOperator
+		case "HOP":
+			return Halfop
+		case "VOP":
+			return Voice
+		}
+	case "access/flags":
+		return importedAccessMode(data)
+	}
+	return Mode(0)
+}
+
+// importAccount adds the account to the store, along with its grouped nicks.
+func importAccount(tx *buntdb.Tx, account *ImportedAccount, creds *AccountCredentials, result *ImportResult) {
+	accountKey, err := CasefoldName(account.Name)
+	if err != nil || account.Name == "*" {
+		result.Skipped = append(result.Skipped, fmt.Sprintf("account %s: name is not valid", account.Name))
+		return
+	}
+	if accountNameTaken(tx, accountKey) {
+		result.Skipped = append(result.Skipped, fmt.Sprintf("account %s: already exists", account.Name))
+		return
+	}
+
+	// certificates can only be attached to one account
+	for _, fingerprint := range account.Certfps {
+		certfp, err := normalizeCertfp(fingerprint)
+		if err != nil {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("account %s: certificate %s is not a SHA-256 fingerprint", account.Name, fingerprint))
+			continue
+		} else if len(creds.certificates()) == maxAccountCertificates {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("account %s: too many certificates", account.Name))
+			break
+		}
+		if _, err := tx.Get(fmt.Sprintf(keyCertToAccount, certfp)); err == nil {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("account %s: certificate %s is already in use", account.Name, certfp))
+			continue
+		}
+		tx.Set(fmt.Sprintf(keyCertToAccount, certfp), accountKey, nil)
+		if creds.Certificate == "" {
+			creds.Certificate = certfp
+		} else {
+			creds.Certificates = append(creds.Certificates, certfp)
+		}
+	}
+
+	createVerifiedAccount(tx, accountKey, account.Name, creds)
+	result.Accounts++
+	if creds.LegacyHash == "" && len(creds.PassphraseHash) == 0 {
+		result.NoPassword = append(result.NoPassword, account.Name)
+	}
+	if !account.RegisteredAt.IsZero() {
+		tx.Set(fmt.Sprintf(keyAccountRegTime, accountKey), strconv.FormatInt(account.RegisteredAt.Unix(), 10), nil)
+	}
+	if !account.LastSeen.IsZero() {
+		tx.Set(fmt.Sprintf(keyAccountLastSeen, accountKey), strconv.FormatInt(account.LastSeen.Unix(), 10), nil)
+	}
+	if account.Email != "" && strings.Contains(account.Email, "@") {
+		tx.Set(fmt.Sprintf(keyAccountEmail, accountKey), account.Email, nil)
+	}
+	if account.Vhost != "" {
+		if isValidVhost(account.Vhost) {
+			tx.Set(fmt.Sprintf(keyAccountVhost, accountKey), account.Vhost, nil)
+			result.Vhosts++
+		} else {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("account %s: vhost %s is not valid", account.Name, account.Vhost))
+		}
+	}
+
+	for _, nick := range account.Nicks {
+		nickKey, err := CasefoldName(nick)
+		if err != nil {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("nick %s: name is not valid", nick))
+			continue
+		} else if accountNameTaken(tx, nickKey) {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("nick %s: already registered", nick))
+			continue
+		}
+		tx.Set(fmt.Sprintf(keyGroupedNick, nickKey), accountKey, nil)
+		result.Nicks++
+	}
+}
+
+// importChannel adds the channel to the store, if its founder's account exists.
+func importChannel(tx *buntdb.Tx, channel *ImportedChannel, result *ImportResult) {
+	channelKey, err := CasefoldChannel(channel.Name)
+	if err != nil {
+		result.Skipped = append(result.Skipped, fmt.Sprintf("channel %s: name is not valid", channel.Name))
+		return
+	}
+	if _, err := tx.Get(fmt.Sprintf(keyChannelExists, channelKey)); err == nil {
+		result.Skipped = append(result.Skipped, fmt.Sprintf("channel %s: already registered", channel.Name))
+		return
+	}
+	founderKey, err := CasefoldName(channel.Founder)
+	var founder string
+	if err == nil {
+		founder, _ = tx.Get(fmt.Sprintf(keyAccountName, founderKey))
+	}
+	if founder == "" {
+		result.Skipped = append(result.Skipped, fmt.Sprintf("channel %s: founder %s was not imported", channel.Name, channel.Founder))
+		return
+	}
+
+	info := RegisteredChannel{
+		Name:         channel.Name,
+		RegisteredAt: channel.RegisteredAt,
+		Founder:      founder,
+		Topic:        channel.Topic,
+		TopicSetBy:   channel.TopicSetBy,
+		TopicSetTime: channel.TopicSetTime,
+		Banlist:      channel.Banlist,
+		AccessList:   make(map[string]Mode),
+	}
+	if info.RegisteredAt.IsZero() {
+		info.RegisteredAt = time.Now()
+	}
+	for name, mode := range channel.Access {
+		accountKey, err := CasefoldName(name)
+		if err != nil || accountKey == founderKey {
+			continue
+		}
+		if _, err := tx.Get(fmt.Sprintf(keyAccountExists, accountKey)); err != nil {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("channel %s: access for %s, their account was not imported", channel.Name, name))
+			continue
+		}
+		info.AccessList[accountKey] = mode
+	}
+	saveRegisteredChannel(tx, channelKey, info)
+	result.Channels++
+}
+
+// ImportServicesDB adds the accounts and channels to the store. Everything is imported in one
+// go, and anything that clashes with what's already in the store is skipped.
+func ImportServicesDB(store *buntdb.DB, db *ServicesDB) (*ImportResult, error) {
+	// plaintext passwords get a cheap bcrypt hash, which is replaced with our own hash when
+	// the account first logs in. hashing them all at our usual cost would take far too long
+	creds := make([]AccountCredentials, len(db.Accounts))
+	for i, account := range db.Accounts {
+		if account.Password != "" {
+			hash, err := bcrypt.GenerateFromPassword([]byte(account.Password), bcrypt.DefaultCost)
+			if err != nil {
+				return nil, err
+			}
+			creds[i].LegacyHash = string(hash)
+		} else {
+			creds[i].LegacyHash = account.PasswordHash
+		}
+	}
+
+	result := new(ImportResult)
+	err := store.Update(func(tx *buntdb.Tx) error {
+		for i, account := range db.Accounts {
+			importAccount(tx, account, &creds[i], result)
+		}
+		for _, channel := range db.Channels {
+			importChannel(tx, channel, result)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(result.NoPassword)
+	return result, nil
+}
+
+// ImportDB imports the services database into the datastore at the given path. It returns
+// errDatastoreInUse if the server is running.
+func ImportDB(path string, db *ServicesDB) (*ImportResult, error) {
+	lock, err := lockDatastore(path)
+	if err != nil {
+		return nil, err
+	}
+	if lock != nil {
+		defer lock.Close()
+	}
+	store, err := buntdb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open datastore: %s", err.Error())
+	}
+	defer store.Close()
+	return ImportServicesDB(store, db)
+}
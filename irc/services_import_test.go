@@ -0,0 +1,123 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/buntdb"
+)
+
+const testAthemeDB = `DBV 12
+MU AAAAAAAAB alice $z$6$10000$c2FsdHNhbHRzYWx0$Yqw7hnYHkSGEMqxpK+IbLvUyi4HYPvfz4MP2CEROU/mmYa7O8craTLnE/8nUUTG0pTe1yOV8K5vAy/Hh9Hn9PQ== alice@example.com 1500000000 1500000100 +sC default
+MU AAAAAAAAC bob hunter2 bob@example.com 1500000000 1500000100 +s default
+MU AAAAAAAAD carol $3$unsupported carol@example.com 1500000000 1500000100 +sC default
+MN alice alice_ 1500000000 1500000100
+MDU alice private:usercloak alice.example.com
+MC #chan 1500000000 1500000100 +v 0 0 0
+CA #chan alice +AFRefiorstv 1500000000 alice
+CA #chan bob +AV 1500000000 alice
+CA #chan *!*@spam.example.com +b 1500000000 alice
+MDC #chan private:topic:text hello world
+`
+
+func TestImportAthemeDB(t *testing.T) {
+	db, err := ParseServicesDB(strings.NewReader(testAthemeDB), "atheme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.Accounts) != 3 || len(db.Channels) != 1 {
+		t.Fatalf("expected 3 accounts and 1 channel, got %d and %d", len(db.Accounts), len(db.Channels))
+	}
+	if db.Accounts[0].PasswordHash == "" || db.Accounts[1].Password != "hunter2" || db.Accounts[2].PasswordHash != "" {
+		t.Errorf("passwords weren't read properly: %+v %+v %+v", db.Accounts[0], db.Accounts[1], db.Accounts[2])
+	}
+	channel := db.Channels[0]
+	if channel.Founder != "alice" || channel.Access["bob"] != Voice || channel.Topic != "hello world" || len(channel.Banlist) != 1 {
+		t.Errorf("channel wasn't read properly: %+v", channel)
+	}
+
+	store, err := buntdb.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	result, err := ImportServicesDB(store, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Accounts != 3 || result.Nicks != 1 || result.Vhosts != 1 || result.Channels != 1 {
+		t.Errorf("unexpected import result: %+v", result)
+	}
+	if len(result.NoPassword) != 1 || result.NoPassword[0] != "carol" {
+		t.Errorf("expected only carol to be without a password, got %v", result.NoPassword)
+	}
+
+	// imported hashes are checked when the account first logs in
+	store.View(func(tx *buntdb.Tx) error {
+		for account, password := range map[string]string{"alice": "hunter2", "bob": "hunter2"} {
+			creds, err := loadAccountCredentials(tx, account)
+			if err != nil {
+				t.Fatalf("%s: couldn't load credentials: %s", account, err.Error())
+			}
+			if err := checkLegacyHash(creds.LegacyHash, password); err != nil {
+				t.Errorf("%s: expected the imported password to work, got %v", account, err)
+			}
+		}
+		if account, _ := tx.Get(fmt.Sprintf(keyGroupedNick, "alice_")); account != "alice" {
+			t.Errorf("expected alice_ to be grouped with alice, got %q", account)
+		}
+		return nil
+	})
+}
+
+func TestAnopeSQL(t *testing.T) {
+	for _, dump := range []string{
+		"-- MySQL dump 10.13\n/*!40101 SET NAMES utf8 */;\nDROP TABLE IF EXISTS `anope_db_NickCore`;\n",
+		"PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\nCREATE TABLE anope_db_NickCore (id INTEGER);\n",
+		"insert into anope_db_NickCore values (1);\n",
+	} {
+		if _, err := ParseServicesDB(strings.NewReader(dump), "anope"); err != errAnopeSQL {
+			t.Errorf("%q: expected errAnopeSQL, got %v", dump, err)
+		}
+	}
+
+	flatfile := "OBJECT NickCore\nDATA display alice\nDATA pass posix:$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/\nEND\n"
+	db, err := ParseServicesDB(strings.NewReader(flatfile), "anope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.Accounts) != 1 || db.Accounts[0].PasswordHash != "$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/" {
+		t.Errorf("flatfile wasn't read properly: %+v", db.Accounts)
+	}
+}
+
+func TestImportDBInUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oragono")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ircd.db")
+
+	lock, err := lockDatastore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lock == nil {
+		t.Skip("datastore locks aren't supported here")
+	}
+	if _, err := ImportDB(path, new(ServicesDB)); err != errDatastoreInUse {
+		t.Errorf("expected the import to be refused while the datastore is locked, got %v", err)
+	}
+	lock.Close()
+	if _, err := ImportDB(path, new(ServicesDB)); err != nil {
+		t.Errorf("expected the import to work once the datastore is unlocked, got %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SetupConfig holds the answers from the setup wizard.
+type SetupConfig struct {
+	NetworkName string
+	ServerName  string
+	// Listen holds the plaintext addresses to listen on, and TLSListen the TLS ones.
+	Listen    []string
+	TLSListen []string
+	TLSCert   string
+	TLSKey    string
+	// OperName and OperPassword are the first oper, with the password already encoded by
+	// GenerateEncodedPassword.
+	OperName     string
+	OperPassword string
+}
+
+// yamlIndent returns how far the line is indented.
+func yamlIndent(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// yamlIsContent returns true if the line isn't blank or a comment.
+func yamlIsContent(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed != "" && !strings.HasPrefix(trimmed, "#")
+}
+
+// yamlFind returns the line that the key at the given path is on, and the line after its
+// block ends.
+func yamlFind(lines []string, path []string) (keyLine int, blockEnd int, err error) {
+	start, end := 0, len(lines)
+	keyLine = -1
+	for _, key := range path {
+		// the block's keys are at the indentation of its first line
+		childIndent := -1
+		for i := start; i < end; i++ {
+			if yamlIsContent(lines[i]) {
+				childIndent = yamlIndent(lines[i])
+				break
+			}
+		}
+		keyLine = -1
+		for i := start; i < end; i++ {
+			if yamlIsContent(lines[i]) && yamlIndent(lines[i]) == childIndent && strings.HasPrefix(strings.TrimSpace(lines[i]), key+":") {
+				keyLine = i
+				break
+			}
+		}
+		if keyLine == -1 {
+			return 0, 0, fmt.Errorf("Example config has no %s setting", strings.Join(path, "."))
+		}
+
+		keyIndent := yamlIndent(lines[keyLine])
+		blockEnd = end
+		for i := keyLine + 1; i < end; i++ {
+			if strings.TrimSpace(lines[i]) != "" && yamlIndent(lines[i]) <= keyIndent {
+				blockEnd = i
+				break
+			}
+		}
+		// keep the blank lines between this block and the next one
+		for keyLine+1 < blockEnd && strings.TrimSpace(lines[blockEnd-1]) == "" {
+			blockEnd--
+		}
+		start, end = keyLine+1, blockEnd
+	}
+	return keyLine, blockEnd, nil
+}
+
+// yamlSetValue sets the value of the key at the given path.
+func yamlSetValue(lines []string, path []string, value string) ([]string, error) {
+	keyLine, blockEnd, err := yamlFind(lines, path)
+	if err != nil {
+		return nil, err
+	}
+	line := fmt.Sprintf("%s%s: %s", strings.Repeat(" ", yamlIndent(lines[keyLine])), path[len(path)-1], value)
+	return append(append(append([]string{}, lines[:keyLine]...), line), lines[blockEnd:]...), nil
+}
+
+// yamlSetBlock replaces the block under the key at the given path with the given lines,
+// which are indented to fit.
+func yamlSetBlock(lines []string, path []string, block []string) ([]string, error) {
+	keyLine, blockEnd, err := yamlFind(lines, path)
+	if err != nil {
+		return nil, err
+	}
+	indent := strings.Repeat(" ", yamlIndent(lines[keyLine])+4)
+	newLines := append([]string{}, lines[:keyLine+1]...)
+	for _, line := range block {
+		if line == "" {
+			newLines = append(newLines, "")
+		} else {
+			newLines = append(newLines, indent+line)
+		}
+	}
+	return append(newLines, lines[blockEnd:]...), nil
+}
+
+// GenerateConfig fills in the example config with the answers from the setup wizard,
+// keeping the rest of the example (and its comments) as it is.
+func GenerateConfig(example []byte, setup SetupConfig) ([]byte, error) {
+	if setup.NetworkName == "" || strings.ContainsAny(setup.NetworkName, " \t") {
+		return nil, errors.New("Network name can't be blank or have spaces in it")
+	}
+	if len(setup.Listen)+len(setup.TLSListen) == 0 {
+		return nil, errors.New("There must be at least one address to listen on")
+	}
+	if setup.OperName != "" {
+		_, err := CasefoldName(setup.OperName)
+		if err != nil || setup.OperPassword == "" {
+			return nil, errors.New("Oper name isn't valid")
+		}
+	}
+
+	lines := strings.Split(strings.Replace(string(example), "\r\n", "\n", -1), "\n")
+	var err error
+	lines, err = yamlSetValue(lines, []string{"network", "name"}, strconv.Quote(setup.NetworkName))
+	if err != nil {
+		return nil, err
+	}
+	lines, err = yamlSetValue(lines, []string{"server", "name"}, strconv.Quote(setup.ServerName))
+	if err != nil {
+		return nil, err
+	}
+
+	var listen []string
+	for _, addr := range append(append([]string{}, setup.Listen...), setup.TLSListen...) {
+		listen = append(listen, "- "+strconv.Quote(addr))
+	}
+	lines, err = yamlSetBlock(lines, []string{"server", "listen"}, listen)
+	if err != nil {
+		return nil, err
+	}
+
+	var tlsListeners []string
+	for _, addr := range setup.TLSListen {
+		tlsListeners = append(tlsListeners,
+			fmt.Sprintf("%s:", strconv.Quote(addr)),
+			fmt.Sprintf("    key: %s", strconv.Quote(setup.TLSKey)),
+			fmt.Sprintf("    cert: %s", strconv.Quote(setup.TLSCert)),
+		)
+	}
+	if len(tlsListeners) == 0 {
+		lines, err = yamlSetValue(lines, []string{"server", "tls-listeners"}, "{}")
+	} else {
+		lines, err = yamlSetBlock(lines, []string{"server", "tls-listeners"}, tlsListeners)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if setup.OperName != "" {
+		lines, err = yamlSetBlock(lines, []string{"opers"}, []string{
+			fmt.Sprintf("# operator named '%s'", setup.OperName),
+			fmt.Sprintf("%s:", setup.OperName),
+			"    # which capabilities this oper has access to",
+			`    class: "server-admin"`,
+			"",
+			"    # custom whois line",
+			"    whois-line: is the server administrator",
+			"",
+			"    # modes are the modes to auto-set upon opering-up",
+			"    modes: +is acjknoqtux",
+			"",
+			"    # password to login with /OPER command",
+			`    # generated using  "oragono genpasswd"`,
+			fmt.Sprintf("    password: %s", setup.OperPassword),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return []byte(strings.Join(lines, "\n")), nil
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+const (
+	defaultSMSURL     = "https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json"
+	defaultSMSTimeout = 10 * time.Second
+	// smsCodeDigits is how long the codes we text are. they're shorter than emailed codes so
+	// they're easy to type, and ACC VERIFY is rate limited to make up for it.
+	smsCodeDigits = 8
+
+	defaultSMSVerifyMessage = "Your {{.NetworkName}} verification code for {{.Account}} is {{.Code}}"
+)
+
+var (
+	errSMSNotConfigured = errors.New("Text messages aren't set up on this server")
+	errInvalidPhone     = errors.New("That phone number is invalid")
+
+	// phoneNumberRegex matches E.164 phone numbers, like +15551234567
+	phoneNumberRegex = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+)
+
+// SMSConfig is how we send text messages for the sms callback, using a Twilio-style HTTP
+// API: a form with To, From and Body is POSTed to the URL, with basic auth.
+//
+// The message is a Go template, which can use {{.NetworkName}}, {{.Account}}, {{.Code}}
+// and {{.Expiry}}.
+type SMSConfig struct {
+	// URL is the endpoint to post messages to. %s is replaced with the username, which is
+	// the account SID for Twilio.
+	URL           string
+	Username      string
+	Password      string
+	From          string
+	TimeoutString string        `yaml:"timeout"`
+	Timeout       time.Duration `yaml:"timeout-real"`
+	VerifyMessage string        `yaml:"verify-message"`
+
+	verifyTemplate *texttemplate.Template
+}
+
+// load checks the config and parses the message template.
+func (conf *SMSConfig) load() (err error) {
+	if conf.URL == "" {
+		conf.URL = defaultSMSURL
+	}
+	conf.Timeout = defaultSMSTimeout
+	if conf.TimeoutString != "" {
+		conf.Timeout, err = time.ParseDuration(conf.TimeoutString)
+		if err != nil {
+			return fmt.Errorf("Could not parse timeout: %s", err.Error())
+		}
+	}
+	if conf.From != "" && !phoneNumberRegex.MatchString(conf.From) {
+		return errors.New("from must be a phone number like +15551234567")
+	}
+	message := conf.VerifyMessage
+	if message == "" {
+		message = defaultSMSVerifyMessage
+	}
+	conf.verifyTemplate, err = texttemplate.New("sms-verify-message").Parse(message)
+	if err != nil {
+		return fmt.Errorf("Could not parse verify message: %s", err.Error())
+	}
+	return nil
+}
+
+// Enabled returns true if we can send text messages.
+func (conf *SMSConfig) Enabled() bool {
+	return conf.Username != "" && conf.From != ""
+}
+
+// normalizePhone checks that the number is in E.164 format, ignoring the spaces, dashes and
+// brackets people like to write numbers with.
+func normalizePhone(number string) (string, error) {
+	number = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')':
+			return -1
+		}
+		return r
+	}, number)
+	if !phoneNumberRegex.MatchString(number) {
+		return "", errInvalidPhone
+	}
+	return number, nil
+}
+
+// randomSMSCode returns a random numeric code to text to a user.
+func randomSMSCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < smsCodeDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	code, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", smsCodeDigits, code), nil
+}
+
+// sendTemplate fills in the given template and texts it to the recipient.
+func (conf *SMSConfig) sendTemplate(recipient string, tmpl *texttemplate.Template, data emailData) error {
+	var body bytes.Buffer
+	err := tmpl.Execute(&body, data)
+	if err != nil {
+		return err
+	}
+	return conf.send(recipient, body.String())
+}
+
+// send texts the message to the recipient.
+func (conf *SMSConfig) send(recipient, message string) error {
+	form := url.Values{}
+	form.Set("To", recipient)
+	form.Set("From", conf.From)
+	form.Set("Body", message)
+	endpoint := conf.URL
+	if strings.Contains(endpoint, "%s") {
+		endpoint = fmt.Sprintf(endpoint, url.PathEscape(conf.Username))
+	}
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(conf.Username, conf.Password)
+
+	httpClient := http.Client{Timeout: conf.Timeout}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || 299 < resp.StatusCode {
+		return fmt.Errorf("SMS endpoint returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	cases := []struct {
+		number     string
+		normalized string
+	}{
+		{"+15551234567", "+15551234567"},
+		{"+1 (555) 123-4567", "+15551234567"},
+		{"+44 20.7946.0000", "+442079460000"},
+		{"15551234567", ""},
+		{"+05551234567", ""},
+		{"+1555", ""},
+		{"+1555123456789012", ""},
+		{"+1555CALLNOW", ""},
+	}
+	for _, c := range cases {
+		normalized, err := normalizePhone(c.number)
+		if normalized != c.normalized || (err == nil) != (c.normalized != "") {
+			t.Errorf("%q: expected %q, got %q %v", c.number, c.normalized, normalized, err)
+		}
+	}
+}
+
+func TestRandomSMSCode(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		code, err := randomSMSCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(code) != smsCodeDigits || strings.Trim(code, "0123456789") != "" {
+			t.Fatalf("expected %d digits, got %q", smsCodeDigits, code)
+		}
+	}
+}
+
+func TestSMSSend(t *testing.T) {
+	var form map[string]string
+	var path string
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		if user, pass, _ := r.BasicAuth(); user != "AC123" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		form = map[string]string{"To": r.FormValue("To"), "From": r.FormValue("From"), "Body": r.FormValue("Body")}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer endpoint.Close()
+
+	conf := SMSConfig{
+		URL:      endpoint.URL + "/Accounts/%s/Messages.json",
+		Username: "AC123",
+		Password: "secret",
+		From:     "+15550000000",
+	}
+	if err := conf.load(); err != nil {
+		t.Fatal(err)
+	}
+	if !conf.Enabled() {
+		t.Fatal("expected texts to be enabled")
+	}
+	err := conf.sendTemplate("+15551234567", conf.verifyTemplate, emailData{NetworkName: "ExampleNet", Account: "alice", Code: "12345678"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/Accounts/AC123/Messages.json" {
+		t.Errorf("expected the username to be filled into the URL, got %s", path)
+	}
+	expected := map[string]string{"To": "+15551234567", "From": "+15550000000", "Body": "Your ExampleNet verification code for alice is 12345678"}
+	for key, value := range expected {
+		if form[key] != value {
+			t.Errorf("expected %s to be %q, got %q", key, value, form[key])
+		}
+	}
+
+	conf.Password = "wrong"
+	if err := conf.send("+15551234567", "hello"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected the endpoint's error to be returned, got %v", err)
+	}
+
+	for _, bad := range []SMSConfig{
+		{From: "5550000000"},
+		{From: "+15550000000", TimeoutString: "soon"},
+		{From: "+15550000000", VerifyMessage: "{{.Code"},
+	} {
+		if err := bad.load(); err == nil {
+			t.Errorf("%+v: expected the config to be refused", bad)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/oragono/oragono/irc/objectstore"
+	"github.com/oragono/oragono/irc/sno"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	// snapshotCheckInterval is how often we check whether a snapshot is due.
+	snapshotCheckInterval = time.Minute
+
+	snapshotKeyPrefix  = "oragono-"
+	snapshotKeySuffix  = ".db.gz"
+	snapshotTimeFormat = "20060102T150405Z"
+)
+
+// SnapshotConfig controls the periodic snapshots of the datastore that are uploaded to
+// S3-compatible object storage.
+type SnapshotConfig struct {
+	Enabled        bool
+	IntervalString string        `yaml:"interval"`
+	Interval       time.Duration `yaml:"interval-real"`
+	// Retention is how many snapshots we keep, with 0 keeping all of them.
+	Retention int
+	// Prefix is put in front of the snapshot names, so several networks can share a bucket.
+	Prefix string
+	S3     objectstore.Config `yaml:"s3"`
+}
+
+// snapshotKey returns the name of a snapshot taken at the given time.
+func (config *SnapshotConfig) snapshotKey(now time.Time) string {
+	return config.Prefix + snapshotKeyPrefix + now.UTC().Format(snapshotTimeFormat) + snapshotKeySuffix
+}
+
+// listSnapshots returns the snapshots in the bucket, oldest first.
+func listSnapshots(client *objectstore.Client, config *SnapshotConfig) ([]objectstore.Object, error) {
+	objects, err := client.List(config.Prefix + snapshotKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []objectstore.Object
+	for _, object := range objects {
+		if strings.HasSuffix(object.Key, snapshotKeySuffix) {
+			snapshots = append(snapshots, object)
+		}
+	}
+	return snapshots, nil
+}
+
+// checkSnapshot starts a snapshot if one is due.
+func (server *Server) checkSnapshot() {
+	server.snapshotMutex.Lock()
+	defer server.snapshotMutex.Unlock()
+
+	// the ticker doesn't fire at exact times, so allow a little leeway
+	sinceLast := time.Since(server.lastSnapshot) + snapshotCheckInterval/2
+	if !server.snapshots.Enabled || server.snapshotRunning || sinceLast < server.snapshots.Interval {
+		return
+	}
+	server.snapshotRunning = true
+	server.lastSnapshot = time.Now()
+	config := server.snapshots
+
+	go func() {
+		err := server.snapshot(&config)
+		server.snapshotMutex.Lock()
+		server.snapshotRunning = false
+		server.snapshotMutex.Unlock()
+
+		if err != nil {
+			server.logger.Error("snapshots", fmt.Sprintf("Could not take datastore snapshot: %s", err.Error()))
+			server.snomasks.Send(sno.LocalOpers, fmt.Sprintf(ircfmt.Unescape("Datastore snapshot failed: $c[grey][$r%s$c[grey]]"), err.Error()))
+		}
+	}()
+}
+
+// snapshot uploads a copy of the datastore, then removes the snapshots past the retention limit.
+func (server *Server) snapshot(config *SnapshotConfig) error {
+	client, err := objectstore.NewClient(config.S3)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	err = server.store.Save(zw)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	key := config.snapshotKey(time.Now())
+	err = client.Put(key, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	server.logger.Info("snapshots", fmt.Sprintf("Uploaded datastore snapshot %s (%d bytes)", key, buf.Len()))
+
+	if config.Retention < 1 {
+		return nil
+	}
+	snapshots, err := listSnapshots(client, config)
+	if err != nil {
+		return err
+	}
+	for config.Retention < len(snapshots) {
+		err = client.Delete(snapshots[0].Key)
+		if err != nil {
+			return err
+		}
+		server.logger.Debug("snapshots", fmt.Sprintf("Removed old datastore snapshot %s", snapshots[0].Key))
+		snapshots = snapshots[1:]
+	}
+	return nil
+}
+
+// RestoreDB downloads the named snapshot (or the latest one if name is empty) and replaces
+// the datastore with it, returning the name of the snapshot that was restored. The old
+// datastore is kept next to the new one, with a .pre-restore suffix.
+func RestoreDB(config *Config, name string) (string, error) {
+	snapConfig := &config.Datastore.Snapshots
+	client, err := objectstore.NewClient(snapConfig.S3)
+	if err != nil {
+		return "", err
+	}
+
+	if name == "" {
+		snapshots, err := listSnapshots(client, snapConfig)
+		if err != nil {
+			return "", err
+		}
+		if len(snapshots) == 0 {
+			return "", errors.New("There are no snapshots to restore")
+		}
+		name = snapshots[len(snapshots)-1].Key
+	}
+
+	data, err := client.Get(name)
+	if err != nil {
+		return "", fmt.Errorf("Could not download snapshot %s: %s", name, err.Error())
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("Snapshot %s is not a gzipped datastore: %s", name, err.Error())
+	}
+	data, err = ioutil.ReadAll(zr)
+	if err != nil {
+		return "", fmt.Errorf("Snapshot %s is corrupt: %s", name, err.Error())
+	}
+
+	// make sure the snapshot loads before we replace anything
+	store, err := buntdb.Open(":memory:")
+	if err != nil {
+		return "", err
+	}
+	err = store.Load(bytes.NewReader(data))
+	store.Close()
+	if err != nil {
+		return "", fmt.Errorf("Snapshot %s is not a valid datastore: %s", name, err.Error())
+	}
+
+	path := config.Datastore.Path
+	tempPath := path + ".restoring"
+	err = ioutil.WriteFile(tempPath, data, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err = os.Stat(path); err == nil {
+		err = os.Rename(path, path+".pre-restore")
+		if err != nil {
+			os.Remove(tempPath)
+			return "", err
+		}
+	}
+	err = os.Rename(tempPath, path)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
@@ -10,6 +10,7 @@ const (
 	LocalConnects      Mask = 'c'
 	LocalChannels      Mask = 'j'
 	LocalKills         Mask = 'k'
+	LocalClones        Mask = 'l'
 	LocalNicks         Mask = 'n'
 	LocalOpers         Mask = 'o'
 	LocalQuits         Mask = 'q'
@@ -25,6 +26,7 @@ var (
 		LocalConnects:      "CONNECT",
 		LocalChannels:      "CHANNEL",
 		LocalKills:         "KILL",
+		LocalClones:        "CLONES",
 		LocalNicks:         "NICK",
 		LocalOpers:         "OPER",
 		LocalQuits:         "QUIT",
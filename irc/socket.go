@@ -14,20 +14,35 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	errNotTLS           = errors.New("Not a TLS connection")
 	errNoPeerCerts      = errors.New("Client did not provide a certificate")
+	errStartTLSBuffered = errors.New("Client sent data after STARTTLS")
 	handshakeTimeout, _ = time.ParseDuration("5s")
 )
 
 // Socket represents an IRC socket.
 type Socket struct {
-	conn   net.Conn
-	reader *bufio.Reader
-
+	// bytesIn and bytesOut count the data read from and sent to the socket, they must be
+	// accessed atomically, so they come first to keep them 64-bit aligned on 32-bit platforms
+	bytesIn  uint64
+	bytesOut uint64
+
+	// conn is replaced when the socket is upgraded with STARTTLS, so it's protected by
+	// connMutex. writeMutex is held for every write, so nothing can be written to the old
+	// conn once the upgrade has started
+	conn       net.Conn
+	connMutex  sync.Mutex
+	writeMutex sync.Mutex
+	remoteAddr net.Addr
+	reader     *bufio.Reader
+
+	// MaxSendQBytes is protected by linesToSendMutex, since it can be changed while the
+	// socket is being written to, see SetMaxSendQ()
 	MaxSendQBytes uint64
 
 	closed      bool
@@ -39,12 +54,17 @@ type Socket struct {
 	lineToSendExists chan bool
 	linesToSend      []string
 	linesToSendMutex sync.Mutex
+	// queuedBytes is how much data is in linesToSend, and sendQWarned is true once the client
+	// has been warned about it, they're protected by linesToSendMutex
+	queuedBytes uint64
+	sendQWarned bool
 }
 
 // NewSocket returns a new Socket.
 func NewSocket(conn net.Conn, maxSendQBytes uint64) Socket {
 	return Socket{
 		conn:             conn,
+		remoteAddr:       conn.RemoteAddr(),
 		reader:           bufio.NewReader(conn),
 		MaxSendQBytes:    maxSendQBytes,
 		lineToSendExists: make(chan bool),
@@ -64,9 +84,21 @@ func (socket *Socket) Close() {
 	go socket.timedFillLineToSendExists(200 * time.Millisecond)
 }
 
+// getConn returns the socket's current connection.
+func (socket *Socket) getConn() net.Conn {
+	socket.connMutex.Lock()
+	defer socket.connMutex.Unlock()
+	return socket.conn
+}
+
+// RemoteAddr returns the address of the other end of the socket.
+func (socket *Socket) RemoteAddr() net.Addr {
+	return socket.remoteAddr
+}
+
 // CertFP returns the fingerprint of the certificate provided by the client.
 func (socket *Socket) CertFP() (string, error) {
-	var tlsConn, isTLS = socket.conn.(*tls.Conn)
+	var tlsConn, isTLS = socket.getConn().(*tls.Conn)
 	if !isTLS {
 		return "", errNotTLS
 	}
@@ -91,6 +123,47 @@ func (socket *Socket) CertFP() (string, error) {
 	return fingerprint, nil
 }
 
+// StartTLS sends the given line (and anything queued before it), and then upgrades the
+// socket to TLS with the given config.
+func (socket *Socket) StartTLS(line string, config *tls.Config) error {
+	// anything the client sent after STARTTLS would be read as plaintext
+	if socket.reader.Buffered() != 0 {
+		return errStartTLSBuffered
+	}
+
+	// holding this stops the writer sending anything until the handshake is done, lines
+	// queued in the meantime are sent over TLS afterwards
+	socket.writeMutex.Lock()
+	defer socket.writeMutex.Unlock()
+
+	socket.linesToSendMutex.Lock()
+	data := strings.Join(socket.linesToSend, "") + line
+	socket.linesToSend = []string{}
+	socket.queuedBytes = 0
+	socket.sendQWarned = false
+	socket.linesToSendMutex.Unlock()
+
+	conn := socket.getConn()
+	_, err := conn.Write([]byte(data))
+	if err != nil {
+		return err
+	}
+
+	tlsConn := tls.Server(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	err = tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+
+	socket.connMutex.Lock()
+	socket.conn = tlsConn
+	socket.connMutex.Unlock()
+	socket.reader = bufio.NewReader(tlsConn)
+	return nil
+}
+
 // Read returns a single IRC line from a Socket.
 func (socket *Socket) Read() (string, error) {
 	if socket.IsClosed() {
@@ -98,6 +171,7 @@ func (socket *Socket) Read() (string, error) {
 	}
 
 	lineBytes, err := socket.reader.ReadBytes('\n')
+	atomic.AddUint64(&socket.bytesIn, uint64(len(lineBytes)))
 
 	// convert bytes to string
 	line := string(lineBytes[:])
@@ -124,13 +198,42 @@ func (socket *Socket) Write(data string) error {
 
 	socket.linesToSendMutex.Lock()
 	socket.linesToSend = append(socket.linesToSend, data)
+	socket.queuedBytes += uint64(len(data))
 	socket.linesToSendMutex.Unlock()
+	atomic.AddUint64(&socket.bytesOut, uint64(len(data)))
 
 	go socket.timedFillLineToSendExists(15 * time.Second)
 
 	return nil
 }
 
+// MaxSendQ returns the most data that can wait to be sent before the client is disconnected.
+func (socket *Socket) MaxSendQ() uint64 {
+	socket.linesToSendMutex.Lock()
+	defer socket.linesToSendMutex.Unlock()
+	return socket.MaxSendQBytes
+}
+
+// SetMaxSendQ changes the most data that can wait to be sent.
+func (socket *Socket) SetMaxSendQ(maxSendQBytes uint64) {
+	socket.linesToSendMutex.Lock()
+	defer socket.linesToSendMutex.Unlock()
+	socket.MaxSendQBytes = maxSendQBytes
+}
+
+// SendQWarning returns true once each time the data waiting to be sent goes over half of
+// the sendq, so the client can be told before they're disconnected for going over it.
+func (socket *Socket) SendQWarning() bool {
+	socket.linesToSendMutex.Lock()
+	defer socket.linesToSendMutex.Unlock()
+
+	if socket.sendQWarned || socket.queuedBytes <= socket.MaxSendQBytes/2 {
+		return false
+	}
+	socket.sendQWarned = true
+	return true
+}
+
 // timedFillLineToSendExists either sends the note or times out.
 func (socket *Socket) timedFillLineToSendExists(duration time.Duration) {
 	select {
@@ -161,17 +264,21 @@ func (socket *Socket) RunSocketWriter() {
 		// wait for new lines
 		select {
 		case <-socket.lineToSendExists:
+			// held until the data is written, so STARTTLS can't upgrade the socket under us
+			socket.writeMutex.Lock()
 			socket.linesToSendMutex.Lock()
 
 			// check if we're closed
 			if socket.IsClosed() {
 				socket.linesToSendMutex.Unlock()
+				socket.writeMutex.Unlock()
 				break
 			}
 
 			// check whether new lines actually exist or not
 			if len(socket.linesToSend) < 1 {
 				socket.linesToSendMutex.Unlock()
+				socket.writeMutex.Unlock()
 				continue
 			}
 
@@ -187,21 +294,26 @@ func (socket *Socket) RunSocketWriter() {
 			if socket.MaxSendQBytes < sendQBytes {
 				socket.SetFinalData("\r\nERROR :SendQ Exceeded\r\n")
 				socket.linesToSendMutex.Unlock()
+				socket.writeMutex.Unlock()
 				break
 			}
 
 			// get all existing data
 			data := strings.Join(socket.linesToSend, "")
 			socket.linesToSend = []string{}
+			socket.queuedBytes = 0
+			socket.sendQWarned = false
 
 			socket.linesToSendMutex.Unlock()
 
 			// write data
+			var err error
 			if 0 < len(data) {
-				_, err := socket.conn.Write([]byte(data))
-				if err != nil {
-					break
-				}
+				_, err = socket.getConn().Write([]byte(data))
+			}
+			socket.writeMutex.Unlock()
+			if err != nil {
+				break
 			}
 		}
 		if socket.IsClosed() {
@@ -217,14 +329,18 @@ func (socket *Socket) RunSocketWriter() {
 	socket.closedMutex.Unlock()
 
 	// write error lines
+	socket.writeMutex.Lock()
+	conn := socket.getConn()
 	socket.finalDataMutex.Lock()
 	if 0 < len(socket.finalData) {
-		socket.conn.Write([]byte(socket.finalData))
+		conn.Write([]byte(socket.finalData))
+		atomic.AddUint64(&socket.bytesOut, uint64(len(socket.finalData)))
 	}
 	socket.finalDataMutex.Unlock()
 
 	// close the connection
-	socket.conn.Close()
+	conn.Close()
+	socket.writeMutex.Unlock()
 
 	// empty the lineToSendExists channel
 	for 0 < len(socket.lineToSendExists) {
@@ -232,6 +348,16 @@ func (socket *Socket) RunSocketWriter() {
 	}
 }
 
+// BytesIn returns how many bytes have been read from the socket.
+func (socket *Socket) BytesIn() uint64 {
+	return atomic.LoadUint64(&socket.bytesIn)
+}
+
+// BytesOut returns how many bytes have been sent to the socket.
+func (socket *Socket) BytesOut() uint64 {
+	return atomic.LoadUint64(&socket.bytesOut)
+}
+
 // WriteLine writes the given line out of Socket.
 func (socket *Socket) WriteLine(line string) error {
 	return socket.Write(line + "\r\n")
@@ -0,0 +1,97 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+// StartTLSConfig lets clients on a plaintext listener upgrade to TLS with STARTTLS.
+type StartTLSConfig struct {
+	Enabled bool
+	// Cert and Key are the certificate to use. If they're blank, the certificate of the
+	// first TLS listener is used.
+	Cert   string
+	Key    string
+	Config *tls.Config `yaml:"-"`
+}
+
+// load checks the config and loads the certificate.
+func (conf *StartTLSConfig) load(tlsListeners map[string]*TLSListenConfig) (err error) {
+	if !conf.Enabled {
+		return nil
+	}
+	certConf := &TLSListenConfig{
+		Cert: conf.Cert,
+		Key:  conf.Key,
+	}
+	if conf.Cert == "" && conf.Key == "" {
+		if len(tlsListeners) == 0 {
+			return errors.New("cert and key must be set when there are no tls-listeners")
+		}
+		var addrs []string
+		for addr := range tlsListeners {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		certConf = tlsListeners[addrs[0]]
+	}
+	conf.Config, err = certConf.Config()
+	if err != nil {
+		return err
+	}
+	// ask for a client certificate, so certfp works the same as on TLS listeners
+	conf.Config.ClientAuth = tls.RequestClientCert
+	return nil
+}
+
+// STARTTLS
+func starttlsHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	if client.registered {
+		rb.Send(nil, server.name, ERR_STARTTLS, client.nick, "STARTTLS can only be used before registering")
+		return false
+	}
+	if client.hasFlag(TLS) {
+		rb.Send(nil, server.name, ERR_STARTTLS, client.nick, "You're already using TLS")
+		return false
+	}
+	if client.listenerConfig == nil || !client.listenerConfig.StartTLS.Enabled {
+		rb.Send(nil, server.name, ERR_STARTTLS, client.nick, "STARTTLS is not enabled on this port")
+		return false
+	}
+
+	// this has to go out as plaintext right before the handshake, so it skips the queue
+	startMsg := ircmsg.MakeMessage(nil, server.name, RPL_STARTTLS, client.nick, "STARTTLS successful, proceed with TLS handshake")
+	startLine, _ := startMsg.Line()
+	err := client.socket.StartTLS(startLine, client.listenerConfig.StartTLS.Config)
+	if err != nil {
+		// we don't know what state the connection is in, so just drop it
+		server.logger.Debug("localconnect", fmt.Sprintf("STARTTLS failed for %s: %s", client.IPString(), err.Error()))
+		client.quitMessageSent = true
+		client.destroy()
+		return true
+	}
+
+	client.setFlag(TLS, true)
+	client.certfp, _ = client.socket.CertFP()
+	server.liftExceededLimits(client)
+	if _, _, overridden := client.connectionClassInfo(); !overridden {
+		class, reason := server.matchConnectionClass(client.IP(), true)
+		client.setConnectionClass(class, reason, false)
+	}
+
+	// they're off plaintext now, so they can stay
+	client.timerMutex.Lock()
+	if client.plaintextTimer != nil {
+		client.plaintextTimer.Stop()
+		client.plaintextTimer = nil
+	}
+	client.timerMutex.Unlock()
+	return false
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+
+	"code.cloudfoundry.org/bytefmt"
+)
+
+// structuredNotice sends the client a NOTE or WARN standard reply, if the server has
+// structured notices turned on. These go along with a normal notice, so bots can react to
+// things like throttling without having to parse text that's meant for people.
+func (client *Client) structuredNotice(kind, command, code string, context []string, text string) {
+	if !client.server.structuredNotices {
+		return
+	}
+	params := append([]string{command, code}, context...)
+	params = append(params, text)
+	client.Send(nil, client.server.name, kind, params...)
+}
+
+// noteNotice sends the client a notice, along with a NOTE if structured notices are on.
+func (client *Client) noteNotice(command, code string, context []string, text string) {
+	client.Notice(text)
+	client.structuredNotice("NOTE", command, code, context, text)
+}
+
+// warnNotice sends the client a notice, along with a WARN if structured notices are on.
+func (client *Client) warnNotice(command, code string, context []string, text string) {
+	client.Notice(text)
+	client.structuredNotice("WARN", command, code, context, text)
+}
+
+// warnSendQ tells the client that their sendq is filling up.
+func (client *Client) warnSendQ() {
+	maxSendQ := bytefmt.ByteSize(client.socket.MaxSendQ())
+	client.warnNotice("*", "SENDQ_FILLING", []string{maxSendQ}, fmt.Sprintf("You aren't reading data as quickly as it's being sent to you, you'll be disconnected if more than %s is waiting", maxSendQ))
+}
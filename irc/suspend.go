@@ -0,0 +1,175 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/sno"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	// keyAccountSuspended holds the AccountSuspension of a suspended account, as JSON.
+	keyAccountSuspended = "account.suspended %s"
+)
+
+var (
+	errAccountSuspended    = errors.New("Account is suspended")
+	errAccountNotSuspended = errors.New("Account is not suspended")
+)
+
+// AccountSuspension is why and when opers suspended an account. Suspended accounts can't be
+// logged into, their nicknames aren't protected, and the channels they founded are locked.
+type AccountSuspension struct {
+	Reason      string
+	SuspendedBy string
+	SuspendedAt time.Time
+}
+
+// loadAccountSuspension returns the account's suspension, or nil if it isn't suspended.
+func loadAccountSuspension(tx *buntdb.Tx, accountKey string) *AccountSuspension {
+	suspensionText, err := tx.Get(fmt.Sprintf(keyAccountSuspended, accountKey))
+	if err != nil {
+		return nil
+	}
+	var suspension AccountSuspension
+	err = json.Unmarshal([]byte(suspensionText), &suspension)
+	if err != nil {
+		// it's still suspended, even if we can't tell why
+		return &AccountSuspension{}
+	}
+	return &suspension
+}
+
+// channelLocked returns true if the channel's founder is suspended, which freezes the
+// channel's registration until they're unsuspended.
+func channelLocked(tx *buntdb.Tx, chanReg *RegisteredChannel) bool {
+	founderKey, err := CasefoldName(chanReg.Founder)
+	return err == nil && loadAccountSuspension(tx, founderKey) != nil
+}
+
+// isChannelLocked returns true if the channel's founder is suspended.
+func (server *Server) isChannelLocked(chanReg *RegisteredChannel) bool {
+	var locked bool
+	server.store.View(func(tx *buntdb.Tx) error {
+		locked = channelLocked(tx, chanReg)
+		return nil
+	})
+	return locked
+}
+
+// refuseLockedChannel tells the client if the channel is locked, returning true if it is.
+func (server *Server) refuseLockedChannel(client *Client, chanReg *RegisteredChannel, rb *ResponseBuffer) bool {
+	if !server.isChannelLocked(chanReg) {
+		return false
+	}
+	rb.ChanServNotice(fmt.Sprintf("%s is locked, because its founder's account is suspended", chanReg.Name))
+	return true
+}
+
+// setAccountSuspension suspends the account, or unsuspends it if the suspension is nil.
+func (server *Server) setAccountSuspension(account *ClientAccount, suspension *AccountSuspension) error {
+	accountKey, _ := CasefoldName(account.Name)
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		key := fmt.Sprintf(keyAccountSuspended, accountKey)
+		if suspension == nil {
+			_, err := tx.Delete(key)
+			if err == buntdb.ErrNotFound {
+				return errAccountNotSuspended
+			}
+			return err
+		}
+		if _, err := tx.Get(key); err == nil {
+			return errAccountSuspended
+		}
+		suspensionText, err := json.Marshal(suspension)
+		if err != nil {
+			return err
+		}
+		_, _, err = tx.Set(key, string(suspensionText), nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	account.Suspension = suspension
+	if suspension != nil {
+		for _, accountClient := range account.getClients() {
+			accountClient.logoutOfAccount(NewResponseBuffer(accountClient))
+			accountClient.NickServNotice(fmt.Sprintf("The account %s has been suspended", account.Name))
+		}
+	}
+	return nil
+}
+
+// SUSPEND <account> [<reason>]
+func suspendHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	account := server.loadAccountByName(msg.Params[0])
+	if account == nil {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "SUSPEND", msg.Params[0], "No such account")
+		return false
+	}
+	if !server.checkWritable(client, "SUSPEND", rb) {
+		return false
+	}
+	reason := strings.Join(msg.Params[1:], " ")
+
+	suspension := &AccountSuspension{
+		Reason:      reason,
+		SuspendedBy: client.operName,
+		SuspendedAt: time.Now(),
+	}
+	err := server.setAccountSuspension(account, suspension)
+	if err == errAccountSuspended {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "SUSPEND", account.Name, "Account is already suspended")
+		return false
+	} else if err != nil {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "SUSPEND", "Could not save the account")
+		server.logger.Error("internal", fmt.Sprintf("Could not suspend account %s: %s", account.Name, err.Error()))
+		return false
+	}
+
+	if reason == "" {
+		reason = "no reason given"
+	}
+	rb.Notice(fmt.Sprintf("Account %s is now suspended", account.Name))
+	server.logger.Info("opers", fmt.Sprintf("Oper %s [%s] suspended account %s (%s)", client.nick, client.operName, account.Name, reason))
+	server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("%s$r suspended account $c[grey][$r%s$c[grey]] (%s)"), client.nick, account.Name, reason))
+	return false
+}
+
+// UNSUSPEND <account>
+func unsuspendHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	account := server.loadAccountByName(msg.Params[0])
+	if account == nil {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "UNSUSPEND", msg.Params[0], "No such account")
+		return false
+	}
+	if !server.checkWritable(client, "UNSUSPEND", rb) {
+		return false
+	}
+
+	err := server.setAccountSuspension(account, nil)
+	if err == errAccountNotSuspended {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "UNSUSPEND", account.Name, "Account is not suspended")
+		return false
+	} else if err != nil {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "UNSUSPEND", "Could not save the account")
+		server.logger.Error("internal", fmt.Sprintf("Could not unsuspend account %s: %s", account.Name, err.Error()))
+		return false
+	}
+
+	rb.Notice(fmt.Sprintf("Account %s is no longer suspended", account.Name))
+	server.logger.Info("opers", fmt.Sprintf("Oper %s [%s] unsuspended account %s", client.nick, client.operName, account.Name))
+	server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("%s$r unsuspended account $c[grey][$r%s$c[grey]]"), client.nick, account.Name))
+	return false
+}
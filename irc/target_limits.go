@@ -0,0 +1,115 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// defaultTargMax is how many targets each command takes at once, unless the config says
+	// otherwise. 0 means there's no limit. PRIVMSG, NOTICE and TAGMSG use the client's
+	// max-targets instead.
+	defaultTargMax = map[string]int{
+		"ACCOUNTSTATUS": 10,
+		"JOIN":          0,
+		"KICK":          4,
+		"LIST":          0,
+		"NAMES":         1,
+		"PART":          0,
+		"USERHOST":      10,
+		"WHOIS":         1,
+	}
+)
+
+// loadTargMax returns the target limits for each command, with the configured ones replacing
+// the defaults.
+func loadTargMax(configured map[string]int) (map[string]int, error) {
+	targmax := make(map[string]int)
+	for command, limit := range defaultTargMax {
+		targmax[command] = limit
+	}
+	for command, limit := range configured {
+		command = strings.ToUpper(command)
+		if _, exists := defaultTargMax[command]; !exists {
+			return nil, fmt.Errorf("%s can't have a target limit", command)
+		}
+		if limit < 0 {
+			return nil, fmt.Errorf("The target limit for %s can't be negative", command)
+		}
+		targmax[command] = limit
+	}
+	return targmax, nil
+}
+
+// targMaxISupport returns the value of the TARGMAX token.
+func (server *Server) targMaxISupport() string {
+	limits := make(map[string]string)
+	for command, limit := range server.limits.TargMax {
+		limits[command] = ""
+		if 0 < limit {
+			limits[command] = strconv.Itoa(limit)
+		}
+	}
+	maxTargetsString := strconv.Itoa(maxTargets)
+	limits["PRIVMSG"] = maxTargetsString
+	limits["NOTICE"] = maxTargetsString
+	limits["TAGMSG"] = maxTargetsString
+	limits["MONITOR"] = ""
+
+	var tokens []string
+	for command, limit := range limits {
+		tokens = append(tokens, fmt.Sprintf("%s:%s", command, limit))
+	}
+	sort.Strings(tokens)
+	return strings.Join(tokens, ",")
+}
+
+// targetLimit returns how many targets the client can give the command at once, or 0 if
+// there's no limit.
+func (client *Client) targetLimit(command string) int {
+	switch command {
+	case "PRIVMSG", "NOTICE", "TAGMSG":
+		return client.maxTargets()
+	}
+	// opers have always been able to look up lots of things at once
+	if client.hasFlag(Operator) {
+		return 0
+	}
+	return client.server.limits.TargMax[command]
+}
+
+// limitTargets returns as many of the targets as the client can give the command at once,
+// telling them about the ones that were dropped.
+func (client *Client) limitTargets(command string, targets []string, rb *ResponseBuffer) []string {
+	limit := client.targetLimit(command)
+	if limit == 0 || len(targets) <= limit {
+		return targets
+	}
+	rb.Send(nil, client.server.name, ERR_TOOMANYTARGETS, client.nick, targets[limit], fmt.Sprintf("Too many targets, %s takes at most %d", command, limit))
+	return targets[:limit]
+}
+
+// limit drops the changes that take an argument after the first maxModes of them, like
+// other servers do. List queries and changes without an argument are always kept.
+func (changes ModeChanges) limit(maxModes int) ModeChanges {
+	if maxModes == 0 {
+		return changes
+	}
+	limited := make(ModeChanges, 0, len(changes))
+	var argModes int
+	for _, change := range changes {
+		if change.arg != "" {
+			if argModes == maxModes {
+				continue
+			}
+			argModes++
+		}
+		limited = append(limited, change)
+	}
+	return limited
+}
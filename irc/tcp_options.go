@@ -0,0 +1,166 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/oragono/oragono/irc/custime"
+)
+
+// TCPListenerConfig tunes the TCP sockets of a listener, for operators of busy servers.
+type TCPListenerConfig struct {
+	// KeepAlive is how often keepalive probes are sent on idle connections. "off" disables
+	// them, and the Go default is used if it's empty.
+	KeepAliveString string        `yaml:"keepalive"`
+	KeepAlive       time.Duration `yaml:"keepalive-real"`
+	KeepAliveOff    bool          `yaml:"keepalive-off"`
+	// NoDelay disables Nagle's algorithm. Go enables it by default.
+	NoDelay *bool `yaml:"nodelay"`
+	// Backlog is the length of the accept queue, with 0 using the system default.
+	Backlog int
+	// DeferAccept only wakes us up for new connections once they've sent some data (linux only).
+	DeferAcceptString string        `yaml:"defer-accept"`
+	DeferAccept       time.Duration `yaml:"defer-accept-real"`
+	// FastOpen is the length of the TCP Fast Open queue, with 0 disabling it (linux only).
+	FastOpen int `yaml:"fast-open"`
+}
+
+// load parses the config's durations.
+func (conf *TCPListenerConfig) load() error {
+	var err error
+	if conf.KeepAliveString == "off" {
+		conf.KeepAliveOff = true
+	} else if conf.KeepAliveString != "" {
+		conf.KeepAlive, err = custime.ParseDuration(conf.KeepAliveString)
+		if err != nil || conf.KeepAlive < time.Second {
+			return fmt.Errorf("Could not parse keepalive (must be at least a second, or off): %s", conf.KeepAliveString)
+		}
+	}
+	if conf.DeferAcceptString != "" {
+		conf.DeferAccept, err = custime.ParseDuration(conf.DeferAcceptString)
+		if err != nil || conf.DeferAccept < 0 {
+			return fmt.Errorf("Could not parse defer-accept: %s", conf.DeferAcceptString)
+		}
+	}
+	if conf.Backlog < 0 || conf.FastOpen < 0 {
+		return fmt.Errorf("backlog and fast-open can't be negative")
+	}
+	return nil
+}
+
+// listenTCP opens a TCP listener on the given address, using the given socket options.
+func listenTCP(addr string, conf TCPListenerConfig) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			controlErr := c.Control(func(fd uintptr) {
+				err = setListenerSocketOptions(fd, conf)
+			})
+			if controlErr != nil {
+				return controlErr
+			}
+			return err
+		},
+	}
+	listener, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if 0 < conf.Backlog {
+		err = setListenerBacklog(listener, conf.Backlog)
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("Could not set backlog: %s", err.Error())
+		}
+	}
+	return listener, nil
+}
+
+// setListenerBacklog changes the length of the listener's accept queue.
+func setListenerBacklog(listener net.Listener, backlog int) error {
+	tcpListener, isTCP := listener.(*net.TCPListener)
+	if !isTCP {
+		return nil
+	}
+	rawConn, err := tcpListener.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	err = rawConn.Control(func(fd uintptr) {
+		listenErr = setSocketBacklog(fd, backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return listenErr
+}
+
+// tcpOptionsListener sets the per-connection TCP options on the connections it accepts.
+type tcpOptionsListener struct {
+	net.Listener
+	server *Server
+	addr   string
+	isTLS  bool
+}
+
+// Accept waits for and returns the next connection, with its TCP options set. Connections
+// over the listener's connection limit are turned away here.
+func (listener *tcpOptionsListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			return conn, err
+		}
+
+		listener.server.listenerUpdateMutex.Lock()
+		listenerConfig := listener.server.listenerConfigs[listener.addr]
+		listener.server.listenerUpdateMutex.Unlock()
+		if listenerConfig == nil {
+			listenerConfig = &ListenerConfig{}
+		}
+
+		if !listener.server.listenerConns.Acquire(listener.addr, listenerConfig.MaxConnections) {
+			// TLS clients wouldn't understand a plaintext ERROR, so they just get closed
+			if !listener.isTLS {
+				conn.Write([]byte(listenerFullBytes))
+			}
+			conn.Close()
+			listener.server.logger.Debug("localconnect-ip", fmt.Sprintf("Listener %s is full, refused connection from %s", listener.addr, IPString(conn.RemoteAddr())))
+			continue
+		}
+
+		setTCPOptions(conn, listenerConfig.TCP)
+		return &countedConn{
+			Conn:  conn,
+			conns: listener.server.listenerConns,
+			addr:  listener.addr,
+		}, nil
+	}
+}
+
+// setTCPOptions sets the per-connection TCP options on the given connection.
+func setTCPOptions(conn net.Conn, conf TCPListenerConfig) {
+	tcpConn, isTCP := conn.(*net.TCPConn)
+	if !isTCP {
+		return
+	}
+
+	// these are set on each connection rather than the listener, so they can be rehashed
+	if conf.KeepAliveOff {
+		tcpConn.SetKeepAlive(false)
+	} else if conf.KeepAlive != 0 {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(conf.KeepAlive)
+	}
+	if conf.NoDelay != nil {
+		tcpConn.SetNoDelay(*conf.NoDelay)
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"syscall"
+)
+
+// tcpFastOpen is TCP_FASTOPEN, which the syscall package doesn't define.
+const tcpFastOpen = 0x17
+
+// setListenerSocketOptions sets the listen-time socket options, before the socket is bound.
+func setListenerSocketOptions(fd uintptr, conf TCPListenerConfig) error {
+	if 0 < conf.DeferAccept {
+		err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, int(conf.DeferAccept.Seconds()))
+		if err != nil {
+			return err
+		}
+	}
+	if 0 < conf.FastOpen {
+		err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen, conf.FastOpen)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setSocketBacklog changes the backlog of a listening socket.
+func setSocketBacklog(fd uintptr, backlog int) error {
+	// calling listen() again on a listening socket just changes its backlog
+	return syscall.Listen(int(fd), backlog)
+}
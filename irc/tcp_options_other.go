@@ -0,0 +1,24 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+//go:build !linux
+// +build !linux
+
+package irc
+
+import (
+	"errors"
+)
+
+// setListenerSocketOptions sets the listen-time socket options, before the socket is bound.
+func setListenerSocketOptions(fd uintptr, conf TCPListenerConfig) error {
+	if 0 < conf.DeferAccept || 0 < conf.FastOpen {
+		return errors.New("defer-accept and fast-open are only supported on linux")
+	}
+	return nil
+}
+
+// setSocketBacklog changes the backlog of a listening socket.
+func setSocketBacklog(fd uintptr, backlog int) error {
+	return errors.New("backlog is only supported on linux")
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"time"
+)
+
+// TopicHistoryEntry is a topic that was set on a registered channel.
+type TopicHistoryEntry struct {
+	Topic string
+	// SetBy is the nickmask of the client that set the topic.
+	SetBy string
+	// Account is the account the client was logged into, if any.
+	Account string
+	SetAt   time.Time
+}
+
+// addTopicHistory records a new topic on the channel, keeping the given number of the most
+// recent ones.
+func (chanReg *RegisteredChannel) addTopicHistory(entry TopicHistoryEntry, length int) {
+	if length < 1 {
+		chanReg.TopicHistory = nil
+		return
+	}
+	chanReg.TopicHistory = append(chanReg.TopicHistory, entry)
+	if length < len(chanReg.TopicHistory) {
+		chanReg.TopicHistory = chanReg.TopicHistory[len(chanReg.TopicHistory)-length:]
+	}
+}
+
+// chanservTopicHistory handles the ChanServ TOPICHISTORY command, which lists the topics
+// recently set on a registered channel, newest first. Secret channels only show theirs to
+// members, people on the access list and opers.
+//
+// TOPICHISTORY <channel>
+func (server *Server) chanservTopicHistory(client *Client, params []string, rb *ResponseBuffer) {
+	if len(params) < 1 {
+		rb.ChanServNotice("Syntax: TOPICHISTORY <channel>")
+		return
+	}
+	_, channel, chanReg := server.loadRegisteredChannel(client, params[0], rb)
+	if chanReg == nil {
+		return
+	}
+	if channel != nil && channel.flags[Secret] && !client.hasFlag(Operator) && chanReg.accessMode(client.account) == 0 {
+		channel.membersMutex.RLock()
+		isMember := channel.members.Has(client)
+		channel.membersMutex.RUnlock()
+		if !isMember {
+			rb.ChanServNotice(fmt.Sprintf("You can't see the topic history of %s", chanReg.Name))
+			return
+		}
+	}
+
+	server.registeredChannelsMutex.Lock()
+	entries := make([]TopicHistoryEntry, len(chanReg.TopicHistory))
+	copy(entries, chanReg.TopicHistory)
+	server.registeredChannelsMutex.Unlock()
+	if len(entries) == 0 {
+		rb.ChanServNotice(fmt.Sprintf("%s has no topic history", chanReg.Name))
+		return
+	}
+
+	rb.ChanServNotice(fmt.Sprintf("Topic history for %s:", chanReg.Name))
+	for i := len(entries) - 1; 0 <= i; i-- {
+		entry := entries[i]
+		setBy := entry.SetBy
+		if entry.Account != "" {
+			setBy = fmt.Sprintf("%s (account %s)", entry.SetBy, entry.Account)
+		}
+		topic := entry.Topic
+		if topic == "" {
+			topic = "(topic cleared)"
+		}
+		rb.ChanServNotice(fmt.Sprintf("%s by %s: %s", entry.SetAt.UTC().Format(time.RFC1123), setBy, topic))
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+var (
+	// typingTags are the client-only tags that carry typing notifications.
+	typingTags = []string{"+typing", "+draft/typing"}
+)
+
+// TypingPolicy controls how typing notifications are relayed.
+type TypingPolicy struct {
+	// maxChannelSize is the most members a channel can have for typing notifications
+	// to be relayed to it, or 0 for no limit
+	maxChannelSize int
+	// minInterval is how often a client can send typing notifications to a single target
+	minInterval time.Duration
+}
+
+// NewTypingPolicy returns a new TypingPolicy from the given config.
+func NewTypingPolicy(config TypingConfig) *TypingPolicy {
+	return &TypingPolicy{
+		maxChannelSize: config.MaxChannelSize,
+		minInterval:    config.MinInterval,
+	}
+}
+
+// hasTypingTag returns true if the given tags contain a typing notification.
+func hasTypingTag(tags *map[string]ircmsg.TagValue) bool {
+	if tags == nil {
+		return false
+	}
+	for _, name := range typingTags {
+		if _, exists := (*tags)[name]; exists {
+			return true
+		}
+	}
+	return false
+}
+
+// stripTypingTags returns the given tags without any typing notifications, or nil
+// if there are no tags left.
+func stripTypingTags(tags *map[string]ircmsg.TagValue) *map[string]ircmsg.TagValue {
+	newTags := make(map[string]ircmsg.TagValue)
+	for name, value := range *tags {
+		newTags[name] = value
+	}
+	for _, name := range typingTags {
+		delete(newTags, name)
+	}
+
+	if len(newTags) == 0 {
+		return nil
+	}
+	return &newTags
+}
+
+// allowChannel returns true if typing notifications can be relayed to the given channel.
+func (tp *TypingPolicy) allowChannel(channel *Channel) bool {
+	channel.membersMutex.RLock()
+	defer channel.membersMutex.RUnlock()
+
+	if channel.flags[NoTyping] {
+		return false
+	}
+	return tp.maxChannelSize == 0 || len(channel.members) <= tp.maxChannelSize
+}
+
+// allowClient returns true if the given client can send a typing notification to the
+// given (casefolded) target right now, and records that they've sent one.
+func (tp *TypingPolicy) allowClient(client *Client, target string) bool {
+	if tp.minInterval == 0 {
+		return true
+	}
+
+	now := time.Now()
+	for name, lastTime := range client.typingTimes {
+		if tp.minInterval <= now.Sub(lastTime) {
+			delete(client.typingTimes, name)
+		}
+	}
+
+	if _, exists := client.typingTimes[target]; exists {
+		return false
+	}
+	client.typingTimes[target] = now
+	return true
+}
+
+// filterTags applies the typing policy to a TAGMSG from the given client, returning the
+// tags that should be relayed or nil if the message should be dropped. channel is nil
+// when the target is a user.
+func (tp *TypingPolicy) filterTags(client *Client, target string, channel *Channel, tags *map[string]ircmsg.TagValue) *map[string]ircmsg.TagValue {
+	if !hasTypingTag(tags) {
+		return tags
+	}
+
+	if channel != nil && !tp.allowChannel(channel) {
+		return stripTypingTags(tags)
+	}
+	if !tp.allowClient(client, target) {
+		return stripTypingTags(tags)
+	}
+	return tags
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/oragono/oragono/irc/sno"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	keyVhostRequest = "account.vhostrequest %s"
+)
+
+// VhostRequest is a vhost that a user has asked for, waiting for an oper to approve it.
+type VhostRequest struct {
+	Account     string
+	Vhost       string
+	RequestedAt time.Time
+}
+
+// loadVhostRequests returns the waiting vhost requests, oldest first.
+func (server *Server) loadVhostRequests() []VhostRequest {
+	var requests []VhostRequest
+	server.store.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys(fmt.Sprintf(keyVhostRequest, "*"), func(key, value string) bool {
+			var request VhostRequest
+			if json.Unmarshal([]byte(value), &request) == nil {
+				requests = append(requests, request)
+			}
+			return true
+		})
+	})
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].RequestedAt.Before(requests[j].RequestedAt)
+	})
+	return requests
+}
+
+// takeVhostRequest removes and returns the given account's waiting vhost request.
+func (server *Server) takeVhostRequest(accountKey string) (*VhostRequest, error) {
+	var request VhostRequest
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		value, err := tx.Delete(fmt.Sprintf(keyVhostRequest, accountKey))
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal([]byte(value), &request)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// notifyAccount sends a HostServ notice to every client logged into the given account.
+func notifyAccount(account *ClientAccount, text string) {
+	for _, accountClient := range account.getClients() {
+		accountClient.HostServNotice(text)
+	}
+}
+
+// hostservRequest handles the HostServ REQUEST command, which asks the opers for a vhost.
+//
+// REQUEST <vhost>
+func (server *Server) hostservRequest(client *Client, params []string, rb *ResponseBuffer) {
+	if !server.vhosts.UserRequests {
+		rb.HostServNotice("Vhost requests are disabled, see OFFERLIST for the vhosts you can take")
+		return
+	}
+	if len(params) < 1 {
+		rb.HostServNotice("Syntax: REQUEST <vhost>")
+		return
+	}
+	account := client.account
+	vhost := strings.ToLower(params[0])
+	if !isValidVhost(vhost) {
+		rb.HostServNotice("That vhost is invalid")
+		return
+	}
+	cooldown := server.vhosts.ChangeCooldown
+	if 0 < cooldown && time.Since(account.VhostChanged) < cooldown {
+		rb.HostServNotice(fmt.Sprintf("You can only change your vhost once every %s, please try again later", cooldown.String()))
+		return
+	}
+	if !server.checkWritable(client, "HOSTSERV", rb) {
+		return
+	}
+
+	accountKey, _ := CasefoldName(account.Name)
+	requestBytes, _ := json.Marshal(VhostRequest{
+		Account:     account.Name,
+		Vhost:       vhost,
+		RequestedAt: time.Now(),
+	})
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(fmt.Sprintf(keyVhostRequest, accountKey), string(requestBytes), nil)
+		return err
+	})
+	if err != nil {
+		rb.HostServNotice("Could not save your request")
+		server.logger.Error("hostserv", fmt.Sprintf("Could not save vhost request for account %s: %s", account.Name, err.Error()))
+		return
+	}
+	rb.HostServNotice(fmt.Sprintf("Your request for %s has been sent to the opers", vhost))
+	server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Account $c[grey][$r%s$c[grey]] requested vhost $c[grey][$r%s$c[grey]]"), account.Name, vhost))
+}
+
+// hostservOper handles the oper-only HostServ commands, which review vhost requests and set
+// anyone's vhost.
+//
+// WAITING | APPROVE <account> | REJECT <account> [<reason>] | SET <account> <vhost> | DEL <account>
+func (server *Server) hostservOper(client *Client, command string, params []string, rb *ResponseBuffer) {
+	if !client.HasCapabs("vhosts") {
+		rb.HostServNotice("Insufficient privileges")
+		return
+	}
+
+	if command == "waiting" {
+		requests := server.loadVhostRequests()
+		if len(requests) == 0 {
+			rb.HostServNotice("There are no vhost requests waiting")
+			return
+		}
+		for _, request := range requests {
+			rb.HostServNotice(fmt.Sprintf("%s wants %s (requested %s ago)", request.Account, request.Vhost, time.Since(request.RequestedAt).Truncate(time.Second)))
+		}
+		return
+	}
+
+	if len(params) < 1 || (command == "set" && len(params) < 2) {
+		switch command {
+		case "approve":
+			rb.HostServNotice("Syntax: APPROVE <account>")
+		case "reject":
+			rb.HostServNotice("Syntax: REJECT <account> [<reason>]")
+		case "set":
+			rb.HostServNotice("Syntax: SET <account> <vhost>")
+		case "del":
+			rb.HostServNotice("Syntax: DEL <account>")
+		}
+		return
+	}
+	account := server.loadAccountByName(params[0])
+	if account == nil {
+		rb.HostServNotice("That account does not exist")
+		return
+	}
+	accountKey, _ := CasefoldName(account.Name)
+	if !server.checkWritable(client, "HOSTSERV", rb) {
+		return
+	}
+
+	var vhost string
+	switch command {
+	case "approve", "reject":
+		request, err := server.takeVhostRequest(accountKey)
+		if err != nil {
+			rb.HostServNotice(fmt.Sprintf("%s doesn't have a vhost request waiting", account.Name))
+			return
+		}
+		if command == "reject" {
+			reason := strings.Join(params[1:], " ")
+			rb.HostServNotice(fmt.Sprintf("Rejected %s's request for %s", account.Name, request.Vhost))
+			if reason == "" {
+				notifyAccount(account, fmt.Sprintf("Your request for %s was rejected", request.Vhost))
+			} else {
+				notifyAccount(account, fmt.Sprintf("Your request for %s was rejected: %s", request.Vhost, reason))
+			}
+			server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("%s$r rejected vhost $c[grey][$r%s$c[grey]] for account $c[grey][$r%s$c[grey]]"), client.nick, request.Vhost, account.Name))
+			return
+		}
+		vhost = request.Vhost
+	case "set":
+		vhost = strings.ToLower(params[1])
+		if !isValidVhost(vhost) {
+			rb.HostServNotice("That vhost is invalid")
+			return
+		}
+	case "del":
+		if account.Vhost == "" {
+			rb.HostServNotice("That account doesn't have a vhost")
+			return
+		}
+	}
+
+	err := server.setAccountVhost(account, vhost)
+	if err != nil {
+		rb.HostServNotice("Could not save the vhost")
+		server.logger.Error("hostserv", fmt.Sprintf("Could not save vhost for account %s: %s", account.Name, err.Error()))
+		return
+	}
+	if vhost == "" {
+		rb.HostServNotice(fmt.Sprintf("Removed the vhost from %s", account.Name))
+		notifyAccount(account, "Your vhost has been removed")
+		server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("%s$r removed the vhost from account $c[grey][$r%s$c[grey]]"), client.nick, account.Name))
+	} else {
+		rb.HostServNotice(fmt.Sprintf("%s now has the vhost %s", account.Name, vhost))
+		notifyAccount(account, fmt.Sprintf("Your vhost is now %s", vhost))
+		server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("%s$r assigned vhost $c[grey][$r%s$c[grey]] to account $c[grey][$r%s$c[grey]]"), client.nick, vhost, account.Name))
+	}
+}
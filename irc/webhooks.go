@@ -0,0 +1,378 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	defaultWebhookTimeout = 10 * time.Second
+	// webhookQueueLength is how many events can be waiting to be delivered before we start
+	// dropping them.
+	webhookQueueLength = 256
+
+	// WebhookEventMessage is sent for each PRIVMSG and NOTICE to the channel.
+	WebhookEventMessage = "message"
+	// WebhookEventJoin is sent when someone joins the channel.
+	WebhookEventJoin = "join"
+	// WebhookEventPart is sent when someone parts the channel.
+	WebhookEventPart = "part"
+	// WebhookEventTopic is sent when the channel's topic is changed.
+	WebhookEventTopic = "topic"
+)
+
+var (
+	errWebhookPrivateAddress = errors.New("Webhooks can't be sent to private addresses")
+
+	// webhookEvents are the events that webhooks can be sent for.
+	webhookEvents = []string{WebhookEventMessage, WebhookEventJoin, WebhookEventPart, WebhookEventTopic}
+	// defaultWebhookEvents are the events new webhooks get, messages are left out since
+	// sending every message somewhere else is a big step.
+	defaultWebhookEvents = []string{WebhookEventJoin, WebhookEventPart, WebhookEventTopic}
+
+	// privateNetworks are the networks webhooks can't be sent to, unless that's allowed.
+	privateNetworks = parseNetworks("127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16", "0.0.0.0/8", "::1/128", "fc00::/7", "fe80::/10")
+)
+
+// WebhooksConfig controls the webhooks that channel founders can set up to be told about
+// what happens in their channels.
+type WebhooksConfig struct {
+	Enabled       bool
+	TimeoutString string        `yaml:"timeout"`
+	Timeout       time.Duration `yaml:"timeout-real"`
+	// AllowPrivateNetworks lets webhooks be sent to loopback and private addresses.
+	AllowPrivateNetworks bool `yaml:"allow-private-networks"`
+}
+
+// load checks the config and parses the timeout.
+func (conf *WebhooksConfig) load() (err error) {
+	conf.Timeout = defaultWebhookTimeout
+	if conf.TimeoutString != "" {
+		conf.Timeout, err = time.ParseDuration(conf.TimeoutString)
+		if err != nil {
+			return fmt.Errorf("Could not parse timeout: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// ChannelWebhook is where a registered channel's events are sent, and which ones.
+type ChannelWebhook struct {
+	URL string
+	// Secret is used to sign the events, so the receiver knows they came from us.
+	Secret string
+	Events []string
+}
+
+// wants returns true if the webhook should be sent the given event.
+func (hook *ChannelWebhook) wants(event string) bool {
+	for _, wanted := range hook.Events {
+		if wanted == event {
+			return true
+		}
+	}
+	return false
+}
+
+// isWebhookEvent returns true if webhooks can be sent the given event.
+func isWebhookEvent(event string) bool {
+	for _, known := range webhookEvents {
+		if known == event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookPayload is the JSON that's posted to webhooks.
+type webhookPayload struct {
+	Channel string    `json:"channel"`
+	Event   string    `json:"event"`
+	Nick    string    `json:"nick"`
+	Account string    `json:"account,omitempty"`
+	Command string    `json:"command,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Topic   string    `json:"topic,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// webhookDelivery is an event waiting to be sent to a webhook.
+type webhookDelivery struct {
+	hook    ChannelWebhook
+	payload webhookPayload
+}
+
+// parseNetworks parses the given CIDRs.
+func parseNetworks(cidrs ...string) (networks []net.IPNet) {
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil {
+			networks = append(networks, *network)
+		}
+	}
+	return networks
+}
+
+// isPrivateAddress returns true if the given IP is a loopback, private or link-local one.
+func isPrivateAddress(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookDialer returns a dial function that refuses to connect to private addresses. The
+// check is done on the addresses the dialer actually connects to, so a hostname can't pass
+// it and then resolve somewhere else.
+func webhookDialer(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("No addresses found for %s", host)
+		}
+		for _, addr := range addrs {
+			if isPrivateAddress(addr.IP) {
+				return nil, errWebhookPrivateAddress
+			}
+		}
+		for _, addr := range addrs {
+			var conn net.Conn
+			conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(addr.IP.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// randomWebhookSecret returns a new secret for signing webhooks.
+func randomWebhookSecret() string {
+	secret := make([]byte, 24)
+	rand.Read(secret)
+	return hex.EncodeToString(secret)
+}
+
+// setWebhook changes where the channel's events are sent, nil turns them off.
+func (channel *Channel) setWebhook(hook *ChannelWebhook) {
+	channel.webhookMutex.Lock()
+	defer channel.webhookMutex.Unlock()
+	if hook == nil || hook.URL == "" {
+		channel.webhook = nil
+	} else {
+		channel.webhook = hook
+	}
+}
+
+// sendWebhook queues the given event to be sent to the channel's webhook, if it has one that
+// wants it.
+func (channel *Channel) sendWebhook(event string, client *Client, payload webhookPayload) {
+	server := channel.server
+	if !server.webhooks.Enabled {
+		return
+	}
+	channel.webhookMutex.Lock()
+	hook := channel.webhook
+	channel.webhookMutex.Unlock()
+	if hook == nil || !hook.wants(event) {
+		return
+	}
+
+	payload.Channel = channel.name
+	payload.Event = event
+	payload.Nick = client.nick
+	if client.account != &NoAccount {
+		payload.Account = client.account.Name
+	}
+	payload.Time = time.Now().UTC()
+
+	select {
+	case server.webhookQueue <- webhookDelivery{hook: *hook, payload: payload}:
+	default:
+		server.logger.Warning("webhooks", fmt.Sprintf("Too many webhooks waiting to be sent, dropped %s event for %s", event, channel.name))
+	}
+}
+
+// runWebhooks sends queued webhook events, one at a time.
+func (server *Server) runWebhooks() {
+	for delivery := range server.webhookQueue {
+		err := server.deliverWebhook(delivery)
+		if err != nil {
+			server.logger.Info("webhooks", fmt.Sprintf("Could not send %s event for %s to %s: %s", delivery.payload.Event, delivery.payload.Channel, delivery.hook.URL, err.Error()))
+		}
+	}
+}
+
+// deliverWebhook posts an event to a webhook. The body is signed with the webhook's
+// secret, using HMAC-SHA256, and the signature is in the X-Oragono-Signature header.
+func (server *Server) deliverWebhook(delivery webhookDelivery) error {
+	conf := server.webhooks
+	body, err := json.Marshal(delivery.payload)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, []byte(delivery.hook.Secret))
+	mac.Write(body)
+
+	req, err := http.NewRequest("POST", delivery.hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Oragono-Event", delivery.payload.Event)
+	req.Header.Set("X-Oragono-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	dialer := &net.Dialer{Timeout: conf.Timeout}
+	dial := dialer.DialContext
+	if !conf.AllowPrivateNetworks {
+		dial = webhookDialer(dialer)
+	}
+	// each delivery gets its own transport, so its connections aren't kept open afterwards
+	httpClient := http.Client{
+		Timeout:   conf.Timeout,
+		Transport: &http.Transport{DialContext: dial, DisableKeepAlives: true},
+		// a redirect could send us somewhere we wouldn't have posted to, so we don't follow them
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || 299 < resp.StatusCode {
+		return fmt.Errorf("Got HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+// chanservWebhook handles the ChanServ WEBHOOK command.
+//
+// WEBHOOK <channel> [SET <url> | EVENTS <event> [<event>...] | SECRET | OFF]
+func (server *Server) chanservWebhook(client *Client, params []string, rb *ResponseBuffer) {
+	if len(params) < 1 {
+		rb.ChanServNotice("Syntax: WEBHOOK <channel> [SET <url> | EVENTS <event> [<event>...] | SECRET | OFF]")
+		return
+	}
+	if !server.webhooks.Enabled {
+		rb.ChanServNotice("Webhooks are not enabled")
+		return
+	}
+	channelKey, channel, chanReg := server.loadRegisteredChannel(client, params[0], rb)
+	if chanReg == nil {
+		return
+	}
+	if chanReg.accessMode(client.account) != ChannelFounder {
+		rb.ChanServNotice(fmt.Sprintf("Only the founder of %s can see or change its webhook", chanReg.Name))
+		return
+	}
+
+	hook := chanReg.Webhook
+	if len(params) < 2 {
+		if hook.URL == "" {
+			rb.ChanServNotice(fmt.Sprintf("%s has no webhook", chanReg.Name))
+		} else {
+			rb.ChanServNotice(fmt.Sprintf("The webhook for %s is %s (events: %s)", chanReg.Name, hook.URL, strings.Join(hook.Events, ", ")))
+		}
+		return
+	}
+
+	switch strings.ToLower(params[1]) {
+	case "set":
+		if len(params) < 3 {
+			rb.ChanServNotice("Syntax: WEBHOOK <channel> SET <url>")
+			return
+		}
+		endpoint, err := url.Parse(params[2])
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			rb.ChanServNotice("The webhook must be an http:// or https:// URL")
+			return
+		}
+		if hook.URL == "" {
+			hook.Events = defaultWebhookEvents
+		}
+		hook.URL = endpoint.String()
+		hook.Secret = randomWebhookSecret()
+	case "events":
+		if len(params) < 3 {
+			rb.ChanServNotice(fmt.Sprintf("Syntax: WEBHOOK <channel> EVENTS <event> [<event>...], events can be: %s", strings.Join(webhookEvents, ", ")))
+			return
+		}
+		if hook.URL == "" {
+			rb.ChanServNotice(fmt.Sprintf("%s has no webhook, set one with WEBHOOK %s SET <url>", chanReg.Name, chanReg.Name))
+			return
+		}
+		var events []string
+		for _, event := range params[2:] {
+			event = strings.ToLower(event)
+			if !isWebhookEvent(event) {
+				rb.ChanServNotice(fmt.Sprintf("Unknown event %s, events can be: %s", event, strings.Join(webhookEvents, ", ")))
+				return
+			}
+			events = append(events, event)
+		}
+		hook.Events = events
+	case "secret":
+		if hook.URL == "" {
+			rb.ChanServNotice(fmt.Sprintf("%s has no webhook, set one with WEBHOOK %s SET <url>", chanReg.Name, chanReg.Name))
+			return
+		}
+		hook.Secret = randomWebhookSecret()
+	case "off":
+		hook = ChannelWebhook{}
+	default:
+		rb.ChanServNotice("Syntax: WEBHOOK <channel> [SET <url> | EVENTS <event> [<event>...] | SECRET | OFF]")
+		return
+	}
+	if !server.checkWritable(client, "CHANSERV", rb) {
+		return
+	}
+
+	server.registeredChannelsMutex.Lock()
+	server.store.Update(func(tx *buntdb.Tx) error {
+		chanReg.Webhook = hook
+		server.saveChannelNoMutex(tx, channelKey, *chanReg)
+		return nil
+	})
+	server.registeredChannelsMutex.Unlock()
+	if channel != nil {
+		channel.setWebhook(&hook)
+	}
+
+	switch strings.ToLower(params[1]) {
+	case "set", "secret":
+		rb.ChanServNotice(fmt.Sprintf("The webhook for %s is %s (events: %s)", chanReg.Name, hook.URL, strings.Join(hook.Events, ", ")))
+		rb.ChanServNotice(fmt.Sprintf("Its secret is %s, events are signed with it using HMAC-SHA256 in the X-Oragono-Signature header. Keep it safe", hook.Secret))
+	case "events":
+		rb.ChanServNotice(fmt.Sprintf("The webhook for %s will now be sent: %s", chanReg.Name, strings.Join(hook.Events, ", ")))
+	case "off":
+		rb.ChanServNotice(fmt.Sprintf("%s no longer has a webhook", chanReg.Name))
+	}
+}
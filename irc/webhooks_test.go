@@ -0,0 +1,54 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeliverWebhook(t *testing.T) {
+	var posts int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		posts++
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ok", http.StatusFound)
+	})
+	endpoint := httptest.NewServer(mux)
+	defer endpoint.Close()
+
+	cases := []struct {
+		path         string
+		allowPrivate bool
+		err          string
+		posts        int
+	}{
+		// the test server listens on loopback
+		{"/ok", false, errWebhookPrivateAddress.Error(), 0},
+		{"/redirect", false, errWebhookPrivateAddress.Error(), 0},
+		{"/ok", true, "", 1},
+		{"/redirect", true, "302", 0},
+	}
+	for _, c := range cases {
+		posts = 0
+		server := &Server{webhooks: WebhooksConfig{Enabled: true, Timeout: 5 * time.Second, AllowPrivateNetworks: c.allowPrivate}}
+		err := server.deliverWebhook(webhookDelivery{
+			hook:    ChannelWebhook{URL: endpoint.URL + c.path, Secret: "secret"},
+			payload: webhookPayload{Event: WebhookEventJoin},
+		})
+		if c.err == "" && err != nil {
+			t.Errorf("%s (private %v): unexpected error: %s", c.path, c.allowPrivate, err.Error())
+		} else if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%s (private %v): expected an error containing %q, got %v", c.path, c.allowPrivate, c.err, err)
+		}
+		if posts != c.posts {
+			t.Errorf("%s (private %v): expected %d posts, got %d", c.path, c.allowPrivate, c.posts, posts)
+		}
+	}
+}
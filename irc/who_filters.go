@@ -0,0 +1,128 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// whoFilter selects the clients that an oper's WHO query returns.
+type whoFilter struct {
+	// opersOnly only matches opers (flag o).
+	opersOnly bool
+	// accountKey only matches clients logged into the account (flag a).
+	accountKey string
+	// network only matches clients connecting from an IP in it (flag i).
+	network *net.IPNet
+}
+
+// parseWhoFilter parses the flags of an oper's WHO query. With the a flag the mask is an
+// account name, and with the i flag it's an IP address or CIDR.
+func parseWhoFilter(mask, flags string) (filter whoFilter, err error) {
+	var byAccount, byIP bool
+	for _, flag := range flags {
+		switch flag {
+		case 'o':
+			filter.opersOnly = true
+		case 'a':
+			byAccount = true
+		case 'i':
+			byIP = true
+		default:
+			return filter, fmt.Errorf("Unknown WHO flag %c", flag)
+		}
+	}
+	if byAccount && byIP {
+		return filter, errors.New("The a and i flags can't be used together")
+	}
+
+	if byAccount {
+		filter.accountKey, err = CasefoldName(mask)
+		if err != nil {
+			return filter, errors.New("Account name isn't valid")
+		}
+	} else if byIP {
+		if !strings.Contains(mask, "/") {
+			ip := net.ParseIP(mask)
+			if ip == nil {
+				return filter, errors.New("IP address isn't valid")
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			mask = fmt.Sprintf("%s/%d", mask, bits)
+		}
+		_, filter.network, err = net.ParseCIDR(mask)
+		if err != nil {
+			return filter, errors.New("CIDR isn't valid")
+		}
+	}
+	return filter, nil
+}
+
+// matches returns true if the client is selected by the filter.
+func (filter *whoFilter) matches(client *Client) bool {
+	if filter.opersOnly && !client.hasFlag(Operator) {
+		return false
+	}
+	if filter.network != nil && !filter.network.Contains(client.IP()) {
+		return false
+	}
+	return true
+}
+
+// candidates returns the clients that the filter should be checked against.
+func (filter *whoFilter) candidates(server *Server, mask string) ClientSet {
+	if filter.accountKey != "" {
+		clients := make(ClientSet)
+		if account, exists := server.getAccount(filter.accountKey); exists {
+			for _, client := range account.getClients() {
+				clients.Add(client)
+			}
+		}
+		return clients
+	}
+	if filter.network != nil || mask == "" || mask == "0" {
+		mask = "*"
+	}
+	return server.clients.FindAll(mask)
+}
+
+// operWhoFilter answers an oper's WHO query with flags, like listing all opers, every
+// client on a CIDR or every session of an account. Results are limited by
+// oper-who-results, and scans that could touch lots of clients are logged.
+func (server *Server) operWhoFilter(client *Client, mask, flags string, rb *ResponseBuffer) {
+	filter, err := parseWhoFilter(mask, flags)
+	if err != nil {
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "WHO", err.Error())
+		return
+	}
+
+	limit := server.limits.OperWhoResults
+	var count int
+	var truncated bool
+	for target := range filter.candidates(server, mask) {
+		if !filter.matches(target) {
+			continue
+		}
+		if 0 < limit && limit <= count {
+			truncated = true
+			break
+		}
+		client.RplWhoReplyNoMutex(nil, target, rb)
+		count++
+	}
+
+	if filter.accountKey == "" {
+		server.logger.Info("opers", fmt.Sprintf("Oper %s [%s] ran WHO %s %s, matching %d clients", client.nick, client.operName, mask, flags, count))
+	}
+	if truncated {
+		rb.Send(nil, server.name, ERR_TOOMANYMATCHES, client.nick, "WHO", fmt.Sprintf("Too many matches, only showing the first %d", limit))
+	}
+	rb.Send(nil, server.name, RPL_ENDOFWHO, client.nick, mask, "End of WHO list")
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2017 Daniel Oaks <daniel@danieloaks.net>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/tidwall/buntdb"
+)
+
+const (
+	keyAccountWhoisChannels = "account.whoischannels %s"
+
+	// WhoisChannelsAll shows all of a user's channels in WHOIS, apart from secret ones.
+	WhoisChannelsAll = "all"
+	// WhoisChannelsShared only shows the channels that the user shares with whoever's asking.
+	WhoisChannelsShared = "shared"
+	// WhoisChannelsNone doesn't show any of a user's channels.
+	WhoisChannelsNone = "none"
+)
+
+// whoisChannelsPrivacy returns which of the client's channels other users can see in WHOIS.
+func (client *Client) whoisChannelsPrivacy() string {
+	if client.account != &NoAccount && client.account.WhoisChannels != "" {
+		return client.account.WhoisChannels
+	}
+	if client.whoisChannels != "" {
+		return client.whoisChannels
+	}
+	return client.server.whoisChannels
+}
+
+// setAccountWhoisChannels saves the account's WHOIS channel privacy setting, with "" meaning
+// the server default.
+func (server *Server) setAccountWhoisChannels(account *ClientAccount, setting string) error {
+	accountKey, _ := CasefoldName(account.Name)
+	err := server.store.Update(func(tx *buntdb.Tx) error {
+		var err error
+		if setting == "" {
+			_, err = tx.Delete(fmt.Sprintf(keyAccountWhoisChannels, accountKey))
+			if err == buntdb.ErrNotFound {
+				err = nil
+			}
+		} else {
+			_, _, err = tx.Set(fmt.Sprintf(keyAccountWhoisChannels, accountKey), setting, nil)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	account.WhoisChannels = setting
+	return nil
+}
+
+// WHOISCHANNELS [ALL|SHARED|NONE|DEFAULT]
+func whoischannelsHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	if len(msg.Params) < 1 {
+		rb.Notice(fmt.Sprintf("Your channels are shown in WHOIS using the %s setting", strings.ToUpper(client.whoisChannelsPrivacy())))
+		return false
+	}
+
+	setting := strings.ToLower(msg.Params[0])
+	switch setting {
+	case WhoisChannelsAll, WhoisChannelsShared, WhoisChannelsNone:
+	case "default":
+		setting = ""
+	default:
+		rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "WHOISCHANNELS", msg.Params[0], "Setting must be ALL, SHARED, NONE or DEFAULT")
+		return false
+	}
+
+	// logged-in users have the setting saved to their account
+	if client.account != &NoAccount {
+		if !server.checkWritable(client, "WHOISCHANNELS", rb) {
+			return false
+		}
+		err := server.setAccountWhoisChannels(client.account, setting)
+		if err != nil {
+			rb.Send(nil, server.name, ERR_UNKNOWNERROR, client.nick, "WHOISCHANNELS", "Could not save setting")
+			return false
+		}
+	}
+	client.whoisChannels = setting
+
+	switch client.whoisChannelsPrivacy() {
+	case WhoisChannelsAll:
+		rb.Notice("WHOIS will now show all of your channels, apart from secret ones")
+	case WhoisChannelsShared:
+		rb.Notice("WHOIS will now only show the channels you share with whoever's asking")
+	case WhoisChannelsNone:
+		rb.Notice("WHOIS will no longer show your channels")
+	}
+	return false
+}
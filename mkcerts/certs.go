@@ -19,11 +19,24 @@ import (
 
 // CreateCertBytes creates a testing ECDSA certificate, returning the cert and key bytes.
 func CreateCertBytes(orgName string, host string) (certBytes []byte, keyBytes []byte, err error) {
+	var hosts []string
+	if host != "" {
+		hosts = append(hosts, host)
+	}
+	return CreateCertBytesForHosts(orgName, hosts)
+}
+
+// CreateCertBytesForHosts creates a testing ECDSA certificate that's valid for the given
+// hostnames and IP addresses, as well as localhost, returning the cert and key bytes.
+func CreateCertBytesForHosts(orgName string, hosts []string) (certBytes []byte, keyBytes []byte, err error) {
 	validFrom := time.Now()
 	validFor := 365 * 24 * time.Hour
 	notAfter := validFrom.Add(validFor)
 
 	priv, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %s", err)
+	}
 
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
@@ -44,13 +57,21 @@ func CreateCertBytes(orgName string, host string) (certBytes []byte, keyBytes []
 		BasicConstraintsValid: true,
 	}
 
-	// TODO: allow explicitly listing allowed addresses/names
-	template.IPAddresses = append(template.IPAddresses, net.ParseIP("127.0.0.1"))
-	template.IPAddresses = append(template.IPAddresses, net.ParseIP("::1"))
-	if host != "" {
-		template.DNSNames = append(template.DNSNames, host)
+	if 0 < len(hosts) {
+		template.Subject.CommonName = hosts[0]
+	}
+	seen := make(map[string]bool)
+	for _, host := range append(hosts, "localhost", "127.0.0.1", "::1") {
+		if host == "" || seen[host] {
+			continue
+		}
+		seen[host] = true
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
 	}
-	template.DNSNames = append(template.DNSNames, "localhost")
 
 	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
 	if err != nil {
@@ -70,8 +91,17 @@ func CreateCertBytes(orgName string, host string) (certBytes []byte, keyBytes []
 
 // CreateCert creates a testing ECDSA certificate, outputting the cert and key at the given filenames.
 func CreateCert(orgName string, host string, certFilename string, keyFilename string) error {
-	certBytes, keyBytes, err := CreateCertBytes(orgName, host)
+	var hosts []string
+	if host != "" {
+		hosts = append(hosts, host)
+	}
+	return CreateCertForHosts(orgName, hosts, certFilename, keyFilename)
+}
 
+// CreateCertForHosts creates a testing ECDSA certificate that's valid for the given hostnames
+// and IP addresses, outputting the cert and key at the given filenames.
+func CreateCertForHosts(orgName string, hosts []string, certFilename string, keyFilename string) error {
+	certBytes, keyBytes, err := CreateCertBytesForHosts(orgName, hosts)
 	if err != nil {
 		return err
 	}
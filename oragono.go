@@ -6,10 +6,20 @@
 package main
 
 import (
+	"bufio"
+	cryptorand "crypto/rand"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
+	"os"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -25,15 +35,36 @@ func main() {
 	version := irc.SemVer
 	usage := `oragono.
 Usage:
+	oragono setup [--conf <filename>] [--example <filename>] [--network <name>] [--server-name <name>] [--listen <addrs>] [--tls-listen <addrs>] [--oper <name>] [--yes]
 	oragono initdb [--conf <filename>] [--quiet]
 	oragono upgradedb [--conf <filename>] [--quiet]
+	oragono checkdb [--conf <filename>] [--repair] [--quiet]
+	oragono restoredb [--conf <filename>] [--snapshot <name>] [--quiet]
+	oragono provision --csv <filename> [--conf <filename>] [--quiet]
+	oragono importdb --file <filename> --format <name> [--conf <filename>] [--quiet]
 	oragono genpasswd [--conf <filename>] [--quiet]
-	oragono mkcerts [--conf <filename>] [--quiet]
+	oragono mkcerts [--conf <filename>] [--force] [--quiet]
+	oragono admin connect [--conf <filename>]
+	oragono admin [--conf <filename>] [--json] <command> [<params>...]
 	oragono run [--conf <filename>] [--quiet]
 	oragono -h | --help
 	oragono --version
 Options:
 	--conf <filename>  Configuration file to use [default: ircd.yaml].
+	--snapshot <name>  Snapshot to restore, defaulting to the latest one.
+	--csv <filename>   Accounts to create, with lines like account[,password].
+	--file <filename>  Services database to import.
+	--format <name>    Format of the services database, atheme or anope.
+	--example <filename>  Example config that setup starts from [default: oragono.yaml].
+	--network <name>      Network name for setup.
+	--server-name <name>  Server name for setup.
+	--listen <addrs>      Plaintext addresses for setup to listen on [default: :6667].
+	--tls-listen <addrs>  TLS addresses for setup to listen on [default: :6697].
+	--oper <name>         Name of the first oper that setup makes [default: admin].
+	--yes              Don't ask setup's questions, use the flags and defaults instead.
+	--json             Print the server's full JSON response.
+	--force            Overwrite certificates that already exist.
+	--repair           Fix the problems checkdb finds, the server must be stopped first.
 	--quiet            Don't show startup/shutdown lines.
 	-h --help          Show this screen.
 	--version          Show version.`
@@ -41,28 +72,27 @@ Options:
 	arguments, _ := docopt.Parse(usage, nil, true, version, false)
 
 	configfile := arguments["--conf"].(string)
+
+	// setup makes the config, so it can't load it first
+	if arguments["setup"].(bool) {
+		runSetup(arguments)
+		return
+	}
+
 	config, err := irc.LoadConfig(configfile)
 	if err != nil {
 		log.Fatal("Config file did not load successfully:", err.Error())
 	}
 
-	// assemble separate log configs
-	var logConfigs []logger.Config
-	for _, lConfig := range config.Logging {
-		logConfigs = append(logConfigs, logger.Config{
-			MethodStdout:  lConfig.MethodStdout,
-			MethodStderr:  lConfig.MethodStderr,
-			MethodFile:    lConfig.MethodFile,
-			Filename:      lConfig.Filename,
-			Level:         lConfig.Level,
-			Types:         lConfig.Types,
-			ExcludedTypes: lConfig.ExcludedTypes,
-		})
+	logger, err := newLogger(config)
+	if err != nil {
+		log.Fatal("Logger did not load successfully:", err.Error())
 	}
 
-	logger, err := logger.NewManager(logConfigs...)
+	// other networks run in this process
+	networks, err := irc.LoadNetworks(config)
 	if err != nil {
-		log.Fatal("Logger did not load successfully:", err.Error())
+		log.Fatal("Network config did not load successfully:", err.Error())
 	}
 
 	if arguments["genpasswd"].(bool) {
@@ -83,23 +113,179 @@ Options:
 		if !arguments["--quiet"].(bool) {
 			log.Println("database initialized: ", config.Datastore.Path)
 		}
+		for name, netConfig := range networks {
+			irc.InitDB(netConfig.Datastore.Path)
+			if !arguments["--quiet"].(bool) {
+				log.Printf("database initialized for network %s: %s\n", name, netConfig.Datastore.Path)
+			}
+		}
 	} else if arguments["upgradedb"].(bool) {
 		irc.UpgradeDB(config.Datastore.Path)
 		if !arguments["--quiet"].(bool) {
 			log.Println("database upgraded: ", config.Datastore.Path)
 		}
+		for name, netConfig := range networks {
+			irc.UpgradeDB(netConfig.Datastore.Path)
+			if !arguments["--quiet"].(bool) {
+				log.Printf("database upgraded for network %s: %s\n", name, netConfig.Datastore.Path)
+			}
+		}
+	} else if arguments["checkdb"].(bool) {
+		repair := arguments["--repair"].(bool)
+		paths := map[string]string{"": config.Datastore.Path}
+		for name, netConfig := range networks {
+			paths[name] = netConfig.Datastore.Path
+		}
+		var unrepaired bool
+		for name, path := range paths {
+			result, err := irc.CheckDB(path, repair)
+			if err != nil {
+				log.Fatal("Could not check datastore: ", err.Error())
+			}
+			for _, problem := range result.Problems {
+				fmt.Println(problem)
+			}
+			if !repair && 0 < len(result.Problems) {
+				unrepaired = true
+			}
+			if !arguments["--quiet"].(bool) {
+				action := "found"
+				if repair {
+					action = "repaired"
+				}
+				if name == "" {
+					log.Printf("%s %d problems in %s\n", action, len(result.Problems), path)
+				} else {
+					log.Printf("%s %d problems for network %s in %s\n", action, len(result.Problems), name, path)
+				}
+			}
+		}
+		if unrepaired {
+			os.Exit(1)
+		}
+	} else if arguments["restoredb"].(bool) {
+		snapshot, _ := arguments["--snapshot"].(string)
+		snapshot, err = irc.RestoreDB(config, snapshot)
+		if err != nil {
+			log.Fatal("Could not restore datastore: ", err.Error())
+		}
+		if !arguments["--quiet"].(bool) {
+			log.Printf("database restored from snapshot %s: %s\n", snapshot, config.Datastore.Path)
+		}
+	} else if arguments["provision"].(bool) {
+		file, err := os.Open(arguments["--csv"].(string))
+		if err != nil {
+			log.Fatal("Could not open accounts file: ", err.Error())
+		}
+		records, err := irc.ParseProvisionCSV(file)
+		file.Close()
+		if err != nil {
+			log.Fatal("Could not read accounts file: ", err.Error())
+		}
+
+		results, err := irc.ProvisionDB(config.Datastore.Path, records)
+		if err != nil {
+			log.Fatal("Could not provision accounts: ", err.Error())
+		}
+
+		// print the generated passwords so they can be given to users
+		out := csv.NewWriter(os.Stdout)
+		out.Write([]string{"account", "password", "error"})
+		var created int
+		for _, result := range results {
+			out.Write([]string{result.Account, result.Password, result.Error})
+			if result.Error == "" {
+				created++
+			}
+		}
+		out.Flush()
+		if !arguments["--quiet"].(bool) {
+			log.Printf("created %d of %d accounts in %s\n", created, len(results), config.Datastore.Path)
+		}
+	} else if arguments["importdb"].(bool) {
+		file, err := os.Open(arguments["--file"].(string))
+		if err != nil {
+			log.Fatal("Could not open services database: ", err.Error())
+		}
+		db, err := irc.ParseServicesDB(file, arguments["--format"].(string))
+		file.Close()
+		if err != nil {
+			log.Fatal("Could not read services database: ", err.Error())
+		}
+
+		result, err := irc.ImportDB(config.Datastore.Path, db)
+		if err != nil {
+			log.Fatal("Could not import services database: ", err.Error())
+		}
+
+		for _, skipped := range result.Skipped {
+			fmt.Println("skipped", skipped)
+		}
+		for _, account := range result.NoPassword {
+			fmt.Println("no usable password:", account)
+		}
+		if !arguments["--quiet"].(bool) {
+			log.Printf("imported %d of %d accounts, %d grouped nicks, %d vhosts and %d of %d channels into %s\n", result.Accounts, len(db.Accounts), result.Nicks, result.Vhosts, result.Channels, len(db.Channels), config.Datastore.Path)
+			if 0 < len(result.NoPassword) {
+				log.Printf("%d accounts have passwords we can't check, their users need to use NS SENDPASS or a certificate to log in\n", len(result.NoPassword))
+			}
+		}
+	} else if arguments["admin"].(bool) {
+		if !config.Server.ControlSocket.Enabled {
+			log.Fatal("The control socket is not enabled in the config file")
+		}
+		conn, err := irc.DialControl(config.Server.ControlSocket.Path)
+		if err != nil {
+			log.Fatal("Could not connect to the control socket: ", err.Error())
+		}
+		defer conn.Close()
+
+		if arguments["connect"].(bool) {
+			adminShell(conn)
+		} else {
+			params, _ := arguments["<params>"].([]string)
+			ok := runAdminCommand(conn, arguments["<command>"].(string), params, arguments["--json"].(bool))
+			if !ok {
+				conn.Close()
+				os.Exit(1)
+			}
+		}
 	} else if arguments["mkcerts"].(bool) {
 		if !arguments["--quiet"].(bool) {
 			log.Println("making self-signed certificates")
 		}
 
-		for name, conf := range config.Server.TLSListeners {
-			log.Printf(" making cert for %s listener\n", name)
-			host := config.Server.Name
-			err := mkcerts.CreateCert("Oragono", host, conf.Cert, conf.Key)
+		// listeners can share a cert, so collect the names each one needs to be valid for
+		var certFiles []string
+		keyFiles := make(map[string]string)
+		certHosts := make(map[string][]string)
+		for addr, conf := range config.Server.TLSListeners {
+			if _, exists := keyFiles[conf.Cert]; !exists {
+				certFiles = append(certFiles, conf.Cert)
+				keyFiles[conf.Cert] = conf.Key
+				certHosts[conf.Cert] = []string{config.Server.Name}
+			}
+			host, _, err := net.SplitHostPort(addr)
+			if err == nil && host != "" && !net.ParseIP(host).IsUnspecified() {
+				certHosts[conf.Cert] = append(certHosts[conf.Cert], host)
+			}
+		}
+		sort.Strings(certFiles)
+
+		for _, certFile := range certFiles {
+			keyFile := keyFiles[certFile]
+			if !arguments["--force"].(bool) {
+				if _, err := os.Stat(certFile); err == nil {
+					log.Printf(" %s already exists, skipping it (use --force to replace it)\n", certFile)
+					continue
+				}
+			}
+			hosts := certHosts[certFile]
+			log.Printf(" making cert for %s\n", strings.Join(hosts, ", "))
+			err := mkcerts.CreateCertForHosts(config.Network.Name, hosts, certFile, keyFile)
 			if err == nil {
 				if !arguments["--quiet"].(bool) {
-					log.Printf("  Certificate created at %s : %s\n", conf.Cert, conf.Key)
+					log.Printf("  Certificate created at %s : %s\n", certFile, keyFile)
 				}
 			} else {
 				log.Fatal("  Could not create certificate:", err.Error())
@@ -135,10 +321,268 @@ Options:
 			logger.Error("startup", fmt.Sprintf("Could not load server: %s", err.Error()))
 			return
 		}
+
+		// start up the other networks, each with its own logging
+		var networksRunning sync.WaitGroup
+		for name, netConfig := range networks {
+			netLogger, err := newLogger(netConfig)
+			if err != nil {
+				logger.Error("startup", fmt.Sprintf("Could not load logger for network %s: %s", name, err.Error()))
+				return
+			}
+			netServer, err := irc.NewServer(config.Networks[name].Config, netConfig, netLogger)
+			if err != nil {
+				logger.Error("startup", fmt.Sprintf("Could not load network %s: %s", name, err.Error()))
+				return
+			}
+			err = server.AddNetwork(name, netServer, config.Networks[name])
+			if err != nil {
+				logger.Error("startup", err.Error())
+				return
+			}
+			networksRunning.Add(1)
+			go func() {
+				defer networksRunning.Done()
+				netServer.Run()
+			}()
+			logger.Info("startup", fmt.Sprintf("Network %s running", name))
+		}
+
 		if !arguments["--quiet"].(bool) {
 			logger.Info("startup", "Server running")
 			defer logger.Info("shutdown", fmt.Sprintf("Oragono v%s exiting", irc.SemVer))
 		}
 		server.Run()
+		// every network gets the exit signal, so let them finish shutting down
+		networksRunning.Wait()
+	}
+}
+
+// adminShell runs the admin commands typed on stdin, until the admin quits.
+func adminShell(conn *irc.ControlConn) {
+	fmt.Println("Connected to the control socket, type help for a list of commands or quit to exit")
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("oragono> ")
+		if !scanner.Scan() {
+			fmt.Println()
+			return
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if command := strings.ToLower(fields[0]); command == "quit" || command == "exit" {
+			return
+		}
+		runAdminCommand(conn, fields[0], fields[1:], false)
+	}
+}
+
+// runAdminCommand runs a command over the control socket and prints the result, returning
+// true if it succeeded.
+func runAdminCommand(conn *irc.ControlConn, command string, params []string, printJSON bool) bool {
+	response, err := conn.Run(command, params)
+	if err != nil {
+		log.Fatal("Lost connection to the control socket: ", err.Error())
+	}
+	if printJSON {
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		out.Encode(response)
+		return response.Error == ""
+	}
+	for _, line := range response.Lines {
+		fmt.Println(line)
+	}
+	if response.Error != "" {
+		fmt.Fprintln(os.Stderr, "Error:", response.Error)
+		return false
+	}
+	return true
+}
+
+// setupPrompter asks the admin questions on the terminal, or takes the defaults if they
+// don't want to be asked.
+type setupPrompter struct {
+	reader      *bufio.Reader
+	useDefaults bool
+}
+
+// ask asks a question, returning the answer or the default if it's left blank.
+func (prompter *setupPrompter) ask(question, defaultAnswer string) string {
+	if prompter.useDefaults {
+		return defaultAnswer
+	}
+	fmt.Printf("%s [%s]: ", question, defaultAnswer)
+	answer, err := prompter.reader.ReadString('\n')
+	if err != nil {
+		log.Fatal("Could not read answer: ", err.Error())
+	}
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return defaultAnswer
+	}
+	if answer == "-" {
+		return ""
+	}
+	return answer
+}
+
+// confirm asks a yes or no question.
+func (prompter *setupPrompter) confirm(question string, defaultAnswer bool) bool {
+	answer := "n"
+	if defaultAnswer {
+		answer = "y"
+	}
+	return strings.HasPrefix(strings.ToLower(prompter.ask(question+" (y/n)", answer)), "y")
+}
+
+// splitAddrs splits a comma-separated list of addresses.
+func splitAddrs(addrs string) []string {
+	var split []string
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			split = append(split, addr)
+		}
+	}
+	return split
+}
+
+// runSetup asks the admin about their network and writes a config for it, along with a
+// certificate, the first oper and the datastore.
+func runSetup(arguments map[string]interface{}) {
+	configfile := arguments["--conf"].(string)
+	prompter := setupPrompter{
+		reader:      bufio.NewReader(os.Stdin),
+		useDefaults: arguments["--yes"].(bool),
+	}
+	if !prompter.useDefaults {
+		fmt.Println("This makes a config for a new network. Press enter to use the default in brackets, or type - to leave something blank.")
+	}
+
+	if _, err := os.Stat(configfile); err == nil {
+		if prompter.useDefaults || !prompter.confirm(fmt.Sprintf("%s already exists, overwrite it?", configfile), false) {
+			log.Fatal("Not overwriting ", configfile)
+		}
+	}
+	example, err := ioutil.ReadFile(arguments["--example"].(string))
+	if err != nil {
+		log.Fatal("Could not read the example config: ", err.Error())
+	}
+
+	var setup irc.SetupConfig
+	networkName, _ := arguments["--network"].(string)
+	if networkName == "" {
+		networkName = "MyNetwork"
+	}
+	setup.NetworkName = prompter.ask("Network name", networkName)
+	serverName, _ := arguments["--server-name"].(string)
+	if serverName == "" {
+		serverName = "irc.example.com"
+	}
+	setup.ServerName = prompter.ask("Server name (the hostname clients connect to)", serverName)
+	setup.Listen = splitAddrs(prompter.ask("Plaintext addresses to listen on, separated by commas", arguments["--listen"].(string)))
+	setup.TLSListen = splitAddrs(prompter.ask("TLS addresses to listen on, separated by commas", arguments["--tls-listen"].(string)))
+
+	if 0 < len(setup.TLSListen) {
+		setup.TLSCert = prompter.ask("TLS certificate file", "tls.crt")
+		setup.TLSKey = prompter.ask("TLS key file", "tls.key")
+		_, certErr := os.Stat(setup.TLSCert)
+		_, keyErr := os.Stat(setup.TLSKey)
+		if certErr != nil || keyErr != nil {
+			if prompter.confirm("The certificate doesn't exist yet, make a self-signed one?", true) {
+				err = mkcerts.CreateCert(setup.NetworkName, setup.ServerName, setup.TLSCert, setup.TLSKey)
+				if err != nil {
+					log.Fatal("Could not create certificate: ", err.Error())
+				}
+				fmt.Printf("Made a self-signed certificate at %s : %s\n", setup.TLSCert, setup.TLSKey)
+			}
+			fmt.Println("Clients won't trust a self-signed certificate. Get one from a certificate authority like Let's Encrypt and put it in place of this one when you can.")
+		}
+	}
+
+	operName, _ := arguments["--oper"].(string)
+	setup.OperName = prompter.ask("Name of the first oper", operName)
+	var operPassword string
+	if setup.OperName != "" {
+		if prompter.useDefaults {
+			passwordBytes := make([]byte, 12)
+			cryptorand.Read(passwordBytes)
+			operPassword = base64.RawURLEncoding.EncodeToString(passwordBytes)
+		} else {
+			for operPassword == "" {
+				fmt.Print("Oper password: ")
+				first, err := terminal.ReadPassword(int(syscall.Stdin))
+				fmt.Print("\nAgain: ")
+				second, err2 := terminal.ReadPassword(int(syscall.Stdin))
+				fmt.Println()
+				if err != nil || err2 != nil {
+					log.Fatal("Could not read password")
+				}
+				if len(first) == 0 || string(first) != string(second) {
+					fmt.Println("The passwords were blank or didn't match, try again")
+					continue
+				}
+				operPassword = string(first)
+			}
+		}
+		setup.OperPassword, err = irc.GenerateEncodedPassword(operPassword)
+		if err != nil {
+			log.Fatal("Could not encode oper password: ", err.Error())
+		}
+	}
+
+	generated, err := irc.GenerateConfig(example, setup)
+	if err != nil {
+		log.Fatal("Could not make config: ", err.Error())
+	}
+	// check that the server will take the config before replacing anything
+	newConfigfile := configfile + ".new"
+	err = ioutil.WriteFile(newConfigfile, generated, 0600)
+	if err != nil {
+		log.Fatal("Could not write config: ", err.Error())
+	}
+	config, err := irc.LoadConfig(newConfigfile)
+	if err != nil {
+		os.Remove(newConfigfile)
+		log.Fatal("The new config doesn't work: ", err.Error())
+	}
+	err = os.Rename(newConfigfile, configfile)
+	if err != nil {
+		log.Fatal("Could not write config: ", err.Error())
+	}
+	fmt.Printf("Wrote config to %s\n", configfile)
+
+	if _, err := os.Stat(config.Datastore.Path); err != nil || prompter.confirm(fmt.Sprintf("The datastore %s already exists, wipe it and start again?", config.Datastore.Path), false) {
+		irc.InitDB(config.Datastore.Path)
+		fmt.Printf("Made the datastore at %s\n", config.Datastore.Path)
+	}
+
+	if setup.OperName != "" {
+		if prompter.useDefaults {
+			fmt.Printf("Log in as an oper with: /OPER %s %s\n", setup.OperName, operPassword)
+		} else {
+			fmt.Printf("Log in as an oper with: /OPER %s <password>\n", setup.OperName)
+		}
+	}
+	fmt.Printf("All done, start the server with: oragono run --conf %s\n", configfile)
+}
+
+// newLogger returns a logger using the logging config in the given config.
+func newLogger(config *irc.Config) (*logger.Manager, error) {
+	// assemble separate log configs
+	var logConfigs []logger.Config
+	for _, lConfig := range config.Logging {
+		logConfigs = append(logConfigs, logger.Config{
+			MethodStdout:  lConfig.MethodStdout,
+			MethodStderr:  lConfig.MethodStderr,
+			MethodFile:    lConfig.MethodFile,
+			Filename:      lConfig.Filename,
+			Level:         lConfig.Level,
+			Types:         lConfig.Types,
+			ExcludedTypes: lConfig.ExcludedTypes,
+		})
 	}
+	return logger.NewManager(logConfigs...)
 }